@@ -0,0 +1,60 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newAdoptCommand() *cobra.Command {
+	var dryRun bool
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "adopt",
+		Short: "Experimental: converts a cluster's control plane Machines into a KubeadmControlPlane on a Cluster API v1alpha3 management cluster.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return adoptControlPlane(config, dryRun)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	cmd.Flags().BoolVar(
+		&dryRun,
+		"dry-run",
+		false,
+		"Print the KubeadmControlPlane and infrastructure machine template without creating them or changing any Machines (optional)",
+	)
+
+	return cmd
+}
+
+func adoptControlPlane(config upgrade.Config, dryRun bool) error {
+	log := newLogger()
+	if dryRun {
+		// Keep stdout for the generated objects so they can be piped
+		log = newLoggerTo(os.Stderr)
+	}
+
+	adopter, err := upgrade.NewAdopter(log, config)
+	if err != nil {
+		return err
+	}
+
+	plan, err := adopter.Plan()
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		return plan.Print(os.Stdout)
+	}
+
+	return adopter.Adopt(plan)
+}
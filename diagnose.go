@@ -0,0 +1,128 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newDiagnoseCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diagnose",
+		Short: "Diagnoses problems with Kubernetes clusters created by Cluster API.",
+	}
+
+	cmd.AddCommand(allowReadOnly(newDiagnoseDriftCommand()))
+	cmd.AddCommand(allowReadOnly(newDiagnoseEtcdCommand()))
+
+	return cmd
+}
+
+func newDiagnoseDriftCommand() *cobra.Command {
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "drift",
+		Short: "Reports control plane Machines that are inconsistent with their infrastructure, bootstrap, or Node objects.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return diagnoseDrift(config)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	return cmd
+}
+
+func diagnoseDrift(config upgrade.Config) error {
+	detector, err := upgrade.NewDriftDetector(newLogger(), config)
+	if err != nil {
+		return err
+	}
+
+	report, err := detector.Detect()
+	if err != nil {
+		return err
+	}
+
+	report.Print(os.Stdout)
+
+	if !report.Clean() {
+		return errors.New("drift detected")
+	}
+
+	return nil
+}
+
+func newDiagnoseEtcdCommand() *cobra.Command {
+	var output string
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "etcd",
+		Short: "Reports the members, endpoint status, alarms and health of the etcd cluster of a cluster.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return diagnoseEtcd(config, output)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	cmd.Flags().StringVar(
+		&config.EtcdCredentialsSecret,
+		"etcd-credentials-secret",
+		"",
+		"Secret in the cluster namespace with the username and password etcdctl authenticates with, for clusters with etcd auth enabled (optional)",
+	)
+
+	cmd.Flags().StringVarP(
+		&output,
+		"output",
+		"o",
+		textOutput,
+		"Output format - [text | json] (optional)",
+	)
+
+	return cmd
+}
+
+func diagnoseEtcd(config upgrade.Config, output string) error {
+	if output != textOutput && output != jsonOutput {
+		return errors.Errorf("invalid output format %q, must be one of %v", output, []string{textOutput, jsonOutput})
+	}
+
+	// Keep stdout for the report so json output can be piped
+	diagnoser, err := upgrade.NewEtcdDiagnoser(newLoggerTo(os.Stderr), config)
+	if err != nil {
+		return err
+	}
+
+	report, err := diagnoser.Diagnose()
+	if err != nil {
+		return err
+	}
+
+	if output == jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	if !report.Healthy() {
+		return errors.New("etcd is unhealthy")
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newDiscoverCommand() *cobra.Command {
+	var output string
+	config := upgrade.DiscoveryConfig{}
+
+	cmd := &cobra.Command{
+		Use:   "discover",
+		Short: "Lists Clusters in one or more management clusters with their versions and upgrade eligibility.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return discoverClusters(config, output)
+		},
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().StringVar(
+		&config.Kubeconfig,
+		"kubeconfig",
+		"",
+		"The kubeconfig path for the management clusters",
+	)
+
+	cmd.Flags().StringSliceVar(
+		&config.Contexts,
+		"context",
+		nil,
+		"Kubeconfig contexts of the management clusters, defaulting to the current context (optional)",
+	)
+
+	cmd.Flags().BoolVar(
+		&config.AllContexts,
+		"all-contexts",
+		false,
+		"Discover clusters in every kubeconfig context (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.Namespace,
+		"namespace",
+		"",
+		"Only discover clusters in this namespace, defaulting to all namespaces (optional)",
+	)
+
+	cmd.Flags().StringVarP(
+		&output,
+		"output",
+		"o",
+		tableOutput,
+		"Output format - [table | json] (optional)",
+	)
+
+	return cmd
+}
+
+func discoverClusters(config upgrade.DiscoveryConfig, output string) error {
+	if output != tableOutput && output != jsonOutput {
+		return errors.Errorf("invalid output format %q, must be one of %v", output, []string{tableOutput, jsonOutput})
+	}
+
+	// Keep stdout for the report so json output can be piped
+	report, err := upgrade.Discover(newLoggerTo(os.Stderr), config)
+	if err != nil {
+		return err
+	}
+
+	if output == jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(report))
+	}
+
+	report.Print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newFleetCommand() *cobra.Command {
+	var manifest, stateFile, kubeconfig, output string
+
+	cmd := &cobra.Command{
+		Use:   "fleet",
+		Short: "Upgrades the clusters of a fleet manifest wave by wave.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return upgradeFleet(manifest, stateFile, kubeconfig, output)
+		},
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().StringVar(
+		&manifest,
+		"manifest",
+		"",
+		"Path of the fleet manifest listing the clusters to upgrade in waves (required)",
+	)
+	if err := cmd.MarkFlagRequired("manifest"); err != nil {
+		fmt.Printf("Unable to mark manifest as a required flag: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmd.Flags().StringVar(
+		&stateFile,
+		"state-file",
+		"",
+		"Path of the file recording the fleet upgrade's progress so that it can be resumed, defaulting to <manifest>-state.json (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&kubeconfig,
+		"kubeconfig",
+		"",
+		"The kubeconfig path for the management clusters, overriding the manifest's (optional)",
+	)
+
+	cmd.Flags().StringVarP(
+		&output,
+		"output",
+		"o",
+		tableOutput,
+		"Format of the final report - [table | json]; with json, logs are written to stderr (optional)",
+	)
+
+	return cmd
+}
+
+func upgradeFleet(manifestPath, stateFile, kubeconfig, output string) error {
+	if output != tableOutput && output != jsonOutput {
+		return errors.Errorf("invalid output format %q, must be one of %v", output, []string{tableOutput, jsonOutput})
+	}
+
+	manifest, err := upgrade.LoadFleetManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	if kubeconfig != "" {
+		manifest.Config.ManagementCluster.Kubeconfig = kubeconfig
+	}
+	if stateFile == "" {
+		stateFile = strings.TrimSuffix(manifestPath, filepath.Ext(manifestPath)) + "-state.json"
+	}
+
+	log := newLogger()
+	if output == jsonOutput {
+		// Keep stdout for the report so it can be piped
+		log = newLoggerTo(os.Stderr)
+	}
+	logging.ToggleDebugOnSignal(log)
+
+	fleet, err := upgrade.NewFleetUpgrader(log, manifest, stateFile)
+	if err != nil {
+		return err
+	}
+
+	report := fleet.Upgrade()
+	if err := upgrade.UploadFleetResults(log, manifest.Config.Results, report); err != nil {
+		log.Error(err, "Unable to upload the fleet report")
+	}
+
+	if output == jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	if !report.Succeeded() {
+		return errors.Errorf("fleet upgrade did not upgrade every cluster, rerun to resume from %s", stateFile)
+	}
+	return nil
+}
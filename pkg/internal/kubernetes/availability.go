@@ -0,0 +1,141 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	availabilityRetryInitialInterval = 1 * time.Second
+	availabilityRetryMaxInterval     = 10 * time.Second
+)
+
+// WithAvailabilityRetry wraps the transport of config so that requests failing because the API server is unavailable,
+// for example while the control plane machine behind its endpoint is being replaced, are retried until it is back or
+// patience runs out. onUnavailable is called with the reason each time a request starts waiting. Other errors are
+// returned immediately.
+func WithAvailabilityRetry(config *rest.Config, patience time.Duration, onUnavailable func(reason string)) {
+	previous := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if previous != nil {
+			rt = previous(rt)
+		}
+		return &availabilityRetrier{
+			delegate:      rt,
+			patience:      patience,
+			interval:      availabilityRetryInitialInterval,
+			onUnavailable: onUnavailable,
+		}
+	}
+}
+
+// availabilityRetrier is an http.RoundTripper that retries requests while the API server is unavailable.
+type availabilityRetrier struct {
+	delegate      http.RoundTripper
+	patience      time.Duration
+	interval      time.Duration
+	onUnavailable func(reason string)
+}
+
+func (r *availabilityRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline := time.Now().Add(r.patience)
+	interval := r.interval
+	waiting := false
+
+	attempt := req
+	for {
+		resp, err := r.delegate.RoundTrip(attempt)
+
+		reason := unavailableReason(req, resp, err)
+		if reason == "" || time.Now().After(deadline) {
+			return resp, err
+		}
+
+		next, rewindErr := rewindRequest(req)
+		if rewindErr != nil {
+			return resp, err
+		}
+
+		if !waiting && r.onUnavailable != nil {
+			r.onUnavailable(reason)
+		}
+		waiting = true
+
+		if resp != nil {
+			// Drain the body so the connection can be reused
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, errors.Wrapf(req.Context().Err(), "API server unavailable: %s", reason)
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > availabilityRetryMaxInterval {
+			interval = availabilityRetryMaxInterval
+		}
+		attempt = next
+	}
+}
+
+// unavailableReason returns why the outcome of req shows the API server is unavailable, or "" if it does not. Failures
+// to connect are safe to retry for any request. Connections dropped mid-request and gateway errors from a load
+// balancer in front of the API server are only retried for requests that do not modify anything.
+func unavailableReason(req *http.Request, resp *http.Response, err error) string {
+	if err != nil {
+		if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+			return err.Error()
+		}
+		msg := err.Error()
+		if strings.Contains(msg, "connection refused") || strings.Contains(msg, "no route to host") {
+			return msg
+		}
+		if isReadOnly(req) && (err == io.EOF || err == io.ErrUnexpectedEOF || strings.Contains(msg, "connection reset by peer")) {
+			return msg
+		}
+		return ""
+	}
+
+	if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout {
+		if isReadOnly(req) {
+			return resp.Status
+		}
+	}
+
+	return ""
+}
+
+func isReadOnly(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// rewindRequest returns a copy of req that can be sent again, with a fresh body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	next := req.WithContext(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return next, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed")
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	next.Body = body
+	return next, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedRoundTripper returns the next scripted outcome for each request and records the bodies it received.
+type scriptedRoundTripper struct {
+	outcomes []func() (*http.Response, error)
+	bodies   []string
+}
+
+func (s *scriptedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		b, _ := ioutil.ReadAll(req.Body)
+		s.bodies = append(s.bodies, string(b))
+	}
+	outcome := s.outcomes[0]
+	s.outcomes = s.outcomes[1:]
+	return outcome()
+}
+
+func status(code int) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return &http.Response{StatusCode: code, Status: http.StatusText(code), Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+}
+
+func failure(err error) func() (*http.Response, error) {
+	return func() (*http.Response, error) { return nil, err }
+}
+
+func TestAvailabilityRetrier(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connect: connection refused")}
+
+	tests := []struct {
+		name           string
+		method         string
+		outcomes       []func() (*http.Response, error)
+		expectedStatus int
+		expectErr      bool
+		expectWaits    int
+	}{
+		{
+			name:           "connection refused then ok",
+			method:         http.MethodPost,
+			outcomes:       []func() (*http.Response, error){failure(refused), failure(refused), status(http.StatusCreated)},
+			expectedStatus: http.StatusCreated,
+			expectWaits:    1,
+		},
+		{
+			name:           "service unavailable is retried for reads",
+			method:         http.MethodGet,
+			outcomes:       []func() (*http.Response, error){status(http.StatusServiceUnavailable), status(http.StatusOK)},
+			expectedStatus: http.StatusOK,
+			expectWaits:    1,
+		},
+		{
+			name:           "service unavailable is not retried for writes",
+			method:         http.MethodPost,
+			outcomes:       []func() (*http.Response, error){status(http.StatusServiceUnavailable)},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:      "genuine errors are not retried",
+			method:    http.MethodGet,
+			outcomes:  []func() (*http.Response, error){failure(errors.New("x509: certificate signed by unknown authority"))},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			delegate := &scriptedRoundTripper{outcomes: tc.outcomes}
+			waits := 0
+			r := &availabilityRetrier{
+				delegate:      delegate,
+				patience:      time.Minute,
+				interval:      time.Millisecond,
+				onUnavailable: func(string) { waits++ },
+			}
+
+			req, err := http.NewRequest(tc.method, "https://example.com/api", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := r.RoundTrip(req)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if resp.StatusCode != tc.expectedStatus {
+					t.Errorf("expected status %d, got %d", tc.expectedStatus, resp.StatusCode)
+				}
+			}
+			if waits != tc.expectWaits {
+				t.Errorf("expected %d wait(s), got %d", tc.expectWaits, waits)
+			}
+			if len(delegate.outcomes) != 0 {
+				t.Errorf("expected all outcomes to be used, %d left", len(delegate.outcomes))
+			}
+			for _, body := range delegate.bodies {
+				if body != "body" {
+					t.Errorf("expected every attempt to send the full body, got %q", body)
+				}
+			}
+		})
+	}
+}
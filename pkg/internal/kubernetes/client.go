@@ -4,6 +4,9 @@
 package kubernetes
 
 import (
+	"context"
+	"sort"
+	"time"
 
 	// We need this to enable authentication plugins. DO NOT REMOVE
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -11,6 +14,7 @@ import (
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
@@ -27,21 +31,26 @@ type KubeConfigContext string
 // 1) kubeconfig file,
 // 2) $KUBECONFIG environment variable,
 // 3) $HOME/.kube/config file
-// kubeConfigContext is used if it is supplied.
-func NewClient(kubeConfigPath KubeConfigPath, kubeConfigContext KubeConfigContext) (client.Client, error) {
-	// The default loading rules will take $KUBECONFIG into account, if applicable.
-	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	loadingRules.ExplicitPath = string(kubeConfigPath)
-
-	configOverrides := &clientcmd.ConfigOverrides{
-		CurrentContext: string(kubeConfigContext),
+// kubeConfigContext is used if it is supplied. A positive timeout bounds each request of the client, including the
+// discovery it starts with, and the CheckEndpoint run before it is created.
+func NewClient(kubeConfigPath KubeConfigPath, kubeConfigContext KubeConfigContext, timeout time.Duration) (client.Client, error) {
+	config, err := NewRestConfig(kubeConfigPath, kubeConfigContext)
+	if err != nil {
+		return nil, err
 	}
+	return NewClientForConfig(config, timeout)
+}
 
-	clientcmdClientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
-
-	config, err := clientcmdClientConfig.ClientConfig()
-	if err != nil {
-		return nil, errors.WithStack(err)
+// NewClientForConfig creates a new controller-runtime Client for config, such as one returned by NewRestConfig and
+// then adjusted. timeout is used as by NewClient.
+func NewClientForConfig(config *rest.Config, timeout time.Duration) (client.Client, error) {
+	if timeout > 0 {
+		config.Timeout = timeout
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := CheckEndpoint(ctx, config); err != nil {
+			return nil, err
+		}
 	}
 
 	scheme := runtime.NewScheme()
@@ -62,3 +71,44 @@ func NewClient(kubeConfigPath KubeConfigPath, kubeConfigContext KubeConfigContex
 
 	return c, nil
 }
+
+// NewRestConfig loads a rest config using the same priorities as NewClient. In read-only mode, it refuses requests that
+// could change the cluster, as WithReadOnly does.
+func NewRestConfig(kubeConfigPath KubeConfigPath, kubeConfigContext KubeConfigContext) (*rest.Config, error) {
+	// The default loading rules will take $KUBECONFIG into account, if applicable.
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = string(kubeConfigPath)
+
+	configOverrides := &clientcmd.ConfigOverrides{
+		CurrentContext: string(kubeConfigContext),
+	}
+
+	clientcmdClientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+
+	config, err := clientcmdClientConfig.ClientConfig()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	WithReadOnly(config)
+	return config, nil
+}
+
+// Contexts returns the names of the contexts in the kubeconfig, loaded using the same priorities as NewClient, and the
+// name of the current context.
+func Contexts(kubeConfigPath KubeConfigPath) ([]string, string, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = string(kubeConfigPath)
+
+	config, err := loadingRules.Load()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error loading kubeconfig")
+	}
+
+	var names []string
+	for name := range config.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, config.CurrentContext, nil
+}
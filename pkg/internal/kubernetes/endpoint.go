@@ -0,0 +1,60 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+)
+
+// CheckEndpoint resolves the host of the API server of config and opens a TCP connection to it, so that a wrong or
+// unreachable server fails fast with the step that failed rather than hanging. Servers reached through a proxy from the
+// environment are not checked, as they may not resolve nor be reachable directly.
+func CheckEndpoint(ctx context.Context, config *rest.Config) error {
+	host := config.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return errors.Wrapf(err, "invalid API server address %q", config.Host)
+	}
+	if u.Hostname() == "" {
+		return errors.Errorf("invalid API server address %q: it has no host", config.Host)
+	}
+	if proxy, err := http.ProxyFromEnvironment(&http.Request{URL: u}); err != nil || proxy != nil {
+		return nil
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	if net.ParseIP(u.Hostname()) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+			return errors.Wrapf(err, "cannot resolve the API server host %q", u.Hostname())
+		}
+	}
+
+	address := net.JoinHostPort(u.Hostname(), port)
+	dial := (&net.Dialer{}).DialContext
+	if config.Dial != nil {
+		dial = config.Dial
+	}
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "cannot connect to the API server at %s", address)
+	}
+	conn.Close()
+	return nil
+}
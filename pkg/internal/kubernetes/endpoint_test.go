@@ -0,0 +1,51 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestCheckEndpoint(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	if err := CheckEndpoint(ctx, &rest.Config{Host: "https://" + address}); err != nil {
+		t.Errorf("expected %s to be reachable: %v", address, err)
+	}
+	// Hosts without a scheme, as kubeconfigs allow
+	if err := CheckEndpoint(ctx, &rest.Config{Host: address}); err != nil {
+		t.Errorf("expected %s to be reachable: %v", address, err)
+	}
+
+	listener.Close()
+	err = CheckEndpoint(ctx, &rest.Config{Host: "https://" + address})
+	if err == nil || !strings.Contains(err.Error(), "cannot connect to the API server at "+address) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+
+	// Hosts behind a proxy are not checked
+	if os.Getenv("HTTPS_PROXY") == "" && os.Getenv("https_proxy") == "" {
+		err = CheckEndpoint(ctx, &rest.Config{Host: "https://api.cluster.invalid:6443"})
+		if err == nil || !strings.Contains(err.Error(), `cannot resolve the API server host "api.cluster.invalid"`) {
+			t.Errorf("expected a resolution error, got %v", err)
+		}
+	}
+
+	if err := CheckEndpoint(ctx, &rest.Config{Host: "https://:6443"}); err == nil {
+		t.Error("expected an error for an address without host")
+	}
+}
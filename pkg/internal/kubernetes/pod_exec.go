@@ -6,13 +6,25 @@ package kubernetes
 import (
 	"bytes"
 	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	defaultPodExecAttempts = 3
+	podExecRetryInterval   = 2 * time.Second
 )
 
 type PodExecInput struct {
@@ -22,9 +34,53 @@ type PodExecInput struct {
 	Name             string
 	Container        string
 	Command          []string
+	// Stdin is written to the standard input of the command, if set. It is written again on each attempt.
+	Stdin []byte
+	// MaxAttempts is the number of times the command is run when the connection is reset. Commands that are not
+	// idempotent should set this to 1. Defaults to 3.
+	MaxAttempts int
 }
 
+// PodExec runs a command in a pod and returns its stdout and stderr. The connection to the pod is closed as soon as
+// ctx is done. If the command fails, the returned error includes whatever output was received.
 func PodExec(ctx context.Context, input PodExecInput) (string, string, error) {
+	return retryPodExec(ctx, input, podExecRetryInterval, podExec)
+}
+
+// retryPodExec runs exec with input until it succeeds, fails other than by a connection reset, or input.MaxAttempts
+// attempts were made, waiting interval between attempts.
+func retryPodExec(ctx context.Context, input PodExecInput, interval time.Duration, exec func(context.Context, PodExecInput) (string, string, error)) (string, string, error) {
+	attempts := input.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultPodExecAttempts
+	}
+
+	var (
+		stdout, stderr string
+		err            error
+	)
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		stdout, stderr, err = exec(ctx, input)
+		if err == nil || !isConnectionReset(err) || attempt == attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return stdout, stderr, errors.Wrapf(err, "pod exec timed out after %d attempt(s)", attempt)
+		case <-time.After(interval):
+		}
+	}
+
+	if err != nil {
+		return stdout, stderr, errors.Wrapf(err, "error running command in pod %s/%s (stdout: %q, stderr: %q)", input.Namespace, input.Name, stdout, stderr)
+	}
+
+	return stdout, stderr, nil
+}
+
+func podExec(ctx context.Context, input PodExecInput) (string, string, error) {
 	req := input.KubernetesClient.CoreV1().RESTClient().Post().
 		Resource("pods").
 		Namespace(input.Namespace).
@@ -33,22 +89,32 @@ func PodExec(ctx context.Context, input PodExecInput) (string, string, error) {
 	req.VersionedParams(&v1.PodExecOptions{
 		Container: input.Container,
 		Command:   input.Command,
+		Stdin:     input.Stdin != nil,
 		Stdout:    true,
 		Stderr:    true,
 	}, scheme.ParameterCodec)
 
-	executor, err := remotecommand.NewSPDYExecutor(input.RestConfig, "POST", req.URL())
+	transport, upgrader, err := spdy.RoundTripperFor(input.RestConfig)
+	if err != nil {
+		return "", "", errors.Wrap(err, "error creating round tripper for pod exec")
+	}
+	tracker := &connectionTracker{Upgrader: upgrader}
+
+	executor, err := remotecommand.NewSPDYExecutorForTransports(transport, tracker, "POST", req.URL())
 	if err != nil {
 		return "", "", errors.Wrap(err, "error creating executor for pod exec")
 	}
 
-	var stdout, stderr bytes.Buffer
+	var stdout, stderr syncBuffer
 	streamOptions := remotecommand.StreamOptions{
 		Stdout: &stdout,
 		Stderr: &stderr,
 	}
+	if input.Stdin != nil {
+		streamOptions.Stdin = bytes.NewReader(input.Stdin)
+	}
 
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 
 	go func() {
 		errCh <- executor.Stream(streamOptions)
@@ -57,8 +123,73 @@ func PodExec(ctx context.Context, input PodExecInput) (string, string, error) {
 	select {
 	case err = <-errCh:
 	case <-ctx.Done():
-		return "", "", errors.New("pod exec timed out")
+		// Closing the connection unblocks the stream so the goroutine above doesn't leak.
+		tracker.close()
+		return stdout.String(), stderr.String(), errors.New("pod exec timed out")
 	}
 
 	return stdout.String(), stderr.String(), errors.WithStack(err)
 }
+
+// isConnectionReset returns true if err was caused by the connection to the API server or kubelet being reset.
+func isConnectionReset(err error) bool {
+	if errors.Cause(err) == syscall.ECONNRESET {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// connectionTracker records the streaming connection created for an exec so it can be closed on cancellation.
+type connectionTracker struct {
+	spdy.Upgrader
+
+	lock   sync.Mutex
+	conn   httpstream.Connection
+	closed bool
+}
+
+func (t *connectionTracker) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := t.Upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		conn.Close()
+		return nil, errors.New("pod exec canceled")
+	}
+	t.conn = conn
+
+	return conn, nil
+}
+
+func (t *connectionTracker) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to read while the exec stream is still writing to it.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsConnectionReset(t *testing.T) {
+	testcases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "errno", err: syscall.ECONNRESET, want: true},
+		{name: "wrapped errno", err: errors.Wrap(syscall.ECONNRESET, "error streaming"), want: true},
+		{name: "op error", err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: true},
+		{name: "message", err: errors.New("error reading from error stream: read tcp 10.0.0.1:443: connection reset by peer"), want: true},
+		{name: "command failure", err: errors.New("command terminated with exit code 1")},
+		{name: "refused", err: syscall.ECONNREFUSED},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isConnectionReset(tc.err); got != tc.want {
+				t.Errorf("isConnectionReset(%v) = %t, want %t", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+// scriptedExec returns the errors of errs in turn, counting its attempts.
+type scriptedExec struct {
+	errs     []error
+	attempts int
+}
+
+func (s *scriptedExec) exec(_ context.Context, _ PodExecInput) (string, string, error) {
+	err := s.errs[s.attempts]
+	s.attempts++
+	return "out", "", err
+}
+
+func TestRetryPodExec(t *testing.T) {
+	reset := errors.Wrap(syscall.ECONNRESET, "error streaming")
+	testcases := []struct {
+		name         string
+		maxAttempts  int
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "success", errs: []error{nil}, wantAttempts: 1},
+		{name: "reset then success", errs: []error{reset, reset, nil}, wantAttempts: 3},
+		{name: "reset until the default attempts are made", errs: []error{reset, reset, reset, nil}, wantAttempts: 3, wantErr: true},
+		{name: "other error", errs: []error{errors.New("command terminated with exit code 1"), nil}, wantAttempts: 1, wantErr: true},
+		{name: "single attempt", maxAttempts: 1, errs: []error{reset, nil}, wantAttempts: 1, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &scriptedExec{errs: tc.errs}
+			input := PodExecInput{Namespace: "kube-system", Name: "etcd-cp-0", MaxAttempts: tc.maxAttempts}
+			stdout, _, err := retryPodExec(context.Background(), input, time.Millisecond, s.exec)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("retryPodExec() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "error running command in pod kube-system/etcd-cp-0") {
+				t.Errorf("unexpected error %v", err)
+			}
+			if stdout != "out" {
+				t.Errorf("retryPodExec() stdout = %q, want the output of the last attempt", stdout)
+			}
+			if s.attempts != tc.wantAttempts {
+				t.Errorf("retryPodExec() made %d attempts, want %d", s.attempts, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryPodExecCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scriptedExec{errs: []error{syscall.ECONNRESET, nil}}
+	exec := func(ctx context.Context, input PodExecInput) (string, string, error) {
+		cancel()
+		return s.exec(ctx, input)
+	}
+
+	_, _, err := retryPodExec(ctx, PodExecInput{}, time.Hour, exec)
+	if err == nil || !strings.Contains(err.Error(), "pod exec timed out after 1 attempt(s)") {
+		t.Errorf("expected the retries to stop with the context, got %v", err)
+	}
+	if s.attempts != 1 {
+		t.Errorf("retryPodExec() made %d attempts, want 1", s.attempts)
+	}
+}
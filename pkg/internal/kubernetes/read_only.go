@@ -0,0 +1,93 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// readOnly is set by EnableReadOnly.
+var readOnly int32
+
+// readOnlyReviews are the resources that are created to ask the API server what is allowed, without changing
+// anything, and so are allowed in read-only mode.
+var readOnlyReviews = []string{"/selfsubjectaccessreviews", "/selfsubjectrulesreviews"}
+
+// ErrReadOnly is the cause of the errors of the requests refused in read-only mode.
+var ErrReadOnly = errors.New("refused in read-only mode")
+
+// EnableReadOnly makes the clients and rest configs created from then on by this package, and those wrapped by
+// WithReadOnly, refuse any request that could change a cluster.
+func EnableReadOnly() {
+	atomic.StoreInt32(&readOnly, 1)
+}
+
+// ReadOnly returns true once EnableReadOnly has been called.
+func ReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+// WithReadOnly wraps the transport of config, in read-only mode, so that requests that could change a cluster are
+// refused before they are sent. Reads are allowed, as are access reviews and server-side dry runs, such as those of the
+// dry run preflight. Exec and port-forward are refused, as they run commands or open connections in the cluster.
+func WithReadOnly(config *rest.Config) {
+	if !ReadOnly() {
+		return
+	}
+	previous := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if previous != nil {
+			rt = previous(rt)
+		}
+		return &readOnlyGuard{delegate: rt}
+	}
+}
+
+// readOnlyGuard is an http.RoundTripper that refuses requests that could change a cluster.
+type readOnlyGuard struct {
+	delegate http.RoundTripper
+}
+
+func (g *readOnlyGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !readOnlyRequest(req) {
+		return nil, errors.Wrapf(ErrReadOnly, "%s %s", req.Method, req.URL.Path)
+	}
+	return g.delegate.RoundTrip(req)
+}
+
+// readOnlyRequest returns true if req cannot change a cluster.
+func readOnlyRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		// Exec, attach and port-forward may be upgraded from a GET
+		return !strings.HasSuffix(req.URL.Path, "/exec") &&
+			!strings.HasSuffix(req.URL.Path, "/attach") &&
+			!strings.HasSuffix(req.URL.Path, "/portforward")
+	case http.MethodPost:
+		for _, review := range readOnlyReviews {
+			if strings.HasSuffix(req.URL.Path, review) {
+				return true
+			}
+		}
+		return dryRunRequest(req)
+	case http.MethodPut, http.MethodPatch:
+		return dryRunRequest(req)
+	}
+	return false
+}
+
+// dryRunRequest returns true if req is a server-side dry run, which runs admission without persisting anything.
+func dryRunRequest(req *http.Request) bool {
+	if strings.HasSuffix(req.URL.Path, "/exec") || strings.HasSuffix(req.URL.Path, "/attach") ||
+		strings.HasSuffix(req.URL.Path, "/portforward") {
+		return false
+	}
+	return req.URL.Query().Get("dryRun") == metav1.DryRunAll
+}
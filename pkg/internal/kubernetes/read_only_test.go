@@ -0,0 +1,131 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestReadOnlyGuard(t *testing.T) {
+	tests := []struct {
+		method  string
+		path    string
+		allowed bool
+	}{
+		{method: http.MethodGet, path: "/api/v1/namespaces/kube-system/pods", allowed: true},
+		{method: http.MethodHead, path: "/healthz/etcd", allowed: true},
+		{method: http.MethodPost, path: "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", allowed: true},
+		{method: http.MethodPost, path: "/apis/authorization.k8s.io/v1/selfsubjectrulesreviews", allowed: true},
+		{method: http.MethodPost, path: "/api/v1/namespaces/default/pods"},
+		{method: http.MethodPost, path: "/apis/cluster.x-k8s.io/v1alpha2/namespaces/default/machines?dryRun=All", allowed: true},
+		{method: http.MethodPut, path: "/api/v1/namespaces/kube-system/configmaps/kubeadm-config?dryRun=All", allowed: true},
+		{method: http.MethodDelete, path: "/apis/cluster.x-k8s.io/v1alpha2/namespaces/default/machines/m?dryRun=All"},
+		{method: http.MethodPost, path: "/api/v1/namespaces/kube-system/pods/etcd/exec?dryRun=All"},
+		{method: http.MethodPut, path: "/api/v1/namespaces/kube-system/configmaps/kubeadm-config"},
+		{method: http.MethodPatch, path: "/apis/cluster.x-k8s.io/v1alpha2/namespaces/default/machines/m"},
+		{method: http.MethodDelete, path: "/apis/cluster.x-k8s.io/v1alpha2/namespaces/default/machines/m"},
+		{method: http.MethodPost, path: "/api/v1/namespaces/kube-system/pods/etcd/exec"},
+		{method: http.MethodGet, path: "/api/v1/namespaces/kube-system/pods/etcd/exec"},
+		{method: http.MethodPost, path: "/api/v1/namespaces/default/pods/relay/portforward"},
+	}
+
+	for _, tt := range tests {
+		delegate := &scriptedRoundTripper{outcomes: []func() (*http.Response, error){status(http.StatusOK)}}
+		guard := &readOnlyGuard{delegate: delegate}
+
+		req := httptest.NewRequest(tt.method, "https://api.example.com"+tt.path, nil)
+		_, err := guard.RoundTrip(req)
+		sent := len(delegate.outcomes) == 0
+		if tt.allowed && (err != nil || !sent) {
+			t.Errorf("expected %s %s to be sent, got error %v", tt.method, tt.path, err)
+		}
+		if !tt.allowed && (errors.Cause(err) != ErrReadOnly || sent) {
+			t.Errorf("expected %s %s to be refused, got error %v", tt.method, tt.path, err)
+		}
+	}
+}
+
+// TestReadOnlyDryRuns sends the server-side dry runs of the dry run preflight through read-only clients, as
+// --read-only with --dry-run-preflight does.
+func TestReadOnlyDryRuns(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		sent = append(sent, r.Method+" "+r.URL.RequestURI())
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"namespace":"kube-system","name":"cm"}}`))
+	}))
+	defer server.Close()
+
+	EnableReadOnly()
+	defer atomic.StoreInt32(&readOnly, 0)
+	config := &rest.Config{Host: server.URL}
+	WithReadOnly(config)
+
+	scheme := runtime.NewScheme()
+	if err := v1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	c, err := client.New(config, client.Options{Scheme: scheme, Mapper: mapper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cm"}}
+	patched := cm.DeepCopy()
+	patched.Annotations = map[string]string{"upgrade-id": "123"}
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("kube-system")
+	obj.SetName("cm")
+	coreClient := clientset.CoreV1().RESTClient()
+
+	dryRuns := map[string]error{
+		"create":              c.Create(context.TODO(), cm.DeepCopy(), client.DryRunAll),
+		"patch":               c.Patch(context.TODO(), patched, client.MergeFrom(cm), client.DryRunAll),
+		"create unstructured": c.Create(context.TODO(), obj, client.DryRunAll),
+		"post": coreClient.Post().Namespace("kube-system").Resource("configmaps").
+			Param("dryRun", metav1.DryRunAll).Body(cm).Do().Error(),
+		"put": coreClient.Put().Namespace("kube-system").Resource("configmaps").Name("cm").
+			Param("dryRun", metav1.DryRunAll).Body(cm).Do().Error(),
+	}
+	for name, err := range dryRuns {
+		if err != nil {
+			t.Errorf("expected the dry run %s to be sent, got error %v", name, err)
+		}
+	}
+	if len(sent) != len(dryRuns) {
+		t.Errorf("expected %d dry runs to be sent, got %v", len(dryRuns), sent)
+	}
+
+	// the transport error is wrapped by the client in a url.Error
+	if err := c.Create(context.TODO(), cm.DeepCopy()); err == nil || !strings.Contains(err.Error(), ErrReadOnly.Error()) {
+		t.Errorf("expected a create without dry run to be refused, got error %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// portForwardReconnectInterval is how long PortForward waits before reconnecting a lost port-forward.
+const portForwardReconnectInterval = 5 * time.Second
+
+// PortForward forwards a local port on the loopback interface to port of the pod namespace/name, and returns the
+// local address. The port-forward lasts for the life of the process: when the connection to the pod is lost, onLost is
+// called with the reason and it is reconnected on the same local port.
+func PortForward(config *rest.Config, namespace, name string, port int, onLost func(err error)) (string, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating client for port-forward")
+	}
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating round tripper for port-forward")
+	}
+	url := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(name).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", url)
+
+	forward := func(localPort int) (*portforward.PortForwarder, chan error, error) {
+		ready := make(chan struct{})
+		ports := []string{fmt.Sprintf("%d:%d", localPort, port)}
+		forwarder, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, ports, make(chan struct{}), ready, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error creating port-forward")
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- forwarder.ForwardPorts()
+		}()
+		select {
+		case <-ready:
+			return forwarder, done, nil
+		case err := <-done:
+			if err == nil {
+				err = errors.New("port-forward stopped")
+			}
+			return nil, nil, errors.Wrapf(err, "error forwarding to port %d of pod %s/%s", port, namespace, name)
+		}
+	}
+
+	forwarder, done, err := forward(0)
+	if err != nil {
+		return "", err
+	}
+	forwarded, err := forwarder.GetPorts()
+	if err != nil {
+		return "", errors.Wrap(err, "error getting the forwarded port")
+	}
+	localPort := int(forwarded[0].Local)
+
+	go func() {
+		for {
+			err := <-done
+			if err == nil {
+				err = errors.Errorf("lost connection to pod %s/%s", namespace, name)
+			}
+			onLost(err)
+			for {
+				time.Sleep(portForwardReconnectInterval)
+				if _, done, err = forward(localPort); err == nil {
+					break
+				}
+				onLost(err)
+			}
+		}
+	}()
+
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), nil
+}
+
+// Tunnel listens on a local port on the loopback interface and connects each accepted connection to a connection
+// opened with dial, for the life of the process. It returns the local address. Connections that cannot be opened are
+// closed, after onError is called with the reason.
+func Tunnel(dial func(ctx context.Context) (net.Conn, error), onError func(err error)) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", errors.Wrap(err, "error listening for tunnel connections")
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				onError(errors.Wrap(err, "error accepting tunnel connection"))
+				time.Sleep(time.Second)
+				continue
+			}
+			go func() {
+				remote, err := dial(context.Background())
+				if err != nil {
+					onError(err)
+					conn.Close()
+					return
+				}
+				pipe(conn, remote)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
+
+// pipe copies data between a and b in both directions until either side is done, then closes both.
+func pipe(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyData := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		once.Do(closeBoth)
+	}
+	go copyData(a, b)
+	go copyData(b, a)
+	wg.Wait()
+}
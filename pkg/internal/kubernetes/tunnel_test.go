@@ -0,0 +1,72 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kubernetes
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTunnel(t *testing.T) {
+	// The remote end echoes lines back
+	dial := func(ctx context.Context) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			scanner := bufio.NewScanner(remote)
+			for scanner.Scan() {
+				if _, err := remote.Write([]byte("echo " + scanner.Text() + "\n")); err != nil {
+					return
+				}
+			}
+		}()
+		return local, nil
+	}
+	address, err := Tunnel(dial, func(err error) { t.Errorf("unexpected tunnel error: %v", err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "echo hello\n" {
+		t.Errorf("expected the remote end's echo, got %q", line)
+	}
+}
+
+func TestTunnelDialError(t *testing.T) {
+	errs := make(chan error, 1)
+	address, err := Tunnel(func(ctx context.Context) (net.Conn, error) {
+		return nil, errors.New("proxy unreachable")
+	}, func(err error) { errs <- err })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-errs; err.Error() != "proxy unreachable" {
+		t.Errorf("unexpected error %v", err)
+	}
+	// The local connection is closed
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
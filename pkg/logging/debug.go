@@ -0,0 +1,49 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package logging
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+)
+
+// debug is non-zero when V(1) and higher logs are written. It is shared by all loggers so that it can be switched
+// while an upgrade runs.
+var debug int32
+
+// SetDebug enables or disables the V(1) and higher logs of every logger returned by this package.
+func SetDebug(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&debug, v)
+}
+
+// DebugEnabled returns true if V(1) and higher logs are written.
+func DebugEnabled() bool {
+	return atomic.LoadInt32(&debug) != 0
+}
+
+// ToggleDebugOnSignal switches debug logs on or off each time the process receives the debug signal (SIGUSR1), so an
+// operator watching a slow upgrade can get detailed logs without restarting it and losing its progress. Each change is
+// logged to log. It does nothing on platforms without the signal.
+func ToggleDebugOnSignal(log logr.Logger) {
+	if debugSignal == nil {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, debugSignal)
+	go func() {
+		for range signals {
+			enabled := !DebugEnabled()
+			SetDebug(enabled)
+			log.Info("Toggled debug logs", "debug", enabled)
+		}
+	}()
+}
@@ -0,0 +1,15 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !windows
+// +build !windows
+
+package logging
+
+import (
+	"os"
+	"syscall"
+)
+
+// debugSignal toggles debug logs.
+var debugSignal os.Signal = syscall.SIGUSR1
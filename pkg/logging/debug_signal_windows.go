@@ -0,0 +1,9 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package logging
+
+import "os"
+
+// debugSignal is not available on Windows.
+var debugSignal os.Signal
@@ -51,8 +51,28 @@ func (l *logrusAdapter) Error(err error, msg string, keysAndValues ...interface{
 	l.withFields(keysAndValues).WithError(err).Error(msg)
 }
 
+// V returns l for level 0. Higher levels are debug logs, only written while debug logs are enabled.
 func (l *logrusAdapter) V(level int) logr.InfoLogger {
-	panic("not implemented")
+	if level <= 0 {
+		return l
+	}
+	return &debugLogger{l}
+}
+
+// debugLogger writes Info logs only while debug logs are enabled.
+type debugLogger struct {
+	*logrusAdapter
+}
+
+func (l *debugLogger) Info(msg string, keysAndValues ...interface{}) {
+	if !DebugEnabled() {
+		return
+	}
+	l.withFields(keysAndValues).Info(msg)
+}
+
+func (l *debugLogger) Enabled() bool {
+	return DebugEnabled()
 }
 
 func (l *logrusAdapter) WithValues(keysAndValues ...interface{}) logr.Logger {
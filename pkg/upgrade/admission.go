@@ -0,0 +1,144 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// admissionWebhookDenialRegex matches the message of a request denied by a validating or mutating webhook.
+	admissionWebhookDenialRegex = regexp.MustCompile(`admission webhook "([^"]+)" denied the request:\s*(.*)`)
+	// admissionPolicyDenialRegex matches the message of a request denied by a ValidatingAdmissionPolicy.
+	admissionPolicyDenialRegex = regexp.MustCompile(`ValidatingAdmissionPolicy '([^']+)'(?: with binding '[^']+')? denied request:\s*(.*)`)
+	// gatekeeperConstraintRegex matches the constraints Gatekeeper lists in its denials, "[denied by name]" in older
+	// versions and "[name]" in newer ones.
+	gatekeeperConstraintRegex = regexp.MustCompile(`\[(?:denied by )?([^\]\s]+)\]`)
+)
+
+// admissionDenial is a create refused by an admission webhook or policy.
+type admissionDenial struct {
+	// webhook is the name of the webhook, or of the ValidatingAdmissionPolicy, that denied the request.
+	webhook string
+	// policies are the Gatekeeper constraints the object violates, if the webhook is Gatekeeper's.
+	policies []string
+	// message is why the request was denied.
+	message string
+}
+
+// parseAdmissionDenial returns the admission denial described by msg, the message of an error from the API server,
+// and false if the error is not an admission denial.
+func parseAdmissionDenial(msg string) (admissionDenial, bool) {
+	match := admissionWebhookDenialRegex.FindStringSubmatch(msg)
+	if match == nil {
+		match = admissionPolicyDenialRegex.FindStringSubmatch(msg)
+	}
+	if match == nil {
+		return admissionDenial{}, false
+	}
+
+	d := admissionDenial{webhook: match[1], message: strings.TrimSpace(match[2])}
+	if strings.Contains(d.webhook, "gatekeeper") {
+		for _, m := range gatekeeperConstraintRegex.FindAllStringSubmatch(d.message, -1) {
+			d.policies = append(d.policies, m[1])
+		}
+	}
+	return d, true
+}
+
+// hint returns how to get the object kind called name past the denial d.
+func (d admissionDenial) hint(kind, name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s was denied by admission webhook %s", kind, name, d.webhook)
+	if len(d.policies) > 0 {
+		fmt.Fprintf(&b, ", violating %s", strings.Join(d.policies, ", "))
+	}
+	fmt.Fprintf(&b, ": %s; ", d.message)
+	if len(d.policies) > 0 {
+		b.WriteString("run kubectl get constraints to see the violated constraints, then ")
+	}
+	b.WriteString("make the replacement comply, adding the labels or annotations the policy requires with --extra-labels or --extra-annotations, or exempt it from the policy, then rerun with the same --upgrade-id to resume")
+	return b.String()
+}
+
+// explainAdmissionDenial adds to err, from creating the object kind called name, the policy it violates and how to
+// remediate, if err is an admission denial.
+func explainAdmissionDenial(err error, kind, name string) error {
+	if err == nil {
+		return nil
+	}
+	d, ok := parseAdmissionDenial(errors.Cause(err).Error())
+	if !ok {
+		return err
+	}
+	return errors.Wrap(err, d.hint(kind, name))
+}
+
+// admissionDryRunProblems creates the infrastructure, bootstrap and machine objects replacing machines in dry run, so
+// that admission webhooks and policies refusing them are found before any machine is replaced. Machines that are
+// replacements of this upgrade, or that have no provider id and so are not replaced, are skipped, as is the whole dry
+// run if the objects are not allowed to be created.
+func (u *ControlPlaneUpgrader) admissionDryRunProblems(machines []*clusterv1.Machine) ([]string, error) {
+	var problems []string
+	for _, machine := range u.plannedReplacements(machines) {
+		replacementKey := u.replacementKey(machine)
+		objects, err := u.replacementObjects(replacementKey, machine)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			err := u.managementClusterClient.Create(context.TODO(), o.obj, ctrlclient.DryRunAll)
+			if err == nil || apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			if d, ok := parseAdmissionDenial(err.Error()); ok {
+				problems = append(problems, d.hint(o.kind, replacementKey.Name))
+				continue
+			}
+			if apierrors.IsForbidden(err) {
+				u.log.Info("Skipping the admission dry run, the replacement objects cannot be created", "error", err.Error())
+				return nil, nil
+			}
+			if apierrors.IsInvalid(err) {
+				problems = append(problems, fmt.Sprintf("%s %s is invalid: %v", o.kind, replacementKey.Name, err))
+				continue
+			}
+			return nil, errors.Wrapf(err, "error creating %s %s in dry run", o.kind, replacementKey.Name)
+		}
+	}
+	return problems, nil
+}
+
+// replacementObject is an object created to replace a machine, and its kind.
+type replacementObject struct {
+	kind string
+	obj  runtime.Object
+}
+
+// replacementObjects returns the infrastructure, bootstrap and machine objects replacing machine at replacementKey, in
+// the order they are created.
+func (u *ControlPlaneUpgrader) replacementObjects(replacementKey ctrlclient.ObjectKey, machine *clusterv1.Machine) ([]replacementObject, error) {
+	infra, err := u.replacementInfrastructure(replacementKey, machine.Spec.InfrastructureRef)
+	if err != nil {
+		return nil, err
+	}
+	bootstrap, err := u.replacementBootstrapConfig(replacementKey, machine.Spec.Bootstrap.ConfigRef.Name)
+	if err != nil {
+		return nil, err
+	}
+	return []replacementObject{
+		{kind: infra.GetKind(), obj: infra},
+		{kind: "KubeadmConfig", obj: bootstrap},
+		{kind: "Machine", obj: u.replacementMachine(replacementKey, machine)},
+	}, nil
+}
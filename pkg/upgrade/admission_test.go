@@ -0,0 +1,74 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAdmissionDenial(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		webhook  string
+		policies []string
+		message  string
+	}{
+		{
+			name:     "gatekeeper",
+			msg:      `admission webhook "validation.gatekeeper.sh" denied the request: [denied by must-have-owner] you must provide labels: {"owner"}`,
+			webhook:  "validation.gatekeeper.sh",
+			policies: []string{"must-have-owner"},
+			message:  `[denied by must-have-owner] you must provide labels: {"owner"}`,
+		},
+		{
+			name:     "gatekeeper without denied by",
+			msg:      `admission webhook "validation.gatekeeper.sh" denied the request: [must-have-owner] missing owner, [no-public-ip] public IPs are not allowed`,
+			webhook:  "validation.gatekeeper.sh",
+			policies: []string{"must-have-owner", "no-public-ip"},
+			message:  `[must-have-owner] missing owner, [no-public-ip] public IPs are not allowed`,
+		},
+		{
+			name:    "kyverno",
+			msg:     `admission webhook "validate.kyverno.svc-fail" denied the request: resource Machine/default/cp-0 was blocked`,
+			webhook: "validate.kyverno.svc-fail",
+			message: `resource Machine/default/cp-0 was blocked`,
+		},
+		{
+			name:    "validating admission policy",
+			msg:     `machines.cluster.x-k8s.io "cp-0" is forbidden: ValidatingAdmissionPolicy 'require-owner' with binding 'require-owner-binding' denied request: missing owner`,
+			webhook: "require-owner",
+			message: "missing owner",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := parseAdmissionDenial(tt.msg)
+			require.True(t, ok)
+			assert.Equal(t, tt.webhook, d.webhook)
+			assert.Equal(t, tt.policies, d.policies)
+			assert.Equal(t, tt.message, d.message)
+		})
+	}
+
+	_, ok := parseAdmissionDenial(`machines.cluster.x-k8s.io "cp-0" already exists`)
+	assert.False(t, ok)
+}
+
+func TestExplainAdmissionDenial(t *testing.T) {
+	denied := errors.New(`admission webhook "validation.gatekeeper.sh" denied the request: [denied by must-have-owner] you must provide labels: {"owner"}`)
+	err := explainAdmissionDenial(errors.Wrap(denied, "Error creating machine: cp-0.upgrade.1"), "Machine", "cp-0.upgrade.1")
+	assert.Equal(t, denied, errors.Cause(err))
+	assert.Contains(t, err.Error(), "Machine cp-0.upgrade.1 was denied by admission webhook validation.gatekeeper.sh, violating must-have-owner")
+	assert.Contains(t, err.Error(), "kubectl get constraints")
+	assert.Contains(t, err.Error(), "--extra-labels")
+
+	other := errors.New("connection refused")
+	assert.Equal(t, other, explainAdmissionDenial(other, "Machine", "cp-0.upgrade.1"))
+	assert.NoError(t, explainAdmissionDenial(nil, "Machine", "cp-0.upgrade.1"))
+}
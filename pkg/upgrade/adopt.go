@@ -0,0 +1,393 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// The v1alpha3 API versions adoption converts to. They are handled as unstructured objects as this tool is built
+// against v1alpha2.
+const (
+	clusterV1alpha3APIVersion      = "cluster.x-k8s.io/v1alpha3"
+	controlPlaneV1alpha3APIVersion = "controlplane.cluster.x-k8s.io/v1alpha3"
+	kubeadmControlPlaneKind        = "KubeadmControlPlane"
+	clusterLabelName               = "cluster.x-k8s.io/cluster-name"
+	controlPlaneLabelName          = "cluster.x-k8s.io/control-plane"
+)
+
+// Adopter converts a Cluster's unmanaged control plane Machines into a KubeadmControlPlane on a Cluster API v1alpha3
+// management cluster. It is experimental.
+type Adopter struct {
+	log                     logr.Logger
+	clusterNamespace        string
+	clusterName             string
+	managementClusterClient ctrlclient.Client
+}
+
+// AdoptionPlan holds the objects adoption creates and the Machines it hands over to the KubeadmControlPlane.
+type AdoptionPlan struct {
+	ControlPlane           *unstructured.Unstructured
+	InfrastructureTemplate *unstructured.Unstructured
+	Machines               []string
+}
+
+// NewAdopter returns an Adopter for the target cluster in config.
+func NewAdopter(log logr.Logger, config Config) (*Adopter, error) {
+	connectTimeout, err := parseConnectTimeout(config.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	managementClusterClient, err := newManagementClusterClient(log, config.ManagementCluster, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Adopter{
+		log:                     log,
+		clusterNamespace:        config.TargetCluster.Namespace,
+		clusterName:             config.TargetCluster.Name,
+		managementClusterClient: managementClusterClient,
+	}, nil
+}
+
+// Plan checks the Cluster's control plane Machines can be adopted and generates the KubeadmControlPlane and
+// infrastructure machine template for them, without changing anything.
+func (a *Adopter) Plan() (*AdoptionPlan, error) {
+	cluster, err := a.getCluster()
+	if err != nil {
+		return nil, err
+	}
+	if ref, found, _ := unstructured.NestedMap(cluster.Object, "spec", "controlPlaneRef"); found && ref != nil {
+		return nil, errors.Errorf("cluster %s/%s already has a control plane reference to %v %v", a.clusterNamespace, a.clusterName, ref["kind"], ref["name"])
+	}
+
+	machines, err := a.listMachines()
+	if err != nil {
+		return nil, err
+	}
+	name := a.clusterName + "-control-plane"
+	if problems := adoptionProblems(machines, name); len(problems) > 0 {
+		return nil, errors.Errorf("control plane machines cannot be adopted: %s", strings.Join(problems, "; "))
+	}
+
+	infraRef, err := objectReference(&machines[0], "spec", "infrastructureRef")
+	if err != nil {
+		return nil, err
+	}
+	infra, err := external.Get(a.managementClusterClient, infraRef, a.clusterNamespace)
+	if err != nil {
+		return nil, err
+	}
+	template := buildInfrastructureTemplate(infra, name)
+
+	kubeadmConfigSpec, err := a.kubeadmConfigSpec(machines)
+	if err != nil {
+		return nil, err
+	}
+
+	version, _, _ := unstructured.NestedString(machines[0].Object, "spec", "version")
+	templateRef := v1.ObjectReference{
+		APIVersion: template.GetAPIVersion(),
+		Kind:       template.GetKind(),
+		Namespace:  template.GetNamespace(),
+		Name:       template.GetName(),
+	}
+
+	plan := &AdoptionPlan{
+		ControlPlane:           buildKubeadmControlPlane(a.clusterNamespace, name, a.clusterName, int64(len(machines)), version, templateRef, kubeadmConfigSpec),
+		InfrastructureTemplate: template,
+	}
+	for _, m := range machines {
+		plan.Machines = append(plan.Machines, m.GetName())
+	}
+
+	return plan, nil
+}
+
+// Adopt creates the objects in plan, makes the KubeadmControlPlane the controller of the Machines, and points the
+// Cluster at it. Objects that already exist are reused, so an interrupted adoption can be rerun.
+func (a *Adopter) Adopt(plan *AdoptionPlan) error {
+	a.log.Info("Creating infrastructure machine template", "kind", plan.InfrastructureTemplate.GetKind(), "name", plan.InfrastructureTemplate.GetName())
+	if err := a.createIfNotExists(plan.InfrastructureTemplate); err != nil {
+		return err
+	}
+
+	a.log.Info("Creating KubeadmControlPlane", "name", plan.ControlPlane.GetName())
+	if err := a.createIfNotExists(plan.ControlPlane); err != nil {
+		return err
+	}
+
+	controllerRef := metav1.NewControllerRef(plan.ControlPlane, plan.ControlPlane.GroupVersionKind())
+	for _, name := range plan.Machines {
+		a.log.Info("Transferring machine ownership", "machine", name, "kubeadm-control-plane", plan.ControlPlane.GetName())
+		machine := newV1alpha3Object(clusterV1alpha3APIVersion, "Machine")
+		if err := a.managementClusterClient.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: a.clusterNamespace, Name: name}, machine); err != nil {
+			return errors.Wrapf(err, "error getting machine %s", name)
+		}
+
+		patch := ctrlclient.MergeFrom(machine.DeepCopy())
+		machine.SetOwnerReferences(addOwnerReference(machine.GetOwnerReferences(), *controllerRef))
+		if err := a.managementClusterClient.Patch(context.TODO(), machine, patch); err != nil {
+			return errors.Wrapf(err, "error patching machine %s", name)
+		}
+	}
+
+	a.log.Info("Setting cluster control plane reference")
+	cluster, err := a.getCluster()
+	if err != nil {
+		return err
+	}
+	patch := ctrlclient.MergeFrom(cluster.DeepCopy())
+	ref := map[string]interface{}{
+		"apiVersion": plan.ControlPlane.GetAPIVersion(),
+		"kind":       plan.ControlPlane.GetKind(),
+		"namespace":  plan.ControlPlane.GetNamespace(),
+		"name":       plan.ControlPlane.GetName(),
+	}
+	if err := unstructured.SetNestedMap(cluster.Object, ref, "spec", "controlPlaneRef"); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := a.managementClusterClient.Patch(context.TODO(), cluster, patch); err != nil {
+		return errors.Wrapf(err, "error patching cluster %s/%s", a.clusterNamespace, a.clusterName)
+	}
+
+	return nil
+}
+
+// Print writes the objects in the plan to w as YAML documents.
+func (p *AdoptionPlan) Print(w io.Writer) error {
+	fmt.Fprintf(w, "# Machines adopted by the KubeadmControlPlane: %s\n", strings.Join(p.Machines, ", "))
+	for _, obj := range []*unstructured.Unstructured{p.InfrastructureTemplate, p.ControlPlane} {
+		data, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return errors.Wrapf(err, "error encoding %s %s", obj.GetKind(), obj.GetName())
+		}
+		fmt.Fprintf(w, "---\n%s", data)
+	}
+	return nil
+}
+
+func (a *Adopter) getCluster() (*unstructured.Unstructured, error) {
+	cluster := newV1alpha3Object(clusterV1alpha3APIVersion, "Cluster")
+	key := ctrlclient.ObjectKey{Namespace: a.clusterNamespace, Name: a.clusterName}
+	if err := a.managementClusterClient.Get(context.TODO(), key, cluster); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil, errors.Errorf("the management cluster does not serve %s; adoption requires Cluster API v1alpha3", clusterV1alpha3APIVersion)
+		}
+		return nil, errors.Wrapf(err, "error getting cluster %s", key.String())
+	}
+	return cluster, nil
+}
+
+// listMachines returns the Cluster's control plane Machines that are not being deleted.
+func (a *Adopter) listMachines() ([]unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetAPIVersion(clusterV1alpha3APIVersion)
+	list.SetKind("MachineList")
+
+	// v1alpha3 control plane machines have an empty control plane label, v1alpha2 ones have "true"
+	selector := labels.SelectorFromSet(labels.Set{clusterLabelName: a.clusterName})
+	r, err := labels.NewRequirement(controlPlaneLabelName, selection.Exists, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	listOptions := []ctrlclient.ListOption{
+		ctrlclient.InNamespace(a.clusterNamespace),
+		ctrlclient.MatchingLabelsSelector{Selector: selector.Add(*r)},
+	}
+	if err := a.managementClusterClient.List(context.TODO(), list, listOptions...); err != nil {
+		return nil, errors.Wrap(err, "error listing machines")
+	}
+
+	var ret []unstructured.Unstructured
+	for _, m := range list.Items {
+		if m.GetDeletionTimestamp() == nil {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+// kubeadmConfigSpec combines the KubeadmConfigs of machines into the kubeadmConfigSpec of a KubeadmControlPlane. The
+// first machine's config is used, with the init or join configuration it lacks taken from another machine.
+func (a *Adopter) kubeadmConfigSpec(machines []unstructured.Unstructured) (map[string]interface{}, error) {
+	var spec map[string]interface{}
+	for i := range machines {
+		ref, err := objectReference(&machines[i], "spec", "bootstrap", "configRef")
+		if err != nil {
+			return nil, err
+		}
+		config, err := external.Get(a.managementClusterClient, ref, a.clusterNamespace)
+		if err != nil {
+			return nil, err
+		}
+		configSpec, _, err := unstructured.NestedMap(config.Object, "spec")
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading spec of kubeadm config %s", ref.Name)
+		}
+
+		if spec == nil {
+			spec = configSpec
+			continue
+		}
+		for _, field := range []string{"clusterConfiguration", "initConfiguration", "joinConfiguration"} {
+			if _, ok := spec[field]; !ok && configSpec[field] != nil {
+				spec[field] = configSpec[field]
+			}
+		}
+	}
+
+	if spec["initConfiguration"] == nil || spec["joinConfiguration"] == nil {
+		a.log.Info("Warning: the control plane KubeadmConfigs lack an init or join configuration; review the generated KubeadmControlPlane")
+	}
+	return spec, nil
+}
+
+func (a *Adopter) createIfNotExists(obj *unstructured.Unstructured) error {
+	err := a.managementClusterClient.Create(context.TODO(), obj)
+	if apierrors.IsAlreadyExists(err) {
+		key := ctrlclient.ObjectKey{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		return errors.Wrapf(a.managementClusterClient.Get(context.TODO(), key, obj), "error getting %s %s", obj.GetKind(), key.String())
+	}
+	return errors.Wrapf(err, "error creating %s %s", obj.GetKind(), obj.GetName())
+}
+
+// adoptionProblems returns the reasons machines cannot be handed over to the KubeadmControlPlane named
+// controlPlaneName. Machines it already controls, from an interrupted adoption, are accepted.
+func adoptionProblems(machines []unstructured.Unstructured, controlPlaneName string) []string {
+	if len(machines) == 0 {
+		return []string{"found 0 control plane machines"}
+	}
+
+	var (
+		problems  []string
+		versions  = make(map[string]bool)
+		infraKind = make(map[string]bool)
+	)
+	for i := range machines {
+		m := &machines[i]
+
+		version, _, _ := unstructured.NestedString(m.Object, "spec", "version")
+		versions[version] = true
+
+		infraAPIVersion, _, _ := unstructured.NestedString(m.Object, "spec", "infrastructureRef", "apiVersion")
+		kind, _, _ := unstructured.NestedString(m.Object, "spec", "infrastructureRef", "kind")
+		infraKind[infraAPIVersion+"/"+kind] = true
+
+		if bootstrapKind, _, _ := unstructured.NestedString(m.Object, "spec", "bootstrap", "configRef", "kind"); bootstrapKind != "KubeadmConfig" {
+			problems = append(problems, fmt.Sprintf("machine %s is not bootstrapped by a KubeadmConfig", m.GetName()))
+		}
+		if owner := metav1.GetControllerOf(m); owner != nil && (owner.Kind != kubeadmControlPlaneKind || owner.Name != controlPlaneName) {
+			problems = append(problems, fmt.Sprintf("machine %s is already controlled by %s %s", m.GetName(), owner.Kind, owner.Name))
+		}
+		if id := m.GetAnnotations()[AnnotationUpgradeID]; id != "" {
+			problems = append(problems, fmt.Sprintf("machine %s is part of upgrade %s", m.GetName(), id))
+		}
+	}
+
+	if len(versions) > 1 || versions[""] {
+		problems = append(problems, "control plane machines must all be at the same, set version")
+	}
+	if len(infraKind) > 1 {
+		problems = append(problems, "control plane machines must all use the same infrastructure kind")
+	}
+
+	return problems
+}
+
+// buildInfrastructureTemplate returns a machine template, such as an AWSMachineTemplate, named name whose template is
+// the spec of infra without its instance specific provider ID.
+func buildInfrastructureTemplate(infra *unstructured.Unstructured, name string) *unstructured.Unstructured {
+	spec, _, _ := unstructured.NestedMap(infra.Object, "spec")
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	delete(spec, "providerID")
+
+	template := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": spec,
+			},
+		},
+	}}
+	template.SetAPIVersion(infra.GetAPIVersion())
+	template.SetKind(infra.GetKind() + "Template")
+	template.SetNamespace(infra.GetNamespace())
+	template.SetName(name)
+	return template
+}
+
+// buildKubeadmControlPlane returns a KubeadmControlPlane for the cluster with the given replicas, version,
+// infrastructure template, and kubeadm config spec.
+func buildKubeadmControlPlane(namespace, name, clusterName string, replicas int64, version string, infrastructureTemplate v1.ObjectReference, kubeadmConfigSpec map[string]interface{}) *unstructured.Unstructured {
+	kcp := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": replicas,
+			"version":  version,
+			"infrastructureTemplate": map[string]interface{}{
+				"apiVersion": infrastructureTemplate.APIVersion,
+				"kind":       infrastructureTemplate.Kind,
+				"namespace":  infrastructureTemplate.Namespace,
+				"name":       infrastructureTemplate.Name,
+			},
+			"kubeadmConfigSpec": kubeadmConfigSpec,
+		},
+	}}
+	kcp.SetAPIVersion(controlPlaneV1alpha3APIVersion)
+	kcp.SetKind(kubeadmControlPlaneKind)
+	kcp.SetNamespace(namespace)
+	kcp.SetName(name)
+	kcp.SetLabels(map[string]string{clusterLabelName: clusterName})
+	return kcp
+}
+
+// addOwnerReference returns refs with ref added, replacing any reference to the same object.
+func addOwnerReference(refs []metav1.OwnerReference, ref metav1.OwnerReference) []metav1.OwnerReference {
+	for i := range refs {
+		if refs[i].UID == ref.UID {
+			refs[i] = ref
+			return refs
+		}
+	}
+	return append(refs, ref)
+}
+
+// objectReference returns the object reference at fields of obj.
+func objectReference(obj *unstructured.Unstructured, fields ...string) (*v1.ObjectReference, error) {
+	ref, found, err := unstructured.NestedStringMap(obj.Object, fields...)
+	if err != nil || !found {
+		return nil, errors.Errorf("machine %s has no %s", obj.GetName(), strings.Join(fields, "."))
+	}
+	return &v1.ObjectReference{
+		APIVersion: ref["apiVersion"],
+		Kind:       ref["kind"],
+		Namespace:  ref["namespace"],
+		Name:       ref["name"],
+	}, nil
+}
+
+func newV1alpha3Object(apiVersion, kind string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	return obj
+}
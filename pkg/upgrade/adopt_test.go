@@ -0,0 +1,131 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestAdoptionProblems(t *testing.T) {
+	machine := func(name, version, infraKind, bootstrapKind string) unstructured.Unstructured {
+		m := unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"version": version,
+				"infrastructureRef": map[string]interface{}{
+					"apiVersion": "infrastructure.cluster.x-k8s.io/v1alpha3",
+					"kind":       infraKind,
+					"name":       name,
+				},
+				"bootstrap": map[string]interface{}{
+					"configRef": map[string]interface{}{
+						"kind": bootstrapKind,
+						"name": name,
+					},
+				},
+			},
+		}}
+		m.SetName(name)
+		return m
+	}
+	controlledBy := func(m unstructured.Unstructured, kind, name string) unstructured.Unstructured {
+		controller := true
+		m.SetOwnerReferences([]metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}})
+		return m
+	}
+	upgrading := func(m unstructured.Unstructured) unstructured.Unstructured {
+		m.SetAnnotations(map[string]string{AnnotationUpgradeID: "123"})
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		machines []unstructured.Unstructured
+		expected []string
+	}{
+		{
+			name:     "no machines",
+			expected: []string{"found 0 control plane machines"},
+		},
+		{
+			name: "adoptable",
+			machines: []unstructured.Unstructured{
+				machine("a", "v1.16.3", "AWSMachine", "KubeadmConfig"),
+				controlledBy(machine("b", "v1.16.3", "AWSMachine", "KubeadmConfig"), kubeadmControlPlaneKind, "c-control-plane"),
+			},
+		},
+		{
+			name: "inconsistent machines",
+			machines: []unstructured.Unstructured{
+				machine("a", "v1.16.3", "AWSMachine", "KubeadmConfig"),
+				machine("b", "v1.16.4", "VSphereMachine", "KubeadmConfig"),
+			},
+			expected: []string{
+				"control plane machines must all be at the same, set version",
+				"control plane machines must all use the same infrastructure kind",
+			},
+		},
+		{
+			name: "unadoptable machines",
+			machines: []unstructured.Unstructured{
+				machine("a", "v1.16.3", "AWSMachine", "TalosConfig"),
+				controlledBy(machine("b", "v1.16.3", "AWSMachine", "KubeadmConfig"), "MachineSet", "workers"),
+				upgrading(machine("c", "v1.16.3", "AWSMachine", "KubeadmConfig")),
+			},
+			expected: []string{
+				"machine a is not bootstrapped by a KubeadmConfig",
+				"machine b is already controlled by MachineSet workers",
+				"machine c is part of upgrade 123",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, adoptionProblems(tc.machines, "c-control-plane"))
+		})
+	}
+}
+
+func TestBuildInfrastructureTemplate(t *testing.T) {
+	infra := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"providerID":   "aws:///us-east-1a/i-123",
+			"instanceType": "m5.large",
+		},
+	}}
+	infra.SetAPIVersion("infrastructure.cluster.x-k8s.io/v1alpha3")
+	infra.SetKind("AWSMachine")
+	infra.SetNamespace("ns")
+	infra.SetName("a")
+
+	template := buildInfrastructureTemplate(infra, "c-control-plane")
+
+	assert.Equal(t, "AWSMachineTemplate", template.GetKind())
+	assert.Equal(t, "infrastructure.cluster.x-k8s.io/v1alpha3", template.GetAPIVersion())
+	assert.Equal(t, "c-control-plane", template.GetName())
+	spec, _, _ := unstructured.NestedMap(template.Object, "spec", "template", "spec")
+	assert.Equal(t, map[string]interface{}{"instanceType": "m5.large"}, spec)
+}
+
+func TestBuildKubeadmControlPlane(t *testing.T) {
+	templateRef := corev1.ObjectReference{APIVersion: "infrastructure.cluster.x-k8s.io/v1alpha3", Kind: "AWSMachineTemplate", Namespace: "ns", Name: "c-control-plane"}
+	kcp := buildKubeadmControlPlane("ns", "c-control-plane", "c", 3, "v1.16.3", templateRef, map[string]interface{}{"files": []interface{}{}})
+
+	assert.Equal(t, controlPlaneV1alpha3APIVersion, kcp.GetAPIVersion())
+	assert.Equal(t, kubeadmControlPlaneKind, kcp.GetKind())
+	assert.Equal(t, "c", kcp.GetLabels()[clusterLabelName])
+
+	replicas, _, _ := unstructured.NestedInt64(kcp.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+	version, _, _ := unstructured.NestedString(kcp.Object, "spec", "version")
+	assert.Equal(t, "v1.16.3", version)
+	kind, _, _ := unstructured.NestedString(kcp.Object, "spec", "infrastructureTemplate", "kind")
+	assert.Equal(t, "AWSMachineTemplate", kind)
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// validateAPIServerCertSANs checks that each of sans is an IP address or a DNS name, which may be a wildcard.
+func validateAPIServerCertSANs(sans []string) error {
+	for _, san := range sans {
+		if net.ParseIP(san) != nil {
+			continue
+		}
+		if len(validation.IsDNS1123Subdomain(san)) > 0 && len(validation.IsWildcardDNS1123Subdomain(san)) > 0 {
+			return errors.Errorf("invalid API server cert SAN %q: must be an IP address or a DNS name", san)
+		}
+	}
+	return nil
+}
+
+// mergeCertSANs returns existing with the SANs of sans it does not have appended, and whether any was.
+func mergeCertSANs(existing, sans []string) ([]string, bool) {
+	merged := existing
+	added := false
+	for _, san := range sans {
+		found := false
+		for _, e := range merged {
+			if e == san {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, san)
+			added = true
+		}
+	}
+	return merged, added
+}
+
+// addAPIServerCertSANs returns a copy of cm whose ClusterConfiguration has sans among its API server cert SANs, so
+// that control plane nodes joining from then on have API server certificates valid for them. cm is returned as is if
+// it already has them all.
+func addAPIServerCertSANs(cm *v1.ConfigMap, sans []string) (*v1.ConfigMap, error) {
+	if len(sans) == 0 {
+		return cm, nil
+	}
+	key, clusterConfig, err := findClusterConfiguration(cm)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, errNoClusterConfiguration
+	}
+
+	apiServer, _ := clusterConfig["apiServer"].(map[string]interface{})
+	if apiServer == nil {
+		apiServer = map[string]interface{}{}
+	}
+	var existing []string
+	if list, ok := apiServer["certSANs"].([]interface{}); ok {
+		for _, san := range list {
+			if s, ok := san.(string); ok {
+				existing = append(existing, s)
+			}
+		}
+	}
+	merged, added := mergeCertSANs(existing, sans)
+	if !added {
+		return cm, nil
+	}
+	apiServer["certSANs"] = merged
+	clusterConfig["apiServer"] = apiServer
+
+	data, err := yaml.Marshal(clusterConfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error encoding kubeadm configmap %s", key)
+	}
+	updated := cm.DeepCopy()
+	updated.Data[key] = string(data)
+	return updated, nil
+}
+
+// addClusterConfigurationCertSANs adds sans to the API server cert SANs of config, if any, so that the KubeadmConfigs
+// of replacements describe the certificates of their nodes.
+func addClusterConfigurationCertSANs(config *kubeadmv1beta1.ClusterConfiguration, sans []string) {
+	if config == nil {
+		return
+	}
+	config.APIServer.CertSANs, _ = mergeCertSANs(config.APIServer.CertSANs, sans)
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+)
+
+func TestValidateAPIServerCertSANs(t *testing.T) {
+	assert.NoError(t, validateAPIServerCertSANs(nil))
+	assert.NoError(t, validateAPIServerCertSANs([]string{"api.example.com", "*.example.com", "10.0.0.100", "fd00::1"}))
+	assert.Error(t, validateAPIServerCertSANs([]string{"https://api.example.com"}))
+	assert.Error(t, validateAPIServerCertSANs([]string{"API.example.com"}))
+}
+
+func TestAddAPIServerCertSANs(t *testing.T) {
+	cm := &v1.ConfigMap{Data: map[string]string{
+		clusterConfigurationKey: "apiServer:\n  certSANs:\n  - api.old-lb.example.com\nkind: ClusterConfiguration\nkubernetesVersion: v1.16.3\n",
+	}}
+
+	updated, err := addAPIServerCertSANs(cm, []string{"api.old-lb.example.com", "api.new-lb.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t,
+		"apiServer:\n  certSANs:\n  - api.old-lb.example.com\n  - api.new-lb.example.com\nkind: ClusterConfiguration\nkubernetesVersion: v1.16.3\n",
+		updated.Data[clusterConfigurationKey])
+	assert.Contains(t, cm.Data[clusterConfigurationKey], "old-lb", "the original is not modified")
+	assert.NotContains(t, cm.Data[clusterConfigurationKey], "new-lb", "the original is not modified")
+
+	again, err := addAPIServerCertSANs(updated, []string{"api.new-lb.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, updated, again)
+
+	noAPIServer := &v1.ConfigMap{Data: map[string]string{clusterConfigurationKey: "kind: ClusterConfiguration\n"}}
+	updated, err = addAPIServerCertSANs(noAPIServer, []string{"10.0.0.100"})
+	require.NoError(t, err)
+	assert.Equal(t, "apiServer:\n  certSANs:\n  - 10.0.0.100\nkind: ClusterConfiguration\n", updated.Data[clusterConfigurationKey])
+
+	_, err = addAPIServerCertSANs(&v1.ConfigMap{}, []string{"10.0.0.100"})
+	assert.Equal(t, errNoClusterConfiguration, err)
+}
+
+func TestAddClusterConfigurationCertSANs(t *testing.T) {
+	addClusterConfigurationCertSANs(nil, []string{"api.new-lb.example.com"})
+
+	config := &kubeadmv1beta1.ClusterConfiguration{}
+	config.APIServer.CertSANs = []string{"api.old-lb.example.com"}
+	addClusterConfigurationCertSANs(config, []string{"api.new-lb.example.com", "api.old-lb.example.com"})
+	assert.Equal(t, []string{"api.old-lb.example.com", "api.new-lb.example.com"}, config.APIServer.CertSANs)
+}
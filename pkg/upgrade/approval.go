@@ -0,0 +1,167 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// approvedAnnotation approves the upgrade whose ID is its value when set on the Cluster.
+const approvedAnnotation = annotationPrefix + "approved"
+
+const (
+	// defaultApprovalTimeout is how long each disruptive phase waits for approval by default.
+	defaultApprovalTimeout = time.Hour
+	approvalPollInterval   = 30 * time.Second
+)
+
+// Disruptive phases gated on approval.
+const (
+	approvalPhaseControlPlane = "control-plane"
+	approvalPhaseBatchPrefix  = "machine-deployment-batch-"
+)
+
+// approvalGate waits for an external approval, from a human or a change management system, before each disruptive
+// phase of an upgrade. A nil approvalGate approves everything.
+type approvalGate struct {
+	log              logr.Logger
+	client           ctrlclient.Client
+	clusterNamespace string
+	clusterName      string
+	upgradeID        string
+	annotation       bool
+	url              string
+	timeout          time.Duration
+	httpClient       *http.Client
+}
+
+// newApprovalGate validates config and returns the gate for the upgrade upgradeID of the cluster namespace/name. It
+// returns nil if no approval is required.
+func newApprovalGate(log logr.Logger, c ctrlclient.Client, namespace, name, upgradeID string, config ApprovalConfig) (*approvalGate, error) {
+	if !config.Annotation && config.URL == "" {
+		return nil, nil
+	}
+
+	if config.URL != "" {
+		u, err := url.Parse(config.URL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing approval url %q", config.URL)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("invalid approval url %q: must be an absolute http or https url", config.URL)
+		}
+	}
+
+	timeout := defaultApprovalTimeout
+	if config.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing approval timeout %q", config.Timeout)
+		}
+		if timeout <= 0 {
+			return nil, errors.Errorf("invalid approval timeout %q: must be positive", config.Timeout)
+		}
+	}
+
+	return &approvalGate{
+		log:              log,
+		client:           c,
+		clusterNamespace: namespace,
+		clusterName:      name,
+		upgradeID:        upgradeID,
+		annotation:       config.Annotation,
+		url:              config.URL,
+		timeout:          timeout,
+		httpClient:       &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// wait blocks until phase is approved. If it is not approved in time, nothing of phase has been done yet, and the
+// returned error explains how to continue the upgrade once approved.
+func (g *approvalGate) wait(phase string) error {
+	if g == nil {
+		return nil
+	}
+
+	g.log.Info("Waiting for approval", "phase", phase, "annotation", g.annotation, "url", g.url, "timeout", g.timeout.String())
+	err := wait.PollImmediate(approvalPollInterval, g.timeout, func() (bool, error) {
+		return g.approved(phase)
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("upgrade %s was not approved within %s, so %s was not started; approve it and rerun with --upgrade-id=%s to continue",
+			g.upgradeID, g.timeout, phase, g.upgradeID)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error waiting for approval of %s", phase)
+	}
+	g.log.Info("Approved", "phase", phase)
+	return nil
+}
+
+// approved returns true if every configured approval is given. Approvals are checked on each poll, so withdrawing
+// one holds the later phases.
+func (g *approvalGate) approved(phase string) (bool, error) {
+	if g.annotation {
+		cluster := &clusterv1.Cluster{}
+		key := ctrlclient.ObjectKey{Namespace: g.clusterNamespace, Name: g.clusterName}
+		if err := g.client.Get(context.TODO(), key, cluster); err != nil {
+			// keep polling, the management cluster may be briefly unavailable
+			g.log.Error(err, "Error getting cluster to check for approval", "cluster", key.String())
+			return false, nil
+		}
+		if !annotationApproves(cluster.Annotations, g.upgradeID) {
+			return false, nil
+		}
+	}
+
+	if g.url != "" {
+		return g.urlApproves(phase), nil
+	}
+	return true, nil
+}
+
+// annotationApproves returns true if annotations approve the upgrade upgradeID.
+func annotationApproves(annotations map[string]string, upgradeID string) bool {
+	return annotations[approvedAnnotation] == upgradeID
+}
+
+// urlApproves returns true if the approval url responds 200 OK for phase. Any other response, including errors,
+// means the phase is not approved yet.
+func (g *approvalGate) urlApproves(phase string) bool {
+	resp, err := g.httpClient.Get(approvalURL(g.url, g.clusterNamespace, g.clusterName, g.upgradeID, phase))
+	if err != nil {
+		g.log.Error(err, "Error polling approval url", "url", g.url)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		g.log.V(1).Info("Not approved yet", "url", g.url, "status", resp.Status)
+		return false
+	}
+	return true
+}
+
+// approvalURL returns base with the cluster, upgrade ID and phase added as query parameters, so a single endpoint can
+// approve upgrades phase by phase. base has been validated by newApprovalGate.
+func approvalURL(base, namespace, name, upgradeID, phase string) string {
+	u, _ := url.Parse(base)
+	query := u.Query()
+	query.Set("namespace", namespace)
+	query.Set("cluster", name)
+	query.Set("upgradeID", upgradeID)
+	query.Set("phase", phase)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
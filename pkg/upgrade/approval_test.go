@@ -0,0 +1,106 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+)
+
+func TestNewApprovalGate(t *testing.T) {
+	testcases := []struct {
+		name        string
+		config      ApprovalConfig
+		wantGate    bool
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{name: "no approval"},
+		{name: "annotation", config: ApprovalConfig{Annotation: true}, wantGate: true, wantTimeout: defaultApprovalTimeout},
+		{name: "url with timeout", config: ApprovalConfig{URL: "https://example.com/approve", Timeout: "4h"}, wantGate: true, wantTimeout: 4 * time.Hour},
+		{name: "relative url", config: ApprovalConfig{URL: "/approve"}, wantErr: true},
+		{name: "unsupported scheme", config: ApprovalConfig{URL: "ftp://example.com/approve"}, wantErr: true},
+		{name: "invalid timeout", config: ApprovalConfig{Annotation: true, Timeout: "soon"}, wantErr: true},
+		{name: "negative timeout", config: ApprovalConfig{Annotation: true, Timeout: "-1h"}, wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			gate, err := newApprovalGate(logging.NewLogrusLoggerAdapter(logrus.New()), nil, "ns", "cluster", "123", tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("newApprovalGate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if (gate != nil) != tc.wantGate {
+				t.Fatalf("newApprovalGate() = %v, want a gate: %v", gate, tc.wantGate)
+			}
+			if gate != nil && gate.timeout != tc.wantTimeout {
+				t.Errorf("timeout = %s, want %s", gate.timeout, tc.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestNilApprovalGateApproves(t *testing.T) {
+	var gate *approvalGate
+	if err := gate.wait(approvalPhaseControlPlane); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAnnotationApproves(t *testing.T) {
+	if annotationApproves(nil, "123") {
+		t.Error("expected no annotations not to approve")
+	}
+	if annotationApproves(map[string]string{approvedAnnotation: "122"}, "123") {
+		t.Error("expected the approval of another upgrade not to approve")
+	}
+	if !annotationApproves(map[string]string{approvedAnnotation: "123"}, "123") {
+		t.Error("expected the approval of the upgrade to approve")
+	}
+}
+
+func TestApprovalURL(t *testing.T) {
+	got, err := url.Parse(approvalURL("https://example.com/approve?token=abc", "ns", "cluster", "123", approvalPhaseControlPlane))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{
+		"token":     {"abc"},
+		"namespace": {"ns"},
+		"cluster":   {"cluster"},
+		"upgradeID": {"123"},
+		"phase":     {approvalPhaseControlPlane},
+	}
+	if got.Query().Encode() != want.Encode() {
+		t.Errorf("query = %s, want %s", got.Query().Encode(), want.Encode())
+	}
+}
+
+func TestURLApproves(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("phase") != approvalPhaseControlPlane {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	gate, err := newApprovalGate(logging.NewLogrusLoggerAdapter(logrus.New()), nil, "ns", "cluster", "123", ApprovalConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gate.urlApproves(approvalPhaseControlPlane) {
+		t.Error("expected the control plane to be approved")
+	}
+	if gate.urlApproves(approvalPhaseBatchPrefix + "1") {
+		t.Error("expected the first batch not to be approved")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationAutoscalerBounds holds, as JSON, the cluster autoscaler size annotations of a MachineDeployment while they
+// are pinned to its replicas during its rollout.
+const AnnotationAutoscalerBounds = annotationPrefix + "autoscaler-bounds"
+
+// Values for MachineDeploymentUpdateConfig.AutoscalerBounds.
+const (
+	// AutoscalerBoundsPin sets the minimum and maximum sizes of machine deployments scaled by the cluster autoscaler
+	// to their replicas while they roll out, and restores them afterwards.
+	AutoscalerBoundsPin = "pin"
+	// AutoscalerBoundsIgnore leaves the sizes of machine deployments scaled by the cluster autoscaler alone.
+	AutoscalerBoundsIgnore = "ignore"
+)
+
+// autoscalerSizeAnnotations are the annotations the Cluster API provider of the cluster autoscaler reads the minimum
+// and maximum sizes of a node group from, with the API group prefixes of its releases.
+var autoscalerSizeAnnotations = []struct{ min, max string }{
+	{min: "cluster.x-k8s.io/cluster-api-autoscaler-node-group-min-size", max: "cluster.x-k8s.io/cluster-api-autoscaler-node-group-max-size"},
+	{min: "cluster.k8s.io/cluster-api-autoscaler-node-group-min-size", max: "cluster.k8s.io/cluster-api-autoscaler-node-group-max-size"},
+}
+
+// parseAutoscalerBounds validates policy, defaulting it to AutoscalerBoundsPin.
+func parseAutoscalerBounds(policy string) (string, error) {
+	switch policy {
+	case "":
+		return AutoscalerBoundsPin, nil
+	case AutoscalerBoundsPin, AutoscalerBoundsIgnore:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid autoscaler bounds policy %q: must be one of %s, %s", policy, AutoscalerBoundsPin, AutoscalerBoundsIgnore)
+	}
+}
+
+// pinAutoscalerBounds sets the cluster autoscaler size annotations of md to its replicas, so that the autoscaler
+// neither scales it nor deletes the machines it creates as unneeded while it rolls out, saving the original values in
+// AnnotationAutoscalerBounds. Values already saved by an interrupted run are kept. It returns false if md is not scaled
+// by the cluster autoscaler.
+func pinAutoscalerBounds(md *clusterv1.MachineDeployment) (bool, error) {
+	original := make(map[string]string)
+	for _, a := range autoscalerSizeAnnotations {
+		for _, key := range []string{a.min, a.max} {
+			if value, ok := md.Annotations[key]; ok {
+				original[key] = value
+			}
+		}
+	}
+	if len(original) == 0 {
+		return false, nil
+	}
+
+	if _, ok := md.Annotations[AnnotationAutoscalerBounds]; !ok {
+		data, err := json.Marshal(original)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		md.Annotations[AnnotationAutoscalerBounds] = string(data)
+	}
+
+	replicas := int32(1)
+	if md.Spec.Replicas != nil {
+		replicas = *md.Spec.Replicas
+	}
+	for key := range original {
+		md.Annotations[key] = strconv.Itoa(int(replicas))
+	}
+	return true, nil
+}
+
+// restoreAutoscalerBounds sets the cluster autoscaler size annotations of md back to the values saved by
+// pinAutoscalerBounds. It returns false if md has no saved values.
+func restoreAutoscalerBounds(md *clusterv1.MachineDeployment) (bool, error) {
+	data, ok := md.Annotations[AnnotationAutoscalerBounds]
+	if !ok {
+		return false, nil
+	}
+	var original map[string]string
+	if err := json.Unmarshal([]byte(data), &original); err != nil {
+		return false, errors.Wrapf(err, "invalid %s annotation of machine deployment %s", AnnotationAutoscalerBounds, md.Name)
+	}
+
+	for key, value := range original {
+		md.Annotations[key] = value
+	}
+	delete(md.Annotations, AnnotationAutoscalerBounds)
+	return true, nil
+}
+
+// pinBatchAutoscalerBounds pins the cluster autoscaler sizes of the machine deployments of a batch before it rolls out,
+// and returns the names of those it pinned.
+func (u *MachineDeploymentUpgrader) pinBatchAutoscalerBounds(machineDeployments []clusterv1.MachineDeployment) ([]string, error) {
+	if u.autoscalerBounds != AutoscalerBoundsPin {
+		return nil, nil
+	}
+
+	var pinned []string
+	for _, name := range machineDeploymentNames(machineDeployments) {
+		md, err := u.getMachineDeployment(name)
+		if err != nil {
+			return nil, err
+		}
+		patch := ctrlclient.MergeFrom(md.DeepCopy())
+		ok, err := pinAutoscalerBounds(md)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		u.log.Info("Pinning cluster autoscaler sizes of MachineDeployment during its rollout", "name", name)
+		if err := u.managementClusterClient.Patch(context.TODO(), md, patch); err != nil {
+			return nil, errors.Wrapf(err, "error pinning the autoscaler sizes of machine deployment %s", name)
+		}
+		pinned = append(pinned, name)
+	}
+	return pinned, nil
+}
+
+// restoreBatchAutoscalerBounds restores the cluster autoscaler sizes of the machine deployments called names once they
+// rolled out.
+func (u *MachineDeploymentUpgrader) restoreBatchAutoscalerBounds(names []string) error {
+	for _, name := range names {
+		md, err := u.getMachineDeployment(name)
+		if err != nil {
+			return err
+		}
+		patch := ctrlclient.MergeFrom(md.DeepCopy())
+		ok, err := restoreAutoscalerBounds(md)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		u.log.Info("Restoring cluster autoscaler sizes of MachineDeployment", "name", name)
+		if err := u.managementClusterClient.Patch(context.TODO(), md, patch); err != nil {
+			return errors.Wrapf(err, "error restoring the autoscaler sizes of machine deployment %s", name)
+		}
+	}
+	return nil
+}
+
+// restoreLeftoverAutoscalerBounds restores the cluster autoscaler sizes that an interrupted run left pinned on the
+// machine deployments among machineDeployments that are not upgraded again, once they rolled out.
+func (u *MachineDeploymentUpgrader) restoreLeftoverAutoscalerBounds(machineDeployments, pending []clusterv1.MachineDeployment) error {
+	upgrading := make(map[string]bool)
+	for _, name := range machineDeploymentNames(pending) {
+		upgrading[name] = true
+	}
+
+	var leftover []clusterv1.MachineDeployment
+	for _, md := range machineDeployments {
+		if _, ok := md.Annotations[AnnotationAutoscalerBounds]; ok && !upgrading[md.Name] {
+			leftover = append(leftover, md)
+		}
+	}
+	if len(leftover) == 0 {
+		return nil
+	}
+
+	// TODO extract timeout as a configurable constant
+	if err := u.waitForRollout(leftover, machineDeploymentRolloutTimeout); err != nil {
+		return err
+	}
+	return u.restoreBatchAutoscalerBounds(machineDeploymentNames(leftover))
+}
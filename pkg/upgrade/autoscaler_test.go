@@ -0,0 +1,85 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestParseAutoscalerBounds(t *testing.T) {
+	policy, err := parseAutoscalerBounds("")
+	require.NoError(t, err)
+	assert.Equal(t, AutoscalerBoundsPin, policy)
+
+	policy, err = parseAutoscalerBounds(AutoscalerBoundsIgnore)
+	require.NoError(t, err)
+	assert.Equal(t, AutoscalerBoundsIgnore, policy)
+
+	_, err = parseAutoscalerBounds("disable")
+	assert.Error(t, err)
+}
+
+func TestPinAutoscalerBounds(t *testing.T) {
+	const (
+		minSize = "cluster.x-k8s.io/cluster-api-autoscaler-node-group-min-size"
+		maxSize = "cluster.x-k8s.io/cluster-api-autoscaler-node-group-max-size"
+	)
+	replicas := int32(4)
+	md := &clusterv1.MachineDeployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "md",
+			Annotations: map[string]string{minSize: "2", maxSize: "10", "other": "kept"},
+		},
+	}
+	md.Spec.Replicas = &replicas
+
+	ok, err := pinAutoscalerBounds(md)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "4", md.Annotations[minSize])
+	assert.Equal(t, "4", md.Annotations[maxSize])
+
+	// A rerun keeps the original sizes
+	ok, err = pinAutoscalerBounds(md)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = restoreAutoscalerBounds(md)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{minSize: "2", maxSize: "10", "other": "kept"}, md.Annotations)
+
+	ok, err = restoreAutoscalerBounds(md)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Not scaled by the autoscaler
+	plain := &clusterv1.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: "plain"}}
+	ok, err = pinAutoscalerBounds(plain)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, plain.Annotations)
+
+	// The older annotations, with only a maximum size
+	legacy := &clusterv1.MachineDeployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "legacy",
+			Annotations: map[string]string{"cluster.k8s.io/cluster-api-autoscaler-node-group-max-size": "5"},
+		},
+	}
+	ok, err = pinAutoscalerBounds(legacy)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", legacy.Annotations["cluster.k8s.io/cluster-api-autoscaler-node-group-max-size"])
+	assert.NotContains(t, legacy.Annotations, "cluster.k8s.io/cluster-api-autoscaler-node-group-min-size")
+
+	legacy.Annotations[AnnotationAutoscalerBounds] = "{"
+	_, err = restoreAutoscalerBounds(legacy)
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Values for Config.BootstrapCleanup.
+const (
+	// BootstrapCleanupWait waits for the bootstrap objects of deleted machines to be garbage collected.
+	BootstrapCleanupWait = "wait"
+	// BootstrapCleanupDelete deletes the bootstrap objects of deleted machines that nothing else owns, then waits for
+	// them to be gone.
+	BootstrapCleanupDelete = "delete"
+)
+
+// parseBootstrapCleanup validates policy, which may be empty to leave bootstrap objects alone.
+func parseBootstrapCleanup(policy string) (string, error) {
+	switch policy {
+	case "", BootstrapCleanupWait, BootstrapCleanupDelete:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid bootstrap cleanup policy %q: must be one of %s, %s", policy, BootstrapCleanupWait, BootstrapCleanupDelete)
+	}
+}
+
+// bootstrapObjects returns the bootstrap objects machine leaves behind once deleted: its KubeadmConfig and the
+// bootstrap data secret the bootstrap provider names after it, if any.
+func bootstrapObjects(machine *clusterv1.Machine) []v1.ObjectReference {
+	ref := machine.Spec.Bootstrap.ConfigRef
+	if ref == nil || ref.Kind != "KubeadmConfig" || ref.Name == "" {
+		return nil
+	}
+	return []v1.ObjectReference{
+		{APIVersion: ref.APIVersion, Kind: ref.Kind, Namespace: machine.Namespace, Name: ref.Name},
+		{APIVersion: "v1", Kind: "Secret", Namespace: machine.Namespace, Name: ref.Name},
+	}
+}
+
+// orphanedBy returns true if obj is only owned by machine or by its KubeadmConfig, so that nothing else uses it once
+// machine is deleted. Objects without owners are orphaned too.
+func orphanedBy(obj *unstructured.Unstructured, machine *clusterv1.Machine) bool {
+	for _, owner := range obj.GetOwnerReferences() {
+		switch {
+		case owner.Kind == "Machine" && owner.Name == machine.Name:
+		case owner.Kind == "KubeadmConfig" && machine.Spec.Bootstrap.ConfigRef != nil && owner.Name == machine.Spec.Bootstrap.ConfigRef.Name:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// lingeringBootstrapMessage describes a bootstrap object that still exists timeout after its machine was deleted.
+func lingeringBootstrapMessage(obj *unstructured.Unstructured, machine string, timeout time.Duration) string {
+	msg := fmt.Sprintf("%s %s still exists %s after machine %s was deleted", obj.GetKind(), obj.GetName(), timeout, machine)
+	if obj.GetDeletionTimestamp() != nil {
+		return msg + "; check its finalizers"
+	}
+	if len(obj.GetOwnerReferences()) == 0 {
+		return msg + "; it has no owner reference, so it is not garbage collected; delete it, or use --bootstrap-cleanup delete"
+	}
+	return msg + " and is not being deleted; check its owner references"
+}
+
+// cleanupBootstrapObjects waits for the bootstrap objects of the deleted machine to be garbage collected, deleting
+// those it orphaned first with BootstrapCleanupDelete. Objects still there after timeout are recorded as warnings. An
+// error is only returned if deleting or waiting fails.
+func (u *ControlPlaneUpgrader) cleanupBootstrapObjects(machine *clusterv1.Machine, timeout time.Duration) error {
+	for _, ref := range bootstrapObjects(machine) {
+		if err := u.cleanupBootstrapObject(machine, ref, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupBootstrapObject waits for the bootstrap object ref of the deleted machine to be gone.
+func (u *ControlPlaneUpgrader) cleanupBootstrapObject(machine *clusterv1.Machine, ref v1.ObjectReference, timeout time.Duration) error {
+	key := ctrlclient.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}
+	log := u.log.WithValues("kind", ref.Kind, "name", key.String())
+
+	deleted := false
+	var remaining *unstructured.Unstructured
+	err := wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		obj := new(unstructured.Unstructured)
+		obj.SetAPIVersion(ref.APIVersion)
+		obj.SetKind(ref.Kind)
+		if err := u.managementClusterClient.Get(context.TODO(), key, obj); err != nil {
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+			log.Error(err, "Error getting bootstrap object, will try again")
+			return false, nil
+		}
+		remaining = obj
+
+		if u.bootstrapCleanup == BootstrapCleanupDelete && !deleted && obj.GetDeletionTimestamp() == nil && orphanedBy(obj, machine) {
+			log.Info("Deleting orphaned bootstrap object")
+			if err := u.managementClusterClient.Delete(context.TODO(), obj); err != nil && !apierrors.IsNotFound(err) {
+				return false, errors.Wrapf(err, "error deleting %s %s", ref.Kind, key.String())
+			}
+			deleted = true
+			return false, nil
+		}
+
+		log.Info("Waiting for bootstrap object to be garbage collected")
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout && remaining != nil {
+		u.warnings.add(WarningBootstrapObjectLingering, fmt.Sprintf("%s/%s", machine.Namespace, machine.Name), "%s",
+			lingeringBootstrapMessage(remaining, machine.Name, timeout))
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error waiting for %s %s to be garbage collected", ref.Kind, key.String())
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestParseBootstrapCleanup(t *testing.T) {
+	for _, policy := range []string{"", BootstrapCleanupWait, BootstrapCleanupDelete} {
+		parsed, err := parseBootstrapCleanup(policy)
+		assert.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := parseBootstrapCleanup("orphan")
+	assert.Error(t, err)
+}
+
+func TestBootstrapObjects(t *testing.T) {
+	machine := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cp-0"}}
+	assert.Empty(t, bootstrapObjects(machine))
+
+	machine.Spec.Bootstrap.ConfigRef = &v1.ObjectReference{APIVersion: "bootstrap.cluster.x-k8s.io/v1alpha2", Kind: "KubeadmConfig", Name: "cp-0-config"}
+	assert.Equal(t, []v1.ObjectReference{
+		{APIVersion: "bootstrap.cluster.x-k8s.io/v1alpha2", Kind: "KubeadmConfig", Namespace: "default", Name: "cp-0-config"},
+		{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "cp-0-config"},
+	}, bootstrapObjects(machine))
+
+	machine.Spec.Bootstrap.ConfigRef.Kind = "TalosConfig"
+	assert.Empty(t, bootstrapObjects(machine))
+}
+
+func TestOrphanedBy(t *testing.T) {
+	machine := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "cp-0"}}
+	machine.Spec.Bootstrap.ConfigRef = &v1.ObjectReference{Kind: "KubeadmConfig", Name: "cp-0-config"}
+
+	obj := &unstructured.Unstructured{}
+	assert.True(t, orphanedBy(obj, machine))
+
+	obj.SetOwnerReferences([]metav1.OwnerReference{{Kind: "Machine", Name: "cp-0"}, {Kind: "KubeadmConfig", Name: "cp-0-config"}})
+	assert.True(t, orphanedBy(obj, machine))
+
+	obj.SetOwnerReferences([]metav1.OwnerReference{{Kind: "Machine", Name: "cp-1"}})
+	assert.False(t, orphanedBy(obj, machine))
+}
+
+func TestLingeringBootstrapMessage(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetKind("KubeadmConfig")
+	obj.SetName("cp-0-config")
+
+	assert.Equal(t,
+		"KubeadmConfig cp-0-config still exists 15m0s after machine cp-0 was deleted; it has no owner reference, so it is not garbage collected; delete it, or use --bootstrap-cleanup delete",
+		lingeringBootstrapMessage(obj, "cp-0", 15*time.Minute),
+	)
+
+	obj.SetOwnerReferences([]metav1.OwnerReference{{Kind: "Machine", Name: "cp-1"}})
+	assert.Equal(t,
+		"KubeadmConfig cp-0-config still exists 15m0s after machine cp-0 was deleted and is not being deleted; check its owner references",
+		lingeringBootstrapMessage(obj, "cp-0", 15*time.Minute),
+	)
+
+	now := metav1.Now()
+	obj.SetDeletionTimestamp(&now)
+	assert.Equal(t,
+		"KubeadmConfig cp-0-config still exists 15m0s after machine cp-0 was deleted; check its finalizers",
+		lingeringBootstrapMessage(obj, "cp-0", 15*time.Minute),
+	)
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// bootstrapDiagnosticsTimeout is how long the provider command collecting the console output of an instance may take.
+const bootstrapDiagnosticsTimeout = time.Minute
+
+// bootstrapVerdict tells whether the node of machine did not join because of its infrastructure, whose infrastructure
+// machine is infra with instanceState, or because the node failed to bootstrap, such as kubeadm join failing.
+func bootstrapVerdict(machine *clusterv1.Machine, infra *unstructured.Unstructured, instanceState string) string {
+	kind := machine.Spec.InfrastructureRef.Kind
+	name := machine.Spec.InfrastructureRef.Name
+	reason, _, _ := unstructured.NestedString(infra.Object, "status", "errorReason")
+	message, _, _ := unstructured.NestedString(infra.Object, "status", "errorMessage")
+	ready, _, _ := unstructured.NestedBool(infra.Object, "status", "ready")
+
+	switch {
+	case reason != "" || message != "":
+		return fmt.Sprintf("infrastructure failure: %s %s failed: %s", kind, name, strings.TrimSpace(reason+" "+message))
+	case !ready || machine.Spec.ProviderID == nil || *machine.Spec.ProviderID == "":
+		state := ""
+		if instanceState != "" {
+			state = fmt.Sprintf(", its instance is %s", instanceState)
+		}
+		return fmt.Sprintf("infrastructure failure: %s %s is not provisioned%s", kind, name, state)
+	case instanceState != "" && instanceState != "running":
+		return fmt.Sprintf("infrastructure failure: the instance of %s %s is %s", kind, name, instanceState)
+	default:
+		return fmt.Sprintf("bootstrap failure: %s %s is provisioned but its node did not join the cluster, check the kubeadm join output in the console output or the cloud-init logs of the instance", kind, name)
+	}
+}
+
+// withBootstrapDiagnostics adds to err, from waiting for the node of the replacement machine at replacementKey, why
+// the node did not join the cluster: whether its infrastructure or its bootstrap failed, the status and events of its
+// infrastructure machine and, for providers that have it, the console output of its instance.
+func (u *ControlPlaneUpgrader) withBootstrapDiagnostics(err error, replacementKey ctrlclient.ObjectKey) error {
+	if errors.Cause(err) != wait.ErrWaitTimeout {
+		return err
+	}
+
+	machine := &clusterv1.Machine{}
+	if getErr := u.managementClusterClient.Get(context.TODO(), replacementKey, machine); getErr != nil {
+		return errors.Wrapf(err, "unable to get machine %s for diagnostics: %v", replacementKey, getErr)
+	}
+	ref := machine.Spec.InfrastructureRef
+	infra, getErr := external.Get(u.managementClusterClient, &ref, machine.Namespace)
+	if getErr != nil {
+		return errors.Wrapf(err, "unable to get %s %s for diagnostics: %v", ref.Kind, ref.Name, getErr)
+	}
+	adapter := providerAdapterForKind(ref.Kind)
+	instanceState := adapter.instanceState(infra)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- machine %s: phase %s, infrastructure ready %t, bootstrap ready %t\n",
+		machine.Name, machine.Status.Phase, machine.Status.InfrastructureReady, machine.Status.BootstrapReady)
+	if instanceState != "" {
+		fmt.Fprintf(&b, "--- %s %s: instance state %s\n", ref.Kind, ref.Name, instanceState)
+	}
+	b.WriteString(u.infrastructureEvents(ref, machine.Namespace))
+	if machine.Spec.ProviderID != nil {
+		b.WriteString(consoleOutput(adapter, *machine.Spec.ProviderID))
+	}
+
+	return errors.Wrapf(err, "the node of machine %s did not join the cluster, %s\n%s",
+		machine.Name, bootstrapVerdict(machine, infra, instanceState), strings.TrimRight(b.String(), "\n"))
+}
+
+// infrastructureEvents returns the events of the infrastructure machine of ref, oldest first, such as the errors of
+// the provider creating its instance.
+func (u *ControlPlaneUpgrader) infrastructureEvents(ref v1.ObjectReference, namespace string) string {
+	events := &v1.EventList{}
+	err := u.managementClusterClient.List(context.TODO(), events, ctrlclient.InNamespace(namespace),
+		ctrlclient.MatchingFields{"involvedObject.kind": ref.Kind, "involvedObject.name": ref.Name})
+	if err != nil {
+		return fmt.Sprintf("--- unable to list the events of %s %s: %v\n", ref.Kind, ref.Name, err)
+	}
+	if len(events.Items) == 0 {
+		return ""
+	}
+
+	sort.Slice(events.Items, func(i, j int) bool {
+		return events.Items[i].LastTimestamp.Before(&events.Items[j].LastTimestamp)
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- events of %s %s:\n", ref.Kind, ref.Name)
+	for _, e := range events.Items {
+		fmt.Fprintf(&b, "%s %s %s: %s\n", e.LastTimestamp.UTC().Format(time.RFC3339), e.Type, e.Reason, e.Message)
+	}
+	return b.String()
+}
+
+// consoleOutput returns the tail of the console output of the instance with providerID, collected with the command of
+// adapter if it has one and it is installed.
+func consoleOutput(adapter providerAdapter, providerID string) string {
+	id, err := parseProviderID(providerID)
+	if err != nil {
+		return ""
+	}
+	args := adapter.consoleOutputCommand(id.ID())
+	if len(args) == 0 {
+		return ""
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Sprintf("--- %s is not installed, the console output of instance %s is not collected\n", args[0], id.ID())
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), bootstrapDiagnosticsTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Sprintf("--- unable to get the console output of instance %s: %v: %s\n", id.ID(), err, strings.TrimSpace(stderr.String()))
+	}
+	return fmt.Sprintf("--- last %d lines of the console output of instance %s:\n%s\n", componentLogTailLines, id.ID(), tailLines(stdout.String(), componentLogTailLines))
+}
+
+// tailLines returns the last n lines of s.
+func tailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestBootstrapVerdict(t *testing.T) {
+	providerID := "aws:///us-east-1a/i-0123"
+	tests := []struct {
+		name          string
+		providerID    *string
+		status        map[string]interface{}
+		instanceState string
+		verdict       string
+	}{
+		{
+			name:    "provider error",
+			status:  map[string]interface{}{"errorReason": "CreateError", "errorMessage": "InsufficientInstanceCapacity"},
+			verdict: "infrastructure failure: AWSMachine cp-1 failed: CreateError InsufficientInstanceCapacity",
+		},
+		{
+			name:          "not provisioned",
+			status:        map[string]interface{}{"ready": false},
+			instanceState: "pending",
+			verdict:       "infrastructure failure: AWSMachine cp-1 is not provisioned, its instance is pending",
+		},
+		{
+			name:    "no provider ID",
+			status:  map[string]interface{}{"ready": true},
+			verdict: "infrastructure failure: AWSMachine cp-1 is not provisioned",
+		},
+		{
+			name:          "instance stopped",
+			providerID:    &providerID,
+			status:        map[string]interface{}{"ready": true},
+			instanceState: "stopped",
+			verdict:       "infrastructure failure: the instance of AWSMachine cp-1 is stopped",
+		},
+		{
+			name:          "join failure",
+			providerID:    &providerID,
+			status:        map[string]interface{}{"ready": true},
+			instanceState: "running",
+			verdict:       "bootstrap failure: AWSMachine cp-1 is provisioned but its node did not join the cluster",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			machine := &clusterv1.Machine{Spec: clusterv1.MachineSpec{
+				InfrastructureRef: v1.ObjectReference{Kind: "AWSMachine", Name: "cp-1"},
+				ProviderID:        tt.providerID,
+			}}
+			infra := &unstructured.Unstructured{Object: map[string]interface{}{"status": tt.status}}
+			verdict := bootstrapVerdict(machine, infra, tt.instanceState)
+			assert.True(t, strings.HasPrefix(verdict, tt.verdict), verdict)
+		})
+	}
+}
+
+func TestConsoleOutputCommand(t *testing.T) {
+	assert.Equal(t, []string{"aws", "ec2", "get-console-output", "--instance-id", "i-0123", "--query", "Output", "--output", "text"},
+		providerAdapterForKind("AWSMachine").consoleOutputCommand("i-0123"))
+	assert.Nil(t, providerAdapterForKind("VSphereMachine").consoleOutputCommand("vm-1"))
+	assert.Nil(t, providerAdapterForKind("AWSMachine").consoleOutputCommand(""))
+}
+
+func TestTailLines(t *testing.T) {
+	assert.Equal(t, "b\nc", tailLines("a\nb\nc\n", 2))
+	assert.Equal(t, "a", tailLines("a\n", 2))
+}
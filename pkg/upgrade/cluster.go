@@ -0,0 +1,181 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// targetUnavailablePatience is how long requests to the target cluster are retried while its API server is
+// unavailable, which happens briefly while control plane machines are replaced.
+const targetUnavailablePatience = 3 * time.Minute
+
+const (
+	// defaultConnectTimeout is how long connecting to a cluster, and each request to the management cluster, may take
+	// by default.
+	defaultConnectTimeout = 30 * time.Second
+	// setupTimeoutFactor bounds the setup of the clients, which takes a few requests, to this many connect timeouts.
+	setupTimeoutFactor = 4
+)
+
+// parseConnectTimeout parses the connect timeout, defaulting to defaultConnectTimeout.
+func parseConnectTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return defaultConnectTimeout, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error parsing connect timeout %q", timeout)
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("invalid connect timeout %q: must be positive", timeout)
+	}
+	return d, nil
+}
+
+// newManagementClusterClient connects to the management cluster of config, failing within timeout if its API server
+// cannot be resolved or reached, or if it does not serve the Cluster API versions the tool supports. Each request of
+// the client is bounded by timeout.
+func newManagementClusterClient(log logr.Logger, config ManagementClusterConfig, timeout time.Duration) (ctrlclient.Client, error) {
+	const hint = "error connecting to the management cluster, check the server of its kubeconfig, given by --kubeconfig, $KUBECONFIG or ~/.kube/config and --context, and that it is reachable from here"
+	restConfig, err := newManagementRestConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, hint)
+	}
+	c, err := kubernetes2.NewClientForConfig(restConfig, timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, hint)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := checkClusterAPIVersions(ctx, log, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// clusterClients holds the clients needed to talk to both the management cluster and the target cluster.
+type clusterClients struct {
+	managementClusterClient ctrlclient.Client
+	cluster                 *clusterv1.Cluster
+	targetRestConfig        *rest.Config
+	targetKubernetesClient  kubernetes.Interface
+}
+
+// newClusterClients connects to the management cluster, retrieves the target cluster, and builds clients for the
+// target cluster from its kubeconfig source, by default its kubeconfig secret, reaching it as its access mode says.
+func newClusterClients(log logr.Logger, config Config) (*clusterClients, error) {
+	connectTimeout, err := parseConnectTimeout(config.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	readCacheTTL, err := parseReadCacheTTL(config.ReadCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeoutFactor*connectTimeout)
+	defer cancel()
+
+	managementClusterClient, err := newManagementClusterClient(log, config.ManagementCluster, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if readCacheTTL > 0 {
+		managementClusterClient = newReadCache(managementClusterClient, readCacheTTL)
+	}
+
+	log.Info("Retrieving cluster from management cluster", "cluster-namespace", config.TargetCluster.Namespace, "cluster-name", config.TargetCluster.Name)
+	cluster := &clusterv1.Cluster{}
+	err = managementClusterClient.Get(ctx, ctrlclient.ObjectKey{Namespace: config.TargetCluster.Namespace, Name: config.TargetCluster.Name}, cluster)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	source, err := newKubeconfigSource(config.TargetCluster.Kubeconfig, managementClusterClient, cluster)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := source.kubeconfig()
+	if err != nil {
+		return nil, err
+	}
+	targetRestConfig, err := newTargetRestConfig(kc, config.TargetCluster.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	if targetRestConfig == nil {
+		return nil, errors.New("could not get a kubeconfig for your target cluster")
+	}
+	if err := configureTargetAccess(log, config, managementClusterClient, cluster, targetRestConfig); err != nil {
+		return nil, err
+	}
+	connectCtx, cancelConnect := context.WithTimeout(ctx, connectTimeout)
+	defer cancelConnect()
+	if err := kubernetes2.CheckEndpoint(connectCtx, targetRestConfig); err != nil {
+		return nil, errors.Wrapf(err, "error connecting to target cluster %s/%s, check the server of its kubeconfig and that it is reachable from here, or reach it with --target-access",
+			config.TargetCluster.Namespace, config.TargetCluster.Name)
+	}
+	kubernetes2.WithAvailabilityRetry(targetRestConfig, targetUnavailablePatience, func(reason string) {
+		log.Info("Target control plane transitioning, waiting for the API server to become available", "reason", reason)
+	})
+	kubernetes2.WithReadOnly(targetRestConfig)
+
+	log.Info("Creating target kubernetes client")
+	targetKubernetesClient, err := kubernetes.NewForConfig(targetRestConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating target cluster client")
+	}
+
+	return &clusterClients{
+		managementClusterClient: managementClusterClient,
+		cluster:                 cluster,
+		targetRestConfig:        targetRestConfig,
+		targetKubernetesClient:  targetKubernetesClient,
+	}, nil
+}
+
+// listControlPlaneMachines returns all control plane machines for the cluster that are not being deleted.
+func listControlPlaneMachines(log logr.Logger, c ctrlclient.Client, namespace, clusterName string) ([]*clusterv1.Machine, error) {
+	return listControlPlaneMachinesDeleting(log, c, namespace, clusterName, false)
+}
+
+// listControlPlaneMachinesDeleting lists the control plane machines of the cluster that are being deleted, if deleting
+// is set, or that are not.
+func listControlPlaneMachinesDeleting(log logr.Logger, c ctrlclient.Client, namespace, clusterName string, deleting bool) ([]*clusterv1.Machine, error) {
+	labels := ctrlclient.MatchingLabels{
+		clusterv1.MachineClusterLabelName:      clusterName,
+		clusterv1.MachineControlPlaneLabelName: "true",
+	}
+	listOptions := []ctrlclient.ListOption{
+		labels,
+		ctrlclient.InNamespace(namespace),
+	}
+	machines := &clusterv1.MachineList{}
+
+	log.Info("Listing machines", "labelSelector", labels)
+	err := c.List(context.TODO(), machines, listOptions...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing machines")
+	}
+
+	var ret []*clusterv1.Machine
+	for i := range machines.Items {
+		m := machines.Items[i]
+		if m.DeletionTimestamp.IsZero() != deleting {
+			ret = append(ret, &m)
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// clusterAPIKind is a kind of Cluster API, or of its kubeadm bootstrap provider, the tool reads or writes, and the
+// versions of it the tool supports.
+type clusterAPIKind struct {
+	group    string
+	kind     string
+	versions []string
+}
+
+// supportedClusterAPIKinds is the compatibility table of the tool: the versions of the Cluster API and kubeadm
+// bootstrap provider kinds it is built against.
+var supportedClusterAPIKinds = []clusterAPIKind{
+	{group: clusterv1.GroupVersion.Group, kind: "Cluster", versions: []string{clusterv1.GroupVersion.Version}},
+	{group: clusterv1.GroupVersion.Group, kind: "Machine", versions: []string{clusterv1.GroupVersion.Version}},
+	{group: clusterv1.GroupVersion.Group, kind: "MachineSet", versions: []string{clusterv1.GroupVersion.Version}},
+	{group: clusterv1.GroupVersion.Group, kind: "MachineDeployment", versions: []string{clusterv1.GroupVersion.Version}},
+	{group: bootstrapv1.GroupVersion.Group, kind: "KubeadmConfig", versions: []string{bootstrapv1.GroupVersion.Version}},
+}
+
+// servedVersions returns the versions the CustomResourceDefinition crd serves, from its versions, or in v1beta1 its
+// single version.
+func servedVersions(crd *unstructured.Unstructured) []string {
+	var ret []string
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		v, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := v["name"].(string)
+		if served, _ := v["served"].(bool); served && name != "" {
+			ret = append(ret, name)
+		}
+	}
+	if len(versions) == 0 {
+		if version, _, _ := unstructured.NestedString(crd.Object, "spec", "version"); version != "" {
+			ret = append(ret, version)
+		}
+	}
+	return ret
+}
+
+// clusterAPIVersionProblems checks that the CustomResourceDefinitions crds serve a supported version of each kind of
+// supportedClusterAPIKinds.
+func clusterAPIVersionProblems(crds []unstructured.Unstructured) []string {
+	var problems []string
+	for _, k := range supportedClusterAPIKinds {
+		crd := findCustomResourceDefinition(crds, k.group, k.kind)
+		if crd == nil {
+			problems = append(problems, fmt.Sprintf("no custom resource definition defines %s in %s, install Cluster API and its kubeadm bootstrap provider", k.kind, k.group))
+			continue
+		}
+		served := servedVersions(crd)
+		if !sets.NewString(served...).HasAny(k.versions...) {
+			problems = append(problems, fmt.Sprintf("%s of %s is served at %s, this tool supports %s", k.kind, k.group, strings.Join(served, ", "), strings.Join(k.versions, ", ")))
+		}
+	}
+	return problems
+}
+
+// checkClusterAPIVersions refuses to go on with a management cluster that does not serve the versions of the Cluster
+// API kinds the tool supports, rather than failing later on objects it cannot decode. The check is skipped if custom
+// resource definitions cannot be listed.
+func checkClusterAPIVersions(ctx context.Context, log logr.Logger, c ctrlclient.Client) error {
+	crds, err := listCustomResourceDefinitions(ctx, c)
+	if apierrors.IsForbidden(errors.Cause(err)) {
+		log.Info("Skipping the Cluster API version check, custom resource definitions cannot be listed", "error", err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if problems := clusterAPIVersionProblems(crds); len(problems) > 0 {
+		return errors.Errorf("the management cluster is not compatible with this tool: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// testCRD returns a v1 CustomResourceDefinition of kind in group serving versions.
+func testCRD(group, kind string, versions ...string) unstructured.Unstructured {
+	var specVersions []interface{}
+	for _, v := range versions {
+		specVersions = append(specVersions, map[string]interface{}{"name": v, "served": true})
+	}
+	return unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"group":    group,
+			"names":    map[string]interface{}{"kind": kind},
+			"versions": specVersions,
+		},
+	}}
+}
+
+func TestServedVersions(t *testing.T) {
+	crd := testCRD("cluster.x-k8s.io", "Machine", "v1alpha2", "v1alpha3")
+	crd.Object["spec"].(map[string]interface{})["versions"] = append(crd.Object["spec"].(map[string]interface{})["versions"].([]interface{}),
+		map[string]interface{}{"name": "v1alpha1", "served": false})
+	assert.Equal(t, []string{"v1alpha2", "v1alpha3"}, servedVersions(&crd))
+
+	v1beta1 := unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"version": "v1alpha2"}}}
+	assert.Equal(t, []string{"v1alpha2"}, servedVersions(&v1beta1))
+}
+
+func TestClusterAPIVersionProblems(t *testing.T) {
+	crds := []unstructured.Unstructured{
+		testCRD("cluster.x-k8s.io", "Cluster", "v1alpha2", "v1alpha3"),
+		testCRD("cluster.x-k8s.io", "Machine", "v1alpha2"),
+		testCRD("cluster.x-k8s.io", "MachineSet", "v1alpha2"),
+		testCRD("cluster.x-k8s.io", "MachineDeployment", "v1alpha2"),
+		testCRD("bootstrap.cluster.x-k8s.io", "KubeadmConfig", "v1alpha2"),
+	}
+	assert.Empty(t, clusterAPIVersionProblems(crds))
+
+	crds[1] = testCRD("cluster.x-k8s.io", "Machine", "v1alpha3")
+	assert.Equal(t, []string{
+		"Machine of cluster.x-k8s.io is served at v1alpha3, this tool supports v1alpha2",
+		"no custom resource definition defines KubeadmConfig in bootstrap.cluster.x-k8s.io, install Cluster API and its kubeadm bootstrap provider",
+	}, clusterAPIVersionProblems(crds[:4]))
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// clusterSecretNames returns the names of the cluster certificate secrets owned by a control plane KubeadmConfig.
+func clusterSecretNames(clusterName string) []string {
+	return []string{
+		fmt.Sprintf("%s-ca", clusterName),
+		fmt.Sprintf("%s-etcd", clusterName),
+		fmt.Sprintf("%s-sa", clusterName),
+		fmt.Sprintf("%s-proxy", clusterName),
+	}
+}
+
+// staleKubeadmConfigRefs returns the KubeadmConfig owner references in refs that do not point to an existing
+// KubeadmConfig. existing maps the names of the KubeadmConfigs in the namespace to their UIDs.
+func staleKubeadmConfigRefs(refs []metav1.OwnerReference, existing map[string]types.UID) []metav1.OwnerReference {
+	var stale []metav1.OwnerReference
+	for _, ref := range refs {
+		if ref.Kind != "KubeadmConfig" {
+			continue
+		}
+		uid, ok := existing[ref.Name]
+		if !ok || (ref.UID != "" && ref.UID != uid) {
+			stale = append(stale, ref)
+		}
+	}
+	return stale
+}
+
+// kubeadmConfigUIDs returns the UIDs of the KubeadmConfigs in the cluster namespace, keyed by name.
+func (u *ControlPlaneUpgrader) kubeadmConfigUIDs() (map[string]types.UID, error) {
+	list := &bootstrapv1.KubeadmConfigList{}
+	if err := u.managementClusterClient.List(context.TODO(), list, ctrlclient.InNamespace(u.clusterNamespace)); err != nil {
+		return nil, errors.Wrap(err, "error listing kubeadm configs")
+	}
+
+	uids := make(map[string]types.UID, len(list.Items))
+	for _, config := range list.Items {
+		uids[config.Name] = config.UID
+	}
+	return uids, nil
+}
+
+// setSecretOwner replaces the secret's owner references with owner. If upgradeID is not empty, it is recorded on the
+// secret so reruns of the same upgrade know the secret has already been updated.
+func (u *ControlPlaneUpgrader) setSecretOwner(secret *v1.Secret, owner *bootstrapv1.KubeadmConfig, upgradeID string) error {
+	helper, err := patch.NewHelper(secret.DeepCopy(), u.managementClusterClient)
+	if err != nil {
+		return err
+	}
+
+	secret.SetOwnerReferences([]metav1.OwnerReference{
+		{
+			APIVersion: bootstrapv1.GroupVersion.String(),
+			Kind:       "KubeadmConfig",
+			Name:       owner.Name,
+			UID:        owner.UID,
+		},
+	})
+	if upgradeID != "" {
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		secret.Annotations[AnnotationUpgradeID] = upgradeID
+	}
+
+	return errors.Wrapf(helper.Patch(context.TODO(), secret), "error patching secret %s/%s", secret.Namespace, secret.Name)
+}
+
+// updateSecretOwners makes owner the owner of the cluster certificate secrets. Secrets that were already updated by
+// this upgrade are left alone, unless their owner references no longer point to an existing KubeadmConfig.
+func (u *ControlPlaneUpgrader) updateSecretOwners(owner *bootstrapv1.KubeadmConfig) error {
+	uids, err := u.kubeadmConfigUIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, secretName := range clusterSecretNames(u.clusterName) {
+		log := u.log.WithValues("secret", secretName)
+
+		secret := &v1.Secret{}
+		secretKey := ctrlclient.ObjectKey{Name: secretName, Namespace: u.clusterNamespace}
+		if err := u.managementClusterClient.Get(context.TODO(), secretKey, secret); err != nil {
+			return errors.WithStack(err)
+		}
+
+		stale := staleKubeadmConfigRefs(secret.OwnerReferences, uids)
+		if secret.Annotations[AnnotationUpgradeID] == u.upgradeID && len(stale) == 0 {
+			log.Info("Secret owner already updated for this upgrade")
+			continue
+		}
+
+		log.Info("Updating secret owner", "kubeadm-config", owner.Name)
+		if err := u.setSecretOwner(secret, owner, u.upgradeID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// repairSecretOwners points cluster certificate secrets whose KubeadmConfig owner references are stale, for example
+// after an interrupted upgrade, at the KubeadmConfig of an existing control plane machine.
+func (u *ControlPlaneUpgrader) repairSecretOwners(machines []*clusterv1.Machine) error {
+	uids, err := u.kubeadmConfigUIDs()
+	if err != nil {
+		return err
+	}
+
+	var owner *bootstrapv1.KubeadmConfig
+
+	for _, secretName := range clusterSecretNames(u.clusterName) {
+		secret := &v1.Secret{}
+		secretKey := ctrlclient.ObjectKey{Name: secretName, Namespace: u.clusterNamespace}
+		if err := u.managementClusterClient.Get(context.TODO(), secretKey, secret); err != nil {
+			return errors.WithStack(err)
+		}
+
+		stale := staleKubeadmConfigRefs(secret.OwnerReferences, uids)
+		if len(stale) == 0 {
+			continue
+		}
+
+		if owner == nil {
+			owner, err = u.liveKubeadmConfig(machines)
+			if err != nil {
+				return err
+			}
+		}
+
+		u.log.Info("Repairing stale secret owner", "secret", secretName, "stale-owner", stale[0].Name, "kubeadm-config", owner.Name)
+		if err := u.setSecretOwner(secret, owner, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// liveKubeadmConfig returns the KubeadmConfig of the first of machines that has one.
+func (u *ControlPlaneUpgrader) liveKubeadmConfig(machines []*clusterv1.Machine) (*bootstrapv1.KubeadmConfig, error) {
+	for _, machine := range machines {
+		ref := machine.Spec.Bootstrap.ConfigRef
+		if ref == nil || ref.Kind != "KubeadmConfig" {
+			continue
+		}
+
+		config := &bootstrapv1.KubeadmConfig{}
+		key := ctrlclient.ObjectKey{Namespace: machine.Namespace, Name: ref.Name}
+		if err := u.managementClusterClient.Get(context.TODO(), key, config); err != nil {
+			return nil, errors.Wrapf(err, "error getting kubeadm config %s", key.String())
+		}
+		return config, nil
+	}
+
+	return nil, errors.New("no control plane machine has a KubeadmConfig to own the cluster secrets")
+}
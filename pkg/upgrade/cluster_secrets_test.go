@@ -0,0 +1,54 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestStaleKubeadmConfigRefs(t *testing.T) {
+	existing := map[string]types.UID{
+		"cp-0": "uid-0",
+		"cp-1": "uid-1",
+	}
+
+	tests := []struct {
+		name     string
+		refs     []metav1.OwnerReference
+		expected []string
+	}{
+		{
+			name: "current owner",
+			refs: []metav1.OwnerReference{{Kind: "KubeadmConfig", Name: "cp-0", UID: "uid-0"}},
+		},
+		{
+			name:     "deleted owner",
+			refs:     []metav1.OwnerReference{{Kind: "KubeadmConfig", Name: "cp-2", UID: "uid-2"}},
+			expected: []string{"cp-2"},
+		},
+		{
+			name:     "recreated owner",
+			refs:     []metav1.OwnerReference{{Kind: "KubeadmConfig", Name: "cp-1", UID: "uid-old"}},
+			expected: []string{"cp-1"},
+		},
+		{
+			name: "other kinds are ignored",
+			refs: []metav1.OwnerReference{{Kind: "Cluster", Name: "cluster", UID: "uid-cluster"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var names []string
+			for _, ref := range staleKubeadmConfigRefs(tc.refs, existing) {
+				names = append(names, ref.Name)
+			}
+			assert.Equal(t, tc.expected, names)
+		})
+	}
+}
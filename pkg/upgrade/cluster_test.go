@@ -0,0 +1,27 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConnectTimeout(t *testing.T) {
+	d, err := parseConnectTimeout("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultConnectTimeout, d)
+
+	d, err = parseConnectTimeout("1m")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, d)
+
+	_, err = parseConnectTimeout("-1s")
+	assert.Error(t, err)
+	_, err = parseConnectTimeout("quickly")
+	assert.Error(t, err)
+}
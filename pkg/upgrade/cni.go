@@ -0,0 +1,111 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// cniDaemonSet is a DaemonSet of the target cluster running the CNI plugin on every node.
+type cniDaemonSet struct {
+	namespace string
+	name      string
+}
+
+func (d cniDaemonSet) String() string {
+	return d.namespace + "/" + d.name
+}
+
+// parseCNIDaemonSets parses DaemonSets of the form "namespace/name", or "name" in kube-system.
+func parseCNIDaemonSets(daemonSets []string) ([]cniDaemonSet, error) {
+	var ret []cniDaemonSet
+	for _, d := range daemonSets {
+		namespace, name := "kube-system", d
+		if parts := strings.SplitN(d, "/", 2); len(parts) == 2 {
+			namespace, name = parts[0], parts[1]
+		}
+		if namespace == "" || name == "" {
+			return nil, errors.Errorf("invalid CNI daemonset %q, must be namespace/name", d)
+		}
+		ret = append(ret, cniDaemonSet{namespace: namespace, name: name})
+	}
+	return ret, nil
+}
+
+// cniPodProblem returns why the CNI pod on nodeName, among pods, is not ready, or an empty string if it is.
+func cniPodProblem(pods []v1.Pod, nodeName string) string {
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.NodeName != nodeName || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if missing := missingPodConditions(pod); missing.Len() > 0 {
+			return fmt.Sprintf("pod %s is missing conditions %v", pod.Name, missing.List())
+		}
+		return ""
+	}
+	return "no pod on the node yet"
+}
+
+// cniDaemonSetProblems returns the CNI DaemonSets that do not exist in the target cluster.
+func (u *ControlPlaneUpgrader) cniDaemonSetProblems() ([]string, error) {
+	var problems []string
+	for _, d := range u.cniDaemonSets {
+		_, err := u.targetKubernetesClient.AppsV1().DaemonSets(d.namespace).Get(d.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			problems = append(problems, fmt.Sprintf("CNI daemonset %s not found", d))
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting CNI daemonset %s", d)
+		}
+	}
+	return problems, nil
+}
+
+// waitForCNIPods waits for the pod of each CNI DaemonSet on node nodeName to be ready, so that pod networking works on
+// the node before it counts as upgraded.
+func (u *ControlPlaneUpgrader) waitForCNIPods(nodeName string, timeout time.Duration) error {
+	for _, d := range u.cniDaemonSets {
+		log := u.log.WithValues("daemonset", d.String(), "node", nodeName)
+		log.Info("Waiting for the CNI pod to be ready")
+
+		problem := ""
+		err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+			daemonSet, err := u.targetKubernetesClient.AppsV1().DaemonSets(d.namespace).Get(d.name, metav1.GetOptions{})
+			if err != nil {
+				log.Error(err, "Error getting CNI daemonset, will try again")
+				return false, nil
+			}
+			selector, err := metav1.LabelSelectorAsSelector(daemonSet.Spec.Selector)
+			if err != nil {
+				return false, errors.Wrapf(err, "invalid selector of CNI daemonset %s", d)
+			}
+			pods, err := u.targetKubernetesClient.CoreV1().Pods(d.namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+			if err != nil {
+				log.Error(err, "Error listing CNI pods, will try again")
+				return false, nil
+			}
+
+			problem = cniPodProblem(pods.Items, nodeName)
+			if problem != "" {
+				log.Info("Waiting for the CNI pod", "problem", problem)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "CNI daemonset %s is not ready on node %s: %s", d, nodeName, problem)
+		}
+	}
+	return nil
+}
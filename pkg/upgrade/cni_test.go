@@ -0,0 +1,50 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCNIDaemonSets(t *testing.T) {
+	daemonSets, err := parseCNIDaemonSets([]string{"kube-system/calico-node", "cilium", "tigera/calico-node"})
+	require.NoError(t, err)
+	assert.Equal(t, []cniDaemonSet{
+		{namespace: "kube-system", name: "calico-node"},
+		{namespace: "kube-system", name: "cilium"},
+		{namespace: "tigera", name: "calico-node"},
+	}, daemonSets)
+
+	for _, d := range []string{"", "kube-system/", "/calico-node"} {
+		_, err := parseCNIDaemonSets([]string{d})
+		assert.Error(t, err, d)
+	}
+}
+
+func TestCNIPodProblem(t *testing.T) {
+	pod := func(name, node string, ready bool) v1.Pod {
+		p := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: v1.PodSpec{NodeName: node}}
+		if ready {
+			for condition := range requiredPodConditions {
+				p.Status.Conditions = append(p.Status.Conditions, v1.PodCondition{Type: v1.PodConditionType(condition), Status: v1.ConditionTrue})
+			}
+		}
+		return p
+	}
+
+	pods := []v1.Pod{pod("calico-a", "node-a", true), pod("calico-b", "node-b", false)}
+	assert.Empty(t, cniPodProblem(pods, "node-a"))
+	assert.Contains(t, cniPodProblem(pods, "node-b"), "pod calico-b is missing conditions")
+	assert.Equal(t, "no pod on the node yet", cniPodProblem(pods, "node-c"))
+
+	// A pod being deleted is not the one the node will run
+	terminating := pod("calico-c", "node-c", true)
+	terminating.DeletionTimestamp = &metav1.Time{}
+	assert.Equal(t, "no pod on the node yet", cniPodProblem([]v1.Pod{terminating}, "node-c"))
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Actions the etcd member commands of a colocated etcd are run with.
+const (
+	etcdMemberJoin   = "join"
+	etcdMemberRemove = "remove"
+)
+
+// colocatedEtcdEndpoints returns the endpoints of endpoints served by the control plane nodes nodes, by one of their
+// addresses or names, or by the loopback address of each of them.
+func colocatedEtcdEndpoints(endpoints []string, nodes []v1.Node) []string {
+	hosts := map[string]bool{}
+	for _, node := range nodes {
+		hosts[node.Name] = true
+		for _, address := range node.Status.Addresses {
+			hosts[address.Address] = true
+		}
+	}
+
+	var ret []string
+	for _, endpoint := range endpoints {
+		parsed, err := url.Parse(endpoint)
+		if err != nil || parsed.Hostname() == "" {
+			continue
+		}
+		host := parsed.Hostname()
+		if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || host == "localhost" || hosts[host] {
+			ret = append(ret, endpoint)
+		}
+	}
+	return ret
+}
+
+// colocatedEtcdProblems returns why the members of a colocated etcd cannot be replaced with the machines.
+func (u *ControlPlaneUpgrader) colocatedEtcdProblems() []string {
+	if !u.etcdColocated || u.externalEtcd.MemberRemoveCommand != "" {
+		return nil
+	}
+	return []string{"the etcd members of the machines replaced cannot be removed without a member remove command; set --etcd-member-remove-command"}
+}
+
+// etcdMemberCommand is a run of an etcd member command for a machine of a colocated etcd and its replacement.
+type etcdMemberCommand struct {
+	action    string
+	cluster   ctrlclient.ObjectKey
+	endpoints []string
+	// machine and node are the machine replaced and its node, whose hostname names its etcd member.
+	machine string
+	node    *v1.Node
+	// replacement and replacementNode are the replacement machine and its node.
+	replacement     string
+	replacementNode *v1.Node
+}
+
+// env returns the environment variables describing the run to the command.
+func (c etcdMemberCommand) env() []string {
+	return []string{
+		"ETCD_MEMBER_ACTION=" + c.action,
+		"ETCD_ENDPOINTS=" + strings.Join(c.endpoints, ","),
+		"CLUSTER_NAMESPACE=" + c.cluster.Namespace,
+		"CLUSTER_NAME=" + c.cluster.Name,
+		"MACHINE_NAME=" + c.machine,
+		"NODE_NAME=" + c.node.Name,
+		"NODE_HOSTNAME=" + hostnameForNode(c.node),
+		"REPLACEMENT_MACHINE_NAME=" + c.replacement,
+		"REPLACEMENT_NODE_NAME=" + c.replacementNode.Name,
+		"REPLACEMENT_NODE_HOSTNAME=" + hostnameForNode(c.replacementNode),
+	}
+}
+
+// run runs command with the action as its argument and the run described by its environment. Commands may run again
+// for the same machine when an upgrade is resumed, so they must be idempotent.
+func (c etcdMemberCommand) run(command string) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), machineReplacementStepTimeout)
+	defer cancel()
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, c.action)
+	cmd.Env = append(os.Environ(), c.env()...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "etcd member %s command %s failed for node %s: %s", c.action, command, c.node.Name, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// replaceColocatedEtcdMember hands the etcd member of the node of machine over to the node of its replacement, with
+// the member join command, if any, then the member remove command.
+func (u *ControlPlaneUpgrader) replaceColocatedEtcdMember(replacementKey ctrlclient.ObjectKey, machine *clusterv1.Machine, oldNode, node *v1.Node) error {
+	c := etcdMemberCommand{
+		cluster:         ctrlclient.ObjectKey{Namespace: u.clusterNamespace, Name: u.clusterName},
+		endpoints:       u.externalEtcd.Endpoints,
+		machine:         machine.Name,
+		node:            oldNode,
+		replacement:     replacementKey.Name,
+		replacementNode: node,
+	}
+
+	if u.externalEtcd.MemberJoinCommand != "" {
+		c.action = etcdMemberJoin
+		u.log.Info("Running the etcd member join command", "node", node.Name, "command", u.externalEtcd.MemberJoinCommand)
+		if err := c.run(u.externalEtcd.MemberJoinCommand); err != nil {
+			return err
+		}
+	}
+
+	u.record.machinePhase(machine.Name, MachinePhaseRemovingEtcdMember)
+	c.action = etcdMemberRemove
+	u.log.Info("Running the etcd member remove command", "node", oldNode.Name, "command", u.externalEtcd.MemberRemoveCommand)
+	if err := c.run(u.externalEtcd.MemberRemoveCommand); err != nil {
+		return err
+	}
+	u.record.event("Removed the etcd member of node %s with %s", oldNode.Name, u.externalEtcd.MemberRemoveCommand)
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestColocatedEtcdEndpoints(t *testing.T) {
+	nodes := []v1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: "cp-0"},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeInternalIP, Address: "10.0.0.10"},
+			{Type: v1.NodeHostName, Address: "ip-10-0-0-10"},
+		}},
+	}}
+
+	tests := []struct {
+		name      string
+		endpoints []string
+		expected  []string
+	}{
+		{name: "shared etcd", endpoints: []string{"https://etcd-0.example.com:2379", "https://10.0.1.5:2379"}},
+		{name: "node address", endpoints: []string{"https://10.0.0.10:2379", "https://10.0.0.11:2379"}, expected: []string{"https://10.0.0.10:2379"}},
+		{name: "node hostname", endpoints: []string{"https://ip-10-0-0-10:2379"}, expected: []string{"https://ip-10-0-0-10:2379"}},
+		{name: "node name", endpoints: []string{"https://cp-0:2379"}, expected: []string{"https://cp-0:2379"}},
+		{name: "loopback", endpoints: []string{"https://127.0.0.1:2379"}, expected: []string{"https://127.0.0.1:2379"}},
+		{name: "invalid", endpoints: []string{"10.0.0.10:2379"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, colocatedEtcdEndpoints(tt.endpoints, nodes))
+		})
+	}
+}
+
+func TestColocatedEtcdProblems(t *testing.T) {
+	u := &ControlPlaneUpgrader{}
+	assert.Empty(t, u.colocatedEtcdProblems())
+
+	u.etcdColocated = true
+	assert.Len(t, u.colocatedEtcdProblems(), 1)
+
+	u.externalEtcd.MemberRemoveCommand = "/usr/local/bin/remove-etcd-member"
+	assert.Empty(t, u.colocatedEtcdProblems())
+}
+
+func TestEtcdMemberCommandRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-member-command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	command := filepath.Join(dir, "member")
+	script := "#!/bin/sh\necho \"$1 $ETCD_MEMBER_ACTION $CLUSTER_NAMESPACE/$CLUSTER_NAME $NODE_HOSTNAME $REPLACEMENT_NODE_HOSTNAME $ETCD_ENDPOINTS\" > " + out + "\n"
+	require.NoError(t, ioutil.WriteFile(command, []byte(script), 0700))
+
+	c := etcdMemberCommand{
+		action:          etcdMemberRemove,
+		cluster:         ctrlclient.ObjectKey{Namespace: "default", Name: "test"},
+		endpoints:       []string{"https://10.0.0.10:2379", "https://10.0.0.11:2379"},
+		machine:         "cp-0",
+		node:            &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "cp-0"}, Status: v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeHostName, Address: "ip-10-0-0-10"}}}},
+		replacement:     "cp-0.123",
+		replacementNode: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "cp-1"}, Status: v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeHostName, Address: "ip-10-0-0-12"}}}},
+	}
+	require.NoError(t, c.run(command))
+	written, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "remove remove default/test ip-10-0-0-10 ip-10-0-0-12 https://10.0.0.10:2379,https://10.0.0.11:2379\n", string(written))
+
+	failing := filepath.Join(dir, "failing")
+	require.NoError(t, ioutil.WriteFile(failing, []byte("#!/bin/sh\necho \"member not found\"\nexit 1\n"), 0700))
+	err = c.run(failing)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "etcd member remove command")
+	assert.Contains(t, err.Error(), "member not found")
+}
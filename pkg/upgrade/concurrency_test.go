@@ -0,0 +1,170 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeManagementAPIServer serves the discovery, custom resource definitions, clusters and machines the setup of a
+// ControlPlaneUpgrader reads, for clusters of any name, acting as both the management and the target cluster.
+func fakeManagementAPIServer(t *testing.T) *httptest.Server {
+	resources := map[string]metav1.APIResourceList{
+		"/api/v1": {GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"},
+			{Name: "secrets", Namespaced: true, Kind: "Secret"},
+			{Name: "pods", Namespaced: true, Kind: "Pod"},
+			{Name: "nodes", Kind: "Node"},
+		}},
+		"/apis/cluster.x-k8s.io/v1alpha2": {GroupVersion: "cluster.x-k8s.io/v1alpha2", APIResources: []metav1.APIResource{
+			{Name: "clusters", Namespaced: true, Kind: "Cluster"},
+			{Name: "machines", Namespaced: true, Kind: "Machine"},
+			{Name: "machinesets", Namespaced: true, Kind: "MachineSet"},
+			{Name: "machinedeployments", Namespaced: true, Kind: "MachineDeployment"},
+		}},
+		"/apis/bootstrap.cluster.x-k8s.io/v1alpha2": {GroupVersion: "bootstrap.cluster.x-k8s.io/v1alpha2", APIResources: []metav1.APIResource{
+			{Name: "kubeadmconfigs", Namespaced: true, Kind: "KubeadmConfig"},
+		}},
+		"/apis/apiextensions.k8s.io/v1": {GroupVersion: "apiextensions.k8s.io/v1", APIResources: []metav1.APIResource{
+			{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"},
+		}},
+	}
+	groups := &metav1.APIGroupList{}
+	for path := range resources {
+		if !strings.HasPrefix(path, "/apis/") {
+			continue
+		}
+		gv := strings.TrimPrefix(path, "/apis/")
+		parts := strings.Split(gv, "/")
+		version := metav1.GroupVersionForDiscovery{GroupVersion: gv, Version: parts[1]}
+		groups.Groups = append(groups.Groups, metav1.APIGroup{Name: parts[0], Versions: []metav1.GroupVersionForDiscovery{version}, PreferredVersion: version})
+	}
+
+	var crds []interface{}
+	for _, k := range supportedClusterAPIKinds {
+		crds = append(crds, testCRD(k.group, k.kind, k.versions...).Object)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var body interface{}
+		switch {
+		case r.URL.Path == "/api":
+			body = &metav1.APIVersions{Versions: []string{"v1"}}
+		case r.URL.Path == "/apis":
+			body = groups
+		case r.URL.Path == "/apis/apiextensions.k8s.io/v1/customresourcedefinitions":
+			body = map[string]interface{}{"apiVersion": "apiextensions.k8s.io/v1", "kind": "CustomResourceDefinitionList", "items": crds}
+		case strings.HasPrefix(r.URL.Path, "/apis/cluster.x-k8s.io/v1alpha2/namespaces/") && strings.Contains(r.URL.Path, "/clusters/"):
+			parts := strings.Split(r.URL.Path, "/")
+			body = map[string]interface{}{
+				"apiVersion": "cluster.x-k8s.io/v1alpha2",
+				"kind":       "Cluster",
+				"metadata":   map[string]interface{}{"namespace": parts[5], "name": parts[7]},
+			}
+		case strings.HasSuffix(r.URL.Path, "/machines"):
+			body = map[string]interface{}{"apiVersion": "cluster.x-k8s.io/v1alpha2", "kind": "MachineList", "items": []interface{}{}}
+		default:
+			list, ok := resources[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			body = &list
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(body))
+	}))
+}
+
+// writeTestKubeconfig writes a kubeconfig for server to a file in dir, and returns its path.
+func writeTestKubeconfig(t *testing.T, dir, server string) string {
+	path := filepath.Join(dir, "kubeconfig")
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+users:
+- name: test
+  user:
+    token: test
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+`, server)
+	require.NoError(t, ioutil.WriteFile(path, []byte(kubeconfig), 0600))
+	return path
+}
+
+// TestConcurrentControlPlaneUpgraders sets up control plane upgraders of several clusters concurrently from one shared
+// configuration, as fleet upgrades do. Run with -race, as make test-race does, it verifies that upgraders share no
+// mutable state and that the configuration is not changed.
+func TestConcurrentControlPlaneUpgraders(t *testing.T) {
+	server := fakeManagementAPIServer(t)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "concurrent-upgraders")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kubeconfig := writeTestKubeconfig(t, dir, server.URL)
+
+	base := Config{
+		ManagementCluster: ManagementClusterConfig{Kubeconfig: kubeconfig},
+		TargetCluster: TargetClusterConfig{
+			Namespace:  "default",
+			Kubeconfig: KubeconfigSourceConfig{File: kubeconfig},
+		},
+		KubernetesVersion: "v1.16.3",
+		UpgradeID:         "123",
+		ExtraLabels:       map[string]string{"team": "platform"},
+		MachineUpdates: MachineUpdateConfig{
+			ImagesByKind: map[string]ImageUpdateConfig{"AWSMachine": {ID: "ami-123"}},
+		},
+	}
+	original := base
+	original.ExtraLabels = map[string]string{"team": "platform"}
+	original.MachineUpdates.ImagesByKind = map[string]ImageUpdateConfig{"AWSMachine": {ID: "ami-123"}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			config := base
+			config.TargetCluster.Name = fmt.Sprintf("cluster-%d", i)
+
+			u, err := newControlPlaneUpgrader(logrtesting.NullLogger{}, config)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, config.TargetCluster.Name, u.clusterName)
+			machines, err := u.listMachines()
+			assert.NoError(t, err)
+			assert.Empty(t, machines)
+			u.warnings.add(WarningMachineWithoutProviderID, u.clusterName, "warning of %s", u.clusterName)
+			assert.Len(t, u.Warnings(), 1)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, reflect.DeepEqual(original, base), "the shared configuration was changed")
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Values for Config.ConcurrentOperations.
+const (
+	// ConcurrentOperationsWarn reports other Cluster API operations in progress as warnings and upgrades anyway.
+	ConcurrentOperationsWarn = "warn"
+	// ConcurrentOperationsBlock refuses to upgrade while other Cluster API operations are in progress.
+	ConcurrentOperationsBlock = "block"
+)
+
+// parseConcurrentOperations validates policy, defaulting it to ConcurrentOperationsWarn.
+func parseConcurrentOperations(policy string) (string, error) {
+	switch policy {
+	case "":
+		return ConcurrentOperationsWarn, nil
+	case ConcurrentOperationsWarn, ConcurrentOperationsBlock:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid concurrent operations policy %q: must be one of %s, %s", policy, ConcurrentOperationsWarn, ConcurrentOperationsBlock)
+	}
+}
+
+// clusterOperations are the Cluster API objects of a cluster that roll out, scale, and delete machines.
+type clusterOperations struct {
+	machineDeployments []clusterv1.MachineDeployment
+	machineSets        []clusterv1.MachineSet
+	machines           []clusterv1.Machine
+}
+
+// listClusterOperations lists the machine deployments, machine sets, and machines of a cluster.
+func listClusterOperations(log logr.Logger, c ctrlclient.Client, namespace, clusterName string) (*clusterOperations, error) {
+	listOptions := []ctrlclient.ListOption{
+		ctrlclient.MatchingLabels{clusterv1.MachineClusterLabelName: clusterName},
+		ctrlclient.InNamespace(namespace),
+	}
+
+	log.Info("Listing machine deployments, machine sets and machines for concurrent operations")
+	machineDeployments := &clusterv1.MachineDeploymentList{}
+	if err := c.List(context.TODO(), machineDeployments, listOptions...); err != nil {
+		return nil, errors.Wrap(err, "error listing machine deployments")
+	}
+	machineSets := &clusterv1.MachineSetList{}
+	if err := c.List(context.TODO(), machineSets, listOptions...); err != nil {
+		return nil, errors.Wrap(err, "error listing machine sets")
+	}
+	machines := &clusterv1.MachineList{}
+	if err := c.List(context.TODO(), machines, listOptions...); err != nil {
+		return nil, errors.Wrap(err, "error listing machines")
+	}
+
+	return &clusterOperations{
+		machineDeployments: machineDeployments.Items,
+		machineSets:        machineSets.Items,
+		machines:           machines.Items,
+	}, nil
+}
+
+// concurrentOperationProblems returns the operations in progress that could overlap with an upgrade: machine
+// deployments rolling out, machine sets scaling or being deleted, and machines being deleted. Upgrading on top of them
+// commonly leaves a cluster in a mixed state. The operations of upgradeID itself, which are expected when an upgrade is
+// resumed, are ignored: machine deployments it updated, and control plane machines it already replaced. Machine sets
+// and machines are not reported on their own when their machine deployment is already accounted for.
+func concurrentOperationProblems(ops *clusterOperations, upgradeID string) []string {
+	var problems []string
+
+	accounted := sets.NewString()
+	for i := range ops.machineDeployments {
+		md := &ops.machineDeployments[i]
+		if md.Spec.Template.Annotations[AnnotationUpgradeID] == upgradeID {
+			accounted.Insert(md.Name)
+			continue
+		}
+		if !md.DeletionTimestamp.IsZero() {
+			accounted.Insert(md.Name)
+			problems = append(problems, fmt.Sprintf("machinedeployment %s/%s is being deleted", md.Namespace, md.Name))
+			continue
+		}
+		if !machineDeploymentRolledOut(md) {
+			accounted.Insert(md.Name)
+			problems = append(problems, fmt.Sprintf("machinedeployment %s/%s is rolling out (%d replicas, %d updated, %d available)",
+				md.Namespace, md.Name, md.Status.Replicas, md.Status.UpdatedReplicas, md.Status.AvailableReplicas))
+		}
+	}
+
+	accountedSets := sets.NewString()
+	for i := range ops.machineSets {
+		ms := &ops.machineSets[i]
+		if owner := metav1.GetControllerOf(ms); owner != nil && owner.Kind == "MachineDeployment" && accounted.Has(owner.Name) {
+			accountedSets.Insert(ms.Name)
+			continue
+		}
+
+		desired := int32(1)
+		if ms.Spec.Replicas != nil {
+			desired = *ms.Spec.Replicas
+		}
+		switch {
+		case !ms.DeletionTimestamp.IsZero():
+			accountedSets.Insert(ms.Name)
+			problems = append(problems, fmt.Sprintf("machineset %s/%s is being deleted", ms.Namespace, ms.Name))
+		case ms.Status.ObservedGeneration < ms.Generation || ms.Status.Replicas != desired:
+			accountedSets.Insert(ms.Name)
+			problems = append(problems, fmt.Sprintf("machineset %s/%s is scaling from %d to %d replicas", ms.Namespace, ms.Name, ms.Status.Replicas, desired))
+		}
+	}
+
+	names := sets.NewString()
+	for _, m := range ops.machines {
+		names.Insert(m.Name)
+	}
+	for _, m := range ops.machines {
+		if m.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if owner := metav1.GetControllerOf(&m); owner != nil && owner.Kind == "MachineSet" && accountedSets.Has(owner.Name) {
+			continue
+		}
+		if names.Has(generateReplacementMachineName(m.Name, upgradeID)) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("machine %s/%s is being deleted", m.Namespace, m.Name))
+	}
+
+	return problems
+}
+
+// checkConcurrentOperations looks for other Cluster API operations in progress on the cluster. With
+// ConcurrentOperationsBlock they are returned as an error, otherwise they are added to warnings.
+func checkConcurrentOperations(log logr.Logger, c ctrlclient.Client, namespace, clusterName, upgradeID, policy string, warnings *warningCollector) error {
+	ops, err := listClusterOperations(log, c, namespace, clusterName)
+	if err != nil {
+		return err
+	}
+
+	problems := concurrentOperationProblems(ops, upgradeID)
+	if len(problems) == 0 {
+		return nil
+	}
+	if policy == ConcurrentOperationsBlock {
+		return errors.Errorf("refusing to upgrade while other operations are in progress, wait for them to finish or rerun with --concurrent-operations=%s to upgrade anyway: %s",
+			ConcurrentOperationsWarn, strings.Join(problems, "; "))
+	}
+	for _, p := range problems {
+		warnings.add(WarningConcurrentOperation, "", "%s", p)
+	}
+	return nil
+}
+
+// precheckConcurrentOperations reports the other Cluster API operations in progress on the cluster.
+func (u *ControlPlaneUpgrader) precheckConcurrentOperations() ([]string, error) {
+	ops, err := listClusterOperations(u.log, u.managementClusterClient, u.clusterNamespace, u.clusterName)
+	if err != nil {
+		return nil, err
+	}
+	return concurrentOperationProblems(ops, u.upgradeID), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestConcurrentOperationProblems(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	now := metav1.Now()
+	controller := true
+	ownedBy := func(kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+	}
+
+	rolledOut := func(name string) clusterv1.MachineDeployment {
+		return clusterv1.MachineDeployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Spec:       clusterv1.MachineDeploymentSpec{Replicas: replicas(2)},
+			Status:     clusterv1.MachineDeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+		}
+	}
+	rollingOut := func(name string) clusterv1.MachineDeployment {
+		md := rolledOut(name)
+		md.Status.UpdatedReplicas = 1
+		return md
+	}
+	ours := rollingOut("ours")
+	ours.Spec.Template.Annotations = map[string]string{AnnotationUpgradeID: "123"}
+
+	scaling := func(name string, owners []metav1.OwnerReference) clusterv1.MachineSet {
+		return clusterv1.MachineSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, OwnerReferences: owners},
+			Spec:       clusterv1.MachineSetSpec{Replicas: replicas(3)},
+			Status:     clusterv1.MachineSetStatus{Replicas: 2},
+		}
+	}
+	deleting := func(name string, owners []metav1.OwnerReference) clusterv1.Machine {
+		return clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, OwnerReferences: owners, DeletionTimestamp: &now}}
+	}
+
+	tests := []struct {
+		name     string
+		ops      clusterOperations
+		expected []string
+	}{
+		{
+			name: "idle",
+			ops: clusterOperations{
+				machineDeployments: []clusterv1.MachineDeployment{rolledOut("md")},
+				machines:           []clusterv1.Machine{{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "m"}}},
+			},
+		},
+		{
+			name: "machine deployment rolling out, with its machine set and machines",
+			ops: clusterOperations{
+				machineDeployments: []clusterv1.MachineDeployment{rollingOut("md")},
+				machineSets:        []clusterv1.MachineSet{scaling("ms", ownedBy("MachineDeployment", "md"))},
+				machines:           []clusterv1.Machine{deleting("m", ownedBy("MachineSet", "ms"))},
+			},
+			expected: []string{"machinedeployment ns/md is rolling out (2 replicas, 1 updated, 2 available)"},
+		},
+		{
+			name: "machine set scaling and machine being deleted",
+			ops: clusterOperations{
+				machineSets: []clusterv1.MachineSet{scaling("ms", nil)},
+				machines:    []clusterv1.Machine{deleting("m", nil)},
+			},
+			expected: []string{
+				"machineset ns/ms is scaling from 2 to 3 replicas",
+				"machine ns/m is being deleted",
+			},
+		},
+		{
+			name: "operations of the upgrade being resumed",
+			ops: clusterOperations{
+				machineDeployments: []clusterv1.MachineDeployment{ours},
+				machineSets:        []clusterv1.MachineSet{scaling("ms", ownedBy("MachineDeployment", "ours"))},
+				machines: []clusterv1.Machine{
+					deleting("cp", nil),
+					{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: generateReplacementMachineName("cp", "123")}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, concurrentOperationProblems(&tc.ops, "123"))
+		})
+	}
+}
+
+func TestParseConcurrentOperations(t *testing.T) {
+	policy, err := parseConcurrentOperations("")
+	assert.NoError(t, err)
+	assert.Equal(t, ConcurrentOperationsWarn, policy)
+
+	policy, err = parseConcurrentOperations(ConcurrentOperationsBlock)
+	assert.NoError(t, err)
+	assert.Equal(t, ConcurrentOperationsBlock, policy)
+
+	_, err = parseConcurrentOperations("ignore")
+	assert.Error(t, err)
+}
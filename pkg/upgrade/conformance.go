@@ -0,0 +1,398 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Phases of the conformance runs of an upgrade.
+const (
+	conformanceBefore = "before"
+	conformanceAfter  = "after"
+)
+
+const (
+	// defaultConformanceTimeout bounds each conformance run unless Config.Conformance.Timeout is set.
+	defaultConformanceTimeout = time.Hour
+	// conformanceCleanupTimeout bounds the steps of a conformance run other than running the checks, such as deleting
+	// it or retrieving its results.
+	conformanceCleanupTimeout = 10 * time.Minute
+	// conformanceJobLogTailLines is how many lines of the logs of a conformance job are kept as its summary.
+	conformanceJobLogTailLines = 20
+)
+
+// sonobuoyStatusRegex matches the status of each plugin in the output of sonobuoy results.
+var sonobuoyStatusRegex = regexp.MustCompile(`(?m)^Status:\s*(\S+)`)
+
+// ConformanceRun is the summary of a conformance run before or after the upgrade.
+type ConformanceRun struct {
+	// Phase is "before" or "after" the upgrade.
+	Phase      string    `json:"phase"`
+	Runner     string    `json:"runner"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Passed     bool      `json:"passed"`
+	Summary    string    `json:"summary,omitempty"`
+}
+
+// conformanceRunner runs the conformance checks of a cluster.
+type conformanceRunner interface {
+	// name describes the runner in the report.
+	name() string
+	// run runs the checks, returning whether they passed and their summary. An error is only returned if they could
+	// not be run.
+	run(phase string) (bool, string, error)
+}
+
+// newConformanceRunner returns the runner configured in config for the target cluster reached with restConfig and
+// client, or nil if none is configured. Runs of the upgrade upgradeID are named after it.
+func newConformanceRunner(log logr.Logger, config ConformanceConfig, access TargetAccessConfig, restConfig *rest.Config, client kubernetes.Interface, upgradeID string) (conformanceRunner, error) {
+	if config.Sonobuoy == "" && config.Job == "" {
+		return nil, nil
+	}
+	if config.Sonobuoy != "" && config.Job != "" {
+		return nil, errors.New("only one of a Sonobuoy conformance run or a conformance job can be set")
+	}
+	timeout := defaultConformanceTimeout
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing conformance timeout %q", config.Timeout)
+		}
+		if d <= 0 {
+			return nil, errors.Errorf("invalid conformance timeout %q: must be positive", config.Timeout)
+		}
+		timeout = d
+	}
+
+	if config.Job != "" {
+		job, err := loadConformanceJob(config.Job)
+		if err != nil {
+			return nil, err
+		}
+		return &jobConformanceRunner{log: log, client: client, job: job, upgradeID: upgradeID, timeout: timeout}, nil
+	}
+
+	mode, _, err := parseTargetAccess(access)
+	if err != nil {
+		return nil, err
+	}
+	if mode != TargetAccessDirect {
+		return nil, errors.Errorf("Sonobuoy conformance runs need the %s target access mode, as the sonobuoy CLI connects to the target cluster itself: use a conformance job instead", TargetAccessDirect)
+	}
+	if _, err := exec.LookPath("sonobuoy"); err != nil {
+		return nil, errors.Wrap(err, "the sonobuoy CLI is required for Sonobuoy conformance runs")
+	}
+	return &sonobuoyConformanceRunner{log: log, restConfig: restConfig, mode: config.Sonobuoy, timeout: timeout}, nil
+}
+
+// runConformance runs the conformance checks of phase, if configured, and adds their summary to the report, with the
+// error as the summary of checks that could not be run. Checks that fail, or cannot be run, after the upgrade are
+// recorded as a warning. An error is only returned if the checks could not be run before the upgrade, which then does
+// not start.
+func (u *ControlPlaneUpgrader) runConformance(phase string) error {
+	if u.conformance == nil {
+		return nil
+	}
+	u.log.Info("Running conformance checks", "phase", phase, "runner", u.conformance.name())
+	run := ConformanceRun{Phase: phase, Runner: u.conformance.name(), StartedAt: time.Now()}
+	passed, summary, err := u.conformance.run(phase)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		err = errors.Wrapf(err, "error running the conformance checks %s the upgrade", phase)
+		run.Summary = err.Error()
+		u.record.conformance(run)
+		u.record.event("Conformance checks %s the upgrade could not be run", phase)
+		if phase == conformanceAfter {
+			u.warnings.add(WarningConformanceFailed, "", "%v", err)
+			return nil
+		}
+		return err
+	}
+	run.Passed = passed
+	run.Summary = summary
+	u.record.conformance(run)
+	outcome := "failed"
+	if passed {
+		outcome = "passed"
+	}
+	u.record.event("Conformance checks %s the upgrade %s", phase, outcome)
+
+	if phase == conformanceAfter && !passed {
+		u.warnings.add(WarningConformanceFailed, "", "conformance checks failed after the upgrade%s; see the conformance summaries of the report",
+			conformanceBeforeOutcome(u.record))
+	}
+	return nil
+}
+
+// conformanceBeforeOutcome describes the outcome of the conformance run before the upgrade recorded by record, if any.
+func conformanceBeforeOutcome(record *runRecorder) string {
+	if record == nil {
+		return ""
+	}
+	for _, run := range record.report.Conformance {
+		if run.Phase != conformanceBefore {
+			continue
+		}
+		if run.Passed {
+			return " while they passed before it"
+		}
+		return ", as they did before it"
+	}
+	return ""
+}
+
+// sonobuoyConformanceRunner runs Sonobuoy with the sonobuoy CLI.
+type sonobuoyConformanceRunner struct {
+	log        logr.Logger
+	restConfig *rest.Config
+	mode       string
+	timeout    time.Duration
+}
+
+func (r *sonobuoyConformanceRunner) name() string {
+	return "sonobuoy " + r.mode
+}
+
+func (r *sonobuoyConformanceRunner) run(phase string) (bool, string, error) {
+	dir, err := ioutil.TempDir("", "upgrade-sonobuoy")
+	if err != nil {
+		return false, "", errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kubeconfig, err := restConfigKubeconfig(r.restConfig)
+	if err != nil {
+		return false, "", err
+	}
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfigPath, kubeconfig, 0600); err != nil {
+		return false, "", errors.Wrap(err, "error writing the kubeconfig of sonobuoy")
+	}
+
+	// A run left behind by an interrupted upgrade would make sonobuoy run fail
+	if _, err := runSonobuoy(conformanceCleanupTimeout, "delete", "--wait", "--kubeconfig", kubeconfigPath); err != nil {
+		return false, "", err
+	}
+	defer func() {
+		if _, err := runSonobuoy(conformanceCleanupTimeout, "delete", "--wait", "--kubeconfig", kubeconfigPath); err != nil {
+			r.log.Error(err, "Unable to delete the Sonobuoy run", "phase", phase)
+		}
+	}()
+
+	minutes := int(math.Ceil(r.timeout.Minutes()))
+	if _, err := runSonobuoy(r.timeout, "run", "--mode", r.mode, fmt.Sprintf("--wait=%d", minutes), "--kubeconfig", kubeconfigPath); err != nil {
+		return false, "", err
+	}
+	tarball, err := runSonobuoy(conformanceCleanupTimeout, "retrieve", dir, "--kubeconfig", kubeconfigPath)
+	if err != nil {
+		return false, "", err
+	}
+	results, err := runSonobuoy(conformanceCleanupTimeout, "results", tarball)
+	if err != nil {
+		return false, "", err
+	}
+	return sonobuoyPassed(results), results, nil
+}
+
+// runSonobuoy runs the sonobuoy command with args for at most timeout, returning its trimmed output.
+func runSonobuoy(timeout time.Duration, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sonobuoy", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "error running sonobuoy %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// sonobuoyPassed returns true if every plugin in the output of sonobuoy results passed.
+func sonobuoyPassed(results string) bool {
+	statuses := sonobuoyStatusRegex.FindAllStringSubmatch(results, -1)
+	if len(statuses) == 0 {
+		return false
+	}
+	for _, status := range statuses {
+		if status[1] != "passed" {
+			return false
+		}
+	}
+	return true
+}
+
+// restConfigKubeconfig returns a kubeconfig connecting as restConfig does, for CLIs run against the target cluster.
+func restConfigKubeconfig(restConfig *rest.Config) ([]byte, error) {
+	user := clientcmdv1.AuthInfo{
+		ClientCertificate:     restConfig.CertFile,
+		ClientCertificateData: restConfig.CertData,
+		ClientKey:             restConfig.KeyFile,
+		ClientKeyData:         restConfig.KeyData,
+		Token:                 restConfig.BearerToken,
+		TokenFile:             restConfig.BearerTokenFile,
+		Username:              restConfig.Username,
+		Password:              restConfig.Password,
+		Impersonate:           restConfig.Impersonate.UserName,
+		ImpersonateGroups:     restConfig.Impersonate.Groups,
+		ImpersonateUserExtra:  restConfig.Impersonate.Extra,
+	}
+	if p := restConfig.AuthProvider; p != nil {
+		user.AuthProvider = &clientcmdv1.AuthProviderConfig{Name: p.Name, Config: p.Config}
+	}
+	if e := restConfig.ExecProvider; e != nil {
+		user.Exec = &clientcmdv1.ExecConfig{Command: e.Command, Args: e.Args, APIVersion: e.APIVersion}
+		for _, env := range e.Env {
+			user.Exec.Env = append(user.Exec.Env, clientcmdv1.ExecEnvVar{Name: env.Name, Value: env.Value})
+		}
+	}
+
+	// Written with the v1 types, as the internal ones are not meant to be serialized directly
+	config := clientcmdv1.Config{
+		Kind:       "Config",
+		APIVersion: "v1",
+		Clusters: []clientcmdv1.NamedCluster{{Name: "target", Cluster: clientcmdv1.Cluster{
+			Server:                   restConfig.Host,
+			CertificateAuthority:     restConfig.CAFile,
+			CertificateAuthorityData: restConfig.CAData,
+			InsecureSkipTLSVerify:    restConfig.Insecure,
+		}}},
+		AuthInfos:      []clientcmdv1.NamedAuthInfo{{Name: "target", AuthInfo: user}},
+		Contexts:       []clientcmdv1.NamedContext{{Name: "target", Context: clientcmdv1.Context{Cluster: "target", AuthInfo: "target"}}},
+		CurrentContext: "target",
+	}
+	data, err := yaml.Marshal(config)
+	return data, errors.Wrap(err, "error writing the target cluster kubeconfig")
+}
+
+// loadConformanceJob reads the Job manifest at path.
+func loadConformanceJob(path string) (*batchv1.Job, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading conformance job %s", path)
+	}
+	job := &batchv1.Job{}
+	if err := yaml.UnmarshalStrict(data, job); err != nil {
+		return nil, errors.Wrapf(err, "error parsing conformance job %s", path)
+	}
+	if job.Kind != "Job" || (job.Name == "" && job.GenerateName == "") {
+		return nil, errors.Errorf("invalid conformance job %s: it must be a Job with a name", path)
+	}
+	if job.Namespace == "" {
+		job.Namespace = metav1.NamespaceDefault
+	}
+	return job, nil
+}
+
+// jobConformanceRunner runs a Job in the target cluster, which passes if the job completes.
+type jobConformanceRunner struct {
+	log       logr.Logger
+	client    kubernetes.Interface
+	job       *batchv1.Job
+	upgradeID string
+	timeout   time.Duration
+}
+
+func (r *jobConformanceRunner) name() string {
+	return fmt.Sprintf("job %s/%s", r.job.Namespace, r.jobName())
+}
+
+// jobName is the name of the job, or its generate name prefix.
+func (r *jobConformanceRunner) jobName() string {
+	if r.job.Name != "" {
+		return r.job.Name
+	}
+	return r.job.GenerateName
+}
+
+func (r *jobConformanceRunner) run(phase string) (bool, string, error) {
+	job := r.job.DeepCopy()
+	job.GenerateName = strings.TrimSuffix(r.jobName(), "-") + "-" + phase + "-"
+	job.Name = ""
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[AnnotationUpgradeID] = r.upgradeID
+
+	created, err := r.client.BatchV1().Jobs(job.Namespace).Create(job)
+	if err != nil {
+		return false, "", errors.Wrapf(err, "error creating conformance job %s/%s", job.Namespace, job.GenerateName)
+	}
+	log := r.log.WithValues("job", created.Namespace+"/"+created.Name)
+	defer func() {
+		background := metav1.DeletePropagationBackground
+		if err := r.client.BatchV1().Jobs(created.Namespace).Delete(created.Name, &metav1.DeleteOptions{PropagationPolicy: &background}); err != nil {
+			log.Error(err, "Unable to delete conformance job")
+		}
+	}()
+
+	var passed bool
+	err = wait.PollImmediate(10*time.Second, r.timeout, func() (bool, error) {
+		current, err := r.client.BatchV1().Jobs(created.Namespace).Get(created.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Error(err, "Error getting conformance job, will try again")
+			return false, nil
+		}
+		for _, c := range current.Status.Conditions {
+			if c.Status != v1.ConditionTrue {
+				continue
+			}
+			switch c.Type {
+			case batchv1.JobComplete:
+				passed = true
+				return true, nil
+			case batchv1.JobFailed:
+				return true, nil
+			}
+		}
+		log.Info("Waiting for conformance job to finish")
+		return false, nil
+	})
+	if err != nil {
+		return false, "", errors.Wrapf(err, "error waiting for conformance job %s/%s to finish", created.Namespace, created.Name)
+	}
+	return passed, r.logs(created), nil
+}
+
+// logs returns the last lines of the logs of the pods of job.
+func (r *jobConformanceRunner) logs(job *batchv1.Job) string {
+	pods, err := r.client.CoreV1().Pods(job.Namespace).List(metav1.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		return fmt.Sprintf("unable to list the pods of job %s: %v", job.Name, err)
+	}
+	var b strings.Builder
+	tailLines := int64(conformanceJobLogTailLines)
+	for _, pod := range pods.Items {
+		logs, err := r.client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{TailLines: &tailLines}).Do().Raw()
+		if err != nil {
+			fmt.Fprintf(&b, "--- unable to get logs of pod %s: %v\n", pod.Name, err)
+			continue
+		}
+		fmt.Fprintf(&b, "--- last %d lines of pod %s (%s):\n%s\n", conformanceJobLogTailLines, pod.Name, pod.Status.Phase, strings.TrimRight(string(logs), "\n"))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
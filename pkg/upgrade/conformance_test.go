@@ -0,0 +1,188 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const conformanceJobManifest = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: smoke
+spec:
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: smoke
+        image: busybox
+`
+
+func TestSonobuoyPassed(t *testing.T) {
+	assert.True(t, sonobuoyPassed("Plugin: e2e\nStatus: passed\nTotal: 1\n\nPlugin: systemd-logs\nStatus: passed\n"))
+	assert.False(t, sonobuoyPassed("Plugin: e2e\nStatus: failed\nTotal: 1\n\nPlugin: systemd-logs\nStatus: passed\n"))
+	assert.False(t, sonobuoyPassed(""))
+}
+
+func TestRestConfigKubeconfig(t *testing.T) {
+	restConfig := &rest.Config{
+		Host:            "https://10.0.0.1:6443",
+		BearerToken:     "token",
+		TLSClientConfig: rest.TLSClientConfig{CAData: []byte("ca")},
+		Impersonate:     rest.ImpersonationConfig{UserName: "upgrader"},
+	}
+	data, err := restConfigKubeconfig(restConfig)
+	assert.NoError(t, err)
+
+	loaded, err := clientcmd.RESTConfigFromKubeConfig(data)
+	assert.NoError(t, err)
+	assert.Equal(t, restConfig.Host, loaded.Host)
+	assert.Equal(t, "token", loaded.BearerToken)
+	assert.Equal(t, []byte("ca"), loaded.CAData)
+	assert.Equal(t, "upgrader", loaded.Impersonate.UserName)
+}
+
+func TestNewConformanceRunner(t *testing.T) {
+	log := logging.NewLogrusLoggerAdapter(logrus.New())
+	dir, err := ioutil.TempDir("", "conformance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "job.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(conformanceJobManifest), 0600))
+
+	runner, err := newConformanceRunner(log, ConformanceConfig{}, TargetAccessConfig{}, nil, nil, "1")
+	assert.NoError(t, err)
+	assert.Nil(t, runner)
+
+	runner, err = newConformanceRunner(log, ConformanceConfig{Job: path}, TargetAccessConfig{}, nil, nil, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "job default/smoke", runner.name())
+
+	_, err = newConformanceRunner(log, ConformanceConfig{Job: path, Sonobuoy: "quick"}, TargetAccessConfig{}, nil, nil, "1")
+	assert.Error(t, err)
+	_, err = newConformanceRunner(log, ConformanceConfig{Job: path, Timeout: "0s"}, TargetAccessConfig{}, nil, nil, "1")
+	assert.Error(t, err)
+	_, err = newConformanceRunner(log, ConformanceConfig{Sonobuoy: "quick"}, TargetAccessConfig{Mode: TargetAccessSOCKS5}, nil, nil, "1")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("kind: Pod\nmetadata:\n  name: smoke\n"), 0600))
+	_, err = newConformanceRunner(log, ConformanceConfig{Job: path}, TargetAccessConfig{}, nil, nil, "1")
+	assert.Error(t, err)
+}
+
+func TestJobConformanceRunner(t *testing.T) {
+	for _, condition := range []batchv1.JobConditionType{batchv1.JobComplete, batchv1.JobFailed} {
+		t.Run(string(condition), func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			// The fake clientset neither generates names nor runs jobs
+			client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+				job.Name = job.GenerateName + "abcde"
+				job.Status.Conditions = []batchv1.JobCondition{{Type: condition, Status: v1.ConditionTrue}}
+				return false, nil, nil
+			})
+
+			dir, err := ioutil.TempDir("", "conformance")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "job.yaml")
+			assert.NoError(t, ioutil.WriteFile(path, []byte(conformanceJobManifest), 0600))
+			job, err := loadConformanceJob(path)
+			assert.NoError(t, err)
+			runner := &jobConformanceRunner{
+				log:       logging.NewLogrusLoggerAdapter(logrus.New()),
+				client:    client,
+				job:       job,
+				upgradeID: "1",
+				timeout:   time.Second,
+			}
+			passed, _, err := runner.run(conformanceBefore)
+			assert.NoError(t, err)
+			assert.Equal(t, condition == batchv1.JobComplete, passed)
+
+			var created *batchv1.Job
+			for _, action := range client.Actions() {
+				if action.Matches("create", "jobs") {
+					created = action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+				}
+			}
+			if assert.NotNil(t, created) {
+				assert.Equal(t, "smoke-before-", created.GenerateName)
+				assert.Equal(t, "1", created.Annotations[AnnotationUpgradeID])
+			}
+			jobs, err := client.BatchV1().Jobs("default").List(metav1.ListOptions{})
+			assert.NoError(t, err)
+			assert.Empty(t, jobs.Items)
+		})
+	}
+}
+
+func TestConformanceReport(t *testing.T) {
+	report := RunReport{
+		Cluster: "default/workload",
+		Conformance: []ConformanceRun{
+			{Phase: conformanceBefore, Runner: "sonobuoy quick", Passed: true, Summary: "Status: passed"},
+			{Phase: conformanceAfter, Runner: "sonobuoy quick", Summary: "Status: failed"},
+		},
+	}
+	for _, format := range []string{reportFormatMarkdown, reportFormatHTML} {
+		var b bytes.Buffer
+		assert.NoError(t, writeReport(&b, format, report))
+		assert.Contains(t, b.String(), "Conformance before the upgrade")
+		assert.Contains(t, b.String(), "Status: failed")
+	}
+}
+
+// erroringConformanceRunner is a conformance runner whose checks cannot be run.
+type erroringConformanceRunner struct{}
+
+func (erroringConformanceRunner) name() string { return "job smoke" }
+
+func (erroringConformanceRunner) run(string) (bool, string, error) {
+	return false, "", errors.New("job smoke was deleted")
+}
+
+func TestRunConformanceError(t *testing.T) {
+	log := logging.NewLogrusLoggerAdapter(logrus.New())
+	u := &ControlPlaneUpgrader{
+		log:         log,
+		conformance: erroringConformanceRunner{},
+		record:      newRunRecorder(controlPlaneScope, "ns", "cluster", "1"),
+		warnings:    newWarningCollector(log),
+	}
+
+	assert.Error(t, u.runConformance(conformanceBefore))
+	assert.NoError(t, u.runConformance(conformanceAfter))
+
+	runs := u.record.report.Conformance
+	if assert.Len(t, runs, 2) {
+		assert.Equal(t, conformanceBefore, runs[0].Phase)
+		assert.Equal(t, conformanceAfter, runs[1].Phase)
+		assert.False(t, runs[1].Passed)
+		assert.Equal(t, "error running the conformance checks after the upgrade: job smoke was deleted", runs[1].Summary)
+	}
+	warnings := u.warnings.list()
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, WarningConformanceFailed, warnings[0].Reason)
+	}
+}
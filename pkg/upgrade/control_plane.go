@@ -5,7 +5,6 @@ package upgrade
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -20,18 +19,16 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
-	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	"sigs.k8s.io/cluster-api/controllers/external"
 	"sigs.k8s.io/cluster-api/controllers/noderefutil"
-	"sigs.k8s.io/cluster-api/util/kubeconfig"
 	"sigs.k8s.io/cluster-api/util/patch"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/yaml"
@@ -47,6 +44,14 @@ const (
 
 	// AnnotationUpgradeID is the annotation key for an upgrade's identifier.
 	AnnotationUpgradeID = annotationPrefix + "id"
+
+	// nodeListFallbackPolls is how often, in polls, waitForMatchingNode lists all nodes while the machine has no node
+	// ref.
+	nodeListFallbackPolls = 6
+
+	// machineReplacementStepTimeout is the timeout of each step of replacing a control plane machine, such as waiting
+	// for its replacement's node to be ready.
+	machineReplacementStepTimeout = 15 * time.Minute
 )
 
 var unsetVersion semver.Version
@@ -55,126 +60,741 @@ type ControlPlaneUpgrader struct {
 	log                     logr.Logger
 	userVersion             semver.Version
 	desiredVersion          semver.Version
+	versionAlias            string
+	versionSource           versionSource
 	clusterNamespace        string
 	clusterName             string
 	managementClusterClient ctrlclient.Client
 	targetRestConfig        *rest.Config
 	targetKubernetesClient  kubernetes.Interface
 	providerIDsToNodes      map[string]*v1.Node
-	imageField, imageID     string
+	machineUpdates          MachineUpdateConfig
 	upgradeID               string
 	oldNodeToEtcdMember     map[string]string
-	secretsUpdated          bool
+	requireCleanDrift       bool
+	readinessComponents     []readinessComponent
+	kubeadmPatches          KubeadmPatchesConfig
+	allowSelfHosted         bool
+	selfHosted              bool
+	quiescenceGate          bool
+	missingKubeadmConfigMap string
+	warnings                *warningCollector
+	verifyEtcdMember        bool
+	// ignoreRuntimeCompatibility reports incompatible node container runtimes as warnings instead of failing.
+	ignoreRuntimeCompatibility bool
+	// pinnedNodes are the nodes of machines excluded from the upgrade by the pin annotation.
+	pinnedNodes sets.String
+	// etcdVersions caches the etcd version detected in each etcd pod.
+	etcdVersions *etcdVersionCache
+	// verifyDeprovisioning waits for the infrastructure of deleted machines to be deprovisioned.
+	verifyDeprovisioning bool
+	// bootstrapCleanup is the policy for the bootstrap objects of deleted machines, empty to leave them alone.
+	bootstrapCleanup string
+	// apiServerCertSANs are added to the API server cert SANs of the kubeadm configmap and of replacements.
+	apiServerCertSANs []string
+	// distroProfile is the set of kubelet configmap steps the distribution leaves to the upgrade.
+	distroProfile distroProfile
+	// kubeletConfig is the KubeletConfiguration of the shared kubelet configmap of the desired version, or nil to copy
+	// the configmap of the previous minor version.
+	kubeletConfig []byte
+	// record accumulates the report of the run.
+	record *runRecorder
+	// egressSelector is the control plane's egress selector setup, carried to replacement machines. It is nil if the
+	// API servers do not use an egress selector.
+	egressSelector *egressSelector
+	// concurrentOperations is the policy for other Cluster API operations in progress on the cluster.
+	concurrentOperations string
+	// machinesWithoutProviderID is the policy for control plane machines without a spec.providerID.
+	machinesWithoutProviderID string
+	// clusterUID is the UID of the Cluster, owning the objects the upgrade leaves on the management cluster.
+	clusterUID types.UID
+	// etcdCredentials authenticate etcdctl on clusters with etcd auth enabled. It is nil if etcd auth is not used.
+	etcdCredentials *etcdCredentials
+	// levelControlPlane upgrades control planes at mixed minor versions to their newest version first.
+	levelControlPlane bool
+	// extraLabels and extraAnnotations are added to every replacement resource.
+	extraLabels      map[string]string
+	extraAnnotations map[string]string
+	// approval gates replacing the control plane machines on an external approval.
+	approval *approvalGate
+	// stateLock is held for the whole run, or nil if none is configured.
+	stateLock *stateLock
+	// conformance runs the conformance checks before and after the upgrade, or is nil if none are configured.
+	conformance conformanceRunner
+	// preCreateAll creates the replacements of all machines, and waits for them to be provisioned, before replacing any.
+	preCreateAll bool
+	// etcdSpaceCheck is the policy for etcd quota and disk space pressure.
+	etcdSpaceCheck string
+	// resumeFrom is the phase the upgrade starts from, skipping the earlier ones.
+	resumeFrom string
+	// budget is the time budget of the run.
+	budget runBudget
+	// effectiveConfig is the configuration of the run, with defaults applied and secrets redacted.
+	effectiveConfig *EffectiveConfig
+	// providerCompatibility is the table infrastructure provider versions are checked against.
+	providerCompatibility []ProviderCompatibility
+	// ignoreProviderCompatibility reports infrastructure providers too old for the desired version as warnings
+	// instead of failing.
+	ignoreProviderCompatibility bool
+	// staticPodManifests configures the scan of the control plane nodes for customized static pod manifests.
+	staticPodManifests StaticPodManifestsConfig
+	// idempotent makes the upgrade a no-op when the control plane is already at the desired version and images.
+	idempotent bool
+	// waitForRescheduling evicts the pods of each old node and waits up to reschedulingTimeout for them to be ready on
+	// other nodes before deleting its machine.
+	waitForRescheduling bool
+	reschedulingTimeout time.Duration
+	// convertInitConfiguration carries the settings of the InitConfiguration of replaced KubeadmConfigs that apply to
+	// joins to their JoinConfiguration, instead of only the node registration.
+	convertInitConfiguration bool
+	// kubeletExtraArgsRules adjust the kubelet extra args of replacement KubeadmConfigs for the desired version.
+	kubeletExtraArgsRules []KubeletExtraArgsRule
+	// cniDaemonSets run the CNI plugin, whose pods must be ready on each new node.
+	cniDaemonSets []cniDaemonSet
+	// execForbidden is set when RBAC forbids exec in the target cluster's kube-system pods, so etcdctl cannot run.
+	execForbidden bool
+	// etcdMembers counts the etcd members while execForbidden, including those of deleted machines listed by
+	// unremovedEtcdMembers, so that deleting a machine does not lose quorum.
+	etcdMembers          int
+	unremovedEtcdMembers []string
+	// externalEtcd configures the external etcd of the control plane, if any.
+	externalEtcd           ExternalEtcdConfig
+	minExternalEtcdVersion semver.Version
+	// etcdExternal is set once the control plane is found to use an external etcd, whose members are left alone.
+	etcdExternal bool
+	// etcdColocated is set once the external etcd is found to run on the control plane machines, whose members are
+	// then replaced with the machines by the member commands.
+	etcdColocated bool
+	// cordon cordons the old nodes once the upgrade is approved; cordonedNodes are those it cordoned, to uncordon if the
+	// upgrade fails.
+	cordon        bool
+	cordonedNodes []string
+	// readiness is what a new control plane node must satisfy, besides its readiness components running.
+	readiness readinessSpec
+	// maxDisruptionsPerHour paces machine replacements, each deleting a machine and removing its etcd member, unless
+	// zero.
+	maxDisruptionsPerHour int
+	// admissionDryRun creates the replacement objects in dry run before the upgrade.
+	admissionDryRun bool
+	// dryRunPreflight performs the planned mutations in dry run before the upgrade.
+	dryRunPreflight bool
+	// healthMonitorInterval is how often etcd and API server health are sampled during the upgrade, unless zero.
+	healthMonitorInterval time.Duration
+	// imageVerifier verifies the configured machine images before any machine is replaced, if configured.
+	imageVerifier *imageVerifier
 }
 
 func NewControlPlaneUpgrader(log logr.Logger, config Config) (*ControlPlaneUpgrader, error) {
-	// Validations
 	if config.KubernetesVersion == "" {
 		return nil, errors.New("kubernetes version is required")
 	}
+	return newControlPlaneUpgrader(log, config)
+}
+
+// newControlPlaneUpgrader returns a ControlPlaneUpgrader for config. Without a Kubernetes version in config, its
+// desired version is left for the caller to set.
+func newControlPlaneUpgrader(log logr.Logger, config Config) (*ControlPlaneUpgrader, error) {
+	// Validations
 	if (config.MachineUpdates.Image.ID == "" && config.MachineUpdates.Image.Field != "") ||
 		(config.MachineUpdates.Image.ID != "" && config.MachineUpdates.Image.Field == "") {
 		return nil, errors.New("when specifying image id, image field is required (and vice versa)")
 	}
+	for kind, image := range config.MachineUpdates.ImagesByKind {
+		if image.ID == "" {
+			return nil, errors.Errorf("image id is required for infrastructure kind %q", kind)
+		}
+	}
+	resumeFrom, err := parseResumeFrom(config.ResumeFrom)
+	if err != nil {
+		return nil, err
+	}
+	if resumeFrom != PhasePrechecks && config.UpgradeID == "" {
+		return nil, errors.Errorf("resuming from the %s phase requires the upgrade ID of the upgrade to resume", resumeFrom)
+	}
 	if !upgradeIDInputRegex.MatchString(config.UpgradeID) {
 		return nil, errors.New("upgrade ID must be a timestamp containing only digits")
 	}
-
-	var userVersion, desiredVersion semver.Version
-
-	v, err := semver.ParseTolerant(config.KubernetesVersion)
+	readinessComponents, err := parseReadinessComponents(config.ReadinessComponents)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing kubernetes version %q", config.KubernetesVersion)
+		return nil, err
 	}
-	userVersion = v
-	desiredVersion = v
-
-	managementClusterClient, err := kubernetes2.NewClient(
-		kubernetes2.KubeConfigPath(config.ManagementCluster.Kubeconfig),
-		kubernetes2.KubeConfigContext(config.ManagementCluster.Context),
-	)
+	readiness, err := newReadinessSpec(config.Readiness)
 	if err != nil {
 		return nil, err
 	}
-
-	log.Info("Retrieving cluster from management cluster", "cluster-namespace", config.TargetCluster.Namespace, "cluster-name", config.TargetCluster.Name)
-	cluster := &clusterv1.Cluster{}
-	err = managementClusterClient.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: config.TargetCluster.Namespace, Name: config.TargetCluster.Name}, cluster)
+	if config.MaxDisruptionsPerHour < 0 {
+		return nil, errors.Errorf("invalid max disruptions per hour %d: must not be negative", config.MaxDisruptionsPerHour)
+	}
+	kubeadmPatches, err := loadKubeadmPatches(config.KubeadmPatches)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-
-	kc, err := kubeconfig.FromSecret(managementClusterClient, cluster)
+	if err := validateImageLookupFormats(config.MachineUpdates); err != nil {
+		return nil, err
+	}
+	missingKubeadmConfigMap, err := parseMissingKubeadmConfigMap(config.MissingKubeadmConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	staticPodManifests := config.StaticPodManifests
+	if staticPodManifests.Image == "" {
+		staticPodManifests.Image = defaultStaticPodManifestsImage
+	}
+	concurrentOperations, err := parseConcurrentOperations(config.ConcurrentOperations)
+	if err != nil {
+		return nil, err
+	}
+	machinesWithoutProviderID, err := parseMachineProviderIDPolicy(config.MachinesWithoutProviderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateExtraMetadata(config.ExtraLabels, config.ExtraAnnotations); err != nil {
+		return nil, err
+	}
+	if err := validateTags(config.MachineUpdates.Tags); err != nil {
+		return nil, err
+	}
+	etcdSpaceCheck, err := parseEtcdSpaceCheck(config.EtcdSpaceCheck)
+	if err != nil {
+		return nil, err
+	}
+	bootstrapCleanup, err := parseBootstrapCleanup(config.BootstrapCleanup)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAPIServerCertSANs(config.APIServerCertSANs); err != nil {
+		return nil, err
+	}
+	distroProfile, err := parseDistroProfile(config.DistroProfile)
+	if err != nil {
+		return nil, err
+	}
+	kubeletConfig, err := loadKubeletConfigFile(config.KubeletConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if kubeletConfig != nil && distroProfile.skipKubeletConfigMap {
+		return nil, errors.Errorf("a kubelet config file cannot be used with the %s distro profile, which leaves the kubelet configmap to the distribution", distroProfile.name)
+	}
+	healthMonitorInterval, err := parseHealthMonitorInterval(config.HealthMonitorInterval)
+	if err != nil {
+		return nil, err
+	}
+	imageVerifier, err := newImageVerifier(config.ImageVerification)
+	if err != nil {
+		return nil, err
+	}
+	budget, err := parseRunBudget(config.MaxDuration, config.ContextDeadline)
+	if err != nil {
+		return nil, err
+	}
+	providerCompatibility, err := loadProviderCompatibility(config.ProviderCompatibilityFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "error retrieving cluster kubeconfig secret")
+		return nil, err
 	}
-	targetRestConfig, err := clientcmd.RESTConfigFromKubeConfig(kc)
+	kubeletExtraArgsRules, err := loadKubeletExtraArgsRules(config.KubeletExtraArgsRulesFile)
 	if err != nil {
 		return nil, err
 	}
-	if targetRestConfig == nil {
-		return nil, errors.New("could not get a kubeconfig for your target cluster")
+	cniDaemonSets, err := parseCNIDaemonSets(config.CNIDaemonSets)
+	if err != nil {
+		return nil, err
+	}
+	reschedulingTimeout, err := parseReschedulingTimeout(config.ReschedulingTimeout)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Info("Creating target kubernetes client")
-	targetKubernetesClient, err := kubernetes.NewForConfig(targetRestConfig)
+	var (
+		userVersion, desiredVersion semver.Version
+		versionAlias                string
+		versions                    versionSource
+	)
+
+	if isVersionAlias(config.KubernetesVersion) {
+		versionAlias = config.KubernetesVersion
+		versions, err = newVersionSource(config.VersionManifest)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.KubernetesVersion != "" {
+		v, err := semver.ParseTolerant(config.KubernetesVersion)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing kubernetes version %q", config.KubernetesVersion)
+		}
+		userVersion = v
+		desiredVersion = v
+
+		// The manifest is still used to plan intermediate versions
+		if config.VersionManifest != "" {
+			versions, err = newVersionSource(config.VersionManifest)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	clients, err := newClusterClients(log, config)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating target cluster client")
+		return nil, err
+	}
+	etcdCredentials, err := loadEtcdCredentials(clients.managementClusterClient, config.TargetCluster.Namespace, config.EtcdCredentialsSecret)
+	if err != nil {
+		return nil, err
+	}
+	minExternalEtcdVersion, err := parseMinExternalEtcdVersion(config.ExternalEtcd.MinVersion)
+	if err != nil {
+		return nil, err
 	}
 
 	if config.UpgradeID == "" {
 		config.UpgradeID = fmt.Sprintf("%d", time.Now().Unix())
 	}
 
+	approval, err := newApprovalGate(log, clients.managementClusterClient, config.TargetCluster.Namespace, config.TargetCluster.Name, config.UpgradeID, config.Approval)
+	if err != nil {
+		return nil, err
+	}
+	stateLock, err := newStateLock(log, config.StateLock, config.TargetCluster.Namespace, config.TargetCluster.Name, config.UpgradeID, controlPlaneScope)
+	if err != nil {
+		return nil, err
+	}
+	conformance, err := newConformanceRunner(log, config.Conformance, config.TargetCluster.Access, clients.targetRestConfig, clients.targetKubernetesClient, config.UpgradeID)
+	if err != nil {
+		return nil, err
+	}
+
 	infoMessage := fmt.Sprintf("Rerun with `--upgrade-id=%s` if this upgrade fails midway and you want to retry", config.UpgradeID)
 	log.Info(infoMessage)
 
+	effective := config
+	if len(effective.ReadinessComponents) == 0 {
+		effective.ReadinessComponents = defaultReadinessComponents
+	}
+	if len(effective.Readiness.PodConditions) == 0 {
+		effective.Readiness.PodConditions = defaultReadinessPodConditions
+	}
+	effective.KubeadmPatches = kubeadmPatches
+	effective.StaticPodManifests = staticPodManifests
+	effective.MissingKubeadmConfigMap = missingKubeadmConfigMap
+	effective.ConcurrentOperations = concurrentOperations
+	effective.MachinesWithoutProviderID = machinesWithoutProviderID
+	effective.EtcdSpaceCheck = etcdSpaceCheck
+	effective.ResumeFrom = resumeFrom
+	effective.DistroProfile = distroProfile.name
+	if effective.WaitForRescheduling {
+		effective.ReschedulingTimeout = reschedulingTimeout.String()
+	}
+	if approval != nil && effective.Approval.Timeout == "" {
+		effective.Approval.Timeout = defaultApprovalTimeout.String()
+	}
+
+	events, err := openEventStream(config.Events, controlPlaneScope, config.TargetCluster.Namespace, config.TargetCluster.Name, config.UpgradeID)
+	if err != nil {
+		return nil, err
+	}
+	warnings := newWarningCollector(log)
+	warnings.events = events
+	record := newRunRecorder(controlPlaneScope, config.TargetCluster.Namespace, config.TargetCluster.Name, config.UpgradeID)
+	record.events = events
+
 	return &ControlPlaneUpgrader{
 		log:                     log,
 		userVersion:             userVersion,
 		desiredVersion:          desiredVersion,
+		versionAlias:            versionAlias,
+		versionSource:           versions,
 		clusterNamespace:        config.TargetCluster.Namespace,
 		clusterName:             config.TargetCluster.Name,
-		managementClusterClient: managementClusterClient,
-		targetRestConfig:        targetRestConfig,
-		targetKubernetesClient:  targetKubernetesClient,
-		imageField:              config.MachineUpdates.Image.Field,
-		imageID:                 config.MachineUpdates.Image.ID,
+		clusterUID:              clients.cluster.UID,
+		managementClusterClient: clients.managementClusterClient,
+		targetRestConfig:        clients.targetRestConfig,
+		targetKubernetesClient:  clients.targetKubernetesClient,
+		machineUpdates:          config.MachineUpdates,
 		upgradeID:               config.UpgradeID,
+		requireCleanDrift:       config.RequireCleanDrift,
+		readinessComponents:     readinessComponents,
+		kubeadmPatches:          kubeadmPatches,
+		allowSelfHosted:         config.AllowSelfHosted,
+		quiescenceGate:          config.WaitForQuiescence,
+		missingKubeadmConfigMap: missingKubeadmConfigMap,
+		warnings:                warnings,
+		verifyEtcdMember:        !config.SkipEtcdMemberVerification,
+
+		ignoreRuntimeCompatibility: config.IgnoreRuntimeCompatibility,
+		verifyDeprovisioning:       config.VerifyDeprovisioning,
+		bootstrapCleanup:           bootstrapCleanup,
+		apiServerCertSANs:          config.APIServerCertSANs,
+		distroProfile:              distroProfile,
+		kubeletConfig:              kubeletConfig,
+		record:                     record,
+		concurrentOperations:       concurrentOperations,
+		machinesWithoutProviderID:  machinesWithoutProviderID,
+		etcdCredentials:            etcdCredentials,
+		levelControlPlane:          config.LevelControlPlane,
+		extraLabels:                config.ExtraLabels,
+		extraAnnotations:           config.ExtraAnnotations,
+		approval:                   approval,
+		stateLock:                  stateLock,
+		conformance:                conformance,
+		preCreateAll:               config.PreCreateAll,
+		etcdSpaceCheck:             etcdSpaceCheck,
+		resumeFrom:                 resumeFrom,
+		budget:                     budget,
+		effectiveConfig:            newEffectiveConfig(effective),
+
+		providerCompatibility:       providerCompatibility,
+		ignoreProviderCompatibility: config.IgnoreProviderCompatibility,
+		staticPodManifests:          staticPodManifests,
+		idempotent:                  config.Idempotent,
+		waitForRescheduling:         config.WaitForRescheduling,
+		reschedulingTimeout:         reschedulingTimeout,
+		convertInitConfiguration:    config.ConvertInitConfiguration,
+		kubeletExtraArgsRules:       kubeletExtraArgsRules,
+		cniDaemonSets:               cniDaemonSets,
+		// etcdctl cannot be run without exec, which read-only mode refuses
+		execForbidden:          kubernetes2.ReadOnly(),
+		externalEtcd:           config.ExternalEtcd,
+		minExternalEtcdVersion: minExternalEtcdVersion,
+		cordon:                 config.CordonOldNodes,
+		readiness:              readiness,
+		maxDisruptionsPerHour:  config.MaxDisruptionsPerHour,
+		admissionDryRun:        config.AdmissionDryRun,
+		dryRunPreflight:        config.DryRunPreflight,
+		healthMonitorInterval:  healthMonitorInterval,
+		etcdVersions:           &etcdVersionCache{},
+		imageVerifier:          imageVerifier,
 	}, nil
 }
 
 // Upgrade does the upgrading of the control plane.
 func (u *ControlPlaneUpgrader) Upgrade() error {
+	if err := u.stateLock.acquire(); err != nil {
+		u.record.done(err)
+		return err
+	}
+	defer u.stateLock.release()
+
+	err := u.upgrade()
+	if err != nil {
+		u.uncordonOldNodes()
+		u.revertKubeadmConfigMap()
+	}
+	u.record.done(err)
+	return err
+}
+
+func (u *ControlPlaneUpgrader) upgrade() error {
+	u.record.start()
+	u.budget.start(time.Now(), time.Duration(u.machineReplacementSteps())*machineReplacementStepTimeout)
+	u.record.event("Upgrade started")
+	if err := logEffectiveConfig(u.log, u.record, u.effectiveConfig); err != nil {
+		return err
+	}
+
 	machines, err := u.listMachines()
 	if err != nil {
 		return err
 	}
+	machines = u.skipPinnedMachines(machines)
 
 	if len(machines) == 0 {
-		return errors.New("Found 0 control plane machines")
+		return errors.New("Found 0 control plane machines that are not pinned")
 	}
+	machines = orderMachinesForDeletion(machines)
 
-	min, max, err := u.minMaxControlPlaneVersions(machines)
+	u.selfHosted, err = u.isSelfHosted()
+	if err != nil {
+		return err
+	}
+	if u.selfHosted {
+		if !u.allowSelfHosted {
+			return errors.New("the management cluster is the target cluster (self-hosted); rerun with --allow-self-hosted to replace the machines running the Cluster API controllers last")
+		}
+
+		controllerNodes, err := u.controllerNodes()
+		if err != nil {
+			return err
+		}
+		u.log.Info("Upgrading self-hosted cluster", "controller-nodes", controllerNodes.List())
+		machines = orderMachinesForSelfHosted(machines, controllerNodes)
+	}
+
+	kinds, err := summarizeInfrastructureKinds(machines, u.machineUpdates, u.desiredVersion)
+	if err != nil {
+		return err
+	}
+	for _, kind := range kinds {
+		u.log.Info("Found control plane infrastructure kind",
+			"kind", kind.Kind,
+			"machines", len(kind.Machines),
+			"image-field", kind.ImageField,
+			"image-id", kind.ImageID,
+		)
+	}
+
+	min, max, err := minMaxMachineVersions(machines)
 	if err != nil {
 		return errors.Wrap(err, "error determining current control plane versions")
 	}
 
-	// default the desired version if the user did not specify it
-	if unsetVersion.EQ(u.userVersion) {
-		u.desiredVersion = max
+	u.desiredVersion, err = u.resolveDesiredVersion(max)
+	if err != nil {
+		return err
+	}
+	u.effectiveConfig.DesiredVersion = u.desiredVersion.String()
+	u.effectiveConfig.Images = resolvedImages(kinds)
+	u.log.Info("Resolved configuration", "desired-version", u.effectiveConfig.DesiredVersion, "images", u.effectiveConfig.Images)
+
+	if !max.EQ(unsetVersion) {
+		u.record.versions(versionRange(min.String(), max.String()), u.desiredVersion.String())
+	} else {
+		u.record.versions("", u.desiredVersion.String())
+	}
+
+	if u.idempotent {
+		upToDate, err := u.upToDate(machines)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			u.log.Info("Nothing to do, the control plane is already upgraded", "version", u.desiredVersion.String())
+			u.record.nothingToDo()
+			return nil
+		}
+	}
+
+	recordDesiredVersion(u.log, u.managementClusterClient, u.warnings, u.clusterNamespace, u.clusterName, u.desiredVersion)
+	u.record.event("Upgrading %d control plane machines to %s", len(machines), u.desiredVersion)
+
+	if err := u.checkExecAllowed(); err != nil {
+		return err
+	}
+	if err := u.detectExternalEtcd(); err != nil {
+		return err
+	}
+	// The health monitor samples etcd the way these checks found it can be reached
+	if u.healthMonitorInterval > 0 {
+		stop := u.startHealthMonitor()
+		defer stop()
+	}
+
+	resuming := skipsPhase(u.resumeFrom, PhasePrechecks)
+	if resuming {
+		u.log.Info("Resuming upgrade", "phase", u.resumeFrom)
+		if err := u.checkResumePrerequisites(machines, min); err != nil {
+			return err
+		}
+		u.record.event("Resuming the upgrade from the %s phase", u.resumeFrom)
+	} else if err := u.checkBeforeUpgrade(machines, min); err != nil {
+		return err
+	}
+
+	// A resumed upgrade has already changed the cluster, so its checks would not describe it before the upgrade
+	if !resuming {
+		if err := u.runConformance(conformanceBefore); err != nil {
+			return err
+		}
+	}
+
+	if err := u.approval.wait(approvalPhaseControlPlane); err != nil {
+		return err
+	}
+	u.record.event("Approved replacing the control plane machines")
+
+	if u.cordon {
+		if err := u.cordonOldNodes(machines); err != nil {
+			return err
+		}
+	}
+
+	// A resumed upgrade is expected to have machines at mixed versions
+	if mixedMinorVersions(min, max) && !resuming {
+		if !u.levelControlPlane {
+			u.warnings.add(WarningMixedControlPlaneVersions, "",
+				"control plane machines are at mixed minor versions %s - %s and are all upgraded to %s directly; rerun with --level-control-plane to first upgrade them to %s",
+				min, max, u.desiredVersion, max)
+		} else if !max.EQ(u.desiredVersion) {
+			machines, min, err = u.level(machines, min, max)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := u.replaceMachines(machines, min); err != nil {
+		return err
+	}
+
+	u.log.Info("Verifying upgrade")
+	if err := u.verify(); err != nil {
+		return err
+	}
+	u.deleteUpgradeState()
+	if err := u.runConformance(conformanceAfter); err != nil {
+		return err
+	}
+	u.record.event("Upgrade completed")
+	return nil
+}
+
+// checkBeforeUpgrade runs the checks Upgrade refuses to start on when they fail, for machines whose oldest version is
+// min.
+func (u *ControlPlaneUpgrader) checkBeforeUpgrade(machines []*clusterv1.Machine, min semver.Version) error {
+	// TODO extract timeout as a configurable constant
+	if err := u.handleMachinesWithoutProviderID(machines, machineReplacementStepTimeout); err != nil {
+		return err
+	}
+
+	if problems := machineStatusProblems(machines, u.upgradeID); len(problems) > 0 {
+		return errors.Errorf("refusing to upgrade unhealthy control plane machines: %s", strings.Join(problems, "; "))
+	}
+
+	if problems := replacementNameCollisions(machines, u.upgradeID); len(problems) > 0 {
+		return errors.Errorf("refusing to upgrade control plane machines without unique replacement names, rename them or use a shorter upgrade id: %s", strings.Join(problems, "; "))
+	}
+
+	u.log.Info("Checking for concurrent operations")
+	if err := checkConcurrentOperations(u.log, u.managementClusterClient, u.clusterNamespace, u.clusterName, u.upgradeID, u.concurrentOperations, u.warnings); err != nil {
+		return err
+	}
+
+	if u.requireCleanDrift {
+		u.log.Info("Checking control plane machines for drift")
+		if err := u.checkDrift(machines); err != nil {
+			return err
+		}
 	}
 
-	if isMinorVersionUpgrade(min, u.desiredVersion) {
-		err = u.updateKubeletConfigMapIfNeeded(u.desiredVersion)
+	problems, err := u.imageFieldProblems(machines)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	if u.imageVerifier != nil {
+		u.log.Info("Verifying machine images")
+		problems, err := u.imageVerificationProblems(machines)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return errors.Errorf("refusing to upgrade with unverified machine images: %s", strings.Join(problems, "; "))
+		}
+	}
+
+	if u.admissionDryRun {
+		u.log.Info("Creating replacement objects in dry run")
+		problems, err := u.admissionDryRunProblems(machines)
 		if err != nil {
 			return err
 		}
+		if len(problems) > 0 {
+			return errors.Errorf("refusing to upgrade, the replacement objects are not admitted: %s", strings.Join(problems, "; "))
+		}
+	}
+
+	if err := u.checkExternalEtcdVersion(); err != nil {
+		return err
+	}
+	if problems := u.colocatedEtcdProblems(); len(problems) > 0 {
+		return errors.Errorf("refusing to upgrade the control plane with its colocated etcd: %s", strings.Join(problems, "; "))
+	}
+
+	problems, err = u.kubeadmConfigMapProblems(machines, min, u.desiredVersion)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	u.log.Info("Checking cluster networking")
+	problems, err = u.clusterNetworkingProblems(machines, u.desiredVersion)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("refusing to upgrade the cluster networking: %s", strings.Join(problems, "; "))
+	}
+	problems, err = u.cniDaemonSetProblems()
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	u.log.Info("Checking node container runtimes")
+	problems, err = u.nodeRuntimeProblems(u.desiredVersion)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("node container runtimes cannot run kubernetes %s, rerun with --ignore-runtime-compatibility to upgrade anyway: %s", u.desiredVersion, strings.Join(problems, "; "))
+	}
+
+	u.log.Info("Checking infrastructure provider compatibility")
+	problems, err = providerCompatibilityProblems(u.log, u.managementClusterClient, u.providerCompatibility, u.desiredVersion, u.ignoreProviderCompatibility, u.warnings)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("infrastructure providers cannot create machines at kubernetes %s, rerun with --ignore-provider-compatibility to upgrade anyway: %s", u.desiredVersion, strings.Join(problems, "; "))
+	}
+
+	if !u.staticPodManifests.Skip && !u.execForbidden {
+		u.log.Info("Scanning static pod manifests for customizations")
+		if err := u.scanStaticPodManifests(machines); err != nil {
+			return err
+		}
+	}
 
-		err = u.updateKubeletRbacIfNeeded(u.desiredVersion)
+	if u.dryRunPreflight {
+		u.log.Info("Performing the planned changes in dry run")
+		problems, err := u.dryRunPreflightProblems(machines, min)
 		if err != nil {
 			return err
 		}
+		if len(problems) > 0 {
+			return errors.Errorf("refusing to upgrade, the planned changes fail in dry run: %s", strings.Join(problems, "; "))
+		}
+	}
+
+	return u.checkEtcdSpace()
+}
+
+// replaceMachines replaces machines, whose oldest version is min, with machines at the desired version.
+func (u *ControlPlaneUpgrader) replaceMachines(machines []*clusterv1.Machine, min semver.Version) error {
+	if skipsPhase(u.resumeFrom, PhaseKubeletConfig) {
+		u.log.Info("Skipping phase", "phase", PhaseKubeletConfig)
+	} else if isMinorVersionUpgrade(min, u.desiredVersion) {
+		if u.distroProfile.skipKubeletConfigMap {
+			u.log.Info("Leaving the kubelet configmap to the distribution", "distro-profile", u.distroProfile.name)
+		} else {
+			u.log.Info("Discovering kubelet config sources")
+			kubeletConfigSources, err := u.discoverKubeletConfigSources()
+			if err != nil {
+				return err
+			}
+
+			if err := u.updateKubeletConfigMapIfNeeded(u.desiredVersion, kubeletConfigSources); err != nil {
+				return err
+			}
+		}
+
+		if u.distroProfile.skipKubeletRBAC {
+			u.log.Info("Leaving the kubelet configmap RBAC to the distribution", "distro-profile", u.distroProfile.name)
+		} else if err := u.updateKubeletRbacIfNeeded(u.desiredVersion); err != nil {
+			return err
+		}
+	} else if u.kubeletConfig != nil && !u.distroProfile.skipKubeletConfigMap {
+		// Patch upgrades write the kubelet config file too, replacing the content of the current configmap
+		if err := u.updateKubeletConfigMapIfNeeded(u.desiredVersion, nil); err != nil {
+			return err
+		}
 	}
 
 	u.log.Info("Checking etcd health")
@@ -182,15 +802,46 @@ func (u *ControlPlaneUpgrader) Upgrade() error {
 		return err
 	}
 
+	// TODO extract timeout as a configurable constant
+	if err := u.waitForQuiescence(machineReplacementStepTimeout); err != nil {
+		return err
+	}
+
 	u.log.Info("Updating provider IDs to nodes")
 	if err := u.UpdateProviderIDsToNodes(); err != nil {
 		return err
 	}
 
-	u.log.Info("Updating kubernetes version")
-	if err := u.updateAndUploadKubeadmKubernetesVersion(); err != nil {
+	if skipsPhase(u.resumeFrom, PhaseKubeadmConfig) {
+		u.log.Info("Skipping phase", "phase", PhaseKubeadmConfig)
+	} else {
+		u.log.Info("Updating kubernetes version")
+		if err := u.updateAndUploadKubeadmKubernetesVersion(machines); err != nil {
+			return err
+		}
+		u.record.event("Updated the kubeadm configuration to %s", u.desiredVersion)
+	}
+
+	u.log.Info("Checking cluster secret owners")
+	if err := u.repairSecretOwners(machines); err != nil {
+		return err
+	}
+
+	u.log.Info("Checking for an egress selector configuration")
+	egressSelector, err := u.detectEgressSelector(machines)
+	if err != nil {
 		return err
 	}
+	u.egressSelector = egressSelector
+	if u.egressSelector != nil {
+		u.log.Info("Carrying the egress selector configuration to replacement machines", "config-file", u.egressSelector.configFile, "files", len(u.egressSelector.files))
+		u.addKonnectivityServerReadiness()
+	}
+
+	if skipsPhase(u.resumeFrom, PhaseMachines) {
+		u.log.Info("Skipping phase", "phase", PhaseMachines)
+		return nil
+	}
 
 	u.log.Info("Updating machines")
 	if err := u.updateMachines(machines); err != nil {
@@ -199,38 +850,73 @@ func (u *ControlPlaneUpgrader) Upgrade() error {
 
 	u.log.Info("Removing upgrade annotations")
 	for _, m := range machines {
-		var replacement clusterv1.Machine
-		replacementName := generateReplacementMachineName(m.Name, u.upgradeID)
-
 		key := ctrlclient.ObjectKey{
 			Namespace: m.Namespace,
-			Name:      replacementName,
-		}
-
-		if err := u.managementClusterClient.Get(context.TODO(), key, &replacement); err != nil {
-			return errors.Wrapf(err, "error getting machine %s", key.String())
+			Name:      generateReplacementMachineName(m.Name, u.upgradeID),
 		}
-
-		helper, err := patch.NewHelper(replacement.DeepCopy(), u.managementClusterClient)
-		if err != nil {
+		if err := u.removeUpgradeID(key); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
 
-		delete(replacement.Annotations, AnnotationUpgradeID)
+// removeUpgradeID removes the upgrade ID annotation from the replacement machine at key, once it is done.
+func (u *ControlPlaneUpgrader) removeUpgradeID(key ctrlclient.ObjectKey) error {
+	var replacement clusterv1.Machine
+	if err := u.managementClusterClient.Get(context.TODO(), key, &replacement); err != nil {
+		return errors.Wrapf(err, "error getting machine %s", key.String())
+	}
 
-		if err := helper.Patch(context.TODO(), &replacement); err != nil {
-			return err
+	helper, err := patch.NewHelper(replacement.DeepCopy(), u.managementClusterClient)
+	if err != nil {
+		return err
+	}
+
+	delete(replacement.Annotations, AnnotationUpgradeID)
+
+	return helper.Patch(context.TODO(), &replacement)
+}
+
+// Warnings returns the non-fatal findings made so far by Upgrade.
+func (u *ControlPlaneUpgrader) Warnings() []Warning {
+	return u.warnings.list()
+}
+
+// Report returns the report of the run so far, including its warnings.
+func (u *ControlPlaneUpgrader) Report() RunReport {
+	return u.record.finish(u.Warnings())
+}
+
+// resolveDesiredVersion returns the version to upgrade to, given the newest version of the current control plane
+// machines.
+func (u *ControlPlaneUpgrader) resolveDesiredVersion(max semver.Version) (semver.Version, error) {
+	if u.versionAlias != "" {
+		if max.EQ(unsetVersion) {
+			return semver.Version{}, errors.New("unable to determine the control plane version")
 		}
+		v, err := resolveVersionAlias(u.versionAlias, max, u.versionSource)
+		if err != nil {
+			return semver.Version{}, errors.Wrapf(err, "error resolving kubernetes version %q", u.versionAlias)
+		}
+		u.log.Info("Resolved kubernetes version", "alias", u.versionAlias, "current-version", max.String(), "version", v.String())
+		return v, nil
 	}
 
-	return nil
+	// default the desired version if the user did not specify it
+	if unsetVersion.EQ(u.userVersion) {
+		return max, nil
+	}
+
+	return u.userVersion, nil
 }
 
 func isMinorVersionUpgrade(base, update semver.Version) bool {
 	return base.Major == update.Major && base.Minor < update.Minor
 }
 
-func (u *ControlPlaneUpgrader) minMaxControlPlaneVersions(machines []*clusterv1.Machine) (semver.Version, semver.Version, error) {
+func minMaxMachineVersions(machines []*clusterv1.Machine) (semver.Version, semver.Version, error) {
 	var min, max semver.Version
 
 	for _, machine := range machines {
@@ -254,57 +940,96 @@ func (u *ControlPlaneUpgrader) minMaxControlPlaneVersions(machines []*clusterv1.
 	return min, max, nil
 }
 
-func (u *ControlPlaneUpgrader) updateKubeletConfigMapIfNeeded(version semver.Version) error {
-	// Check if the desired configmap already exists
-	desiredKubeletConfigMapName := fmt.Sprintf("kubelet-config-%d.%d", version.Major, version.Minor)
-	_, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(desiredKubeletConfigMapName, metav1.GetOptions{})
-	if err == nil {
-		u.log.Info("kubelet configmap already exists", "configMapName", desiredKubeletConfigMapName)
-		return nil
-	}
-	if !apierrors.IsNotFound(err) {
-		return errors.Wrapf(err, "error determining if configmap %s exists", desiredKubeletConfigMapName)
+// updateKubeletConfigMapIfNeeded creates the shared kubelet configmap kubeadm reads when joining a node of version, from
+// the one of the previous minor version or, on clusters using per-node kubelet configmaps without a shared one, from the
+// configmap of one of the nodes using sources. With a kubelet config file, the configmap is written from the file
+// instead, replacing the content of an existing one.
+func (u *ControlPlaneUpgrader) updateKubeletConfigMapIfNeeded(version semver.Version, sources map[string]*v1.ConfigMapNodeConfigSource) error {
+	cm, err := u.desiredKubeletConfigMap(version, sources)
+	if err != nil || cm == nil {
+		return err
 	}
 
-	// If we get here, we have to make the configmap
-	previousMinorVersionKubeletConfigMapName := fmt.Sprintf("kubelet-config-%d.%d", version.Major, version.Minor-1)
-	cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(previousMinorVersionKubeletConfigMapName, metav1.GetOptions{})
-	if apierrors.IsNotFound(err) {
-		return errors.Errorf("unable to find current kubelet configmap %s", previousMinorVersionKubeletConfigMapName)
+	if cm.ResourceVersion != "" {
+		if _, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Update(cm); err != nil {
+			return errors.Wrapf(err, "error updating configmap %s", cm.Name)
+		}
+		u.record.event("Replaced the content of kubelet configmap %s with the kubelet config file", cm.Name)
+		return nil
 	}
-	cm.Name = desiredKubeletConfigMapName
-	cm.ResourceVersion = ""
 
 	_, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Create(cm)
 	if err != nil && !apierrors.IsAlreadyExists(err) {
-		return errors.Wrapf(err, "error creating configmap %s", desiredKubeletConfigMapName)
+		return errors.Wrapf(err, "error creating configmap %s", cm.Name)
 	}
 
 	return nil
 }
 
+// desiredKubeletConfigMap returns the shared kubelet configmap of version to create, or nil if it already exists. With
+// a kubelet config file, an existing configmap whose content differs from the file is returned updated, with its
+// resource version set.
+func (u *ControlPlaneUpgrader) desiredKubeletConfigMap(version semver.Version, sources map[string]*v1.ConfigMapNodeConfigSource) (*v1.ConfigMap, error) {
+	// Check if the desired configmap already exists
+	desiredKubeletConfigMapName := kubeletConfigMapName(version)
+	existing, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(desiredKubeletConfigMapName, metav1.GetOptions{})
+	if err == nil {
+		if u.kubeletConfig == nil || existing.Data[kubeadmKubeletConfigKey] == string(u.kubeletConfig) {
+			u.log.Info("kubelet configmap already exists", "configMapName", desiredKubeletConfigMapName)
+			return nil, nil
+		}
+		u.log.Info("Replacing the content of the kubelet configmap with the kubelet config file", "configMapName", desiredKubeletConfigMapName)
+		if existing.Data == nil {
+			existing.Data = map[string]string{}
+		}
+		existing.Data[kubeadmKubeletConfigKey] = string(u.kubeletConfig)
+		return existing, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "error determining if configmap %s exists", desiredKubeletConfigMapName)
+	}
+
+	if u.kubeletConfig != nil {
+		u.log.Info("Creating the kubelet configmap from the kubelet config file", "configMapName", desiredKubeletConfigMapName)
+		return &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: desiredKubeletConfigMapName},
+			Data:       map[string]string{kubeadmKubeletConfigKey: string(u.kubeletConfig)},
+		}, nil
+	}
+
+	// If we get here, we have to make the configmap
+	previousVersion := semver.Version{Major: version.Major, Minor: version.Minor - 1}
+	previousKubeletConfigMapName := kubeletConfigMapName(previousVersion)
+	cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(previousKubeletConfigMapName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		cm.Name = desiredKubeletConfigMapName
+		cm.ResourceVersion = ""
+		cm.UID = ""
+	case apierrors.IsNotFound(err):
+		data, err := u.sharedKubeletConfigFromNode(sources)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return nil, errors.Errorf("unable to find current kubelet configmap %s or a node-specific kubelet configmap", previousKubeletConfigMapName)
+		}
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: desiredKubeletConfigMapName},
+			Data:       data,
+		}
+	default:
+		return nil, errors.Wrapf(err, "error getting configmap %s", previousKubeletConfigMapName)
+	}
+	return cm, nil
+}
+
 func (u *ControlPlaneUpgrader) updateKubeletRbacIfNeeded(version semver.Version) error {
-	majorMinor := fmt.Sprintf("%d.%d", version.Major, version.Minor)
-	roleName := fmt.Sprintf("kubeadm:kubelet-config-%s", majorMinor)
+	roleName := kubeletConfigRoleName(version)
 
 	_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Get(roleName, metav1.GetOptions{})
 	if apierrors.IsNotFound(err) {
-		newRole := &rbacv1.Role{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: "kube-system",
-				Name:      roleName,
-			},
-			Rules: []rbacv1.PolicyRule{
-				{
-					Verbs:         []string{"get"},
-					APIGroups:     []string{""},
-					Resources:     []string{"configmaps"},
-					ResourceNames: []string{fmt.Sprintf("kubelet-config-%s", majorMinor)},
-				},
-			},
-		}
-
-		_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Create(newRole)
+		_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Create(kubeletConfigRole(version))
 		if err != nil && !apierrors.IsAlreadyExists(err) {
 			return errors.Wrapf(err, "error creating role %s", roleName)
 		}
@@ -314,31 +1039,7 @@ func (u *ControlPlaneUpgrader) updateKubeletRbacIfNeeded(version semver.Version)
 
 	_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Get(roleName, metav1.GetOptions{})
 	if apierrors.IsNotFound(err) {
-		newRoleBinding := &rbacv1.RoleBinding{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: "kube-system",
-				Name:      roleName,
-			},
-			Subjects: []rbacv1.Subject{
-				{
-					APIGroup: "rbac.authorization.k8s.io",
-					Kind:     "Group",
-					Name:     "system:nodes",
-				},
-				{
-					APIGroup: "rbac.authorization.k8s.io",
-					Kind:     "Group",
-					Name:     "system:bootstrappers:kubeadm:default-node-token",
-				},
-			},
-			RoleRef: rbacv1.RoleRef{
-				APIGroup: "rbac.authorization.k8s.io",
-				Kind:     "Role",
-				Name:     roleName,
-			},
-		}
-
-		_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Create(newRoleBinding)
+		_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Create(kubeletConfigRoleBinding(version))
 		if err != nil && !apierrors.IsAlreadyExists(err) {
 			return errors.Wrapf(err, "error creating rolebinding %s", roleName)
 		}
@@ -349,26 +1050,62 @@ func (u *ControlPlaneUpgrader) updateKubeletRbacIfNeeded(version semver.Version)
 	return nil
 }
 
-func (u *ControlPlaneUpgrader) etcdClusterHealthCheck(timeout time.Duration) error {
-	members, err := u.listEtcdMembers(timeout)
-	if err != nil {
-		return err
+// kubeletConfigRole returns the role allowing to read the shared kubelet configmap of version.
+func kubeletConfigRole(version semver.Version) *rbacv1.Role {
+	return &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      kubeletConfigRoleName(version),
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				Verbs:         []string{"get"},
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps"},
+				ResourceNames: []string{kubeletConfigMapName(version)},
+			},
+		},
 	}
+}
 
-	var endpoints []string
-	for _, member := range members {
-		endpoints = append(endpoints, member.ClientURLs...)
+// kubeletConfigRoleBinding returns the role binding granting the kubelet config role of version to nodes and joining
+// nodes.
+func kubeletConfigRoleBinding(version semver.Version) *rbacv1.RoleBinding {
+	roleName := kubeletConfigRoleName(version)
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      roleName,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "Group",
+				Name:     "system:nodes",
+			},
+			{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "Group",
+				Name:     "system:bootstrappers:kubeadm:default-node-token",
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "Role",
+			Name:     roleName,
+		},
+	}
+}
+
+func (u *ControlPlaneUpgrader) etcdClusterHealthCheck(timeout time.Duration) error {
+	if u.execForbidden || u.etcdExternal {
+		return u.apiServerEtcdHealth(timeout)
 	}
 
 	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
 	defer cancel()
 
-	// TODO: we can switch back to using --cluster instead of --endpoints when we no longer need to support etcd 3.2
-	// (which is the version kubeadm installs for Kubernetes v1.13.x). kubeadm switched to etcd 3.3 with v1.14.x.
-
-	// TODO: use '-w json' when it's in the minimum supported etcd version.
-	_, _, err = u.etcdctl(ctx, "endpoint health --endpoints", strings.Join(endpoints, ","))
-	return err
+	return u.etcdEndpointHealth(ctx, nil)
 }
 
 func (u *ControlPlaneUpgrader) updateMachine(replacementKey ctrlclient.ObjectKey, machine *clusterv1.Machine) error {
@@ -377,13 +1114,20 @@ func (u *ControlPlaneUpgrader) updateMachine(replacementKey ctrlclient.ObjectKey
 		"replacement", replacementKey.String(),
 	)
 
-	originalProviderID, err := noderefutil.NewProviderID(*machine.Spec.ProviderID)
+	originalProviderID, err := parseProviderID(*machine.Spec.ProviderID)
 	if err != nil {
 		return err
 	}
 	log.Info("Determined provider id for machine", "provider-id", originalProviderID)
 
 	oldNode := u.GetNodeFromProviderID(originalProviderID.ID())
+	if oldNode == nil && machine.Status.NodeRef != nil {
+		// The node may have joined after the provider IDs were listed, get it alone instead of listing all nodes.
+		oldNode, err = u.getNodeWithProviderID(machine.Status.NodeRef.Name, originalProviderID)
+		if err != nil {
+			return err
+		}
+	}
 	if oldNode == nil {
 		u.log.Info("Couldn't retrieve oldNode", "id", originalProviderID.String())
 		return fmt.Errorf("unknown previous node %q", originalProviderID.String())
@@ -392,6 +1136,106 @@ func (u *ControlPlaneUpgrader) updateMachine(replacementKey ctrlclient.ObjectKey
 	oldHostName := hostnameForNode(oldNode)
 	log.Info("Determined node hostname for machine", "node", oldNode.Name, "hostname", oldHostName)
 
+	if err := u.ensureReplacementMachine(replacementKey, machine); err != nil {
+		return err
+	}
+
+	u.record.machinePhase(machine.Name, MachinePhaseWaitingForNode)
+	node, err := u.waitForReplacementNode(replacementKey)
+	if err != nil {
+		return err
+	}
+
+	if err := u.carryNodeKubeletConfig(oldNode, node); err != nil {
+		return err
+	}
+
+	if err := u.ensureControlPlaneNodeRole(oldNode, node); err != nil {
+		return err
+	}
+
+	// Delete the etcd member, if necessary
+	oldEtcdMemberID := u.oldNodeToEtcdMember[oldHostName]
+	if u.etcdColocated {
+		if err := u.replaceColocatedEtcdMember(replacementKey, machine, oldNode, node); err != nil {
+			return err
+		}
+	} else if u.etcdExternal {
+		log.Info("Leaving the external etcd members alone")
+	} else if u.execForbidden {
+		if err := u.skipEtcdMemberRemoval(machine, oldHostName); err != nil {
+			return err
+		}
+	} else if oldEtcdMemberID != "" {
+		if u.verifyEtcdMember {
+			// TODO extract timeout as a configurable constant
+			if err := u.waitForEtcdMember(hostnameForNode(node), machineReplacementStepTimeout); err != nil {
+				return err
+			}
+		}
+
+		u.record.machinePhase(machine.Name, MachinePhaseRemovingEtcdMember)
+		// TODO make timeout the last arg, for consistency (or pass in a ctx?)
+		deleted, err := u.deleteEtcdMember(time.Minute*1, oldEtcdMemberID)
+		if err != nil {
+			return errors.Wrapf(err, "unable to delete old etcd member %s", oldEtcdMemberID)
+		}
+		if !deleted {
+			u.warnings.add(WarningEtcdMemberAbsent, fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
+				"etcd member %s of node %s was already removed", oldEtcdMemberID, oldHostName)
+		}
+	} else {
+		u.warnings.add(WarningEtcdMemberAbsent, fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
+			"no etcd member found for node %s, assuming it was already removed", oldHostName)
+	}
+
+	u.record.machinePhase(machine.Name, MachinePhaseDeleting)
+	if u.waitForRescheduling && excludesNodeDraining(machine) {
+		log.Info("Not rescheduling the workloads of the old node, its machine excludes node draining", "node", oldNode.Name)
+	} else if u.waitForRescheduling {
+		if err := u.rescheduleWorkloads(oldNode); err != nil {
+			return err
+		}
+	}
+
+	u.log.Info("Deleting existing machine", "namespace", machine.Namespace, "name", machine.Name)
+	// TODO plumb a context down to here instead of using TODO
+	if err := u.managementClusterClient.Delete(context.TODO(), machine); err != nil {
+		return errors.Wrapf(err, "error deleting machine %s/%s", machine.Namespace, machine.Name)
+	}
+	u.record.replaced(machine.Name, replacementKey.Name)
+
+	if u.verifyDeprovisioning {
+		// TODO extract timeout as a configurable constant
+		if err := u.verifyInfrastructureDeprovisioned(machine, machineReplacementStepTimeout); err != nil {
+			return err
+		}
+	}
+
+	if u.bootstrapCleanup != "" {
+		// TODO extract timeout as a configurable constant
+		if err := u.cleanupBootstrapObjects(machine, machineReplacementStepTimeout); err != nil {
+			return err
+		}
+	}
+
+	if u.selfHosted {
+		// TODO extract timeout as a configurable constant
+		if err := u.waitForControllers(oldNode.Name, machineReplacementStepTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureReplacementMachine creates the machine replacing machine at replacementKey, unless it already exists.
+func (u *ControlPlaneUpgrader) ensureReplacementMachine(replacementKey ctrlclient.ObjectKey, machine *clusterv1.Machine) error {
+	log := u.log.WithValues(
+		"machine", fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
+		"replacement", replacementKey.String(),
+	)
+
 	log.Info("Checking if we need to create a new machine")
 	replacementRef := v1.ObjectReference{
 		APIVersion: clusterv1.GroupVersion.String(),
@@ -403,94 +1247,160 @@ func (u *ControlPlaneUpgrader) updateMachine(replacementKey ctrlclient.ObjectKey
 	if err != nil {
 		return err
 	}
+	if exists {
+		log.Info("New machine exists")
+		return nil
+	}
 
-	var replacementMachine *clusterv1.Machine
-	if !exists {
-		log.Info("New machine does not exist - need to create a new one")
-		replacementMachine = machine.DeepCopy()
-
-		// have to clear this out so we can create a new machine
-		replacementMachine.ResourceVersion = ""
-
-		// have to clear this out so the new machine can get its own provider id set
-		replacementMachine.Spec.ProviderID = nil
+	log.Info("New machine does not exist - need to create a new one")
+	replacementMachine := u.replacementMachine(replacementKey, machine)
 
-		// Use the new, generated replacement machine name for all the things
-		replacementMachine.Name = replacementKey.Name
-		replacementMachine.Spec.InfrastructureRef.Name = replacementKey.Name
-		replacementMachine.Spec.Bootstrap.Data = nil
-		replacementMachine.Spec.Bootstrap.ConfigRef.Name = replacementKey.Name
+	log.Info("Creating new machine")
+	if err := u.managementClusterClient.Create(context.TODO(), replacementMachine); err != nil {
+		return explainAdmissionDenial(errors.Wrapf(err, "Error creating machine: %s", replacementMachine.Name), "Machine", replacementMachine.Name)
+	}
+	log.Info("Create succeeded")
+	u.record.event("Created replacement machine %s for %s", replacementMachine.Name, machine.Name)
+	return nil
+}
 
-		desiredVersion := u.desiredVersion.String()
-		replacementMachine.Spec.Version = &desiredVersion
+// replacementMachine returns the machine replacing machine at replacementKey, at the desired version.
+func (u *ControlPlaneUpgrader) replacementMachine(replacementKey ctrlclient.ObjectKey, machine *clusterv1.Machine) *clusterv1.Machine {
+	return u.replacementBuilder(replacementKey).machine(machine)
+}
 
-		log.Info("Creating new machine")
-		if err := u.managementClusterClient.Create(context.TODO(), replacementMachine); err != nil {
-			return errors.Wrapf(err, "Error creating machine: %s", replacementMachine.Name)
-		}
-		log.Info("Create succeeded")
-	} else {
-		log.Info("New machine exists - retrieving from server")
-		replacementMachine = new(clusterv1.Machine)
-		if err := u.managementClusterClient.Get(context.TODO(), replacementKey, replacementMachine); err != nil {
-			return errors.Wrapf(err, "error getting replacement machine %s", replacementKey.String())
-		}
+// waitForReplacementNode waits for the replacement machine at replacementKey to be provisioned and its node to be
+// ready, and returns the node.
+func (u *ControlPlaneUpgrader) waitForReplacementNode(replacementKey ctrlclient.ObjectKey) (*v1.Node, error) {
+	// TODO extract timeout as a configurable constant
+	newProviderID, err := u.waitForProviderID(u.clusterNamespace, replacementKey.Name, machineReplacementStepTimeout)
+	if err != nil {
+		return nil, u.withBootstrapDiagnostics(err, replacementKey)
 	}
-
 	// TODO extract timeout as a configurable constant
-	newProviderID, err := u.waitForProviderID(u.clusterNamespace, replacementKey.Name, 15*time.Minute)
+	node, err := u.waitForMatchingNode(replacementKey, newProviderID, machineReplacementStepTimeout)
 	if err != nil {
-		return err
+		return nil, u.withBootstrapDiagnostics(err, replacementKey)
+	}
+	// TODO extract timeout as a configurable constant
+	if err := u.waitForNodeReady(node, machineReplacementStepTimeout); err != nil {
+		return nil, err
+	}
+	// TODO extract timeout as a configurable constant
+	if err := u.waitForCNIPods(node.Name, machineReplacementStepTimeout); err != nil {
+		return nil, err
+	}
+	u.record.event("Node %s of machine %s is ready", node.Name, replacementKey.Name)
+
+	if u.egressSelector != nil {
+		// TODO extract timeout as a configurable constant
+		if err := u.waitForKonnectivityAgents(machineReplacementStepTimeout); err != nil {
+			return nil, err
+		}
 	}
-	// TODO extract timeout as a configurable constant
-	node, err := u.waitForMatchingNode(newProviderID, 15*time.Minute)
-	if err != nil {
+
+	// This used to happen when a new machine was created as a side effect. Must still update the mapping, but only
+	// the replacement's node changed, so there is no need to list every node again.
+	u.updateProviderIDToNode(node)
+
+	return node, nil
+}
+
+func (u *ControlPlaneUpgrader) updateMachines(machines []*clusterv1.Machine) error {
+	if err := u.saveEtcdMembers(); err != nil {
 		return err
 	}
-	// TODO extract timeout as a configurable constant
-	if err := u.waitForNodeReady(node, 15*time.Minute); err != nil {
+	if err := u.restoreUpgradeState(); err != nil {
 		return err
 	}
 
-	// This used to happen when a new machine was created as a side effect. Must still update the mapping.
-	if err := u.UpdateProviderIDsToNodes(); err != nil {
-		return err
+	machines = u.machinesToReplace(machines)
+	for _, machine := range machines {
+		u.record.machinePhase(machine.Name, MachinePhasePending)
 	}
 
-	// Delete the etcd member, if necessary
-	oldEtcdMemberID := u.oldNodeToEtcdMember[oldHostName]
-	if oldEtcdMemberID != "" {
-		// TODO make timeout the last arg, for consistency (or pass in a ctx?)
-		err = u.deleteEtcdMember(time.Minute*1, oldEtcdMemberID)
-		if err != nil {
-			return errors.Wrapf(err, "unable to delete old etcd member %s", oldEtcdMemberID)
+	if u.preCreateAll {
+		if err := u.preCreateReplacements(machines); err != nil {
+			return err
 		}
 	}
 
-	u.log.Info("Deleting existing machine", "namespace", machine.Namespace, "name", machine.Name)
-	// TODO plumb a context down to here instead of using TODO
-	if err := u.managementClusterClient.Delete(context.TODO(), machine); err != nil {
-		return errors.Wrapf(err, "error deleting machine %s/%s", machine.Namespace, machine.Name)
+	for i, machine := range machines {
+		log := u.log.WithValues(
+			"machine", fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
+			"upgrade-id", u.upgradeID,
+		)
+
+		remaining := fmt.Sprintf("%d control plane machines", len(machines)-i)
+		if err := u.timeBudgetExhausted(remaining); err != nil {
+			return err
+		}
+		if err := u.paceDisruption(fmt.Sprintf("replacing machine %s", machine.Name), remaining); err != nil {
+			return err
+		}
+		started := time.Now()
+
+		// TODO extract timeout as a configurable constant
+		if err := u.waitForQuiescence(machineReplacementStepTimeout); err != nil {
+			return err
+		}
+
+		// TODO extract timeout as a configurable constant
+		if err := u.waitForQuorumSafety(machineReplacementStepTimeout); err != nil {
+			return err
+		}
+
+		u.record.machinePhase(machine.Name, MachinePhaseCreating)
+		replacementKey := u.replacementKey(machine)
+		if err := u.createReplacementObjects(replacementKey, machine); err != nil {
+			u.record.machinePhase(machine.Name, MachinePhaseFailed)
+			return err
+		}
+
+		log.Info("Updating machine")
+		if err := u.updateMachine(replacementKey, machine); err != nil {
+			u.record.machinePhase(machine.Name, MachinePhaseFailed)
+			return err
+		}
+		u.record.machinePhase(machine.Name, MachinePhaseReplaced)
+		u.budget.observe(time.Since(started))
 	}
 
 	return nil
 }
 
-func (u *ControlPlaneUpgrader) updateMachines(machines []*clusterv1.Machine) error {
-	// save all etcd member id corresponding to node before upgrade starts
-	err := u.oldNodeToEtcdMemberId(time.Minute * 1)
-	if err != nil {
-		return err
+// saveEtcdMembers saves the etcd member ID of each control plane node before machines are replaced, or counts the
+// members when they cannot be listed. The members of an external etcd are not saved, as they are left alone.
+func (u *ControlPlaneUpgrader) saveEtcdMembers() error {
+	if u.etcdExternal {
+		return nil
+	}
+	if u.execForbidden {
+		// etcd members cannot be listed, assume each control plane machine has one
+		all, err := u.listMachines()
+		if err != nil {
+			return err
+		}
+		u.etcdMembers = len(all)
+		return nil
 	}
+	return u.oldNodeToEtcdMemberId(time.Minute * 1)
+}
 
+// machinesToReplace stores the upgrade ID on machines and returns those to replace in this upgrade. The others are
+// listed in the warnings, unless they are replacements of this upgrade.
+func (u *ControlPlaneUpgrader) machinesToReplace(machines []*clusterv1.Machine) []*clusterv1.Machine {
+	var ret []*clusterv1.Machine
 	for _, machine := range machines {
 		log := u.log.WithValues(
 			"machine", fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
 			"upgrade-id", u.upgradeID,
 		)
 
-		if machine.Spec.ProviderID == nil {
-			log.Info("unable to upgrade machine as it has no spec.providerID")
+		machineName := fmt.Sprintf("%s/%s", machine.Namespace, machine.Name)
+
+		if machine.Spec.ProviderID == nil || *machine.Spec.ProviderID == "" {
+			u.warnings.add(WarningMachineWithoutProviderID, machineName, "machine was not upgraded as it has no spec.providerID")
 			// TODO record event/annotation?
 			continue
 		}
@@ -507,6 +1417,7 @@ func (u *ControlPlaneUpgrader) updateMachines(machines []*clusterv1.Machine) err
 			if err != nil {
 				// TODO should we do anything else?
 				log.Error(err, "error creating patch helper for machine (add upgrade id)")
+				u.warnings.add(WarningUpgradeIDNotStored, machineName, "machine was not upgraded as its upgrade ID could not be stored: %v", err)
 				continue
 			}
 
@@ -517,6 +1428,7 @@ func (u *ControlPlaneUpgrader) updateMachines(machines []*clusterv1.Machine) err
 			if err := helper.Patch(context.TODO(), machine); err != nil {
 				// TODO should we do anything else?
 				log.Error(err, "error patching machine (add upgrade id)")
+				u.warnings.add(WarningUpgradeIDNotStored, machineName, "machine was not upgraded as its upgrade ID could not be stored: %v", err)
 				continue
 			}
 		}
@@ -524,7 +1436,7 @@ func (u *ControlPlaneUpgrader) updateMachines(machines []*clusterv1.Machine) err
 		// Don't process a mismatching upgrade ID
 		if annotations[AnnotationUpgradeID] != u.upgradeID {
 			// TODO record that we're unable to upgrade because the ID is a mismatch (annotation? event?)
-			log.Info("Unable to upgrade machine - mismatching upgrade id", "machine-upgrade-id", annotations[AnnotationUpgradeID])
+			u.warnings.add(WarningUpgradeIDMismatch, machineName, "machine was not upgraded as it belongs to upgrade %s", annotations[AnnotationUpgradeID])
 			continue
 		}
 
@@ -536,38 +1448,42 @@ func (u *ControlPlaneUpgrader) updateMachines(machines []*clusterv1.Machine) err
 
 		// TODO skip if the bootstrap ref is not a KubeadmConfig
 
-		replacementMachineName := generateReplacementMachineName(machine.Name, u.upgradeID)
-
-		replacementKey := ctrlclient.ObjectKey{
-			Namespace: u.clusterNamespace,
-			Name:      replacementMachineName,
-		}
+		ret = append(ret, machine)
+	}
+	return ret
+}
 
-		log.Info("Updating infrastructure reference",
-			"api-version", machine.Spec.InfrastructureRef.APIVersion,
-			"kind", machine.Spec.InfrastructureRef.Kind,
-			"name", machine.Spec.InfrastructureRef.Name,
-		)
-		if err := u.updateInfrastructureReference(replacementKey, machine.Spec.InfrastructureRef); err != nil {
-			return err
-		}
+// replacementKey returns the key of the machine, and of its infrastructure and bootstrap objects, replacing machine.
+func (u *ControlPlaneUpgrader) replacementKey(machine *clusterv1.Machine) ctrlclient.ObjectKey {
+	return ctrlclient.ObjectKey{
+		Namespace: u.clusterNamespace,
+		Name:      generateReplacementMachineName(machine.Name, u.upgradeID),
+	}
+}
 
-		log.Info("Updating bootstrap reference",
-			"api-version", machine.Spec.Bootstrap.ConfigRef.APIVersion,
-			"kind", machine.Spec.Bootstrap.ConfigRef.Kind,
-			"name", machine.Spec.Bootstrap.ConfigRef.Name,
-		)
-		if err := u.updateBootstrapConfig(replacementKey, machine.Spec.Bootstrap.ConfigRef.Name); err != nil {
-			return err
-		}
+// createReplacementObjects creates the infrastructure and bootstrap objects of the machine replacing machine at
+// replacementKey, unless they already exist.
+func (u *ControlPlaneUpgrader) createReplacementObjects(replacementKey ctrlclient.ObjectKey, machine *clusterv1.Machine) error {
+	log := u.log.WithValues(
+		"machine", fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
+		"upgrade-id", u.upgradeID,
+	)
 
-		log.Info("Updating machine")
-		if err := u.updateMachine(replacementKey, machine); err != nil {
-			return err
-		}
+	log.Info("Updating infrastructure reference",
+		"api-version", machine.Spec.InfrastructureRef.APIVersion,
+		"kind", machine.Spec.InfrastructureRef.Kind,
+		"name", machine.Spec.InfrastructureRef.Name,
+	)
+	if err := u.updateInfrastructureReference(replacementKey, machine.Spec.InfrastructureRef); err != nil {
+		return err
 	}
 
-	return nil
+	log.Info("Updating bootstrap reference",
+		"api-version", machine.Spec.Bootstrap.ConfigRef.APIVersion,
+		"kind", machine.Spec.Bootstrap.ConfigRef.Kind,
+		"name", machine.Spec.Bootstrap.ConfigRef.Name,
+	)
+	return u.updateBootstrapConfig(replacementKey, machine.Spec.Bootstrap.ConfigRef.Name)
 }
 
 func upgradeSuffix(upgradeID string) string {
@@ -576,7 +1492,8 @@ func upgradeSuffix(upgradeID string) string {
 
 // generateReplacementMachineName takes the original machine name and appends the upgrade suffix to it, removing any previous
 // suffix. If the generated name would be longer than the maximum allowed name length, generateReplacementMachineName truncates
-// the original name until the upgrade suffix fits.
+// the original name until the upgrade suffix and a hash of the original name fit, so that machines whose names only
+// differ past the truncation keep distinct replacements.
 func generateReplacementMachineName(original, upgradeID string) string {
 	machineName := original
 	match := upgradeIDNameSuffixRegex.FindStringIndex(machineName)
@@ -588,8 +1505,9 @@ func generateReplacementMachineName(original, upgradeID string) string {
 
 	excess := len(machineName) + len(machineSuffix) - validation.DNS1123SubdomainMaxLength
 	if excess > 0 {
-		max := len(machineName) - excess
-		machineName = machineName[0:max]
+		hash := "-" + replacementNameHash(machineName)
+		max := len(machineName) - excess - len(hash)
+		machineName = strings.TrimRight(machineName[0:max], "-.") + hash
 	}
 
 	return machineName + machineSuffix
@@ -608,92 +1526,49 @@ func (u *ControlPlaneUpgrader) updateBootstrapConfig(replacementKey ctrlclient.O
 		return err
 	}
 	if exists {
-		return nil
+		// Make sure a previous run that was interrupted after creating the replacement also updated the secrets
+		replacement := &bootstrapv1.KubeadmConfig{}
+		if err := u.managementClusterClient.Get(context.TODO(), replacementKey, replacement); err != nil {
+			return errors.WithStack(err)
+		}
+		return u.updateSecretOwners(replacement)
 	}
 
 	// Step 2: if we're here, we need to create it
+	bootstrap, err := u.replacementBootstrapConfig(replacementKey, configName)
+	if err != nil {
+		return err
+	}
+	err = u.managementClusterClient.Create(context.TODO(), bootstrap)
+	if err != nil {
+		return explainAdmissionDenial(errors.WithStack(err), "KubeadmConfig", bootstrap.Name)
+	}
+
+	return u.updateSecretOwners(bootstrap)
+}
 
-	// copy node registration
+// replacementBootstrapConfig returns the KubeadmConfig of the machine replacing the one of the KubeadmConfig called
+// configName, at replacementKey, joining the control plane.
+func (u *ControlPlaneUpgrader) replacementBootstrapConfig(replacementKey ctrlclient.ObjectKey, configName string) (*bootstrapv1.KubeadmConfig, error) {
 	bootstrap := &bootstrapv1.KubeadmConfig{}
 	bootstrapKey := ctrlclient.ObjectKey{
 		Name:      configName,
 		Namespace: u.clusterNamespace,
 	}
 	if err := u.managementClusterClient.Get(context.TODO(), bootstrapKey, bootstrap); err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	// modify bootstrap config
-	bootstrap.SetName(replacementKey.Name)
-	bootstrap.SetResourceVersion("")
-	bootstrap.SetOwnerReferences(nil)
-
-	// find node registration
-	nodeRegistration := kubeadmv1beta1.NodeRegistrationOptions{}
-	if bootstrap.Spec.InitConfiguration != nil {
-		nodeRegistration = bootstrap.Spec.InitConfiguration.NodeRegistration
-	} else if bootstrap.Spec.JoinConfiguration != nil {
-		nodeRegistration = bootstrap.Spec.JoinConfiguration.NodeRegistration
-	}
-	if bootstrap.Spec.JoinConfiguration == nil {
-		bootstrap.Spec.JoinConfiguration = &kubeadmv1beta1.JoinConfiguration{
-			ControlPlane: &kubeadmv1beta1.JoinControlPlane{},
+	replacement, changes := u.replacementBuilder(replacementKey).kubeadmConfig(bootstrap)
+	if u.convertInitConfiguration {
+		if err := u.reportInitConfigurationConversion(configName, bootstrap.Spec.ClusterConfiguration, changes.dropped); err != nil {
+			return nil, err
 		}
 	}
-	bootstrap.Spec.JoinConfiguration.NodeRegistration = nodeRegistration
-
-	// clear init configuration
-	// When you have both the init configuration and the join configuration present
-	// for a control plane upgrade, kubeadm will use the init configuration instead
-	// of the join configuration. during upgrades, you will never be initializing a
-	// new node. It will always be joining an existing control plane.
-	bootstrap.Spec.InitConfiguration = nil
-
-	err = u.managementClusterClient.Create(context.TODO(), bootstrap)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	// Return early if we've already updated the ownerRefs
-	if u.secretsUpdated {
-		return nil
-	}
-
-	secretNames := []string{
-		fmt.Sprintf("%s-ca", u.clusterName),
-		fmt.Sprintf("%s-etcd", u.clusterName),
-		fmt.Sprintf("%s-sa", u.clusterName),
-		fmt.Sprintf("%s-proxy", u.clusterName),
-	}
-
-	for _, secretName := range secretNames {
-		secret := &v1.Secret{}
-		secretKey := ctrlclient.ObjectKey{Name: secretName, Namespace: u.clusterNamespace}
-		if err := u.managementClusterClient.Get(context.TODO(), secretKey, secret); err != nil {
-			return errors.WithStack(err)
-		}
-		helper, err := patch.NewHelper(secret.DeepCopy(), u.managementClusterClient)
-		if err != nil {
-			return err
-		}
-
-		secret.SetOwnerReferences([]metav1.OwnerReference{
-			metav1.OwnerReference{
-				APIVersion: bootstrapv1.GroupVersion.String(),
-				Kind:       "KubeadmConfig",
-				Name:       bootstrap.Name,
-				UID:        bootstrap.UID,
-			},
-		})
-
-		if err := helper.Patch(context.TODO(), secret); err != nil {
-			return err
-		}
+	if len(changes.kubeletExtraArgs) > 0 {
+		u.log.Info("Adjusted kubelet extra args of replacement", "name", replacementKey.Name, "version", u.desiredVersion.String(), "changes", changes.kubeletExtraArgs)
 	}
-
-	u.secretsUpdated = true
-
-	return nil
+	return replacement, nil
 }
 
 func (u *ControlPlaneUpgrader) resourceExists(ref v1.ObjectReference) (bool, error) {
@@ -731,30 +1606,49 @@ func (u *ControlPlaneUpgrader) updateInfrastructureReference(replacementKey ctrl
 	}
 
 	// Step 2: if we're here, we need to create it
-
-	// get original infrastructure object
-	infraRef, err := external.Get(u.managementClusterClient, &ref, u.clusterNamespace)
+	infraRef, err := u.replacementInfrastructure(replacementKey, ref)
 	if err != nil {
 		return err
 	}
 
-	// prep the replacement
-	infraRef.SetResourceVersion("")
-	infraRef.SetName(replacementKey.Name)
-	infraRef.SetOwnerReferences(nil)
-	unstructured.RemoveNestedField(infraRef.UnstructuredContent(), "spec", "providerID")
-
-	// point the machine at the replacement
-
 	// create the replacement infrastructure object
 	err = u.managementClusterClient.Create(context.TODO(), infraRef)
 	if err != nil {
-		return errors.WithStack(err)
+		return explainAdmissionDenial(errors.WithStack(err), infraRef.GetKind(), infraRef.GetName())
 	}
 
 	return nil
 }
 
+// replacementInfrastructure returns the infrastructure object of the machine replacing the one of ref, at
+// replacementKey, with the image and tags of the machine updates.
+func (u *ControlPlaneUpgrader) replacementInfrastructure(replacementKey ctrlclient.ObjectKey, ref v1.ObjectReference) (*unstructured.Unstructured, error) {
+	infra, err := external.Get(u.managementClusterClient, &ref, u.clusterNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return u.replacementBuilder(replacementKey).infrastructure(infra)
+}
+
+// replacementBuilder returns the builder of the objects replacing a machine at replacementKey.
+func (u *ControlPlaneUpgrader) replacementBuilder(replacementKey ctrlclient.ObjectKey) replacementBuilder {
+	b := replacementBuilder{
+		name:                     replacementKey.Name,
+		version:                  u.desiredVersion,
+		machineUpdates:           u.machineUpdates,
+		extraLabels:              u.extraLabels,
+		extraAnnotations:         u.extraAnnotations,
+		convertInitConfiguration: u.convertInitConfiguration,
+		kubeletExtraArgsRules:    u.kubeletExtraArgsRules,
+		kubeadmPatches:           u.kubeadmPatches,
+		apiServerCertSANs:        u.apiServerCertSANs,
+	}
+	if u.egressSelector != nil {
+		b.files = u.egressSelector.files
+	}
+	return b
+}
+
 func hostnameForNode(node *v1.Node) string {
 	for _, address := range node.Status.Addresses {
 		if address.Type == v1.NodeHostName {
@@ -765,31 +1659,7 @@ func hostnameForNode(node *v1.Node) string {
 }
 
 func (u *ControlPlaneUpgrader) listMachines() ([]*clusterv1.Machine, error) {
-	labels := ctrlclient.MatchingLabels{
-		clusterv1.MachineClusterLabelName:      u.clusterName,
-		clusterv1.MachineControlPlaneLabelName: "true",
-	}
-	listOptions := []ctrlclient.ListOption{
-		labels,
-		ctrlclient.InNamespace(u.clusterNamespace),
-	}
-	machines := &clusterv1.MachineList{}
-
-	u.log.Info("Listing machines", "labelSelector", labels)
-	err := u.managementClusterClient.List(context.TODO(), machines, listOptions...)
-	if err != nil {
-		return nil, errors.Wrap(err, "error listing machines")
-	}
-
-	var ret []*clusterv1.Machine
-	for i := range machines.Items {
-		m := machines.Items[i]
-		if m.DeletionTimestamp.IsZero() {
-			ret = append(ret, &m)
-		}
-	}
-
-	return ret, nil
+	return listControlPlaneMachines(u.log, u.managementClusterClient, u.clusterNamespace, u.clusterName)
 }
 
 type etcdMembersResponse struct {
@@ -800,6 +1670,7 @@ type etcdMember struct {
 	ID         uint64   `json:"ID"`
 	Name       string   `json:"name"`
 	ClientURLs []string `json:"clientURLs"`
+	IsLearner  bool     `json:"isLearner"`
 }
 
 func (u *ControlPlaneUpgrader) listEtcdMembers(timeout time.Duration) ([]etcdMember, error) {
@@ -811,12 +1682,7 @@ func (u *ControlPlaneUpgrader) listEtcdMembers(timeout time.Duration) ([]etcdMem
 		return []etcdMember{}, err
 	}
 
-	var resp etcdMembersResponse
-	if err := json.Unmarshal([]byte(stdout), &resp); err != nil {
-		return []etcdMember{}, errors.Wrap(err, "unable to parse etcdctl member list json output")
-	}
-
-	return resp.Members, nil
+	return parseEtcdMembers(stdout)
 }
 
 func (u *ControlPlaneUpgrader) oldNodeToEtcdMemberId(timeout time.Duration) error {
@@ -837,14 +1703,74 @@ func (u *ControlPlaneUpgrader) oldNodeToEtcdMemberId(timeout time.Duration) erro
 	return nil
 }
 
-// deleteEtcdMember deletes the old etcd member
-func (u *ControlPlaneUpgrader) deleteEtcdMember(timeout time.Duration, etcdMemberId string) error {
+// deleteEtcdMember deletes the old etcd member. It returns false if the member was already removed, such as by a
+// previous run of a resumed upgrade or by kubeadm reset, which is not an error.
+func (u *ControlPlaneUpgrader) deleteEtcdMember(timeout time.Duration, etcdMemberId string) (bool, error) {
+	members, err := u.listEtcdMembers(timeout)
+	if err != nil {
+		return false, err
+	}
+	if !etcdMemberListed(members, etcdMemberId) {
+		u.log.Info("Etcd member already removed", "id", etcdMemberId)
+		return false, nil
+	}
+
 	u.log.Info("Deleting etcd member", "id", etcdMemberId)
 	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
 	defer cancel()
 
-	_, _, err := u.etcdctl(ctx, "member", "remove", etcdMemberId)
-	return err
+	_, stderr, err := u.etcdctl(ctx, "member", "remove", etcdMemberId)
+	if err != nil && etcdMemberNotFound(stderr) {
+		// removed since it was listed
+		u.log.Info("Etcd member already removed", "id", etcdMemberId)
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// waitForEtcdMember waits until the etcd member named name is listed and its endpoints report healthy, so the old
+// member is only removed once the cluster has its replacement.
+func (u *ControlPlaneUpgrader) waitForEtcdMember(name string, timeout time.Duration) error {
+	u.log.Info("Waiting for etcd member to be healthy", "member", name)
+
+	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+		members, err := u.listEtcdMembers(time.Minute * 1)
+		if err != nil {
+			u.log.Error(err, "Error listing etcd members, will try again")
+			return false, nil
+		}
+
+		member := findEtcdMember(members, name)
+		if member == nil || len(member.ClientURLs) == 0 {
+			u.log.Info("Etcd member not started yet", "member", name)
+			return false, nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Minute*1)
+		defer cancel()
+
+		if err := u.etcdEndpointHealth(ctx, member.ClientURLs); err != nil {
+			u.log.Info("Etcd member not healthy yet", "member", name, "error", err.Error())
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "timed out waiting for etcd member %s to be healthy", name)
+	}
+
+	return nil
+}
+
+// findEtcdMember returns the member of members named name, or nil. Members that have been added but not started yet
+// have no name.
+func findEtcdMember(members []etcdMember, name string) *etcdMember {
+	for i := range members {
+		if members[i].Name == name {
+			return &members[i]
+		}
+	}
+	return nil
 }
 
 func (u *ControlPlaneUpgrader) listEtcdPods() ([]v1.Pod, error) {
@@ -856,26 +1782,30 @@ func (u *ControlPlaneUpgrader) listEtcdPods() ([]v1.Pod, error) {
 	return list.Items, nil
 }
 
-func (u *ControlPlaneUpgrader) etcdctl(ctx context.Context, args ...string) (string, string, error) {
-	pods, err := u.listEtcdPods()
-	if err != nil {
-		return "", "", err
-	}
-	if len(pods) == 0 {
-		return "", "", errors.New("found 0 etcd pods")
-	}
-
-	var (
-		stdout, stderr string
-	)
+// mutatingEtcdctlCommands are the etcdctl commands changing the members of etcd, which are run only once.
+var mutatingEtcdctlCommands = []string{"member add", "member remove", "member update"}
 
-	// Try all etcd pods. Return as soon as we get a successful result.
-	for _, pod := range pods {
-		stdout, stderr, err = u.etcdctlForPod(ctx, &pod, args...)
-		if err == nil {
-			return stdout, stderr, nil
+// isMutatingEtcdctlCommand returns true if the etcdctl arguments args run one of the mutating etcdctl commands.
+func isMutatingEtcdctlCommand(args []string) bool {
+	command := strings.Join(args, " ")
+	for _, mutating := range mutatingEtcdctlCommands {
+		if command == mutating || strings.HasPrefix(command, mutating+" ") {
+			return true
 		}
 	}
+	return false
+}
+
+// etcdctl runs etcdctl with args, which must be the same for all supported etcd versions, in the etcd pods until it
+// succeeds in one.
+func (u *ControlPlaneUpgrader) etcdctl(ctx context.Context, args ...string) (string, string, error) {
+	var stdout, stderr string
+
+	err := u.forEachEtcdPod(ctx, func(pod *v1.Pod, _ semver.Version) error {
+		var err error
+		stdout, stderr, err = u.etcdctlForPod(ctx, pod, args...)
+		return err
+	})
 	return stdout, stderr, err
 }
 
@@ -884,14 +1814,13 @@ func (u *ControlPlaneUpgrader) etcdctlForPod(ctx context.Context, pod *v1.Pod, a
 
 	endpoint := fmt.Sprintf("https://%s:2379", pod.Status.PodIP)
 
-	fullArgs := []string{
-		"ETCDCTL_API=3",
+	fullArgs := append(u.etcdCredentials.shellPrefix(), "ETCDCTL_API=3",
 		"etcdctl",
 		"--cacert", etcdCACertFile,
 		"--cert", etcdCertFile,
 		"--key", etcdKeyFile,
 		"--endpoints", endpoint,
-	}
+	)
 
 	fullArgs = append(fullArgs, args...)
 
@@ -905,6 +1834,11 @@ func (u *ControlPlaneUpgrader) etcdctlForPod(ctx context.Context, pod *v1.Pod, a
 			"-c",
 			strings.Join(fullArgs, " "),
 		},
+		Stdin: u.etcdCredentials.stdin(),
+	}
+	if isMutatingEtcdctlCommand(args) {
+		// the first attempt may have changed the cluster before the connection was reset
+		opts.MaxAttempts = 1
 	}
 
 	opts.Command = append(opts.Command, args...)
@@ -919,41 +1853,69 @@ func (u *ControlPlaneUpgrader) etcdctlForPod(ctx context.Context, pod *v1.Pod, a
 }
 
 // updateAndUploadKubeadmKubernetesVersion updates the Kubernetes version stored in the kubeadm configmap. This is
-// required so that new Machines joining the cluster use the correct Kubernetes version as part of the upgrade.
-func (u *ControlPlaneUpgrader) updateAndUploadKubeadmKubernetesVersion() error {
-	original, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get("kubeadm-config", metav1.GetOptions{})
-	if err != nil {
-		return errors.Wrap(err, "error getting kubeadm configmap from target cluster")
-	}
+// required so that new Machines joining the cluster use the correct Kubernetes version as part of the upgrade. The
+// original ClusterConfiguration is kept in a snapshot annotation, restored if the upgrade fails. If the configmap or
+// its ClusterConfiguration is missing, the missing kubeadm configmap policy decides what happens.
+func (u *ControlPlaneUpgrader) updateAndUploadKubeadmKubernetesVersion(machines []*clusterv1.Machine) error {
+	version := "v" + u.desiredVersion.String()
 
-	updated, err := updateKubeadmKubernetesVersion(original, "v"+u.desiredVersion.String())
+	original, err := u.getKubeadmConfigMap()
 	if err != nil {
 		return err
 	}
 
-	if _, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Update(updated); err != nil {
-		return errors.Wrap(err, "error updating kubeadm configmap")
+	if original != nil {
+		updated, err := updateKubeadmKubernetesVersion(original, version)
+		if err == nil {
+			if updated, err = addAPIServerCertSANs(updated, u.apiServerCertSANs); err != nil {
+				return err
+			}
+			if err := snapshotClusterConfiguration(original, updated, u.upgradeID); err != nil {
+				return err
+			}
+			if _, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Update(updated); err != nil {
+				return errors.Wrap(err, "error updating kubeadm configmap")
+			}
+			return nil
+		}
+		if errors.Cause(err) != errNoClusterConfiguration {
+			return err
+		}
 	}
 
-	return nil
+	switch u.missingKubeadmConfigMap {
+	case KubeadmConfigMapSkip:
+		u.warnings.add(WarningKubeadmConfigMapSkipped, kubeadmConfigMapName, "kubeadm configmap was not updated to %s as it is missing or has no ClusterConfiguration", version)
+		return nil
+	case KubeadmConfigMapReconstruct:
+		return u.reconstructKubeadmConfigMap(original, machines, version)
+	default:
+		return errors.Errorf("configmap %s is missing or has no ClusterConfiguration", kubeadmConfigMapName)
+	}
 }
 
+// errNoClusterConfiguration is returned by updateKubeadmKubernetesVersion if the configmap has no ClusterConfiguration.
+var errNoClusterConfiguration = errors.New("kubeadm configmap has no ClusterConfiguration")
+
 func updateKubeadmKubernetesVersion(original *v1.ConfigMap, version string) (*v1.ConfigMap, error) {
 	cm := original.DeepCopy()
 
-	clusterConfig := make(map[string]interface{})
-	if err := yaml.Unmarshal([]byte(cm.Data["ClusterConfiguration"]), &clusterConfig); err != nil {
-		return nil, errors.Wrap(err, "error decoding kubeadm configmap ClusterConfiguration")
+	key, clusterConfig, err := findClusterConfiguration(cm)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, errNoClusterConfiguration
 	}
 
 	clusterConfig["kubernetesVersion"] = version
 
 	updated, err := yaml.Marshal(clusterConfig)
 	if err != nil {
-		return nil, errors.Wrap(err, "error encoding kubeadm configmap ClusterConfiguration")
+		return nil, errors.Wrapf(err, "error encoding kubeadm configmap %s", key)
 	}
 
-	cm.Data["ClusterConfiguration"] = string(updated)
+	cm.Data[key] = string(updated)
 
 	return cm, nil
 }
@@ -975,26 +1937,54 @@ func (u *ControlPlaneUpgrader) UpdateProviderIDsToNodes() error {
 		return errors.Wrap(err, "error listing nodes")
 	}
 
-	pairs := make(map[string]*v1.Node)
+	u.providerIDsToNodes = make(map[string]*v1.Node)
 	for i := range nodes.Items {
-		node := nodes.Items[i]
-		id := ""
-		providerID, err := noderefutil.NewProviderID(node.Spec.ProviderID)
-		if err == nil {
-			id = providerID.ID()
-		} else {
-			u.log.Error(err, "failed to parse provider id", "id", node.Spec.ProviderID, "node", node.Name)
-			// unable to parse provider ID with whitelist of provider ID formats. Use original provider ID
-			id = node.Spec.ProviderID
-		}
-		pairs[id] = &node
+		u.updateProviderIDToNode(&nodes.Items[i])
 	}
 
-	u.providerIDsToNodes = pairs
-
 	return nil
 }
 
+// updateProviderIDToNode adds or refreshes a single node in the providerID : Node map, without listing all Nodes.
+func (u *ControlPlaneUpgrader) updateProviderIDToNode(node *v1.Node) {
+	if u.providerIDsToNodes == nil {
+		u.providerIDsToNodes = make(map[string]*v1.Node)
+	}
+	u.providerIDsToNodes[u.providerIDKey(node)] = node
+}
+
+// providerIDKey returns the key of node in the providerID : Node map.
+func (u *ControlPlaneUpgrader) providerIDKey(node *v1.Node) string {
+	providerID, err := parseProviderID(node.Spec.ProviderID)
+	if err != nil {
+		u.warnings.add(WarningInvalidNodeProviderID, node.Name, "unable to parse provider id %q: %v", node.Spec.ProviderID, err)
+		// unable to parse provider ID with whitelist of provider ID formats. Use original provider ID
+		return node.Spec.ProviderID
+	}
+	return providerID.ID()
+}
+
+// getNodeWithProviderID gets the node called name and adds it to the providerID : Node map if it has providerID. It
+// returns nil if the node does not exist (yet) or has another provider ID.
+func (u *ControlPlaneUpgrader) getNodeWithProviderID(name string, providerID *noderefutil.ProviderID) (*v1.Node, error) {
+	node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting node %s", name)
+	}
+
+	nodeID, err := parseProviderID(node.Spec.ProviderID)
+	if err != nil || !providerID.Equals(nodeID) {
+		u.log.V(1).Info("Node has another provider id", "node", name, "provider-id", node.Spec.ProviderID, "expected-provider-id", providerID.String())
+		return nil, nil
+	}
+
+	u.updateProviderIDToNode(node)
+	return node, nil
+}
+
 func (u *ControlPlaneUpgrader) waitForProviderID(ns, name string, timeout time.Duration) (string, error) {
 	log := u.log.WithValues("namespace", ns, "name", name)
 	log.Info("Waiting for machine to have a provider id")
@@ -1007,6 +1997,7 @@ func (u *ControlPlaneUpgrader) waitForProviderID(ns, name string, timeout time.D
 		}
 
 		if machine.Spec.ProviderID == nil {
+			log.V(1).Info("Machine has no provider id yet", "phase", machine.Status.Phase, "infrastructure-ready", machine.Status.InfrastructureReady)
 			return false, nil
 		}
 
@@ -1025,24 +2016,51 @@ func (u *ControlPlaneUpgrader) waitForProviderID(ns, name string, timeout time.D
 	return providerID, nil
 }
 
-func (u *ControlPlaneUpgrader) waitForMatchingNode(rawProviderID string, timeout time.Duration) (*v1.Node, error) {
+// waitForMatchingNode waits for the node of machineKey, which has rawProviderID. The node is found with a single Get
+// once the machine has a node ref. Listing every node, which is expensive on clusters with thousands of worker nodes,
+// is only a fallback done every nodeListFallbackPolls polls, in case the node ref is never set.
+func (u *ControlPlaneUpgrader) waitForMatchingNode(machineKey ctrlclient.ObjectKey, rawProviderID string, timeout time.Duration) (*v1.Node, error) {
 	u.log.Info("Waiting for node", "provider-id", rawProviderID)
 	var matchingNode v1.Node
-	providerID, err := noderefutil.NewProviderID(rawProviderID)
+	providerID, err := parseProviderID(rawProviderID)
 	if err != nil {
 		return nil, err
 	}
 
+	polls := 0
 	err = wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		polls++
+
+		machine := &clusterv1.Machine{}
+		if err := u.managementClusterClient.Get(context.TODO(), machineKey, machine); err != nil {
+			u.log.Error(err, "Error getting machine, will try again", "machine", machineKey.String())
+		} else if machine.Status.NodeRef != nil {
+			node, err := u.getNodeWithProviderID(machine.Status.NodeRef.Name, providerID)
+			if err != nil {
+				u.log.Error(err, "Error getting node in target cluster, will try again")
+				return false, nil
+			}
+			if node != nil {
+				u.log.Info("Found node", "name", node.Name)
+				matchingNode = *node
+				return true, nil
+			}
+		}
+
+		if polls%nodeListFallbackPolls != 0 {
+			u.log.V(1).Info("Machine has no node ref yet", "machine", machineKey.String())
+			return false, nil
+		}
+
 		nodes, err := u.targetKubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
 		if err != nil {
 			u.log.Error(err, "Error listing nodes in target cluster, will try again")
 			return false, nil
 		}
 		for _, node := range nodes.Items {
-			nodeID, err := noderefutil.NewProviderID(node.Spec.ProviderID)
+			nodeID, err := parseProviderID(node.Spec.ProviderID)
 			if err != nil {
-				u.log.Error(err, "unable to process node's provider ID", "node", node.Name, "provider-id", node.Spec.ProviderID)
+				u.warnings.add(WarningInvalidNodeProviderID, node.Name, "unable to parse provider id %q: %v", node.Spec.ProviderID, err)
 				// Continue instead of returning so we can process all the nodes in the list
 				continue
 			}
@@ -1053,6 +2071,7 @@ func (u *ControlPlaneUpgrader) waitForMatchingNode(rawProviderID string, timeout
 			}
 		}
 
+		u.log.V(1).Info("No node has the provider id yet", "provider-id", rawProviderID, "nodes", len(nodes.Items))
 		return false, nil
 	})
 
@@ -1071,50 +2090,14 @@ func (u *ControlPlaneUpgrader) waitForNodeReady(newNode *v1.Node, timeout time.D
 		return errors.Errorf("unable to find hostname for node %s", newNode.Name)
 	}
 	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
-		ready := u.isReady(nodeHostname)
+		ready := u.isReady(newNode.Name, nodeHostname)
 		return ready, nil
 	})
 	if err != nil {
+		if logs := u.unreadyComponentLogs(newNode.Name, nodeHostname); logs != "" {
+			return errors.Wrapf(err, "components on node %s are not ready\n%s", newNode.Name, logs)
+		}
 		return errors.Wrapf(err, "components on node %s are not ready", newNode.Name)
 	}
 	return nil
 }
-
-func (u *ControlPlaneUpgrader) isReady(nodeHostname string) bool {
-	u.log.Info("Component health check for node", "hostname", nodeHostname)
-
-	components := []string{"etcd", "kube-apiserver", "kube-scheduler", "kube-controller-manager"}
-	requiredConditions := sets.NewString("PodScheduled", "Initialized", "Ready", "ContainersReady")
-
-	for _, component := range components {
-		foundConditions := sets.NewString()
-
-		podName := fmt.Sprintf("%s-%v", component, nodeHostname)
-		log := u.log.WithValues("pod", podName)
-
-		log.Info("Getting pod")
-		pod, err := u.targetKubernetesClient.CoreV1().Pods("kube-system").Get(podName, metav1.GetOptions{})
-		if apierrors.IsNotFound(err) {
-			log.Info("Pod not found yet")
-			return false
-		} else if err != nil {
-			log.Error(err, "error getting pod")
-			return false
-		}
-
-		for _, condition := range pod.Status.Conditions {
-			if condition.Status == "True" {
-				foundConditions.Insert(string(condition.Type))
-			}
-		}
-
-		missingConditions := requiredConditions.Difference(foundConditions)
-		if missingConditions.Len() > 0 {
-			missingDescription := strings.Join(missingConditions.List(), ",")
-			log.Info("pod is missing some required conditions", "conditions", missingDescription)
-			return false
-		}
-	}
-
-	return true
-}
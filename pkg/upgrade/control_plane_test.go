@@ -162,7 +162,12 @@ func TestGenerateMachineName(t *testing.T) {
 		{
 			name:         "trimming",
 			originalName: strings.Repeat("s", maxNameLength),
-			expected:     strings.Repeat("s", maxNameLengthWithoutTrimming) + suffix,
+			expected:     strings.Repeat("s", maxNameLengthWithoutTrimming-9) + "-" + replacementNameHash(strings.Repeat("s", maxNameLength)) + suffix,
+		},
+		{
+			name:         "trimming drops trailing separators",
+			originalName: strings.Repeat("s", maxNameLengthWithoutTrimming-10) + "-." + strings.Repeat("s", 20),
+			expected:     strings.Repeat("s", maxNameLengthWithoutTrimming-10) + "-" + replacementNameHash(strings.Repeat("s", maxNameLengthWithoutTrimming-10)+"-."+strings.Repeat("s", 20)) + suffix,
 		},
 		{
 			name:         "replace old upgrade id - short",
@@ -185,3 +190,41 @@ func TestGenerateMachineName(t *testing.T) {
 		})
 	}
 }
+
+func TestFindEtcdMember(t *testing.T) {
+	members := []etcdMember{
+		{ID: 1, Name: "ip-10-0-0-1", ClientURLs: []string{"https://10.0.0.1:2379"}},
+		{ID: 2},
+		{ID: 3, Name: "ip-10-0-0-3", ClientURLs: []string{"https://10.0.0.3:2379"}},
+	}
+
+	member := findEtcdMember(members, "ip-10-0-0-3")
+	if member == nil || member.ID != 3 {
+		t.Errorf("expected member 3, got %#v", member)
+	}
+	if member := findEtcdMember(members, "ip-10-0-0-2"); member != nil {
+		t.Errorf("expected no member, got %#v", member)
+	}
+}
+
+func TestUpdateProviderIDToNode(t *testing.T) {
+	u := &ControlPlaneUpgrader{}
+
+	old := &v1.Node{Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-1"}}
+	u.updateProviderIDToNode(old)
+	if u.GetNodeFromProviderID("i-1") != old {
+		t.Fatalf("expected node to be keyed by its parsed provider id, got %v", u.providerIDsToNodes)
+	}
+
+	replacement := &v1.Node{Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-2"}}
+	u.updateProviderIDToNode(replacement)
+	if u.GetNodeFromProviderID("i-1") != old || u.GetNodeFromProviderID("i-2") != replacement {
+		t.Fatalf("expected both nodes to be mapped, got %v", u.providerIDsToNodes)
+	}
+
+	invalid := &v1.Node{Spec: v1.NodeSpec{ProviderID: "not-a-provider-id"}}
+	u.updateProviderIDToNode(invalid)
+	if u.GetNodeFromProviderID("not-a-provider-id") != invalid {
+		t.Fatalf("expected node with an invalid provider id to be keyed by its raw provider id, got %v", u.providerIDsToNodes)
+	}
+}
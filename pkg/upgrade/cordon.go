@@ -0,0 +1,96 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// oldNodesToCordon returns the sorted nodes of the machines the upgrade upgradeID is about to replace: machines that
+// are not replacements of the upgrade, nor belong to another upgrade, nor exclude node draining.
+func oldNodesToCordon(machines []*clusterv1.Machine, upgradeID string) []string {
+	var nodes []string
+	for _, m := range machines {
+		if strings.HasSuffix(m.Name, upgradeSuffix(upgradeID)) {
+			continue
+		}
+		if id := m.Annotations[AnnotationUpgradeID]; id != "" && id != upgradeID {
+			continue
+		}
+		if m.Status.NodeRef == nil || excludesNodeDraining(m) {
+			continue
+		}
+		nodes = append(nodes, m.Status.NodeRef.Name)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// cordonOldNodes cordons the nodes of the machines about to be replaced, so that no new workloads land on them before
+// they are deleted. The nodes it cordons are uncordoned by uncordonOldNodes if the upgrade fails.
+func (u *ControlPlaneUpgrader) cordonOldNodes(machines []*clusterv1.Machine) error {
+	nodes := oldNodesToCordon(machines, u.upgradeID)
+	for _, node := range nodes {
+		cordoned, err := u.cordonNode(node)
+		if err != nil {
+			return err
+		}
+		if cordoned {
+			u.cordonedNodes = append(u.cordonedNodes, node)
+		}
+	}
+	u.record.event("Cordoned %d old control plane nodes", len(u.cordonedNodes))
+	return nil
+}
+
+// uncordonOldNodes uncordons the nodes cordoned by cordonOldNodes that still exist, once the upgrade failed. Nodes
+// that cannot be uncordoned are reported as warnings.
+func (u *ControlPlaneUpgrader) uncordonOldNodes() {
+	if len(u.cordonedNodes) == 0 {
+		return
+	}
+
+	u.log.Info("Uncordoning the old control plane nodes cordoned by the upgrade")
+	uncordoned := 0
+	for _, node := range u.cordonedNodes {
+		ok, err := u.uncordonNode(node)
+		if err != nil {
+			u.warnings.add(WarningNodeNotUncordoned, node, "node %s was cordoned by the upgrade and could not be uncordoned, run kubectl uncordon %s: %v", node, node, err)
+			continue
+		}
+		if ok {
+			uncordoned++
+		}
+	}
+	u.cordonedNodes = nil
+	u.record.event("Uncordoned %d old control plane nodes", uncordoned)
+}
+
+// uncordonNode marks the node nodeName schedulable. It returns false if the node no longer exists, such as once its
+// machine is deleted, or already was schedulable.
+func (u *ControlPlaneUpgrader) uncordonNode(nodeName string) (bool, error) {
+	node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "error getting node %s", nodeName)
+	}
+	if !node.Spec.Unschedulable {
+		return false, nil
+	}
+
+	u.log.Info("Uncordoning node", "node", nodeName)
+	node.Spec.Unschedulable = false
+	if _, err := u.targetKubernetesClient.CoreV1().Nodes().Update(node); err != nil {
+		return false, errors.Wrapf(err, "error uncordoning node %s", nodeName)
+	}
+	return true, nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestOldNodesToCordon(t *testing.T) {
+	machine := func(name, node, upgradeID string) *clusterv1.Machine {
+		m := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+		if node != "" {
+			m.Status.NodeRef = &corev1.ObjectReference{Name: node}
+		}
+		if upgradeID != "" {
+			m.Annotations = map[string]string{AnnotationUpgradeID: upgradeID}
+		}
+		return m
+	}
+
+	machines := []*clusterv1.Machine{
+		machine("c", "node-c", ""),
+		machine("a", "node-a", "100"),
+		machine("b"+upgradeSuffix("100"), "node-b-new", "100"),
+		machine("d", "node-d", "99"),
+		machine("e", "", ""),
+		machine("f", "node-f", ""),
+	}
+	machines[5].Annotations = map[string]string{AnnotationExcludeNodeDraining: ""}
+	assert.Equal(t, []string{"node-a", "node-c"}, oldNodesToCordon(machines, "100"))
+}
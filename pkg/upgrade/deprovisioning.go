@@ -0,0 +1,68 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// verifyInfrastructureDeprovisioned waits for the infrastructure machine of the deleted machine to be deleted, which
+// infrastructure providers only allow once the instance behind it is deprovisioned. If it still exists after timeout,
+// the instance may have leaked and a warning is recorded. An error is only returned if waiting fails.
+func (u *ControlPlaneUpgrader) verifyInfrastructureDeprovisioned(machine *clusterv1.Machine, timeout time.Duration) error {
+	ref := machine.Spec.InfrastructureRef
+	adapter := providerAdapterForKind(ref.Kind)
+	key := ctrlclient.ObjectKey{Namespace: machine.Namespace, Name: ref.Name}
+	log := u.log.WithValues("kind", ref.Kind, "name", key.String())
+
+	var remaining *unstructured.Unstructured
+	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+		infra := new(unstructured.Unstructured)
+		infra.SetAPIVersion(ref.APIVersion)
+		infra.SetKind(ref.Kind)
+		if err := u.managementClusterClient.Get(context.TODO(), key, infra); err != nil {
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+			log.Error(err, "Error getting infrastructure machine, will try again")
+			return false, nil
+		}
+
+		remaining = infra
+		log.Info("Waiting for infrastructure to be deprovisioned", "instance-state", adapter.instanceState(infra))
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout && remaining != nil {
+		u.warnings.add(WarningInstanceLeaked, fmt.Sprintf("%s/%s", machine.Namespace, machine.Name), "%s",
+			leakedInstanceMessage(remaining, adapter.instanceState(remaining), timeout))
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error waiting for %s %s to be deprovisioned", ref.Kind, key.String())
+	}
+
+	log.Info("Infrastructure deprovisioned")
+	return nil
+}
+
+// leakedInstanceMessage describes an infrastructure machine that still exists timeout after its machine was deleted.
+func leakedInstanceMessage(infra *unstructured.Unstructured, instanceState string, timeout time.Duration) string {
+	msg := fmt.Sprintf("%s %s still exists %s after its machine was deleted", infra.GetKind(), infra.GetName(), timeout)
+	if infra.GetDeletionTimestamp() == nil {
+		msg += " and is not being deleted"
+	}
+	if instanceState != "" {
+		msg += fmt.Sprintf("; the provider reports its instance as %s", instanceState)
+	}
+	return msg + "; check that its instance was deprovisioned"
+}
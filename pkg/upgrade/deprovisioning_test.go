@@ -0,0 +1,32 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestLeakedInstanceMessage(t *testing.T) {
+	infra := &unstructured.Unstructured{}
+	infra.SetKind("AWSMachine")
+	infra.SetName("cp-0")
+
+	assert.Equal(t,
+		"AWSMachine cp-0 still exists 15m0s after its machine was deleted and is not being deleted; check that its instance was deprovisioned",
+		leakedInstanceMessage(infra, "", 15*time.Minute),
+	)
+
+	now := metav1.Now()
+	infra.SetDeletionTimestamp(&now)
+	assert.Equal(t,
+		"AWSMachine cp-0 still exists 15m0s after its machine was deleted; the provider reports its instance as running; check that its instance was deprovisioned",
+		leakedInstanceMessage(infra, "running", 15*time.Minute),
+	)
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DiscoveryConfig selects the management clusters and namespaces to discover Clusters in.
+type DiscoveryConfig struct {
+	// Kubeconfig is a path to a kubeconfig
+	Kubeconfig string `json:"kubeconfig"`
+	// Contexts are the kubeconfig contexts of the management clusters. Defaults to the current context.
+	Contexts []string `json:"contexts,omitempty"`
+	// AllContexts discovers Clusters in every context of the kubeconfig, ignoring Contexts.
+	AllContexts bool `json:"allContexts"`
+	// Namespace limits discovery to a single namespace. Defaults to all namespaces.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// DiscoveryReport lists the Clusters found in each management cluster context.
+type DiscoveryReport struct {
+	Clusters []DiscoveredCluster `json:"clusters"`
+	// Failures lists the contexts whose Clusters could not be listed.
+	Failures []DiscoveryFailure `json:"failures,omitempty"`
+}
+
+// DiscoveredCluster summarizes the versions of a Cluster's Machines and whether it is eligible for an upgrade.
+type DiscoveredCluster struct {
+	Context              string   `json:"context"`
+	Namespace            string   `json:"namespace"`
+	Name                 string   `json:"name"`
+	ControlPlaneMachines int      `json:"controlPlaneMachines"`
+	ControlPlaneVersions []string `json:"controlPlaneVersions,omitempty"`
+	WorkerMachines       int      `json:"workerMachines"`
+	WorkerVersions       []string `json:"workerVersions,omitempty"`
+	// DesiredVersion is the version the Cluster was last upgraded towards, from AnnotationDesiredKubernetesVersion.
+	DesiredVersion string `json:"desiredVersion,omitempty"`
+	Eligible       bool   `json:"eligible"`
+	// Reasons explains why the Cluster is not eligible for an upgrade.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// DiscoveryFailure records why the Clusters of a context could not be listed.
+type DiscoveryFailure struct {
+	Context string `json:"context"`
+	Error   string `json:"error"`
+}
+
+// Discover lists the Clusters in the management cluster contexts selected by config. A context that cannot be reached
+// is recorded as a failure in the report instead of failing discovery.
+func Discover(log logr.Logger, config DiscoveryConfig) (*DiscoveryReport, error) {
+	contexts, current, err := kubernetes.Contexts(kubernetes.KubeConfigPath(config.Kubeconfig))
+	if err != nil {
+		return nil, err
+	}
+	if !config.AllContexts {
+		contexts = config.Contexts
+		if len(contexts) == 0 {
+			contexts = []string{current}
+		}
+	}
+
+	report := &DiscoveryReport{}
+	for _, kubeContext := range contexts {
+		log.Info("Discovering clusters", "context", kubeContext, "namespace", config.Namespace)
+		clusters, err := discoverContext(log, config, kubeContext)
+		if err != nil {
+			log.Error(err, "Error discovering clusters", "context", kubeContext)
+			report.Failures = append(report.Failures, DiscoveryFailure{Context: kubeContext, Error: err.Error()})
+			continue
+		}
+		report.Clusters = append(report.Clusters, clusters...)
+	}
+
+	return report, nil
+}
+
+func discoverContext(log logr.Logger, config DiscoveryConfig, kubeContext string) ([]DiscoveredCluster, error) {
+	c, err := kubernetes.NewClient(
+		kubernetes.KubeConfigPath(config.Kubeconfig),
+		kubernetes.KubeConfigContext(kubeContext),
+		defaultConnectTimeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var listOptions []ctrlclient.ListOption
+	if config.Namespace != "" {
+		listOptions = append(listOptions, ctrlclient.InNamespace(config.Namespace))
+	}
+
+	clusters := &clusterv1.ClusterList{}
+	if err := c.List(context.TODO(), clusters, listOptions...); err != nil {
+		return nil, errors.Wrap(err, "error listing clusters")
+	}
+
+	machines := &clusterv1.MachineList{}
+	if err := c.List(context.TODO(), machines, listOptions...); err != nil {
+		return nil, errors.Wrap(err, "error listing machines")
+	}
+
+	var ret []DiscoveredCluster
+	for _, cluster := range clusters.Items {
+		var clusterMachines []*clusterv1.Machine
+		for i := range machines.Items {
+			m := &machines.Items[i]
+			if m.Namespace == cluster.Namespace && m.Labels[clusterv1.MachineClusterLabelName] == cluster.Name && m.DeletionTimestamp.IsZero() {
+				clusterMachines = append(clusterMachines, m)
+			}
+		}
+
+		discovered := summarizeCluster(clusterMachines)
+		discovered.Context = kubeContext
+		discovered.Namespace = cluster.Namespace
+		discovered.Name = cluster.Name
+		discovered.DesiredVersion = cluster.Annotations[AnnotationDesiredKubernetesVersion]
+		ret = append(ret, discovered)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Namespace != ret[j].Namespace {
+			return ret[i].Namespace < ret[j].Namespace
+		}
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret, nil
+}
+
+// summarizeCluster returns the version spread of a Cluster's machines and whether it is eligible for an upgrade.
+func summarizeCluster(machines []*clusterv1.Machine) DiscoveredCluster {
+	var (
+		summary                              DiscoveredCluster
+		controlPlaneVersions, workerVersions = sets.NewString(), sets.NewString()
+		upgradeIDs                           = sets.NewString()
+	)
+
+	for _, m := range machines {
+		version := ""
+		if m.Spec.Version != nil {
+			version = *m.Spec.Version
+		}
+
+		if m.Labels[clusterv1.MachineControlPlaneLabelName] == "true" {
+			summary.ControlPlaneMachines++
+			controlPlaneVersions.Insert(version)
+		} else {
+			summary.WorkerMachines++
+			workerVersions.Insert(version)
+		}
+
+		if id := m.Annotations[AnnotationUpgradeID]; id != "" {
+			upgradeIDs.Insert(id)
+		}
+	}
+	summary.ControlPlaneVersions = controlPlaneVersions.List()
+	summary.WorkerVersions = workerVersions.List()
+
+	switch {
+	case summary.ControlPlaneMachines == 0:
+		summary.Reasons = append(summary.Reasons, "no control plane machines")
+	case controlPlaneVersions.Has(""):
+		summary.Reasons = append(summary.Reasons, "control plane machines without a version")
+	case controlPlaneVersions.Len() > 1:
+		summary.Reasons = append(summary.Reasons, "control plane machines are at different versions")
+	}
+
+	if len(summary.ControlPlaneVersions) == 1 && summary.ControlPlaneVersions[0] != "" {
+		controlPlane, err := semver.ParseTolerant(summary.ControlPlaneVersions[0])
+		if err != nil {
+			summary.Reasons = append(summary.Reasons, fmt.Sprintf("invalid control plane version %q", summary.ControlPlaneVersions[0]))
+		}
+		for _, v := range summary.WorkerVersions {
+			if v == "" {
+				continue
+			}
+			workerVersion, workerErr := semver.ParseTolerant(v)
+			if err == nil && workerErr == nil && workerVersion.GT(controlPlane) {
+				summary.Reasons = append(summary.Reasons, fmt.Sprintf("workers at %s are newer than the control plane", v))
+			}
+		}
+	}
+
+	for _, id := range upgradeIDs.List() {
+		summary.Reasons = append(summary.Reasons, fmt.Sprintf("upgrade %s is in progress or was interrupted", id))
+	}
+
+	summary.Eligible = len(summary.Reasons) == 0
+	return summary
+}
+
+// Print writes a human readable version of the report to w.
+func (r *DiscoveryReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTEXT\tNAMESPACE\tNAME\tCONTROL PLANE\tWORKERS\tELIGIBLE")
+	for _, c := range r.Clusters {
+		eligible := "yes"
+		if !c.Eligible {
+			eligible = "no: " + strings.Join(c.Reasons, "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.Context,
+			c.Namespace,
+			c.Name,
+			versionSpread(c.ControlPlaneMachines, c.ControlPlaneVersions),
+			versionSpread(c.WorkerMachines, c.WorkerVersions),
+			eligible,
+		)
+	}
+	tw.Flush()
+
+	for _, f := range r.Failures {
+		fmt.Fprintf(w, "context %s: %s\n", f.Context, f.Error)
+	}
+}
+
+// versionSpread formats a machine count and the distinct versions of those machines, e.g. "3 (v1.15.3, v1.15.4)".
+func versionSpread(count int, versions []string) string {
+	if count == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d (%s)", count, strings.Join(versions, ", "))
+}
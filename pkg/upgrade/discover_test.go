@@ -0,0 +1,97 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestSummarizeCluster(t *testing.T) {
+	machine := func(controlPlane bool, version string, annotations map[string]string) *clusterv1.Machine {
+		m := &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{clusterv1.MachineClusterLabelName: "test"},
+				Annotations: annotations,
+			},
+			Spec: clusterv1.MachineSpec{Version: &version},
+		}
+		if controlPlane {
+			m.Labels[clusterv1.MachineControlPlaneLabelName] = "true"
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		machines []*clusterv1.Machine
+		expected DiscoveredCluster
+	}{
+		{
+			name:     "eligible",
+			machines: []*clusterv1.Machine{machine(true, "v1.15.3", nil), machine(false, "v1.15.3", nil), machine(false, "v1.14.7", nil)},
+			expected: DiscoveredCluster{
+				ControlPlaneMachines: 1,
+				ControlPlaneVersions: []string{"v1.15.3"},
+				WorkerMachines:       2,
+				WorkerVersions:       []string{"v1.14.7", "v1.15.3"},
+				Eligible:             true,
+			},
+		},
+		{
+			name:     "no control plane",
+			machines: []*clusterv1.Machine{machine(false, "v1.15.3", nil)},
+			expected: DiscoveredCluster{
+				WorkerMachines: 1,
+				WorkerVersions: []string{"v1.15.3"},
+				Reasons:        []string{"no control plane machines"},
+			},
+		},
+		{
+			name:     "control plane version spread",
+			machines: []*clusterv1.Machine{machine(true, "v1.15.3", nil), machine(true, "v1.16.2", nil)},
+			expected: DiscoveredCluster{
+				ControlPlaneMachines: 2,
+				ControlPlaneVersions: []string{"v1.15.3", "v1.16.2"},
+				Reasons:              []string{"control plane machines are at different versions"},
+			},
+		},
+		{
+			name:     "workers newer than control plane",
+			machines: []*clusterv1.Machine{machine(true, "v1.15.3", nil), machine(false, "v1.16.2", nil)},
+			expected: DiscoveredCluster{
+				ControlPlaneMachines: 1,
+				ControlPlaneVersions: []string{"v1.15.3"},
+				WorkerMachines:       1,
+				WorkerVersions:       []string{"v1.16.2"},
+				Reasons:              []string{"workers at v1.16.2 are newer than the control plane"},
+			},
+		},
+		{
+			name:     "interrupted upgrade",
+			machines: []*clusterv1.Machine{machine(true, "v1.15.3", map[string]string{AnnotationUpgradeID: "1570000000"})},
+			expected: DiscoveredCluster{
+				ControlPlaneMachines: 1,
+				ControlPlaneVersions: []string{"v1.15.3"},
+				Reasons:              []string{"upgrade 1570000000 is in progress or was interrupted"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := summarizeCluster(tc.machines)
+			if tc.expected.WorkerVersions == nil {
+				tc.expected.WorkerVersions = []string{}
+			}
+			if tc.expected.ControlPlaneVersions == nil {
+				tc.expected.ControlPlaneVersions = []string{}
+			}
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Values for Config.DistroProfile.
+const (
+	// DistroProfileVanilla is upstream kubeadm: minor version upgrades create the kubelet configmap of the new version
+	// and the RBAC allowing nodes to read it.
+	DistroProfileVanilla = "vanilla"
+	// DistroProfileEKSA is for EKS Anywhere, which manages the kubelet configmap RBAC itself: minor version upgrades
+	// only create the kubelet configmap.
+	DistroProfileEKSA = "eksa"
+	// DistroProfileManaged is for managed kubeadm forks that manage both the kubelet configmap and its RBAC: minor
+	// version upgrades create neither.
+	DistroProfileManaged = "managed"
+)
+
+// distroProfile is the set of built-in steps of minor version upgrades a distribution manages itself. The zero value
+// is DistroProfileVanilla.
+type distroProfile struct {
+	// name is the Config.DistroProfile value of the profile.
+	name string
+	// skipKubeletConfigMap leaves creating the shared kubelet configmap of the new version to the distribution.
+	skipKubeletConfigMap bool
+	// skipKubeletRBAC leaves creating the role and role binding allowing nodes to read the shared kubelet configmap to
+	// the distribution.
+	skipKubeletRBAC bool
+}
+
+// distroProfiles are the supported distribution profiles by name.
+var distroProfiles = map[string]distroProfile{
+	DistroProfileVanilla: {name: DistroProfileVanilla},
+	DistroProfileEKSA:    {name: DistroProfileEKSA, skipKubeletRBAC: true},
+	DistroProfileManaged: {name: DistroProfileManaged, skipKubeletConfigMap: true, skipKubeletRBAC: true},
+}
+
+// parseDistroProfile returns the distribution profile name, defaulting it to DistroProfileVanilla.
+func parseDistroProfile(name string) (distroProfile, error) {
+	if name == "" {
+		name = DistroProfileVanilla
+	}
+	profile, ok := distroProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(distroProfiles))
+		for n := range distroProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return distroProfile{}, errors.Errorf("invalid distro profile %q: must be one of %s", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
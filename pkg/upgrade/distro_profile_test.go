@@ -0,0 +1,109 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseDistroProfile(t *testing.T) {
+	profile, err := parseDistroProfile("")
+	assert.NoError(t, err)
+	assert.Equal(t, distroProfile{name: DistroProfileVanilla}, profile)
+
+	profile, err = parseDistroProfile(DistroProfileEKSA)
+	assert.NoError(t, err)
+	assert.False(t, profile.skipKubeletConfigMap)
+	assert.True(t, profile.skipKubeletRBAC)
+
+	profile, err = parseDistroProfile(DistroProfileManaged)
+	assert.NoError(t, err)
+	assert.True(t, profile.skipKubeletConfigMap)
+	assert.True(t, profile.skipKubeletRBAC)
+
+	_, err = parseDistroProfile("openshift")
+	assert.EqualError(t, err, `invalid distro profile "openshift": must be one of eksa, managed, vanilla`)
+}
+
+func TestCheckKubeletConfigDistroProfile(t *testing.T) {
+	version := semver.MustParse("1.16.2")
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: kubeletConfigMapName(version)},
+	})
+
+	tests := []struct {
+		profile  string
+		problems []string
+	}{
+		{profile: DistroProfileVanilla, problems: []string{"role kubeadm:kubelet-config-1.16 does not exist", "rolebinding kubeadm:kubelet-config-1.16 does not exist"}},
+		{profile: DistroProfileEKSA},
+		{profile: DistroProfileManaged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			profile, err := parseDistroProfile(tt.profile)
+			assert.NoError(t, err)
+			v := &Verifier{version: version, targetKubernetesClient: client, distroProfile: profile}
+			problems, err := v.checkKubeletConfig()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.problems, problems)
+		})
+	}
+
+	v := &Verifier{version: version, targetKubernetesClient: fake.NewSimpleClientset(), distroProfile: distroProfiles[DistroProfileManaged]}
+	problems, err := v.checkKubeletConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestReplaceMachinesPatchUpgradeKubeletConfigDistroProfile(t *testing.T) {
+	version := semver.MustParse("1.16.3")
+	kubeletConfig := []byte("apiVersion: kubelet.config.k8s.io/v1beta1\nkind: KubeletConfiguration\nmaxPods: 64\n")
+
+	tests := []struct {
+		profile string
+		written bool
+	}{
+		{profile: DistroProfileVanilla, written: true},
+		{profile: DistroProfileEKSA, written: true},
+		{profile: DistroProfileManaged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&v1.ConfigMap{
+				// the fake clientset does not set resource versions as the API server does
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: kubeletConfigMapName(version), ResourceVersion: "1"},
+				Data:       map[string]string{kubeadmKubeletConfigKey: "maxPods: 110\n"},
+			})
+			u := &ControlPlaneUpgrader{
+				log:                    logrtesting.NullLogger{},
+				desiredVersion:         version,
+				targetKubernetesClient: client,
+				kubeletConfig:          kubeletConfig,
+				distroProfile:          distroProfiles[tt.profile],
+			}
+
+			// Without etcd pods, the upgrade stops at the etcd health check following the kubelet config
+			err := u.replaceMachines(nil, semver.MustParse("1.16.2"))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "found 0 etcd pods")
+
+			cm, err := client.CoreV1().ConfigMaps("kube-system").Get(kubeletConfigMapName(version), metav1.GetOptions{})
+			require.NoError(t, err)
+			if tt.written {
+				assert.Equal(t, string(kubeletConfig), cm.Data[kubeadmKubeletConfigKey])
+			} else {
+				assert.Equal(t, "maxPods: 110\n", cm.Data[kubeadmKubeletConfigKey])
+			}
+		})
+	}
+}
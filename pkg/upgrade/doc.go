@@ -0,0 +1,10 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upgrade upgrades the control planes and MachineDeployments of Cluster API clusters.
+//
+// Upgraders keep all their state, their clients and the rate limiters, schemes and caches behind them, to themselves
+// and do not change the Config they are created from, so upgraders of different clusters can be created and run
+// concurrently in one process, as fleet upgrades do. A single upgrader is not safe for concurrent use. Read-only mode,
+// enabled with EnableReadOnly, and debug logging are the only process-wide settings.
+package upgrade
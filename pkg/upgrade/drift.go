@@ -0,0 +1,228 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DriftDetector checks that control plane Machines are consistent with their infrastructure and bootstrap objects,
+// and with the Nodes they represent.
+type DriftDetector struct {
+	log                     logr.Logger
+	clusterNamespace        string
+	clusterName             string
+	managementClusterClient ctrlclient.Client
+	targetKubernetesClient  kubernetes.Interface
+}
+
+// DriftReport lists the problems found for each control plane Machine.
+type DriftReport struct {
+	Machines []MachineDrift `json:"machines"`
+}
+
+// MachineDrift lists the problems found for a single Machine.
+type MachineDrift struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Problems  []string `json:"problems,omitempty"`
+}
+
+func NewDriftDetector(log logr.Logger, config Config) (*DriftDetector, error) {
+	clients, err := newClusterClients(log, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DriftDetector{
+		log:                     log,
+		clusterNamespace:        config.TargetCluster.Namespace,
+		clusterName:             config.TargetCluster.Name,
+		managementClusterClient: clients.managementClusterClient,
+		targetKubernetesClient:  clients.targetKubernetesClient,
+	}, nil
+}
+
+// Clean returns true if no problems were found for any Machine.
+func (r *DriftReport) Clean() bool {
+	for _, m := range r.Machines {
+		if len(m.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes a human readable version of the report to w.
+func (r *DriftReport) Print(w io.Writer) {
+	for _, m := range r.Machines {
+		if len(m.Problems) == 0 {
+			fmt.Fprintf(w, "%s/%s: OK\n", m.Namespace, m.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s/%s: %d problem(s)\n", m.Namespace, m.Name, len(m.Problems))
+		for _, p := range m.Problems {
+			fmt.Fprintf(w, "  - %s\n", p)
+		}
+	}
+}
+
+// Detect checks all control plane Machines in the cluster for drift.
+func (d *DriftDetector) Detect() (*DriftReport, error) {
+	machines, err := listControlPlaneMachines(d.log, d.managementClusterClient, d.clusterNamespace, d.clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.detect(machines)
+}
+
+func (d *DriftDetector) detect(machines []*clusterv1.Machine) (*DriftReport, error) {
+	report := &DriftReport{}
+
+	for _, machine := range machines {
+		problems, err := d.checkMachine(machine)
+		if err != nil {
+			return nil, err
+		}
+		report.Machines = append(report.Machines, MachineDrift{
+			Namespace: machine.Namespace,
+			Name:      machine.Name,
+			Problems:  problems,
+		})
+	}
+
+	return report, nil
+}
+
+func (d *DriftDetector) checkMachine(machine *clusterv1.Machine) ([]string, error) {
+	log := d.log.WithValues("machine", fmt.Sprintf("%s/%s", machine.Namespace, machine.Name))
+	log.Info("Checking machine for drift")
+
+	var problems []string
+
+	infra, err := external.Get(d.managementClusterClient, &machine.Spec.InfrastructureRef, machine.Namespace)
+	switch {
+	case apierrors.IsNotFound(errors.Cause(err)):
+		problems = append(problems, fmt.Sprintf("infrastructure reference %s %s does not exist", machine.Spec.InfrastructureRef.Kind, machine.Spec.InfrastructureRef.Name))
+	case err != nil:
+		return nil, err
+	default:
+		if !hasMachineOwnerRef(infra.GetOwnerReferences(), machine) {
+			problems = append(problems, fmt.Sprintf("%s %s is not owned by the machine", infra.GetKind(), infra.GetName()))
+		}
+		infraProviderID, found, _ := unstructured.NestedString(infra.Object, "spec", "providerID")
+		if found && machine.Spec.ProviderID != nil && infraProviderID != *machine.Spec.ProviderID {
+			problems = append(problems, fmt.Sprintf("%s %s has provider id %q, machine has %q", infra.GetKind(), infra.GetName(), infraProviderID, *machine.Spec.ProviderID))
+		}
+	}
+
+	if machine.Spec.Bootstrap.ConfigRef != nil {
+		bootstrap, err := external.Get(d.managementClusterClient, machine.Spec.Bootstrap.ConfigRef, machine.Namespace)
+		switch {
+		case apierrors.IsNotFound(errors.Cause(err)):
+			problems = append(problems, fmt.Sprintf("bootstrap reference %s %s does not exist", machine.Spec.Bootstrap.ConfigRef.Kind, machine.Spec.Bootstrap.ConfigRef.Name))
+		case err != nil:
+			return nil, err
+		default:
+			if !hasMachineOwnerRef(bootstrap.GetOwnerReferences(), machine) {
+				problems = append(problems, fmt.Sprintf("%s %s is not owned by the machine", bootstrap.GetKind(), bootstrap.GetName()))
+			}
+		}
+	}
+
+	nodeProblems, err := d.checkNode(machine)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(problems, nodeProblems...), nil
+}
+
+func (d *DriftDetector) checkNode(machine *clusterv1.Machine) ([]string, error) {
+	if machine.Spec.ProviderID == nil || *machine.Spec.ProviderID == "" {
+		return []string{"machine has no spec.providerID"}, nil
+	}
+	if machine.Status.NodeRef == nil {
+		return []string{"machine has no status.nodeRef"}, nil
+	}
+
+	node, err := d.targetKubernetesClient.CoreV1().Nodes().Get(machine.Status.NodeRef.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return []string{fmt.Sprintf("node %s does not exist", machine.Status.NodeRef.Name)}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting node %s", machine.Status.NodeRef.Name)
+	}
+
+	if !providerIDsEqual(*machine.Spec.ProviderID, node.Spec.ProviderID) {
+		return []string{fmt.Sprintf("node %s has provider id %q, machine has %q", node.Name, node.Spec.ProviderID, *machine.Spec.ProviderID)}, nil
+	}
+
+	return nil, nil
+}
+
+// hasMachineOwnerRef returns true if refs contains an owner reference to machine.
+func hasMachineOwnerRef(refs []metav1.OwnerReference, machine *clusterv1.Machine) bool {
+	for _, ref := range refs {
+		if ref.Kind != "Machine" || ref.Name != machine.Name {
+			continue
+		}
+		if ref.UID != "" && machine.UID != "" && ref.UID != machine.UID {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// providerIDsEqual compares two provider IDs, falling back to a string comparison when either cannot be parsed.
+func providerIDsEqual(a, b string) bool {
+	aID, aErr := parseProviderID(a)
+	bID, bErr := parseProviderID(b)
+	if aErr != nil || bErr != nil {
+		return a == b
+	}
+	return aID.Equals(bID)
+}
+
+// detectDrift checks machines for drift from their infrastructure, bootstrap or Node objects.
+func (u *ControlPlaneUpgrader) detectDrift(machines []*clusterv1.Machine) (*DriftReport, error) {
+	d := &DriftDetector{
+		log:                     u.log,
+		clusterNamespace:        u.clusterNamespace,
+		clusterName:             u.clusterName,
+		managementClusterClient: u.managementClusterClient,
+		targetKubernetesClient:  u.targetKubernetesClient,
+	}
+
+	return d.detect(machines)
+}
+
+// checkDrift returns an error if any of machines has drifted from its infrastructure, bootstrap or Node objects.
+func (u *ControlPlaneUpgrader) checkDrift(machines []*clusterv1.Machine) error {
+	report, err := u.detectDrift(machines)
+	if err != nil {
+		return err
+	}
+	if report.Clean() {
+		return nil
+	}
+
+	var b strings.Builder
+	report.Print(&b)
+	return errors.Errorf("control plane machines have drifted, refusing to upgrade:\n%s", b.String())
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestHasMachineOwnerRef(t *testing.T) {
+	machine := &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "machine-1",
+			UID:  "uid-1",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		refs     []metav1.OwnerReference
+		expected bool
+	}{
+		{
+			name:     "no owner refs",
+			expected: false,
+		},
+		{
+			name:     "matching owner ref",
+			refs:     []metav1.OwnerReference{{Kind: "Machine", Name: "machine-1", UID: "uid-1"}},
+			expected: true,
+		},
+		{
+			name:     "matching owner ref without uid",
+			refs:     []metav1.OwnerReference{{Kind: "Machine", Name: "machine-1"}},
+			expected: true,
+		},
+		{
+			name:     "stale uid",
+			refs:     []metav1.OwnerReference{{Kind: "Machine", Name: "machine-1", UID: "uid-0"}},
+			expected: false,
+		},
+		{
+			name:     "different machine",
+			refs:     []metav1.OwnerReference{{Kind: "Machine", Name: "machine-2", UID: "uid-2"}},
+			expected: false,
+		},
+		{
+			name:     "different kind",
+			refs:     []metav1.OwnerReference{{Kind: "MachineSet", Name: "machine-1"}},
+			expected: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := hasMachineOwnerRef(tc.refs, machine); actual != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestProviderIDsEqual(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		expected bool
+	}{
+		{
+			name:     "aws ids with different zones",
+			a:        "aws:///us-east-1a/i-1234",
+			b:        "aws:////i-1234",
+			expected: true,
+		},
+		{
+			name:     "different ids",
+			a:        "aws:///us-east-1a/i-1234",
+			b:        "aws:///us-east-1a/i-5678",
+			expected: false,
+		},
+		{
+			name:     "unparseable ids",
+			a:        "not-a-provider-id",
+			b:        "not-a-provider-id",
+			expected: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := providerIDsEqual(tc.a, tc.b); actual != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+)
+
+// redacted replaces secrets in the effective configuration.
+const redacted = "REDACTED"
+
+// EffectiveConfig is the configuration an upgrade runs with, once defaults are applied, and what it resolved to. It is
+// logged when the upgrade starts and recorded in its report, with secrets redacted.
+type EffectiveConfig struct {
+	Config
+	// DesiredVersion is the Kubernetes version the upgrade resolved KubernetesVersion to.
+	DesiredVersion string `json:"desiredVersion,omitempty"`
+	// Images are the images of the replacement infrastructure machines, by infrastructure kind.
+	Images map[string]ImageUpdateConfig `json:"images,omitempty"`
+}
+
+// newEffectiveConfig returns the effective configuration of config, which must have its defaults applied, with
+// secrets redacted.
+func newEffectiveConfig(config Config) *EffectiveConfig {
+	return &EffectiveConfig{Config: redactConfig(config)}
+}
+
+// redactConfig returns a copy of config without the credentials of its URLs nor the content of its kubeadm patches,
+// which may hold secrets.
+func redactConfig(config Config) Config {
+	config.VersionManifest = redactURL(config.VersionManifest)
+	config.Approval.URL = redactURL(config.Approval.URL)
+	config.TargetCluster.Access.SOCKSProxy = redactURL(config.TargetCluster.Access.SOCKSProxy)
+	config.Results.HTTP = redactURL(config.Results.HTTP)
+	config.Readiness.PrometheusURL = redactURL(config.Readiness.PrometheusURL)
+	if vault := config.TargetCluster.Kubeconfig.Vault; vault != nil {
+		redactedVault := *vault
+		redactedVault.Address = redactURL(vault.Address)
+		config.TargetCluster.Kubeconfig.Vault = &redactedVault
+	}
+
+	if len(config.KubeadmPatches.Files) > 0 {
+		files := make(map[string]string, len(config.KubeadmPatches.Files))
+		for name := range config.KubeadmPatches.Files {
+			files[name] = redacted
+		}
+		config.KubeadmPatches.Files = files
+	}
+	return config
+}
+
+// redactURL returns raw with the password of its user info and its query parameter values redacted, as they may
+// carry tokens. It returns raw if it is not an absolute URL, such as a file path.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return raw
+	}
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redacted}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// resolvedImages returns the images the replacement infrastructure machines of each of kinds get.
+func resolvedImages(kinds []infrastructureKindSummary) map[string]ImageUpdateConfig {
+	images := make(map[string]ImageUpdateConfig)
+	for _, kind := range kinds {
+		if kind.ImageID != "" {
+			images[kind.Kind] = ImageUpdateConfig{ID: kind.ImageID, Field: kind.ImageField}
+		}
+	}
+	return images
+}
+
+// logEffectiveConfig logs config as JSON and records it in the report.
+func logEffectiveConfig(log logr.Logger, record *runRecorder, config *EffectiveConfig) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return errors.Wrap(err, "error encoding the effective configuration")
+	}
+	log.Info("Effective configuration", "config", string(b))
+	record.configured(config)
+	return nil
+}
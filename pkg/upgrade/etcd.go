@@ -0,0 +1,275 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	// etcdMinimumVersion is assumed for etcd pods whose version cannot be detected. kubeadm installs etcd 3.2 for
+	// Kubernetes v1.13.x, the oldest version supported.
+	etcdMinimumVersion = semver.MustParse("3.2.0")
+	// etcdClusterFlagVersion is the first etcdctl version with "endpoint health --cluster".
+	etcdClusterFlagVersion = semver.MustParse("3.3.0")
+	// etcdHealthJSONVersion is the first etcdctl version that can write "endpoint health" as JSON.
+	etcdHealthJSONVersion = semver.MustParse("3.4.0")
+
+	etcdctlVersionRegex = regexp.MustCompile(`etcdctl version:\s*(\S+)`)
+	// etcdHealthLineRegex matches the text output of "endpoint health" before etcd 3.4, for example
+	// "https://10.0.0.1:2379 is unhealthy: failed to commit proposal: context deadline exceeded".
+	etcdHealthLineRegex = regexp.MustCompile(`^(\S+) is (healthy|unhealthy):\s*(.*)$`)
+)
+
+// etcdEndpointHealth is the health of a single etcd endpoint as reported by etcdctl.
+type etcdEndpointHealth struct {
+	Endpoint string `json:"endpoint"`
+	Health   bool   `json:"health"`
+	Error    string `json:"error,omitempty"`
+}
+
+// etcdVersionForPod returns the version of etcdctl in pod, detected once per pod. If it cannot be detected from
+// "etcdctl version" or the pod's image tag, the oldest supported version is assumed.
+func (u *ControlPlaneUpgrader) etcdVersionForPod(ctx context.Context, pod *v1.Pod) semver.Version {
+	if v, ok := u.etcdVersions.get(pod.UID); ok {
+		return v
+	}
+
+	v, err := u.detectEtcdVersion(ctx, pod)
+	if err != nil {
+		u.log.Info("Unable to detect etcd version, assuming the oldest supported version", "pod", pod.Name, "version", etcdMinimumVersion.String(), "error", err.Error())
+		v = etcdMinimumVersion
+	}
+
+	u.etcdVersions.set(pod.UID, v)
+	return v
+}
+
+// etcdVersionCache caches the etcd version detected in each etcd pod. It is safe for concurrent use, as the health
+// monitor detects versions while the upgrade runs. Like runRecorder, a nil cache caches nothing.
+type etcdVersionCache struct {
+	lock     sync.Mutex
+	versions map[types.UID]semver.Version
+}
+
+func (c *etcdVersionCache) get(uid types.UID) (semver.Version, bool) {
+	if c == nil {
+		return semver.Version{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.versions[uid]
+	return v, ok
+}
+
+func (c *etcdVersionCache) set(uid types.UID, v semver.Version) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.versions == nil {
+		c.versions = make(map[types.UID]semver.Version)
+	}
+	c.versions[uid] = v
+}
+
+func (u *ControlPlaneUpgrader) detectEtcdVersion(ctx context.Context, pod *v1.Pod) (semver.Version, error) {
+	stdout, _, err := u.etcdctlForPod(ctx, pod, "version")
+	if err == nil {
+		if v, err := parseEtcdctlVersion(stdout); err == nil {
+			return v, nil
+		}
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name != "etcd" {
+			continue
+		}
+		if v, err := semver.ParseTolerant(imageTag(container.Image)); err == nil {
+			return v, nil
+		}
+	}
+
+	return semver.Version{}, errors.Errorf("unable to determine the etcd version of pod %s", pod.Name)
+}
+
+// forEachEtcdPod calls fn with each etcd pod and its etcd version until it succeeds, returning the last error if it
+// never does.
+func (u *ControlPlaneUpgrader) forEachEtcdPod(ctx context.Context, fn func(pod *v1.Pod, version semver.Version) error) error {
+	pods, err := u.listEtcdPods()
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return errors.New("found 0 etcd pods")
+	}
+
+	for i := range pods {
+		pod := &pods[i]
+		if err = fn(pod, u.etcdVersionForPod(ctx, pod)); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// etcdEndpointHealth checks that the etcd endpoints are healthy, or all members if endpoints is empty. The etcdctl
+// arguments and output format depend on the etcd version of the pod it runs in.
+func (u *ControlPlaneUpgrader) etcdEndpointHealth(ctx context.Context, endpoints []string) error {
+	health, err := u.etcdEndpointHealthStatus(ctx, endpoints)
+	if err != nil {
+		return err
+	}
+	if unhealthy := unhealthyEtcdEndpoints(health); len(unhealthy) > 0 {
+		return errors.Errorf("unhealthy etcd endpoints: %s", strings.Join(unhealthy, "; "))
+	}
+	return nil
+}
+
+// unhealthyEtcdEndpoints describes the endpoints of health that are not healthy.
+func unhealthyEtcdEndpoints(health []etcdEndpointHealth) []string {
+	var unhealthy []string
+	for _, h := range health {
+		if !h.Health {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s: %s", h.Endpoint, h.Error))
+		}
+	}
+	return unhealthy
+}
+
+// etcdEndpointHealthStatus returns the health of the etcd endpoints, or of all members if endpoints is empty. An etcd
+// pod that sees unhealthy endpoints is only trusted if no other pod sees them all healthy.
+func (u *ControlPlaneUpgrader) etcdEndpointHealthStatus(ctx context.Context, endpoints []string) ([]etcdEndpointHealth, error) {
+	var ret []etcdEndpointHealth
+	err := u.forEachEtcdPod(ctx, func(pod *v1.Pod, version semver.Version) error {
+		podEndpoints := endpoints
+		if len(podEndpoints) == 0 && version.LT(etcdClusterFlagVersion) {
+			stdout, _, err := u.etcdctlForPod(ctx, pod, "member list -w json")
+			if err != nil {
+				return err
+			}
+			members, err := parseEtcdMembers(stdout)
+			if err != nil {
+				return err
+			}
+			for _, member := range members {
+				podEndpoints = append(podEndpoints, member.ClientURLs...)
+			}
+		}
+
+		stdout, stderr, err := u.etcdctlForPod(ctx, pod, etcdEndpointHealthArgs(version, podEndpoints)...)
+		health, parseErr := parseEtcdEndpointHealth(version, stdout, stderr)
+		if parseErr != nil {
+			if err != nil {
+				return err
+			}
+			return parseErr
+		}
+
+		ret = health
+		if unhealthy := unhealthyEtcdEndpoints(health); len(unhealthy) > 0 {
+			return errors.Errorf("unhealthy etcd endpoints: %s", strings.Join(unhealthy, "; "))
+		}
+		// etcdctl exits with an error for unhealthy endpoints, so any other failure is unexpected
+		return err
+	})
+	if err != nil && len(unhealthyEtcdEndpoints(ret)) == 0 {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// etcdEndpointHealthArgs returns the etcdctl arguments checking the health of endpoints, or of all members if endpoints
+// is empty, for an etcdctl of version. All members can only be checked without listing them from etcd 3.3, and JSON
+// output is only available from etcd 3.4.
+func etcdEndpointHealthArgs(version semver.Version, endpoints []string) []string {
+	args := []string{"endpoint", "health"}
+	if len(endpoints) == 0 && !version.LT(etcdClusterFlagVersion) {
+		args = append(args, "--cluster")
+	} else {
+		args = append(args, "--endpoints", strings.Join(endpoints, ","))
+	}
+	if !version.LT(etcdHealthJSONVersion) {
+		args = append(args, "-w", "json")
+	}
+	return args
+}
+
+// parseEtcdEndpointHealth parses the output of "endpoint health" for an etcdctl of version. Before etcd 3.4 the output
+// is text, with unhealthy endpoints written to stderr.
+func parseEtcdEndpointHealth(version semver.Version, stdout, stderr string) ([]etcdEndpointHealth, error) {
+	if !version.LT(etcdHealthJSONVersion) {
+		var health []etcdEndpointHealth
+		if err := json.Unmarshal([]byte(stdout), &health); err != nil {
+			return nil, errors.Wrap(err, "unable to parse etcdctl endpoint health json output")
+		}
+		return health, nil
+	}
+
+	var health []etcdEndpointHealth
+	for _, line := range strings.Split(stdout+"\n"+stderr, "\n") {
+		match := etcdHealthLineRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		h := etcdEndpointHealth{Endpoint: match[1], Health: match[2] == "healthy"}
+		if !h.Health {
+			h.Error = match[3]
+		}
+		health = append(health, h)
+	}
+	if len(health) == 0 {
+		return nil, errors.Errorf("unable to parse etcdctl endpoint health output: %q", strings.TrimSpace(stdout+"\n"+stderr))
+	}
+	return health, nil
+}
+
+// parseEtcdctlVersion parses the output of "etcdctl version", such as "etcdctl version: 3.3.10\nAPI version: 3.3".
+func parseEtcdctlVersion(stdout string) (semver.Version, error) {
+	match := etcdctlVersionRegex.FindStringSubmatch(stdout)
+	if match == nil {
+		return semver.Version{}, errors.Errorf("unable to parse etcdctl version output: %q", stdout)
+	}
+	v, err := semver.ParseTolerant(match[1])
+	if err != nil {
+		return semver.Version{}, errors.Wrapf(err, "error parsing etcdctl version %q", match[1])
+	}
+	return v, nil
+}
+
+// parseEtcdMembers parses the output of "member list -w json", which is the same for all supported etcd versions.
+func parseEtcdMembers(stdout string) ([]etcdMember, error) {
+	var resp etcdMembersResponse
+	if err := json.Unmarshal([]byte(stdout), &resp); err != nil {
+		return nil, errors.Wrap(err, "unable to parse etcdctl member list json output")
+	}
+	return resp.Members, nil
+}
+
+// etcdMemberListed returns true if members has the member whose ID, in hex as etcdctl expects it, is id.
+func etcdMemberListed(members []etcdMember, id string) bool {
+	for _, member := range members {
+		if strconv.FormatUint(member.ID, 16) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// etcdMemberNotFound returns true if stderr, that of a failed "member remove", reports that the member does not exist.
+func etcdMemberNotFound(stderr string) bool {
+	return strings.Contains(stderr, "member not found")
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of the etcd credentials secret.
+const (
+	etcdCredentialsUsernameKey = "username"
+	etcdCredentialsPasswordKey = "password"
+)
+
+// etcdCredentials authenticate etcdctl as an etcd user, whose roles grant it access, on clusters with etcd auth
+// enabled. A nil etcdCredentials only uses the client certificates.
+type etcdCredentials struct {
+	username string
+	password string
+}
+
+// loadEtcdCredentials reads the etcd credentials from the secret called name in namespace. It returns nil if name is
+// empty.
+func loadEtcdCredentials(c ctrlclient.Client, namespace, name string) (*etcdCredentials, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	secret := &v1.Secret{}
+	if err := c.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: namespace, Name: name}, secret); err != nil {
+		return nil, errors.Wrapf(err, "error getting etcd credentials secret %s/%s", namespace, name)
+	}
+	return etcdCredentialsFromSecret(secret)
+}
+
+func etcdCredentialsFromSecret(secret *v1.Secret) (*etcdCredentials, error) {
+	username := string(secret.Data[etcdCredentialsUsernameKey])
+	if username == "" {
+		return nil, errors.Errorf("etcd credentials secret %s/%s has no %s", secret.Namespace, secret.Name, etcdCredentialsUsernameKey)
+	}
+	if strings.Contains(username, ":") {
+		return nil, errors.Errorf("etcd credentials secret %s/%s has a %s containing a colon", secret.Namespace, secret.Name, etcdCredentialsUsernameKey)
+	}
+	password := string(secret.Data[etcdCredentialsPasswordKey])
+	if strings.ContainsAny(username+password, "\n\r") {
+		return nil, errors.Errorf("etcd credentials secret %s/%s has a %s or %s containing a line break", secret.Namespace, secret.Name,
+			etcdCredentialsUsernameKey, etcdCredentialsPasswordKey)
+	}
+	return &etcdCredentials{
+		username: username,
+		password: password,
+	}, nil
+}
+
+// readEtcdctlUser is the shell command reading the credentials written to standard input by stdin into ETCDCTL_USER.
+// The credentials are passed on standard input so that they are neither in the pods/exec request, whose command the
+// API server audit log records, nor in the command line of any process of the etcd container.
+const readEtcdctlUser = "IFS= read -r ETCDCTL_USER && export ETCDCTL_USER &&"
+
+// shellPrefix returns the shell command reading the credentials before running etcdctl, or nil without credentials.
+func (c *etcdCredentials) shellPrefix() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{readEtcdctlUser}
+}
+
+// stdin returns the standard input passing the credentials to readEtcdctlUser, or nil without credentials.
+func (c *etcdCredentials) stdin() []byte {
+	if c == nil {
+		return nil
+	}
+	return []byte(c.username + ":" + c.password + "\n")
+}
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
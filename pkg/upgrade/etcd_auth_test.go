@@ -0,0 +1,40 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEtcdCredentialsFromSecret(t *testing.T) {
+	secret := func(data map[string]string) *v1.Secret {
+		s := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "etcd"}, Data: map[string][]byte{}}
+		for k, v := range data {
+			s.Data[k] = []byte(v)
+		}
+		return s
+	}
+
+	credentials, err := etcdCredentialsFromSecret(secret(map[string]string{"username": "root", "password": "it's secret"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{readEtcdctlUser}, credentials.shellPrefix())
+	assert.Equal(t, "root:it's secret\n", string(credentials.stdin()))
+
+	_, err = etcdCredentialsFromSecret(secret(map[string]string{"password": "secret"}))
+	assert.EqualError(t, err, "etcd credentials secret ns/etcd has no username")
+
+	_, err = etcdCredentialsFromSecret(secret(map[string]string{"username": "a:b"}))
+	assert.Error(t, err)
+
+	_, err = etcdCredentialsFromSecret(secret(map[string]string{"username": "root", "password": "secret\n"}))
+	assert.EqualError(t, err, "etcd credentials secret ns/etcd has a username or password containing a line break")
+
+	var none *etcdCredentials
+	assert.Empty(t, none.shellPrefix())
+	assert.Nil(t, none.stdin())
+}
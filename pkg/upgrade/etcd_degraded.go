@@ -0,0 +1,97 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// checkExecAllowed finds out whether exec in the kube-system pods of the target cluster is allowed. If RBAC forbids
+// it, etcdctl cannot run, and the upgrade continues degraded: etcd health is checked through the API server, the
+// checks running commands in pods are skipped, and old etcd members are left for the operator to remove.
+func (u *ControlPlaneUpgrader) checkExecAllowed() error {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   "kube-system",
+				Verb:        "create",
+				Resource:    "pods",
+				Subresource: "exec",
+			},
+		},
+	}
+	result, err := u.targetKubernetesClient.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+	if err != nil {
+		return errors.Wrap(err, "error checking whether exec in kube-system pods is allowed")
+	}
+	if result.Status.Allowed {
+		return nil
+	}
+
+	u.execForbidden = true
+	u.warnings.add(WarningEtcdDegraded, "",
+		"exec in kube-system pods of the target cluster is forbidden, so etcdctl cannot run: etcd health is checked through the API server, the etcd space check and static pod manifest scan are skipped, and old etcd members are not removed")
+	return nil
+}
+
+// apiServerEtcdHealth checks etcd health as seen by the target cluster's API server, through its /healthz/etcd
+// endpoint.
+func (u *ControlPlaneUpgrader) apiServerEtcdHealth(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	body, err := u.targetKubernetesClient.CoreV1().RESTClient().Get().AbsPath("/healthz/etcd").Context(ctx).DoRaw()
+	if err != nil {
+		return errors.Wrapf(err, "etcd is not healthy according to the API server: %s", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// etcdQuorumKept returns true if etcd keeps its quorum once a machine is deleted without removing its member, given
+// the members before the deletion, and the members without a machine once it is deleted.
+func etcdQuorumKept(members, unremoved int) bool {
+	return members-unremoved >= members/2+1
+}
+
+// skipEtcdMemberRemoval replaces the removal of the etcd member of machine, whose node is oldHostName, while exec is
+// forbidden: it waits for etcd to be healthy with the new member, then records the old member for the operator to
+// remove, refusing to go on if etcd would lose its quorum once machine is deleted.
+func (u *ControlPlaneUpgrader) skipEtcdMemberRemoval(machine *clusterv1.Machine, oldHostName string) error {
+	if u.verifyEtcdMember {
+		u.log.Info("Waiting for etcd to be healthy according to the API server")
+		// TODO extract timeout as a configurable constant
+		err := wait.PollImmediate(15*time.Second, machineReplacementStepTimeout, func() (bool, error) {
+			if err := u.apiServerEtcdHealth(time.Minute * 1); err != nil {
+				u.log.Info("Etcd not healthy yet", "error", err.Error())
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "timed out waiting for etcd to be healthy according to the API server")
+		}
+	}
+
+	// The replacement's member joined
+	members := u.etcdMembers + 1
+	unremoved := append(u.unremovedEtcdMembers, oldHostName)
+	if !etcdQuorumKept(members, len(unremoved)) {
+		return errors.Errorf("deleting machine %s/%s without removing its etcd member would lose etcd quorum; remove the etcd members of nodes %s with etcdctl member remove, then resume the upgrade with the same upgrade ID",
+			machine.Namespace, machine.Name, strings.Join(unremoved, ", "))
+	}
+	u.etcdMembers = members
+	u.unremovedEtcdMembers = unremoved
+
+	u.warnings.add(WarningEtcdMemberNotRemoved, fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
+		"the etcd member of node %s was not removed; find its ID with etcdctl member list, then run etcdctl member remove <ID>", oldHostName)
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blang/semver"
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestEtcdQuorumKept(t *testing.T) {
+	testcases := []struct {
+		members   int
+		unremoved int
+		kept      bool
+	}{
+		// A single machine control plane cannot lose its only old member
+		{members: 2, unremoved: 1, kept: false},
+		// Three machines: the first two replacements keep quorum, the third does not
+		{members: 4, unremoved: 1, kept: true},
+		{members: 5, unremoved: 2, kept: true},
+		{members: 6, unremoved: 3, kept: false},
+		// Five machines
+		{members: 6, unremoved: 1, kept: true},
+		{members: 8, unremoved: 3, kept: true},
+		{members: 9, unremoved: 4, kept: true},
+		{members: 10, unremoved: 5, kept: false},
+	}
+	for _, tc := range testcases {
+		assert.Equal(t, tc.kept, etcdQuorumKept(tc.members, tc.unremoved), "%d members, %d unremoved", tc.members, tc.unremoved)
+	}
+}
+
+func TestVerifyExecForbidden(t *testing.T) {
+	var lock sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/healthz/etcd":
+			w.Write([]byte("ok"))
+		case "/api/v1/nodes":
+			w.Write([]byte(`{"kind":"NodeList","apiVersion":"v1","items":[]}`))
+		case "/api/v1/namespaces/kube-system/pods":
+			w.Write([]byte(`{"kind":"PodList","apiVersion":"v1","items":[{"metadata":{"name":"etcd-cp-1","namespace":"kube-system","labels":{"component":"etcd"}},"status":{"podIP":"10.0.0.1"}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+		}
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL}
+	client, err := kubernetes.NewForConfig(config)
+	require.NoError(t, err)
+	u := &ControlPlaneUpgrader{
+		log:                    logrtesting.NullLogger{},
+		desiredVersion:         semver.MustParse("1.16.2"),
+		targetRestConfig:       config,
+		targetKubernetesClient: client,
+		execForbidden:          true,
+	}
+
+	err = u.verify()
+	// the cluster served above fails other checks, but not the etcd health check
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "[PASS] etcd health")
+	assert.Contains(t, paths, "/healthz/etcd")
+	for _, path := range paths {
+		assert.False(t, strings.HasSuffix(path, "/exec"), "etcdctl was run through exec: %s", path)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// etcdMaxRaftIndexLag is how many raft entries a member may be behind the most advanced member before it is reported
+// as lagging. Statuses are not read at the same instant, so a small lag is expected on a busy cluster.
+const etcdMaxRaftIndexLag = 1000
+
+// etcdAlarmLineRegex matches a line of "etcdctl alarm list", such as "memberID:8211f1d0f64f3269 alarm:NOSPACE". The
+// member ID is written in decimal.
+var etcdAlarmLineRegex = regexp.MustCompile(`^memberID:(\d+)\s+alarm:(\S+)$`)
+
+// EtcdDiagnoser reports the health of the etcd cluster of a target cluster, independently of any upgrade.
+type EtcdDiagnoser struct {
+	log                    logr.Logger
+	targetRestConfig       *rest.Config
+	targetKubernetesClient kubernetes.Interface
+	// etcdCredentials authenticate etcdctl on clusters with etcd auth enabled.
+	etcdCredentials *etcdCredentials
+}
+
+// EtcdReport describes the members of an etcd cluster, its alarms, and the problems found.
+type EtcdReport struct {
+	Members  []EtcdMemberStatus `json:"members"`
+	Alarms   []EtcdAlarm        `json:"alarms,omitempty"`
+	Problems []string           `json:"problems,omitempty"`
+}
+
+// EtcdMemberStatus is a member of an etcd cluster, with the status and health of its endpoint.
+type EtcdMemberStatus struct {
+	// ID is the member ID in hexadecimal, as etcdctl prints it.
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	ClientURLs []string `json:"clientURLs,omitempty"`
+	Learner    bool     `json:"learner,omitempty"`
+	Leader     bool     `json:"leader"`
+	Healthy    bool     `json:"healthy"`
+	// HealthError is why the member's endpoint is unhealthy.
+	HealthError string `json:"healthError,omitempty"`
+	Version     string `json:"version,omitempty"`
+	DBSize      int64  `json:"dbSize,omitempty"`
+	RaftTerm    uint64 `json:"raftTerm,omitempty"`
+	RaftIndex   uint64 `json:"raftIndex,omitempty"`
+	// RaftIndexLag is how many raft entries the member is behind the most advanced member.
+	RaftIndexLag uint64 `json:"raftIndexLag"`
+	// Errors are the errors the member's endpoint reports, such as alarms raised on it.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// EtcdAlarm is an alarm raised on an etcd member, such as NOSPACE.
+type EtcdAlarm struct {
+	MemberID string `json:"memberID"`
+	Alarm    string `json:"alarm"`
+}
+
+// NewEtcdDiagnoser returns an EtcdDiagnoser for the target cluster in config.
+func NewEtcdDiagnoser(log logr.Logger, config Config) (*EtcdDiagnoser, error) {
+	clients, err := newClusterClients(log, config)
+	if err != nil {
+		return nil, err
+	}
+	etcdCredentials, err := loadEtcdCredentials(clients.managementClusterClient, config.TargetCluster.Namespace, config.EtcdCredentialsSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EtcdDiagnoser{
+		log:                    log,
+		targetRestConfig:       clients.targetRestConfig,
+		targetKubernetesClient: clients.targetKubernetesClient,
+		etcdCredentials:        etcdCredentials,
+	}, nil
+}
+
+// Healthy returns true if no problems were found.
+func (r *EtcdReport) Healthy() bool {
+	return len(r.Problems) == 0
+}
+
+// Print writes a human readable version of the report to w.
+func (r *EtcdReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tROLE\tHEALTH\tVERSION\tDB SIZE\tRAFT TERM\tRAFT INDEX\tLAG")
+	for _, m := range r.Members {
+		role := "follower"
+		switch {
+		case m.Leader:
+			role = "leader"
+		case m.Learner:
+			role = "learner"
+		}
+		health := "healthy"
+		if !m.Healthy {
+			health = "unhealthy"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			m.ID, m.Name, role, health, m.Version, formatBytes(m.DBSize), m.RaftTerm, m.RaftIndex, m.RaftIndexLag)
+	}
+	tw.Flush()
+
+	for _, a := range r.Alarms {
+		fmt.Fprintf(w, "Alarm %s on member %s\n", a.Alarm, a.MemberID)
+	}
+	if r.Healthy() {
+		fmt.Fprintln(w, "Verdict: healthy")
+		return
+	}
+	fmt.Fprintf(w, "Verdict: unhealthy (%d problem(s))\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "  - %s\n", p)
+	}
+}
+
+// Diagnose lists the etcd members, and reads the status and health of their endpoints and the alarms of the cluster,
+// running etcdctl in the first etcd pod where it succeeds.
+func (d *EtcdDiagnoser) Diagnose() (*EtcdReport, error) {
+	// Borrow the etcd tooling of the control plane upgrader
+	etcd := &ControlPlaneUpgrader{
+		log:                    d.log,
+		targetRestConfig:       d.targetRestConfig,
+		targetKubernetesClient: d.targetKubernetesClient,
+		etcdCredentials:        d.etcdCredentials,
+	}
+
+	if kubernetes2.ReadOnly() {
+		// etcdctl cannot be run without exec, so only the health of etcd according to the API server is reported
+		report := &EtcdReport{}
+		if err := etcd.apiServerEtcdHealth(time.Minute * 1); err != nil {
+			report.Problems = append(report.Problems, err.Error())
+		}
+		return report, nil
+	}
+
+	// TODO extract timeout as a configurable constant
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Minute*1)
+	defer cancel()
+
+	var report *EtcdReport
+	err := etcd.forEachEtcdPod(ctx, func(pod *v1.Pod, version semver.Version) error {
+		var err error
+		report, err = etcd.diagnoseEtcd(ctx, pod, version)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error diagnosing etcd")
+	}
+	return report, nil
+}
+
+// diagnoseEtcd runs the etcdctl commands of Diagnose in pod, whose etcdctl is of version.
+func (u *ControlPlaneUpgrader) diagnoseEtcd(ctx context.Context, pod *v1.Pod, version semver.Version) (*EtcdReport, error) {
+	stdout, _, err := u.etcdctlForPod(ctx, pod, "member list -w json")
+	if err != nil {
+		return nil, err
+	}
+	members, err := parseEtcdMembers(stdout)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, m := range members {
+		endpoints = append(endpoints, m.ClientURLs...)
+	}
+
+	// Both commands exit with an error if any endpoint fails, but still report the others
+	stdout, _, err = u.etcdctlForPod(ctx, pod, "endpoint", "status", "--endpoints", strings.Join(endpoints, ","), "-w", "json")
+	statuses, parseErr := parseEtcdEndpointStatus(stdout)
+	if parseErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, parseErr
+	}
+	stdout, stderr, err := u.etcdctlForPod(ctx, pod, etcdEndpointHealthArgs(version, endpoints)...)
+	health, parseErr := parseEtcdEndpointHealth(version, stdout, stderr)
+	if parseErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, parseErr
+	}
+
+	stdout, _, err = u.etcdctlForPod(ctx, pod, "alarm list")
+	if err != nil {
+		return nil, err
+	}
+	alarms, err := parseEtcdAlarms(stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildEtcdReport(members, statuses, health, alarms), nil
+}
+
+// parseEtcdAlarms parses the output of "etcdctl alarm list", which is empty if there are no alarms.
+func parseEtcdAlarms(stdout string) ([]EtcdAlarm, error) {
+	var alarms []EtcdAlarm
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		match := etcdAlarmLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			return nil, errors.Errorf("unable to parse etcdctl alarm list output: %q", line)
+		}
+		id, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid etcd member ID %q", match[1])
+		}
+		alarms = append(alarms, EtcdAlarm{MemberID: fmt.Sprintf("%x", id), Alarm: match[2]})
+	}
+	return alarms, nil
+}
+
+// buildEtcdReport combines the members of an etcd cluster with the statuses and health of their endpoints, and finds
+// problems: unstarted, unhealthy, unreachable or lagging members, disagreement on the leader, errors and alarms.
+func buildEtcdReport(members []etcdMember, statuses []etcdEndpointStatus, health []etcdEndpointHealth, alarms []EtcdAlarm) *EtcdReport {
+	report := &EtcdReport{Alarms: alarms}
+
+	statusByID := make(map[uint64]*etcdEndpointStatus, len(statuses))
+	leaders := make(map[uint64]bool)
+	var maxRaftIndex uint64
+	for i := range statuses {
+		s := &statuses[i]
+		statusByID[s.Status.Header.MemberID] = s
+		leaders[s.Status.Leader] = true
+		if s.Status.RaftIndex > maxRaftIndex {
+			maxRaftIndex = s.Status.RaftIndex
+		}
+	}
+	healthByEndpoint := make(map[string]etcdEndpointHealth, len(health))
+	for _, h := range health {
+		healthByEndpoint[h.Endpoint] = h
+	}
+
+	for _, m := range members {
+		member := EtcdMemberStatus{
+			ID:         fmt.Sprintf("%x", m.ID),
+			Name:       m.Name,
+			ClientURLs: m.ClientURLs,
+			Learner:    m.IsLearner,
+		}
+		if m.Name == "" || len(m.ClientURLs) == 0 {
+			report.Problems = append(report.Problems, fmt.Sprintf("member %s has been added but has not started", member.ID))
+			report.Members = append(report.Members, member)
+			continue
+		}
+
+		member.Healthy = true
+		for _, url := range m.ClientURLs {
+			h, ok := healthByEndpoint[url]
+			switch {
+			case !ok:
+				member.Healthy, member.HealthError = false, "no health reported"
+			case !h.Health:
+				member.Healthy, member.HealthError = false, h.Error
+			}
+		}
+		if !member.Healthy {
+			report.Problems = append(report.Problems, fmt.Sprintf("member %s (%s) is unhealthy: %s", member.ID, m.Name, member.HealthError))
+		}
+
+		s, ok := statusByID[m.ID]
+		if !ok {
+			report.Problems = append(report.Problems, fmt.Sprintf("member %s (%s) did not report its status", member.ID, m.Name))
+			report.Members = append(report.Members, member)
+			continue
+		}
+		member.Leader = s.Status.Leader == m.ID
+		member.Version = s.Status.Version
+		member.DBSize = s.Status.DBSize
+		member.RaftTerm = s.Status.RaftTerm
+		member.RaftIndex = s.Status.RaftIndex
+		member.RaftIndexLag = maxRaftIndex - s.Status.RaftIndex
+		member.Errors = s.Status.Errors
+		if member.RaftIndexLag > etcdMaxRaftIndexLag {
+			report.Problems = append(report.Problems, fmt.Sprintf("member %s (%s) is %d raft entries behind", member.ID, m.Name, member.RaftIndexLag))
+		}
+		for _, e := range s.Status.Errors {
+			report.Problems = append(report.Problems, fmt.Sprintf("member %s (%s) reports: %s", member.ID, m.Name, e))
+		}
+		report.Members = append(report.Members, member)
+	}
+
+	switch {
+	case len(statuses) > 0 && leaders[0]:
+		report.Problems = append(report.Problems, "a member has no leader")
+	case len(leaders) > 1:
+		report.Problems = append(report.Problems, fmt.Sprintf("members disagree on the leader, reporting %d different leaders", len(leaders)))
+	}
+	for _, a := range alarms {
+		report.Problems = append(report.Problems, fmt.Sprintf("alarm %s is raised on member %s", a.Alarm, a.MemberID))
+	}
+	return report
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEtcdAlarms(t *testing.T) {
+	alarms, err := parseEtcdAlarms("")
+	require.NoError(t, err)
+	assert.Empty(t, alarms)
+
+	alarms, err = parseEtcdAlarms("memberID:9372538179322589801 alarm:NOSPACE\n")
+	require.NoError(t, err)
+	assert.Equal(t, []EtcdAlarm{{MemberID: "8211f1d0f64f3269", Alarm: "NOSPACE"}}, alarms)
+
+	_, err = parseEtcdAlarms("Error: context deadline exceeded")
+	assert.Error(t, err)
+}
+
+func etcdStatus(endpoint string, memberID, leader, raftIndex uint64) etcdEndpointStatus {
+	s := etcdEndpointStatus{Endpoint: endpoint}
+	s.Status.Header.MemberID = memberID
+	s.Status.Leader = leader
+	s.Status.RaftIndex = raftIndex
+	s.Status.RaftTerm = 2
+	s.Status.Version = "3.4.3"
+	s.Status.DBSize = 1 << 20
+	return s
+}
+
+func TestBuildEtcdReport(t *testing.T) {
+	members := []etcdMember{
+		{ID: 1, Name: "a", ClientURLs: []string{"https://10.0.0.1:2379"}},
+		{ID: 2, Name: "b", ClientURLs: []string{"https://10.0.0.2:2379"}},
+		{ID: 3, Name: "c", ClientURLs: []string{"https://10.0.0.3:2379"}, IsLearner: true},
+	}
+	statuses := []etcdEndpointStatus{
+		etcdStatus("https://10.0.0.1:2379", 1, 1, 100),
+		etcdStatus("https://10.0.0.2:2379", 2, 1, 99),
+		etcdStatus("https://10.0.0.3:2379", 3, 1, 90),
+	}
+	health := []etcdEndpointHealth{
+		{Endpoint: "https://10.0.0.1:2379", Health: true},
+		{Endpoint: "https://10.0.0.2:2379", Health: true},
+		{Endpoint: "https://10.0.0.3:2379", Health: true},
+	}
+
+	report := buildEtcdReport(members, statuses, health, nil)
+	assert.True(t, report.Healthy(), report.Problems)
+	require.Len(t, report.Members, 3)
+	assert.True(t, report.Members[0].Leader)
+	assert.False(t, report.Members[1].Leader)
+	assert.True(t, report.Members[2].Learner)
+	assert.Equal(t, uint64(10), report.Members[2].RaftIndexLag)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Contains(t, out.String(), "Verdict: healthy")
+
+	// Member b lost track of the leader, c is unreachable, d has not started, and an alarm is raised
+	members = append(members, etcdMember{ID: 4})
+	statuses[1] = etcdStatus("https://10.0.0.2:2379", 2, 0, 99)
+	statuses = statuses[:2]
+	health[2] = etcdEndpointHealth{Endpoint: "https://10.0.0.3:2379", Error: "context deadline exceeded"}
+	alarms := []EtcdAlarm{{MemberID: "1", Alarm: "NOSPACE"}}
+
+	report = buildEtcdReport(members, statuses, health, alarms)
+	assert.False(t, report.Healthy())
+	assert.Equal(t, []string{
+		"member 3 (c) is unhealthy: context deadline exceeded",
+		"member 3 (c) did not report its status",
+		"member 4 has been added but has not started",
+		"a member has no leader",
+		"alarm NOSPACE is raised on member 1",
+	}, report.Problems)
+
+	// Lagging beyond the threshold
+	statuses[0] = etcdStatus("https://10.0.0.1:2379", 1, 1, 2000)
+	statuses[1] = etcdStatus("https://10.0.0.2:2379", 2, 1, 2000-etcdMaxRaftIndexLag-1)
+	report = buildEtcdReport(members[:2], statuses, health[:2], nil)
+	assert.Equal(t, []string{"member 2 (b) is 1001 raft entries behind"}, report.Problems)
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Values for Config.EtcdSpaceCheck.
+const (
+	// EtcdSpaceWarn reports etcd quota and disk space pressure as warnings and upgrades anyway.
+	EtcdSpaceWarn = "warn"
+	// EtcdSpaceFail refuses to upgrade under etcd quota or disk space pressure, or if it cannot be checked.
+	EtcdSpaceFail = "fail"
+)
+
+const (
+	// etcdDefaultQuotaBytes is etcd's default --quota-backend-bytes.
+	etcdDefaultQuotaBytes = 2 * 1024 * 1024 * 1024
+	// etcdDefaultDataDir is the etcd data directory kubeadm uses.
+	etcdDefaultDataDir = "/var/lib/etcd"
+	// etcdQuotaPressureRatio is the share of its quota above which an etcd database is considered under pressure.
+	etcdQuotaPressureRatio = 0.8
+	// etcdSnapshotSpaceFactor is how many times the database size must be free on a node's etcd data disk. A new member
+	// receives a snapshot of the database, which is written next to the database itself.
+	etcdSnapshotSpaceFactor = 2
+)
+
+// parseEtcdSpaceCheck validates policy, defaulting it to EtcdSpaceWarn.
+func parseEtcdSpaceCheck(policy string) (string, error) {
+	switch policy {
+	case "":
+		return EtcdSpaceWarn, nil
+	case EtcdSpaceWarn, EtcdSpaceFail:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid etcd space check policy %q: must be one of %s, %s", policy, EtcdSpaceWarn, EtcdSpaceFail)
+	}
+}
+
+// etcdEndpointStatus is the status of a single etcd endpoint as reported by "etcdctl endpoint status -w json".
+type etcdEndpointStatus struct {
+	Endpoint string `json:"Endpoint"`
+	Status   struct {
+		Header struct {
+			MemberID uint64 `json:"member_id"`
+		} `json:"header"`
+		Version   string   `json:"version"`
+		DBSize    int64    `json:"dbSize"`
+		Leader    uint64   `json:"leader"`
+		RaftIndex uint64   `json:"raftIndex"`
+		RaftTerm  uint64   `json:"raftTerm"`
+		Errors    []string `json:"errors"`
+	} `json:"Status"`
+}
+
+func parseEtcdEndpointStatus(stdout string) ([]etcdEndpointStatus, error) {
+	var statuses []etcdEndpointStatus
+	if err := json.Unmarshal([]byte(stdout), &statuses); err != nil {
+		return nil, errors.Wrap(err, "unable to parse etcdctl endpoint status json output")
+	}
+	return statuses, nil
+}
+
+// etcdFlag returns the value of the etcd flag name, such as --data-dir, in pod's etcd container, or "" if not set.
+func etcdFlag(pod *v1.Pod, name string) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != "etcd" {
+			continue
+		}
+		args := append(append([]string{}, container.Command...), container.Args...)
+		for i, arg := range args {
+			if strings.HasPrefix(arg, name+"=") {
+				return strings.TrimPrefix(arg, name+"=")
+			}
+			if arg == name && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// etcdQuotaBytes returns the backend quota of the etcd member running in pod.
+func etcdQuotaBytes(pod *v1.Pod) (int64, error) {
+	flag := etcdFlag(pod, "--quota-backend-bytes")
+	if flag == "" {
+		return etcdDefaultQuotaBytes, nil
+	}
+	quota, err := strconv.ParseInt(flag, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid --quota-backend-bytes %q in pod %s", flag, pod.Name)
+	}
+	if quota <= 0 {
+		return etcdDefaultQuotaBytes, nil
+	}
+	return quota, nil
+}
+
+// etcdDataDir returns the data directory of the etcd member running in pod.
+func etcdDataDir(pod *v1.Pod) string {
+	if dir := etcdFlag(pod, "--data-dir"); dir != "" {
+		return dir
+	}
+	return etcdDefaultDataDir
+}
+
+// parseDfAvailable returns the available bytes reported by "df -Pk" for a single file system.
+func parseDfAvailable(stdout string) (int64, error) {
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) < 2 {
+		return 0, errors.Errorf("unexpected df output %q", stdout)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return 0, errors.Errorf("unexpected df output %q", stdout)
+	}
+	available, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unexpected df output %q", stdout)
+	}
+	return available * 1024, nil
+}
+
+// etcdSpaceProblems returns the space pressure on node, whose etcd database uses dbSize bytes of its quota, with
+// available bytes free in its data directory dataDir.
+func etcdSpaceProblems(node, dataDir string, dbSize, quota, available int64) []string {
+	var problems []string
+	if float64(dbSize) >= float64(quota)*etcdQuotaPressureRatio {
+		problems = append(problems, fmt.Sprintf("etcd database on node %s uses %s of its %s quota; compact and defragment etcd before upgrading",
+			node, formatBytes(dbSize), formatBytes(quota)))
+	}
+	if available < dbSize*etcdSnapshotSpaceFactor {
+		problems = append(problems, fmt.Sprintf("node %s has %s free in %s, less than the %s needed to transfer the %s etcd database to a new member",
+			node, formatBytes(available), dataDir, formatBytes(dbSize*etcdSnapshotSpaceFactor), formatBytes(dbSize)))
+	}
+	return problems
+}
+
+func formatBytes(n int64) string {
+	return resource.NewQuantity(n, resource.BinarySI).String()
+}
+
+// etcdSpaceProblems checks the etcd database size against its quota, and the free disk space of the etcd data
+// directory, on each control plane node running an etcd pod. Nodes that cannot be checked are reported as problems.
+func (u *ControlPlaneUpgrader) etcdSpaceProblems(timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	pods, err := u.listEtcdPods()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for i := range pods {
+		pod := &pods[i]
+		podProblems, err := u.etcdSpaceProblemsForPod(ctx, pod)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unable to check etcd space on node %s: %v", pod.Spec.NodeName, err))
+			continue
+		}
+		problems = append(problems, podProblems...)
+	}
+	return problems, nil
+}
+
+func (u *ControlPlaneUpgrader) etcdSpaceProblemsForPod(ctx context.Context, pod *v1.Pod) ([]string, error) {
+	quota, err := etcdQuotaBytes(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, _, err := u.etcdctlForPod(ctx, pod, "endpoint status -w json")
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := parseEtcdEndpointStatus(stdout)
+	if err != nil {
+		return nil, err
+	}
+	if len(statuses) != 1 {
+		return nil, errors.Errorf("expected the status of 1 etcd endpoint, got %d", len(statuses))
+	}
+
+	dataDir := etcdDataDir(pod)
+	stdout, err = u.execInPod(ctx, pod, "df -Pk "+shellQuote(dataDir))
+	if err != nil {
+		return nil, err
+	}
+	available, err := parseDfAvailable(stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	u.log.Info("Checked etcd space", "node", pod.Spec.NodeName, "db-size", statuses[0].Status.DBSize, "quota", quota, "available", available)
+	return etcdSpaceProblems(pod.Spec.NodeName, dataDir, statuses[0].Status.DBSize, quota, available), nil
+}
+
+// execInPod runs command with sh in pod and returns its stdout.
+func (u *ControlPlaneUpgrader) execInPod(ctx context.Context, pod *v1.Pod, command string) (string, error) {
+	stdout, stderr, err := kubernetes2.PodExec(ctx, kubernetes2.PodExecInput{
+		RestConfig:       u.targetRestConfig,
+		KubernetesClient: u.targetKubernetesClient,
+		Namespace:        pod.Namespace,
+		Name:             pod.Name,
+		Command:          []string{"sh", "-c", command},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error running %q in pod %s: %s", command, pod.Name, stderr)
+	}
+	return stdout, nil
+}
+
+// checkEtcdSpace applies the etcd space check policy before upgrading.
+func (u *ControlPlaneUpgrader) checkEtcdSpace() error {
+	if u.execForbidden || u.etcdExternal {
+		return nil
+	}
+	u.log.Info("Checking etcd quota and disk space")
+	// TODO extract timeout as a configurable constant
+	problems, err := u.etcdSpaceProblems(time.Minute * 1)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if u.etcdSpaceCheck == EtcdSpaceFail {
+		return errors.Errorf("refusing to upgrade under etcd space pressure, which would likely fail adding the new etcd members: %s", strings.Join(problems, "; "))
+	}
+	for _, p := range problems {
+		u.warnings.add(WarningEtcdSpace, "", "%s", p)
+	}
+	return nil
+}
+
+func (u *ControlPlaneUpgrader) precheckEtcdSpace() ([]string, error) {
+	if u.etcdExternal {
+		return nil, nil
+	}
+	return u.etcdSpaceProblems(time.Minute * 1)
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseEtcdSpaceCheck(t *testing.T) {
+	for policy, want := range map[string]string{"": EtcdSpaceWarn, EtcdSpaceWarn: EtcdSpaceWarn, EtcdSpaceFail: EtcdSpaceFail} {
+		got, err := parseEtcdSpaceCheck(policy)
+		if err != nil {
+			t.Fatalf("parseEtcdSpaceCheck(%q) unexpected error: %v", policy, err)
+		}
+		if got != want {
+			t.Errorf("parseEtcdSpaceCheck(%q) = %q, want %q", policy, got, want)
+		}
+	}
+	if _, err := parseEtcdSpaceCheck("block"); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+}
+
+func etcdPod(command ...string) *v1.Pod {
+	return &v1.Pod{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "etcd", Command: command}},
+		},
+	}
+}
+
+func TestEtcdQuotaAndDataDir(t *testing.T) {
+	testcases := []struct {
+		name        string
+		pod         *v1.Pod
+		wantQuota   int64
+		wantDataDir string
+		wantErr     bool
+	}{
+		{
+			name:        "defaults",
+			pod:         etcdPod("etcd", "--name=node-1"),
+			wantQuota:   etcdDefaultQuotaBytes,
+			wantDataDir: etcdDefaultDataDir,
+		},
+		{
+			name:        "flags with equals",
+			pod:         etcdPod("etcd", "--quota-backend-bytes=8589934592", "--data-dir=/mnt/etcd"),
+			wantQuota:   8589934592,
+			wantDataDir: "/mnt/etcd",
+		},
+		{
+			name:        "flags with separate values",
+			pod:         etcdPod("etcd", "--quota-backend-bytes", "4294967296", "--data-dir", "/mnt/etcd"),
+			wantQuota:   4294967296,
+			wantDataDir: "/mnt/etcd",
+		},
+		{
+			name:    "invalid quota",
+			pod:     etcdPod("etcd", "--quota-backend-bytes=8G"),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			quota, err := etcdQuotaBytes(tc.pod)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("etcdQuotaBytes() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if quota != tc.wantQuota {
+				t.Errorf("etcdQuotaBytes() = %d, want %d", quota, tc.wantQuota)
+			}
+			if dir := etcdDataDir(tc.pod); dir != tc.wantDataDir {
+				t.Errorf("etcdDataDir() = %q, want %q", dir, tc.wantDataDir)
+			}
+		})
+	}
+}
+
+func TestParseEtcdEndpointStatus(t *testing.T) {
+	stdout := `[{"Endpoint":"https://10.0.0.1:2379","Status":{"header":{"cluster_id":1,"member_id":2,"revision":3,"raft_term":4},"version":"3.3.10","dbSize":25165824,"leader":2,"raftIndex":5,"raftTerm":4}}]`
+	statuses, err := parseEtcdEndpointStatus(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Endpoint != "https://10.0.0.1:2379" || statuses[0].Status.DBSize != 25165824 {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+
+	if _, err := parseEtcdEndpointStatus("Error: context deadline exceeded"); err == nil {
+		t.Error("expected an error for invalid output")
+	}
+}
+
+func TestParseDfAvailable(t *testing.T) {
+	stdout := `Filesystem           1024-blocks    Used Available Capacity Mounted on
+/dev/sda1             20511312 4194304  16317008  21% /var/lib/etcd
+`
+	available, err := parseDfAvailable(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(16317008 * 1024); available != want {
+		t.Errorf("parseDfAvailable() = %d, want %d", available, want)
+	}
+
+	for _, invalid := range []string{"", "Filesystem 1024-blocks Used Available Capacity Mounted on", "Filesystem\n/dev/sda1 a b c d /"} {
+		if _, err := parseDfAvailable(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestEtcdSpaceProblems(t *testing.T) {
+	const gi = 1024 * 1024 * 1024
+	testcases := []struct {
+		name      string
+		dbSize    int64
+		quota     int64
+		available int64
+		want      int
+	}{
+		{name: "plenty of space", dbSize: gi / 2, quota: 2 * gi, available: 10 * gi},
+		{name: "close to quota", dbSize: 9 * gi / 5, quota: 2 * gi, available: 10 * gi, want: 1},
+		{name: "low disk space", dbSize: gi, quota: 8 * gi, available: gi, want: 1},
+		{name: "both", dbSize: 19 * gi / 10, quota: 2 * gi, available: gi, want: 2},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			problems := etcdSpaceProblems("node-1", etcdDefaultDataDir, tc.dbSize, tc.quota, tc.available)
+			if len(problems) != tc.want {
+				t.Errorf("etcdSpaceProblems() = %v, want %d problems", problems, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEtcdctlVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdout   string
+		expected string
+	}{
+		{name: "etcd 3.2", stdout: "etcdctl version: 3.2.24\nAPI version: 3.2\n", expected: "3.2.24"},
+		{name: "etcd 3.3", stdout: "etcdctl version: 3.3.10\nAPI version: 3.3\n", expected: "3.3.10"},
+		{name: "etcd 3.4", stdout: "etcdctl version: 3.4.3\nAPI version: 3.4\n", expected: "3.4.3"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := parseEtcdctlVersion(tc.stdout)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, v.String())
+		})
+	}
+
+	_, err := parseEtcdctlVersion("sh: etcdctl: not found")
+	assert.Error(t, err)
+}
+
+func TestEtcdEndpointHealthArgs(t *testing.T) {
+	endpoints := []string{"https://10.0.0.1:2379", "https://10.0.0.2:2379"}
+
+	tests := []struct {
+		name      string
+		version   string
+		endpoints []string
+		expected  []string
+	}{
+		{
+			name:      "etcd 3.2 endpoints",
+			version:   "3.2.24",
+			endpoints: endpoints,
+			expected:  []string{"endpoint", "health", "--endpoints", "https://10.0.0.1:2379,https://10.0.0.2:2379"},
+		},
+		{
+			name:     "etcd 3.3 cluster",
+			version:  "3.3.10",
+			expected: []string{"endpoint", "health", "--cluster"},
+		},
+		{
+			name:      "etcd 3.3 endpoints",
+			version:   "3.3.10",
+			endpoints: endpoints[:1],
+			expected:  []string{"endpoint", "health", "--endpoints", "https://10.0.0.1:2379"},
+		},
+		{
+			name:     "etcd 3.4 cluster",
+			version:  "3.4.3",
+			expected: []string{"endpoint", "health", "--cluster", "-w", "json"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, etcdEndpointHealthArgs(semver.MustParse(tc.version), tc.endpoints))
+		})
+	}
+}
+
+func TestParseEtcdEndpointHealth(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  string
+		stdout   string
+		stderr   string
+		expected []etcdEndpointHealth
+	}{
+		{
+			name:    "etcd 3.2 healthy",
+			version: "3.2.24",
+			stdout:  "https://10.0.0.1:2379 is healthy: successfully committed proposal: took = 1.6ms\n",
+			expected: []etcdEndpointHealth{
+				{Endpoint: "https://10.0.0.1:2379", Health: true},
+			},
+		},
+		{
+			name:    "etcd 3.3 unhealthy on stderr",
+			version: "3.3.10",
+			stdout:  "https://10.0.0.1:2379 is healthy: successfully committed proposal: took = 2.1ms\n",
+			stderr:  "https://10.0.0.2:2379 is unhealthy: failed to commit proposal: context deadline exceeded\nError: unhealthy cluster\n",
+			expected: []etcdEndpointHealth{
+				{Endpoint: "https://10.0.0.1:2379", Health: true},
+				{Endpoint: "https://10.0.0.2:2379", Health: false, Error: "failed to commit proposal: context deadline exceeded"},
+			},
+		},
+		{
+			name:    "etcd 3.4 json",
+			version: "3.4.3",
+			stdout:  `[{"endpoint":"https://10.0.0.1:2379","health":true,"took":"2.13ms"},{"endpoint":"https://10.0.0.2:2379","health":false,"took":"5s","error":"context deadline exceeded"}]`,
+			expected: []etcdEndpointHealth{
+				{Endpoint: "https://10.0.0.1:2379", Health: true},
+				{Endpoint: "https://10.0.0.2:2379", Health: false, Error: "context deadline exceeded"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			health, err := parseEtcdEndpointHealth(semver.MustParse(tc.version), tc.stdout, tc.stderr)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, health)
+		})
+	}
+
+	_, err := parseEtcdEndpointHealth(semver.MustParse("3.3.10"), "", "Error: context deadline exceeded")
+	assert.Error(t, err)
+	_, err = parseEtcdEndpointHealth(semver.MustParse("3.4.3"), "not json", "")
+	assert.Error(t, err)
+}
+
+func TestEtcdMemberListed(t *testing.T) {
+	members := []etcdMember{{ID: 0x8e9e05c52164694d, Name: "ip-10-0-0-10"}, {ID: 0x91bc3c398fb3c146, Name: "ip-10-0-0-11"}}
+	assert.True(t, etcdMemberListed(members, "8e9e05c52164694d"))
+	assert.False(t, etcdMemberListed(members, "fd422379fda50e48"))
+	assert.False(t, etcdMemberListed(nil, "8e9e05c52164694d"))
+}
+
+func TestEtcdMemberNotFound(t *testing.T) {
+	assert.True(t, etcdMemberNotFound("Error: etcdserver: member not found\n"))
+	assert.False(t, etcdMemberNotFound("Error: context deadline exceeded\n"))
+	assert.False(t, etcdMemberNotFound(""))
+}
+
+func TestIsMutatingEtcdctlCommand(t *testing.T) {
+	assert.True(t, isMutatingEtcdctlCommand([]string{"member", "remove", "8e9e05c52164694d"}))
+	assert.True(t, isMutatingEtcdctlCommand([]string{"member remove 8e9e05c52164694d"}))
+	assert.False(t, isMutatingEtcdctlCommand([]string{"member list -w json"}))
+	assert.False(t, isMutatingEtcdctlCommand([]string{"endpoint", "health", "--cluster"}))
+	assert.False(t, isMutatingEtcdctlCommand([]string{"member", "removed"}))
+}
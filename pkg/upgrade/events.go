@@ -0,0 +1,205 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Types of progress events.
+const (
+	// EventStep is a step of the upgrade, as recorded in the timeline of its report.
+	EventStep = "step"
+	// EventWarning is a warning, when it is first found.
+	EventWarning = "warning"
+	// EventMachine is a control plane machine, or a machine deployment, entering a phase of its upgrade.
+	EventMachine = "machine"
+	// EventFinished is the last event of an upgrade, with its outcome.
+	EventFinished = "finished"
+)
+
+// Phases of control plane machines and machine deployments in machine events.
+const (
+	// MachinePhasePending is a machine or machine deployment the upgrade has yet to start on.
+	MachinePhasePending = "pending"
+	// MachinePhaseCreating is a control plane machine whose replacement is being created.
+	MachinePhaseCreating = "creating replacement"
+	// MachinePhaseWaitingForNode is a control plane machine waiting for the node of its replacement to be ready.
+	MachinePhaseWaitingForNode = "waiting for node"
+	// MachinePhaseRemovingEtcdMember is a control plane machine whose etcd member is being removed.
+	MachinePhaseRemovingEtcdMember = "removing etcd member"
+	// MachinePhaseDeleting is a control plane machine being deleted, after its workloads are rescheduled if waited for.
+	MachinePhaseDeleting = "deleting"
+	// MachinePhaseReplaced is a control plane machine that was replaced.
+	MachinePhaseReplaced = "replaced"
+	// MachinePhaseUpdating is a machine deployment whose template is being updated.
+	MachinePhaseUpdating = "updating"
+	// MachinePhaseRollingOut is a machine deployment rolling out its updated template.
+	MachinePhaseRollingOut = "rolling out"
+	// MachinePhaseRolledOut is a machine deployment whose replicas are all updated and available.
+	MachinePhaseRolledOut = "rolled out"
+	// MachinePhaseFailed is a machine or machine deployment whose upgrade failed.
+	MachinePhaseFailed = "failed"
+)
+
+// ProgressEvent is a line of the event stream of an upgrade.
+type ProgressEvent struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Scope     string    `json:"scope"`
+	Cluster   string    `json:"cluster"`
+	UpgradeID string    `json:"upgradeID"`
+	Message   string    `json:"message,omitempty"`
+	Warning   *Warning  `json:"warning,omitempty"`
+	// Machine and Phase are the machine, or machine deployment, and the phase it entered in machine events.
+	Machine string `json:"machine,omitempty"`
+	Phase   string `json:"phase,omitempty"`
+	// Succeeded and Error are the outcome of the upgrade in finished events.
+	Succeeded *bool  `json:"succeeded,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// NothingToDo is true in the finished event of an idempotent upgrade that found the cluster already upgraded.
+	NothingToDo bool `json:"nothingToDo,omitempty"`
+}
+
+// eventStream writes the progress events of an upgrade as newline delimited JSON. Like runRecorder, a nil stream
+// discards everything.
+type eventStream struct {
+	mu        sync.Mutex
+	w         io.WriteCloser
+	scope     string
+	cluster   string
+	upgradeID string
+	now       func() time.Time
+}
+
+// openEventStream opens the event stream configured by config for the upgrade upgradeID of the cluster called name
+// in namespace. It returns nil if no stream is configured.
+func openEventStream(config EventsConfig, scope, namespace, name, upgradeID string) (*eventStream, error) {
+	w, err := openEventsFile(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Writer != nil {
+		w = &eventsWriter{Writer: config.Writer, file: w}
+	}
+	if w == nil {
+		return nil, nil
+	}
+	return newEventStream(w, scope, namespace, name, upgradeID), nil
+}
+
+// openEventsFile opens the file or file descriptor config writes the events to, or returns nil if there is none.
+func openEventsFile(config EventsConfig) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	switch {
+	case config.File != "" && config.FD != 0:
+		return nil, errors.New("progress events can be written to a file or a file descriptor, not both")
+	case config.File != "":
+		f, err := os.Create(config.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating events file %s", config.File)
+		}
+		w = f
+	case config.FD < 0:
+		return nil, errors.Errorf("invalid events file descriptor %d", config.FD)
+	case config.FD > 0:
+		f := os.NewFile(uintptr(config.FD), "events")
+		if f == nil {
+			return nil, errors.Errorf("invalid events file descriptor %d", config.FD)
+		}
+		w = f
+	}
+	return w, nil
+}
+
+// eventsWriter writes the events to an in-process writer, and to the events file if there is one.
+type eventsWriter struct {
+	io.Writer
+	file io.WriteCloser
+}
+
+func (w *eventsWriter) Write(p []byte) (int, error) {
+	if w.file != nil {
+		_, _ = w.file.Write(p)
+	}
+	return w.Writer.Write(p)
+}
+
+// Close closes the events file, leaving the in-process writer to its owner.
+func (w *eventsWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func newEventStream(w io.WriteCloser, scope, namespace, name, upgradeID string) *eventStream {
+	return &eventStream{
+		w:         w,
+		scope:     scope,
+		cluster:   namespace + "/" + name,
+		upgradeID: upgradeID,
+		now:       time.Now,
+	}
+}
+
+// emit writes event, stamped with the time and the upgrade it belongs to. Events are best effort: a stream that
+// cannot be written to, such as a closed pipe, does not fail the upgrade.
+func (s *eventStream) emit(event ProgressEvent) {
+	if s == nil {
+		return
+	}
+
+	event.Time = s.now()
+	event.Scope = s.scope
+	event.Cluster = s.cluster
+	event.UpgradeID = s.upgradeID
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.w.Write(append(line, '\n'))
+}
+
+// step emits a step of the upgrade.
+func (s *eventStream) step(message string) {
+	s.emit(ProgressEvent{Type: EventStep, Message: message})
+}
+
+// machine emits that machine, or a machine deployment, entered phase.
+func (s *eventStream) machine(machine, phase string) {
+	s.emit(ProgressEvent{Type: EventMachine, Machine: machine, Phase: phase})
+}
+
+// warning emits a warning.
+func (s *eventStream) warning(w Warning) {
+	s.emit(ProgressEvent{Type: EventWarning, Message: w.Message, Warning: &w})
+}
+
+// finished emits the outcome of the upgrade, err being its error if it failed, and closes the stream.
+func (s *eventStream) finished(err error, nothingToDo bool) {
+	if s == nil {
+		return
+	}
+
+	succeeded := err == nil
+	event := ProgressEvent{Type: EventFinished, Succeeded: &succeeded, NothingToDo: nothingToDo}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.emit(event)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.w.Close()
+}
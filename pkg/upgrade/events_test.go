@@ -0,0 +1,131 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closeRecorder is a buffer that records whether it was closed.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func decodeEvents(t *testing.T, data []byte) []ProgressEvent {
+	var events []ProgressEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e ProgressEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e), scanner.Text())
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestEventStream(t *testing.T) {
+	out := &closeRecorder{}
+	events := newEventStream(out, "control-plane", "ns", "c", "123")
+	events.now = func() time.Time { return time.Date(2019, 11, 5, 10, 0, 0, 0, time.UTC) }
+
+	record := newRunRecorder("control-plane", "ns", "c", "123")
+	record.events = events
+	warnings := &warningCollector{log: logrtesting.NullLogger{}, events: events}
+
+	record.event("Upgrade started")
+	warnings.add(WarningEtcdMemberAbsent, "ns/a", "no etcd member")
+	warnings.add(WarningEtcdMemberAbsent, "ns/a", "no etcd member")
+	record.done(errors.New("boom"))
+
+	got := decodeEvents(t, out.Bytes())
+	require.Len(t, got, 3)
+	assert.Equal(t, EventStep, got[0].Type)
+	assert.Equal(t, "Upgrade started", got[0].Message)
+	assert.Equal(t, "ns/c", got[0].Cluster)
+	assert.Equal(t, "123", got[0].UpgradeID)
+	assert.Equal(t, EventWarning, got[1].Type)
+	assert.Equal(t, &Warning{Reason: WarningEtcdMemberAbsent, Object: "ns/a", Message: "no etcd member"}, got[1].Warning)
+	assert.Equal(t, EventFinished, got[2].Type)
+	require.NotNil(t, got[2].Succeeded)
+	assert.False(t, *got[2].Succeeded)
+	assert.Equal(t, "boom", got[2].Error)
+	assert.True(t, out.closed)
+
+	var nilStream *eventStream
+	nilStream.step("ignored")
+	nilStream.finished(nil, false)
+}
+
+func TestOpenEventStream(t *testing.T) {
+	events, err := openEventStream(EventsConfig{}, "control-plane", "ns", "c", "123")
+	require.NoError(t, err)
+	assert.Nil(t, events)
+
+	_, err = openEventStream(EventsConfig{File: "events.ndjson", FD: 3}, "control-plane", "ns", "c", "123")
+	assert.Error(t, err)
+	_, err = openEventStream(EventsConfig{FD: -1}, "control-plane", "ns", "c", "123")
+	assert.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "events")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.ndjson")
+	events, err = openEventStream(EventsConfig{File: path}, "machine-deployment", "ns", "c", "123")
+	require.NoError(t, err)
+	events.step("Upgrade started")
+	events.finished(nil, true)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	got := decodeEvents(t, data)
+	require.Len(t, got, 2)
+	assert.Equal(t, "machine-deployment", got[0].Scope)
+	require.NotNil(t, got[1].Succeeded)
+	assert.True(t, *got[1].Succeeded)
+	assert.True(t, got[1].NothingToDo)
+}
+
+func TestOpenEventStreamWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	path := filepath.Join(dir, "events.ndjson")
+	events, err := openEventStream(EventsConfig{File: path, Writer: &out}, "control-plane", "ns", "c", "123")
+	require.NoError(t, err)
+	record := newRunRecorder("control-plane", "ns", "c", "123")
+	record.events = events
+	record.machinePhase("cp-0", MachinePhaseCreating)
+	events.finished(nil, false)
+
+	got := decodeEvents(t, out.Bytes())
+	require.Len(t, got, 2)
+	assert.Equal(t, EventMachine, got[0].Type)
+	assert.Equal(t, "cp-0", got[0].Machine)
+	assert.Equal(t, MachinePhaseCreating, got[0].Phase)
+	assert.Empty(t, record.report.Timeline)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, out.Bytes(), data)
+}
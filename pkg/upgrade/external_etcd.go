@@ -0,0 +1,212 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultMinExternalEtcdVersion is the oldest external etcd version kubeadm supports.
+const defaultMinExternalEtcdVersion = "3.2.18"
+
+// externalEtcdCAKey is the key of the CA certificate of the external etcd client secret, whose client certificate and
+// key are under the keys of a kubernetes.io/tls secret.
+const externalEtcdCAKey = "ca.crt"
+
+// parseMinExternalEtcdVersion validates version, defaulting it to defaultMinExternalEtcdVersion.
+func parseMinExternalEtcdVersion(version string) (semver.Version, error) {
+	if version == "" {
+		version = defaultMinExternalEtcdVersion
+	}
+	v, err := semver.ParseTolerant(version)
+	if err != nil {
+		return semver.Version{}, errors.Wrapf(err, "invalid minimum external etcd version %q", version)
+	}
+	return v, nil
+}
+
+// detectExternalEtcd finds out whether the control plane uses an external etcd, configured or listed in the
+// etcd.external of the kubeadm ClusterConfiguration. If so, etcd health is checked through the API server, and new
+// nodes are not expected to run an etcd static pod. Its members are left alone, unless the etcd is colocated on the
+// control plane machines, as etcdadm bootstraps it.
+func (u *ControlPlaneUpgrader) detectExternalEtcd() error {
+	endpoints := u.externalEtcd.Endpoints
+	if len(endpoints) == 0 {
+		cm, err := u.getKubeadmConfigMap()
+		if err != nil || cm == nil {
+			return err
+		}
+		_, clusterConfig, err := findClusterConfiguration(cm)
+		if err != nil {
+			return err
+		}
+		endpoints, _, _ = unstructured.NestedStringSlice(clusterConfig, "etcd", "external", "endpoints")
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	u.externalEtcd.Endpoints = endpoints
+	u.etcdExternal = true
+	u.readinessComponents = withoutLocalEtcd(u.readinessComponents)
+
+	colocated := u.externalEtcd.Colocated
+	if !colocated {
+		nodes, err := listControlPlaneNodes(u.targetKubernetesClient)
+		if err != nil {
+			return err
+		}
+		colocated = len(colocatedEtcdEndpoints(endpoints, nodes)) > 0
+	}
+	if colocated {
+		u.etcdColocated = true
+		u.log.Info("The control plane uses an external etcd colocated on its machines, its members are replaced by the member commands", "endpoints", endpoints)
+		return nil
+	}
+	u.log.Info("The control plane uses an external etcd, its members are left alone", "endpoints", endpoints)
+	return nil
+}
+
+// withoutLocalEtcd returns components without the etcd static pod kubeadm runs on control plane nodes with a local
+// etcd.
+func withoutLocalEtcd(components []readinessComponent) []readinessComponent {
+	var ret []readinessComponent
+	for _, c := range components {
+		if c.name == "etcd" && c.selector.String() == "component=etcd" {
+			continue
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// externalEtcdVersionProblems checks that every member of the external etcd is at least at the minimum version. The
+// check is skipped once the upgrade of another cluster sharing the etcd did it.
+func (u *ControlPlaneUpgrader) externalEtcdVersionProblems() ([]string, error) {
+	if !u.etcdExternal {
+		return nil, nil
+	}
+	if u.externalEtcd.Verified {
+		u.log.Info("Skipping the external etcd version check, done by the upgrade of another cluster sharing it")
+		return nil, nil
+	}
+	if u.externalEtcd.ClientSecret == "" {
+		return []string{"the version of the external etcd cannot be checked without an etcd client secret; set --external-etcd-client-secret, or pass --external-etcd-verified if the upgrade of another cluster sharing it already checked it"}, nil
+	}
+
+	client, err := externalEtcdClient(u.managementClusterClient, u.clusterNamespace, u.externalEtcd.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, endpoint := range u.externalEtcd.Endpoints {
+		version, err := externalEtcdVersion(client, endpoint)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		u.log.Info("Checked external etcd version", "endpoint", endpoint, "version", version.String())
+		if version.LT(u.minExternalEtcdVersion) {
+			problems = append(problems, fmt.Sprintf("external etcd member %s is at %s, older than %s", endpoint, version, u.minExternalEtcdVersion))
+		}
+	}
+	return problems, nil
+}
+
+// checkExternalEtcdVersion refuses to upgrade a control plane whose external etcd is older than the minimum version.
+func (u *ControlPlaneUpgrader) checkExternalEtcdVersion() error {
+	if !u.etcdExternal {
+		return nil
+	}
+	u.log.Info("Checking the external etcd version")
+	problems, err := u.externalEtcdVersionProblems()
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("refusing to upgrade the control plane with its external etcd: %s", strings.Join(problems, "; "))
+	}
+	if !u.externalEtcd.Verified {
+		u.record.event("Checked the external etcd is at %s or later", u.minExternalEtcdVersion)
+	}
+	return nil
+}
+
+// externalEtcdClient returns an HTTP client authenticating to the external etcd with the client certificate of the
+// secret called name in namespace.
+func externalEtcdClient(c ctrlclient.Client, namespace, name string) (*http.Client, error) {
+	secret := &v1.Secret{}
+	if err := c.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: namespace, Name: name}, secret); err != nil {
+		return nil, errors.Wrapf(err, "error getting external etcd client secret %s/%s", namespace, name)
+	}
+	config, err := externalEtcdTLSConfig(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config},
+	}, nil
+}
+
+func externalEtcdTLSConfig(secret *v1.Secret) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid client certificate in external etcd client secret %s/%s", secret.Namespace, secret.Name)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data[externalEtcdCAKey]) {
+		return nil, errors.Errorf("external etcd client secret %s/%s has no valid %s", secret.Namespace, secret.Name, externalEtcdCAKey)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}, nil
+}
+
+// externalEtcdVersion reads the version of the etcd member serving endpoint from its /version endpoint.
+func externalEtcdVersion(client *http.Client, endpoint string) (semver.Version, error) {
+	resp, err := client.Get(strings.TrimRight(endpoint, "/") + "/version")
+	if err != nil {
+		return semver.Version{}, errors.Wrapf(err, "error reading the version of external etcd member %s", endpoint)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return semver.Version{}, errors.Wrapf(err, "error reading the version of external etcd member %s", endpoint)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return semver.Version{}, errors.Errorf("error reading the version of external etcd member %s: %s", endpoint, resp.Status)
+	}
+	return parseEtcdServerVersion(body, endpoint)
+}
+
+// parseEtcdServerVersion parses the response of the /version endpoint of an etcd member, such as
+// {"etcdserver":"3.3.15","etcdcluster":"3.3.0"}.
+func parseEtcdServerVersion(body []byte, endpoint string) (semver.Version, error) {
+	var versions struct {
+		Server string `json:"etcdserver"`
+	}
+	if err := json.Unmarshal(body, &versions); err != nil {
+		return semver.Version{}, errors.Wrapf(err, "error decoding the version of external etcd member %s", endpoint)
+	}
+	v, err := semver.ParseTolerant(versions.Server)
+	if err != nil {
+		return semver.Version{}, errors.Wrapf(err, "invalid version of external etcd member %s", endpoint)
+	}
+	return v, nil
+}
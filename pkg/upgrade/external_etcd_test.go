@@ -0,0 +1,64 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMinExternalEtcdVersion(t *testing.T) {
+	v, err := parseMinExternalEtcdVersion("")
+	require.NoError(t, err)
+	assert.Equal(t, semver.MustParse("3.2.18"), v)
+
+	v, err = parseMinExternalEtcdVersion("v3.4")
+	require.NoError(t, err)
+	assert.Equal(t, semver.MustParse("3.4.0"), v)
+
+	_, err = parseMinExternalEtcdVersion("latest")
+	assert.Error(t, err)
+}
+
+func TestWithoutLocalEtcd(t *testing.T) {
+	components, err := parseReadinessComponents([]string{"etcd", "kube-apiserver", "etcd-proxy:app=etcd-proxy"})
+	require.NoError(t, err)
+
+	var names []string
+	for _, c := range withoutLocalEtcd(components) {
+		names = append(names, c.name)
+	}
+	assert.Equal(t, []string{"kube-apiserver", "etcd-proxy"}, names)
+}
+
+func TestExternalEtcdVersion(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"etcdserver":"3.3.15","etcdcluster":"3.3.0"}`))
+	}))
+	defer server.Close()
+
+	v, err := externalEtcdVersion(server.Client(), server.URL+"/")
+	require.NoError(t, err)
+	assert.Equal(t, semver.MustParse("3.3.15"), v)
+
+	_, err = externalEtcdVersion(server.Client(), server.URL+"/other")
+	assert.Error(t, err)
+}
+
+func TestParseEtcdServerVersion(t *testing.T) {
+	_, err := parseEtcdServerVersion([]byte(`{"etcdcluster":"3.3.0"}`), "https://etcd-0:2379")
+	assert.Error(t, err)
+
+	_, err = parseEtcdServerVersion([]byte(`not json`), "https://etcd-0:2379")
+	assert.Error(t, err)
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// validateExtraMetadata checks the extra labels and annotations are valid, and do not use the prefixes of the labels
+// and annotations managed by this tool and Cluster API, which would change how the replacements are handled.
+func validateExtraMetadata(labels, annotations map[string]string) error {
+	var problems []string
+	for _, key := range sortedKeys(labels) {
+		problems = append(problems, extraMetadataKeyProblems("label", key)...)
+		for _, msg := range validation.IsValidLabelValue(labels[key]) {
+			problems = append(problems, "label "+key+" value: "+msg)
+		}
+	}
+	for _, key := range sortedKeys(annotations) {
+		problems = append(problems, extraMetadataKeyProblems("annotation", key)...)
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid extra metadata: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func extraMetadataKeyProblems(kind, key string) []string {
+	var problems []string
+	for _, msg := range validation.IsQualifiedName(key) {
+		problems = append(problems, kind+" "+key+": "+msg)
+	}
+	for _, reserved := range []string{annotationPrefix, clusterv1.GroupVersion.Group + "/"} {
+		if strings.HasPrefix(key, reserved) {
+			problems = append(problems, kind+" "+key+": the "+reserved+" prefix is reserved")
+		}
+	}
+	return problems
+}
+
+// applyExtraMetadata adds labels and annotations to obj, replacing those with the same keys.
+func applyExtraMetadata(obj metav1.Object, labels, annotations map[string]string) {
+	if len(labels) > 0 {
+		objLabels := obj.GetLabels()
+		if objLabels == nil {
+			objLabels = make(map[string]string)
+		}
+		for k, v := range labels {
+			objLabels[k] = v
+		}
+		obj.SetLabels(objLabels)
+	}
+
+	if len(annotations) > 0 {
+		objAnnotations := obj.GetAnnotations()
+		if objAnnotations == nil {
+			objAnnotations = make(map[string]string)
+		}
+		for k, v := range annotations {
+			objAnnotations[k] = v
+		}
+		obj.SetAnnotations(objAnnotations)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
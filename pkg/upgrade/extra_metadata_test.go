@@ -0,0 +1,60 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"reflect"
+	"testing"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestValidateExtraMetadata(t *testing.T) {
+	testcases := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{name: "empty"},
+		{
+			name:        "valid",
+			labels:      map[string]string{"team": "infra", "example.com/cost-center": "1234"},
+			annotations: map[string]string{"example.com/owner": "anything goes here"},
+		},
+		{name: "invalid label key", labels: map[string]string{"not a key": "x"}, wantErr: true},
+		{name: "invalid label value", labels: map[string]string{"team": "not a value"}, wantErr: true},
+		{name: "tool prefix", annotations: map[string]string{annotationPrefix + "upgrade-id": "1"}, wantErr: true},
+		{name: "cluster api prefix", labels: map[string]string{"cluster.x-k8s.io/control-plane": "true"}, wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateExtraMetadata(tc.labels, tc.annotations)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("validateExtraMetadata() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyExtraMetadata(t *testing.T) {
+	m := &clusterv1.Machine{}
+	m.Labels = map[string]string{"team": "old", "keep": "me"}
+
+	applyExtraMetadata(m, map[string]string{"team": "infra"}, map[string]string{"example.com/owner": "ops"})
+
+	if want := map[string]string{"team": "infra", "keep": "me"}; !reflect.DeepEqual(m.Labels, want) {
+		t.Errorf("labels = %v, want %v", m.Labels, want)
+	}
+	if want := map[string]string{"example.com/owner": "ops"}; !reflect.DeepEqual(m.Annotations, want) {
+		t.Errorf("annotations = %v, want %v", m.Annotations, want)
+	}
+
+	unchanged := &clusterv1.Machine{}
+	applyExtraMetadata(unchanged, nil, nil)
+	if unchanged.Labels != nil || unchanged.Annotations != nil {
+		t.Errorf("expected no metadata, got labels %v annotations %v", unchanged.Labels, unchanged.Annotations)
+	}
+}
@@ -0,0 +1,644 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	controlPlaneScope      = "control-plane"
+	machineDeploymentScope = "machine-deployment"
+)
+
+// Statuses of the clusters of a fleet upgrade.
+const (
+	FleetClusterSucceeded  = "Succeeded"
+	FleetClusterFailed     = "Failed"
+	FleetClusterInProgress = "InProgress"
+	FleetClusterNotStarted = "NotStarted"
+)
+
+// FleetManifest lists the clusters of a fleet upgrade in waves, such as dev, then staging, then prod. Each wave starts
+// once the previous one is done, unless its failures reached the failure threshold.
+type FleetManifest struct {
+	// Config is the base configuration of every cluster's upgrade. The target cluster and upgrade ID are set per
+	// cluster.
+	Config Config `json:"config,omitempty"`
+	// FailureThreshold is the number of failed clusters in a wave that halts the fleet upgrade, leaving the rest of
+	// the wave and all later waves unstarted. Defaults to 1.
+	FailureThreshold int         `json:"failureThreshold,omitempty"`
+	Waves            []FleetWave `json:"waves"`
+}
+
+// FleetWave is a group of clusters upgraded together.
+type FleetWave struct {
+	Name string `json:"name,omitempty"`
+	// MaxConcurrent is the number of clusters of the wave upgraded at the same time. Defaults to 1.
+	MaxConcurrent int            `json:"maxConcurrent,omitempty"`
+	Clusters      []FleetCluster `json:"clusters"`
+}
+
+// FleetCluster is a cluster of a fleet upgrade.
+type FleetCluster struct {
+	// Context is the kubeconfig context of the cluster's management cluster, defaulting to the manifest config's.
+	Context string `json:"context,omitempty"`
+	// ManagementCluster overrides the kubeconfig path, context and impersonation of the manifest config's management
+	// cluster, for fleets whose management clusters are in different kubeconfig files. It cannot be set with Context.
+	ManagementCluster *ManagementClusterConfig `json:"managementCluster,omitempty"`
+	Namespace         string                   `json:"namespace"`
+	Name              string                   `json:"name"`
+	// KubernetesVersion overrides the manifest config's version. It may be a version alias.
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+	// MachineDeploymentVersions overrides the version of the cluster's machine deployments, by name, in addition to
+	// the manifest config's machineDeployment.versions.
+	MachineDeploymentVersions map[string]string `json:"machineDeploymentVersions,omitempty"`
+	// Scopes are upgraded in order. Defaults to control-plane, then machine-deployment.
+	Scopes []string `json:"scopes,omitempty"`
+	// Kubeconfig is where the cluster's kubeconfig is read from, defaulting to its Cluster API kubeconfig secret.
+	Kubeconfig KubeconfigSourceConfig `json:"kubeconfig,omitempty"`
+	// Access overrides how the manifest config reaches the cluster's API server.
+	Access *TargetAccessConfig `json:"access,omitempty"`
+	// SharedEtcd names the external etcd the cluster's control plane shares with other clusters of the fleet. Their
+	// control planes are upgraded one at a time, and the etcd version is only checked until one of them succeeds.
+	SharedEtcd string `json:"sharedEtcd,omitempty"`
+}
+
+// managementCluster returns the management cluster config of c, given that of the manifest config.
+func (c FleetCluster) managementCluster(base ManagementClusterConfig) ManagementClusterConfig {
+	if c.ManagementCluster != nil {
+		config := *c.ManagementCluster
+		if config.Kubeconfig == "" {
+			config.Kubeconfig = base.Kubeconfig
+		}
+		return config
+	}
+	if c.Context != "" {
+		base.Context = c.Context
+	}
+	return base
+}
+
+func (c FleetCluster) key() string {
+	if c.ManagementCluster != nil {
+		return fleetClusterKey(c.ManagementCluster.Kubeconfig, c.ManagementCluster.Context, c.Namespace, c.Name)
+	}
+	return fleetClusterKey("", c.Context, c.Namespace, c.Name)
+}
+
+// fleetClusterKey identifies a cluster in the fleet state by its management cluster, given by a kubeconfig path, if
+// not the manifest config's, and a context, and its namespace and name.
+func fleetClusterKey(kubeconfig, context, namespace, name string) string {
+	if kubeconfig != "" {
+		context = kubeconfig + ":" + context
+	}
+	return context + "/" + namespace + "/" + name
+}
+
+// FleetState records the progress of a fleet upgrade so that it can be resumed.
+type FleetState struct {
+	Clusters map[string]FleetClusterState `json:"clusters"`
+	// VerifiedEtcds are the shared etcds whose version was checked by the control plane upgrade of one of their
+	// clusters.
+	VerifiedEtcds []string `json:"verifiedEtcds,omitempty"`
+}
+
+// FleetClusterState is the progress of a cluster of a fleet upgrade. A cluster that did not succeed is resumed with
+// the same upgrade ID, unless its version changed.
+type FleetClusterState struct {
+	KubernetesVersion string `json:"kubernetesVersion"`
+	UpgradeID         string `json:"upgradeID"`
+	Status            string `json:"status"`
+	Error             string `json:"error,omitempty"`
+}
+
+// FleetReport is the outcome of a fleet upgrade.
+type FleetReport struct {
+	Waves []FleetWaveResult `json:"waves"`
+	// HaltedAfter is the wave whose failures halted the fleet upgrade.
+	HaltedAfter string `json:"haltedAfter,omitempty"`
+}
+
+// FleetWaveResult is the outcome of a wave of a fleet upgrade.
+type FleetWaveResult struct {
+	Name     string               `json:"name"`
+	Failures int                  `json:"failures"`
+	Clusters []FleetClusterResult `json:"clusters"`
+}
+
+// FleetClusterResult is the outcome of a cluster of a fleet upgrade.
+type FleetClusterResult struct {
+	Context           string    `json:"context,omitempty"`
+	Namespace         string    `json:"namespace"`
+	Name              string    `json:"name"`
+	KubernetesVersion string    `json:"kubernetesVersion"`
+	UpgradeID         string    `json:"upgradeID,omitempty"`
+	Status            string    `json:"status"`
+	Error             string    `json:"error,omitempty"`
+	Warnings          []Warning `json:"warnings,omitempty"`
+
+	// key identifies the cluster in the fleet state.
+	key string
+}
+
+// Succeeded returns true if every cluster of the fleet was upgraded.
+func (r *FleetReport) Succeeded() bool {
+	for _, wave := range r.Waves {
+		for _, cluster := range wave.Clusters {
+			if cluster.Status != FleetClusterSucceeded {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Print writes the report as a table, followed by the warnings of every cluster.
+func (r *FleetReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WAVE\tCONTEXT\tCLUSTER\tVERSION\tUPGRADE ID\tSTATUS\tERROR")
+	var warnings []Warning
+	for _, wave := range r.Waves {
+		for _, cluster := range wave.Clusters {
+			fmt.Fprintf(tw, "%s\t%s\t%s/%s\t%s\t%s\t%s\t%s\n",
+				wave.Name, cluster.Context, cluster.Namespace, cluster.Name, cluster.KubernetesVersion, cluster.UpgradeID, cluster.Status, cluster.Error)
+			warnings = append(warnings, cluster.Warnings...)
+		}
+	}
+	tw.Flush()
+
+	if r.HaltedAfter != "" {
+		fmt.Fprintf(w, "\nHalted after wave %s reached the failure threshold\n", r.HaltedAfter)
+	}
+	PrintWarnings(w, warnings)
+}
+
+// LoadFleetManifest reads and validates the fleet manifest at path.
+func LoadFleetManifest(path string) (*FleetManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading fleet manifest %s", path)
+	}
+
+	var m FleetManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "error decoding fleet manifest %s", path)
+	}
+
+	if problems := fleetManifestProblems(&m); len(problems) > 0 {
+		return nil, errors.Errorf("invalid fleet manifest %s: %s", path, strings.Join(problems, "; "))
+	}
+	return &m, nil
+}
+
+func fleetManifestProblems(m *FleetManifest) []string {
+	var problems []string
+	if len(m.Waves) == 0 {
+		problems = append(problems, "at least one wave is required")
+	}
+	if m.FailureThreshold < 0 {
+		problems = append(problems, "failureThreshold must not be negative")
+	}
+	for _, p := range impersonationProblems(m.Config.ManagementCluster.Impersonate) {
+		problems = append(problems, "managementCluster: "+p)
+	}
+	if err := CheckResultsConfig(m.Config.Results); err != nil {
+		problems = append(problems, "results: "+err.Error())
+	}
+
+	seen := sets.NewString()
+	for i, wave := range m.Waves {
+		name := fleetWaveName(i, wave)
+		if len(wave.Clusters) == 0 {
+			problems = append(problems, fmt.Sprintf("wave %s has no clusters", name))
+		}
+		if wave.MaxConcurrent < 0 {
+			problems = append(problems, fmt.Sprintf("wave %s: maxConcurrent must not be negative", name))
+		}
+		for _, cluster := range wave.Clusters {
+			if cluster.Namespace == "" || cluster.Name == "" {
+				problems = append(problems, fmt.Sprintf("wave %s: cluster namespace and name are required", name))
+				continue
+			}
+			if seen.Has(cluster.key()) {
+				problems = append(problems, fmt.Sprintf("cluster %s/%s is listed more than once", cluster.Namespace, cluster.Name))
+			}
+			seen.Insert(cluster.key())
+			if cluster.KubernetesVersion == "" && m.Config.KubernetesVersion == "" {
+				problems = append(problems, fmt.Sprintf("cluster %s/%s has no kubernetes version", cluster.Namespace, cluster.Name))
+			}
+			for _, scope := range cluster.Scopes {
+				if scope != controlPlaneScope && scope != machineDeploymentScope {
+					problems = append(problems, fmt.Sprintf("cluster %s/%s has invalid scope %q, must be one of %v",
+						cluster.Namespace, cluster.Name, scope, []string{controlPlaneScope, machineDeploymentScope}))
+				}
+			}
+			if cluster.ManagementCluster != nil {
+				if cluster.Context != "" {
+					problems = append(problems, fmt.Sprintf("cluster %s/%s sets both context and managementCluster, set the context in managementCluster", cluster.Namespace, cluster.Name))
+				}
+				for _, p := range impersonationProblems(cluster.ManagementCluster.Impersonate) {
+					problems = append(problems, fmt.Sprintf("cluster %s/%s managementCluster: %s", cluster.Namespace, cluster.Name, p))
+				}
+			}
+			for _, p := range impersonationProblems(cluster.Kubeconfig.Impersonate) {
+				problems = append(problems, fmt.Sprintf("cluster %s/%s kubeconfig: %s", cluster.Namespace, cluster.Name, p))
+			}
+		}
+	}
+	return problems
+}
+
+// fleetKubeconfigProblems checks that the kubeconfig files of the management and target clusters of the clusters of m
+// have their contexts. Each kubeconfig and context is checked once.
+func fleetKubeconfigProblems(m *FleetManifest) []string {
+	var problems []string
+	checked := sets.NewString()
+	check := func(cluster FleetCluster, what, path, context string) {
+		if path == "" || checked.Has(path+"\x00"+context) {
+			return
+		}
+		checked.Insert(path + "\x00" + context)
+		for _, p := range kubeconfigContextProblems(path, context) {
+			problems = append(problems, fmt.Sprintf("cluster %s/%s %s: %s", cluster.Namespace, cluster.Name, what, p))
+		}
+	}
+
+	for _, wave := range m.Waves {
+		for _, cluster := range wave.Clusters {
+			management := cluster.managementCluster(m.Config.ManagementCluster)
+			check(cluster, "management cluster", management.Kubeconfig, management.Context)
+			check(cluster, "kubeconfig", cluster.Kubeconfig.File, cluster.Kubeconfig.Context)
+		}
+	}
+	return problems
+}
+
+func fleetWaveName(i int, wave FleetWave) string {
+	if wave.Name != "" {
+		return wave.Name
+	}
+	return fmt.Sprintf("%d", i+1)
+}
+
+// loadFleetState reads the fleet state at path, which may not exist yet.
+func loadFleetState(path string) (*FleetState, error) {
+	state := &FleetState{Clusters: map[string]FleetClusterState{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading fleet state %s", path)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "error decoding fleet state %s", path)
+	}
+	if state.Clusters == nil {
+		state.Clusters = map[string]FleetClusterState{}
+	}
+	return state, nil
+}
+
+// saveFleetState writes state to path, replacing it only once fully written.
+func saveFleetState(path string, state *FleetState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "error writing fleet state %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, path), "error writing fleet state %s", path)
+}
+
+// fleetScopeUpgradeFunc upgrades a scope of a cluster, returning the warnings found.
+type fleetScopeUpgradeFunc func(log logr.Logger, scope string, config Config) ([]Warning, error)
+
+// FleetUpgrader upgrades the clusters of a fleet manifest wave by wave, recording its progress in a state file.
+type FleetUpgrader struct {
+	log          logr.Logger
+	manifest     *FleetManifest
+	statePath    string
+	upgradeScope fleetScopeUpgradeFunc
+	newUpgradeID func() string
+
+	// mu guards state, which is shared by the clusters of a wave upgraded concurrently, and sharedEtcdLocks.
+	mu    sync.Mutex
+	state *FleetState
+	// sharedEtcdLocks serialize the control plane upgrades of the clusters sharing an etcd, by name.
+	sharedEtcdLocks map[string]*sync.Mutex
+}
+
+// NewFleetUpgrader returns a FleetUpgrader for manifest, resuming from the state at statePath if it exists. It fails
+// if a kubeconfig file of the manifest cannot be loaded or lacks the context it is used with.
+func NewFleetUpgrader(log logr.Logger, manifest *FleetManifest, statePath string) (*FleetUpgrader, error) {
+	if problems := fleetKubeconfigProblems(manifest); len(problems) > 0 {
+		return nil, errors.Errorf("invalid fleet manifest: %s", strings.Join(problems, "; "))
+	}
+
+	state, err := loadFleetState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FleetUpgrader{
+		log:          log,
+		manifest:     manifest,
+		statePath:    statePath,
+		upgradeScope: upgradeScope,
+		newUpgradeID: func() string { return fmt.Sprintf("%d", time.Now().Unix()) },
+		state:        state,
+	}, nil
+}
+
+// Upgrade upgrades the fleet wave by wave. Once the failures of a wave reach the failure threshold, its remaining
+// clusters and all later waves are not started.
+func (f *FleetUpgrader) Upgrade() *FleetReport {
+	threshold := f.manifest.FailureThreshold
+	if threshold == 0 {
+		threshold = 1
+	}
+
+	report := &FleetReport{}
+	for i, wave := range f.manifest.Waves {
+		name := fleetWaveName(i, wave)
+
+		if report.HaltedAfter != "" {
+			result := FleetWaveResult{Name: name}
+			for _, cluster := range wave.Clusters {
+				result.Clusters = append(result.Clusters, f.notStarted(cluster))
+			}
+			report.Waves = append(report.Waves, result)
+			continue
+		}
+
+		f.log.Info("Upgrading fleet wave", "wave", name, "clusters", len(wave.Clusters))
+		result := f.upgradeWave(name, wave, threshold)
+		report.Waves = append(report.Waves, result)
+
+		if result.Failures >= threshold {
+			f.log.Info("Halting fleet upgrade, the wave reached the failure threshold", "wave", name, "failures", result.Failures, "threshold", threshold)
+			report.HaltedAfter = name
+		}
+	}
+
+	return report
+}
+
+func (f *FleetUpgrader) upgradeWave(name string, wave FleetWave, threshold int) FleetWaveResult {
+	maxConcurrent := wave.MaxConcurrent
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		slots  = make(chan struct{}, maxConcurrent)
+		result = FleetWaveResult{Name: name, Clusters: make([]FleetClusterResult, len(wave.Clusters))}
+	)
+	for i, cluster := range wave.Clusters {
+		slots <- struct{}{}
+
+		mu.Lock()
+		halted := result.Failures >= threshold
+		mu.Unlock()
+		if halted {
+			<-slots
+			result.Clusters[i] = f.notStarted(cluster)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, cluster FleetCluster) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			clusterResult := f.upgradeCluster(cluster)
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Clusters[i] = clusterResult
+			if clusterResult.Status == FleetClusterFailed {
+				result.Failures++
+			}
+		}(i, cluster)
+	}
+	wg.Wait()
+
+	return result
+}
+
+// upgradeCluster upgrades each scope of cluster, skipping it if a previous run already upgraded it to the same
+// version and resuming the previous run's upgrade ID if it did not finish.
+func (f *FleetUpgrader) upgradeCluster(cluster FleetCluster) FleetClusterResult {
+	result := f.notStarted(cluster)
+	log := f.log.WithValues("context", result.Context, "cluster", fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name))
+
+	f.mu.Lock()
+	previous, ok := f.state.Clusters[cluster.key()]
+	f.mu.Unlock()
+
+	if ok && previous.KubernetesVersion == result.KubernetesVersion {
+		result.UpgradeID = previous.UpgradeID
+		if previous.Status == FleetClusterSucceeded {
+			log.Info("Cluster was already upgraded by a previous run", "upgrade-id", result.UpgradeID)
+			result.Status = FleetClusterSucceeded
+			return result
+		}
+		log.Info("Resuming the upgrade of a previous run", "upgrade-id", result.UpgradeID)
+	} else {
+		result.UpgradeID = f.newUpgradeID()
+	}
+
+	result.Status = FleetClusterInProgress
+	f.saveState(log, result)
+
+	config := f.manifest.Config
+	config.TargetCluster = TargetClusterConfig{Namespace: cluster.Namespace, Name: cluster.Name, Kubeconfig: cluster.Kubeconfig, Access: config.TargetCluster.Access}
+	if cluster.Access != nil {
+		config.TargetCluster.Access = *cluster.Access
+	}
+	config.KubernetesVersion = result.KubernetesVersion
+	config.UpgradeID = result.UpgradeID
+	config.ManagementCluster = cluster.managementCluster(config.ManagementCluster)
+	config.MachineDeployment.Versions = mergeMachineDeploymentVersions(config.MachineDeployment.Versions, cluster.MachineDeploymentVersions)
+
+	scopes := cluster.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{controlPlaneScope, machineDeploymentScope}
+	}
+
+	result.Status = FleetClusterSucceeded
+	for _, scope := range scopes {
+		log.Info("Upgrading cluster", "scope", scope, "version", result.KubernetesVersion, "upgrade-id", result.UpgradeID)
+		scopeConfig := config
+		if scope != controlPlaneScope {
+			// Conformance checks run around the control plane upgrade
+			scopeConfig.Conformance = ConformanceConfig{}
+		}
+		warnings, err := f.upgradeClusterScope(log.WithValues("scope", scope), cluster, scope, scopeConfig)
+		result.Warnings = append(result.Warnings, warnings...)
+		if err != nil {
+			log.Error(err, "Error upgrading cluster", "scope", scope)
+			result.Status = FleetClusterFailed
+			result.Error = errors.Wrapf(err, "error upgrading %s", scope).Error()
+			break
+		}
+	}
+
+	f.saveState(log, result)
+	return result
+}
+
+// upgradeClusterScope upgrades scope of cluster with config. The control planes of clusters sharing an etcd are
+// upgraded one at a time, skipping the etcd version check once one of them succeeded.
+func (f *FleetUpgrader) upgradeClusterScope(log logr.Logger, cluster FleetCluster, scope string, config Config) ([]Warning, error) {
+	if scope != controlPlaneScope || cluster.SharedEtcd == "" {
+		return f.upgradeScope(log, scope, config)
+	}
+
+	lock := f.sharedEtcdLock(cluster.SharedEtcd)
+	lock.Lock()
+	defer lock.Unlock()
+
+	f.mu.Lock()
+	verified := sets.NewString(f.state.VerifiedEtcds...).Has(cluster.SharedEtcd)
+	f.mu.Unlock()
+	if verified {
+		config.ExternalEtcd.Verified = true
+	}
+
+	warnings, err := f.upgradeScope(log, scope, config)
+	if err == nil && !verified {
+		f.sharedEtcdVerified(log, cluster.SharedEtcd)
+	}
+	return warnings, err
+}
+
+// sharedEtcdLock returns the lock of the clusters sharing the etcd called name.
+func (f *FleetUpgrader) sharedEtcdLock(name string) *sync.Mutex {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.sharedEtcdLocks == nil {
+		f.sharedEtcdLocks = make(map[string]*sync.Mutex)
+	}
+	if f.sharedEtcdLocks[name] == nil {
+		f.sharedEtcdLocks[name] = &sync.Mutex{}
+	}
+	return f.sharedEtcdLocks[name]
+}
+
+// sharedEtcdVerified records that the version of the shared etcd called name was checked.
+func (f *FleetUpgrader) sharedEtcdVerified(log logr.Logger, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	verified := sets.NewString(f.state.VerifiedEtcds...)
+	verified.Insert(name)
+	f.state.VerifiedEtcds = verified.List()
+	if err := saveFleetState(f.statePath, f.state); err != nil {
+		log.Error(err, "Unable to save fleet state, a resumed fleet upgrade may check the shared etcd version again")
+	}
+}
+
+// mergeMachineDeploymentVersions returns the machine deployment versions of base, overridden by those of cluster.
+func mergeMachineDeploymentVersions(base, cluster map[string]string) map[string]string {
+	if len(cluster) == 0 {
+		return base
+	}
+	merged := make(map[string]string, len(base)+len(cluster))
+	for name, version := range base {
+		merged[name] = version
+	}
+	for name, version := range cluster {
+		merged[name] = version
+	}
+	return merged
+}
+
+// notStarted returns the result of cluster before it is upgraded.
+func (f *FleetUpgrader) notStarted(cluster FleetCluster) FleetClusterResult {
+	version := cluster.KubernetesVersion
+	if version == "" {
+		version = f.manifest.Config.KubernetesVersion
+	}
+	return FleetClusterResult{
+		Context:           cluster.managementCluster(f.manifest.Config.ManagementCluster).Context,
+		Namespace:         cluster.Namespace,
+		Name:              cluster.Name,
+		KubernetesVersion: version,
+		Status:            FleetClusterNotStarted,
+		key:               cluster.key(),
+	}
+}
+
+// saveState records the progress of a cluster. Failing to save it is logged rather than failing the upgrade, as it
+// only matters if the fleet upgrade has to be resumed.
+func (f *FleetUpgrader) saveState(log logr.Logger, result FleetClusterResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.state.Clusters[result.key] = FleetClusterState{
+		KubernetesVersion: result.KubernetesVersion,
+		UpgradeID:         result.UpgradeID,
+		Status:            result.Status,
+		Error:             result.Error,
+	}
+	if err := saveFleetState(f.statePath, f.state); err != nil {
+		log.Error(err, "Unable to save fleet state, a resumed fleet upgrade may upgrade this cluster again")
+	}
+}
+
+// upgradeScope upgrades a scope of the cluster in config, then uploads its results if config has a results sink.
+func upgradeScope(log logr.Logger, scope string, config Config) ([]Warning, error) {
+	var (
+		upgrader interface {
+			Upgrade() error
+			Warnings() []Warning
+			Report() RunReport
+		}
+		err error
+	)
+	switch scope {
+	case controlPlaneScope:
+		upgrader, err = NewControlPlaneUpgrader(log, config)
+	case machineDeploymentScope:
+		upgrader, err = NewMachineDeploymentUpgrader(log, config)
+	default:
+		return nil, errors.Errorf("invalid upgrade scope %q", scope)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = upgrader.Upgrade()
+
+	report := upgrader.Report()
+	report.Succeeded = err == nil
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if uploadErr := UploadRunResults(log, config.Results, report); uploadErr != nil {
+		log.Error(uploadErr, "Unable to upload the results of the upgrade")
+	}
+
+	return upgrader.Warnings(), err
+}
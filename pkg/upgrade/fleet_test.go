@@ -0,0 +1,295 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+)
+
+func TestLoadFleetManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := filepath.Join(dir, "fleet.yaml")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`config:
+  kubernetesVersion: v1.16.3
+failureThreshold: 2
+waves:
+- name: dev
+  clusters:
+  - namespace: dev
+    name: a
+    scopes: [control-plane]
+- name: prod
+  maxConcurrent: 2
+  clusters:
+  - context: prod
+    namespace: prod
+    name: b
+    kubernetesVersion: latest-patch
+`), 0644))
+
+	m, err := LoadFleetManifest(manifest)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.16.3", m.Config.KubernetesVersion)
+	assert.Equal(t, 2, m.FailureThreshold)
+	require.Len(t, m.Waves, 2)
+	assert.Equal(t, []string{controlPlaneScope}, m.Waves[0].Clusters[0].Scopes)
+	assert.Equal(t, FleetCluster{Context: "prod", Namespace: "prod", Name: "b", KubernetesVersion: "latest-patch"}, m.Waves[1].Clusters[0])
+}
+
+func TestFleetManifestProblems(t *testing.T) {
+	m := &FleetManifest{
+		FailureThreshold: -1,
+		Waves: []FleetWave{
+			{Name: "dev", Clusters: []FleetCluster{
+				{Namespace: "dev", Name: "a", KubernetesVersion: "v1.16.3", Scopes: []string{"workers"}},
+				{Namespace: "dev", Name: "a", KubernetesVersion: "v1.16.3"},
+				{Namespace: "dev", Name: "b"},
+				{Name: "c"},
+			}},
+			{},
+		},
+	}
+
+	assert.Equal(t, []string{
+		"failureThreshold must not be negative",
+		`cluster dev/a has invalid scope "workers", must be one of [control-plane machine-deployment]`,
+		"cluster dev/a is listed more than once",
+		"cluster dev/b has no kubernetes version",
+		"wave dev: cluster namespace and name are required",
+		"wave 2 has no clusters",
+	}, fleetManifestProblems(m))
+}
+
+func TestFleetManagementClusters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet-kubeconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	require.NoError(t, ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600))
+
+	base := ManagementClusterConfig{Kubeconfig: kubeconfig, Context: "dev"}
+	legacy := FleetCluster{Context: "prod", Namespace: "prod", Name: "a"}
+	assert.Equal(t, ManagementClusterConfig{Kubeconfig: kubeconfig, Context: "prod"}, legacy.managementCluster(base))
+	assert.Equal(t, "prod/prod/a", legacy.key())
+
+	// The kubeconfig path defaults to the manifest config's, impersonation does not
+	structured := FleetCluster{
+		ManagementCluster: &ManagementClusterConfig{Context: "prod", Impersonate: ImpersonationConfig{User: "upgrader"}},
+		Namespace:         "prod",
+		Name:              "b",
+	}
+	assert.Equal(t, ManagementClusterConfig{Kubeconfig: kubeconfig, Context: "prod", Impersonate: ImpersonationConfig{User: "upgrader"}}, structured.managementCluster(base))
+	other := FleetCluster{ManagementCluster: &ManagementClusterConfig{Kubeconfig: "other", Context: "prod"}, Namespace: "prod", Name: "b"}
+	assert.NotEqual(t, structured.key(), other.key())
+
+	m := &FleetManifest{
+		Config: Config{KubernetesVersion: "v1.16.3", ManagementCluster: base},
+		Waves: []FleetWave{{Clusters: []FleetCluster{
+			legacy,
+			structured,
+			{ManagementCluster: &ManagementClusterConfig{Context: "staging"}, Namespace: "staging", Name: "c"},
+			{ManagementCluster: &ManagementClusterConfig{Context: "staging"}, Namespace: "staging", Name: "d"},
+			{Namespace: "dev", Name: "e", Kubeconfig: KubeconfigSourceConfig{File: kubeconfig, Context: "qa"}},
+		}}},
+	}
+	assert.Equal(t, []string{
+		`cluster staging/c management cluster: kubeconfig ` + kubeconfig + ` has no context "staging"`,
+		`cluster dev/e kubeconfig: kubeconfig ` + kubeconfig + ` has no context "qa"`,
+	}, fleetKubeconfigProblems(m))
+
+	m.Waves[0].Clusters = append(m.Waves[0].Clusters,
+		FleetCluster{Context: "prod", ManagementCluster: &ManagementClusterConfig{Impersonate: ImpersonationConfig{Groups: []string{"g"}}}, Namespace: "prod", Name: "f"},
+	)
+	assert.Equal(t, []string{
+		"cluster prod/f sets both context and managementCluster, set the context in managementCluster",
+		"cluster prod/f managementCluster: impersonated groups require an impersonated user",
+	}, fleetManifestProblems(m))
+}
+
+func TestFleetUpgrade(t *testing.T) {
+	manifest := &FleetManifest{
+		Config: Config{KubernetesVersion: "v1.16.3"},
+		Waves: []FleetWave{
+			{Name: "dev", Clusters: []FleetCluster{{Namespace: "dev", Name: "a"}}},
+			{Name: "staging", MaxConcurrent: 2, Clusters: []FleetCluster{
+				{Namespace: "staging", Name: "b"},
+				{Namespace: "staging", Name: "c"},
+			}},
+			{Name: "prod", Clusters: []FleetCluster{{Namespace: "prod", Name: "d"}}},
+		},
+	}
+
+	tests := []struct {
+		name             string
+		failureThreshold int
+		failing          string
+		expectedHalted   string
+		expectedStatuses map[string]string
+	}{
+		{
+			name: "all succeed",
+			expectedStatuses: map[string]string{
+				"a": FleetClusterSucceeded, "b": FleetClusterSucceeded, "c": FleetClusterSucceeded, "d": FleetClusterSucceeded,
+			},
+		},
+		{
+			name:           "failure halts later waves",
+			failing:        "c",
+			expectedHalted: "staging",
+			expectedStatuses: map[string]string{
+				"a": FleetClusterSucceeded, "b": FleetClusterSucceeded, "c": FleetClusterFailed, "d": FleetClusterNotStarted,
+			},
+		},
+		{
+			name:             "failure below threshold",
+			failureThreshold: 2,
+			failing:          "c",
+			expectedStatuses: map[string]string{
+				"a": FleetClusterSucceeded, "b": FleetClusterSucceeded, "c": FleetClusterFailed, "d": FleetClusterSucceeded,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fleet-state")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			m := *manifest
+			m.FailureThreshold = tc.failureThreshold
+			f := newTestFleetUpgrader(t, &m, filepath.Join(dir, "state.json"), func(name string) error {
+				if name == tc.failing {
+					return errors.New("boom")
+				}
+				return nil
+			})
+
+			report := f.Upgrade()
+
+			assert.Equal(t, tc.expectedHalted, report.HaltedAfter)
+			assert.Equal(t, tc.expectedStatuses, fleetStatuses(report))
+			assert.Equal(t, tc.failing == "", report.Succeeded())
+		})
+	}
+}
+
+func TestFleetUpgradeResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	manifest := &FleetManifest{
+		Config: Config{KubernetesVersion: "v1.16.3"},
+		Waves: []FleetWave{
+			{Name: "dev", Clusters: []FleetCluster{{Namespace: "dev", Name: "a"}, {Namespace: "dev", Name: "b"}}},
+		},
+	}
+
+	first := newTestFleetUpgrader(t, manifest, statePath, func(name string) error {
+		if name == "b" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	first.newUpgradeID = func() string { return "100" }
+	report := first.Upgrade()
+	assert.Equal(t, map[string]string{"a": FleetClusterSucceeded, "b": FleetClusterFailed}, fleetStatuses(report))
+
+	var upgraded []string
+	second := newTestFleetUpgrader(t, manifest, statePath, func(name string) error {
+		upgraded = append(upgraded, name)
+		return nil
+	})
+	second.newUpgradeID = func() string { return "200" }
+	report = second.Upgrade()
+
+	assert.Equal(t, map[string]string{"a": FleetClusterSucceeded, "b": FleetClusterSucceeded}, fleetStatuses(report))
+	// a is not upgraded again, and b resumes with its upgrade ID
+	assert.Equal(t, []string{"b", "b"}, upgraded)
+	assert.Equal(t, "100", report.Waves[0].Clusters[1].UpgradeID)
+}
+
+func TestFleetSharedEtcd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := &FleetManifest{
+		Config:           Config{KubernetesVersion: "v1.16.3"},
+		FailureThreshold: 2,
+		Waves: []FleetWave{
+			{Name: "dev", MaxConcurrent: 3, Clusters: []FleetCluster{
+				{Namespace: "dev", Name: "a", SharedEtcd: "etcd-1", Scopes: []string{controlPlaneScope}},
+				{Namespace: "dev", Name: "b", SharedEtcd: "etcd-1", Scopes: []string{controlPlaneScope}},
+				{Namespace: "dev", Name: "c", SharedEtcd: "etcd-1", Scopes: []string{controlPlaneScope}},
+			}},
+		},
+	}
+
+	var (
+		mu       sync.Mutex
+		upgraded []string
+		verified = map[string]bool{}
+	)
+	f := newTestFleetUpgrader(t, manifest, filepath.Join(dir, "state.json"), nil)
+	f.upgradeScope = func(_ logr.Logger, _ string, config Config) ([]Warning, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		name := config.TargetCluster.Name
+		upgraded = append(upgraded, name)
+		verified[name] = config.ExternalEtcd.Verified
+		if len(upgraded) == 1 {
+			return nil, errors.New("boom")
+		}
+		return nil, nil
+	}
+
+	f.Upgrade()
+
+	// The first upgrade fails, the second checks the etcd version, and the third skips the check
+	require.Len(t, upgraded, 3)
+	assert.False(t, verified[upgraded[0]])
+	assert.False(t, verified[upgraded[1]])
+	assert.True(t, verified[upgraded[2]])
+	assert.Equal(t, []string{"etcd-1"}, f.state.VerifiedEtcds)
+}
+
+func newTestFleetUpgrader(t *testing.T, manifest *FleetManifest, statePath string, upgrade func(name string) error) *FleetUpgrader {
+	f, err := NewFleetUpgrader(logging.NewLogrusLoggerAdapter(logrus.New()), manifest, statePath)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	f.upgradeScope = func(_ logr.Logger, _ string, config Config) ([]Warning, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return nil, upgrade(config.TargetCluster.Name)
+	}
+	return f
+}
+
+func fleetStatuses(report *FleetReport) map[string]string {
+	statuses := map[string]string{}
+	for _, wave := range report.Waves {
+		for _, cluster := range wave.Clusters {
+			statuses[cluster.Name] = cluster.Status
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// healthSampleTimeout is how long sampling the health of etcd and of the API server may take.
+const healthSampleTimeout = 30 * time.Second
+
+// HealthWindow is a period of a run during which the sampled health of etcd and of the API server did not change.
+type HealthWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Etcd is the health of etcd, such as "healthy, 3 endpoints" or the unhealthy endpoints.
+	Etcd string `json:"etcd"`
+	// APIServer is the readiness of the API server, "ready" or why it is not.
+	APIServer string `json:"apiServer"`
+	// Samples is how many samples the window spans.
+	Samples int `json:"samples"`
+}
+
+// healthSample is the health of etcd and of the API server at a point in time.
+type healthSample struct {
+	etcd      string
+	apiServer string
+}
+
+// appendHealthSample adds sample, taken at now, to windows, extending the last window if the health did not change.
+func appendHealthSample(windows []HealthWindow, now time.Time, sample healthSample) []HealthWindow {
+	if n := len(windows); n > 0 && windows[n-1].Etcd == sample.etcd && windows[n-1].APIServer == sample.apiServer {
+		windows[n-1].End = now
+		windows[n-1].Samples++
+		return windows
+	}
+	return append(windows, HealthWindow{Start: now, End: now, Etcd: sample.etcd, APIServer: sample.apiServer, Samples: 1})
+}
+
+// parseHealthMonitorInterval parses the interval of the health monitor, which is disabled if interval is empty.
+func parseHealthMonitorInterval(interval string) (time.Duration, error) {
+	if interval == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error parsing health monitor interval %q", interval)
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("invalid health monitor interval %q: must be positive", interval)
+	}
+	return d, nil
+}
+
+// healthMonitor samples health in the background, every interval, until it is stopped.
+type healthMonitor struct {
+	interval time.Duration
+	sample   func() healthSample
+	// changed, if not nil, is called with each window as it starts.
+	changed func(HealthWindow)
+	now     func() time.Time
+
+	lock    sync.Mutex
+	windows []HealthWindow
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// start starts sampling.
+func (m *healthMonitor) start() {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			m.add(m.sample())
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *healthMonitor) add(sample healthSample) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := len(m.windows)
+	m.windows = appendHealthSample(m.windows, m.now(), sample)
+	if len(m.windows) > n && m.changed != nil {
+		m.changed(m.windows[len(m.windows)-1])
+	}
+}
+
+// finish stops sampling, waiting for the sample in progress, and returns the health windows.
+func (m *healthMonitor) finish() []HealthWindow {
+	close(m.stop)
+	<-m.done
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.windows
+}
+
+// startHealthMonitor starts sampling the health of etcd and of the API server of the target cluster every health
+// monitor interval, and returns the function stopping it and recording its windows in the report. It must be started
+// once exec and an external etcd were checked for, as it samples etcd according to what was found then.
+func (u *ControlPlaneUpgrader) startHealthMonitor() func() {
+	viaAPIServer := u.execForbidden || u.etcdExternal
+	m := &healthMonitor{
+		interval: u.healthMonitorInterval,
+		sample: func() healthSample {
+			return u.sampleHealth(viaAPIServer)
+		},
+		changed: func(w HealthWindow) {
+			u.log.Info("Control plane health changed", "etcd", w.Etcd, "api-server", w.APIServer)
+		},
+		now: time.Now,
+	}
+	m.start()
+	return func() {
+		u.record.health(m.finish())
+	}
+}
+
+// sampleHealth returns the health of etcd, according to the API server if viaAPIServer is true, and of the API server
+// of the target cluster.
+func (u *ControlPlaneUpgrader) sampleHealth(viaAPIServer bool) healthSample {
+	ctx, cancel := context.WithTimeout(context.TODO(), healthSampleTimeout)
+	defer cancel()
+	return healthSample{etcd: u.sampleEtcdHealth(ctx, viaAPIServer), apiServer: u.sampleAPIServerReadiness(ctx)}
+}
+
+// sampleEtcdHealth returns the health of the etcd endpoints, or of etcd according to the API server if viaAPIServer is
+// true, without etcdctl or with an external etcd.
+func (u *ControlPlaneUpgrader) sampleEtcdHealth(ctx context.Context, viaAPIServer bool) string {
+	if viaAPIServer {
+		if err := u.apiServerEtcdHealth(healthSampleTimeout); err != nil {
+			return fmt.Sprintf("unhealthy: %v", err)
+		}
+		return "healthy"
+	}
+
+	health, err := u.etcdEndpointHealthStatus(ctx, nil)
+	if err != nil {
+		return fmt.Sprintf("unknown: %v", err)
+	}
+	if unhealthy := unhealthyEtcdEndpoints(health); len(unhealthy) > 0 {
+		return fmt.Sprintf("unhealthy: %s", strings.Join(unhealthy, "; "))
+	}
+	return fmt.Sprintf("healthy, %d endpoints", len(health))
+}
+
+// sampleAPIServerReadiness returns the readiness of the API server from /readyz, or /healthz on API servers that do
+// not serve it.
+func (u *ControlPlaneUpgrader) sampleAPIServerReadiness(ctx context.Context) string {
+	client := u.targetKubernetesClient.CoreV1().RESTClient()
+	body, err := client.Get().AbsPath("/readyz").Context(ctx).DoRaw()
+	if apierrors.IsNotFound(err) {
+		body, err = client.Get().AbsPath("/healthz").Context(ctx).DoRaw()
+	}
+	if err != nil {
+		if detail := strings.TrimSpace(string(body)); detail != "" {
+			return fmt.Sprintf("not ready: %s", detail)
+		}
+		return fmt.Sprintf("not ready: %v", err)
+	}
+	return "ready"
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestAppendHealthSample(t *testing.T) {
+	start := time.Date(2019, 11, 5, 10, 0, 0, 0, time.UTC)
+	healthy := healthSample{etcd: "healthy, 3 endpoints", apiServer: "ready"}
+	degraded := healthSample{etcd: "unhealthy: https://10.0.0.1:2379: context deadline exceeded", apiServer: "ready"}
+
+	var windows []HealthWindow
+	windows = appendHealthSample(windows, start, healthy)
+	windows = appendHealthSample(windows, start.Add(10*time.Second), healthy)
+	windows = appendHealthSample(windows, start.Add(20*time.Second), degraded)
+	windows = appendHealthSample(windows, start.Add(30*time.Second), healthy)
+
+	assert.Equal(t, []HealthWindow{
+		{Start: start, End: start.Add(10 * time.Second), Etcd: healthy.etcd, APIServer: "ready", Samples: 2},
+		{Start: start.Add(20 * time.Second), End: start.Add(20 * time.Second), Etcd: degraded.etcd, APIServer: "ready", Samples: 1},
+		{Start: start.Add(30 * time.Second), End: start.Add(30 * time.Second), Etcd: healthy.etcd, APIServer: "ready", Samples: 1},
+	}, windows)
+}
+
+func TestParseHealthMonitorInterval(t *testing.T) {
+	d, err := parseHealthMonitorInterval("")
+	require.NoError(t, err)
+	assert.Zero(t, d)
+
+	d, err = parseHealthMonitorInterval("10s")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, d)
+
+	for _, invalid := range []string{"10", "0s", "-1s"} {
+		_, err := parseHealthMonitorInterval(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHealthMonitor(t *testing.T) {
+	samples := make(chan struct{}, 10)
+	var changes []HealthWindow
+	m := &healthMonitor{
+		interval: time.Millisecond,
+		sample: func() healthSample {
+			select {
+			case samples <- struct{}{}:
+			default:
+			}
+			return healthSample{etcd: "healthy, 1 endpoints", apiServer: "ready"}
+		},
+		changed: func(w HealthWindow) { changes = append(changes, w) },
+		now:     time.Now,
+	}
+	m.start()
+	<-samples
+	<-samples
+	windows := m.finish()
+
+	require.Len(t, windows, 1)
+	assert.True(t, windows[0].Samples >= 2)
+	assert.Equal(t, "ready", windows[0].APIServer)
+	assert.Len(t, changes, 1)
+}
+
+// TestHealthMonitorDegradedFlags is meant to run with -race: the monitor must not read the flags the upgrade sets once
+// it started.
+func TestHealthMonitorDegradedFlags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz/etcd", "/readyz":
+			w.Write([]byte("ok"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+	u := &ControlPlaneUpgrader{
+		log:                    logrtesting.NullLogger{},
+		targetKubernetesClient: client,
+		healthMonitorInterval:  time.Millisecond,
+		record:                 newRunRecorder("control-plane", "ns", "cluster", "123"),
+		execForbidden:          true,
+	}
+
+	stop := u.startHealthMonitor()
+	for i := 0; i < 20; i++ {
+		u.execForbidden = i%2 == 1
+		u.etcdExternal = i%2 == 0
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	// etcd health is sampled through the API server, as exec was forbidden when the monitor started
+	windows := u.record.report.HealthTimeline
+	require.Len(t, windows, 1)
+	assert.Equal(t, "healthy", windows[0].Etcd)
+	assert.Equal(t, "ready", windows[0].APIServer)
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+)
+
+// validateIdempotent refuses the options that wait for interactive confirmation, which an idempotent run cannot
+// answer.
+func validateIdempotent(config Config) error {
+	if !config.Idempotent {
+		return nil
+	}
+	if config.MachineDeployment.PauseBetweenBatches {
+		return errors.New("idempotent upgrades are non-interactive and cannot pause between batches")
+	}
+	for i, batch := range config.MachineDeployment.Batches {
+		if batch.Pause {
+			return errors.Errorf("idempotent upgrades are non-interactive and cannot pause after machine deployment batch %d", i+1)
+		}
+	}
+	return nil
+}
+
+// infrastructureImageUpToDate returns true if the image at field of the infrastructure machine infra is already id.
+func infrastructureImageUpToDate(infra *unstructured.Unstructured, field, id string) (bool, error) {
+	updated := infra.DeepCopy()
+	if err := updateInfrastructureImage(updated, field, id); err != nil {
+		return false, err
+	}
+	return equality.Semantic.DeepEqual(infra.Object, updated.Object), nil
+}
+
+// upToDate returns true if machines are all at the desired version, and their infrastructure machines have the
+// images of their infrastructure kinds, so that an idempotent upgrade has nothing to do.
+func (u *ControlPlaneUpgrader) upToDate(machines []*clusterv1.Machine) (bool, error) {
+	for _, machine := range machines {
+		if machine.Spec.Version == nil || !versionMatches(*machine.Spec.Version, u.desiredVersion) {
+			return false, nil
+		}
+
+		ref := machine.Spec.InfrastructureRef
+		update, ok, err := resolveImageUpdate(u.machineUpdates, ref.Kind, u.desiredVersion)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		infra, err := external.Get(u.managementClusterClient, &ref, machine.Namespace)
+		if err != nil {
+			return false, err
+		}
+		if upToDate, err := infrastructureImageUpToDate(infra, update.field, update.id); err != nil || !upToDate {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// upToDate returns true if the template of machineDeployment already has its target version and, if it is the
+// desired version, the desired image, so that an idempotent upgrade leaves it alone.
+func (u *MachineDeploymentUpgrader) upToDate(machineDeployment *clusterv1.MachineDeployment) (bool, error) {
+	version := machineDeployment.Spec.Template.Spec.Version
+	if version == nil || !versionMatches(*version, u.targetVersion(machineDeployment)) {
+		return false, nil
+	}
+
+	updated := machineDeployment.DeepCopy()
+	if err := u.setTemplateVersion(updated); err != nil {
+		return false, err
+	}
+	updated.Spec.Template.Spec.Version = version
+	return equality.Semantic.DeepEqual(updated.Spec.Template.Spec, machineDeployment.Spec.Template.Spec), nil
+}
+
+// machineDeploymentsToUpgrade returns the machine deployments of machineDeployments that are not up to date. All of
+// them are returned unless the upgrade is idempotent.
+func (u *MachineDeploymentUpgrader) machineDeploymentsToUpgrade(machineDeployments []clusterv1.MachineDeployment) ([]clusterv1.MachineDeployment, error) {
+	if !u.idempotent {
+		return machineDeployments, nil
+	}
+
+	var ret []clusterv1.MachineDeployment
+	for i := range machineDeployments {
+		upToDate, err := u.upToDate(&machineDeployments[i])
+		if err != nil {
+			return nil, err
+		}
+		if upToDate {
+			u.log.Info("MachineDeployment is already upgraded", "namespace", machineDeployments[i].Namespace, "name", machineDeployments[i].Name)
+			continue
+		}
+		ret = append(ret, machineDeployments[i])
+	}
+	return ret, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestValidateIdempotent(t *testing.T) {
+	assert.NoError(t, validateIdempotent(Config{MachineDeployment: MachineDeploymentUpdateConfig{PauseBetweenBatches: true}}))
+	assert.NoError(t, validateIdempotent(Config{Idempotent: true}))
+
+	assert.Error(t, validateIdempotent(Config{Idempotent: true, MachineDeployment: MachineDeploymentUpdateConfig{PauseBetweenBatches: true}}))
+	assert.Error(t, validateIdempotent(Config{Idempotent: true, MachineDeployment: MachineDeploymentUpdateConfig{
+		Batches: []MachineDeploymentBatchConfig{{Names: []string{"a"}}, {Names: []string{"b"}, Pause: true}},
+	}}))
+}
+
+func TestInfrastructureImageUpToDate(t *testing.T) {
+	infra := &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": "FooMachine",
+		"spec": map[string]interface{}{"image": "new"},
+	}}
+
+	upToDate, err := infrastructureImageUpToDate(infra, "spec.image", "new")
+	require.NoError(t, err)
+	assert.True(t, upToDate)
+
+	upToDate, err = infrastructureImageUpToDate(infra, "spec.image", "newer")
+	require.NoError(t, err)
+	assert.False(t, upToDate)
+	assert.Equal(t, "new", infra.Object["spec"].(map[string]interface{})["image"], "the infrastructure machine is not changed")
+
+	_, err = infrastructureImageUpToDate(infra, "spec.disks[0].image", "new")
+	assert.Error(t, err)
+}
+
+func TestMachineDeploymentsToUpgrade(t *testing.T) {
+	md := func(name, version, image string) clusterv1.MachineDeployment {
+		m := clusterv1.MachineDeployment{}
+		m.Name = name
+		m.Spec.Template.Spec.Version = &version
+		m.Spec.Template.Spec.InfrastructureRef = corev1.ObjectReference{Name: image}
+		return m
+	}
+	machineDeployments := []clusterv1.MachineDeployment{
+		md("upgraded", "v1.16.3", "new"),
+		md("old-version", "v1.15.3", "new"),
+		md("old-image", "v1.16.3", "old"),
+		md("held-back", "v1.15.6", "old"),
+	}
+
+	u := &MachineDeploymentUpgrader{
+		log:              logrtesting.NullLogger{},
+		desiredVersion:   semver.MustParse("1.16.3"),
+		imageField:       "infrastructureRef.name",
+		imageID:          "new",
+		versionOverrides: map[string]semver.Version{"held-back": semver.MustParse("1.15.6")},
+	}
+
+	pending, err := u.machineDeploymentsToUpgrade(machineDeployments)
+	require.NoError(t, err)
+	assert.Equal(t, machineDeployments, pending, "all machine deployments are upgraded unless idempotent")
+
+	u.idempotent = true
+	pending, err = u.machineDeploymentsToUpgrade(machineDeployments)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old-version", "old-image"}, machineDeploymentNames(pending))
+}
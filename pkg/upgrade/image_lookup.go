@@ -0,0 +1,73 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+)
+
+// imageLookupData is what image lookup formats are expanded with, as {{.Version}} or {{.Kind}}.
+type imageLookupData struct {
+	// Version is the Kubernetes version of the machine, without the v prefix, such as 1.16.3.
+	Version string
+	Major   uint64
+	Minor   uint64
+	Patch   uint64
+	// Kind is the kind of the infrastructure machine, such as AWSMachine.
+	Kind string
+}
+
+// parseImageLookupFormat parses format, a text/template of an image identifier.
+func parseImageLookupFormat(format string) (*template.Template, error) {
+	t, err := template.New("image").Option("missingkey=error").Parse(format)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid image lookup format %q", format)
+	}
+	return t, nil
+}
+
+// expandImageLookupFormat returns the image identifier of infrastructure machines of kind at version, from format.
+func expandImageLookupFormat(format, kind string, version semver.Version) (string, error) {
+	t, err := parseImageLookupFormat(format)
+	if err != nil {
+		return "", err
+	}
+	data := imageLookupData{
+		Version: fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch),
+		Major:   version.Major,
+		Minor:   version.Minor,
+		Patch:   version.Patch,
+		Kind:    kind,
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", errors.Wrapf(err, "error expanding image lookup format %q", format)
+	}
+	if b.Len() == 0 {
+		return "", errors.Errorf("image lookup format %q expands to an empty image for %s %s", format, kind, version)
+	}
+	return b.String(), nil
+}
+
+// validateImageLookupFormats checks the image lookup formats of config parse.
+func validateImageLookupFormats(config MachineUpdateConfig) error {
+	formats := []string{config.Image.LookupFormat}
+	for _, image := range config.ImagesByKind {
+		formats = append(formats, image.LookupFormat)
+	}
+	for _, format := range formats {
+		if format == "" {
+			continue
+		}
+		if _, err := parseImageLookupFormat(format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandImageLookupFormat(t *testing.T) {
+	version := semver.MustParse("1.16.3")
+	tests := []struct {
+		format      string
+		expected    string
+		expectedErr bool
+	}{
+		{format: "ubuntu-1804-kube-v{{.Version}}", expected: "ubuntu-1804-kube-v1.16.3"},
+		{format: "capi-{{.Kind}}-{{.Major}}.{{.Minor}}-{{.Patch}}", expected: "capi-VSphereMachine-1.16-3"},
+		{format: "fixed-template", expected: "fixed-template"},
+		{format: "{{.Unknown}}", expectedErr: true},
+		{format: "{{.Version", expectedErr: true},
+		{format: "{{if false}}x{{end}}", expectedErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.format, func(t *testing.T) {
+			actual, err := expandImageLookupFormat(tc.format, "VSphereMachine", version)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestValidateImageLookupFormats(t *testing.T) {
+	assert.NoError(t, validateImageLookupFormats(MachineUpdateConfig{Image: ImageUpdateConfig{LookupFormat: "ubuntu-{{.Version}}"}}))
+	assert.Error(t, validateImageLookupFormats(MachineUpdateConfig{
+		ImagesByKind: map[string]ImageUpdateConfig{"AWSMachine": {LookupFormat: "{{.Version"}},
+	}))
+}
@@ -0,0 +1,262 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationAvailableImages, on a Cluster, lists the images known to exist in the image service of its provider,
+// separated by commas, such as those an image pipeline uploaded to Glance. They are not looked up when verifying that
+// images exist.
+const AnnotationAvailableImages = annotationPrefix + "available-images"
+
+// imageVerifier verifies machine images against a catalog of approved images and with a command.
+type imageVerifier struct {
+	// catalog is the set of approved images, or nil if there is no catalog.
+	catalog sets.String
+	// command is run for each image unless empty.
+	command string
+	// existence looks images not in available up in the image service of their provider.
+	existence bool
+	available sets.String
+}
+
+// newImageVerifier returns the verifier configured in config, verifying the signature of its catalog and reading it,
+// or nil if image verification is not configured.
+func newImageVerifier(config ImageVerificationConfig) (*imageVerifier, error) {
+	if config == (ImageVerificationConfig{}) {
+		return nil, nil
+	}
+	if config.Catalog == "" && (config.CatalogSignature != "" || config.CatalogKey != "") {
+		return nil, errors.New("an image catalog signature or key requires an image catalog")
+	}
+	if (config.CatalogSignature == "") != (config.CatalogKey == "") {
+		return nil, errors.New("an image catalog signature requires a key to verify it with, and vice versa")
+	}
+
+	v := &imageVerifier{command: config.Command, existence: config.Existence}
+	if config.Catalog == "" {
+		return v, nil
+	}
+	if config.CatalogSignature != "" {
+		if err := verifyBlobSignature(config.Catalog, config.CatalogSignature, config.CatalogKey); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(config.Catalog)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening image catalog")
+	}
+	defer f.Close()
+	v.catalog, err = parseImageCatalog(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading image catalog %s", config.Catalog)
+	}
+	return v, nil
+}
+
+// verifyBlobSignature verifies the cosign signature of the file path with key.
+func verifyBlobSignature(path, signature, key string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("cosign", "verify-blob", "--key", key, "--signature", signature, path)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "error verifying the signature of image catalog %s with cosign: %s", path, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// parseImageCatalog reads the images of a catalog, the last field of each line that is not empty or a comment.
+func parseImageCatalog(r io.Reader) (sets.String, error) {
+	images := sets.NewString()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		// sha256sum marks files read in binary mode with a leading *
+		images.Insert(strings.TrimPrefix(fields[len(fields)-1], "*"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return images, nil
+}
+
+// verify checks that image, used for infrastructure machines of kind, is in the catalog and passes the command.
+func (v *imageVerifier) verify(kind, image string) error {
+	if v.catalog != nil && !v.catalog.Has(image) {
+		return errors.Errorf("image %s of %s is not in the image catalog", image, kind)
+	}
+	if v.command != "" {
+		var output bytes.Buffer
+		cmd := exec.Command(v.command, image, kind)
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "image %s of %s failed verification by %s: %s", image, kind, v.command, strings.TrimSpace(output.String()))
+		}
+	}
+	if v.existence && !v.available.Has(image) {
+		return verifyImageExists(kind, image)
+	}
+	return nil
+}
+
+// verifyImageExists looks image up with the image status command of the provider of kind, if it has one, and checks
+// that it is active.
+func verifyImageExists(kind, image string) error {
+	args := providerAdapterForKind(kind).imageStatusCommand(image)
+	if len(args) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return errors.Errorf("image %s of %s cannot be looked up as %s is not installed", image, kind, args[0])
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "image %s of %s was not found: %s", image, kind, strings.TrimSpace(stderr.String()))
+	}
+	if status := strings.TrimSpace(stdout.String()); !strings.EqualFold(status, "active") {
+		return errors.Errorf("image %s of %s is %s, not active", image, kind, status)
+	}
+	return nil
+}
+
+// withAvailableImages returns a copy of v that does not look up the images of the available images annotation of the
+// cluster namespace/name, reading it only if v verifies that images exist. A nil verifier is returned as is.
+func (v *imageVerifier) withAvailableImages(c ctrlclient.Client, namespace, name string) (*imageVerifier, error) {
+	if v == nil || !v.existence {
+		return v, nil
+	}
+	cluster := &clusterv1.Cluster{}
+	if err := c.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: namespace, Name: name}, cluster); err != nil {
+		return nil, errors.Wrapf(err, "error getting cluster %s/%s", namespace, name)
+	}
+	copied := *v
+	copied.available = parseAvailableImages(cluster.Annotations[AnnotationAvailableImages])
+	return &copied, nil
+}
+
+// parseAvailableImages parses the value of the available images annotation.
+func parseAvailableImages(value string) sets.String {
+	images := sets.NewString()
+	for _, image := range strings.Split(value, ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			images.Insert(image)
+		}
+	}
+	return images
+}
+
+// problems verifies images, by infrastructure machine kind, and returns why those that fail do. A nil verifier
+// verifies nothing.
+func (v *imageVerifier) problems(images map[string]string) []string {
+	if v == nil {
+		return nil
+	}
+	kinds := make([]string, 0, len(images))
+	for kind := range images {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var problems []string
+	for _, kind := range kinds {
+		if err := v.verify(kind, images[kind]); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// replacementImages returns the configured images of the infrastructure machines replacing machines, by kind.
+func (u *ControlPlaneUpgrader) replacementImages(machines []*clusterv1.Machine) (map[string]string, error) {
+	images := make(map[string]string)
+	for _, machine := range machines {
+		kind := machine.Spec.InfrastructureRef.Kind
+		if _, ok := images[kind]; ok {
+			continue
+		}
+		update, ok, err := resolveImageUpdate(u.machineUpdates, kind, u.desiredVersion)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			images[kind] = update.id
+		}
+	}
+	return images, nil
+}
+
+// imageVerificationProblems verifies the configured images of the infrastructure machines replacing machines.
+func (u *ControlPlaneUpgrader) imageVerificationProblems(machines []*clusterv1.Machine) ([]string, error) {
+	images, err := u.replacementImages(machines)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := u.imageVerifier.withAvailableImages(u.managementClusterClient, u.clusterNamespace, u.clusterName)
+	if err != nil {
+		return nil, err
+	}
+	return verifier.problems(images), nil
+}
+
+// imageVerificationProblems verifies the images the machine deployments are set to.
+func (u *MachineDeploymentUpgrader) imageVerificationProblems(machineDeployments []clusterv1.MachineDeployment) ([]string, error) {
+	verifier, err := u.imageVerifier.withAvailableImages(u.managementClusterClient, u.clusterNamespace, u.clusterName)
+	if err != nil {
+		return nil, err
+	}
+	// images differ by target version with an image lookup format, so each kind and image is verified on its own
+	verified := sets.NewString()
+	var problems []string
+	for i := range machineDeployments {
+		image, ok, err := u.templateImage(&machineDeployments[i])
+		if err != nil {
+			return nil, err
+		}
+		kind := machineDeployments[i].Spec.Template.Spec.InfrastructureRef.Kind
+		if !ok || verified.Has(kind+"/"+image) {
+			continue
+		}
+		verified.Insert(kind + "/" + image)
+		problems = append(problems, verifier.problems(map[string]string{kind: image})...)
+	}
+	return problems, nil
+}
+
+// checkImages refuses to change machineDeployments if the image they are set to fails verification.
+func (u *MachineDeploymentUpgrader) checkImages(machineDeployments []clusterv1.MachineDeployment) error {
+	if u.imageVerifier == nil {
+		return nil
+	}
+	u.log.Info("Verifying machine images")
+	problems, err := u.imageVerificationProblems(machineDeployments)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("refusing to upgrade with unverified machine images: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImageCatalog(t *testing.T) {
+	catalog := `# approved images
+ami-0123
+
+e3b0c44298fc1c149afbf4c8996fb924  ubuntu-1804-kube-v1.16.3.ova
+e3b0c44298fc1c149afbf4c8996fb925 *photon-3-kube-v1.16.3.ova
+`
+	images, err := parseImageCatalog(strings.NewReader(catalog))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ami-0123", "photon-3-kube-v1.16.3.ova", "ubuntu-1804-kube-v1.16.3.ova"}, images.List())
+}
+
+func TestNewImageVerifier(t *testing.T) {
+	v, err := newImageVerifier(ImageVerificationConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, v)
+	assert.Empty(t, v.problems(map[string]string{"AWSMachine": "ami-0123"}))
+
+	for _, config := range []ImageVerificationConfig{
+		{CatalogSignature: "images.sig", CatalogKey: "cosign.pub"},
+		{Catalog: "images.txt", CatalogSignature: "images.sig"},
+		{Catalog: "images.txt", CatalogKey: "cosign.pub"},
+	} {
+		_, err := newImageVerifier(config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+func TestImageVerifierProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-verification")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	catalog := filepath.Join(dir, "images.txt")
+	require.NoError(t, ioutil.WriteFile(catalog, []byte("ami-0123\nubuntu-1804-kube-v1.16.3\n"), 0600))
+	command := filepath.Join(dir, "verify")
+	script := "#!/bin/sh\nif [ \"$2\" = VSphereMachine ]; then echo \"unsigned $1\"; exit 1; fi\n"
+	require.NoError(t, ioutil.WriteFile(command, []byte(script), 0700))
+
+	v, err := newImageVerifier(ImageVerificationConfig{Catalog: catalog})
+	require.NoError(t, err)
+	problems := v.problems(map[string]string{"AWSMachine": "ami-0123", "AzureMachine": "ubuntu-1804-kube-v1.16.4"})
+	assert.Equal(t, []string{"image ubuntu-1804-kube-v1.16.4 of AzureMachine is not in the image catalog"}, problems)
+
+	v, err = newImageVerifier(ImageVerificationConfig{Command: command})
+	require.NoError(t, err)
+	problems = v.problems(map[string]string{"AWSMachine": "ami-0123", "VSphereMachine": "ubuntu-1804-kube-v1.16.3"})
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "image ubuntu-1804-kube-v1.16.3 of VSphereMachine failed verification")
+	assert.Contains(t, problems[0], "unsigned ubuntu-1804-kube-v1.16.3")
+}
+
+func TestImageVerifierExistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-existence")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := "#!/bin/sh\ncase \"$3\" in\nubuntu-1804-kube-v1.16.3) echo active ;;\nubuntu-1804-kube-v1.16.4) echo queued ;;\n*) echo \"No Image found for $3\" >&2; exit 1 ;;\nesac\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "openstack"), []byte(script), 0700))
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	require.NoError(t, os.Setenv("PATH", dir))
+
+	v, err := newImageVerifier(ImageVerificationConfig{Existence: true})
+	require.NoError(t, err)
+	assert.Empty(t, v.problems(map[string]string{"OpenStackMachine": "ubuntu-1804-kube-v1.16.3", "AWSMachine": "ami-0123"}))
+	assert.Equal(t, []string{"image ubuntu-1804-kube-v1.16.4 of OpenStackMachine is queued, not active"},
+		v.problems(map[string]string{"OpenStackMachine": "ubuntu-1804-kube-v1.16.4"}))
+	problems := v.problems(map[string]string{"OpenStackMachine": "ubuntu-1804-kube-v1.17.0"})
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "No Image found for ubuntu-1804-kube-v1.17.0")
+
+	v.available = parseAvailableImages("ubuntu-1804-kube-v1.17.0, ubuntu-1804-kube-v1.17.1")
+	assert.Empty(t, v.problems(map[string]string{"OpenStackMachine": "ubuntu-1804-kube-v1.17.0"}))
+
+	require.NoError(t, os.Setenv("PATH", ""))
+	assert.Equal(t, []string{"image ubuntu-1804-kube-v1.16.3 of OpenStackMachine cannot be looked up as openstack is not installed"},
+		v.problems(map[string]string{"OpenStackMachine": "ubuntu-1804-kube-v1.16.3"}))
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// crdAPIVersions are the versions of the CustomResourceDefinition API, newest first: management clusters older than
+// Kubernetes 1.16 only serve v1beta1.
+var crdAPIVersions = []string{"apiextensions.k8s.io/v1", "apiextensions.k8s.io/v1beta1"}
+
+// infrastructureSchema returns the OpenAPI schema of the version of the infrastructure kind of ref, from its
+// CustomResourceDefinition on the management cluster, and the name of the definition. The schema is nil if the
+// definition has none, and the name is empty if no definition defines the kind.
+func (u *ControlPlaneUpgrader) infrastructureSchema(ref corev1.ObjectReference) (map[string]interface{}, string, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid API version of %s %s", ref.Kind, ref.Name)
+	}
+
+	crds, err := listCustomResourceDefinitions(context.TODO(), u.managementClusterClient)
+	if err != nil {
+		return nil, "", err
+	}
+	if crd := findCustomResourceDefinition(crds, gv.Group, ref.Kind); crd != nil {
+		return crdSchema(crd.Object, gv.Version), crd.GetName(), nil
+	}
+	return nil, "", nil
+}
+
+// listCustomResourceDefinitions lists the CustomResourceDefinitions of the cluster of c, at the newest API version it
+// serves.
+func listCustomResourceDefinitions(ctx context.Context, c ctrlclient.Client) ([]unstructured.Unstructured, error) {
+	for _, apiVersion := range crdAPIVersions {
+		crds := &unstructured.UnstructuredList{}
+		crds.SetAPIVersion(apiVersion)
+		crds.SetKind("CustomResourceDefinitionList")
+		if err := c.List(ctx, crds); err != nil {
+			if meta.IsNoMatchError(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "error listing custom resource definitions")
+		}
+		return crds.Items, nil
+	}
+	return nil, errors.New("the management cluster serves no custom resource definition API")
+}
+
+// findCustomResourceDefinition returns the definition of crds defining kind in group, or nil.
+func findCustomResourceDefinition(crds []unstructured.Unstructured, group, kind string) *unstructured.Unstructured {
+	for i := range crds {
+		crdGroup, _, _ := unstructured.NestedString(crds[i].Object, "spec", "group")
+		crdKind, _, _ := unstructured.NestedString(crds[i].Object, "spec", "names", "kind")
+		if crdGroup == group && crdKind == kind {
+			return &crds[i]
+		}
+	}
+	return nil
+}
+
+// crdSchema returns the OpenAPI schema of version in the CustomResourceDefinition crd: the version's own, or in
+// v1beta1 the schema shared by every version.
+func crdSchema(crd map[string]interface{}, version string) map[string]interface{} {
+	versions, _, _ := unstructured.NestedSlice(crd, "spec", "versions")
+	for _, v := range versions {
+		v, ok := v.(map[string]interface{})
+		if !ok || v["name"] != version {
+			continue
+		}
+		if s, ok, _ := unstructured.NestedMap(v, "schema", "openAPIV3Schema"); ok {
+			return s
+		}
+	}
+	s, _, _ := unstructured.NestedMap(crd, "spec", "validation", "openAPIV3Schema")
+	return s
+}
+
+// imageFieldSchemaProblem returns why the image field path is not a string field of objects of the OpenAPI schema
+// s, listing the valid fields where it strays from the schema, or "" if it is valid. Objects whose fields are not
+// described, such as those preserving unknown fields, cannot be checked past them.
+func imageFieldSchemaProblem(s map[string]interface{}, path []imageFieldSegment) string {
+	at := ""
+	for _, segment := range path {
+		properties, _, _ := unstructured.NestedMap(s, "properties")
+		if len(properties) == 0 {
+			if t := schemaType(s); t != "" && t != "object" {
+				return fmt.Sprintf("%s is of type %s, not object", at, t)
+			}
+			additional, ok, _ := unstructured.NestedMap(s, "additionalProperties")
+			if !ok {
+				return ""
+			}
+			properties = map[string]interface{}{segment.name: additional}
+		}
+
+		field, ok := properties[segment.name].(map[string]interface{})
+		if !ok {
+			parent := at
+			if parent == "" {
+				parent = "the object"
+			}
+			return fmt.Sprintf("%s has no field %s, its fields are %s", parent, segment.name, strings.Join(propertyNames(properties), ", "))
+		}
+		s = field
+		at = strings.TrimPrefix(at+"."+segment.name, ".")
+
+		if segment.isList() {
+			if t := schemaType(s); t != "" && t != "array" {
+				return fmt.Sprintf("%s is of type %s, not array", at, t)
+			}
+			items, ok, _ := unstructured.NestedMap(s, "items")
+			if !ok {
+				return ""
+			}
+			s = items
+			at += "[]"
+		}
+	}
+
+	if t := schemaType(s); t != "" && t != "string" {
+		return fmt.Sprintf("%s is of type %s, not string", at, t)
+	}
+	return ""
+}
+
+// schemaType returns the type of the OpenAPI schema s, or "" if it has none.
+func schemaType(s map[string]interface{}) string {
+	t, _ := s["type"].(string)
+	return t
+}
+
+// propertyNames returns the sorted names of the properties of an OpenAPI schema.
+func propertyNames(properties map[string]interface{}) []string {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// imageFieldSchemaProblems checks the image field of the infrastructure kind of ref against the schema of its
+// CustomResourceDefinition. Kinds whose definition cannot be read, or has no schema, are only warned about, as the
+// field is still checked on an infrastructure machine.
+func (u *ControlPlaneUpgrader) imageFieldSchemaProblems(ref corev1.ObjectReference, field string) ([]string, error) {
+	path, err := parseImageField(field)
+	if err != nil {
+		return nil, err
+	}
+
+	s, crd, err := u.infrastructureSchema(ref)
+	if apierrors.IsForbidden(errors.Cause(err)) {
+		u.warnings.add(WarningInfrastructureSchema, ref.Kind, "the image field of %s could not be checked against its custom resource definition: %v", ref.Kind, err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if crd == "" {
+		u.warnings.add(WarningInfrastructureSchema, ref.Kind, "the image field of %s could not be checked: no custom resource definition defines %s in %s", ref.Kind, ref.Kind, ref.APIVersion)
+		return nil, nil
+	}
+	if s == nil {
+		u.warnings.add(WarningInfrastructureSchema, ref.Kind, "the image field of %s could not be checked: custom resource definition %s has no schema", ref.Kind, crd)
+		return nil, nil
+	}
+
+	if problem := imageFieldSchemaProblem(s, path); problem != "" {
+		return []string{fmt.Sprintf("%s image field %q is not in the schema of %s: %s", ref.Kind, field, crd, problem)}, nil
+	}
+	return nil, nil
+}
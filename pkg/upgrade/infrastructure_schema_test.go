@@ -0,0 +1,97 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+const testInfrastructureSchema = `
+type: object
+properties:
+  apiVersion:
+    type: string
+  kind:
+    type: string
+  spec:
+    type: object
+    properties:
+      ami:
+        type: object
+        properties:
+          arn:
+            type: string
+          id:
+            type: string
+      dataDisks:
+        type: array
+        items:
+          type: object
+          properties:
+            image:
+              type: string
+      tags:
+        type: object
+        additionalProperties:
+          type: string
+      providerSpec:
+        type: object
+        x-kubernetes-preserve-unknown-fields: true
+      size:
+        type: integer
+`
+
+func TestImageFieldSchemaProblem(t *testing.T) {
+	var s map[string]interface{}
+	require.NoError(t, yaml.Unmarshal([]byte(testInfrastructureSchema), &s))
+
+	tests := []struct {
+		field   string
+		problem string
+	}{
+		{field: "spec.ami.id"},
+		{field: "spec.dataDisks[*].image"},
+		{field: "spec.dataDisks[0].image"},
+		{field: "spec.tags.image"},
+		{field: "spec.providerSpec.value.image"},
+		{field: "spec.ami.idd", problem: "spec.ami has no field idd, its fields are arn, id"},
+		{field: "image", problem: "the object has no field image, its fields are apiVersion, kind, spec"},
+		{field: "spec.ami", problem: "spec.ami is of type object, not string"},
+		{field: "spec.ami[*].id", problem: "spec.ami is of type object, not array"},
+		{field: "spec.size.id", problem: "spec.size is of type integer, not object"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.field, func(t *testing.T) {
+			path, err := parseImageField(tc.field)
+			require.NoError(t, err)
+			assert.Equal(t, tc.problem, imageFieldSchemaProblem(s, path))
+		})
+	}
+}
+
+func TestCRDSchema(t *testing.T) {
+	v1 := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"versions": []interface{}{
+				map[string]interface{}{"name": "v1alpha2", "schema": map[string]interface{}{"openAPIV3Schema": map[string]interface{}{"type": "object"}}},
+				map[string]interface{}{"name": "v1alpha3", "schema": map[string]interface{}{"openAPIV3Schema": map[string]interface{}{"type": "string"}}},
+			},
+		},
+	}
+	assert.Equal(t, map[string]interface{}{"type": "object"}, crdSchema(v1, "v1alpha2"))
+	assert.Nil(t, crdSchema(v1, "v1alpha1"))
+
+	v1beta1 := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"versions":   []interface{}{map[string]interface{}{"name": "v1alpha2"}},
+			"validation": map[string]interface{}{"openAPIV3Schema": map[string]interface{}{"type": "object"}},
+		},
+	}
+	assert.Equal(t, map[string]interface{}{"type": "object"}, crdSchema(v1beta1, "v1alpha2"))
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+)
+
+// convertInitConfiguration returns join, or a new control plane JoinConfiguration if it is nil, with the settings of
+// init that also apply to joining nodes: node registration settings join does not set, kubelet extra args merged
+// under those of join, and the API server bind port. It also returns the settings of init that cannot be carried to a
+// join, as they only apply to the first node.
+func convertInitConfiguration(init *kubeadmv1beta1.InitConfiguration, join *kubeadmv1beta1.JoinConfiguration) (*kubeadmv1beta1.JoinConfiguration, []string) {
+	if join == nil {
+		join = &kubeadmv1beta1.JoinConfiguration{}
+	} else {
+		join = join.DeepCopy()
+	}
+	if join.ControlPlane == nil {
+		join.ControlPlane = &kubeadmv1beta1.JoinControlPlane{}
+	}
+	if init == nil {
+		return join, nil
+	}
+
+	registration := &join.NodeRegistration
+	if registration.Name == "" {
+		registration.Name = init.NodeRegistration.Name
+	}
+	if registration.CRISocket == "" {
+		registration.CRISocket = init.NodeRegistration.CRISocket
+	}
+	if registration.Taints == nil {
+		registration.Taints = init.NodeRegistration.Taints
+	}
+	if len(init.NodeRegistration.KubeletExtraArgs) > 0 {
+		args := make(map[string]string, len(init.NodeRegistration.KubeletExtraArgs)+len(registration.KubeletExtraArgs))
+		for k, v := range init.NodeRegistration.KubeletExtraArgs {
+			args[k] = v
+		}
+		for k, v := range registration.KubeletExtraArgs {
+			args[k] = v
+		}
+		registration.KubeletExtraArgs = args
+	}
+
+	endpoint := &join.ControlPlane.LocalAPIEndpoint
+	if endpoint.BindPort == 0 {
+		endpoint.BindPort = init.LocalAPIEndpoint.BindPort
+	}
+
+	var dropped []string
+	if init.LocalAPIEndpoint.AdvertiseAddress != "" && endpoint.AdvertiseAddress == "" {
+		dropped = append(dropped, fmt.Sprintf("the API server advertise address %s, which is the address of the first node", init.LocalAPIEndpoint.AdvertiseAddress))
+	}
+	if len(init.BootstrapTokens) > 0 {
+		dropped = append(dropped, "the bootstrap tokens, which only kubeadm init creates")
+	}
+	return join, dropped
+}
+
+// missingCertSANs returns the API server certificate SANs of clusterConfiguration that are not in the
+// ClusterConfiguration of the kubeadm-config configmap, clusterConfig. Joining control plane nodes generate their
+// certificates from the configmap, so they lack those SANs.
+func missingCertSANs(clusterConfiguration *kubeadmv1beta1.ClusterConfiguration, clusterConfig map[string]interface{}) []string {
+	if clusterConfiguration == nil || len(clusterConfiguration.APIServer.CertSANs) == 0 {
+		return nil
+	}
+
+	sans, _, _ := unstructured.NestedStringSlice(clusterConfig, "apiServer", "certSANs")
+	return sets.NewString(clusterConfiguration.APIServer.CertSANs...).Difference(sets.NewString(sans...)).List()
+}
+
+// reportInitConfigurationConversion reports, as warnings, the settings of the InitConfiguration of the KubeadmConfig
+// called name that could not be carried to its replacement, dropped, and the API server certificate SANs of its
+// clusterConfiguration joining nodes would not get.
+func (u *ControlPlaneUpgrader) reportInitConfigurationConversion(name string, clusterConfiguration *kubeadmv1beta1.ClusterConfiguration, dropped []string) error {
+	object := fmt.Sprintf("%s/%s", u.clusterNamespace, name)
+	for _, msg := range dropped {
+		u.warnings.add(WarningInitConfigurationDropped, object, "the init configuration of KubeadmConfig %s is not carried to its replacement: %s", object, msg)
+	}
+
+	cm, err := u.getKubeadmConfigMap()
+	if err != nil || cm == nil {
+		return err
+	}
+	key, clusterConfig, err := findClusterConfiguration(cm)
+	if err != nil || key == "" {
+		return err
+	}
+	if missing := missingCertSANs(clusterConfiguration, clusterConfig); len(missing) > 0 {
+		u.warnings.add(WarningInitConfigurationDropped, object, "the API server certificate SANs %s of KubeadmConfig %s are not in the %s configmap, so joining control plane nodes do not get them; add them to its apiServer.certSANs",
+			strings.Join(missing, ", "), object, kubeadmConfigMapName)
+	}
+	return nil
+}
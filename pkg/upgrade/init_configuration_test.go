@@ -0,0 +1,64 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+)
+
+func TestConvertInitConfiguration(t *testing.T) {
+	init := &kubeadmv1beta1.InitConfiguration{
+		NodeRegistration: kubeadmv1beta1.NodeRegistrationOptions{
+			Name:             "{{ ds.meta_data.hostname }}",
+			CRISocket:        "/var/run/containerd/containerd.sock",
+			Taints:           []v1.Taint{{Key: "dedicated", Value: "platform", Effect: v1.TaintEffectNoSchedule}},
+			KubeletExtraArgs: map[string]string{"cloud-provider": "aws", "node-labels": "tier=init"},
+		},
+		LocalAPIEndpoint: kubeadmv1beta1.APIEndpoint{AdvertiseAddress: "10.0.0.1", BindPort: 8443},
+		BootstrapTokens:  []kubeadmv1beta1.BootstrapToken{{}},
+	}
+
+	join, dropped := convertInitConfiguration(init, nil)
+	assert.Equal(t, init.NodeRegistration, join.NodeRegistration)
+	assert.Equal(t, kubeadmv1beta1.APIEndpoint{BindPort: 8443}, join.ControlPlane.LocalAPIEndpoint)
+	assert.Len(t, dropped, 2)
+
+	existing := &kubeadmv1beta1.JoinConfiguration{
+		NodeRegistration: kubeadmv1beta1.NodeRegistrationOptions{
+			Name:             "join-name",
+			Taints:           []v1.Taint{},
+			KubeletExtraArgs: map[string]string{"node-labels": "tier=join"},
+		},
+		ControlPlane: &kubeadmv1beta1.JoinControlPlane{LocalAPIEndpoint: kubeadmv1beta1.APIEndpoint{AdvertiseAddress: "0.0.0.0"}},
+	}
+	join, dropped = convertInitConfiguration(init, existing)
+	assert.Equal(t, "join-name", join.NodeRegistration.Name)
+	assert.Equal(t, "/var/run/containerd/containerd.sock", join.NodeRegistration.CRISocket)
+	assert.Empty(t, join.NodeRegistration.Taints)
+	assert.Equal(t, map[string]string{"cloud-provider": "aws", "node-labels": "tier=join"}, join.NodeRegistration.KubeletExtraArgs)
+	assert.Equal(t, kubeadmv1beta1.APIEndpoint{AdvertiseAddress: "0.0.0.0", BindPort: 8443}, join.ControlPlane.LocalAPIEndpoint)
+	assert.Equal(t, []string{"the bootstrap tokens, which only kubeadm init creates"}, dropped)
+	assert.Equal(t, map[string]string{"node-labels": "tier=join"}, existing.NodeRegistration.KubeletExtraArgs, "the join configuration is copied")
+
+	join, dropped = convertInitConfiguration(nil, nil)
+	assert.NotNil(t, join.ControlPlane)
+	assert.Empty(t, dropped)
+}
+
+func TestMissingCertSANs(t *testing.T) {
+	clusterConfiguration := &kubeadmv1beta1.ClusterConfiguration{
+		APIServer: kubeadmv1beta1.APIServer{CertSANs: []string{"api.example.com", "10.0.0.100"}},
+	}
+	clusterConfig := map[string]interface{}{
+		"apiServer": map[string]interface{}{"certSANs": []interface{}{"api.example.com"}},
+	}
+
+	assert.Equal(t, []string{"10.0.0.100"}, missingCertSANs(clusterConfiguration, clusterConfig))
+	assert.Equal(t, []string{"10.0.0.100", "api.example.com"}, missingCertSANs(clusterConfiguration, map[string]interface{}{}))
+	assert.Empty(t, missingCertSANs(nil, clusterConfig))
+}
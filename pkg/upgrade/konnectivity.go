@@ -0,0 +1,217 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// egressSelectorConfigFileArg is the kube-apiserver flag pointing at its egress selector configuration.
+	egressSelectorConfigFileArg = "egress-selector-config-file"
+	// konnectivityServerComponent is the konnectivity server's static pod, run beside kube-apiserver.
+	konnectivityServerComponent = "konnectivity-server"
+	// konnectivityServerManifest is the file name of the konnectivity server's static pod manifest.
+	konnectivityServerManifest = konnectivityServerComponent + ".yaml"
+	// konnectivityAgentSelector selects the konnectivity agent pods, as labelled by the upstream manifests.
+	konnectivityAgentSelector = "k8s-app=konnectivity-agent"
+	// kubernetesConfigDir is the kubeadm configuration directory, holding many unrelated files.
+	kubernetesConfigDir = "/etc/kubernetes"
+)
+
+// egressSelector is the egress selector setup of a control plane whose API servers reach the cluster through
+// konnectivity.
+type egressSelector struct {
+	configFile string
+	// files are the KubeadmConfig files needed by the egress selector on every control plane machine: its
+	// configuration, the files next to it such as the konnectivity server's kubeconfig, and the konnectivity server's
+	// static pod manifest.
+	files []bootstrapv1.File
+}
+
+// hasKonnectivityServerPod returns true if the konnectivity server runs as a static pod written by the KubeadmConfigs.
+func (e *egressSelector) hasKonnectivityServerPod() bool {
+	for _, f := range e.files {
+		if path.Base(f.Path) == konnectivityServerManifest {
+			return true
+		}
+	}
+	return false
+}
+
+// detectEgressSelector returns the egress selector setup of the control plane, or nil if kube-apiserver is not
+// configured with an egress selector. The configuration file is looked up in the kubeadm-config ConfigMap, falling back
+// to the machines' KubeadmConfigs, and its files are collected from the machines' KubeadmConfigs so that replacement
+// machines get them even if the machine they replace was not bootstrapped with them.
+func (u *ControlPlaneUpgrader) detectEgressSelector(machines []*clusterv1.Machine) (*egressSelector, error) {
+	configs, err := u.kubeadmConfigs(machines)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err := u.egressSelectorConfigFile(configs)
+	if err != nil || configFile == "" {
+		return nil, err
+	}
+
+	selector := &egressSelector{
+		configFile: configFile,
+		files:      egressSelectorFiles(configs, configFile),
+	}
+	if !hasFile(selector.files, configFile) {
+		u.warnings.add(WarningEgressSelector, configFile,
+			"kube-apiserver uses egress selector configuration %s but no control plane KubeadmConfig writes it; replacement machines must get it from their image", configFile)
+	}
+	return selector, nil
+}
+
+// egressSelectorConfigFile returns the kube-apiserver egress selector configuration file, or "" if there is none.
+func (u *ControlPlaneUpgrader) egressSelectorConfigFile(configs []*bootstrapv1.KubeadmConfig) (string, error) {
+	cm, err := u.getKubeadmConfigMap()
+	if err != nil {
+		return "", err
+	}
+	if cm != nil {
+		key, clusterConfig, err := findClusterConfiguration(cm)
+		if err != nil {
+			return "", err
+		}
+		if key != "" {
+			configFile, _, _ := unstructured.NestedString(clusterConfig, "apiServer", "extraArgs", egressSelectorConfigFileArg)
+			return configFile, nil
+		}
+	}
+
+	for _, config := range configs {
+		if config.Spec.ClusterConfiguration == nil {
+			continue
+		}
+		if configFile := config.Spec.ClusterConfiguration.APIServer.ExtraArgs[egressSelectorConfigFileArg]; configFile != "" {
+			return configFile, nil
+		}
+	}
+	return "", nil
+}
+
+// kubeadmConfigs returns the KubeadmConfigs of machines, skipping machines bootstrapped otherwise.
+func (u *ControlPlaneUpgrader) kubeadmConfigs(machines []*clusterv1.Machine) ([]*bootstrapv1.KubeadmConfig, error) {
+	var configs []*bootstrapv1.KubeadmConfig
+	for _, machine := range machines {
+		ref := machine.Spec.Bootstrap.ConfigRef
+		if ref == nil || ref.Kind != "KubeadmConfig" {
+			continue
+		}
+
+		config := &bootstrapv1.KubeadmConfig{}
+		key := ctrlclient.ObjectKey{Namespace: machine.Namespace, Name: ref.Name}
+		if err := u.managementClusterClient.Get(context.TODO(), key, config); err != nil {
+			return nil, errors.Wrapf(err, "error getting kubeadm config %s", key.String())
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// egressSelectorFiles returns the files of configs the egress selector configured by configFile needs: configFile
+// itself, the files in its directory unless that is the kubeadm configuration directory, and the konnectivity server's
+// static pod manifest. The first file found at each path is used.
+func egressSelectorFiles(configs []*bootstrapv1.KubeadmConfig, configFile string) []bootstrapv1.File {
+	dir := path.Dir(configFile)
+
+	var files []bootstrapv1.File
+	for _, config := range configs {
+		for _, f := range config.Spec.Files {
+			needed := f.Path == configFile ||
+				(dir != kubernetesConfigDir && path.Dir(f.Path) == dir) ||
+				path.Base(f.Path) == konnectivityServerManifest
+			if needed && !hasFile(files, f.Path) {
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
+
+// mergeMissingFiles returns files with each of extra whose path is not already in files.
+func mergeMissingFiles(files, extra []bootstrapv1.File) []bootstrapv1.File {
+	merged := files
+	for _, f := range extra {
+		if !hasFile(merged, f.Path) {
+			merged = append(merged, f)
+		}
+	}
+	return merged
+}
+
+func hasFile(files []bootstrapv1.File, filePath string) bool {
+	for _, f := range files {
+		if f.Path == filePath {
+			return true
+		}
+	}
+	return false
+}
+
+// addKonnectivityServerReadiness adds the konnectivity server to the readiness components if it runs as a static pod
+// and is not already listed.
+func (u *ControlPlaneUpgrader) addKonnectivityServerReadiness() {
+	if u.egressSelector == nil || !u.egressSelector.hasKonnectivityServerPod() {
+		return
+	}
+	for _, c := range u.readinessComponents {
+		if c.name == konnectivityServerComponent {
+			return
+		}
+	}
+	u.readinessComponents = append(u.readinessComponents, readinessComponent{
+		name:     konnectivityServerComponent,
+		selector: labels.SelectorFromSet(labels.Set{"component": konnectivityServerComponent}),
+	})
+}
+
+// waitForKonnectivityAgents waits until every konnectivity agent is ready, meaning it is connected to a konnectivity
+// server again after one of the servers was replaced.
+func (u *ControlPlaneUpgrader) waitForKonnectivityAgents(timeout time.Duration) error {
+	u.log.Info("Waiting for konnectivity agents to be ready")
+
+	var unready []string
+	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+		pods, err := u.targetKubernetesClient.CoreV1().Pods("kube-system").List(metav1.ListOptions{LabelSelector: konnectivityAgentSelector})
+		if err != nil {
+			u.log.Error(err, "Error listing konnectivity agents, will try again")
+			return false, nil
+		}
+
+		unready = nil
+		for i := range pods.Items {
+			if missing := missingPodConditions(&pods.Items[i]); missing.Len() > 0 {
+				unready = append(unready, fmt.Sprintf("%s (%v)", pods.Items[i].Name, missing.List()))
+			}
+		}
+		if len(pods.Items) == 0 {
+			unready = []string{"no konnectivity agent pods found"}
+		}
+		if len(unready) > 0 {
+			u.log.Info("Waiting for konnectivity agents", "unready", unready)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "timed out waiting for konnectivity agents to be ready: %v", unready)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+)
+
+func TestEgressSelectorFiles(t *testing.T) {
+	file := func(path, content string) bootstrapv1.File {
+		return bootstrapv1.File{Path: path, Content: content}
+	}
+	configs := []*bootstrapv1.KubeadmConfig{
+		{Spec: bootstrapv1.KubeadmConfigSpec{Files: []bootstrapv1.File{
+			file("/etc/kubernetes/patches/kube-apiserver0+strategic.yaml", "patch"),
+		}}},
+		{Spec: bootstrapv1.KubeadmConfigSpec{Files: []bootstrapv1.File{
+			file("/etc/kubernetes/konnectivity/egress-selector-configuration.yaml", "egress"),
+			file("/etc/kubernetes/konnectivity/konnectivity-server.conf", "kubeconfig"),
+			file("/etc/kubernetes/manifests/konnectivity-server.yaml", "server"),
+			file("/etc/kubernetes/audit-policy.yaml", "audit"),
+		}}},
+		{Spec: bootstrapv1.KubeadmConfigSpec{Files: []bootstrapv1.File{
+			file("/etc/kubernetes/konnectivity/egress-selector-configuration.yaml", "other"),
+		}}},
+	}
+
+	files := egressSelectorFiles(configs, "/etc/kubernetes/konnectivity/egress-selector-configuration.yaml")
+	assert.Equal(t, []bootstrapv1.File{
+		file("/etc/kubernetes/konnectivity/egress-selector-configuration.yaml", "egress"),
+		file("/etc/kubernetes/konnectivity/konnectivity-server.conf", "kubeconfig"),
+		file("/etc/kubernetes/manifests/konnectivity-server.yaml", "server"),
+	}, files)
+	assert.True(t, (&egressSelector{files: files}).hasKonnectivityServerPod())
+
+	// Files next to a configuration in the kubeadm directory are unrelated
+	files = egressSelectorFiles(configs, "/etc/kubernetes/egress-selector-configuration.yaml")
+	assert.Equal(t, []bootstrapv1.File{file("/etc/kubernetes/manifests/konnectivity-server.yaml", "server")}, files)
+}
+
+func TestMergeMissingFiles(t *testing.T) {
+	files := []bootstrapv1.File{{Path: "/a", Content: "original"}}
+	extra := []bootstrapv1.File{{Path: "/a", Content: "extra"}, {Path: "/b", Content: "extra"}}
+
+	assert.Equal(t, []bootstrapv1.File{{Path: "/a", Content: "original"}, {Path: "/b", Content: "extra"}}, mergeMissingFiles(files, extra))
+}
+
+func TestAddKonnectivityServerReadiness(t *testing.T) {
+	components, err := parseReadinessComponents(nil)
+	assert.NoError(t, err)
+
+	u := &ControlPlaneUpgrader{
+		readinessComponents: components,
+		egressSelector:      &egressSelector{files: []bootstrapv1.File{{Path: "/etc/kubernetes/manifests/konnectivity-server.yaml"}}},
+	}
+	u.addKonnectivityServerReadiness()
+	u.addKonnectivityServerReadiness()
+
+	assert.Len(t, u.readinessComponents, len(defaultReadinessComponents)+1)
+	last := u.readinessComponents[len(u.readinessComponents)-1]
+	assert.Equal(t, konnectivityServerComponent, last.name)
+	assert.Equal(t, "component=konnectivity-server", last.selector.String())
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	kubeadmConfigMapName    = "kubeadm-config"
+	clusterConfigurationKey = "ClusterConfiguration"
+	clusterStatusKey        = "ClusterStatus"
+	kubeadmAPIVersion       = "kubeadm.k8s.io/v1beta1"
+
+	// defaultAPIServerBindPort is the port kubeadm binds the API server to when the KubeadmConfig does not set one.
+	defaultAPIServerBindPort = 6443
+)
+
+// Values for Config.MissingKubeadmConfigMap.
+const (
+	// KubeadmConfigMapFail refuses to upgrade when the kubeadm-config ConfigMap or its ClusterConfiguration is missing.
+	KubeadmConfigMapFail = "fail"
+	// KubeadmConfigMapReconstruct rebuilds the kubeadm-config ConfigMap from a control plane KubeadmConfig.
+	KubeadmConfigMapReconstruct = "reconstruct"
+	// KubeadmConfigMapSkip leaves the kubeadm-config ConfigMap alone. It is refused for minor version upgrades.
+	KubeadmConfigMapSkip = "skip"
+)
+
+// parseMissingKubeadmConfigMap validates policy, defaulting it to KubeadmConfigMapFail.
+func parseMissingKubeadmConfigMap(policy string) (string, error) {
+	switch policy {
+	case "":
+		return KubeadmConfigMapFail, nil
+	case KubeadmConfigMapFail, KubeadmConfigMapReconstruct, KubeadmConfigMapSkip:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid missing kubeadm configmap policy %q: must be one of %s, %s, %s", policy, KubeadmConfigMapFail, KubeadmConfigMapReconstruct, KubeadmConfigMapSkip)
+	}
+}
+
+// findClusterConfiguration returns the data key of cm holding the kubeadm ClusterConfiguration and its decoded content.
+// The ClusterConfiguration key is preferred; otherwise any key whose document is of kind ClusterConfiguration is
+// used. The returned key is empty if there is no ClusterConfiguration.
+func findClusterConfiguration(cm *v1.ConfigMap) (string, map[string]interface{}, error) {
+	if data, ok := cm.Data[clusterConfigurationKey]; ok {
+		clusterConfig := make(map[string]interface{})
+		if err := yaml.Unmarshal([]byte(data), &clusterConfig); err != nil {
+			return "", nil, errors.Wrapf(err, "error decoding kubeadm configmap %s", clusterConfigurationKey)
+		}
+		return clusterConfigurationKey, clusterConfig, nil
+	}
+
+	var keys []string
+	for key := range cm.Data {
+		if key != clusterStatusKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		clusterConfig := make(map[string]interface{})
+		if err := yaml.Unmarshal([]byte(cm.Data[key]), &clusterConfig); err != nil {
+			continue
+		}
+		if kind, _ := clusterConfig["kind"].(string); kind == "ClusterConfiguration" {
+			return key, clusterConfig, nil
+		}
+	}
+
+	return "", nil, nil
+}
+
+// getKubeadmConfigMap returns the target cluster's kubeadm-config ConfigMap, or nil if it does not exist.
+func (u *ControlPlaneUpgrader) getKubeadmConfigMap() (*v1.ConfigMap, error) {
+	cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(kubeadmConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting kubeadm configmap from target cluster")
+	}
+	return cm, nil
+}
+
+// kubeadmConfigMapProblems returns the reasons the kubeadm-config ConfigMap cannot be updated to desired using the
+// missing kubeadm configmap policy. min is the oldest version of the current control plane machines.
+func (u *ControlPlaneUpgrader) kubeadmConfigMapProblems(machines []*clusterv1.Machine, min, desired semver.Version) ([]string, error) {
+	cm, err := u.getKubeadmConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	if cm != nil {
+		key, _, err := findClusterConfiguration(cm)
+		if err != nil {
+			return nil, err
+		}
+		if key != "" {
+			return nil, nil
+		}
+	}
+
+	switch u.missingKubeadmConfigMap {
+	case KubeadmConfigMapSkip:
+		// New control plane machines join using the kubernetesVersion recorded in the ConfigMap, so leaving it at the
+		// old version is only safe when the minor version does not change.
+		if isMinorVersionUpgrade(min, desired) {
+			return []string{fmt.Sprintf("configmap %s cannot be skipped for a minor version upgrade from %s to %s", kubeadmConfigMapName, min, desired)}, nil
+		}
+		return nil, nil
+	case KubeadmConfigMapReconstruct:
+		if _, err := u.clusterConfigurationSource(machines); err != nil {
+			return []string{err.Error()}, nil
+		}
+		return nil, nil
+	default:
+		return []string{fmt.Sprintf("configmap %s is missing or has no ClusterConfiguration; use the %s or %s policy to continue without it", kubeadmConfigMapName, KubeadmConfigMapReconstruct, KubeadmConfigMapSkip)}, nil
+	}
+}
+
+// clusterConfigurationSource returns the KubeadmConfig of the first of machines that has a ClusterConfiguration.
+func (u *ControlPlaneUpgrader) clusterConfigurationSource(machines []*clusterv1.Machine) (*bootstrapv1.KubeadmConfig, error) {
+	for _, machine := range machines {
+		ref := machine.Spec.Bootstrap.ConfigRef
+		if ref == nil || ref.Kind != "KubeadmConfig" {
+			continue
+		}
+
+		config := &bootstrapv1.KubeadmConfig{}
+		key := ctrlclient.ObjectKey{Namespace: machine.Namespace, Name: ref.Name}
+		if err := u.managementClusterClient.Get(context.TODO(), key, config); err != nil {
+			return nil, errors.Wrapf(err, "error getting kubeadm config %s", key.String())
+		}
+		if config.Spec.ClusterConfiguration != nil {
+			return config, nil
+		}
+	}
+
+	return nil, errors.New("no control plane machine has a KubeadmConfig with a ClusterConfiguration to reconstruct the kubeadm configmap from")
+}
+
+// reconstructKubeadmConfigMap creates or fills in the kubeadm-config ConfigMap from a control plane KubeadmConfig and
+// the target cluster's control plane nodes. original is nil if the ConfigMap does not exist.
+func (u *ControlPlaneUpgrader) reconstructKubeadmConfigMap(original *v1.ConfigMap, machines []*clusterv1.Machine, version string) error {
+	config, err := u.clusterConfigurationSource(machines)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := listControlPlaneNodes(u.targetKubernetesClient)
+	if err != nil {
+		return err
+	}
+
+	cm, err := buildKubeadmConfigMap(original, config, nodes, version)
+	if err != nil {
+		return err
+	}
+	if cm, err = addAPIServerCertSANs(cm, u.apiServerCertSANs); err != nil {
+		return err
+	}
+
+	u.log.Info("Reconstructing kubeadm configmap", "kubeadm-config", config.Name)
+	if original == nil {
+		_, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Create(cm)
+	} else {
+		_, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Update(cm)
+	}
+	return errors.Wrap(err, "error writing reconstructed kubeadm configmap")
+}
+
+// buildKubeadmConfigMap returns original, or a new kubeadm-config ConfigMap if it is nil, with a ClusterConfiguration
+// from config at version. A ClusterStatus listing the API endpoints of nodes is added if original has none.
+func buildKubeadmConfigMap(original *v1.ConfigMap, config *bootstrapv1.KubeadmConfig, nodes []v1.Node, version string) (*v1.ConfigMap, error) {
+	var cm *v1.ConfigMap
+	if original == nil {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "kube-system",
+				Name:      kubeadmConfigMapName,
+			},
+		}
+	} else {
+		cm = original.DeepCopy()
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+
+	clusterConfig := config.Spec.ClusterConfiguration.DeepCopy()
+	clusterConfig.APIVersion = kubeadmAPIVersion
+	clusterConfig.Kind = "ClusterConfiguration"
+	clusterConfig.KubernetesVersion = version
+
+	data, err := yaml.Marshal(clusterConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding kubeadm configmap ClusterConfiguration")
+	}
+	cm.Data[clusterConfigurationKey] = string(data)
+
+	if _, ok := cm.Data[clusterStatusKey]; ok {
+		return cm, nil
+	}
+
+	clusterStatus := kubeadmv1beta1.ClusterStatus{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: kubeadmAPIVersion,
+			Kind:       "ClusterStatus",
+		},
+		APIEndpoints: make(map[string]kubeadmv1beta1.APIEndpoint),
+	}
+	bindPort := apiServerBindPort(config)
+	for _, node := range nodes {
+		for _, address := range node.Status.Addresses {
+			if address.Type == v1.NodeInternalIP {
+				clusterStatus.APIEndpoints[node.Name] = kubeadmv1beta1.APIEndpoint{
+					AdvertiseAddress: address.Address,
+					BindPort:         bindPort,
+				}
+				break
+			}
+		}
+	}
+
+	data, err = yaml.Marshal(clusterStatus)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding kubeadm configmap ClusterStatus")
+	}
+	cm.Data[clusterStatusKey] = string(data)
+
+	return cm, nil
+}
+
+// apiServerBindPort returns the API server bind port configured in config, or the kubeadm default.
+func apiServerBindPort(config *bootstrapv1.KubeadmConfig) int32 {
+	if config.Spec.InitConfiguration != nil && config.Spec.InitConfiguration.LocalAPIEndpoint.BindPort != 0 {
+		return config.Spec.InitConfiguration.LocalAPIEndpoint.BindPort
+	}
+	if config.Spec.JoinConfiguration != nil && config.Spec.JoinConfiguration.ControlPlane != nil &&
+		config.Spec.JoinConfiguration.ControlPlane.LocalAPIEndpoint.BindPort != 0 {
+		return config.Spec.JoinConfiguration.ControlPlane.LocalAPIEndpoint.BindPort
+	}
+	return defaultAPIServerBindPort
+}
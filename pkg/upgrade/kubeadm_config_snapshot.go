@@ -0,0 +1,205 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationKubeadmConfigSnapshot is the annotation of the kubeadm-config ConfigMap holding its ClusterConfiguration
+	// as it was before an upgrade updated its Kubernetes version.
+	AnnotationKubeadmConfigSnapshot = annotationPrefix + "kubeadm-config-snapshot"
+	// AnnotationKubeadmConfigSnapshotID is the ID of the upgrade that took the snapshot.
+	AnnotationKubeadmConfigSnapshotID = annotationPrefix + "kubeadm-config-snapshot-id"
+)
+
+// snapshotClusterConfiguration records, in the annotations of updated, the ClusterConfiguration of original before
+// the upgrade upgradeID updates it. A snapshot the upgrade already took, before it was resumed, is kept, as original
+// is then already updated.
+func snapshotClusterConfiguration(original, updated *v1.ConfigMap, upgradeID string) error {
+	if original.Annotations[AnnotationKubeadmConfigSnapshotID] == upgradeID {
+		if _, ok := original.Annotations[AnnotationKubeadmConfigSnapshot]; ok {
+			return nil
+		}
+	}
+	key, _, err := findClusterConfiguration(original)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return errNoClusterConfiguration
+	}
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[AnnotationKubeadmConfigSnapshot] = original.Data[key]
+	updated.Annotations[AnnotationKubeadmConfigSnapshotID] = upgradeID
+	return nil
+}
+
+// restoreClusterConfiguration returns a copy of cm with the ClusterConfiguration of its snapshot, and without the
+// snapshot. Only the ClusterConfiguration is restored: the ClusterStatus lists the API endpoints of the nodes that
+// joined since.
+func restoreClusterConfiguration(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	snapshot, ok := cm.Annotations[AnnotationKubeadmConfigSnapshot]
+	if !ok {
+		return nil, errors.Errorf("configmap %s has no snapshot", kubeadmConfigMapName)
+	}
+	key, _, err := findClusterConfiguration(cm)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		key = clusterConfigurationKey
+	}
+
+	restored := cm.DeepCopy()
+	if restored.Data == nil {
+		restored.Data = map[string]string{}
+	}
+	restored.Data[key] = snapshot
+	delete(restored.Annotations, AnnotationKubeadmConfigSnapshot)
+	delete(restored.Annotations, AnnotationKubeadmConfigSnapshotID)
+	return restored, nil
+}
+
+// advertisedKubernetesVersion returns the Kubernetes version of the ClusterConfiguration of cm.
+func advertisedKubernetesVersion(cm *v1.ConfigMap) (semver.Version, error) {
+	key, clusterConfig, err := findClusterConfiguration(cm)
+	if err != nil {
+		return semver.Version{}, err
+	}
+	if key == "" {
+		return semver.Version{}, errNoClusterConfiguration
+	}
+	version, _ := clusterConfig["kubernetesVersion"].(string)
+	v, err := semver.ParseTolerant(version)
+	if err != nil {
+		return semver.Version{}, errors.Wrapf(err, "invalid kubernetesVersion %q in configmap %s", version, kubeadmConfigMapName)
+	}
+	return v, nil
+}
+
+// nodesAtVersion returns the names of nodes whose kubelet runs version.
+func nodesAtVersion(nodes []v1.Node, version semver.Version) []string {
+	var ret []string
+	for _, node := range nodes {
+		v, err := semver.ParseTolerant(node.Status.NodeInfo.KubeletVersion)
+		if err == nil && v.Equals(version) {
+			ret = append(ret, node.Name)
+		}
+	}
+	return ret
+}
+
+// advertisedVersionRunning is returned when the kubeadm configmap is not restored, as control plane nodes run the
+// version it advertises.
+type advertisedVersionRunning struct {
+	version semver.Version
+	nodes   []string
+}
+
+func (e *advertisedVersionRunning) Error() string {
+	return fmt.Sprintf("control plane nodes %s run kubernetes %s, which configmap %s advertises", strings.Join(e.nodes, ", "), e.version, kubeadmConfigMapName)
+}
+
+// restoreKubeadmConfigMap restores the ClusterConfiguration of the snapshot of the kubeadm configmap, taken by the
+// upgrade upgradeID or by any upgrade if upgradeID is empty, unless a control plane node runs the version it
+// advertises, as nodes joining the control plane then need it. It returns false if there was nothing to restore.
+func (u *ControlPlaneUpgrader) restoreKubeadmConfigMap(upgradeID string) (bool, error) {
+	cm, err := u.getKubeadmConfigMap()
+	if err != nil || cm == nil {
+		return false, err
+	}
+	if _, ok := cm.Annotations[AnnotationKubeadmConfigSnapshot]; !ok {
+		return false, nil
+	}
+	if upgradeID != "" && cm.Annotations[AnnotationKubeadmConfigSnapshotID] != upgradeID {
+		return false, nil
+	}
+
+	advertised, err := advertisedKubernetesVersion(cm)
+	if err != nil {
+		return false, err
+	}
+	nodes, err := listControlPlaneNodes(u.targetKubernetesClient)
+	if err != nil {
+		return false, err
+	}
+	if names := nodesAtVersion(nodes, advertised); len(names) > 0 {
+		return false, errors.WithStack(&advertisedVersionRunning{version: advertised, nodes: names})
+	}
+
+	restored, err := restoreClusterConfiguration(cm)
+	if err != nil {
+		return false, err
+	}
+	if _, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Update(restored); err != nil {
+		return false, errors.Wrap(err, "error restoring kubeadm configmap")
+	}
+	return true, nil
+}
+
+// revertKubeadmConfigMap restores the kubeadm configmap updated by the upgrade once it failed, so that it does not
+// advertise a version no node runs. A configmap that cannot be restored is reported as a warning.
+func (u *ControlPlaneUpgrader) revertKubeadmConfigMap() {
+	if kubernetes2.ReadOnly() {
+		return
+	}
+	restored, err := u.restoreKubeadmConfigMap(u.upgradeID)
+	if running, ok := errors.Cause(err).(*advertisedVersionRunning); ok {
+		u.log.Info("Keeping the kubeadm configuration, control plane nodes run its version", "nodes", running.nodes)
+		return
+	}
+	if err != nil {
+		u.warnings.add(WarningKubeadmConfigMapNotReverted, kubeadmConfigMapName, "kubeadm configmap was not reverted to its version before the upgrade: %v", err)
+		return
+	}
+	if restored {
+		u.record.event("Reverted the kubeadm configuration to its version before the upgrade")
+	}
+}
+
+// KubeadmConfigRestorer restores the kubeadm-config ConfigMap of a target cluster to its snapshot, taken before an
+// upgrade updated its Kubernetes version, once the upgrade is abandoned.
+type KubeadmConfigRestorer struct {
+	log      logr.Logger
+	upgrader *ControlPlaneUpgrader
+}
+
+// NewKubeadmConfigRestorer returns a KubeadmConfigRestorer for the target cluster in config. The snapshot of any
+// upgrade is restored, unless config has an upgrade ID.
+func NewKubeadmConfigRestorer(log logr.Logger, config Config) (*KubeadmConfigRestorer, error) {
+	config.KubernetesVersion = ""
+	config.VersionManifest = ""
+	upgradeID := config.UpgradeID
+	upgrader, err := newControlPlaneUpgrader(log, config)
+	if err != nil {
+		return nil, err
+	}
+	upgrader.upgradeID = upgradeID
+	return &KubeadmConfigRestorer{log: log, upgrader: upgrader}, nil
+}
+
+// Restore restores the ClusterConfiguration of the kubeadm-config ConfigMap to its snapshot. It refuses to while a
+// control plane node runs the version the ConfigMap advertises.
+func (r *KubeadmConfigRestorer) Restore() error {
+	restored, err := r.upgrader.restoreKubeadmConfigMap(r.upgrader.upgradeID)
+	if err != nil {
+		return err
+	}
+	if !restored {
+		return errors.Errorf("configmap %s has no snapshot to restore", kubeadmConfigMapName)
+	}
+	r.log.Info("Restored the kubeadm configuration to its snapshot")
+	return nil
+}
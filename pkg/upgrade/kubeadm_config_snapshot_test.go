@@ -0,0 +1,80 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const snapshotClusterConfigurationYAML = `apiVersion: kubeadm.k8s.io/v1beta1
+kind: ClusterConfiguration
+kubernetesVersion: v1.15.5
+`
+
+func testKubeadmConfigMap() *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: kubeadmConfigMapName},
+		Data: map[string]string{
+			clusterConfigurationKey: snapshotClusterConfigurationYAML,
+			clusterStatusKey:        "apiEndpoints: {}\n",
+		},
+	}
+}
+
+func TestSnapshotAndRestoreClusterConfiguration(t *testing.T) {
+	original := testKubeadmConfigMap()
+	updated, err := updateKubeadmKubernetesVersion(original, "v1.16.3")
+	require.NoError(t, err)
+	require.NoError(t, snapshotClusterConfiguration(original, updated, "123"))
+	assert.Equal(t, snapshotClusterConfigurationYAML, updated.Annotations[AnnotationKubeadmConfigSnapshot])
+	assert.Equal(t, "123", updated.Annotations[AnnotationKubeadmConfigSnapshotID])
+	assert.Empty(t, original.Annotations, "the original configmap was changed")
+
+	version, err := advertisedKubernetesVersion(updated)
+	require.NoError(t, err)
+	assert.Equal(t, "1.16.3", version.String())
+
+	// a resumed upgrade keeps the snapshot of the configmap before it was first updated
+	resumed, err := updateKubeadmKubernetesVersion(updated, "v1.16.3")
+	require.NoError(t, err)
+	require.NoError(t, snapshotClusterConfiguration(updated, resumed, "123"))
+	assert.Equal(t, snapshotClusterConfigurationYAML, resumed.Annotations[AnnotationKubeadmConfigSnapshot])
+
+	// another upgrade takes its own snapshot
+	next, err := updateKubeadmKubernetesVersion(updated, "v1.17.0")
+	require.NoError(t, err)
+	require.NoError(t, snapshotClusterConfiguration(updated, next, "456"))
+	assert.Equal(t, updated.Data[clusterConfigurationKey], next.Annotations[AnnotationKubeadmConfigSnapshot])
+	assert.Equal(t, "456", next.Annotations[AnnotationKubeadmConfigSnapshotID])
+
+	// nodes joined since the snapshot are kept in the ClusterStatus
+	updated.Data[clusterStatusKey] = "apiEndpoints: {cp-1: {}}\n"
+	restored, err := restoreClusterConfiguration(updated)
+	require.NoError(t, err)
+	assert.Equal(t, snapshotClusterConfigurationYAML, restored.Data[clusterConfigurationKey])
+	assert.Equal(t, "apiEndpoints: {cp-1: {}}\n", restored.Data[clusterStatusKey])
+	assert.NotContains(t, restored.Annotations, AnnotationKubeadmConfigSnapshot)
+	assert.NotContains(t, restored.Annotations, AnnotationKubeadmConfigSnapshotID)
+
+	_, err = restoreClusterConfiguration(original)
+	assert.Error(t, err)
+}
+
+func TestNodesAtVersion(t *testing.T) {
+	node := func(name, version string) v1.Node {
+		return v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     v1.NodeStatus{NodeInfo: v1.NodeSystemInfo{KubeletVersion: version}},
+		}
+	}
+	nodes := []v1.Node{node("cp-0", "v1.15.5"), node("cp-1", "v1.16.3"), node("cp-2", "unknown")}
+	assert.Equal(t, []string{"cp-1"}, nodesAtVersion(nodes, semver.MustParse("1.16.3")))
+	assert.Empty(t, nodesAtVersion(nodes, semver.MustParse("1.17.0")))
+}
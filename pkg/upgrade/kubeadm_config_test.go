@@ -0,0 +1,117 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestFindClusterConfiguration(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		expectedKey string
+	}{
+		{
+			name: "well-known key",
+			data: map[string]string{
+				"ClusterConfiguration": "kind: ClusterConfiguration\nkubernetesVersion: v1.15.3\n",
+				"ClusterStatus":        "kind: ClusterStatus\n",
+			},
+			expectedKey: "ClusterConfiguration",
+		},
+		{
+			name: "other key",
+			data: map[string]string{
+				"ClusterStatus":       "kind: ClusterStatus\n",
+				"MasterConfiguration": "kind: ClusterConfiguration\nkubernetesVersion: v1.15.3\n",
+			},
+			expectedKey: "MasterConfiguration",
+		},
+		{
+			name: "missing",
+			data: map[string]string{"ClusterStatus": "kind: ClusterStatus\n"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, clusterConfig, err := findClusterConfiguration(&v1.ConfigMap{Data: tc.data})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedKey, key)
+			if tc.expectedKey != "" {
+				assert.Equal(t, "v1.15.3", clusterConfig["kubernetesVersion"])
+			}
+		})
+	}
+}
+
+func TestBuildKubeadmConfigMap(t *testing.T) {
+	config := &bootstrapv1.KubeadmConfig{
+		Spec: bootstrapv1.KubeadmConfigSpec{
+			ClusterConfiguration: &kubeadmv1beta1.ClusterConfiguration{
+				ClusterName:       "test1",
+				KubernetesVersion: "v1.15.3",
+			},
+			InitConfiguration: &kubeadmv1beta1.InitConfiguration{
+				LocalAPIEndpoint: kubeadmv1beta1.APIEndpoint{BindPort: 443},
+			},
+		},
+	}
+	nodes := []v1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+			Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: "node-a"},
+				{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+			}},
+		},
+	}
+
+	cm, err := buildKubeadmConfigMap(nil, config, nodes, "v1.15.4")
+	require.NoError(t, err)
+	assert.Equal(t, "kube-system", cm.Namespace)
+	assert.Equal(t, "kubeadm-config", cm.Name)
+
+	clusterConfig := kubeadmv1beta1.ClusterConfiguration{}
+	require.NoError(t, yaml.Unmarshal([]byte(cm.Data["ClusterConfiguration"]), &clusterConfig))
+	assert.Equal(t, "ClusterConfiguration", clusterConfig.Kind)
+	assert.Equal(t, "test1", clusterConfig.ClusterName)
+	assert.Equal(t, "v1.15.4", clusterConfig.KubernetesVersion)
+	assert.Equal(t, "v1.15.3", config.Spec.ClusterConfiguration.KubernetesVersion, "config must not be modified")
+
+	clusterStatus := kubeadmv1beta1.ClusterStatus{}
+	require.NoError(t, yaml.Unmarshal([]byte(cm.Data["ClusterStatus"]), &clusterStatus))
+	assert.Equal(t, map[string]kubeadmv1beta1.APIEndpoint{
+		"node-a": {AdvertiseAddress: "10.0.0.1", BindPort: 443},
+	}, clusterStatus.APIEndpoints)
+
+	// An existing ClusterStatus is kept.
+	original := &v1.ConfigMap{Data: map[string]string{"ClusterStatus": "existing"}}
+	cm, err = buildKubeadmConfigMap(original, config, nodes, "v1.15.4")
+	require.NoError(t, err)
+	assert.Equal(t, "existing", cm.Data["ClusterStatus"])
+	assert.Empty(t, original.Data["ClusterConfiguration"], "original must not be modified")
+}
+
+func TestParseMissingKubeadmConfigMap(t *testing.T) {
+	policy, err := parseMissingKubeadmConfigMap("")
+	require.NoError(t, err)
+	assert.Equal(t, KubeadmConfigMapFail, policy)
+
+	policy, err = parseMissingKubeadmConfigMap(KubeadmConfigMapSkip)
+	require.NoError(t, err)
+	assert.Equal(t, KubeadmConfigMapSkip, policy)
+
+	_, err = parseMissingKubeadmConfigMap("ignore")
+	assert.Error(t, err)
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+)
+
+// defaultKubeadmPatchesDirectory is where kubeadm patches are written on replacement machines if no directory is
+// configured.
+const defaultKubeadmPatchesDirectory = "/etc/kubernetes/patches"
+
+// loadKubeadmPatches returns config with the patches from its source directory added to its files. Files already
+// present in config take precedence.
+func loadKubeadmPatches(config KubeadmPatchesConfig) (KubeadmPatchesConfig, error) {
+	if config.Directory == "" {
+		config.Directory = defaultKubeadmPatchesDirectory
+	}
+	if config.SourceDirectory == "" {
+		return config, nil
+	}
+
+	entries, err := ioutil.ReadDir(config.SourceDirectory)
+	if err != nil {
+		return config, errors.Wrapf(err, "error reading kubeadm patches directory %s", config.SourceDirectory)
+	}
+
+	files := make(map[string]string, len(entries)+len(config.Files))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(config.SourceDirectory, entry.Name()))
+		if err != nil {
+			return config, errors.Wrapf(err, "error reading kubeadm patch %s", entry.Name())
+		}
+		files[entry.Name()] = string(content)
+	}
+	for name, content := range config.Files {
+		files[name] = content
+	}
+	config.Files = files
+
+	return config, nil
+}
+
+// mergeKubeadmPatchFiles returns files with a file for each patch in config, replacing any file at the same path.
+func mergeKubeadmPatchFiles(files []bootstrapv1.File, config KubeadmPatchesConfig) []bootstrapv1.File {
+	if len(config.Files) == 0 {
+		return files
+	}
+
+	patches := make(map[string]string, len(config.Files))
+	for name, content := range config.Files {
+		patches[path.Join(config.Directory, name)] = content
+	}
+
+	var merged []bootstrapv1.File
+	for _, f := range files {
+		if _, ok := patches[f.Path]; !ok {
+			merged = append(merged, f)
+		}
+	}
+
+	var paths []string
+	for p := range patches {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		merged = append(merged, bootstrapv1.File{
+			Path:        p,
+			Owner:       "root:root",
+			Permissions: "0600",
+			Content:     patches[p],
+		})
+	}
+
+	return merged
+}
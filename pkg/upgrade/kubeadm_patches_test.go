@@ -0,0 +1,59 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+)
+
+func TestLoadKubeadmPatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeadm-patches")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "etcd.yaml"), []byte("from-dir"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kube-apiserver.yaml"), []byte("from-dir"), 0600))
+
+	config, err := loadKubeadmPatches(KubeadmPatchesConfig{
+		SourceDirectory: dir,
+		Files:           map[string]string{"kube-apiserver.yaml": "from-config"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, defaultKubeadmPatchesDirectory, config.Directory)
+	assert.Equal(t, map[string]string{
+		"etcd.yaml":           "from-dir",
+		"kube-apiserver.yaml": "from-config",
+	}, config.Files)
+}
+
+func TestMergeKubeadmPatchFiles(t *testing.T) {
+	files := []bootstrapv1.File{
+		{Path: "/etc/other", Content: "other"},
+		{Path: "/etc/kubernetes/patches/etcd.yaml", Content: "old"},
+	}
+
+	merged := mergeKubeadmPatchFiles(files, KubeadmPatchesConfig{
+		Directory: "/etc/kubernetes/patches",
+		Files: map[string]string{
+			"kube-apiserver.yaml": "apiserver",
+			"etcd.yaml":           "new",
+		},
+	})
+
+	assert.Equal(t, []bootstrapv1.File{
+		{Path: "/etc/other", Content: "other"},
+		{Path: "/etc/kubernetes/patches/etcd.yaml", Owner: "root:root", Permissions: "0600", Content: "new"},
+		{Path: "/etc/kubernetes/patches/kube-apiserver.yaml", Owner: "root:root", Permissions: "0600", Content: "apiserver"},
+	}, merged)
+
+	assert.Equal(t, files, mergeKubeadmPatchFiles(files, KubeadmPatchesConfig{}))
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// apply makes the requests of config as the impersonated user and groups, if any.
+func (i ImpersonationConfig) apply(config *rest.Config) {
+	if i.User == "" {
+		return
+	}
+	config.Impersonate = rest.ImpersonationConfig{UserName: i.User, Groups: i.Groups}
+}
+
+// impersonationProblems validates i: groups can only be impersonated along with a user.
+func impersonationProblems(i ImpersonationConfig) []string {
+	var problems []string
+	if i.User == "" && len(i.Groups) > 0 {
+		problems = append(problems, "impersonated groups require an impersonated user")
+	}
+	for _, group := range i.Groups {
+		if group == "" {
+			problems = append(problems, "impersonated groups must not be empty")
+			break
+		}
+	}
+	return problems
+}
+
+// kubeconfigContextProblems checks that the kubeconfig at path loads and has context, or a current context if context
+// is empty.
+func kubeconfigContextProblems(path, context string) []string {
+	contexts, current, err := kubernetes2.Contexts(kubernetes2.KubeConfigPath(path))
+	if err != nil {
+		return []string{fmt.Sprintf("kubeconfig %s: %v", path, err)}
+	}
+	if context == "" {
+		if current == "" {
+			return []string{fmt.Sprintf("kubeconfig %s has no current context, set one", path)}
+		}
+		return nil
+	}
+	for _, c := range contexts {
+		if c == context {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("kubeconfig %s has no context %q", path, context)}
+}
+
+// newManagementRestConfig loads the rest config of the management cluster of config, with its impersonation.
+func newManagementRestConfig(config ManagementClusterConfig) (*rest.Config, error) {
+	restConfig, err := kubernetes2.NewRestConfig(
+		kubernetes2.KubeConfigPath(config.Kubeconfig),
+		kubernetes2.KubeConfigContext(config.Context),
+	)
+	if err != nil {
+		return nil, err
+	}
+	config.Impersonate.apply(restConfig)
+	return restConfig, nil
+}
+
+// newTargetRestConfig returns the rest config of the context of kubeconfig kc given by source, defaulting to its
+// current context, with the impersonation of source.
+func newTargetRestConfig(kc []byte, source KubeconfigSourceConfig) (*rest.Config, error) {
+	raw, err := clientcmd.Load(kc)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading the target cluster kubeconfig")
+	}
+	restConfig, err := clientcmd.NewNonInteractiveClientConfig(*raw, source.Context, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading the target cluster kubeconfig")
+	}
+	source.Impersonate.apply(restConfig)
+	return restConfig, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com:6443
+- name: prod
+  cluster:
+    server: https://prod.example.com:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: admin
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+current-context: dev
+`
+
+func TestImpersonationProblems(t *testing.T) {
+	assert.Empty(t, impersonationProblems(ImpersonationConfig{}))
+	assert.Empty(t, impersonationProblems(ImpersonationConfig{User: "auditor", Groups: []string{"auditors"}}))
+	assert.Equal(t, []string{"impersonated groups require an impersonated user"}, impersonationProblems(ImpersonationConfig{Groups: []string{"auditors"}}))
+	assert.Equal(t, []string{"impersonated groups must not be empty"}, impersonationProblems(ImpersonationConfig{User: "auditor", Groups: []string{""}}))
+}
+
+func TestKubeconfigContextProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kubeconfig")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testKubeconfig), 0600))
+
+	assert.Empty(t, kubeconfigContextProblems(path, ""))
+	assert.Empty(t, kubeconfigContextProblems(path, "prod"))
+	assert.Equal(t, []string{`kubeconfig ` + path + ` has no context "staging"`}, kubeconfigContextProblems(path, "staging"))
+	assert.Len(t, kubeconfigContextProblems(filepath.Join(dir, "missing"), "prod"), 1)
+}
+
+func TestNewTargetRestConfig(t *testing.T) {
+	config, err := newTargetRestConfig([]byte(testKubeconfig), KubeconfigSourceConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://dev.example.com:6443", config.Host)
+	assert.Empty(t, config.Impersonate.UserName)
+
+	config, err = newTargetRestConfig([]byte(testKubeconfig), KubeconfigSourceConfig{
+		Context:     "prod",
+		Impersonate: ImpersonationConfig{User: "auditor", Groups: []string{"auditors"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "https://prod.example.com:6443", config.Host)
+	assert.Equal(t, "auditor", config.Impersonate.UserName)
+	assert.Equal(t, []string{"auditors"}, config.Impersonate.Groups)
+
+	_, err = newTargetRestConfig([]byte(testKubeconfig), KubeconfigSourceConfig{Context: "staging"})
+	assert.Error(t, err)
+}
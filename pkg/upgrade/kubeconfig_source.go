@@ -0,0 +1,183 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/util/kubeconfig"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultVaultKubeconfigField is the field of a Vault secret holding the kubeconfig when none is configured.
+const defaultVaultKubeconfigField = "kubeconfig"
+
+// kubeconfigSource reads the kubeconfig of a target cluster.
+type kubeconfigSource interface {
+	kubeconfig() ([]byte, error)
+}
+
+// newKubeconfigSource returns the source configured in config, defaulting to the Cluster API kubeconfig secret of
+// cluster. At most one source can be configured.
+func newKubeconfigSource(config KubeconfigSourceConfig, c ctrlclient.Client, cluster *clusterv1.Cluster) (kubeconfigSource, error) {
+	var sources []kubeconfigSource
+	if config.File != "" {
+		sources = append(sources, fileKubeconfigSource{path: config.File})
+	}
+	if config.SOPSFile != "" {
+		sources = append(sources, sopsKubeconfigSource{path: config.SOPSFile})
+	}
+	if config.Vault != nil {
+		sources = append(sources, newVaultKubeconfigSource(*config.Vault))
+	}
+
+	switch len(sources) {
+	case 0:
+		return secretKubeconfigSource{client: c, cluster: cluster}, nil
+	case 1:
+		return sources[0], nil
+	default:
+		return nil, errors.New("only one of the target kubeconfig file, SOPS file, or Vault secret can be set")
+	}
+}
+
+// secretKubeconfigSource reads the kubeconfig from the secret Cluster API stores it in on the management cluster.
+type secretKubeconfigSource struct {
+	client  ctrlclient.Client
+	cluster *clusterv1.Cluster
+}
+
+func (s secretKubeconfigSource) kubeconfig() ([]byte, error) {
+	kc, err := kubeconfig.FromSecret(s.client, s.cluster)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving cluster kubeconfig secret")
+	}
+	return kc, nil
+}
+
+// fileKubeconfigSource reads the kubeconfig from a file.
+type fileKubeconfigSource struct {
+	path string
+}
+
+func (s fileKubeconfigSource) kubeconfig() ([]byte, error) {
+	kc, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading target kubeconfig %s", s.path)
+	}
+	return kc, nil
+}
+
+// sopsKubeconfigSource decrypts a SOPS encrypted kubeconfig file with the sops command, which finds its keys as usual,
+// for example from SOPS_AGE_KEY_FILE, a PGP keyring, or cloud KMS credentials.
+type sopsKubeconfigSource struct {
+	path string
+}
+
+func (s sopsKubeconfigSource) kubeconfig() ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sops", "--decrypt", s.path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "error decrypting target kubeconfig %s with sops: %s", s.path, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// vaultKubeconfigSource reads the kubeconfig from a field of a HashiCorp Vault secret, using the Vault HTTP API.
+type vaultKubeconfigSource struct {
+	address string
+	token   string
+	path    string
+	field   string
+	client  *http.Client
+}
+
+// newVaultKubeconfigSource returns a source for the Vault secret in config. The address defaults to $VAULT_ADDR and
+// the token is read from $VAULT_TOKEN, so that it is never written to a config file.
+func newVaultKubeconfigSource(config VaultKubeconfigSourceConfig) vaultKubeconfigSource {
+	s := vaultKubeconfigSource{
+		address: config.Address,
+		token:   os.Getenv("VAULT_TOKEN"),
+		path:    strings.Trim(config.Path, "/"),
+		field:   config.Field,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.address == "" {
+		s.address = os.Getenv("VAULT_ADDR")
+	}
+	if s.field == "" {
+		s.field = defaultVaultKubeconfigField
+	}
+	return s
+}
+
+func (s vaultKubeconfigSource) kubeconfig() ([]byte, error) {
+	if s.address == "" {
+		return nil, errors.New("the Vault address is required, set it in the config or in VAULT_ADDR")
+	}
+	if s.token == "" {
+		return nil, errors.New("a Vault token is required in VAULT_TOKEN")
+	}
+	if s.path == "" {
+		return nil, errors.New("the Vault secret path is required")
+	}
+
+	url := strings.TrimRight(s.address, "/") + "/v1/" + s.path
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading Vault secret %s", s.path)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("error reading Vault secret %s: %s", s.path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading Vault secret %s", s.path)
+	}
+
+	return vaultSecretField(body, s.path, s.field)
+}
+
+// vaultSecretField returns field of the Vault secret read from path. KV version 2 secrets nest their fields under
+// data.data, version 1 secrets directly under data.
+func vaultSecretField(body []byte, path, field string) ([]byte, error) {
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, errors.Wrapf(err, "error decoding Vault secret %s", path)
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[field].(string)
+	if !ok || value == "" {
+		return nil, errors.Errorf("Vault secret %s has no %s field", path, field)
+	}
+	return []byte(value), nil
+}
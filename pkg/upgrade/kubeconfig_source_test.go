@@ -0,0 +1,70 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKubeconfigSource(t *testing.T) {
+	source, err := newKubeconfigSource(KubeconfigSourceConfig{}, nil, nil)
+	require.NoError(t, err)
+	assert.IsType(t, secretKubeconfigSource{}, source)
+
+	source, err = newKubeconfigSource(KubeconfigSourceConfig{SOPSFile: "kubeconfig.enc.yaml"}, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, sopsKubeconfigSource{path: "kubeconfig.enc.yaml"}, source)
+
+	_, err = newKubeconfigSource(KubeconfigSourceConfig{File: "kubeconfig", Vault: &VaultKubeconfigSourceConfig{Path: "secret/c"}}, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestVaultSecretField(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{name: "kv version 1", body: `{"data":{"kubeconfig":"apiVersion: v1"}}`, field: "kubeconfig"},
+		{name: "kv version 2", body: `{"data":{"data":{"value":"apiVersion: v1"},"metadata":{"version":3}}}`, field: "value"},
+		{name: "kv version 1 field named data", body: `{"data":{"data":{"kubeconfig":"nested"},"kubeconfig":"apiVersion: v1"}}`, field: "kubeconfig"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := vaultSecretField([]byte(tc.body), "secret/c", tc.field)
+			require.NoError(t, err)
+			assert.Equal(t, "apiVersion: v1", string(value))
+		})
+	}
+
+	_, err := vaultSecretField([]byte(`{"data":{"other":"x"}}`), "secret/c", "kubeconfig")
+	assert.Error(t, err)
+}
+
+func TestVaultKubeconfigSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/clusters/c" || r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"kubeconfig":"apiVersion: v1"},"metadata":{}}}`))
+	}))
+	defer server.Close()
+
+	source := newVaultKubeconfigSource(VaultKubeconfigSourceConfig{Address: server.URL, Path: "/secret/data/clusters/c"})
+	source.token = "token"
+	kc, err := source.kubeconfig()
+	require.NoError(t, err)
+	assert.Equal(t, "apiVersion: v1", string(kc))
+
+	source.token = "wrong"
+	_, err = source.kubeconfig()
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Kubelet config source strategies.
+const (
+	// kubeletConfigShared is the kubeadm default: all kubelets use the kubelet configmap of their version.
+	kubeletConfigShared = "shared"
+	// kubeletConfigPerNode is for clusters whose nodes use a node-specific configmap, such as kubelet-config-<node>, as
+	// their dynamic kubelet config source.
+	kubeletConfigPerNode = "per-node"
+)
+
+// kubeadmKubeletConfigKey is the key of the shared kubelet configmaps holding the KubeletConfiguration.
+const kubeadmKubeletConfigKey = "kubelet"
+
+// kubeletConfigGroup is the API group of KubeletConfiguration.
+const kubeletConfigGroup = "kubelet.config.k8s.io"
+
+var (
+	// unversionedKubeletConfigVersion is the first kubeadm version to use a single kubelet-config configmap instead
+	// of one per minor version.
+	unversionedKubeletConfigVersion = semver.MustParse("1.24.0")
+	// dynamicKubeletConfigRemovedVersion is the first kubelet version to ignore the node's config source.
+	dynamicKubeletConfigRemovedVersion = semver.MustParse("1.24.0")
+)
+
+// kubeletConfigMapName returns the name of the shared kubelet configmap kubeadm reads when joining a node of version.
+func kubeletConfigMapName(version semver.Version) string {
+	if !version.LT(unversionedKubeletConfigVersion) {
+		return "kubelet-config"
+	}
+	return fmt.Sprintf("kubelet-config-%d.%d", version.Major, version.Minor)
+}
+
+// loadKubeletConfigFile returns the content of the KubeletConfiguration file at path, or nil if path is empty.
+func loadKubeletConfigFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading kubelet config file %s", path)
+	}
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(data, &typeMeta); err != nil {
+		return nil, errors.Wrapf(err, "error decoding kubelet config file %s", path)
+	}
+	if typeMeta.Kind != "KubeletConfiguration" || !strings.HasPrefix(typeMeta.APIVersion, kubeletConfigGroup+"/") {
+		return nil, errors.Errorf("kubelet config file %s must hold a %s/v1beta1 KubeletConfiguration, not %s %s", path,
+			kubeletConfigGroup, typeMeta.APIVersion, typeMeta.Kind)
+	}
+	return data, nil
+}
+
+// kubeletConfigRoleName returns the name of the role, and role binding, allowing nodes of version to read their
+// shared kubelet configmap.
+func kubeletConfigRoleName(version semver.Version) string {
+	return "kubeadm:" + kubeletConfigMapName(version)
+}
+
+// perNodeKubeletConfigSources returns the configmap config sources of the nodes using one, by node name.
+func perNodeKubeletConfigSources(nodes []v1.Node) map[string]*v1.ConfigMapNodeConfigSource {
+	sources := map[string]*v1.ConfigMapNodeConfigSource{}
+	for _, node := range nodes {
+		if node.Spec.ConfigSource != nil && node.Spec.ConfigSource.ConfigMap != nil {
+			sources[node.Name] = node.Spec.ConfigSource.ConfigMap
+		}
+	}
+	return sources
+}
+
+// kubeletConfigStrategy returns the kubelet config source strategy of a cluster whose nodes use sources.
+func kubeletConfigStrategy(sources map[string]*v1.ConfigMapNodeConfigSource) string {
+	if len(sources) > 0 {
+		return kubeletConfigPerNode
+	}
+	return kubeletConfigShared
+}
+
+// replacementKubeletConfigMapName returns the name of the node-specific kubelet configmap of newNode, given the
+// configmap name of oldNode, the node it replaces.
+func replacementKubeletConfigMapName(name, oldNode, newNode string) string {
+	base := name
+	if strings.HasSuffix(name, oldNode) {
+		base = strings.TrimSuffix(name, oldNode)
+	} else {
+		base += "-"
+	}
+	if excess := len(base) + len(newNode) - validation.DNS1123SubdomainMaxLength; excess > 0 {
+		base = base[:len(base)-excess]
+	}
+	return base + newNode
+}
+
+// discoverKubeletConfigSources returns the configmap config sources of the nodes of the target cluster that use one,
+// by node name.
+func (u *ControlPlaneUpgrader) discoverKubeletConfigSources() (map[string]*v1.ConfigMapNodeConfigSource, error) {
+	nodes, err := u.targetKubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing nodes")
+	}
+	sources := perNodeKubeletConfigSources(nodes.Items)
+	u.log.Info("Discovered kubelet config source strategy", "strategy", kubeletConfigStrategy(sources), "per-node-configmaps", len(sources))
+	return sources, nil
+}
+
+// sharedKubeletConfigFromNode returns the data of a shared kubelet configmap built from the node-specific configmap of
+// one of the nodes using sources, for clusters that only have node-specific configmaps.
+func (u *ControlPlaneUpgrader) sharedKubeletConfigFromNode(sources map[string]*v1.ConfigMapNodeConfigSource) (map[string]string, error) {
+	nodeNames := make([]string, 0, len(sources))
+	for name := range sources {
+		nodeNames = append(nodeNames, name)
+	}
+	sort.Strings(nodeNames)
+
+	for _, nodeName := range nodeNames {
+		source := sources[nodeName]
+		cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps(source.Namespace).Get(source.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting kubelet configmap %s/%s of node %s", source.Namespace, source.Name, nodeName)
+		}
+		config, ok := cm.Data[source.KubeletConfigKey]
+		if !ok {
+			continue
+		}
+		u.log.Info("Using the kubelet configmap of a node as the shared kubelet config", "node", nodeName, "configmap", fmt.Sprintf("%s/%s", source.Namespace, source.Name))
+		return map[string]string{kubeadmKubeletConfigKey: config}, nil
+	}
+	return nil, nil
+}
+
+// carryNodeKubeletConfig gives newNode a copy of the node-specific kubelet configmap of oldNode, the node it replaces,
+// and makes it newNode's config source. It does nothing if oldNode uses the shared kubelet configmap.
+func (u *ControlPlaneUpgrader) carryNodeKubeletConfig(oldNode, newNode *v1.Node) error {
+	if oldNode.Spec.ConfigSource == nil || oldNode.Spec.ConfigSource.ConfigMap == nil {
+		return nil
+	}
+	source := oldNode.Spec.ConfigSource.ConfigMap
+
+	if !u.desiredVersion.LT(dynamicKubeletConfigRemovedVersion) {
+		u.warnings.add(WarningKubeletConfigSource, newNode.Name,
+			"node %s used the kubelet configmap %s/%s, which kubelets %s ignore; move its settings to the shared kubelet configmap or the bootstrap config",
+			oldNode.Name, source.Namespace, source.Name, u.desiredVersion)
+		return nil
+	}
+
+	name := replacementKubeletConfigMapName(source.Name, oldNode.Name, newNode.Name)
+	u.log.Info("Copying the node-specific kubelet configmap", "node", newNode.Name, "configmap", fmt.Sprintf("%s/%s", source.Namespace, name))
+
+	cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps(source.Namespace).Get(source.Name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "error getting kubelet configmap %s/%s of node %s", source.Namespace, source.Name, oldNode.Name)
+	}
+	replacement := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   cm.Namespace,
+			Name:        name,
+			Labels:      cm.Labels,
+			Annotations: cm.Annotations,
+		},
+		Data:       cm.Data,
+		BinaryData: cm.BinaryData,
+	}
+	if _, err := u.targetKubernetesClient.CoreV1().ConfigMaps(cm.Namespace).Create(replacement); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "error creating kubelet configmap %s/%s", cm.Namespace, name)
+	}
+
+	node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(newNode.Name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "error getting node %s", newNode.Name)
+	}
+	node.Spec.ConfigSource = &v1.NodeConfigSource{
+		ConfigMap: &v1.ConfigMapNodeConfigSource{
+			Namespace:        cm.Namespace,
+			Name:             name,
+			KubeletConfigKey: source.KubeletConfigKey,
+		},
+	}
+	if _, err := u.targetKubernetesClient.CoreV1().Nodes().Update(node); err != nil {
+		return errors.Wrapf(err, "error setting the kubelet config source of node %s", newNode.Name)
+	}
+	u.record.event("Node %s uses the kubelet configmap %s, copied from node %s", newNode.Name, name, oldNode.Name)
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blang/semver"
+	logrtesting "github.com/go-logr/logr/testing"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubeletConfigMapName(t *testing.T) {
+	testcases := []struct {
+		version  string
+		wantName string
+		wantRole string
+	}{
+		{version: "1.15.3", wantName: "kubelet-config-1.15", wantRole: "kubeadm:kubelet-config-1.15"},
+		{version: "1.23.17", wantName: "kubelet-config-1.23", wantRole: "kubeadm:kubelet-config-1.23"},
+		{version: "1.24.0", wantName: "kubelet-config", wantRole: "kubeadm:kubelet-config"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.version, func(t *testing.T) {
+			v := semver.MustParse(tc.version)
+			if name := kubeletConfigMapName(v); name != tc.wantName {
+				t.Errorf("kubeletConfigMapName() = %q, want %q", name, tc.wantName)
+			}
+			if role := kubeletConfigRoleName(v); role != tc.wantRole {
+				t.Errorf("kubeletConfigRoleName() = %q, want %q", role, tc.wantRole)
+			}
+		})
+	}
+}
+
+func TestPerNodeKubeletConfigSources(t *testing.T) {
+	source := &v1.ConfigMapNodeConfigSource{Namespace: "kube-system", Name: "kubelet-config-node-1", KubeletConfigKey: "kubelet"}
+	nodes := []v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Spec: v1.NodeSpec{ConfigSource: &v1.NodeConfigSource{ConfigMap: source}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}, Spec: v1.NodeSpec{ConfigSource: &v1.NodeConfigSource{}}},
+	}
+
+	sources := perNodeKubeletConfigSources(nodes)
+	if len(sources) != 1 || sources["node-1"] != source {
+		t.Errorf("unexpected sources %v", sources)
+	}
+	if strategy := kubeletConfigStrategy(sources); strategy != kubeletConfigPerNode {
+		t.Errorf("kubeletConfigStrategy() = %q, want %q", strategy, kubeletConfigPerNode)
+	}
+	if strategy := kubeletConfigStrategy(perNodeKubeletConfigSources(nodes[1:])); strategy != kubeletConfigShared {
+		t.Errorf("kubeletConfigStrategy() = %q, want %q", strategy, kubeletConfigShared)
+	}
+}
+
+func TestReplacementKubeletConfigMapName(t *testing.T) {
+	testcases := []struct {
+		name string
+		want string
+	}{
+		{name: "kubelet-config-old-node", want: "kubelet-config-new-node"},
+		{name: "custom-kubelet", want: "custom-kubelet-new-node"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := replacementKubeletConfigMapName(tc.name, "old-node", "new-node"); got != tc.want {
+				t.Errorf("replacementKubeletConfigMapName() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	newNode := strings.Repeat("n", 250)
+	got := replacementKubeletConfigMapName("kubelet-config-old-node", "old-node", newNode)
+	if len(got) > validation.DNS1123SubdomainMaxLength || !strings.HasSuffix(got, newNode) {
+		t.Errorf("replacementKubeletConfigMapName() = %q, want at most %d characters ending with the new node name", got, validation.DNS1123SubdomainMaxLength)
+	}
+}
+
+func TestLoadKubeletConfigFile(t *testing.T) {
+	data, err := loadKubeletConfigFile("")
+	if err != nil || data != nil {
+		t.Errorf("loadKubeletConfigFile() = %q, %v, want nil", data, err)
+	}
+
+	dir, err := ioutil.TempDir("", "kubelet-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testcases := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: "apiVersion: kubelet.config.k8s.io/v1beta1\nkind: KubeletConfiguration\ncgroupDriver: systemd\n"},
+		{name: "wrong-kind", content: "apiVersion: kubeadm.k8s.io/v1beta2\nkind: ClusterConfiguration\n", wantErr: true},
+		{name: "wrong-group", content: "apiVersion: v1\nkind: KubeletConfiguration\n", wantErr: true},
+		{name: "invalid", content: "kind: [", wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".yaml")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			data, err := loadKubeletConfigFile(path)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("loadKubeletConfigFile() = %q, want an error", data)
+				}
+				return
+			}
+			if err != nil || string(data) != tc.content {
+				t.Errorf("loadKubeletConfigFile() = %q, %v, want %q", data, err, tc.content)
+			}
+		})
+	}
+
+	if _, err := loadKubeletConfigFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("loadKubeletConfigFile() of a missing file succeeded, want an error")
+	}
+}
+
+func TestUpdateKubeletConfigMapFromFile(t *testing.T) {
+	version := semver.MustParse("1.16.2")
+	config := "apiVersion: kubelet.config.k8s.io/v1beta1\nkind: KubeletConfiguration\ncgroupDriver: systemd\n"
+	previous := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kubelet-config-1.15"},
+		Data:       map[string]string{kubeadmKubeletConfigKey: "previous"},
+	}
+	existing := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kubelet-config-1.16", ResourceVersion: "1"},
+		Data:       map[string]string{kubeadmKubeletConfigKey: "stale", "other": "kept"},
+	}
+
+	testcases := []struct {
+		name          string
+		kubeletConfig []byte
+		objects       []*v1.ConfigMap
+		want          map[string]string
+	}{
+		{name: "copied", objects: []*v1.ConfigMap{previous}, want: map[string]string{kubeadmKubeletConfigKey: "previous"}},
+		{name: "created", kubeletConfig: []byte(config), objects: []*v1.ConfigMap{previous}, want: map[string]string{kubeadmKubeletConfigKey: config}},
+		{name: "created-without-previous", kubeletConfig: []byte(config), want: map[string]string{kubeadmKubeletConfigKey: config}},
+		{name: "kept", objects: []*v1.ConfigMap{previous, existing}, want: existing.Data},
+		{name: "replaced", kubeletConfig: []byte(config), objects: []*v1.ConfigMap{previous, existing}, want: map[string]string{kubeadmKubeletConfigKey: config, "other": "kept"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			for _, cm := range tc.objects {
+				if _, err := client.CoreV1().ConfigMaps("kube-system").Create(cm.DeepCopy()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			u := &ControlPlaneUpgrader{log: logrtesting.NullLogger{}, targetKubernetesClient: client, kubeletConfig: tc.kubeletConfig}
+			if err := u.updateKubeletConfigMapIfNeeded(version, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			cm, err := client.CoreV1().ConfigMaps("kube-system").Get(kubeletConfigMapName(version), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cm.Data) != len(tc.want) {
+				t.Errorf("configmap data = %v, want %v", cm.Data, tc.want)
+			}
+			for k, v := range tc.want {
+				if cm.Data[k] != v {
+					t.Errorf("configmap data = %v, want %v", cm.Data, tc.want)
+				}
+			}
+		})
+	}
+}
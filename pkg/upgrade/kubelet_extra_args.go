@@ -0,0 +1,113 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// KubeletExtraArgsRule adjusts the kubelet extra args of replacement control plane machines upgraded to a range of
+// Kubernetes versions.
+type KubeletExtraArgsRule struct {
+	// KubernetesVersions is the range of desired versions the rule applies to, such as ">=1.16.0" or
+	// ">=1.15.0 <1.17.0".
+	KubernetesVersions string `json:"kubernetesVersions"`
+	// Remove lists the flags removed, without their leading dashes, such as allow-privileged.
+	Remove []string `json:"remove,omitempty"`
+	// Set adds or replaces flags, without their leading dashes.
+	Set map[string]string `json:"set,omitempty"`
+
+	versions semver.Range
+}
+
+// defaultKubeletExtraArgsRules remove the kubelet flags whose removal prevents the kubelet from starting, in the
+// versions this tool upgrades to. Rules from a rules file apply after them.
+var defaultKubeletExtraArgsRules = []KubeletExtraArgsRule{
+	{KubernetesVersions: ">=1.12.0", Remove: []string{"cadvisor-port"}},
+	{KubernetesVersions: ">=1.15.0", Remove: []string{"allow-privileged"}},
+}
+
+// loadKubeletExtraArgsRules returns the default rules followed by those of the YAML file at path, if any.
+func loadKubeletExtraArgsRules(path string) ([]KubeletExtraArgsRule, error) {
+	rules := append([]KubeletExtraArgsRule(nil), defaultKubeletExtraArgsRules...)
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading kubelet extra args rules file %s", path)
+		}
+		var file []KubeletExtraArgsRule
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, errors.Wrapf(err, "error decoding kubelet extra args rules file %s", path)
+		}
+		for i, rule := range file {
+			if len(rule.Remove) == 0 && len(rule.Set) == 0 {
+				return nil, errors.Errorf("kubelet extra args rules file %s: rule %d neither removes nor sets flags", path, i+1)
+			}
+		}
+		rules = append(rules, file...)
+	}
+	return parseKubeletExtraArgsRules(rules)
+}
+
+// parseKubeletExtraArgsRules parses the versions of rules, in place, and returns them.
+func parseKubeletExtraArgsRules(rules []KubeletExtraArgsRule) ([]KubeletExtraArgsRule, error) {
+	for i := range rules {
+		versions, err := semver.ParseRange(rules[i].KubernetesVersions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid kubernetes versions %q of kubelet extra args rule %d", rules[i].KubernetesVersions, i+1)
+		}
+		rules[i].versions = versions
+	}
+	return rules, nil
+}
+
+// adjustKubeletExtraArgs returns a copy of args with the rules applying to version applied in order, and describes the
+// changes made.
+func adjustKubeletExtraArgs(args map[string]string, rules []KubeletExtraArgsRule, version semver.Version) (map[string]string, []string) {
+	adjusted := make(map[string]string, len(args))
+	for k, v := range args {
+		adjusted[k] = v
+	}
+
+	var changes []string
+	for _, rule := range rules {
+		if rule.versions == nil || !rule.versions(version) {
+			continue
+		}
+		for _, flag := range rule.Remove {
+			flag = strings.TrimLeft(flag, "-")
+			if _, ok := adjusted[flag]; ok {
+				delete(adjusted, flag)
+				changes = append(changes, fmt.Sprintf("removed %s", flag))
+			}
+		}
+
+		var flags []string
+		for flag := range rule.Set {
+			flags = append(flags, flag)
+		}
+		sort.Strings(flags)
+		for _, flag := range flags {
+			value := rule.Set[flag]
+			flag = strings.TrimLeft(flag, "-")
+			if current, ok := adjusted[flag]; ok && current == value {
+				continue
+			}
+			adjusted[flag] = value
+			changes = append(changes, fmt.Sprintf("set %s=%s", flag, value))
+		}
+	}
+
+	if len(adjusted) == 0 && args == nil {
+		return nil, changes
+	}
+	return adjusted, changes
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKubeletExtraArgsRules(t *testing.T) {
+	rules, err := loadKubeletExtraArgsRules("")
+	require.NoError(t, err)
+	assert.Len(t, rules, len(defaultKubeletExtraArgsRules))
+
+	dir, err := ioutil.TempDir("", "kubelet-extra-args")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(content string) string {
+		path := filepath.Join(dir, "rules.yaml")
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	rules, err = loadKubeletExtraArgsRules(write(`
+- kubernetesVersions: ">=1.16.0"
+  remove: [feature-gates]
+`))
+	require.NoError(t, err)
+	require.Len(t, rules, len(defaultKubeletExtraArgsRules)+1)
+	assert.Equal(t, []string{"feature-gates"}, rules[len(rules)-1].Remove)
+
+	for _, content := range []string{
+		`- kubernetesVersions: "1.16"` + "\n  remove: [feature-gates]",
+		`- kubernetesVersions: ">=1.16.0"`,
+		`not: [a list`,
+	} {
+		_, err := loadKubeletExtraArgsRules(write(content))
+		assert.Error(t, err, content)
+	}
+
+	_, err = loadKubeletExtraArgsRules(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestAdjustKubeletExtraArgs(t *testing.T) {
+	rules := []KubeletExtraArgsRule{
+		{KubernetesVersions: ">=1.15.0", Remove: []string{"allow-privileged"}},
+		{KubernetesVersions: ">=1.16.0", Remove: []string{"--feature-gates"}, Set: map[string]string{"cgroup-driver": "systemd", "--node-labels": "a=b"}},
+	}
+	for i := range rules {
+		rules[i].versions = semver.MustParseRange(rules[i].KubernetesVersions)
+	}
+	args := map[string]string{
+		"allow-privileged": "true",
+		"feature-gates":    "A=true",
+		"cgroup-driver":    "systemd",
+	}
+
+	adjusted, changes := adjustKubeletExtraArgs(args, rules, semver.MustParse("1.16.3"))
+	assert.Equal(t, map[string]string{"cgroup-driver": "systemd", "node-labels": "a=b"}, adjusted)
+	assert.Equal(t, []string{"removed allow-privileged", "removed feature-gates", "set node-labels=a=b"}, changes)
+	// args is left alone
+	assert.Len(t, args, 3)
+
+	adjusted, changes = adjustKubeletExtraArgs(args, rules, semver.MustParse("1.15.9"))
+	assert.Equal(t, map[string]string{"feature-gates": "A=true", "cgroup-driver": "systemd"}, adjusted)
+	assert.Equal(t, []string{"removed allow-privileged"}, changes)
+
+	adjusted, changes = adjustKubeletExtraArgs(nil, rules, semver.MustParse("1.14.0"))
+	assert.Nil(t, adjusted)
+	assert.Empty(t, changes)
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+)
+
+// mixedMinorVersions returns true if a control plane whose versions range from min to max has machines at different
+// minor versions, as happens when an earlier upgrade stopped midway.
+func mixedMinorVersions(min, max semver.Version) bool {
+	return isMinorVersionUpgrade(min, max)
+}
+
+// levelingUpgradeID returns the upgrade ID used to level the control plane during the upgrade upgradeID. It differs
+// from upgradeID so the upgrade replaces the leveled machines again, and is made of digits like any upgrade ID.
+func levelingUpgradeID(upgradeID string) string {
+	return upgradeID + "0"
+}
+
+// machinesOlderThan returns the machines whose version is older than version.
+func machinesOlderThan(machines []*clusterv1.Machine, version semver.Version) []*clusterv1.Machine {
+	var ret []*clusterv1.Machine
+	for _, m := range machines {
+		if m.Spec.Version == nil || *m.Spec.Version == "" {
+			continue
+		}
+		v, err := semver.ParseTolerant(*m.Spec.Version)
+		if err == nil && v.LT(version) {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// imageFieldForKind returns the image field of infrastructure machines of kind: the configured one, or the provider's.
+func imageFieldForKind(config MachineUpdateConfig, kind string) string {
+	if image, ok := config.ImagesByKind[kind]; ok && image.Field != "" {
+		return image.Field
+	}
+	if config.Image.Field != "" {
+		return config.Image.Field
+	}
+	return providerAdapterForKind(kind).defaultImageField()
+}
+
+// level upgrades the control plane machines older than max to max, so that all of them are then upgraded to the
+// desired version from the same minor version. It returns the control plane machines and their oldest version once
+// leveled.
+func (u *ControlPlaneUpgrader) level(machines []*clusterv1.Machine, min, max semver.Version) ([]*clusterv1.Machine, semver.Version, error) {
+	older := machinesOlderThan(machines, max)
+	u.log.Info("Leveling control plane machines before upgrading", "machines", len(older), "version", max.String(), "desired-version", u.desiredVersion.String())
+	u.record.event("Leveling %d control plane machines to %s before upgrading to %s", len(older), max, u.desiredVersion)
+
+	machineUpdates, err := u.levelingMachineUpdates(machines, older, max)
+	if err != nil {
+		return nil, semver.Version{}, err
+	}
+
+	leveler := *u
+	leveler.desiredVersion = max
+	leveler.upgradeID = levelingUpgradeID(u.upgradeID)
+	leveler.machineUpdates = machineUpdates
+	if err := leveler.replaceMachines(older, min); err != nil {
+		return nil, semver.Version{}, errors.Wrapf(err, "error leveling control plane machines to %s", max)
+	}
+	u.record.event("Leveled the control plane to %s", max)
+
+	machines, err = u.listMachines()
+	if err != nil {
+		return nil, semver.Version{}, err
+	}
+	machines = u.skipPinnedMachines(machines)
+	min, _, err = minMaxMachineVersions(machines)
+	if err != nil {
+		return nil, semver.Version{}, errors.Wrap(err, "error determining leveled control plane versions")
+	}
+	return machines, min, nil
+}
+
+// levelingMachineUpdates returns the image updates of the machines replaced while leveling. The configured images are
+// meant for the desired version, so each infrastructure kind gets the image of a machine already at max instead. Kinds
+// without such a machine keep their image.
+func (u *ControlPlaneUpgrader) levelingMachineUpdates(machines, older []*clusterv1.Machine, max semver.Version) (MachineUpdateConfig, error) {
+	config := MachineUpdateConfig{ImagesByKind: map[string]ImageUpdateConfig{}}
+	for _, m := range older {
+		kind := m.Spec.InfrastructureRef.Kind
+		if _, ok := config.ImagesByKind[kind]; ok {
+			continue
+		}
+
+		field := imageFieldForKind(u.machineUpdates, kind)
+		id, err := u.imageAtVersion(machines, kind, field, max)
+		if err != nil {
+			return config, err
+		}
+		if id == "" {
+			u.warnings.add(WarningMixedControlPlaneVersions, kind,
+				"control plane machines of kind %s keep their image while leveled to %s, as the image of a machine at %s could not be determined", kind, max, max)
+		}
+		// An empty id leaves the image as is, overriding any configured image
+		config.ImagesByKind[kind] = ImageUpdateConfig{ID: id, Field: field}
+	}
+	return config, nil
+}
+
+// imageAtVersion returns the image, in field, of the infrastructure machine of the first of machines of kind at version.
+// It returns "" if there is no such machine, or field is unknown or goes through a list.
+func (u *ControlPlaneUpgrader) imageAtVersion(machines []*clusterv1.Machine, kind, field string, version semver.Version) (string, error) {
+	if field == "" || strings.Contains(field, "[") {
+		return "", nil
+	}
+
+	for _, m := range machines {
+		if m.Spec.InfrastructureRef.Kind != kind || m.Spec.Version == nil {
+			continue
+		}
+		if v, err := semver.ParseTolerant(*m.Spec.Version); err != nil || !v.EQ(version) {
+			continue
+		}
+
+		infra, err := external.Get(u.managementClusterClient, &m.Spec.InfrastructureRef, m.Namespace)
+		if err != nil {
+			return "", err
+		}
+		id, _, err := unstructured.NestedString(infra.Object, strings.Split(field, ".")...)
+		if err != nil {
+			return "", errors.Wrapf(err, "error reading %s of %s %s", field, kind, infra.GetName())
+		}
+		return id, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestMixedMinorVersions(t *testing.T) {
+	assert.True(t, mixedMinorVersions(semver.MustParse("1.14.9"), semver.MustParse("1.15.3")))
+	assert.False(t, mixedMinorVersions(semver.MustParse("1.15.1"), semver.MustParse("1.15.3")))
+}
+
+func TestMachinesOlderThan(t *testing.T) {
+	machine := func(name, version string) *clusterv1.Machine {
+		return &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       clusterv1.MachineSpec{Version: &version},
+		}
+	}
+	machines := []*clusterv1.Machine{machine("a", "v1.14.9"), machine("b", "1.15.3"), machine("c", "v1.15.3"), machine("d", "")}
+
+	older := machinesOlderThan(machines, semver.MustParse("1.15.3"))
+	assert.Equal(t, []*clusterv1.Machine{machines[0]}, older)
+}
+
+func TestLevelingUpgradeID(t *testing.T) {
+	id := levelingUpgradeID("1575000000")
+	assert.NotEqual(t, "1575000000", id)
+	assert.True(t, upgradeIDInputRegex.MatchString(id))
+	assert.True(t, upgradeIDNameSuffixRegex.MatchString(generateReplacementMachineName("cp-0", id)))
+}
+
+func TestImageFieldForKind(t *testing.T) {
+	assert.Equal(t, "spec.ami.id", imageFieldForKind(MachineUpdateConfig{}, "AWSMachine"))
+	assert.Equal(t, "spec.image", imageFieldForKind(MachineUpdateConfig{Image: ImageUpdateConfig{Field: "spec.image"}}, "AWSMachine"))
+	assert.Equal(t, "spec.kindImage", imageFieldForKind(MachineUpdateConfig{
+		Image:        ImageUpdateConfig{Field: "spec.image"},
+		ImagesByKind: map[string]ImageUpdateConfig{"AWSMachine": {ID: "ami-1", Field: "spec.kindImage"}},
+	}, "AWSMachine"))
+	assert.Equal(t, "", imageFieldForKind(MachineUpdateConfig{}, "UnknownMachine"))
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"sort"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// Well-known Cluster API annotations on machines, which upgrades honor the way the Cluster API controllers do. They
+// are honored by their presence, whatever their value.
+const (
+	// AnnotationSkipRemediation excludes a machine from remediation by machine health checks, such as while an
+	// operator investigates it. Machines with it are not recreated, and are not carried over to replacements.
+	AnnotationSkipRemediation = "cluster.x-k8s.io/skip-remediation"
+	// AnnotationDeleteMachine marks a machine to be deleted first when its MachineSet scales down. Control plane
+	// machines with it are replaced first, and it is not carried over to replacements.
+	AnnotationDeleteMachine = "cluster.x-k8s.io/delete-machine"
+	// AnnotationExcludeNodeDraining skips draining the node of a machine when it is deleted. The nodes of control
+	// plane machines with it are neither cordoned nor have their workloads rescheduled by upgrades.
+	AnnotationExcludeNodeDraining = "machine.cluster.x-k8s.io/exclude-node-draining"
+
+	// legacyAnnotationDeleteMachine is the delete machine annotation of the Cluster API v0.2 MachineSet controller.
+	legacyAnnotationDeleteMachine = "cluster.k8s.io/delete-machine"
+)
+
+// hasAnnotation returns true if machine has any of keys.
+func hasAnnotation(machine *clusterv1.Machine, keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := machine.Annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// skipsRemediation returns true if machine is excluded from remediation.
+func skipsRemediation(machine *clusterv1.Machine) bool {
+	return hasAnnotation(machine, AnnotationSkipRemediation)
+}
+
+// markedForDeletion returns true if machine is marked to be deleted first.
+func markedForDeletion(machine *clusterv1.Machine) bool {
+	return hasAnnotation(machine, AnnotationDeleteMachine, legacyAnnotationDeleteMachine)
+}
+
+// excludesNodeDraining returns true if the node of machine is not to be drained, with the annotation of current
+// Cluster API controllers or the misspelled one of v0.2.
+func excludesNodeDraining(machine *clusterv1.Machine) bool {
+	return hasAnnotation(machine, AnnotationExcludeNodeDraining, clusterv1.ExcludeNodeDrainingAnnotation)
+}
+
+// orderMachinesForDeletion returns machines with the ones marked for deletion first, preserving their order otherwise.
+func orderMachinesForDeletion(machines []*clusterv1.Machine) []*clusterv1.Machine {
+	ordered := make([]*clusterv1.Machine, len(machines))
+	copy(ordered, machines)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return markedForDeletion(ordered[i]) && !markedForDeletion(ordered[j])
+	})
+	return ordered
+}
+
+// deleteMachineStateAnnotations deletes from annotations, those of a machine copied to its replacement, the
+// annotations describing the state of the machine replaced rather than its role.
+func deleteMachineStateAnnotations(annotations map[string]string) {
+	for _, key := range []string{AnnotationSkipRemediation, AnnotationDeleteMachine, legacyAnnotationDeleteMachine} {
+		delete(annotations, key)
+	}
+}
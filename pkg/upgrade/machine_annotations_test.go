@@ -0,0 +1,49 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestWellKnownMachineAnnotations(t *testing.T) {
+	machine := func(annotations ...string) *clusterv1.Machine {
+		m := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+		for _, a := range annotations {
+			m.Annotations[a] = ""
+		}
+		return m
+	}
+
+	assert.False(t, skipsRemediation(machine()))
+	assert.True(t, skipsRemediation(machine(AnnotationSkipRemediation)))
+	assert.False(t, markedForDeletion(machine(AnnotationSkipRemediation)))
+	assert.True(t, markedForDeletion(machine(AnnotationDeleteMachine)))
+	assert.True(t, markedForDeletion(machine("cluster.k8s.io/delete-machine")))
+	assert.False(t, excludesNodeDraining(machine(AnnotationDeleteMachine)))
+	assert.True(t, excludesNodeDraining(machine(AnnotationExcludeNodeDraining)))
+	assert.True(t, excludesNodeDraining(machine("machine.cluster.x-k8s.io.io/exclude-node-draining")))
+}
+
+func TestOrderMachinesForDeletion(t *testing.T) {
+	machine := func(name string, marked bool) *clusterv1.Machine {
+		m := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if marked {
+			m.Annotations = map[string]string{AnnotationDeleteMachine: "yes"}
+		}
+		return m
+	}
+	machines := []*clusterv1.Machine{machine("a", false), machine("b", true), machine("c", false), machine("d", true)}
+
+	var names []string
+	for _, m := range orderMachinesForDeletion(machines) {
+		names = append(names, m.Name)
+	}
+	assert.Equal(t, []string{"b", "d", "a", "c"}, names)
+	assert.Equal(t, "a", machines[0].Name, "machines were reordered in place")
+}
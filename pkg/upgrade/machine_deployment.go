@@ -4,30 +4,78 @@
 package upgrade
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/blang/semver"
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
-	"github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// machineDeploymentRolloutTimeout is how long a batch of machine deployments is given to roll out.
+const machineDeploymentRolloutTimeout = 30 * time.Minute
+
 type MachineDeploymentUpgrader struct {
-	log                     logr.Logger
-	clusterNamespace        string
-	clusterName             string
-	name                    string
-	selector                labels.Selector
-	desiredVersion          semver.Version
-	imageField, imageID     string
+	log                 logr.Logger
+	clusterNamespace    string
+	clusterName         string
+	names               []string
+	selector            labels.Selector
+	batches             []machineDeploymentBatch
+	pauseBetweenBatches bool
+	approvalIn          io.Reader
+	approvalOut         io.Writer
+	desiredVersion      semver.Version
+	versionSource       versionSource
+	imageField, imageID string
+	// imageLookupFormat is expanded for the target version of each machine deployment when there is no image ID.
+	imageLookupFormat       string
 	upgradeID               string
 	managementClusterClient ctrlclient.Client
+	warnings                *warningCollector
+	// record accumulates the report of the run.
+	record *runRecorder
+	// concurrentOperations is the policy for other Cluster API operations in progress on the cluster.
+	concurrentOperations string
+	// approval gates each batch on an external approval.
+	approval *approvalGate
+	// stateLock is held for the whole run, or nil if none is configured.
+	stateLock *stateLock
+	// budget is the time budget of the run.
+	budget runBudget
+	// effectiveConfig is the configuration of the run, with defaults applied and secrets redacted.
+	effectiveConfig *EffectiveConfig
+	// versionOverrides are the versions of the machine deployments not upgraded to the desired version, by name.
+	versionOverrides map[string]semver.Version
+	// providerCompatibility is the table infrastructure provider versions are checked against.
+	providerCompatibility []ProviderCompatibility
+	// ignoreProviderCompatibility reports infrastructure providers too old for the desired version as warnings
+	// instead of failing.
+	ignoreProviderCompatibility bool
+	// idempotent leaves the machine deployments already at their target version and image alone.
+	idempotent bool
+	// targetKubernetesClient reads the target cluster's nodes and pods when planning capacity, and is nil otherwise.
+	targetKubernetesClient kubernetes.Interface
+	// planCapacity splits batches to fit the surge quota and the headroom of the target cluster.
+	planCapacity bool
+	// surgeQuota is how many machines can be created beyond the replicas of the machine deployments, if positive.
+	surgeQuota int
+	// autoscalerBounds is the policy for the cluster autoscaler sizes of machine deployments while they roll out.
+	autoscalerBounds string
+	// imageVerifier verifies the image before any machine deployment is changed, if configured.
+	imageVerifier *imageVerifier
 }
 
 func NewMachineDeploymentUpgrader(log logr.Logger, config Config) (*MachineDeploymentUpgrader, error) {
@@ -35,16 +83,35 @@ func NewMachineDeploymentUpgrader(log logr.Logger, config Config) (*MachineDeplo
 	if config.KubernetesVersion == "" {
 		return nil, errors.New("kubernetes version is required")
 	}
-	if config.MachineDeployment.Name != "" && config.MachineDeployment.LabelSelector != "" {
-		return nil, errors.New("you may only specify one of machine deployment name and label selector, but not both")
+	selectionMethods := 0
+	for _, set := range []bool{
+		config.MachineDeployment.Name != "",
+		len(config.MachineDeployment.Names) > 0,
+		config.MachineDeployment.LabelSelector != "",
+	} {
+		if set {
+			selectionMethods++
+		}
+	}
+	if selectionMethods > 1 {
+		return nil, errors.New("you may only specify one of machine deployment name, names, and label selector")
+	}
+	hasImage := config.MachineUpdates.Image.ID != "" || config.MachineUpdates.Image.LookupFormat != ""
+	if hasImage != (config.MachineUpdates.Image.Field != "") {
+		return nil, errors.New("when specifying image id or lookup format, image field is required (and vice versa)")
 	}
-	if (config.MachineUpdates.Image.ID == "" && config.MachineUpdates.Image.Field != "") ||
-		(config.MachineUpdates.Image.ID != "" && config.MachineUpdates.Image.Field == "") {
-		return nil, errors.New("when specifying image id, image field is required (and vice versa)")
+	if err := validateImageLookupFormats(config.MachineUpdates); err != nil {
+		return nil, err
 	}
 	if !upgradeIDInputRegex.MatchString(config.UpgradeID) {
 		return nil, errors.New("upgrade ID must be a timestamp containing only digits")
 	}
+	if config.ResumeFrom != "" {
+		return nil, errors.New("resuming from a phase is only supported for control plane upgrades")
+	}
+	if config.Conformance != (ConformanceConfig{}) {
+		return nil, errors.New("conformance checks are only supported for control plane upgrades")
+	}
 
 	var (
 		selector labels.Selector
@@ -68,9 +135,66 @@ func NewMachineDeploymentUpgrader(log logr.Logger, config Config) (*MachineDeplo
 		selector = selector.Add(*r)
 	}
 
-	desiredVersion, err := semver.ParseTolerant(config.KubernetesVersion)
+	names := config.MachineDeployment.Names
+	if config.MachineDeployment.Name != "" {
+		names = []string{config.MachineDeployment.Name}
+	}
+
+	batches, err := parseMachineDeploymentBatches(config.MachineDeployment.Batches)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrentOperations, err := parseConcurrentOperations(config.ConcurrentOperations)
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := parseRunBudget(config.MaxDuration, config.ContextDeadline)
+	if err != nil {
+		return nil, err
+	}
+
+	versionOverrides, err := parseMachineDeploymentVersions(config.MachineDeployment.Versions)
+	if err != nil {
+		return nil, err
+	}
+
+	providerCompatibility, err := loadProviderCompatibility(config.ProviderCompatibilityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateIdempotent(config); err != nil {
+		return nil, err
+	}
+
+	autoscalerBounds, err := parseAutoscalerBounds(config.MachineDeployment.AutoscalerBounds)
+	if err != nil {
+		return nil, err
+	}
+	imageVerifier, err := newImageVerifier(config.ImageVerification)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing kubernetes version %q", config.KubernetesVersion)
+		return nil, err
+	}
+
+	var (
+		desiredVersion semver.Version
+		versions       versionSource
+	)
+	switch config.KubernetesVersion {
+	case VersionNextMinor:
+		return nil, errors.Errorf("%s is only supported for control plane upgrades", VersionNextMinor)
+	case VersionLatestPatch:
+		versions, err = newVersionSource(config.VersionManifest)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		desiredVersion, err = semver.ParseTolerant(config.KubernetesVersion)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing kubernetes version %q", config.KubernetesVersion)
+		}
 	}
 
 	upgradeID := config.UpgradeID
@@ -81,66 +205,347 @@ func NewMachineDeploymentUpgrader(log logr.Logger, config Config) (*MachineDeplo
 	infoMessage := fmt.Sprintf("Rerun with `--upgrade-id=%s` if this upgrade fails midway and you want to retry", config.UpgradeID)
 	log.Info(infoMessage)
 
-	managementClusterClient, err := kubernetes.NewClient(
-		kubernetes.KubeConfigPath(config.ManagementCluster.Kubeconfig),
-		kubernetes.KubeConfigContext(config.ManagementCluster.Context),
+	if config.MachineDeployment.Capacity.SurgeQuota < 0 {
+		return nil, errors.New("the surge quota must not be negative")
+	}
+	if config.MachineDeployment.Capacity.SurgeQuota > 0 && !config.MachineDeployment.Capacity.Plan {
+		return nil, errors.New("the surge quota is only used when planning capacity")
+	}
+
+	var (
+		managementClusterClient ctrlclient.Client
+		targetKubernetesClient  kubernetes.Interface
 	)
+	if config.MachineDeployment.Capacity.Plan {
+		// Planning capacity reads the nodes and pods of the target cluster
+		clients, err := newClusterClients(log, config)
+		if err != nil {
+			return nil, err
+		}
+		managementClusterClient = clients.managementClusterClient
+		targetKubernetesClient = clients.targetKubernetesClient
+	} else {
+		connectTimeout, err := parseConnectTimeout(config.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		managementClusterClient, err = newManagementClusterClient(log, config.ManagementCluster, connectTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	approval, err := newApprovalGate(log, managementClusterClient, config.TargetCluster.Namespace, config.TargetCluster.Name, upgradeID, config.Approval)
+	if err != nil {
+		return nil, err
+	}
+	stateLock, err := newStateLock(log, config.StateLock, config.TargetCluster.Namespace, config.TargetCluster.Name, upgradeID, machineDeploymentScope)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating management cluster client")
+		return nil, err
 	}
 
+	effective := config
+	effective.UpgradeID = upgradeID
+	effective.ConcurrentOperations = concurrentOperations
+	effective.MachineDeployment.AutoscalerBounds = autoscalerBounds
+	if approval != nil && effective.Approval.Timeout == "" {
+		effective.Approval.Timeout = defaultApprovalTimeout.String()
+	}
+
+	events, err := openEventStream(config.Events, machineDeploymentScope, config.TargetCluster.Namespace, config.TargetCluster.Name, upgradeID)
+	if err != nil {
+		return nil, err
+	}
+	warnings := newWarningCollector(log)
+	warnings.events = events
+	record := newRunRecorder(machineDeploymentScope, config.TargetCluster.Namespace, config.TargetCluster.Name, upgradeID)
+	record.events = events
+
 	return &MachineDeploymentUpgrader{
 		log:                     log,
 		clusterNamespace:        config.TargetCluster.Namespace,
 		clusterName:             config.TargetCluster.Name,
-		name:                    config.MachineDeployment.Name,
+		names:                   names,
 		selector:                selector,
+		batches:                 batches,
+		pauseBetweenBatches:     config.MachineDeployment.PauseBetweenBatches,
+		approvalIn:              os.Stdin,
+		approvalOut:             os.Stdout,
 		desiredVersion:          desiredVersion,
+		versionSource:           versions,
 		imageField:              config.MachineUpdates.Image.Field,
 		imageID:                 config.MachineUpdates.Image.ID,
+		imageLookupFormat:       config.MachineUpdates.Image.LookupFormat,
 		upgradeID:               upgradeID,
 		managementClusterClient: managementClusterClient,
+		warnings:                warnings,
+		record:                  record,
+		concurrentOperations:    concurrentOperations,
+		approval:                approval,
+		stateLock:               stateLock,
+		budget:                  budget,
+		effectiveConfig:         newEffectiveConfig(effective),
+		versionOverrides:        versionOverrides,
+
+		providerCompatibility:       providerCompatibility,
+		ignoreProviderCompatibility: config.IgnoreProviderCompatibility,
+		idempotent:                  config.Idempotent,
+		targetKubernetesClient:      targetKubernetesClient,
+		planCapacity:                config.MachineDeployment.Capacity.Plan,
+		surgeQuota:                  config.MachineDeployment.Capacity.SurgeQuota,
+		autoscalerBounds:            autoscalerBounds,
+		imageVerifier:               imageVerifier,
 	}, nil
 }
 
 func (u *MachineDeploymentUpgrader) Upgrade() error {
-	var (
-		machineDeployments *clusterv1.MachineDeploymentList
-		err                error
-	)
+	if err := u.stateLock.acquire(); err != nil {
+		u.record.done(err)
+		return err
+	}
+	defer u.stateLock.release()
+
+	err := u.upgrade()
+	u.record.done(err)
+	return err
+}
+
+func (u *MachineDeploymentUpgrader) upgrade() error {
+	u.record.start()
+	u.budget.start(time.Now(), machineDeploymentRolloutTimeout)
+	u.record.event("Upgrade started")
+	if err := logEffectiveConfig(u.log, u.record, u.effectiveConfig); err != nil {
+		return err
+	}
+
+	machineDeployments, err := u.selectMachineDeployments()
+	if err != nil {
+		return err
+	}
+	u.effectiveConfig.DesiredVersion = u.desiredVersion.String()
+	u.log.Info("Resolved configuration", "desired-version", u.effectiveConfig.DesiredVersion)
+	u.record.versions(versionRange(machineDeploymentVersions(machineDeployments)...), versionRange(u.targetVersions(machineDeployments)...))
+
+	pending, err := u.machineDeploymentsToUpgrade(machineDeployments)
+	if err != nil {
+		return err
+	}
+	if u.idempotent && len(pending) == 0 {
+		u.log.Info("Nothing to do, the machine deployments are already upgraded")
+		u.record.nothingToDo()
+		return nil
+	}
+
+	if err := u.checkVersionOverrides(machineDeployments); err != nil {
+		return err
+	}
+	if err := u.checkImages(machineDeployments); err != nil {
+		return err
+	}
+	recordDesiredVersion(u.log, u.managementClusterClient, u.warnings, u.clusterNamespace, u.clusterName, u.desiredVersion)
+
+	u.log.Info("Checking for concurrent operations")
+	if err := checkConcurrentOperations(u.log, u.managementClusterClient, u.clusterNamespace, u.clusterName, u.upgradeID, u.concurrentOperations, u.warnings); err != nil {
+		return err
+	}
+
+	u.log.Info("Checking infrastructure provider compatibility")
+	problems, err := providerCompatibilityProblems(u.log, u.managementClusterClient, u.providerCompatibility, u.desiredVersion, u.ignoreProviderCompatibility, u.warnings)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("infrastructure providers cannot create machines at kubernetes %s, rerun with --ignore-provider-compatibility to upgrade anyway: %s", u.desiredVersion, strings.Join(problems, "; "))
+	}
+
+	for _, i := range emptyMachineDeploymentBatches(machineDeployments, u.batches) {
+		u.warnings.add(WarningEmptyBatch, "", "machine deployment batch %d does not select any machine deployments", i)
+	}
+
+	if err := u.restoreLeftoverAutoscalerBounds(machineDeployments, pending); err != nil {
+		return err
+	}
+
+	batches := planMachineDeploymentBatches(pending, u.batches)
+	if u.planCapacity {
+		u.log.Info("Planning capacity")
+		batches, err = u.fitCapacity(batches)
+		if err != nil {
+			return err
+		}
+	}
+	for _, batch := range batches {
+		for _, name := range machineDeploymentNames(batch.machineDeployments) {
+			u.record.machinePhase(name, MachinePhasePending)
+		}
+	}
+	for i, batch := range batches {
+		if err := u.timeBudgetExhausted(fmt.Sprintf("%d machine deployment batches", len(batches)-i)); err != nil {
+			return err
+		}
+
+		u.log.Info("Upgrading machine deployment batch", "batch", fmt.Sprintf("%d/%d", i+1, len(batches)), "machine-deployments", machineDeploymentNames(batch.machineDeployments))
+		u.record.event("Upgrading machine deployment batch %d/%d: %s", i+1, len(batches), strings.Join(machineDeploymentNames(batch.machineDeployments), ", "))
 
-	if u.name != "" {
-		key := ctrlclient.ObjectKey{
-			Namespace: u.clusterNamespace,
-			Name:      u.name,
+		if err := u.approval.wait(fmt.Sprintf("%s%d", approvalPhaseBatchPrefix, i+1)); err != nil {
+			return err
 		}
+		// waiting for approval does not count towards how long batches take
+		started := time.Now()
 
-		var machineDeployment clusterv1.MachineDeployment
+		pinned, err := u.pinBatchAutoscalerBounds(batch.machineDeployments)
+		if err != nil {
+			return err
+		}
 
-		if err := u.managementClusterClient.Get(context.TODO(), key, &machineDeployment); err != nil {
-			return errors.Wrapf(err, "error getting machine deployment %q", u.name)
+		if err := u.upgradeMachineDeployments(batch.machineDeployments); err != nil {
+			return err
 		}
 
-		if machineDeployment.Labels == nil {
-			return errors.Errorf("machine deployment is missing the %q label", clusterv1.MachineClusterLabelName)
+		// The autoscaler sizes are only restored once the batch rolled out
+		if len(batches) == 1 && len(pinned) == 0 {
+			break
 		}
-		if machineDeploymentCluster := machineDeployment.Labels[clusterv1.MachineClusterLabelName]; machineDeploymentCluster != u.clusterName {
-			return errors.Errorf("machine deployment belongs to a different cluster (%q)", machineDeploymentCluster)
+
+		// TODO extract timeout as a configurable constant
+		if err := u.waitForRollout(batch.machineDeployments, machineDeploymentRolloutTimeout); err != nil {
+			return err
+		}
+		u.record.event("Machine deployment batch %d/%d rolled out", i+1, len(batches))
+
+		if err := u.restoreBatchAutoscalerBounds(pinned); err != nil {
+			return err
 		}
+		u.budget.observe(time.Since(started))
 
-		machineDeployments = &clusterv1.MachineDeploymentList{Items: []clusterv1.MachineDeployment{machineDeployment}}
+		if i < len(batches)-1 && (batch.pause || u.pauseBetweenBatches) {
+			if err := u.waitForApproval(i + 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	u.record.event("Upgrade completed")
+	return nil
+}
+
+// SetVersion only sets the version and image of the selected machine deployments' templates, leaving Cluster API to
+// roll their machines out. Batches are ignored and nothing is waited for.
+func (u *MachineDeploymentUpgrader) SetVersion() error {
+	machineDeployments, err := u.selectMachineDeployments()
+	if err != nil {
+		return err
+	}
+	if err := u.checkVersionOverrides(machineDeployments); err != nil {
+		return err
+	}
+	if err := u.checkImages(machineDeployments); err != nil {
+		return err
+	}
+	recordDesiredVersion(u.log, u.managementClusterClient, u.warnings, u.clusterNamespace, u.clusterName, u.desiredVersion)
+
+	for i := range machineDeployments {
+		machineDeployment := &machineDeployments[i]
+		u.log.Info("Setting MachineDeployment version", "namespace", machineDeployment.Namespace, "name", machineDeployment.Name, "version", u.targetVersion(machineDeployment).String())
+
+		patch := ctrlclient.MergeFrom(machineDeployment.DeepCopy())
+		if err := u.setTemplateVersion(machineDeployment); err != nil {
+			return err
+		}
+		if err := u.managementClusterClient.Patch(context.TODO(), machineDeployment, patch); err != nil {
+			return errors.Wrapf(err, "error patching machinedeployment %s", machineDeployment.Name)
+		}
+	}
+
+	return nil
+}
+
+// selectMachineDeployments returns the machine deployments to upgrade, leaving out those with pinned machines, and
+// resolves the desired version if it is an alias.
+func (u *MachineDeploymentUpgrader) selectMachineDeployments() ([]clusterv1.MachineDeployment, error) {
+	var (
+		machineDeployments *clusterv1.MachineDeploymentList
+		err                error
+	)
+
+	if len(u.names) > 0 {
+		machineDeployments = &clusterv1.MachineDeploymentList{}
+		for _, name := range u.names {
+			machineDeployment, err := u.getMachineDeployment(name)
+			if err != nil {
+				return nil, err
+			}
+			machineDeployments.Items = append(machineDeployments.Items, *machineDeployment)
+		}
 	} else {
 		machineDeployments, err = u.listMachineDeployments()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	if machineDeployments == nil || len(machineDeployments.Items) == 0 {
-		return errors.New("Found 0 machine deployments")
+		return nil, errors.New("Found 0 machine deployments")
 	}
 
-	return u.upgradeMachineDeployments(machineDeployments)
+	items, err := u.skipPinnedMachineDeployments(machineDeployments.Items)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.New("Found 0 machine deployments without pinned machines")
+	}
+
+	if u.versionSource != nil {
+		if err := u.resolveLatestPatch(); err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+// Warnings returns the non-fatal findings made so far by Upgrade.
+func (u *MachineDeploymentUpgrader) Warnings() []Warning {
+	return u.warnings.list()
+}
+
+// Report returns the report of the run so far, including its warnings.
+func (u *MachineDeploymentUpgrader) Report() RunReport {
+	return u.record.finish(u.Warnings())
+}
+
+// machineDeploymentVersions returns the versions of the machineDeployments' templates.
+func machineDeploymentVersions(machineDeployments []clusterv1.MachineDeployment) []string {
+	var versions []string
+	for _, md := range machineDeployments {
+		if md.Spec.Template.Spec.Version != nil {
+			versions = append(versions, *md.Spec.Template.Spec.Version)
+		}
+	}
+	return versions
+}
+
+func (u *MachineDeploymentUpgrader) getMachineDeployment(name string) (*clusterv1.MachineDeployment, error) {
+	key := ctrlclient.ObjectKey{
+		Namespace: u.clusterNamespace,
+		Name:      name,
+	}
+
+	var machineDeployment clusterv1.MachineDeployment
+
+	if err := u.managementClusterClient.Get(context.TODO(), key, &machineDeployment); err != nil {
+		return nil, errors.Wrapf(err, "error getting machine deployment %q", name)
+	}
+
+	if machineDeployment.Labels == nil {
+		return nil, errors.Errorf("machine deployment %q is missing the %q label", name, clusterv1.MachineClusterLabelName)
+	}
+	if machineDeploymentCluster := machineDeployment.Labels[clusterv1.MachineClusterLabelName]; machineDeploymentCluster != u.clusterName {
+		return nil, errors.Errorf("machine deployment %q belongs to a different cluster (%q)", name, machineDeploymentCluster)
+	}
+
+	return &machineDeployment, nil
 }
 
 func (u *MachineDeploymentUpgrader) listMachineDeployments() (*clusterv1.MachineDeploymentList, error) {
@@ -170,16 +575,26 @@ func (u *MachineDeploymentUpgrader) listMachineDeployments() (*clusterv1.Machine
 	return list, nil
 }
 
-func (u *MachineDeploymentUpgrader) upgradeMachineDeployments(list *clusterv1.MachineDeploymentList) error {
-	for _, machineDeployment := range list.Items {
+func (u *MachineDeploymentUpgrader) upgradeMachineDeployments(machineDeployments []clusterv1.MachineDeployment) error {
+	for _, machineDeployment := range machineDeployments {
 		// Skip any machineDeployments that already have this upgrade annotation id
 		if val, ok := machineDeployment.Spec.Template.Annotations[AnnotationUpgradeID]; ok && val == u.upgradeID {
+			u.record.machinePhase(machineDeployment.Name, MachinePhaseRollingOut)
+			continue
+		}
+		// Machine deployments held back at their version are not rolled out
+		if _, ok := u.versionOverrides[machineDeployment.Name]; ok && machineDeployment.Spec.Template.Spec.Version != nil &&
+			versionMatches(*machineDeployment.Spec.Template.Spec.Version, u.targetVersion(&machineDeployment)) {
+			u.log.Info("Keeping MachineDeployment at its version", "namespace", machineDeployment.Namespace, "name", machineDeployment.Name, "version", *machineDeployment.Spec.Template.Spec.Version)
 			continue
 		}
+		u.record.machinePhase(machineDeployment.Name, MachinePhaseUpdating)
 		if err := u.updateMachineDeployment(&machineDeployment); err != nil {
 			u.log.Error(err, "Failed to create new MachineDeployment", "namespace", machineDeployment.Namespace, "name", machineDeployment.Name)
+			u.record.machinePhase(machineDeployment.Name, MachinePhaseFailed)
 			return err
 		}
+		u.record.machinePhase(machineDeployment.Name, MachinePhaseRollingOut)
 	}
 	return nil
 }
@@ -191,8 +606,9 @@ func (u *MachineDeploymentUpgrader) updateMachineDeployment(machineDeployment *c
 	patch := ctrlclient.MergeFrom(machineDeployment.DeepCopy())
 
 	// Make the modification(s)
-	desiredVersion := u.desiredVersion.String()
-	machineDeployment.Spec.Template.Spec.Version = &desiredVersion
+	if err := u.setTemplateVersion(machineDeployment); err != nil {
+		return err
+	}
 
 	// Add the upgrade ID to this template so all machines get it
 	if machineDeployment.Spec.Template.Annotations == nil {
@@ -200,16 +616,138 @@ func (u *MachineDeploymentUpgrader) updateMachineDeployment(machineDeployment *c
 	}
 	machineDeployment.Spec.Template.Annotations[AnnotationUpgradeID] = u.upgradeID
 
-	if u.imageField != "" && u.imageID != "" {
-		if err := updateMachineSpecImage(&machineDeployment.Spec.Template.Spec, u.imageField, u.imageID); err != nil {
+	// Get the updated version in json
+	if err := u.managementClusterClient.Patch(context.TODO(), machineDeployment, patch); err != nil {
+		return errors.Wrapf(err, "error patching machinedeployment %s", machineDeployment.Name)
+	}
+	u.record.updated(machineDeployment.Name)
+
+	return nil
+}
+
+// setTemplateVersion sets the target version on machineDeployment's template, and its image, if any.
+func (u *MachineDeploymentUpgrader) setTemplateVersion(machineDeployment *clusterv1.MachineDeployment) error {
+	target := u.targetVersion(machineDeployment)
+	targetVersion := target.String()
+	machineDeployment.Spec.Template.Spec.Version = &targetVersion
+
+	image, ok, err := u.templateImage(machineDeployment)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := updateMachineSpecImage(&machineDeployment.Spec.Template.Spec, u.imageField, image); err != nil {
 			return err
 		}
 	}
 
-	// Get the updated version in json
-	if err := u.managementClusterClient.Patch(context.TODO(), machineDeployment, patch); err != nil {
-		return errors.Wrapf(err, "error patching machinedeployment %s", machineDeployment.Name)
+	return nil
+}
+
+// templateImage returns the image machineDeployment's template is set to: the image lookup format expanded for its
+// target version, or the image ID if its target version is the desired version. The returned bool is false if its
+// image is left alone.
+func (u *MachineDeploymentUpgrader) templateImage(machineDeployment *clusterv1.MachineDeployment) (string, bool, error) {
+	if u.imageField == "" {
+		return "", false, nil
+	}
+	target := u.targetVersion(machineDeployment)
+	if u.imageID == "" && u.imageLookupFormat != "" {
+		kind := machineDeployment.Spec.Template.Spec.InfrastructureRef.Kind
+		image, err := providerAdapterForKind(kind).lookupImage(u.imageLookupFormat, kind, target)
+		if err != nil {
+			return "", false, err
+		}
+		return image, true, nil
+	}
+	if u.imageID != "" && target.EQ(u.desiredVersion) {
+		return u.imageID, true, nil
+	}
+	return "", false, nil
+}
+
+// waitForRollout waits until all replicas of each machine deployment have been updated and are available.
+func (u *MachineDeploymentUpgrader) waitForRollout(machineDeployments []clusterv1.MachineDeployment, timeout time.Duration) error {
+	pending := sets.NewString(machineDeploymentNames(machineDeployments)...)
+
+	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+		for _, name := range pending.List() {
+			var machineDeployment clusterv1.MachineDeployment
+			key := ctrlclient.ObjectKey{Namespace: u.clusterNamespace, Name: name}
+			if err := u.managementClusterClient.Get(context.TODO(), key, &machineDeployment); err != nil {
+				u.log.Error(err, "Error getting machine deployment, will try again", "name", name)
+				return false, nil
+			}
+
+			if !machineDeploymentRolledOut(&machineDeployment) {
+				u.log.Info("Waiting for machine deployment rollout", "name", name,
+					"updated-replicas", machineDeployment.Status.UpdatedReplicas,
+					"available-replicas", machineDeployment.Status.AvailableReplicas,
+				)
+				return false, nil
+			}
+			pending.Delete(name)
+			u.record.machinePhase(name, MachinePhaseRolledOut)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "timed out waiting for machine deployments %v to roll out", pending.List())
+	}
+
+	return nil
+}
+
+// machineDeploymentRolledOut returns true if the controller has observed the latest spec and all desired replicas
+// are updated and available.
+func machineDeploymentRolledOut(md *clusterv1.MachineDeployment) bool {
+	desired := int32(1)
+	if md.Spec.Replicas != nil {
+		desired = *md.Spec.Replicas
+	}
+
+	return md.Status.ObservedGeneration >= md.Generation &&
+		md.Status.UpdatedReplicas == desired &&
+		md.Status.AvailableReplicas == desired &&
+		md.Status.Replicas == desired
+}
+
+// waitForApproval blocks until the operator approves continuing past the given batch.
+func (u *MachineDeploymentUpgrader) waitForApproval(batch int) error {
+	fmt.Fprintf(u.approvalOut, "Batch %d has been upgraded. Type \"yes\" to continue with the next batch: ", batch)
+
+	answer, err := bufio.NewReader(u.approvalIn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "error reading approval")
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.Errorf("upgrade stopped after batch %d; rerun with the same --upgrade-id to continue", batch)
+	}
+
+	return nil
+}
+
+// resolveLatestPatch sets the desired version to the newest patch release of the control plane's minor version.
+func (u *MachineDeploymentUpgrader) resolveLatestPatch() error {
+	machines, err := listControlPlaneMachines(u.log, u.managementClusterClient, u.clusterNamespace, u.clusterName)
+	if err != nil {
+		return err
+	}
+
+	_, max, err := minMaxMachineVersions(machines)
+	if err != nil {
+		return errors.Wrap(err, "error determining current control plane versions")
+	}
+	if max.EQ(unsetVersion) {
+		return errors.New("unable to determine the control plane version")
+	}
+
+	v, err := resolveVersionAlias(VersionLatestPatch, max, u.versionSource)
+	if err != nil {
+		return errors.Wrapf(err, "error resolving kubernetes version %q", VersionLatestPatch)
 	}
+	u.log.Info("Resolved kubernetes version", "alias", VersionLatestPatch, "control-plane-version", max.String(), "version", v.String())
+	u.desiredVersion = v
 
 	return nil
 }
@@ -0,0 +1,133 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// machineDeploymentBatch selects the machine deployments to upgrade together.
+type machineDeploymentBatch struct {
+	names    sets.String
+	selector labels.Selector
+	pause    bool
+}
+
+// selects returns true if the batch selects md by name or label.
+func (b *machineDeploymentBatch) selects(md *clusterv1.MachineDeployment) bool {
+	return b.names.Has(md.Name) || (b.selector != nil && b.selector.Matches(labels.Set(md.Labels)))
+}
+
+// plannedMachineDeploymentBatch is a batch with its selected machine deployments.
+type plannedMachineDeploymentBatch struct {
+	machineDeployments []clusterv1.MachineDeployment
+	pause              bool
+}
+
+// ParseMachineDeploymentBatch parses a batch of the form "names=md-1,md-2" or "selector=<label selector>".
+func ParseMachineDeploymentBatch(s string) (MachineDeploymentBatchConfig, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return MachineDeploymentBatchConfig{}, errors.Errorf("invalid machine deployment batch %q: must be names=<names> or selector=<label selector>", s)
+	}
+
+	switch parts[0] {
+	case "names":
+		return MachineDeploymentBatchConfig{Names: strings.Split(parts[1], ",")}, nil
+	case "selector":
+		return MachineDeploymentBatchConfig{LabelSelector: parts[1]}, nil
+	default:
+		return MachineDeploymentBatchConfig{}, errors.Errorf("invalid machine deployment batch %q: must be names=<names> or selector=<label selector>", s)
+	}
+}
+
+func parseMachineDeploymentBatches(configs []MachineDeploymentBatchConfig) ([]machineDeploymentBatch, error) {
+	var batches []machineDeploymentBatch
+	for i, config := range configs {
+		if (len(config.Names) == 0) == (config.LabelSelector == "") {
+			return nil, errors.Errorf("machine deployment batch %d must specify exactly one of names and label selector", i+1)
+		}
+
+		batch := machineDeploymentBatch{
+			names: sets.NewString(config.Names...),
+			pause: config.Pause,
+		}
+		if config.LabelSelector != "" {
+			selector, err := labels.Parse(config.LabelSelector)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error parsing label selector for machine deployment batch %d", i+1)
+			}
+			batch.selector = selector
+		}
+
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// planMachineDeploymentBatches assigns each machine deployment to the first batch that selects it. Machine deployments
+// not selected by any batch form a final batch. Empty batches are dropped.
+func planMachineDeploymentBatches(machineDeployments []clusterv1.MachineDeployment, batches []machineDeploymentBatch) []plannedMachineDeploymentBatch {
+	assigned := sets.NewString()
+
+	var planned []plannedMachineDeploymentBatch
+	for _, batch := range batches {
+		current := plannedMachineDeploymentBatch{pause: batch.pause}
+		for _, md := range machineDeployments {
+			if assigned.Has(md.Name) {
+				continue
+			}
+			if batch.selects(&md) {
+				current.machineDeployments = append(current.machineDeployments, md)
+				assigned.Insert(md.Name)
+			}
+		}
+		if len(current.machineDeployments) > 0 {
+			planned = append(planned, current)
+		}
+	}
+
+	rest := plannedMachineDeploymentBatch{}
+	for _, md := range machineDeployments {
+		if !assigned.Has(md.Name) {
+			rest.machineDeployments = append(rest.machineDeployments, md)
+		}
+	}
+	if len(rest.machineDeployments) > 0 {
+		planned = append(planned, rest)
+	}
+
+	return planned
+}
+
+// emptyMachineDeploymentBatches returns the 1-based indexes of the batches that select none of machineDeployments.
+func emptyMachineDeploymentBatches(machineDeployments []clusterv1.MachineDeployment, batches []machineDeploymentBatch) []int {
+	var empty []int
+	for i := range batches {
+		found := false
+		for j := range machineDeployments {
+			if batches[i].selects(&machineDeployments[j]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			empty = append(empty, i+1)
+		}
+	}
+	return empty
+}
+
+func machineDeploymentNames(machineDeployments []clusterv1.MachineDeployment) []string {
+	names := make([]string, 0, len(machineDeployments))
+	for _, md := range machineDeployments {
+		names = append(names, md.Name)
+	}
+	return names
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestParseMachineDeploymentBatch(t *testing.T) {
+	batch, err := ParseMachineDeploymentBatch("names=canary,gpu")
+	require.NoError(t, err)
+	assert.Equal(t, MachineDeploymentBatchConfig{Names: []string{"canary", "gpu"}}, batch)
+
+	batch, err = ParseMachineDeploymentBatch("selector=tier=frontend")
+	require.NoError(t, err)
+	assert.Equal(t, MachineDeploymentBatchConfig{LabelSelector: "tier=frontend"}, batch)
+
+	_, err = ParseMachineDeploymentBatch("canary")
+	assert.Error(t, err)
+
+	_, err = ParseMachineDeploymentBatch("labels=tier=frontend")
+	assert.Error(t, err)
+}
+
+func TestPlanMachineDeploymentBatches(t *testing.T) {
+	md := func(name string, labels map[string]string) clusterv1.MachineDeployment {
+		return clusterv1.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+
+	machineDeployments := []clusterv1.MachineDeployment{
+		md("canary", nil),
+		md("frontend-1", map[string]string{"tier": "frontend"}),
+		md("backend-1", map[string]string{"tier": "backend"}),
+		md("frontend-2", map[string]string{"tier": "frontend"}),
+	}
+
+	batches, err := parseMachineDeploymentBatches([]MachineDeploymentBatchConfig{
+		{Names: []string{"canary"}, Pause: true},
+		{LabelSelector: "tier=frontend"},
+		{Names: []string{"does-not-exist"}},
+	})
+	require.NoError(t, err)
+
+	planned := planMachineDeploymentBatches(machineDeployments, batches)
+	require.Len(t, planned, 3)
+	assert.Equal(t, []string{"canary"}, machineDeploymentNames(planned[0].machineDeployments))
+	assert.True(t, planned[0].pause)
+	assert.Equal(t, []string{"frontend-1", "frontend-2"}, machineDeploymentNames(planned[1].machineDeployments))
+	assert.Equal(t, []string{"backend-1"}, machineDeploymentNames(planned[2].machineDeployments))
+	assert.Equal(t, []int{3}, emptyMachineDeploymentBatches(machineDeployments, batches))
+
+	planned = planMachineDeploymentBatches(machineDeployments, nil)
+	require.Len(t, planned, 1)
+	assert.Len(t, planned[0].machineDeployments, 4)
+
+	_, err = parseMachineDeploymentBatches([]MachineDeploymentBatchConfig{{Names: []string{"a"}, LabelSelector: "b=c"}})
+	assert.Error(t, err)
+}
+
+func TestMachineDeploymentRolledOut(t *testing.T) {
+	replicas := int32(2)
+	md := &clusterv1.MachineDeployment{
+		ObjectMeta: metav1.ObjectMeta{Generation: 2},
+		Spec:       clusterv1.MachineDeploymentSpec{Replicas: &replicas},
+		Status: clusterv1.MachineDeploymentStatus{
+			ObservedGeneration: 2,
+			Replicas:           3,
+			UpdatedReplicas:    2,
+			AvailableReplicas:  2,
+		},
+	}
+	assert.False(t, machineDeploymentRolledOut(md), "old replica still present")
+
+	md.Status.Replicas = 2
+	assert.True(t, machineDeploymentRolledOut(md))
+
+	md.Status.ObservedGeneration = 1
+	assert.False(t, machineDeploymentRolledOut(md), "new spec not observed")
+}
@@ -0,0 +1,259 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// resources are amounts of CPU, in millicores, and memory, in bytes.
+type resources struct {
+	cpu    int64
+	memory int64
+}
+
+func (r resources) add(o resources) resources {
+	return resources{cpu: r.cpu + o.cpu, memory: r.memory + o.memory}
+}
+
+func (r resources) sub(o resources) resources {
+	return resources{cpu: r.cpu - o.cpu, memory: r.memory - o.memory}
+}
+
+// fits returns true if r is no more than o in both CPU and memory.
+func (r resources) fits(o resources) bool {
+	return r.cpu <= o.cpu && r.memory <= o.memory
+}
+
+func (r resources) String() string {
+	return fmt.Sprintf("%dm CPU, %dMi memory", r.cpu, r.memory/(1<<20))
+}
+
+// resourceList converts the CPU and memory of list to resources.
+func resourceList(list v1.ResourceList) resources {
+	return resources{cpu: list.Cpu().MilliValue(), memory: list.Memory().Value()}
+}
+
+// podRequests returns the resources requested by the containers of pod, or its largest init container if that is more.
+func podRequests(pod *v1.Pod) resources {
+	var requests resources
+	for _, c := range pod.Spec.Containers {
+		requests = requests.add(resourceList(c.Resources.Requests))
+	}
+	for _, c := range pod.Spec.InitContainers {
+		init := resourceList(c.Resources.Requests)
+		if init.cpu > requests.cpu {
+			requests.cpu = init.cpu
+		}
+		if init.memory > requests.memory {
+			requests.memory = init.memory
+		}
+	}
+	return requests
+}
+
+// schedulableNode returns true if workloads can be scheduled on node: it is not cordoned nor tainted NoSchedule or
+// NoExecute, which leaves out control plane nodes.
+func schedulableNode(node *v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == v1.TaintEffectNoSchedule || taint.Effect == v1.TaintEffectNoExecute {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeRequests returns the resources requested by the pods of pods, which are not finished, by node name.
+func nodeRequests(pods []v1.Pod) map[string]resources {
+	requested := make(map[string]resources)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		requested[pod.Spec.NodeName] = requested[pod.Spec.NodeName].add(podRequests(pod))
+	}
+	return requested
+}
+
+// clusterHeadroom returns the allocatable resources of the schedulable nodes of nodes that are not requested by pods,
+// as given by nodeRequests.
+func clusterHeadroom(nodes []v1.Node, requested map[string]resources) resources {
+	var headroom resources
+	for i := range nodes {
+		node := &nodes[i]
+		if !schedulableNode(node) {
+			continue
+		}
+		headroom = headroom.add(resourceList(node.Status.Allocatable).sub(requested[node.Name]))
+	}
+	return headroom
+}
+
+// rollingUpdateMachines returns how many machines md creates beyond its replicas, and how many of its machines may be
+// unavailable, during a rolling update.
+func rollingUpdateMachines(md *clusterv1.MachineDeployment) (int, int, error) {
+	replicas := 1
+	if md.Spec.Replicas != nil {
+		replicas = int(*md.Spec.Replicas)
+	}
+	// The Cluster API defaults
+	maxSurge := intstr.FromInt(1)
+	maxUnavailable := intstr.FromInt(0)
+	if md.Spec.Strategy != nil && md.Spec.Strategy.RollingUpdate != nil {
+		rollingUpdate := md.Spec.Strategy.RollingUpdate
+		if rollingUpdate.MaxSurge != nil {
+			maxSurge = *rollingUpdate.MaxSurge
+		}
+		if rollingUpdate.MaxUnavailable != nil {
+			maxUnavailable = *rollingUpdate.MaxUnavailable
+		}
+	}
+
+	surge, err := intstr.GetValueFromIntOrPercent(&maxSurge, replicas, true)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid max surge of machine deployment %s", md.Name)
+	}
+	unavailable, err := intstr.GetValueFromIntOrPercent(&maxUnavailable, replicas, false)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid max unavailable of machine deployment %s", md.Name)
+	}
+	if unavailable > replicas {
+		unavailable = replicas
+	}
+	return surge, unavailable, nil
+}
+
+// machineDeploymentCapacity is what rolling a machine deployment out takes: the machines it creates beyond its
+// replicas, and the requests of the pods its unavailable machines displace onto other nodes.
+type machineDeploymentCapacity struct {
+	surge     int
+	displaced resources
+}
+
+// splitByCapacity splits batch into consecutive batches, in order, whose machine deployments together create no more
+// than quota machines beyond their replicas, when quota is positive, and displace no more than headroom. Only the last
+// batch keeps the pause of batch. Machine deployments that do not fit on their own are upgraded alone, and returned.
+func splitByCapacity(batch plannedMachineDeploymentBatch, capacities map[string]machineDeploymentCapacity, quota int, headroom resources) ([]plannedMachineDeploymentBatch, []string) {
+	var (
+		split     []plannedMachineDeploymentBatch
+		oversized []string
+		current   plannedMachineDeploymentBatch
+		surge     int
+		displaced resources
+	)
+	fits := func(surge int, displaced resources) bool {
+		return (quota <= 0 || surge <= quota) && displaced.fits(headroom)
+	}
+
+	for _, md := range batch.machineDeployments {
+		c := capacities[md.Name]
+		if !fits(c.surge, c.displaced) {
+			oversized = append(oversized, md.Name)
+		}
+		if len(current.machineDeployments) > 0 && !fits(surge+c.surge, displaced.add(c.displaced)) {
+			split = append(split, current)
+			current, surge, displaced = plannedMachineDeploymentBatch{}, 0, resources{}
+		}
+		current.machineDeployments = append(current.machineDeployments, md)
+		surge += c.surge
+		displaced = displaced.add(c.displaced)
+	}
+	if len(current.machineDeployments) > 0 {
+		current.pause = batch.pause
+		split = append(split, current)
+	}
+	return split, oversized
+}
+
+// fitCapacity splits batches so that each one fits the surge quota and the headroom of the target cluster, reporting
+// machine deployments that do not fit on their own as warnings. A machine deployment displaces, for each machine it
+// may have unavailable, the requests of its busiest node.
+func (u *MachineDeploymentUpgrader) fitCapacity(batches []plannedMachineDeploymentBatch) ([]plannedMachineDeploymentBatch, error) {
+	nodes, err := u.targetKubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing nodes")
+	}
+	pods, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing pods")
+	}
+	requested := nodeRequests(pods.Items)
+	headroom := clusterHeadroom(nodes.Items, requested)
+	u.log.Info("Computed cluster headroom", "headroom", headroom.String(), "surge-quota", u.surgeQuota)
+
+	capacities := make(map[string]machineDeploymentCapacity)
+	for _, batch := range batches {
+		for i := range batch.machineDeployments {
+			md := &batch.machineDeployments[i]
+			surge, unavailable, err := rollingUpdateMachines(md)
+			if err != nil {
+				return nil, err
+			}
+			busiest, err := u.busiestNodeRequests(md, requested)
+			if err != nil {
+				return nil, err
+			}
+			capacities[md.Name] = machineDeploymentCapacity{
+				surge:     surge,
+				displaced: resources{cpu: busiest.cpu * int64(unavailable), memory: busiest.memory * int64(unavailable)},
+			}
+		}
+	}
+
+	var planned []plannedMachineDeploymentBatch
+	for _, batch := range batches {
+		split, oversized := splitByCapacity(batch, capacities, u.surgeQuota, headroom)
+		for _, name := range oversized {
+			c := capacities[name]
+			u.warnings.add(WarningInsufficientCapacity, name,
+				"machine deployment %s may stall rolling out: it creates %d machines beyond its replicas (quota %d) and displaces %s (headroom %s)",
+				name, c.surge, u.surgeQuota, c.displaced, headroom)
+		}
+		if len(split) > 1 {
+			u.log.Info("Split machine deployment batch to fit capacity", "machine-deployments", machineDeploymentNames(batch.machineDeployments), "batches", len(split))
+		}
+		planned = append(planned, split...)
+	}
+	return planned, nil
+}
+
+// busiestNodeRequests returns the largest requests, among the nodes of the machines of md, as given by requested.
+func (u *MachineDeploymentUpgrader) busiestNodeRequests(md *clusterv1.MachineDeployment, requested map[string]resources) (resources, error) {
+	selector, err := metav1.LabelSelectorAsSelector(&md.Spec.Selector)
+	if err != nil {
+		return resources{}, errors.Wrapf(err, "invalid selector of machine deployment %s", md.Name)
+	}
+	machines := &clusterv1.MachineList{}
+	err = u.managementClusterClient.List(context.TODO(), machines, ctrlclient.InNamespace(md.Namespace), ctrlclient.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return resources{}, errors.Wrapf(err, "error listing machines of machine deployment %s", md.Name)
+	}
+
+	var busiest resources
+	for _, m := range machines.Items {
+		if m.Status.NodeRef == nil {
+			continue
+		}
+		r := requested[m.Status.NodeRef.Name]
+		if r.cpu > busiest.cpu {
+			busiest.cpu = r.cpu
+		}
+		if r.memory > busiest.memory {
+			busiest.memory = r.memory
+		}
+	}
+	return busiest, nil
+}
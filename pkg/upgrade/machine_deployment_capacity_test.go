@@ -0,0 +1,140 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func requests(cpu, memory string) v1.ResourceList {
+	return v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu), v1.ResourceMemory: resource.MustParse(memory)}
+}
+
+func TestClusterHeadroom(t *testing.T) {
+	pod := func(node string, phase v1.PodPhase, cpu, memory string) v1.Pod {
+		return v1.Pod{
+			Spec: v1.PodSpec{
+				NodeName:       node,
+				Containers:     []v1.Container{{Resources: v1.ResourceRequirements{Requests: requests(cpu, memory)}}},
+				InitContainers: []v1.Container{{Resources: v1.ResourceRequirements{Requests: requests("100m", "4Gi")}}},
+			},
+			Status: v1.PodStatus{Phase: phase},
+		}
+	}
+	node := func(name string, taint bool) v1.Node {
+		n := v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     v1.NodeStatus{Allocatable: requests("4", "16Gi")},
+		}
+		if taint {
+			n.Spec.Taints = []v1.Taint{{Key: "node-role.kubernetes.io/master", Effect: v1.TaintEffectNoSchedule}}
+		}
+		return n
+	}
+
+	requested := nodeRequests([]v1.Pod{
+		pod("worker-1", v1.PodRunning, "1", "2Gi"),
+		pod("worker-1", v1.PodRunning, "500m", "1Gi"),
+		pod("worker-1", v1.PodSucceeded, "2", "2Gi"),
+		pod("worker-2", v1.PodPending, "2", "1Gi"),
+		pod("", v1.PodPending, "2", "1Gi"),
+		pod("master", v1.PodRunning, "1", "1Gi"),
+	})
+	// The init container requests more memory than the containers
+	assert.Equal(t, resources{cpu: 1500, memory: 8 << 30}, requested["worker-1"])
+	assert.Equal(t, resources{cpu: 2000, memory: 4 << 30}, requested["worker-2"])
+
+	headroom := clusterHeadroom([]v1.Node{node("worker-1", false), node("worker-2", false), node("master", true)}, requested)
+	assert.Equal(t, resources{cpu: 4500, memory: 20 << 30}, headroom)
+}
+
+func TestRollingUpdateMachines(t *testing.T) {
+	md := func(replicas int32, maxSurge, maxUnavailable *intstr.IntOrString) *clusterv1.MachineDeployment {
+		m := &clusterv1.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: "md"}}
+		m.Spec.Replicas = &replicas
+		if maxSurge != nil || maxUnavailable != nil {
+			m.Spec.Strategy = &clusterv1.MachineDeploymentStrategy{
+				RollingUpdate: &clusterv1.MachineRollingUpdateDeployment{MaxSurge: maxSurge, MaxUnavailable: maxUnavailable},
+			}
+		}
+		return m
+	}
+	percent := func(s string) *intstr.IntOrString {
+		v := intstr.FromString(s)
+		return &v
+	}
+	count := func(i int) *intstr.IntOrString {
+		v := intstr.FromInt(i)
+		return &v
+	}
+
+	testcases := []struct {
+		name        string
+		md          *clusterv1.MachineDeployment
+		surge       int
+		unavailable int
+	}{
+		{name: "defaults", md: md(5, nil, nil), surge: 1, unavailable: 0},
+		{name: "counts", md: md(5, count(2), count(1)), surge: 2, unavailable: 1},
+		{name: "percentages round surge up and unavailable down", md: md(5, percent("30%"), percent("30%")), surge: 2, unavailable: 1},
+		{name: "unavailable capped at replicas", md: md(2, count(0), count(5)), surge: 0, unavailable: 2},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			surge, unavailable, err := rollingUpdateMachines(tc.md)
+			require.NoError(t, err)
+			assert.Equal(t, tc.surge, surge)
+			assert.Equal(t, tc.unavailable, unavailable)
+		})
+	}
+
+	_, _, err := rollingUpdateMachines(md(5, percent("lots"), nil))
+	assert.Error(t, err)
+}
+
+func TestSplitByCapacity(t *testing.T) {
+	batch := plannedMachineDeploymentBatch{pause: true}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		batch.machineDeployments = append(batch.machineDeployments, clusterv1.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	capacities := map[string]machineDeploymentCapacity{
+		"a": {surge: 2},
+		"b": {surge: 1},
+		"c": {surge: 1, displaced: resources{cpu: 3000}},
+		"d": {surge: 5},
+		"e": {surge: 1},
+	}
+	names := func(batches []plannedMachineDeploymentBatch) [][]string {
+		var out [][]string
+		for _, b := range batches {
+			out = append(out, machineDeploymentNames(b.machineDeployments))
+		}
+		return out
+	}
+
+	split, oversized := splitByCapacity(batch, capacities, 3, resources{cpu: 4000, memory: 1 << 30})
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}, {"d"}, {"e"}}, names(split))
+	assert.Equal(t, []string{"d"}, oversized)
+	// Only the last batch pauses
+	assert.False(t, split[0].pause)
+	assert.True(t, split[3].pause)
+
+	// The headroom limits too
+	split, oversized = splitByCapacity(batch, capacities, 0, resources{cpu: 2000, memory: 1 << 30})
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}, {"d", "e"}}, names(split))
+	assert.Equal(t, []string{"c"}, oversized)
+
+	// Everything fits
+	split, oversized = splitByCapacity(batch, capacities, 0, resources{cpu: 4000, memory: 1 << 30})
+	assert.Equal(t, [][]string{{"a", "b", "c", "d", "e"}}, names(split))
+	assert.Empty(t, oversized)
+}
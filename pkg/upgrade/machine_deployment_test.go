@@ -0,0 +1,73 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestSetTemplateVersion(t *testing.T) {
+	oldVersion := "v1.15.3"
+	md := &clusterv1.MachineDeployment{}
+	md.Spec.Template.Spec.Version = &oldVersion
+	md.Spec.Template.Spec.InfrastructureRef = corev1.ObjectReference{Name: "foo"}
+
+	u := &MachineDeploymentUpgrader{
+		desiredVersion: semver.MustParse("1.15.4"),
+		imageField:     "infrastructureRef.name",
+		imageID:        "bar",
+	}
+	require.NoError(t, u.setTemplateVersion(md))
+
+	require.NotNil(t, md.Spec.Template.Spec.Version)
+	assert.Equal(t, "1.15.4", *md.Spec.Template.Spec.Version)
+	assert.Equal(t, "bar", md.Spec.Template.Spec.InfrastructureRef.Name)
+	assert.Empty(t, md.Spec.Template.Annotations, "only the version and image are set")
+}
+
+func TestSetTemplateVersionOverride(t *testing.T) {
+	oldVersion := "v1.14.9"
+	md := &clusterv1.MachineDeployment{}
+	md.Name = "gpu-pool"
+	md.Spec.Template.Spec.Version = &oldVersion
+	md.Spec.Template.Spec.InfrastructureRef = corev1.ObjectReference{Name: "foo"}
+
+	u := &MachineDeploymentUpgrader{
+		desiredVersion:   semver.MustParse("1.16.3"),
+		imageField:       "infrastructureRef.name",
+		imageID:          "bar",
+		versionOverrides: map[string]semver.Version{"gpu-pool": semver.MustParse("1.15.6")},
+	}
+	require.NoError(t, u.setTemplateVersion(md))
+
+	require.NotNil(t, md.Spec.Template.Spec.Version)
+	assert.Equal(t, "1.15.6", *md.Spec.Template.Spec.Version)
+	assert.Equal(t, "foo", md.Spec.Template.Spec.InfrastructureRef.Name, "the image is for the desired version")
+}
+
+func TestSetTemplateVersionImageLookupFormat(t *testing.T) {
+	oldVersion := "v1.14.9"
+	md := &clusterv1.MachineDeployment{}
+	md.Name = "gpu-pool"
+	md.Spec.Template.Spec.Version = &oldVersion
+	md.Spec.Template.Spec.InfrastructureRef = corev1.ObjectReference{Kind: "VSphereMachine", Name: "foo"}
+
+	u := &MachineDeploymentUpgrader{
+		desiredVersion:    semver.MustParse("1.16.3"),
+		imageField:        "infrastructureRef.name",
+		imageLookupFormat: "ubuntu-1804-kube-v{{.Version}}",
+		versionOverrides:  map[string]semver.Version{"gpu-pool": semver.MustParse("1.15.6")},
+	}
+	require.NoError(t, u.setTemplateVersion(md))
+
+	assert.Equal(t, "1.15.6", *md.Spec.Template.Spec.Version)
+	assert.Equal(t, "ubuntu-1804-kube-v1.15.6", md.Spec.Template.Spec.InfrastructureRef.Name, "the image is for the target version")
+}
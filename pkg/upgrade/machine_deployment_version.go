@@ -0,0 +1,125 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// parseMachineDeploymentVersions parses the versions overriding the desired version of machine deployments, by name.
+func parseMachineDeploymentVersions(versions map[string]string) (map[string]semver.Version, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+
+	ret := make(map[string]semver.Version, len(versions))
+	for _, name := range sortedKeys(versions) {
+		if name == "" {
+			return nil, errors.New("machine deployment version overrides require a machine deployment name")
+		}
+		v, err := semver.ParseTolerant(versions[name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing kubernetes version %q of machine deployment %s", versions[name], name)
+		}
+		ret[name] = v
+	}
+	return ret, nil
+}
+
+// machineDeploymentVersionProblems returns why the overridden versions of machineDeployments cannot be used with a
+// control plane whose oldest version is controlPlane: kubelets may not be newer than the API server nor more than
+// maxKubeletSkew minor versions older, and machine deployments are not downgraded.
+func machineDeploymentVersionProblems(machineDeployments []clusterv1.MachineDeployment, overrides map[string]semver.Version, controlPlane semver.Version) []string {
+	var problems []string
+	for _, md := range machineDeployments {
+		v, ok := overrides[md.Name]
+		if !ok {
+			continue
+		}
+
+		switch {
+		case v.Major != controlPlane.Major || v.Minor > controlPlane.Minor:
+			problems = append(problems, fmt.Sprintf("machine deployment %s version %s is not supported by the control plane at %s", md.Name, v, controlPlane))
+		case controlPlane.Minor-v.Minor > maxKubeletSkew:
+			problems = append(problems, fmt.Sprintf("machine deployment %s version %s is more than %d minor versions older than the control plane at %s", md.Name, v, maxKubeletSkew, controlPlane))
+		}
+
+		if md.Spec.Template.Spec.Version == nil {
+			continue
+		}
+		if current, err := semver.ParseTolerant(*md.Spec.Template.Spec.Version); err == nil && v.LT(current) {
+			problems = append(problems, fmt.Sprintf("machine deployment %s would be downgraded from %s to %s", md.Name, current, v))
+		}
+	}
+	return problems
+}
+
+// unusedMachineDeploymentVersions returns the names of the overrides that match none of machineDeployments.
+func unusedMachineDeploymentVersions(machineDeployments []clusterv1.MachineDeployment, overrides map[string]semver.Version) []string {
+	selected := make(map[string]bool, len(machineDeployments))
+	for _, md := range machineDeployments {
+		selected[md.Name] = true
+	}
+
+	var unused []string
+	for name := range overrides {
+		if !selected[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// targetVersion returns the version machineDeployment is upgraded to: its override, or the desired version.
+func (u *MachineDeploymentUpgrader) targetVersion(machineDeployment *clusterv1.MachineDeployment) semver.Version {
+	if v, ok := u.versionOverrides[machineDeployment.Name]; ok {
+		return v
+	}
+	return u.desiredVersion
+}
+
+// targetVersions returns the versions machineDeployments are upgraded to.
+func (u *MachineDeploymentUpgrader) targetVersions(machineDeployments []clusterv1.MachineDeployment) []string {
+	var versions []string
+	for i := range machineDeployments {
+		versions = append(versions, u.targetVersion(&machineDeployments[i]).String())
+	}
+	return versions
+}
+
+// checkVersionOverrides refuses version overrides of machineDeployments that break the version skew policy with the
+// control plane, and warns about overrides of machine deployments that are not upgraded.
+func (u *MachineDeploymentUpgrader) checkVersionOverrides(machineDeployments []clusterv1.MachineDeployment) error {
+	if len(u.versionOverrides) == 0 {
+		return nil
+	}
+
+	for _, name := range unusedMachineDeploymentVersions(machineDeployments, u.versionOverrides) {
+		u.warnings.add(WarningUnusedVersionOverride, name, "the version override of machine deployment %s does not match any machine deployment being upgraded", name)
+	}
+
+	machines, err := listControlPlaneMachines(u.log, u.managementClusterClient, u.clusterNamespace, u.clusterName)
+	if err != nil {
+		return err
+	}
+	min, _, err := minMaxMachineVersions(machines)
+	if err != nil {
+		return errors.Wrap(err, "error determining current control plane versions")
+	}
+	if min.EQ(unsetVersion) {
+		return errors.New("unable to determine the control plane version to check machine deployment version overrides against")
+	}
+
+	if problems := machineDeploymentVersionProblems(machineDeployments, u.versionOverrides, min); len(problems) > 0 {
+		return errors.Errorf("refusing to upgrade machine deployments: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
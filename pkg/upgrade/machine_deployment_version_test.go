@@ -0,0 +1,71 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestParseMachineDeploymentVersions(t *testing.T) {
+	versions, err := parseMachineDeploymentVersions(nil)
+	require.NoError(t, err)
+	assert.Nil(t, versions)
+
+	versions, err = parseMachineDeploymentVersions(map[string]string{"gpu-pool": "v1.15.6"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]semver.Version{"gpu-pool": semver.MustParse("1.15.6")}, versions)
+
+	_, err = parseMachineDeploymentVersions(map[string]string{"gpu-pool": "latest-patch"})
+	assert.Error(t, err)
+
+	_, err = parseMachineDeploymentVersions(map[string]string{"": "v1.15.6"})
+	assert.Error(t, err)
+}
+
+func TestMachineDeploymentVersionProblems(t *testing.T) {
+	md := func(name, version string) clusterv1.MachineDeployment {
+		m := clusterv1.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		m.Spec.Template.Spec.Version = &version
+		return m
+	}
+	controlPlane := semver.MustParse("1.16.3")
+
+	tests := []struct {
+		name     string
+		current  string
+		override string
+		problems int
+	}{
+		{name: "held back one minor", current: "v1.15.3", override: "1.15.6", problems: 0},
+		{name: "same as the control plane", current: "v1.15.3", override: "1.16.3", problems: 0},
+		{name: "newer patch than the control plane", current: "v1.15.3", override: "1.16.4", problems: 0},
+		{name: "newer minor than the control plane", current: "v1.15.3", override: "1.17.0", problems: 1},
+		{name: "too old", current: "v1.13.3", override: "1.13.4", problems: 1},
+		{name: "downgrade", current: "v1.15.3", override: "1.14.9", problems: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			overrides := map[string]semver.Version{"gpu-pool": semver.MustParse(tc.override)}
+			problems := machineDeploymentVersionProblems([]clusterv1.MachineDeployment{md("gpu-pool", tc.current), md("default", "v1.10.0")}, overrides, controlPlane)
+			assert.Len(t, problems, tc.problems, problems)
+		})
+	}
+}
+
+func TestUnusedMachineDeploymentVersions(t *testing.T) {
+	machineDeployments := []clusterv1.MachineDeployment{{ObjectMeta: metav1.ObjectMeta{Name: "gpu-pool"}}}
+	overrides := map[string]semver.Version{
+		"gpu-pool": semver.MustParse("1.15.6"),
+		"gpu-pol":  semver.MustParse("1.15.6"),
+	}
+	assert.Equal(t, []string{"gpu-pol"}, unusedMachineDeploymentVersions(machineDeployments, overrides))
+}
@@ -0,0 +1,21 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"github.com/pkg/errors"
+)
+
+// resolveFlavorField returns the field of infrastructure machines of the given kind that the configured flavor is set
+// in, the instance size field of the provider adapter. The returned bool is false if no flavor is configured.
+func resolveFlavorField(config MachineUpdateConfig, kind string) (string, bool, error) {
+	if config.Flavor == "" {
+		return "", false, nil
+	}
+	field := providerAdapterForKind(kind).defaultFlavorField()
+	if field == "" {
+		return "", false, errors.Errorf("infrastructure kind %q has no known flavor field", kind)
+	}
+	return field, true, nil
+}
@@ -4,23 +4,156 @@
 package upgrade
 
 import (
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
 )
 
+// imageFieldSegmentRegex matches an element of an image field path: a field name, optionally followed by a list index
+// or by [*] for every element of the list.
+var imageFieldSegmentRegex = regexp.MustCompile(`^([^\[\]]+)(?:\[(\*|\d+)\])?$`)
+
+// imageFieldSegment is a parsed element of an image field path such as spec.dataDisks[*].image.
+type imageFieldSegment struct {
+	name string
+	// index is the list index, or -1 if the field is not a list.
+	index    int
+	wildcard bool
+}
+
+func (s imageFieldSegment) isList() bool {
+	return s.wildcard || s.index >= 0
+}
+
+// parseImageField parses a dotted image field path whose fields may be indexed, as in spec.disks[0].image, or
+// indexed with a wildcard to replace the image in every element of a list, as in spec.dataDisks[*].image.
+func parseImageField(field string) ([]imageFieldSegment, error) {
+	if field == "" {
+		return nil, errors.New("image field is empty")
+	}
+
+	var path []imageFieldSegment
+	for _, part := range strings.Split(field, ".") {
+		match := imageFieldSegmentRegex.FindStringSubmatch(part)
+		if match == nil {
+			return nil, errors.Errorf("invalid image field %q: %q is not a field name, optionally followed by [index] or [*]", field, part)
+		}
+
+		segment := imageFieldSegment{name: match[1], index: -1}
+		switch match[2] {
+		case "":
+		case "*":
+			segment.wildcard = true
+		default:
+			index, err := strconv.Atoi(match[2])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid image field %q", field)
+			}
+			segment.index = index
+		}
+		path = append(path, segment)
+	}
+
+	return path, nil
+}
+
+// setImageField sets the values at path in obj to id and returns how many were set. Lists, and the fields leading to
+// them, must exist. Fields after the last list are created if missing, as they are for a path without lists.
+func setImageField(obj map[string]interface{}, path []imageFieldSegment, id, at string) (int, error) {
+	lastList := -1
+	for i, segment := range path {
+		if segment.isList() {
+			lastList = i
+		}
+	}
+	if lastList < 0 {
+		var names []string
+		for _, segment := range path {
+			names = append(names, segment.name)
+		}
+		if err := unstructured.SetNestedField(obj, id, names...); err != nil {
+			return 0, errors.Wrapf(err, "error setting %s", strings.TrimPrefix(at+"."+strings.Join(names, "."), "."))
+		}
+		return 1, nil
+	}
+
+	segment := path[0]
+	at = strings.TrimPrefix(at+"."+segment.name, ".")
+	value, ok := obj[segment.name]
+	if !ok {
+		return 0, errors.Errorf("%s does not exist", at)
+	}
+
+	if !segment.isList() {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, errors.Errorf("%s is not an object", at)
+		}
+		return setImageField(nested, path[1:], id, at)
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return 0, errors.Errorf("%s is not a list", at)
+	}
+
+	var indices []int
+	if segment.wildcard {
+		if len(list) == 0 {
+			return 0, errors.Errorf("%s is empty", at)
+		}
+		for i := range list {
+			indices = append(indices, i)
+		}
+	} else {
+		if segment.index >= len(list) {
+			return 0, errors.Errorf("%s has no element %d", at, segment.index)
+		}
+		indices = []int{segment.index}
+	}
+
+	set := 0
+	for _, i := range indices {
+		elementAt := at + "[" + strconv.Itoa(i) + "]"
+		if len(path) == 1 {
+			list[i] = id
+			set++
+			continue
+		}
+
+		element, ok := list[i].(map[string]interface{})
+		if !ok {
+			return 0, errors.Errorf("%s is not an object", elementAt)
+		}
+		n, err := setImageField(element, path[1:], id, elementAt)
+		if err != nil {
+			return 0, err
+		}
+		set += n
+	}
+
+	return set, nil
+}
+
 // updateMachineSpecImage replaces the value in spec specified by field with id.
 func updateMachineSpecImage(spec *clusterv1.MachineSpec, field, id string) error {
+	path, err := parseImageField(field)
+	if err != nil {
+		return err
+	}
+
 	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
 	if err != nil {
 		return errors.Wrap(err, "error converting machine spec to unstructured")
 	}
 
-	pathParts := strings.Split(field, ".")
-	if err := unstructured.SetNestedField(u, id, pathParts...); err != nil {
+	if _, err := setImageField(u, path, id, ""); err != nil {
 		return errors.Wrapf(err, "error setting machine spec field %q to %q", field, id)
 	}
 
@@ -33,3 +166,59 @@ func updateMachineSpecImage(spec *clusterv1.MachineSpec, field, id string) error
 
 	return nil
 }
+
+// updateInfrastructureImage replaces the value in the infrastructure machine obj specified by field with id.
+func updateInfrastructureImage(obj *unstructured.Unstructured, field, id string) error {
+	path, err := parseImageField(field)
+	if err != nil {
+		return err
+	}
+
+	if _, err := setImageField(obj.UnstructuredContent(), path, id, ""); err != nil {
+		return errors.Wrapf(err, "error setting %s %s field %q to %q", obj.GetKind(), obj.GetName(), field, id)
+	}
+	return nil
+}
+
+// imageFieldProblems returns the reasons the image update of each infrastructure kind cannot be applied: its field is
+// not in the schema of the kind's custom resource definition, or cannot be set on the infrastructure machine of the
+// first control plane machine of that kind. It is run before any machine is replaced.
+func (u *ControlPlaneUpgrader) imageFieldProblems(machines []*clusterv1.Machine) ([]string, error) {
+	checked := make(map[string]bool)
+
+	var problems []string
+	for _, machine := range machines {
+		ref := machine.Spec.InfrastructureRef
+		if checked[ref.Kind] {
+			continue
+		}
+		checked[ref.Kind] = true
+
+		update, ok, err := resolveImageUpdate(u.machineUpdates, ref.Kind, u.desiredVersion)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		schemaProblems, err := u.imageFieldSchemaProblems(ref, update.field)
+		if err != nil {
+			return nil, err
+		}
+		if len(schemaProblems) > 0 {
+			problems = append(problems, schemaProblems...)
+			continue
+		}
+
+		infra, err := external.Get(u.managementClusterClient, &ref, machine.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if err := updateInfrastructureImage(infra.DeepCopy(), update.field, update.id); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems, nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 )
 
@@ -26,3 +27,113 @@ func TestUpdateMachineSpecImage(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "bar", machine.Spec.InfrastructureRef.Name)
 }
+
+func TestParseImageField(t *testing.T) {
+	path, err := parseImageField("spec.dataDisks[*].image")
+	require.NoError(t, err)
+	assert.Equal(t, []imageFieldSegment{
+		{name: "spec", index: -1},
+		{name: "dataDisks", index: -1, wildcard: true},
+		{name: "image", index: -1},
+	}, path)
+
+	path, err = parseImageField("spec.disks[2].image")
+	require.NoError(t, err)
+	assert.Equal(t, 2, path[1].index)
+
+	for _, invalid := range []string{"", "spec..image", "spec.disks[].image", "spec.disks[a].image", "spec.disks[*"} {
+		_, err := parseImageField(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestUpdateInfrastructureImage(t *testing.T) {
+	newInfra := func() *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"kind": "FooMachine",
+			"spec": map[string]interface{}{
+				"image": "old",
+				"dataDisks": []interface{}{
+					map[string]interface{}{"image": "old", "size": int64(10)},
+					map[string]interface{}{"size": int64(20)},
+				},
+				"emptyDisks": []interface{}{},
+			},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		field       string
+		expected    func(obj map[string]interface{})
+		expectedErr string
+	}{
+		{
+			name:  "plain path",
+			field: "spec.image",
+			expected: func(obj map[string]interface{}) {
+				obj["spec"].(map[string]interface{})["image"] = "new"
+			},
+		},
+		{
+			name:  "missing plain field is created",
+			field: "spec.os.image",
+			expected: func(obj map[string]interface{}) {
+				obj["spec"].(map[string]interface{})["os"] = map[string]interface{}{"image": "new"}
+			},
+		},
+		{
+			name:  "list index",
+			field: "spec.dataDisks[1].image",
+			expected: func(obj map[string]interface{}) {
+				obj["spec"].(map[string]interface{})["dataDisks"].([]interface{})[1].(map[string]interface{})["image"] = "new"
+			},
+		},
+		{
+			name:  "wildcard",
+			field: "spec.dataDisks[*].image",
+			expected: func(obj map[string]interface{}) {
+				for _, disk := range obj["spec"].(map[string]interface{})["dataDisks"].([]interface{}) {
+					disk.(map[string]interface{})["image"] = "new"
+				}
+			},
+		},
+		{
+			name:        "missing list",
+			field:       "spec.disks[*].image",
+			expectedErr: "spec.disks does not exist",
+		},
+		{
+			name:        "index out of range",
+			field:       "spec.dataDisks[2].image",
+			expectedErr: "spec.dataDisks has no element 2",
+		},
+		{
+			name:        "empty list",
+			field:       "spec.emptyDisks[*].image",
+			expectedErr: "spec.emptyDisks is empty",
+		},
+		{
+			name:        "not a list",
+			field:       "spec.image[0]",
+			expectedErr: "spec.image is not a list",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			obj := newInfra()
+			err := updateInfrastructureImage(obj, tc.field, "new")
+			if tc.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			expected := newInfra()
+			tc.expected(expected.Object)
+			assert.Equal(t, expected.Object, obj.Object)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/noderefutil"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Values for Config.MachinesWithoutProviderID.
+const (
+	// MachineProviderIDSkip leaves control plane machines without a spec.providerID at their current version, counting
+	// them in the warnings.
+	MachineProviderIDSkip = "skip"
+	// MachineProviderIDWait waits for the infrastructure provider to set the spec.providerID of all control plane
+	// machines before upgrading.
+	MachineProviderIDWait = "wait"
+	// MachineProviderIDFail refuses to upgrade when a control plane machine has no spec.providerID.
+	MachineProviderIDFail = "fail"
+)
+
+// parseMachineProviderIDPolicy validates policy, defaulting it to MachineProviderIDSkip.
+func parseMachineProviderIDPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return MachineProviderIDSkip, nil
+	case MachineProviderIDSkip, MachineProviderIDWait, MachineProviderIDFail:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid machines without provider id policy %q: must be one of %s, %s, %s", policy, MachineProviderIDSkip, MachineProviderIDWait, MachineProviderIDFail)
+	}
+}
+
+// machinesWithoutProviderID returns the names of the machines that have no spec.providerID.
+func machinesWithoutProviderID(machines []*clusterv1.Machine) []string {
+	var names []string
+	for _, m := range machines {
+		if m.Spec.ProviderID == nil || *m.Spec.ProviderID == "" {
+			names = append(names, fmt.Sprintf("%s/%s", m.Namespace, m.Name))
+		}
+	}
+	return names
+}
+
+// handleMachinesWithoutProviderID applies the machines without provider id policy to machines. With
+// MachineProviderIDWait, the machines are refreshed in place once their provider id is set.
+func (u *ControlPlaneUpgrader) handleMachinesWithoutProviderID(machines []*clusterv1.Machine, timeout time.Duration) error {
+	missing := machinesWithoutProviderID(machines)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	switch u.machinesWithoutProviderID {
+	case MachineProviderIDFail:
+		return errors.Errorf("refusing to upgrade control plane machines without a spec.providerID, which usually means the cluster is not ready to be upgraded: %s",
+			strings.Join(missing, ", "))
+	case MachineProviderIDWait:
+		for _, m := range machines {
+			if m.Spec.ProviderID != nil && *m.Spec.ProviderID != "" {
+				continue
+			}
+			if _, err := u.waitForProviderID(m.Namespace, m.Name, timeout); err != nil {
+				return errors.Wrapf(err, "error waiting for machine %s/%s", m.Namespace, m.Name)
+			}
+			key := ctrlclient.ObjectKey{Namespace: m.Namespace, Name: m.Name}
+			if err := u.managementClusterClient.Get(context.TODO(), key, m); err != nil {
+				return errors.Wrapf(err, "error getting machine %s", key)
+			}
+		}
+		return nil
+	default:
+		u.log.Info("Control plane machines without a provider id will not be upgraded", "count", len(missing), "machines", missing)
+		u.record.event("Skipping %d control plane machines without a provider id: %s", len(missing), strings.Join(missing, ", "))
+		return nil
+	}
+}
+
+// parseProviderID parses providerID, that of a machine or a node, working around the differences between the provider
+// IDs infrastructure and cloud providers set for the same instance.
+func parseProviderID(providerID string) (*noderefutil.ProviderID, error) {
+	return noderefutil.NewProviderID(normalizeOpenStackProviderID(providerID))
+}
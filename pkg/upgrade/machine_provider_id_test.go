@@ -0,0 +1,41 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestMachinesWithoutProviderID(t *testing.T) {
+	machine := func(name string, providerID *string) *clusterv1.Machine {
+		return &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Spec:       clusterv1.MachineSpec{ProviderID: providerID},
+		}
+	}
+	set := "aws:///us-east-1a/i-1"
+	empty := ""
+
+	machines := []*clusterv1.Machine{machine("a", &set), machine("b", nil), machine("c", &empty)}
+	assert.Equal(t, []string{"ns/b", "ns/c"}, machinesWithoutProviderID(machines))
+	assert.Equal(t, []string{"machine ns/b has no spec.providerID", "machine ns/c has no spec.providerID"}, precheckProviderIDs(machines))
+	assert.Empty(t, machinesWithoutProviderID(machines[:1]))
+}
+
+func TestParseMachineProviderIDPolicy(t *testing.T) {
+	policy, err := parseMachineProviderIDPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, MachineProviderIDSkip, policy)
+
+	policy, err = parseMachineProviderIDPolicy(MachineProviderIDWait)
+	assert.NoError(t, err)
+	assert.Equal(t, MachineProviderIDWait, policy)
+
+	_, err = parseMachineProviderIDPolicy("ignore")
+	assert.Error(t, err)
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// machineStatusProblems returns the control plane machines that have failed or are still provisioning. Replacing a
+// broken control plane machine is a remediation, not an upgrade, so Upgrade refuses to start until they are fixed.
+// Machines being deleted and the replacement machines of upgradeID are expected to be in flux when an upgrade is
+// resumed, and are ignored.
+func machineStatusProblems(machines []*clusterv1.Machine, upgradeID string) []string {
+	var problems []string
+	for _, m := range machines {
+		if !m.DeletionTimestamp.IsZero() || strings.HasSuffix(m.Name, upgradeSuffix(upgradeID)) {
+			continue
+		}
+
+		name := fmt.Sprintf("%s/%s", m.Namespace, m.Name)
+		status := m.Status
+		switch {
+		case (status.ErrorReason != nil || status.ErrorMessage != nil || status.GetTypedPhase() == clusterv1.MachinePhaseFailed) && skipsRemediation(m):
+			problems = append(problems, fmt.Sprintf("machine %s has failed%s and is excluded from remediation by the %s annotation; pin it with the %s annotation to upgrade the other machines, or remove the annotation and remediate it, before upgrading",
+				name, machineErrorDetail(status), AnnotationSkipRemediation, AnnotationPin))
+		case status.ErrorReason != nil || status.ErrorMessage != nil || status.GetTypedPhase() == clusterv1.MachinePhaseFailed:
+			problems = append(problems, fmt.Sprintf("machine %s has failed%s; remediate it, for example by removing its etcd member and deleting it, before upgrading",
+				name, machineErrorDetail(status)))
+		case status.GetTypedPhase() == clusterv1.MachinePhasePending || status.GetTypedPhase() == clusterv1.MachinePhaseProvisioning ||
+			!status.BootstrapReady || !status.InfrastructureReady:
+			problems = append(problems, fmt.Sprintf("machine %s is not provisioned (phase %q, bootstrap ready %t, infrastructure ready %t); wait for it to be running, or remediate it if it is stuck, before upgrading",
+				name, status.Phase, status.BootstrapReady, status.InfrastructureReady))
+		}
+	}
+	return problems
+}
+
+func machineErrorDetail(status clusterv1.MachineStatus) string {
+	var details []string
+	if status.ErrorReason != nil {
+		details = append(details, string(*status.ErrorReason))
+	}
+	if status.ErrorMessage != nil {
+		details = append(details, *status.ErrorMessage)
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(details, ": ")
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	capierrors "sigs.k8s.io/cluster-api/errors"
+)
+
+func TestMachineStatusProblems(t *testing.T) {
+	machine := func(name string, phase clusterv1.MachinePhase, ready bool) *clusterv1.Machine {
+		m := &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Status: clusterv1.MachineStatus{
+				BootstrapReady:      ready,
+				InfrastructureReady: ready,
+			},
+		}
+		m.Status.SetTypedPhase(phase)
+		return m
+	}
+	failed := func(m *clusterv1.Machine) *clusterv1.Machine {
+		reason := capierrors.CreateMachineError
+		message := "instance terminated"
+		m.Status.ErrorReason = &reason
+		m.Status.ErrorMessage = &message
+		return m
+	}
+	skipRemediation := func(m *clusterv1.Machine) *clusterv1.Machine {
+		m.Annotations = map[string]string{AnnotationSkipRemediation: ""}
+		return m
+	}
+	deleting := func(m *clusterv1.Machine) *clusterv1.Machine {
+		now := metav1.Now()
+		m.DeletionTimestamp = &now
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		machines []*clusterv1.Machine
+		expected []string
+	}{
+		{
+			name:     "running",
+			machines: []*clusterv1.Machine{machine("a", clusterv1.MachinePhaseRunning, true)},
+		},
+		{
+			name:     "failed",
+			machines: []*clusterv1.Machine{failed(machine("a", clusterv1.MachinePhaseFailed, true))},
+			expected: []string{
+				"machine ns/a has failed: CreateError: instance terminated; remediate it, for example by removing its etcd member and deleting it, before upgrading",
+			},
+		},
+		{
+			name:     "failed and excluded from remediation",
+			machines: []*clusterv1.Machine{skipRemediation(failed(machine("a", clusterv1.MachinePhaseFailed, true)))},
+			expected: []string{
+				"machine ns/a has failed: CreateError: instance terminated and is excluded from remediation by the cluster.x-k8s.io/skip-remediation annotation; pin it with the upgrade.cluster-api.vmware.com/pin annotation to upgrade the other machines, or remove the annotation and remediate it, before upgrading",
+			},
+		},
+		{
+			name:     "running and excluded from remediation",
+			machines: []*clusterv1.Machine{skipRemediation(machine("a", clusterv1.MachinePhaseRunning, true))},
+		},
+		{
+			name:     "provisioning",
+			machines: []*clusterv1.Machine{machine("a", clusterv1.MachinePhaseProvisioning, false)},
+			expected: []string{
+				`machine ns/a is not provisioned (phase "provisioning", bootstrap ready false, infrastructure ready false); wait for it to be running, or remediate it if it is stuck, before upgrading`,
+			},
+		},
+		{
+			name: "ignores deleting machines and replacements",
+			machines: []*clusterv1.Machine{
+				deleting(machine("a", clusterv1.MachinePhaseDeleting, true)),
+				machine("b"+upgradeSuffix("123"), clusterv1.MachinePhaseProvisioning, false),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, machineStatusProblems(tc.machines, "123"))
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// resolveTagsField returns the field of infrastructure machines of the given kind that the configured tags are merged
+// into. Per-kind configuration takes precedence over the provider adapter. The returned bool is false if no tags are
+// configured.
+func resolveTagsField(config MachineUpdateConfig, kind string) (string, bool, error) {
+	if len(config.Tags) == 0 {
+		return "", false, nil
+	}
+
+	field := config.TagsFieldsByKind[kind]
+	if field == "" {
+		field = providerAdapterForKind(kind).defaultTagsField()
+	}
+	if field == "" {
+		return "", false, errors.Errorf("no tags field configured for infrastructure kind %q", kind)
+	}
+	for _, name := range strings.Split(field, ".") {
+		if name == "" {
+			return "", false, errors.Errorf("invalid tags field %q of infrastructure kind %q", field, kind)
+		}
+	}
+	return field, true, nil
+}
+
+// validateTags checks that tags have keys.
+func validateTags(tags map[string]string) error {
+	for k := range tags {
+		if strings.TrimSpace(k) == "" {
+			return errors.New("invalid tag: the key is empty")
+		}
+	}
+	return nil
+}
+
+// mergeInfrastructureTags merges tags into the string map at field of infra, replacing tags with the same keys.
+func mergeInfrastructureTags(infra *unstructured.Unstructured, field string, tags map[string]string) error {
+	path := strings.Split(field, ".")
+	merged, _, err := unstructured.NestedStringMap(infra.Object, path...)
+	if err != nil {
+		return errors.Wrapf(err, "%s %s: tags field %s is not a map of strings", infra.GetKind(), infra.GetName(), field)
+	}
+	if merged == nil {
+		merged = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return errors.WithStack(unstructured.SetNestedStringMap(infra.Object, merged, path...))
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestResolveTagsField(t *testing.T) {
+	_, ok, err := resolveTagsField(MachineUpdateConfig{}, "VSphereMachine")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	config := MachineUpdateConfig{
+		Tags:             map[string]string{"cost-center": "1234"},
+		TagsFieldsByKind: map[string]string{"FooMachine": "spec.labels", "AzureMachine": "spec.tags"},
+	}
+	testcases := []struct {
+		kind  string
+		field string
+	}{
+		{kind: "AWSMachine", field: "spec.additionalTags"},
+		{kind: "AzureMachine", field: "spec.tags"},
+		{kind: "FooMachine", field: "spec.labels"},
+	}
+	for _, tc := range testcases {
+		field, ok, err := resolveTagsField(config, tc.kind)
+		require.NoError(t, err, tc.kind)
+		assert.True(t, ok, tc.kind)
+		assert.Equal(t, tc.field, field, tc.kind)
+	}
+
+	_, _, err = resolveTagsField(config, "VSphereMachine")
+	assert.Error(t, err)
+
+	config.TagsFieldsByKind["FooMachine"] = "spec..labels"
+	_, _, err = resolveTagsField(config, "FooMachine")
+	assert.Error(t, err)
+}
+
+func TestMergeInfrastructureTags(t *testing.T) {
+	infra := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"additionalTags": map[string]interface{}{"owner": "dev", "env": "prod"},
+		},
+	}}
+	require.NoError(t, mergeInfrastructureTags(infra, "spec.additionalTags", map[string]string{"owner": "ops", "cost-center": "1234"}))
+	tags, _, err := unstructured.NestedStringMap(infra.Object, "spec", "additionalTags")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "ops", "env": "prod", "cost-center": "1234"}, tags)
+
+	// The field is created if missing
+	infra = &unstructured.Unstructured{Object: map[string]interface{}{}}
+	require.NoError(t, mergeInfrastructureTags(infra, "spec.additionalTags", map[string]string{"owner": "ops"}))
+	tags, _, err = unstructured.NestedStringMap(infra.Object, "spec", "additionalTags")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "ops"}, tags)
+
+	infra = &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"additionalTags": []interface{}{"owner"}},
+	}}
+	assert.Error(t, mergeInfrastructureTags(infra, "spec.additionalTags", map[string]string{"owner": "ops"}))
+}
+
+func TestValidateTags(t *testing.T) {
+	assert.NoError(t, validateTags(map[string]string{"owner": ""}))
+	assert.Error(t, validateTags(map[string]string{" ": "ops"}))
+}
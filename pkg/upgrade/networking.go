@@ -0,0 +1,245 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// dualStackFeatureGate is the feature gate enabling dual-stack networking until it graduated.
+	dualStackFeatureGate = "IPv6DualStack"
+	// featureGatesArg is the flag of the control plane components setting their feature gates.
+	featureGatesArg = "feature-gates"
+	// kubeadmFeatureGates is where the kubeadm feature gates of a ClusterConfiguration are reported.
+	kubeadmFeatureGates = "featureGates"
+)
+
+var (
+	// dualStackAlphaVersion is the first version supporting dual-stack networking, behind dualStackFeatureGate.
+	dualStackAlphaVersion = semver.Version{Major: 1, Minor: 16}
+	// dualStackBetaVersion is the first version enabling dualStackFeatureGate by default.
+	dualStackBetaVersion = semver.Version{Major: 1, Minor: 21}
+	// dualStackGAVersion is the first version locking dualStackFeatureGate to true.
+	dualStackGAVersion = semver.Version{Major: 1, Minor: 23}
+	// dualStackGateRemovalVersion is the first version without dualStackFeatureGate, refusing to start if it is set.
+	dualStackGateRemovalVersion = semver.Version{Major: 1, Minor: 24}
+)
+
+// clusterNetworking is the networking of a kubeadm ClusterConfiguration, which replacement machines join with.
+type clusterNetworking struct {
+	podSubnet     string
+	serviceSubnet string
+	// dualStackGates maps where dualStackFeatureGate is set, kubeadmFeatureGates or a control plane component, to its
+	// value.
+	dualStackGates map[string]bool
+}
+
+// networkingFromClusterConfiguration returns the networking of the decoded ClusterConfiguration config.
+func networkingFromClusterConfiguration(config map[string]interface{}) clusterNetworking {
+	n := clusterNetworking{dualStackGates: make(map[string]bool)}
+	n.podSubnet, _, _ = unstructured.NestedString(config, "networking", "podSubnet")
+	n.serviceSubnet, _, _ = unstructured.NestedString(config, "networking", "serviceSubnet")
+
+	if enabled, ok, _ := unstructured.NestedBool(config, kubeadmFeatureGates, dualStackFeatureGate); ok {
+		n.dualStackGates[kubeadmFeatureGates] = enabled
+	}
+	for _, component := range []string{"apiServer", "controllerManager", "scheduler"} {
+		gates, _, _ := unstructured.NestedString(config, component, "extraArgs", featureGatesArg)
+		if enabled, ok := parseFeatureGate(gates, dualStackFeatureGate); ok {
+			n.dualStackGates[component] = enabled
+		}
+	}
+	return n
+}
+
+// networkingFromKubeadmConfig returns the networking of the ClusterConfiguration of config, which must have one.
+func networkingFromKubeadmConfig(config *bootstrapv1.KubeadmConfig) (clusterNetworking, error) {
+	clusterConfig, err := runtime.DefaultUnstructuredConverter.ToUnstructured(config.Spec.ClusterConfiguration)
+	if err != nil {
+		return clusterNetworking{}, errors.Wrapf(err, "error decoding the ClusterConfiguration of kubeadm config %s", config.Name)
+	}
+	return networkingFromClusterConfiguration(clusterConfig), nil
+}
+
+// parseFeatureGate returns the value of gate in the feature-gates flag value gates, such as "A=true,B=false", and
+// whether it is set.
+func parseFeatureGate(gates, gate string) (bool, bool) {
+	for _, pair := range strings.Split(gates, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] != gate {
+			continue
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+		if err != nil {
+			continue
+		}
+		return enabled, true
+	}
+	return false, false
+}
+
+// dualStack returns true if n assigns pods or services both an IPv4 and an IPv6 subnet.
+func (n clusterNetworking) dualStack() bool {
+	return strings.Contains(n.podSubnet, ",") || strings.Contains(n.serviceSubnet, ",")
+}
+
+// gateLocations returns where dualStackFeatureGate is set to enabled, sorted.
+func (n clusterNetworking) gateLocations(enabled bool) []string {
+	var locations []string
+	for location, value := range n.dualStackGates {
+		if value == enabled {
+			locations = append(locations, location)
+		}
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+// networkingDifferences returns how the networking of other differs from n.
+func networkingDifferences(n, other clusterNetworking) []string {
+	var differences []string
+	if n.podSubnet != other.podSubnet {
+		differences = append(differences, fmt.Sprintf("pod subnet %q instead of %q", other.podSubnet, n.podSubnet))
+	}
+	if n.serviceSubnet != other.serviceSubnet {
+		differences = append(differences, fmt.Sprintf("service subnet %q instead of %q", other.serviceSubnet, n.serviceSubnet))
+	}
+
+	locations := make(map[string]bool)
+	for location := range n.dualStackGates {
+		locations[location] = true
+	}
+	for location := range other.dualStackGates {
+		locations[location] = true
+	}
+	var sorted []string
+	for location := range locations {
+		sorted = append(sorted, location)
+	}
+	sort.Strings(sorted)
+	for _, location := range sorted {
+		value, ok := n.dualStackGates[location]
+		otherValue, otherOK := other.dualStackGates[location]
+		if ok != otherOK || value != otherValue {
+			differences = append(differences, fmt.Sprintf("%s %s %s instead of %s", location, dualStackFeatureGate, gateValue(otherValue, otherOK), gateValue(value, ok)))
+		}
+	}
+	return differences
+}
+
+// gateValue describes the value of a feature gate that may not be set.
+func gateValue(enabled, ok bool) string {
+	if !ok {
+		return "unset"
+	}
+	return strconv.FormatBool(enabled)
+}
+
+// dualStackFindings are the results of checking the dual-stack networking of a cluster against a Kubernetes version.
+type dualStackFindings struct {
+	// unsupported lists why the version cannot run the cluster's networking.
+	unsupported []string
+	// gates lists the dualStackFeatureGate settings to add or remove for the version.
+	gates []string
+}
+
+// checkDualStack checks the networking n is supported at version, and whether dualStackFeatureGate needs to be added
+// or removed: it is required for dual-stack networking until it is enabled by default, may not be disabled once it
+// is locked, and may not be set once it is removed.
+func checkDualStack(n clusterNetworking, version semver.Version) dualStackFindings {
+	var findings dualStackFindings
+	minor := semver.Version{Major: version.Major, Minor: version.Minor}
+
+	if minor.GTE(dualStackGateRemovalVersion) {
+		if locations := n.gateLocations(true); len(locations) > 0 {
+			findings.gates = append(findings.gates, fmt.Sprintf("remove the %s feature gate from %s, it was removed in kubernetes %d.%d",
+				dualStackFeatureGate, strings.Join(locations, ", "), dualStackGateRemovalVersion.Major, dualStackGateRemovalVersion.Minor))
+		}
+	}
+	if minor.GTE(dualStackGAVersion) {
+		if locations := n.gateLocations(false); len(locations) > 0 {
+			findings.gates = append(findings.gates, fmt.Sprintf("remove %s=false from %s, dual-stack networking cannot be disabled since kubernetes %d.%d",
+				dualStackFeatureGate, strings.Join(locations, ", "), dualStackGAVersion.Major, dualStackGAVersion.Minor))
+		}
+		return findings
+	}
+
+	if !n.dualStack() {
+		return findings
+	}
+	if minor.LT(dualStackAlphaVersion) {
+		findings.unsupported = append(findings.unsupported, fmt.Sprintf("kubernetes %d.%d does not support the dual-stack pod subnet %q and service subnet %q",
+			minor.Major, minor.Minor, n.podSubnet, n.serviceSubnet))
+		return findings
+	}
+	if locations := n.gateLocations(false); len(locations) > 0 {
+		findings.gates = append(findings.gates, fmt.Sprintf("remove %s=false from %s, the dual-stack subnets require it", dualStackFeatureGate, strings.Join(locations, ", ")))
+	}
+	if minor.LT(dualStackBetaVersion) && len(n.gateLocations(true)) == 0 {
+		findings.gates = append(findings.gates, fmt.Sprintf("add %s=true to the kubeadm %s, the dual-stack subnets require it until kubernetes %d.%d",
+			dualStackFeatureGate, kubeadmFeatureGates, dualStackBetaVersion.Major, dualStackBetaVersion.Minor))
+	}
+	return findings
+}
+
+// clusterNetworkingProblems returns the reasons replacement machines cannot join the cluster with its networking at
+// version: the KubeadmConfigs of machines, which replacements are copied from, must have the networking of the
+// kubeadm-config ConfigMap, and the version must support dual-stack networking if it is used. Feature gates to add or
+// remove for version are recorded as warnings. Clusters without a ClusterConfiguration in the ConfigMap are left to
+// the missing kubeadm configmap policy.
+func (u *ControlPlaneUpgrader) clusterNetworkingProblems(machines []*clusterv1.Machine, version semver.Version) ([]string, error) {
+	cm, err := u.getKubeadmConfigMap()
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	key, clusterConfig, err := findClusterConfiguration(cm)
+	if err != nil || key == "" {
+		return nil, err
+	}
+	networking := networkingFromClusterConfiguration(clusterConfig)
+
+	var problems []string
+	for _, machine := range machines {
+		ref := machine.Spec.Bootstrap.ConfigRef
+		if ref == nil || ref.Kind != "KubeadmConfig" {
+			continue
+		}
+		config := &bootstrapv1.KubeadmConfig{}
+		configKey := ctrlclient.ObjectKey{Namespace: machine.Namespace, Name: ref.Name}
+		if err := u.managementClusterClient.Get(context.TODO(), configKey, config); err != nil {
+			return nil, errors.Wrapf(err, "error getting kubeadm config %s", configKey.String())
+		}
+		if config.Spec.ClusterConfiguration == nil {
+			continue
+		}
+
+		configNetworking, err := networkingFromKubeadmConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		if differences := networkingDifferences(networking, configNetworking); len(differences) > 0 {
+			problems = append(problems, fmt.Sprintf("kubeadm config %s of machine %s has %s, unlike configmap %s",
+				configKey.String(), machine.Name, strings.Join(differences, ", "), kubeadmConfigMapName))
+		}
+	}
+
+	findings := checkDualStack(networking, version)
+	for _, msg := range findings.gates {
+		u.warnings.add(WarningDualStackFeatureGate, kubeadmConfigMapName, "%s", msg)
+	}
+	return append(problems, findings.unsupported...), nil
+}
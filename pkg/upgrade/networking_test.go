@@ -0,0 +1,146 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestNetworkingFromClusterConfiguration(t *testing.T) {
+	data := `
+apiVersion: kubeadm.k8s.io/v1beta1
+kind: ClusterConfiguration
+networking:
+  podSubnet: 10.244.0.0/16,fd00:10:244::/56
+  serviceSubnet: 10.96.0.0/12,fd00:10:96::/112
+featureGates:
+  IPv6DualStack: true
+apiServer:
+  extraArgs:
+    feature-gates: SomeGate=true, IPv6DualStack=true
+controllerManager:
+  extraArgs:
+    feature-gates: IPv6DualStack=false
+`
+	config := make(map[string]interface{})
+	require.NoError(t, yaml.Unmarshal([]byte(data), &config))
+
+	n := networkingFromClusterConfiguration(config)
+	assert.Equal(t, clusterNetworking{
+		podSubnet:      "10.244.0.0/16,fd00:10:244::/56",
+		serviceSubnet:  "10.96.0.0/12,fd00:10:96::/112",
+		dualStackGates: map[string]bool{"featureGates": true, "apiServer": true, "controllerManager": false},
+	}, n)
+	assert.True(t, n.dualStack())
+}
+
+func TestNetworkingFromKubeadmConfig(t *testing.T) {
+	config := &bootstrapv1.KubeadmConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cp-0"},
+		Spec: bootstrapv1.KubeadmConfigSpec{
+			ClusterConfiguration: &kubeadmv1beta1.ClusterConfiguration{
+				Networking:   kubeadmv1beta1.Networking{PodSubnet: "10.244.0.0/16", ServiceSubnet: "10.96.0.0/12"},
+				FeatureGates: map[string]bool{dualStackFeatureGate: true},
+			},
+		},
+	}
+
+	n, err := networkingFromKubeadmConfig(config)
+	require.NoError(t, err)
+	assert.Equal(t, clusterNetworking{
+		podSubnet:      "10.244.0.0/16",
+		serviceSubnet:  "10.96.0.0/12",
+		dualStackGates: map[string]bool{"featureGates": true},
+	}, n)
+	assert.False(t, n.dualStack())
+}
+
+func TestNetworkingDifferences(t *testing.T) {
+	n := clusterNetworking{podSubnet: "10.244.0.0/16", serviceSubnet: "10.96.0.0/12", dualStackGates: map[string]bool{"featureGates": true}}
+
+	assert.Empty(t, networkingDifferences(n, n))
+	assert.Equal(t, []string{
+		`pod subnet "192.168.0.0/16" instead of "10.244.0.0/16"`,
+		"apiServer IPv6DualStack false instead of unset",
+		"featureGates IPv6DualStack unset instead of true",
+	}, networkingDifferences(n, clusterNetworking{
+		podSubnet:      "192.168.0.0/16",
+		serviceSubnet:  "10.96.0.0/12",
+		dualStackGates: map[string]bool{"apiServer": false},
+	}))
+}
+
+func TestCheckDualStack(t *testing.T) {
+	dualStack := func(gates map[string]bool) clusterNetworking {
+		return clusterNetworking{podSubnet: "10.244.0.0/16,fd00:10:244::/56", serviceSubnet: "10.96.0.0/12", dualStackGates: gates}
+	}
+	singleStack := func(gates map[string]bool) clusterNetworking {
+		return clusterNetworking{podSubnet: "10.244.0.0/16", serviceSubnet: "10.96.0.0/12", dualStackGates: gates}
+	}
+
+	tests := []struct {
+		name        string
+		networking  clusterNetworking
+		version     string
+		unsupported int
+		gates       []string
+	}{
+		{
+			name:       "single stack without gates",
+			networking: singleStack(nil),
+			version:    "1.15.3",
+		},
+		{
+			name:        "dual stack before alpha",
+			networking:  dualStack(nil),
+			version:     "1.15.3",
+			unsupported: 1,
+		},
+		{
+			name:       "dual stack alpha without gate",
+			networking: dualStack(nil),
+			version:    "1.16.2",
+			gates:      []string{"add IPv6DualStack=true to the kubeadm featureGates, the dual-stack subnets require it until kubernetes 1.21"},
+		},
+		{
+			name:       "dual stack alpha with gate",
+			networking: dualStack(map[string]bool{"featureGates": true}),
+			version:    "1.20.1",
+		},
+		{
+			name:       "dual stack beta disabled",
+			networking: dualStack(map[string]bool{"apiServer": false}),
+			version:    "1.21.0",
+			gates:      []string{"remove IPv6DualStack=false from apiServer, the dual-stack subnets require it"},
+		},
+		{
+			name:       "single stack ga disabled",
+			networking: singleStack(map[string]bool{"featureGates": false}),
+			version:    "1.23.4",
+			gates:      []string{"remove IPv6DualStack=false from featureGates, dual-stack networking cannot be disabled since kubernetes 1.23"},
+		},
+		{
+			name:       "gate removed",
+			networking: dualStack(map[string]bool{"featureGates": true, "apiServer": true}),
+			version:    "1.24.0",
+			gates:      []string{"remove the IPv6DualStack feature gate from apiServer, featureGates, it was removed in kubernetes 1.24"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			findings := checkDualStack(tc.networking, semver.MustParse(tc.version))
+			assert.Len(t, findings.unsupported, tc.unsupported)
+			assert.Equal(t, tc.gates, findings.gates)
+		})
+	}
+}
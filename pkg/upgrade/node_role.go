@@ -0,0 +1,174 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// controlPlaneNodeLabel is the label kubeadm sets on control plane nodes since 1.20, and their taint since 1.24.
+	controlPlaneNodeLabel = "node-role.kubernetes.io/control-plane"
+	// legacyControlPlaneNodeLabel is the label kubeadm sets on control plane nodes until 1.23, and their taint until
+	// 1.24.
+	legacyControlPlaneNodeLabel = "node-role.kubernetes.io/master"
+)
+
+var (
+	// controlPlaneLabelVersion is the first version kubeadm labels control plane nodes with controlPlaneNodeLabel.
+	controlPlaneLabelVersion = semver.Version{Major: 1, Minor: 20}
+	// controlPlaneTaintVersion is the first version kubeadm taints control plane nodes with controlPlaneNodeLabel, and
+	// the first one without legacyControlPlaneNodeLabel.
+	controlPlaneTaintVersion = semver.Version{Major: 1, Minor: 24}
+	// legacyTaintRemovalVersion is the first version kubeadm no longer taints control plane nodes with
+	// legacyControlPlaneNodeLabel.
+	legacyTaintRemovalVersion = semver.Version{Major: 1, Minor: 25}
+)
+
+// controlPlaneNodeLabels returns the labels kubeadm sets on control plane nodes at version.
+func controlPlaneNodeLabels(version semver.Version) []string {
+	minor := semver.Version{Major: version.Major, Minor: version.Minor}
+	switch {
+	case minor.LT(controlPlaneLabelVersion):
+		return []string{legacyControlPlaneNodeLabel}
+	case minor.LT(controlPlaneTaintVersion):
+		return []string{legacyControlPlaneNodeLabel, controlPlaneNodeLabel}
+	default:
+		return []string{controlPlaneNodeLabel}
+	}
+}
+
+// controlPlaneNodeTaints returns the keys of the NoSchedule taints kubeadm sets on control plane nodes at version.
+func controlPlaneNodeTaints(version semver.Version) []string {
+	minor := semver.Version{Major: version.Major, Minor: version.Minor}
+	switch {
+	case minor.LT(controlPlaneTaintVersion):
+		return []string{legacyControlPlaneNodeLabel}
+	case minor.LT(legacyTaintRemovalVersion):
+		return []string{legacyControlPlaneNodeLabel, controlPlaneNodeLabel}
+	default:
+		return []string{controlPlaneNodeLabel}
+	}
+}
+
+// isControlPlaneNode returns true if node has a control plane label of any Kubernetes version.
+func isControlPlaneNode(node *v1.Node) bool {
+	_, legacy := node.Labels[legacyControlPlaneNodeLabel]
+	_, current := node.Labels[controlPlaneNodeLabel]
+	return legacy || current
+}
+
+// hasControlPlaneTaint returns true if node has a control plane NoSchedule taint of any Kubernetes version.
+func hasControlPlaneTaint(node *v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == v1.TaintEffectNoSchedule && (taint.Key == legacyControlPlaneNodeLabel || taint.Key == controlPlaneNodeLabel) {
+			return true
+		}
+	}
+	return false
+}
+
+// listControlPlaneNodes lists the control plane nodes of a cluster, whichever control plane label they have. A label
+// selector cannot match either label, so all nodes are listed.
+func listControlPlaneNodes(client kubernetes.Interface) ([]v1.Node, error) {
+	nodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing nodes")
+	}
+
+	var ret []v1.Node
+	for i := range nodes.Items {
+		if isControlPlaneNode(&nodes.Items[i]) {
+			ret = append(ret, nodes.Items[i])
+		}
+	}
+	return ret, nil
+}
+
+// missingControlPlaneNodeRole returns the labels, and the taints if tainted is true, that node lacks for a control
+// plane node at version.
+func missingControlPlaneNodeRole(node *v1.Node, version semver.Version, tainted bool) (labels, taints []string) {
+	for _, label := range controlPlaneNodeLabels(version) {
+		if _, ok := node.Labels[label]; !ok {
+			labels = append(labels, label)
+		}
+	}
+	if !tainted {
+		return labels, nil
+	}
+
+	for _, key := range controlPlaneNodeTaints(version) {
+		found := false
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == key && taint.Effect == v1.TaintEffectNoSchedule {
+				found = true
+				break
+			}
+		}
+		if !found {
+			taints = append(taints, key)
+		}
+	}
+	return labels, taints
+}
+
+// ensureControlPlaneNodeRole applies the control plane labels of the desired version to the replacement of oldNode,
+// newNode, and its control plane taints if oldNode was tainted, as kubeadm only sets them when a node joins and some
+// bootstrap configurations override them. Taints of the other label, from before or after the transition, are left
+// as is.
+func (u *ControlPlaneUpgrader) ensureControlPlaneNodeRole(oldNode, newNode *v1.Node) error {
+	node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(newNode.Name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "error getting node %s", newNode.Name)
+	}
+
+	labels, taints := missingControlPlaneNodeRole(node, u.desiredVersion, hasControlPlaneTaint(oldNode))
+	if len(labels) == 0 && len(taints) == 0 {
+		return nil
+	}
+
+	u.log.Info("Applying control plane labels and taints", "node", node.Name, "labels", labels, "taints", taints)
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	for _, label := range labels {
+		node.Labels[label] = ""
+	}
+	for _, key := range taints {
+		node.Spec.Taints = append(node.Spec.Taints, v1.Taint{Key: key, Effect: v1.TaintEffectNoSchedule})
+	}
+	if _, err := u.targetKubernetesClient.CoreV1().Nodes().Update(node); err != nil {
+		return errors.Wrapf(err, "error applying control plane labels and taints to node %s", node.Name)
+	}
+	u.record.event("Applied the control plane labels and taints %s to node %s", strings.Join(append(labels, taints...), ", "), node.Name)
+	return nil
+}
+
+// checkControlPlaneNodeRoles returns the control plane nodes lacking the control plane labels kubeadm sets at the
+// verified version. Taints are not checked, as clusters may remove them to schedule workloads on the control plane.
+func (v *Verifier) checkControlPlaneNodeRoles() ([]string, error) {
+	nodes, err := listControlPlaneNodes(v.targetKubernetesClient)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for i := range nodes {
+		node := &nodes[i]
+		if v.skipNodes.Has(node.Name) {
+			continue
+		}
+		if labels, _ := missingControlPlaneNodeRole(node, v.version, false); len(labels) > 0 {
+			problems = append(problems, fmt.Sprintf("node %s lacks the labels %s", node.Name, strings.Join(labels, ", ")))
+		}
+	}
+	return problems, nil
+}
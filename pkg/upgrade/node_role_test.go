@@ -0,0 +1,67 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestControlPlaneNodeLabelsAndTaints(t *testing.T) {
+	tests := []struct {
+		version string
+		labels  []string
+		taints  []string
+	}{
+		{version: "1.19.9", labels: []string{legacyControlPlaneNodeLabel}, taints: []string{legacyControlPlaneNodeLabel}},
+		{version: "1.20.0", labels: []string{legacyControlPlaneNodeLabel, controlPlaneNodeLabel}, taints: []string{legacyControlPlaneNodeLabel}},
+		{version: "1.23.5", labels: []string{legacyControlPlaneNodeLabel, controlPlaneNodeLabel}, taints: []string{legacyControlPlaneNodeLabel}},
+		{version: "1.24.0", labels: []string{controlPlaneNodeLabel}, taints: []string{legacyControlPlaneNodeLabel, controlPlaneNodeLabel}},
+		{version: "1.25.2", labels: []string{controlPlaneNodeLabel}, taints: []string{controlPlaneNodeLabel}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.version, func(t *testing.T) {
+			v := semver.MustParse(tc.version)
+			assert.Equal(t, tc.labels, controlPlaneNodeLabels(v))
+			assert.Equal(t, tc.taints, controlPlaneNodeTaints(v))
+		})
+	}
+}
+
+func TestIsControlPlaneNode(t *testing.T) {
+	legacy := &v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{legacyControlPlaneNodeLabel: ""}}}
+	current := &v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{controlPlaneNodeLabel: ""}}}
+	worker := &v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"node-role.kubernetes.io/worker": ""}}}
+
+	assert.True(t, isControlPlaneNode(legacy))
+	assert.True(t, isControlPlaneNode(current))
+	assert.False(t, isControlPlaneNode(worker))
+}
+
+func TestMissingControlPlaneNodeRole(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{legacyControlPlaneNodeLabel: ""}},
+		Spec: v1.NodeSpec{Taints: []v1.Taint{
+			{Key: legacyControlPlaneNodeLabel, Effect: v1.TaintEffectNoSchedule},
+		}},
+	}
+	assert.True(t, hasControlPlaneTaint(node))
+
+	labels, taints := missingControlPlaneNodeRole(node, semver.MustParse("1.24.3"), true)
+	assert.Equal(t, []string{controlPlaneNodeLabel}, labels)
+	assert.Equal(t, []string{controlPlaneNodeLabel}, taints)
+
+	labels, taints = missingControlPlaneNodeRole(node, semver.MustParse("1.24.3"), false)
+	assert.Equal(t, []string{controlPlaneNodeLabel}, labels)
+	assert.Empty(t, taints)
+
+	labels, taints = missingControlPlaneNodeRole(node, semver.MustParse("1.19.1"), true)
+	assert.Empty(t, labels)
+	assert.Empty(t, taints)
+}
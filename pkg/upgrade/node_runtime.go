@@ -0,0 +1,122 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// dockershimDeprecatedVersion is the first Kubernetes version that warns about the docker runtime.
+	dockershimDeprecatedVersion = semver.MustParse("1.20.0")
+	// dockershimRemovedVersion is the first Kubernetes version that cannot use the docker runtime.
+	dockershimRemovedVersion = semver.MustParse("1.24.0")
+	// criV1OnlyVersion is the first Kubernetes version that only supports the CRI v1 API.
+	criV1OnlyVersion = semver.MustParse("1.26.0")
+	// containerdCRIV1Version is the first containerd version that serves the CRI v1 API.
+	containerdCRIV1Version = semver.MustParse("1.6.0")
+)
+
+// runtimeFinding is a container runtime problem found on a node.
+type runtimeFinding struct {
+	node    string
+	message string
+}
+
+// runtimeFindings are the container runtime problems found on nodes for a Kubernetes version.
+type runtimeFindings struct {
+	// incompatible lists nodes whose runtime cannot run the version.
+	incompatible []runtimeFinding
+	// deprecated lists nodes whose runtime still works with the version but will not for long.
+	deprecated []runtimeFinding
+}
+
+// checkNodeRuntimes returns the container runtime problems of nodes for the Kubernetes version.
+func checkNodeRuntimes(nodes []v1.Node, version semver.Version) runtimeFindings {
+	var findings runtimeFindings
+
+	for i := range nodes {
+		node := &nodes[i]
+		info := node.Status.NodeInfo
+		describe := func(problem string) runtimeFinding {
+			return runtimeFinding{
+				node:    node.Name,
+				message: fmt.Sprintf("%s (%s, kernel %s): %s", info.ContainerRuntimeVersion, info.OSImage, info.KernelVersion, problem),
+			}
+		}
+
+		runtime, runtimeVersion := parseContainerRuntimeVersion(info.ContainerRuntimeVersion)
+		switch runtime {
+		case "docker":
+			if !version.LT(dockershimRemovedVersion) {
+				findings.incompatible = append(findings.incompatible, describe(fmt.Sprintf("dockershim was removed in Kubernetes %d.%d", dockershimRemovedVersion.Major, dockershimRemovedVersion.Minor)))
+			} else if !version.LT(dockershimDeprecatedVersion) {
+				findings.deprecated = append(findings.deprecated, describe(fmt.Sprintf("dockershim is deprecated and removed in Kubernetes %d.%d", dockershimRemovedVersion.Major, dockershimRemovedVersion.Minor)))
+			}
+		case "containerd":
+			if version.LT(criV1OnlyVersion) {
+				continue
+			}
+			v, err := semver.ParseTolerant(runtimeVersion)
+			if err != nil {
+				findings.deprecated = append(findings.deprecated, describe("unable to determine whether the containerd version supports the CRI v1 API"))
+			} else if v.LT(containerdCRIV1Version) {
+				findings.incompatible = append(findings.incompatible, describe(fmt.Sprintf("Kubernetes %d.%d requires containerd %s or newer", criV1OnlyVersion.Major, criV1OnlyVersion.Minor, containerdCRIV1Version)))
+			}
+		case "cri-o":
+			// CRI-O minor versions track Kubernetes minor versions
+			v, err := semver.ParseTolerant(runtimeVersion)
+			if err != nil {
+				findings.deprecated = append(findings.deprecated, describe("unable to determine whether the CRI-O version matches the Kubernetes version"))
+			} else if v.Major == version.Major && v.Minor < version.Minor {
+				findings.deprecated = append(findings.deprecated, describe(fmt.Sprintf("CRI-O %d.%d is meant for Kubernetes %d.%d", v.Major, v.Minor, v.Major, v.Minor)))
+			}
+		}
+	}
+
+	return findings
+}
+
+// parseContainerRuntimeVersion splits a node's containerRuntimeVersion, such as containerd://1.6.2, into the runtime
+// and its version.
+func parseContainerRuntimeVersion(s string) (string, string) {
+	parts := strings.SplitN(s, "://", 2)
+	if len(parts) != 2 {
+		return s, ""
+	}
+	return parts[0], parts[1]
+}
+
+// nodeRuntimeProblems returns the reasons the container runtimes of the target cluster's nodes cannot run version.
+// Runtimes that are deprecated for version, and incompatible ones if compatibility is ignored, are recorded as
+// warnings instead.
+func (u *ControlPlaneUpgrader) nodeRuntimeProblems(version semver.Version) ([]string, error) {
+	nodes, err := u.targetKubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing nodes")
+	}
+
+	findings := checkNodeRuntimes(nodes.Items, version)
+	for _, f := range findings.deprecated {
+		u.warnings.add(WarningNodeRuntime, f.node, "%s", f.message)
+	}
+	if u.ignoreRuntimeCompatibility {
+		for _, f := range findings.incompatible {
+			u.warnings.add(WarningNodeRuntime, f.node, "%s", f.message)
+		}
+		return nil, nil
+	}
+
+	var problems []string
+	for _, f := range findings.incompatible {
+		problems = append(problems, fmt.Sprintf("node %s runs %s", f.node, f.message))
+	}
+	return problems, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckNodeRuntimes(t *testing.T) {
+	node := func(name, runtime string) v1.Node {
+		return v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: v1.NodeStatus{
+				NodeInfo: v1.NodeSystemInfo{
+					ContainerRuntimeVersion: runtime,
+					OSImage:                 "Ubuntu 18.04.3 LTS",
+					KernelVersion:           "4.15.0",
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name                 string
+		nodes                []v1.Node
+		version              string
+		expectedIncompatible []string
+		expectedDeprecated   []string
+	}{
+		{
+			name:    "docker before deprecation",
+			nodes:   []v1.Node{node("a", "docker://18.9.7")},
+			version: "1.19.4",
+		},
+		{
+			name:               "docker deprecated",
+			nodes:              []v1.Node{node("a", "docker://19.3.1")},
+			version:            "1.20.0",
+			expectedDeprecated: []string{"a"},
+		},
+		{
+			name:                 "docker removed",
+			nodes:                []v1.Node{node("a", "docker://19.3.1"), node("b", "containerd://1.4.3")},
+			version:              "1.24.1",
+			expectedIncompatible: []string{"a"},
+		},
+		{
+			name:                 "containerd without CRI v1",
+			nodes:                []v1.Node{node("a", "containerd://1.5.9"), node("b", "containerd://1.6.2")},
+			version:              "1.26.0",
+			expectedIncompatible: []string{"a"},
+		},
+		{
+			name:    "old containerd before CRI v1 is required",
+			nodes:   []v1.Node{node("a", "containerd://1.5.9")},
+			version: "1.25.3",
+		},
+		{
+			name:               "unparseable containerd version",
+			nodes:              []v1.Node{node("a", "containerd://unknown")},
+			version:            "1.26.0",
+			expectedDeprecated: []string{"a"},
+		},
+		{
+			name:               "cri-o older than kubernetes",
+			nodes:              []v1.Node{node("a", "cri-o://1.15.2"), node("b", "cri-o://1.16.0")},
+			version:            "1.16.1",
+			expectedDeprecated: []string{"a"},
+		},
+		{
+			name:    "unknown runtime",
+			nodes:   []v1.Node{node("a", "")},
+			version: "1.26.0",
+		},
+	}
+
+	nodeNames := func(findings []runtimeFinding) []string {
+		var ret []string
+		for _, f := range findings {
+			ret = append(ret, f.node)
+		}
+		return ret
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			findings := checkNodeRuntimes(tc.nodes, semver.MustParse(tc.version))
+			assert.Equal(t, tc.expectedIncompatible, nodeNames(findings.incompatible))
+			assert.Equal(t, tc.expectedDeprecated, nodeNames(findings.deprecated))
+		})
+	}
+}
+
+func TestParseContainerRuntimeVersion(t *testing.T) {
+	runtime, version := parseContainerRuntimeVersion("containerd://1.6.2")
+	assert.Equal(t, "containerd", runtime)
+	assert.Equal(t, "1.6.2", version)
+
+	runtime, version = parseContainerRuntimeVersion("docker")
+	assert.Equal(t, "docker", runtime)
+	assert.Equal(t, "", version)
+}
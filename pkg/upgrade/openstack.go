@@ -0,0 +1,34 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strconv"
+	"strings"
+)
+
+// openstackCloudProvider is the cloud provider of the provider IDs of OpenStack instances.
+const openstackCloudProvider = "openstack"
+
+// openstackConsoleOutputCommand prints the console output of an OpenStack server with the openstack command, using
+// its usual credentials from the environment or clouds.yaml.
+func openstackConsoleOutputCommand(instanceID string) []string {
+	return []string{"openstack", "console", "log", "show", "--lines", strconv.Itoa(componentLogTailLines), instanceID}
+}
+
+// openstackImageStatusCommand prints the status of a Glance image, by name or ID, with the openstack command.
+func openstackImageStatusCommand(image string) []string {
+	return []string{"openstack", "image", "show", image, "--format", "value", "--column", "status"}
+}
+
+// normalizeOpenStackProviderID returns providerID with the server UUID of OpenStack provider IDs in lower case. The
+// OpenStack cloud providers and Cluster API Provider OpenStack do not agree on its case, nor on the region segment,
+// such as openstack://RegionOne/<uuid> against openstack:///<uuid>, which comparing provider IDs already ignores.
+func normalizeOpenStackProviderID(providerID string) string {
+	if !strings.HasPrefix(providerID, openstackCloudProvider+"://") {
+		return providerID
+	}
+	i := strings.LastIndex(providerID, "/")
+	return providerID[:i+1] + strings.ToLower(providerID[i+1:])
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestNormalizeOpenStackProviderID(t *testing.T) {
+	assert.Equal(t, "openstack:///5f9e2c1a-6d3b-4c8e-9b1a-0a2f4e6c8d10", normalizeOpenStackProviderID("openstack:///5F9E2C1A-6D3B-4C8E-9B1A-0A2F4E6C8D10"))
+	assert.Equal(t, "openstack://RegionOne/5f9e2c1a-6d3b-4c8e-9b1a-0a2f4e6c8d10", normalizeOpenStackProviderID("openstack://RegionOne/5F9E2C1A-6D3B-4C8E-9B1A-0A2F4E6C8D10"))
+	assert.Equal(t, "aws:///us-east-1a/i-0ABC", normalizeOpenStackProviderID("aws:///us-east-1a/i-0ABC"))
+}
+
+func TestParseProviderIDOpenStack(t *testing.T) {
+	machine, err := parseProviderID("openstack:///5F9E2C1A-6D3B-4C8E-9B1A-0A2F4E6C8D10")
+	require.NoError(t, err)
+	node, err := parseProviderID("openstack://RegionOne/5f9e2c1a-6d3b-4c8e-9b1a-0a2f4e6c8d10")
+	require.NoError(t, err)
+	assert.True(t, machine.Equals(node))
+	assert.Equal(t, "5f9e2c1a-6d3b-4c8e-9b1a-0a2f4e6c8d10", machine.ID())
+}
+
+func TestBuildReplacementInfraOpenStack(t *testing.T) {
+	infra := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "infrastructure.cluster.x-k8s.io/v1alpha2",
+		"kind":       "OpenStackMachine",
+		"metadata":   map[string]interface{}{"namespace": "ns", "name": "cp-0-infra"},
+		"spec": map[string]interface{}{
+			"providerID": "openstack:///5f9e2c1a-6d3b-4c8e-9b1a-0a2f4e6c8d10",
+			"image":      "ubuntu-1804-kube-v1.15.5",
+			"flavor":     "m1.large",
+		},
+	}}
+
+	opts := ReplacementOptions{
+		UpgradeID: "123",
+		Version:   "v1.16.3",
+		MachineUpdates: MachineUpdateConfig{
+			Image:  ImageUpdateConfig{LookupFormat: "ubuntu-1804-kube-v{{.Version}}"},
+			Flavor: "m1.xlarge",
+		},
+	}
+	replacement, err := BuildReplacementInfra(infra, opts)
+	require.NoError(t, err)
+	image, _, _ := unstructured.NestedString(replacement.Object, "spec", "image")
+	assert.Equal(t, "ubuntu-1804-kube-v1.16.3", image)
+	flavor, _, _ := unstructured.NestedString(replacement.Object, "spec", "flavor")
+	assert.Equal(t, "m1.xlarge", flavor)
+
+	infra.SetKind("VSphereMachine")
+	_, err = BuildReplacementInfra(infra, opts)
+	assert.Error(t, err, "VSphereMachines have no flavor field")
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// disruptionBucketKey is the key of the pacing ConfigMap holding the disruption bucket.
+const disruptionBucketKey = "disruptionBucket"
+
+// disruptionBucket is the token bucket pacing the disruptive actions of upgrades of a cluster, machine replacements,
+// each deleting a machine and removing its etcd member. It holds up to the maximum disruptions per hour, and is refilled at that rate.
+type disruptionBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// pacingConfigMapName returns the name of the ConfigMap holding the disruption bucket of the cluster called
+// clusterName. It is not specific to an upgrade, so that later upgrades, resumed or not, respect the budget.
+func pacingConfigMapName(clusterName string) string {
+	return fmt.Sprintf("%s-upgrade-pacing", clusterName)
+}
+
+// take refills b with the tokens earned since it was last updated, at maxPerHour an hour, and takes one. A new bucket
+// is full. If b has no token, none is taken and take returns how long until it has one.
+func (b *disruptionBucket) take(maxPerHour int, now time.Time) time.Duration {
+	capacity := float64(maxPerHour)
+	if b.Updated.IsZero() {
+		b.Tokens = capacity
+	} else if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed.Hours()*capacity)
+	}
+	b.Updated = now
+
+	// tolerate the rounding of the tokens earned over time
+	if b.Tokens >= 1-1e-9 {
+		b.Tokens = math.Max(0, b.Tokens-1)
+		return 0
+	}
+	wait := time.Duration(math.Round((1-b.Tokens)/capacity*time.Hour.Seconds())) * time.Second
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// paceDisruption waits until the disruption budget allows one more disruptive action, described by action, such as
+// "replacing machine cp-0", and takes it from the budget. It is taken before the replacement starts, so that the etcd
+// member removal and the machine deletion follow each other without waiting. If the wait would run past the deadline
+// of the time budget, it stops the upgrade instead, with remaining left to upgrade.
+func (u *ControlPlaneUpgrader) paceDisruption(action, remaining string) error {
+	if u.maxDisruptionsPerHour == 0 {
+		return nil
+	}
+	for {
+		wait, err := u.takeDisruptionToken(time.Now())
+		if apierrors.IsConflict(errors.Cause(err)) || apierrors.IsAlreadyExists(errors.Cause(err)) {
+			// another upgrade of the cluster took a token meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+		if stop := u.budget.stopWaiting(time.Now(), wait, u.upgradeID, remaining); stop != nil {
+			u.record.event("Stopped as %s, with %s left to upgrade", stop.reason(), remaining)
+			return stop
+		}
+		u.record.event("Waiting %s for the budget of %d disruptions per hour before %s", wait, u.maxDisruptionsPerHour, action)
+		time.Sleep(wait)
+	}
+}
+
+// takeDisruptionToken takes a token from the disruption bucket of the cluster at now, persisting the bucket, and
+// returns how long to wait for one if there is none.
+func (u *ControlPlaneUpgrader) takeDisruptionToken(now time.Time) (time.Duration, error) {
+	key := ctrlclient.ObjectKey{Namespace: u.clusterNamespace, Name: pacingConfigMapName(u.clusterName)}
+
+	cm := &v1.ConfigMap{}
+	err := u.managementClusterClient.Get(context.TODO(), key, cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return 0, errors.Wrapf(err, "error getting pacing configmap %s", key)
+	}
+	exists := err == nil
+
+	var bucket disruptionBucket
+	if data := cm.Data[disruptionBucketKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &bucket); err != nil {
+			return 0, errors.Wrapf(err, "error decoding the disruption bucket of pacing configmap %s", key)
+		}
+	}
+	wait := bucket.take(u.maxDisruptionsPerHour, now)
+
+	data, err := json.Marshal(bucket)
+	if err != nil {
+		return 0, errors.Wrap(err, "error encoding the disruption bucket")
+	}
+	if !exists {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Labels:    map[string]string{clusterv1.MachineClusterLabelName: u.clusterName},
+			},
+			Data: map[string]string{disruptionBucketKey: string(data)},
+		}
+		if err := u.managementClusterClient.Create(context.TODO(), cm); err != nil {
+			return 0, errors.Wrapf(err, "error creating pacing configmap %s", key)
+		}
+		return wait, nil
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[disruptionBucketKey] = string(data)
+	if err := u.managementClusterClient.Update(context.TODO(), cm); err != nil {
+		return 0, errors.Wrapf(err, "error updating pacing configmap %s", key)
+	}
+	return wait, nil
+}
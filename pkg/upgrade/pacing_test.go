@@ -0,0 +1,80 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDisruptionBucketTake(t *testing.T) {
+	start := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	var b disruptionBucket
+
+	// A new bucket allows a burst of the maximum
+	assert.Equal(t, time.Duration(0), b.take(2, start))
+	assert.Equal(t, time.Duration(0), b.take(2, start))
+	assert.Equal(t, 30*time.Minute, b.take(2, start))
+	assert.Equal(t, 0.0, b.Tokens)
+
+	// Tokens are earned at the maximum an hour
+	assert.Equal(t, 10*time.Minute, b.take(2, start.Add(20*time.Minute)))
+	assert.Equal(t, time.Duration(0), b.take(2, start.Add(30*time.Minute)))
+
+	// Up to the maximum
+	assert.Equal(t, time.Duration(0), b.take(2, start.Add(10*time.Hour)))
+	assert.Equal(t, 1.0, b.Tokens)
+	assert.Equal(t, start.Add(10*time.Hour), b.Updated)
+}
+
+func TestPaceDisruptionPastDeadline(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, v1.AddToScheme(scheme))
+	data, err := json.Marshal(disruptionBucket{Tokens: 0, Updated: time.Now()})
+	require.NoError(t, err)
+	pacing := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "cluster-upgrade-pacing"},
+		Data:       map[string]string{disruptionBucketKey: string(data)},
+	}
+	u := &ControlPlaneUpgrader{
+		clusterNamespace:        "ns",
+		clusterName:             "cluster",
+		upgradeID:               "123",
+		managementClusterClient: fake.NewFakeClientWithScheme(scheme, pacing),
+		maxDisruptionsPerHour:   1,
+	}
+	u.budget.until = time.Now().Add(time.Minute)
+	u.budget.start(time.Now(), 0)
+
+	// The bucket is empty, and waiting an hour for a token would run past the deadline
+	started := time.Now()
+	err = u.paceDisruption("replacing machine cp-0", "3 control plane machines")
+	require.Error(t, err)
+	assert.True(t, IsTimeBudgetExhausted(err), "unexpected error %v", err)
+	assert.Contains(t, err.Error(), "for the disruption budget would run past the deadline")
+	assert.Contains(t, err.Error(), "with 3 control plane machines left to upgrade")
+	assert.True(t, time.Since(started) < time.Second, "the upgrade waited before stopping")
+
+	// No token was taken
+	cm := &v1.ConfigMap{}
+	require.NoError(t, u.managementClusterClient.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: "ns", Name: "cluster-upgrade-pacing"}, cm))
+	var bucket disruptionBucket
+	require.NoError(t, json.Unmarshal([]byte(cm.Data[disruptionBucketKey]), &bucket))
+	assert.True(t, bucket.Tokens < 1)
+
+	// A full bucket lets the replacement start right away
+	u.budget = runBudget{}
+	require.NoError(t, u.managementClusterClient.Delete(context.TODO(), cm))
+	require.NoError(t, u.paceDisruption("replacing machine cp-0", "3 control plane machines"))
+}
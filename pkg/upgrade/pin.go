@@ -0,0 +1,107 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationPin is the annotation key operators set to "true" on a Machine to exclude it from upgrades, for example
+// while it is under investigation or runs on special hardware.
+const AnnotationPin = annotationPrefix + "pin"
+
+// isPinned returns true if machine is excluded from upgrades by the pin annotation.
+func isPinned(machine *clusterv1.Machine) bool {
+	pinned, err := strconv.ParseBool(machine.Annotations[AnnotationPin])
+	return err == nil && pinned
+}
+
+// partitionPinnedMachines splits machines into those to upgrade and those that are pinned, preserving their order.
+func partitionPinnedMachines(machines []*clusterv1.Machine) ([]*clusterv1.Machine, []*clusterv1.Machine) {
+	var unpinned, pinned []*clusterv1.Machine
+	for _, m := range machines {
+		if isPinned(m) {
+			pinned = append(pinned, m)
+			continue
+		}
+		unpinned = append(unpinned, m)
+	}
+	return unpinned, pinned
+}
+
+// pinnedNodeNames returns the names of the nodes of pinned machines.
+func pinnedNodeNames(pinned []*clusterv1.Machine) sets.String {
+	names := sets.NewString()
+	for _, m := range pinned {
+		if m.Status.NodeRef != nil {
+			names.Insert(m.Status.NodeRef.Name)
+		}
+	}
+	return names
+}
+
+// skipPinnedMachines returns the control plane machines to upgrade, recording a warning for each pinned machine it
+// leaves out.
+func (u *ControlPlaneUpgrader) skipPinnedMachines(machines []*clusterv1.Machine) []*clusterv1.Machine {
+	unpinned, pinned := partitionPinnedMachines(machines)
+	for _, m := range pinned {
+		u.warnings.add(WarningMachinePinned, fmt.Sprintf("%s/%s", m.Namespace, m.Name), "machine was not upgraded as it is pinned by the %s annotation", AnnotationPin)
+	}
+	u.pinnedNodes = pinnedNodeNames(pinned)
+	return unpinned
+}
+
+// pinnedMachines returns the names of the pinned machines of machineDeployment. Rolling out a machine deployment
+// replaces all of its machines, so one with pinned machines cannot be upgraded without upgrading them too.
+func (u *MachineDeploymentUpgrader) pinnedMachines(machineDeployment *clusterv1.MachineDeployment) ([]string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(&machineDeployment.Spec.Selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing selector of machine deployment %q", machineDeployment.Name)
+	}
+
+	machines := &clusterv1.MachineList{}
+	listOptions := []ctrlclient.ListOption{
+		ctrlclient.InNamespace(machineDeployment.Namespace),
+		ctrlclient.MatchingLabelsSelector{Selector: selector},
+	}
+	if err := u.managementClusterClient.List(context.TODO(), machines, listOptions...); err != nil {
+		return nil, errors.Wrapf(err, "error listing machines of machine deployment %q", machineDeployment.Name)
+	}
+
+	var names []string
+	for i := range machines.Items {
+		if m := &machines.Items[i]; m.DeletionTimestamp.IsZero() && isPinned(m) {
+			names = append(names, m.Name)
+		}
+	}
+	return names, nil
+}
+
+// skipPinnedMachineDeployments returns the machine deployments to upgrade, recording a warning for each one left out
+// because it has pinned machines.
+func (u *MachineDeploymentUpgrader) skipPinnedMachineDeployments(machineDeployments []clusterv1.MachineDeployment) ([]clusterv1.MachineDeployment, error) {
+	var ret []clusterv1.MachineDeployment
+	for i := range machineDeployments {
+		md := &machineDeployments[i]
+		pinned, err := u.pinnedMachines(md)
+		if err != nil {
+			return nil, err
+		}
+		if len(pinned) > 0 {
+			u.warnings.add(WarningMachinePinned, fmt.Sprintf("%s/%s", md.Namespace, md.Name), "machine deployment was not upgraded as its machines %s are pinned by the %s annotation", strings.Join(pinned, ", "), AnnotationPin)
+			continue
+		}
+		ret = append(ret, *md)
+	}
+	return ret, nil
+}
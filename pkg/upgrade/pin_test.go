@@ -0,0 +1,48 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestPartitionPinnedMachines(t *testing.T) {
+	machine := func(name, pin, node string) *clusterv1.Machine {
+		m := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if pin != "" {
+			m.Annotations = map[string]string{AnnotationPin: pin}
+		}
+		if node != "" {
+			m.Status.NodeRef = &corev1.ObjectReference{Name: node}
+		}
+		return m
+	}
+
+	machines := []*clusterv1.Machine{
+		machine("a", "", "node-a"),
+		machine("b", "true", "node-b"),
+		machine("c", "false", "node-c"),
+		machine("d", "yes", "node-d"),
+		machine("e", "TRUE", ""),
+	}
+
+	unpinned, pinned := partitionPinnedMachines(machines)
+
+	names := func(machines []*clusterv1.Machine) []string {
+		var ret []string
+		for _, m := range machines {
+			ret = append(ret, m.Name)
+		}
+		return ret
+	}
+	assert.Equal(t, []string{"a", "c", "d"}, names(unpinned))
+	assert.Equal(t, []string{"b", "e"}, names(pinned))
+	assert.Equal(t, []string{"node-b"}, pinnedNodeNames(pinned).List())
+}
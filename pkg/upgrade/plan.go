@@ -0,0 +1,344 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxKubeletSkew is how many minor versions kubelets may be older than the API server.
+const maxKubeletSkew = 2
+
+// UpgradePlan describes how a cluster would be upgraded to a Kubernetes version, without changing anything.
+type UpgradePlan struct {
+	Cluster                string `json:"cluster"`
+	ControlPlaneMachines   int    `json:"controlPlaneMachines"`
+	ControlPlaneMinVersion string `json:"controlPlaneMinVersion,omitempty"`
+	ControlPlaneMaxVersion string `json:"controlPlaneMaxVersion,omitempty"`
+	// Workers is the spread of versions of the cluster's machine deployments.
+	Workers       []WorkerVersion `json:"workers,omitempty"`
+	TargetVersion string          `json:"targetVersion"`
+	// Steps are the upgrades to run, in order, going through every minor version between the current and the target
+	// version.
+	Steps []PlanStep `json:"steps"`
+	// KubeletConfigCreations are the kubelet configmaps and RBAC objects the upgrades will create.
+	KubeletConfigCreations []string `json:"kubeletConfigCreations,omitempty"`
+	// EstimatedDuration is the longest the steps may take, based on their timeouts.
+	EstimatedDuration string `json:"estimatedDuration"`
+}
+
+// WorkerVersion lists the machine deployments at a version.
+type WorkerVersion struct {
+	Version            string   `json:"version"`
+	MachineDeployments []string `json:"machineDeployments"`
+	Replicas           int32    `json:"replicas"`
+}
+
+// PlanStep is a single run of the upgrade tool.
+type PlanStep struct {
+	Scope             string `json:"scope"`
+	KubernetesVersion string `json:"kubernetesVersion"`
+	// Args are the arguments to run the step with.
+	Args []string `json:"args"`
+}
+
+// Print writes a human readable version of the plan to w, with the commands to run prefixed by program.
+func (p *UpgradePlan) Print(w io.Writer, program string) {
+	fmt.Fprintf(w, "Cluster %s\n", p.Cluster)
+	fmt.Fprintf(w, "Control plane: %d machines at %s\n", p.ControlPlaneMachines, versionRange(p.ControlPlaneMinVersion, p.ControlPlaneMaxVersion))
+	if len(p.Workers) == 0 {
+		fmt.Fprintln(w, "Workers: no machine deployments")
+	}
+	for _, worker := range p.Workers {
+		fmt.Fprintf(w, "Workers at %s: %d replicas in %s\n", worker.Version, worker.Replicas, strings.Join(worker.MachineDeployments, ", "))
+	}
+	fmt.Fprintf(w, "Target version: %s\n", p.TargetVersion)
+
+	if len(p.KubeletConfigCreations) > 0 {
+		fmt.Fprintf(w, "\nThe control plane upgrades will create:\n")
+		for _, c := range p.KubeletConfigCreations {
+			fmt.Fprintf(w, "  %s\n", c)
+		}
+	}
+
+	if len(p.Steps) == 0 {
+		fmt.Fprintf(w, "\nThe cluster is already at %s, there is nothing to upgrade.\n", p.TargetVersion)
+		return
+	}
+
+	fmt.Fprintf(w, "\nEstimated duration: up to %s, based on the timeouts of each step\n", p.EstimatedDuration)
+	fmt.Fprintf(w, "\nRun, in order:\n")
+	for i, step := range p.Steps {
+		fmt.Fprintf(w, "%d. %s %s\n", i+1, program, strings.Join(step.Args, " "))
+	}
+}
+
+// Plan determines the current versions of the cluster and the steps to upgrade it to the desired version, without
+// changing anything.
+func (u *ControlPlaneUpgrader) Plan() (*UpgradePlan, error) {
+	plan := &UpgradePlan{Cluster: fmt.Sprintf("%s/%s", u.clusterNamespace, u.clusterName)}
+
+	machines, err := u.listMachines()
+	if err != nil {
+		return nil, err
+	}
+	machines, _ = partitionPinnedMachines(machines)
+	plan.ControlPlaneMachines = len(machines)
+	min, max, err := minMaxMachineVersions(machines)
+	if err != nil {
+		return nil, err
+	}
+	if max.EQ(unsetVersion) {
+		return nil, errors.New("unable to determine the control plane version")
+	}
+	plan.ControlPlaneMinVersion = min.String()
+	plan.ControlPlaneMaxVersion = max.String()
+
+	target, err := u.resolveDesiredVersion(max)
+	if err != nil {
+		return nil, err
+	}
+	plan.TargetVersion = target.String()
+
+	machineDeployments := &clusterv1.MachineDeploymentList{}
+	err = u.managementClusterClient.List(context.TODO(), machineDeployments,
+		ctrlclient.InNamespace(u.clusterNamespace),
+		ctrlclient.MatchingLabels{clusterv1.MachineClusterLabelName: u.clusterName},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing machine deployments")
+	}
+	plan.Workers, err = workerVersions(machineDeployments.Items)
+	if err != nil {
+		return nil, err
+	}
+	var workers []semver.Version
+	for _, worker := range plan.Workers {
+		workers = append(workers, semver.MustParse(worker.Version))
+	}
+
+	source := u.versionSource
+	if source == nil {
+		source = &releaseVersionSource{baseURL: defaultReleaseURL}
+	}
+	intermediate := func(major, minor uint64) semver.Version {
+		v, err := source.latestPatch(major, minor)
+		if err != nil {
+			v = semver.Version{Major: major, Minor: minor}
+			u.log.Info("Unable to find the newest patch release, planning the first release instead", "version", v.String(), "error", err.Error())
+		}
+		return v
+	}
+	steps := planSteps(min, max, target, workers, intermediate)
+	for i := range steps {
+		steps[i].Args = []string{
+			"--cluster-namespace", u.clusterNamespace,
+			"--cluster-name", u.clusterName,
+			"--scope", steps[i].Scope,
+			"--kubernetes-version", steps[i].KubernetesVersion,
+		}
+		if steps[i].Scope == controlPlaneScope && u.distroProfile.name != "" && u.distroProfile.name != DistroProfileVanilla {
+			steps[i].Args = append(steps[i].Args, "--distro-profile", u.distroProfile.name)
+		}
+	}
+	if i := lastControlPlaneStep(steps); i >= 0 && u.kubeletConfig != nil {
+		steps[i].Args = append(steps[i].Args, "--kubelet-config-file", u.effectiveConfig.KubeletConfigFile)
+	}
+	plan.Steps = steps
+
+	plan.KubeletConfigCreations, err = u.kubeletConfigCreations(min, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.EstimatedDuration = estimateDuration(steps, len(machines), u.machineReplacementSteps()).String()
+
+	return plan, nil
+}
+
+// workerVersions groups machineDeployments by the Kubernetes version of their machines.
+func workerVersions(machineDeployments []clusterv1.MachineDeployment) ([]WorkerVersion, error) {
+	byVersion := map[string]*WorkerVersion{}
+	var versions []semver.Version
+	for _, md := range machineDeployments {
+		if md.Spec.Template.Spec.Version == nil {
+			return nil, errors.Errorf("nil version for machine deployment %s/%s", md.Namespace, md.Name)
+		}
+		v, err := semver.ParseTolerant(*md.Spec.Template.Spec.Version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid version %q for machine deployment %s/%s", *md.Spec.Template.Spec.Version, md.Namespace, md.Name)
+		}
+
+		worker, ok := byVersion[v.String()]
+		if !ok {
+			worker = &WorkerVersion{Version: v.String()}
+			byVersion[v.String()] = worker
+			versions = append(versions, v)
+		}
+		worker.MachineDeployments = append(worker.MachineDeployments, md.Name)
+		if md.Spec.Replicas != nil {
+			worker.Replicas += *md.Spec.Replicas
+		} else {
+			worker.Replicas++
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].LT(versions[j]) })
+	ret := make([]WorkerVersion, 0, len(versions))
+	for _, v := range versions {
+		ret = append(ret, *byVersion[v.String()])
+	}
+	return ret, nil
+}
+
+// planSteps returns the upgrades taking a control plane at versions min to max, and workers at versions workers, to
+// target. The control plane goes through every minor version in between, at the version returned by intermediate.
+// Workers are upgraded last, or earlier when they would otherwise fall more than maxKubeletSkew minor versions behind
+// the control plane.
+func planSteps(min, max, target semver.Version, workers []semver.Version, intermediate func(major, minor uint64) semver.Version) []PlanStep {
+	var steps []PlanStep
+
+	var oldestWorker semver.Version
+	for _, w := range workers {
+		if oldestWorker.EQ(unsetVersion) || w.LT(oldestWorker) {
+			oldestWorker = w
+		}
+	}
+
+	controlPlane := max
+	upgradeControlPlane := func(v semver.Version) {
+		if len(workers) > 0 && oldestWorker.Major == v.Major && oldestWorker.Minor+maxKubeletSkew < v.Minor {
+			steps = append(steps, PlanStep{Scope: machineDeploymentScope, KubernetesVersion: controlPlane.String()})
+			oldestWorker = controlPlane
+		}
+		steps = append(steps, PlanStep{Scope: controlPlaneScope, KubernetesVersion: v.String()})
+		controlPlane = v
+	}
+
+	if max.Major == target.Major {
+		for minor := max.Minor + 1; minor < target.Minor; minor++ {
+			upgradeControlPlane(intermediate(target.Major, minor))
+		}
+	}
+	if !min.EQ(target) || !controlPlane.EQ(target) {
+		upgradeControlPlane(target)
+	}
+
+	for _, w := range workers {
+		if !w.EQ(target) {
+			steps = append(steps, PlanStep{Scope: machineDeploymentScope, KubernetesVersion: target.String()})
+			break
+		}
+	}
+
+	return steps
+}
+
+// lastControlPlaneStep returns the index of the last control plane step of steps, or -1 if there is none.
+func lastControlPlaneStep(steps []PlanStep) int {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].Scope == controlPlaneScope {
+			return i
+		}
+	}
+	return -1
+}
+
+// kubeletConfigCreations returns the kubelet configmaps and RBAC objects the control plane steps will create when
+// upgrading from min, as they do not exist yet. With a kubelet config file, the configmap the last control plane step
+// writes from it, even as a patch upgrade, is also listed if it exists with a different content.
+func (u *ControlPlaneUpgrader) kubeletConfigCreations(min semver.Version, steps []PlanStep) ([]string, error) {
+	var creations []string
+	current := min
+	last := lastControlPlaneStep(steps)
+	for i, step := range steps {
+		if step.Scope != controlPlaneScope {
+			continue
+		}
+		v := semver.MustParse(step.KubernetesVersion)
+		minor := isMinorVersionUpgrade(current, v)
+		current = v
+		if !minor && (i != last || u.kubeletConfig == nil) {
+			continue
+		}
+
+		if !u.distroProfile.skipKubeletConfigMap {
+			configMapName := kubeletConfigMapName(v)
+			cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(configMapName, metav1.GetOptions{})
+			switch {
+			case apierrors.IsNotFound(err):
+				creations = append(creations, "configmap kube-system/"+configMapName)
+			case err != nil:
+				return nil, errors.Wrapf(err, "error determining if configmap %s exists", configMapName)
+			case i == last && u.kubeletConfig != nil && cm.Data[kubeadmKubeletConfigKey] != string(u.kubeletConfig):
+				creations = append(creations, "configmap kube-system/"+configMapName+" (replaced from the kubelet config file)")
+			}
+		}
+		if !minor || u.distroProfile.skipKubeletRBAC {
+			continue
+		}
+
+		roleName := kubeletConfigRoleName(v)
+		_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Get(roleName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			creations = append(creations, "role kube-system/"+roleName)
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "error determining if role %s exists", roleName)
+		}
+		_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Get(roleName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			creations = append(creations, "rolebinding kube-system/"+roleName)
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "error determining if rolebinding %s exists", roleName)
+		}
+	}
+	return creations, nil
+}
+
+// machineReplacementSteps returns how many steps, each bounded by machineReplacementStepTimeout, replacing a control
+// plane machine waits for.
+func (u *ControlPlaneUpgrader) machineReplacementSteps() int {
+	// provider id, node, node ready
+	steps := 3
+	if u.verifyEtcdMember {
+		steps++
+	}
+	if u.verifyDeprovisioning {
+		steps++
+	}
+	if u.bootstrapCleanup != "" {
+		steps++
+	}
+	if u.quiescenceGate {
+		steps++
+	}
+	return steps
+}
+
+// estimateDuration returns the longest steps may take for a control plane of machines machines, based on the step
+// timeouts.
+func estimateDuration(steps []PlanStep, machines, machineReplacementSteps int) time.Duration {
+	var d time.Duration
+	for _, step := range steps {
+		switch step.Scope {
+		case controlPlaneScope:
+			d += time.Duration(machines*machineReplacementSteps) * machineReplacementStepTimeout
+		case machineDeploymentScope:
+			d += machineDeploymentRolloutTimeout
+		}
+	}
+	return d
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestPlanSteps(t *testing.T) {
+	v := semver.MustParse
+	intermediate := func(major, minor uint64) semver.Version {
+		return semver.Version{Major: major, Minor: minor, Patch: 9}
+	}
+	step := func(scope, version string) PlanStep {
+		return PlanStep{Scope: scope, KubernetesVersion: version}
+	}
+
+	tests := []struct {
+		name     string
+		min, max string
+		target   string
+		workers  []semver.Version
+		expected []PlanStep
+	}{
+		{
+			name: "patch upgrade",
+			min:  "1.16.1", max: "1.16.1", target: "1.16.3",
+			workers: []semver.Version{v("1.16.1")},
+			expected: []PlanStep{
+				step(controlPlaneScope, "1.16.3"),
+				step(machineDeploymentScope, "1.16.3"),
+			},
+		},
+		{
+			name: "already at target",
+			min:  "1.16.3", max: "1.16.3", target: "1.16.3",
+			workers: []semver.Version{v("1.16.3")},
+		},
+		{
+			name: "control plane partially upgraded",
+			min:  "1.15.2", max: "1.16.3", target: "1.16.3",
+			expected: []PlanStep{
+				step(controlPlaneScope, "1.16.3"),
+			},
+		},
+		{
+			name: "only workers behind",
+			min:  "1.16.3", max: "1.16.3", target: "1.16.3",
+			workers: []semver.Version{v("1.16.3"), v("1.15.2")},
+			expected: []PlanStep{
+				step(machineDeploymentScope, "1.16.3"),
+			},
+		},
+		{
+			name: "intermediate minor versions",
+			min:  "1.14.1", max: "1.14.1", target: "1.16.3",
+			workers: []semver.Version{v("1.14.1")},
+			expected: []PlanStep{
+				step(controlPlaneScope, "1.15.9"),
+				step(controlPlaneScope, "1.16.3"),
+				step(machineDeploymentScope, "1.16.3"),
+			},
+		},
+		{
+			name: "workers upgraded before falling too far behind",
+			min:  "1.14.1", max: "1.14.1", target: "1.18.0",
+			workers: []semver.Version{v("1.14.1")},
+			expected: []PlanStep{
+				step(controlPlaneScope, "1.15.9"),
+				step(controlPlaneScope, "1.16.9"),
+				step(machineDeploymentScope, "1.16.9"),
+				step(controlPlaneScope, "1.17.9"),
+				step(controlPlaneScope, "1.18.0"),
+				step(machineDeploymentScope, "1.18.0"),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := planSteps(v(tc.min), v(tc.max), v(tc.target), tc.workers, intermediate)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestWorkerVersions(t *testing.T) {
+	machineDeployment := func(name, version string, replicas *int32) clusterv1.MachineDeployment {
+		md := clusterv1.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+		md.Spec.Replicas = replicas
+		md.Spec.Template.Spec.Version = &version
+		return md
+	}
+	three := int32(3)
+
+	workers, err := workerVersions([]clusterv1.MachineDeployment{
+		machineDeployment("a", "v1.16.3", &three),
+		machineDeployment("b", "1.15.2", nil),
+		machineDeployment("c", "1.16.3", &three),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []WorkerVersion{
+		{Version: "1.15.2", MachineDeployments: []string{"b"}, Replicas: 1},
+		{Version: "1.16.3", MachineDeployments: []string{"a", "c"}, Replicas: 6},
+	}, workers)
+
+	_, err = workerVersions([]clusterv1.MachineDeployment{machineDeployment("a", "bad", nil)})
+	assert.Error(t, err)
+}
+
+func TestEstimateDuration(t *testing.T) {
+	steps := []PlanStep{
+		{Scope: controlPlaneScope, KubernetesVersion: "1.15.9"},
+		{Scope: controlPlaneScope, KubernetesVersion: "1.16.3"},
+		{Scope: machineDeploymentScope, KubernetesVersion: "1.16.3"},
+	}
+	// 2 control plane steps * 3 machines * 4 steps * 15 minutes + 30 minutes
+	assert.Equal(t, 6*time.Hour+30*time.Minute, estimateDuration(steps, 3, 4))
+}
+
+func TestKubeletConfigCreationsFromFile(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kubelet-config-1.16"},
+		Data:       map[string]string{kubeadmKubeletConfigKey: "current"},
+	})
+	steps := []PlanStep{{Scope: controlPlaneScope, KubernetesVersion: "1.16.3"}}
+
+	u := &ControlPlaneUpgrader{targetKubernetesClient: client}
+	creations, err := u.kubeletConfigCreations(semver.MustParse("1.16.2"), steps)
+	assert.NoError(t, err)
+	assert.Empty(t, creations)
+
+	u.kubeletConfig = []byte("kind: KubeletConfiguration")
+	creations, err = u.kubeletConfigCreations(semver.MustParse("1.16.2"), steps)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"configmap kube-system/kubelet-config-1.16 (replaced from the kubelet config file)"}, creations)
+
+	u.kubeletConfig = []byte("current")
+	creations, err = u.kubeletConfigCreations(semver.MustParse("1.16.2"), steps)
+	assert.NoError(t, err)
+	assert.Empty(t, creations)
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// preCreateSteps are the steps of creating the replacement of a control plane machine before any machine is replaced.
+type preCreateSteps struct {
+	// createObjects creates the infrastructure and bootstrap objects replacing machine.
+	createObjects func(machine *clusterv1.Machine) error
+	// createMachine creates the machine replacing machine.
+	createMachine func(machine *clusterv1.Machine) error
+	// waitForNode waits for the machine replacing machine to be provisioned with a ready node.
+	waitForNode func(machine *clusterv1.Machine) error
+}
+
+// preCreateReplacements creates the replacements of all of machines, and waits for them to be provisioned, before any
+// of them is replaced, so that replacements rejected by the management cluster or failing to provision stop the
+// upgrade before the control plane is touched. The infrastructure and bootstrap objects of all replacements are
+// created first, then the replacement machines, one at a time so their etcd members join one by one, each provisioned
+// with a ready node before the next one is created. The old machines are then replaced, and their etcd members
+// removed, one at a time as usual.
+func (u *ControlPlaneUpgrader) preCreateReplacements(machines []*clusterv1.Machine) error {
+	return u.preCreate(machines, preCreateSteps{
+		createObjects: func(machine *clusterv1.Machine) error {
+			return u.createReplacementObjects(u.replacementKey(machine), machine)
+		},
+		createMachine: func(machine *clusterv1.Machine) error {
+			// none of the machines has been replaced yet
+			if err := u.timeBudgetExhausted(fmt.Sprintf("%d control plane machines", len(machines))); err != nil {
+				return err
+			}
+			// TODO extract timeout as a configurable constant
+			if err := u.waitForQuiescence(machineReplacementStepTimeout); err != nil {
+				return err
+			}
+			return u.ensureReplacementMachine(u.replacementKey(machine), machine)
+		},
+		waitForNode: func(machine *clusterv1.Machine) error {
+			_, err := u.waitForReplacementNode(u.replacementKey(machine))
+			return err
+		},
+	})
+}
+
+// preCreate runs the steps of preCreateReplacements for machines.
+func (u *ControlPlaneUpgrader) preCreate(machines []*clusterv1.Machine, steps preCreateSteps) error {
+	u.log.Info("Creating all replacement infrastructure and bootstrap objects", "machines", len(machines))
+	for _, machine := range machines {
+		if err := steps.createObjects(machine); err != nil {
+			return errors.Wrapf(err, "error creating the replacement objects of machine %s/%s", machine.Namespace, machine.Name)
+		}
+	}
+	u.record.event("Created the replacement infrastructure and bootstrap objects of %d control plane machines", len(machines))
+
+	for i, machine := range machines {
+		u.log.Info("Creating replacement machine", "machine", fmt.Sprintf("%s/%s", machine.Namespace, machine.Name), "progress", fmt.Sprintf("%d/%d", i+1, len(machines)))
+		if err := steps.createMachine(machine); err != nil {
+			return err
+		}
+		if err := steps.waitForNode(machine); err != nil {
+			return errors.Wrapf(err, "replacement machine %s did not provision, no control plane machine was deleted", u.replacementKey(machine))
+		}
+	}
+	u.record.event("All %d replacement control plane machines are provisioned", len(machines))
+	return nil
+}
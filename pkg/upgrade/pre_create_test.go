@@ -0,0 +1,136 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakePreCreateSteps records the pre-creation steps, creating the replacement machines in client, and fails waiting
+// for the node of the machine called failNode.
+type fakePreCreateSteps struct {
+	u        *ControlPlaneUpgrader
+	client   ctrlclient.Client
+	failNode string
+	steps    []string
+}
+
+func (f *fakePreCreateSteps) preCreateSteps() preCreateSteps {
+	return preCreateSteps{
+		createObjects: func(machine *clusterv1.Machine) error {
+			f.steps = append(f.steps, "objects "+machine.Name)
+			return nil
+		},
+		createMachine: func(machine *clusterv1.Machine) error {
+			f.steps = append(f.steps, "machine "+machine.Name)
+			key := f.u.replacementKey(machine)
+			return f.client.Create(context.TODO(), &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}})
+		},
+		waitForNode: func(machine *clusterv1.Machine) error {
+			f.steps = append(f.steps, "node "+machine.Name)
+			if machine.Name == f.failNode {
+				return errors.New("timed out waiting for machine provider id")
+			}
+			return nil
+		},
+	}
+}
+
+func preCreateTestMachines() []*clusterv1.Machine {
+	var machines []*clusterv1.Machine
+	for i := 0; i < 3; i++ {
+		machines = append(machines, &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: fmt.Sprintf("cp-%d", i)}})
+	}
+	return machines
+}
+
+func newPreCreateTestUpgrader(t *testing.T, machines []*clusterv1.Machine) *ControlPlaneUpgrader {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterv1.AddToScheme(scheme))
+	var objs []runtime.Object
+	for _, machine := range machines {
+		objs = append(objs, machine.DeepCopy())
+	}
+	return &ControlPlaneUpgrader{
+		log:                     logrtesting.NullLogger{},
+		clusterNamespace:        "ns",
+		upgradeID:               "123",
+		managementClusterClient: fake.NewFakeClientWithScheme(scheme, objs...),
+	}
+}
+
+func TestPreCreate(t *testing.T) {
+	machines := preCreateTestMachines()
+	u := newPreCreateTestUpgrader(t, machines)
+	f := &fakePreCreateSteps{u: u, client: u.managementClusterClient}
+
+	require.NoError(t, u.preCreate(machines, f.preCreateSteps()))
+
+	// The objects of all replacements come first, then each machine is provisioned before the next one is created
+	assert.Equal(t, []string{
+		"objects cp-0", "objects cp-1", "objects cp-2",
+		"machine cp-0", "node cp-0",
+		"machine cp-1", "node cp-1",
+		"machine cp-2", "node cp-2",
+	}, f.steps)
+}
+
+func TestPreCreateProvisioningFailure(t *testing.T) {
+	machines := preCreateTestMachines()
+	u := newPreCreateTestUpgrader(t, machines)
+	f := &fakePreCreateSteps{u: u, client: u.managementClusterClient, failNode: "cp-1"}
+
+	err := u.preCreate(machines, f.preCreateSteps())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "replacement machine ns/cp-1.upgrade.123 did not provision, no control plane machine was deleted")
+
+	// The upgrade stops at the first replacement failing to provision
+	assert.Equal(t, []string{
+		"objects cp-0", "objects cp-1", "objects cp-2",
+		"machine cp-0", "node cp-0",
+		"machine cp-1", "node cp-1",
+	}, f.steps)
+
+	// and none of the old machines is deleted
+	list := &clusterv1.MachineList{}
+	require.NoError(t, u.managementClusterClient.List(context.TODO(), list))
+	var names []string
+	for _, machine := range list.Items {
+		names = append(names, machine.Name)
+	}
+	assert.ElementsMatch(t, []string{"cp-0", "cp-1", "cp-2", "cp-0.upgrade.123", "cp-1.upgrade.123"}, names)
+}
+
+func TestPreCreateObjectsFailure(t *testing.T) {
+	machines := preCreateTestMachines()
+	u := newPreCreateTestUpgrader(t, machines)
+	f := &fakePreCreateSteps{u: u, client: u.managementClusterClient}
+	steps := f.preCreateSteps()
+	createObjects := steps.createObjects
+	steps.createObjects = func(machine *clusterv1.Machine) error {
+		if machine.Name == "cp-2" {
+			return errors.New(`admission webhook "validation.awsmachine" denied the request`)
+		}
+		return createObjects(machine)
+	}
+
+	err := u.preCreate(machines, steps)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error creating the replacement objects of machine ns/cp-2")
+
+	// No replacement machine is created until the objects of all of them are
+	assert.Equal(t, []string{"objects cp-0", "objects cp-1"}, f.steps)
+}
@@ -0,0 +1,323 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// PrecheckReport contains the results of the checks run before a control plane upgrade.
+type PrecheckReport struct {
+	CurrentVersion string        `json:"currentVersion,omitempty"`
+	DesiredVersion string        `json:"desiredVersion,omitempty"`
+	Results        []CheckResult `json:"results"`
+	// PinnedMachines lists the machines excluded from the upgrade by the pin annotation.
+	PinnedMachines []string `json:"pinnedMachines,omitempty"`
+}
+
+// precheck is a named check run by Precheck. It returns the problems found.
+type precheck struct {
+	name  string
+	check func() ([]string, error)
+}
+
+// Eligible returns true if all checks passed, meaning Upgrade would not refuse to start.
+func (r *PrecheckReport) Eligible() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes a human readable version of the report to w.
+func (r *PrecheckReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Checking control plane upgrade from %s to %s\n", r.CurrentVersion, r.DesiredVersion)
+	if len(r.PinnedMachines) > 0 {
+		fmt.Fprintf(w, "Skipping pinned machines: %s\n", strings.Join(r.PinnedMachines, ", "))
+	}
+	for _, result := range r.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		if result.Message == "" {
+			fmt.Fprintf(w, "[%s] %s\n", status, result.Name)
+			continue
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, result.Name, result.Message)
+	}
+}
+
+// Precheck runs the checks Upgrade performs before it changes anything, without starting an upgrade. Checks that fail
+// are reported in the returned report; an error is only returned if the checks could not be run or ctx is done.
+func (u *ControlPlaneUpgrader) Precheck(ctx context.Context) (PrecheckReport, error) {
+	report := PrecheckReport{}
+
+	machines, err := u.listMachines()
+	if err != nil {
+		return report, err
+	}
+	machines, pinned := partitionPinnedMachines(machines)
+	if err := u.detectExternalEtcd(); err != nil {
+		return report, err
+	}
+	for _, m := range pinned {
+		report.PinnedMachines = append(report.PinnedMachines, fmt.Sprintf("%s/%s", m.Namespace, m.Name))
+	}
+
+	checks := []precheck{
+		{name: "control plane machines", check: func() ([]string, error) { return precheckMachines(machines), nil }},
+		{name: "machine status", check: func() ([]string, error) { return machineStatusProblems(machines, u.upgradeID), nil }},
+		{name: "replacement machine names", check: func() ([]string, error) { return replacementNameCollisions(machines, u.upgradeID), nil }},
+	}
+	if u.machinesWithoutProviderID == MachineProviderIDFail {
+		checks = append(checks, precheck{name: "machine provider ids", check: func() ([]string, error) { return precheckProviderIDs(machines), nil }})
+	}
+	if u.concurrentOperations == ConcurrentOperationsBlock {
+		checks = append(checks, precheck{name: "concurrent operations", check: u.precheckConcurrentOperations})
+	}
+	checks = append(checks, precheck{name: "self-hosted cluster", check: u.precheckSelfHosted})
+	if u.requireCleanDrift {
+		checks = append(checks, precheck{name: "machine drift", check: func() ([]string, error) { return u.precheckDrift(machines) }})
+	}
+	checks = append(checks,
+		precheck{name: "infrastructure kinds", check: func() ([]string, error) { return u.precheckInfrastructureKinds(machines), nil }},
+		precheck{name: "image fields", check: func() ([]string, error) { return u.precheckImageFields(machines) }},
+		precheck{name: "kubernetes version", check: func() ([]string, error) { return u.precheckVersion(machines, &report), nil }},
+		precheck{name: "kubeadm-config", check: func() ([]string, error) { return u.precheckKubeadmConfigMap(machines, &report) }},
+		precheck{name: "cluster networking", check: func() ([]string, error) { return u.precheckClusterNetworking(machines, &report) }},
+		precheck{name: "node runtime compatibility", check: func() ([]string, error) { return u.precheckNodeRuntimes(&report) }},
+		precheck{name: "infrastructure provider compatibility", check: func() ([]string, error) { return u.precheckProviderCompatibility(&report) }},
+		precheck{name: "etcd health", check: u.precheckEtcd},
+	)
+	if u.etcdExternal {
+		checks = append(checks, precheck{name: "external etcd version", check: u.externalEtcdVersionProblems})
+	}
+	if u.etcdColocated {
+		checks = append(checks, precheck{name: "colocated etcd", check: func() ([]string, error) { return u.colocatedEtcdProblems(), nil }})
+	}
+	if u.etcdSpaceCheck == EtcdSpaceFail {
+		checks = append(checks, precheck{name: "etcd space", check: u.precheckEtcdSpace})
+	}
+	if u.quiescenceGate {
+		checks = append(checks, precheck{name: "cluster quiescence", check: u.checkQuiescence})
+	}
+	if u.imageVerifier != nil {
+		checks = append(checks, precheck{name: "image verification", check: func() ([]string, error) { return u.imageVerificationProblems(machines) }})
+	}
+	if u.admissionDryRun {
+		checks = append(checks, precheck{name: "admission dry run", check: func() ([]string, error) { return u.precheckAdmission(machines, &report) }})
+	}
+	if u.dryRunPreflight {
+		checks = append(checks, precheck{name: "dry run preflight", check: func() ([]string, error) { return u.precheckDryRun(machines, &report) }})
+	}
+
+	for _, c := range checks {
+		if err := ctx.Err(); err != nil {
+			return report, errors.WithStack(err)
+		}
+
+		u.log.Info("Prechecking", "check", c.name)
+		problems, err := c.check()
+		if err != nil {
+			return report, errors.Wrapf(err, "error checking %s", c.name)
+		}
+		report.Results = append(report.Results, CheckResult{
+			Name:    c.name,
+			Passed:  len(problems) == 0,
+			Message: strings.Join(problems, "; "),
+		})
+	}
+
+	return report, nil
+}
+
+func precheckMachines(machines []*clusterv1.Machine) []string {
+	if len(machines) == 0 {
+		return []string{"found 0 control plane machines that are not pinned"}
+	}
+	return nil
+}
+
+func precheckProviderIDs(machines []*clusterv1.Machine) []string {
+	var problems []string
+	for _, name := range machinesWithoutProviderID(machines) {
+		problems = append(problems, fmt.Sprintf("machine %s has no spec.providerID", name))
+	}
+	return problems
+}
+
+func (u *ControlPlaneUpgrader) precheckSelfHosted() ([]string, error) {
+	selfHosted, err := u.isSelfHosted()
+	if err != nil {
+		return nil, err
+	}
+	if selfHosted && !u.allowSelfHosted {
+		return []string{"the management cluster is the target cluster (self-hosted) and self-hosted upgrades are not allowed"}, nil
+	}
+	return nil, nil
+}
+
+func (u *ControlPlaneUpgrader) precheckDrift(machines []*clusterv1.Machine) ([]string, error) {
+	report, err := u.detectDrift(machines)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, m := range report.Machines {
+		for _, p := range m.Problems {
+			problems = append(problems, fmt.Sprintf("machine %s/%s: %s", m.Namespace, m.Name, p))
+		}
+	}
+	return problems, nil
+}
+
+func (u *ControlPlaneUpgrader) precheckInfrastructureKinds(machines []*clusterv1.Machine) []string {
+	if _, err := summarizeInfrastructureKinds(machines, u.machineUpdates, u.desiredVersion); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// precheckImageFields checks the image fields exist on the infrastructure machines. It is skipped if the image
+// configuration is invalid, as the infrastructure kinds check reports that.
+func (u *ControlPlaneUpgrader) precheckImageFields(machines []*clusterv1.Machine) ([]string, error) {
+	if _, err := summarizeInfrastructureKinds(machines, u.machineUpdates, u.desiredVersion); err != nil {
+		return nil, nil
+	}
+	return u.imageFieldProblems(machines)
+}
+
+// precheckVersion determines the current and desired versions of the control plane and records them in report.
+func (u *ControlPlaneUpgrader) precheckVersion(machines []*clusterv1.Machine, report *PrecheckReport) []string {
+	_, max, err := minMaxMachineVersions(machines)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if !max.EQ(unsetVersion) {
+		report.CurrentVersion = max.String()
+	}
+
+	desired, err := u.resolveDesiredVersion(max)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	report.DesiredVersion = desired.String()
+
+	return nil
+}
+
+// precheckKubeadmConfigMap checks the kubeadm-config ConfigMap can be updated to the desired version recorded in report.
+// It is skipped if the desired version could not be determined.
+func (u *ControlPlaneUpgrader) precheckKubeadmConfigMap(machines []*clusterv1.Machine, report *PrecheckReport) ([]string, error) {
+	if report.DesiredVersion == "" {
+		return nil, nil
+	}
+	desired, err := semver.Parse(report.DesiredVersion)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	min, _, err := minMaxMachineVersions(machines)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.kubeadmConfigMapProblems(machines, min, desired)
+}
+
+// precheckAdmission creates the replacement objects of machines in dry run at the desired version recorded in report.
+// It is skipped if the desired version could not be determined.
+func (u *ControlPlaneUpgrader) precheckAdmission(machines []*clusterv1.Machine, report *PrecheckReport) ([]string, error) {
+	if report.DesiredVersion == "" {
+		return nil, nil
+	}
+	desired, err := semver.Parse(report.DesiredVersion)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// the replacements are built at the desired version, which prechecks do not otherwise set
+	u.desiredVersion = desired
+
+	return u.admissionDryRunProblems(machines)
+}
+
+// precheckDryRun performs the mutations planned for machines in dry run at the desired version recorded in report. It
+// is skipped if the desired version could not be determined.
+func (u *ControlPlaneUpgrader) precheckDryRun(machines []*clusterv1.Machine, report *PrecheckReport) ([]string, error) {
+	if report.DesiredVersion == "" {
+		return nil, nil
+	}
+	desired, err := semver.Parse(report.DesiredVersion)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	min, _, err := minMaxMachineVersions(machines)
+	if err != nil {
+		return nil, err
+	}
+	// the planned mutations are built at the desired version, which prechecks do not otherwise set
+	u.desiredVersion = desired
+
+	return u.dryRunPreflightProblems(machines, min)
+}
+
+// precheckNodeRuntimes checks the nodes' container runtimes can run the desired version recorded in report. It is
+// skipped if the desired version could not be determined.
+func (u *ControlPlaneUpgrader) precheckNodeRuntimes(report *PrecheckReport) ([]string, error) {
+	if report.DesiredVersion == "" {
+		return nil, nil
+	}
+	desired, err := semver.Parse(report.DesiredVersion)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return u.nodeRuntimeProblems(desired)
+}
+
+// precheckClusterNetworking checks the cluster networking of machines is consistent and supported at the desired
+// version recorded in report. It is skipped if the desired version could not be determined.
+func (u *ControlPlaneUpgrader) precheckClusterNetworking(machines []*clusterv1.Machine, report *PrecheckReport) ([]string, error) {
+	if report.DesiredVersion == "" {
+		return nil, nil
+	}
+	desired, err := semver.Parse(report.DesiredVersion)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return u.clusterNetworkingProblems(machines, desired)
+}
+
+// precheckProviderCompatibility checks the infrastructure providers support the desired version recorded in report. It
+// is skipped if the desired version could not be determined.
+func (u *ControlPlaneUpgrader) precheckProviderCompatibility(report *PrecheckReport) ([]string, error) {
+	if report.DesiredVersion == "" {
+		return nil, nil
+	}
+	desired, err := semver.Parse(report.DesiredVersion)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return providerCompatibilityProblems(u.log, u.managementClusterClient, u.providerCompatibility, desired, u.ignoreProviderCompatibility, u.warnings)
+}
+
+func (u *ControlPlaneUpgrader) precheckEtcd() ([]string, error) {
+	if err := u.etcdClusterHealthCheck(time.Minute * 1); err != nil {
+		return []string{err.Error()}, nil
+	}
+	return nil, nil
+}
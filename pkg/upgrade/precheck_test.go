@@ -0,0 +1,72 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestPrecheckVersion(t *testing.T) {
+	machine := func(name, version string) *clusterv1.Machine {
+		return &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       clusterv1.MachineSpec{Version: &version},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		userVersion     semver.Version
+		machines        []*clusterv1.Machine
+		expectedCurrent string
+		expectedDesired string
+		expectProblems  bool
+	}{
+		{
+			name:            "user version",
+			userVersion:     semver.MustParse("1.16.2"),
+			machines:        []*clusterv1.Machine{machine("a", "v1.15.3"), machine("b", "v1.15.4")},
+			expectedCurrent: "1.15.4",
+			expectedDesired: "1.16.2",
+		},
+		{
+			name:            "defaults to newest machine version",
+			machines:        []*clusterv1.Machine{machine("a", "v1.15.3"), machine("b", "v1.15.4")},
+			expectedCurrent: "1.15.4",
+			expectedDesired: "1.15.4",
+		},
+		{
+			name:           "invalid machine version",
+			userVersion:    semver.MustParse("1.16.2"),
+			machines:       []*clusterv1.Machine{machine("a", "bogus")},
+			expectProblems: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &ControlPlaneUpgrader{userVersion: tc.userVersion}
+			report := &PrecheckReport{}
+
+			problems := u.precheckVersion(tc.machines, report)
+
+			assert.Equal(t, tc.expectProblems, len(problems) > 0, "problems: %v", problems)
+			assert.Equal(t, tc.expectedCurrent, report.CurrentVersion)
+			assert.Equal(t, tc.expectedDesired, report.DesiredVersion)
+		})
+	}
+}
+
+func TestPrecheckReportEligible(t *testing.T) {
+	report := &PrecheckReport{Results: []CheckResult{{Name: "a", Passed: true}}}
+	assert.True(t, report.Eligible())
+
+	report.Results = append(report.Results, CheckResult{Name: "b", Message: "broken"})
+	assert.False(t, report.Eligible())
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// plannedReplacements returns the machines of machines an upgrade replaces: those with a provider id that are not
+// replacements of this upgrade.
+func (u *ControlPlaneUpgrader) plannedReplacements(machines []*clusterv1.Machine) []*clusterv1.Machine {
+	var ret []*clusterv1.Machine
+	for _, machine := range machines {
+		if strings.HasSuffix(machine.Name, upgradeSuffix(u.upgradeID)) || machine.Spec.ProviderID == nil || *machine.Spec.ProviderID == "" {
+			continue
+		}
+		ret = append(ret, machine)
+	}
+	return ret
+}
+
+// dryRunProblem returns the problem err, from the server-side dry run of action, such as "create Machine cp-0", reveals,
+// or an error if the dry run itself failed. Objects that already exist are not a problem, as the upgrade keeps them.
+func dryRunProblem(action string, err error) (string, error) {
+	if err == nil || apierrors.IsAlreadyExists(errors.Cause(err)) {
+		return "", nil
+	}
+	if d, ok := parseAdmissionDenial(errors.Cause(err).Error()); ok {
+		return fmt.Sprintf("%s: denied by admission webhook %s: %s", action, d.webhook, d.message), nil
+	}
+	if _, ok := errors.Cause(err).(apierrors.APIStatus); ok {
+		return fmt.Sprintf("%s: %v", action, errors.Cause(err)), nil
+	}
+	return "", errors.Wrapf(err, "error in the dry run of %s", action)
+}
+
+// dryRunPreflightProblems performs, in server-side dry run, the mutations an upgrade of machines, whose oldest version
+// is min, plans: the kubelet configmap and RBAC and the kubeadm configmap in the target cluster, and the upgrade ID
+// patch, replacement objects and deletion of each machine to replace in the management cluster. The API servers
+// validate them against their schemas, quotas, admission and the permissions of the tool, so that the upgrade is
+// refused before anything changes rather than failing half way.
+func (u *ControlPlaneUpgrader) dryRunPreflightProblems(machines []*clusterv1.Machine, min semver.Version) ([]string, error) {
+	var problems []string
+	add := func(action string, err error) error {
+		problem, err := dryRunProblem(action, err)
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+		return err
+	}
+
+	if (isMinorVersionUpgrade(min, u.desiredVersion) || u.kubeletConfig != nil) && !u.distroProfile.skipKubeletConfigMap {
+		sources, err := u.discoverKubeletConfigSources()
+		if err != nil {
+			return nil, err
+		}
+		cm, err := u.desiredKubeletConfigMap(u.desiredVersion, sources)
+		if err != nil {
+			return nil, err
+		}
+		coreClient := u.targetKubernetesClient.CoreV1().RESTClient()
+		switch {
+		case cm == nil:
+		case cm.ResourceVersion != "":
+			if err := add("update configmap "+cm.Name, targetDryRun(coreClient, "PUT", "configmaps", cm.Name, cm)); err != nil {
+				return nil, err
+			}
+		default:
+			if err := add("create configmap "+cm.Name, targetDryRun(coreClient, "POST", "configmaps", "", cm)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if isMinorVersionUpgrade(min, u.desiredVersion) && !u.distroProfile.skipKubeletRBAC {
+		rbacClient := u.targetKubernetesClient.RbacV1().RESTClient()
+		role := kubeletConfigRole(u.desiredVersion)
+		if err := add("create role "+role.Name, targetDryRun(rbacClient, "POST", "roles", "", role)); err != nil {
+			return nil, err
+		}
+		binding := kubeletConfigRoleBinding(u.desiredVersion)
+		if err := add("create rolebinding "+binding.Name, targetDryRun(rbacClient, "POST", "rolebindings", "", binding)); err != nil {
+			return nil, err
+		}
+	}
+
+	original, err := u.getKubeadmConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	if original != nil {
+		if updated, err := updateKubeadmKubernetesVersion(original, "v"+u.desiredVersion.String()); err == nil {
+			if updated, err = addAPIServerCertSANs(updated, u.apiServerCertSANs); err != nil {
+				return nil, err
+			}
+			action := "update configmap " + kubeadmConfigMapName
+			if err := add(action, targetDryRun(u.targetKubernetesClient.CoreV1().RESTClient(), "PUT", "configmaps", updated.Name, updated)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, machine := range u.plannedReplacements(machines) {
+		if machine.Annotations[AnnotationUpgradeID] == "" {
+			annotated := machine.DeepCopy()
+			if annotated.Annotations == nil {
+				annotated.Annotations = map[string]string{}
+			}
+			annotated.Annotations[AnnotationUpgradeID] = u.upgradeID
+			err := u.managementClusterClient.Patch(context.TODO(), annotated, ctrlclient.MergeFrom(machine), ctrlclient.DryRunAll)
+			if err := add("patch Machine "+machine.Name, err); err != nil {
+				return nil, err
+			}
+		}
+
+		replacementKey := u.replacementKey(machine)
+		objects, err := u.replacementObjects(replacementKey, machine)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			err := u.managementClusterClient.Create(context.TODO(), o.obj, ctrlclient.DryRunAll)
+			if err := add(fmt.Sprintf("create %s %s", o.kind, replacementKey.Name), err); err != nil {
+				return nil, err
+			}
+		}
+
+		// deletions carry their dry run option in their body, so read-only mode cannot tell them apart and refuses them
+		if !kubernetes2.ReadOnly() {
+			err = u.managementClusterClient.Delete(context.TODO(), machine.DeepCopy(), ctrlclient.DryRunAll)
+			if err := add("delete Machine "+machine.Name, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// targetDryRun sends the request of verb, such as POST, for obj to resource in kube-system of the target cluster, with
+// name for requests on an existing object, in server-side dry run.
+func targetDryRun(client rest.Interface, verb, resource, name string, obj runtime.Object) error {
+	req := client.Verb(verb).Namespace("kube-system").Resource(resource).Param("dryRun", metav1.DryRunAll)
+	if name != "" {
+		req = req.Name(name)
+	}
+	return req.Body(obj).Do().Error()
+}
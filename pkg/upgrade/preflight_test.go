@@ -0,0 +1,40 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestDryRunProblem(t *testing.T) {
+	problem, err := dryRunProblem("create Machine cp-0.upgrade.1", nil)
+	require.NoError(t, err)
+	assert.Empty(t, problem)
+
+	exists := apierrors.NewAlreadyExists(schema.GroupResource{Group: "cluster.x-k8s.io", Resource: "machines"}, "cp-0.upgrade.1")
+	problem, err = dryRunProblem("create Machine cp-0.upgrade.1", errors.WithStack(exists))
+	require.NoError(t, err)
+	assert.Empty(t, problem)
+
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "roles"}, "kubeadm:kubelet-config-1.16", errors.New("user cannot create roles"))
+	problem, err = dryRunProblem("create role kubeadm:kubelet-config-1.16", forbidden)
+	require.NoError(t, err)
+	assert.Contains(t, problem, "create role kubeadm:kubelet-config-1.16: ")
+	assert.Contains(t, problem, "user cannot create roles")
+
+	denied := apierrors.NewForbidden(schema.GroupResource{Resource: "machines"}, "cp-0.upgrade.1",
+		errors.New(`admission webhook "validate.kyverno.svc" denied the request: missing owner`))
+	problem, err = dryRunProblem("create Machine cp-0.upgrade.1", denied)
+	require.NoError(t, err)
+	assert.Equal(t, "create Machine cp-0.upgrade.1: denied by admission webhook validate.kyverno.svc: missing owner", problem)
+
+	_, err = dryRunProblem("create Machine cp-0.upgrade.1", errors.New("connection refused"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,271 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// progressUIRefresh is how often the progress UI is redrawn, so that elapsed times move between events.
+	progressUIRefresh = 500 * time.Millisecond
+	// progressUILogLines is how many of the latest log lines the log pane of the progress UI shows.
+	progressUILogLines = 15
+)
+
+// ANSI escape sequences of the terminal the progress UI draws on.
+const (
+	ansiAlternateScreen = "\x1b[?1049h"
+	ansiMainScreen      = "\x1b[?1049l"
+	ansiClearScreen     = "\x1b[H\x1b[2J"
+	ansiHideCursor      = "\x1b[?25l"
+	ansiShowCursor      = "\x1b[?25h"
+)
+
+// ProgressUI is a terminal view of an upgrade: a live table of its control plane machines or machine deployments,
+// their phases and how long they have been in them, above a pane scrolling through the latest logs. It is driven by
+// the event stream, written to Events, and by the logs, written to Logs.
+type ProgressUI struct {
+	out io.Writer
+	now func() time.Time
+
+	lock      sync.Mutex
+	started   time.Time
+	cluster   string
+	scope     string
+	upgradeID string
+	// step is the latest step of the upgrade.
+	step     string
+	warnings int
+	// outcome is how the upgrade finished, or empty while it runs.
+	outcome  string
+	machines []*progressMachine
+	logs     []string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// progressMachine is a row of the machine table of the progress UI.
+type progressMachine struct {
+	name  string
+	phase string
+	// since is when the machine entered its phase.
+	since time.Time
+	// started is when the machine left the pending phase, and finished when it was replaced, rolled out or failed.
+	started  time.Time
+	finished time.Time
+}
+
+// NewProgressUI returns a progress UI drawing on out, a terminal.
+func NewProgressUI(out io.Writer) *ProgressUI {
+	return &ProgressUI{out: out, now: time.Now}
+}
+
+// Events returns the writer the event stream of the upgrade is written to, to be set as EventsConfig.Writer.
+func (p *ProgressUI) Events() io.Writer {
+	return &lineWriter{line: p.event}
+}
+
+// Logs returns the writer the logs of the upgrade are written to.
+func (p *ProgressUI) Logs() io.Writer {
+	return &lineWriter{line: p.log}
+}
+
+// Start switches the terminal to the UI and redraws it until Stop is called.
+func (p *ProgressUI) Start() {
+	p.lock.Lock()
+	p.started = p.now()
+	p.lock.Unlock()
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	fmt.Fprint(p.out, ansiAlternateScreen+ansiHideCursor)
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressUIRefresh)
+		defer ticker.Stop()
+		for {
+			p.draw()
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops redrawing, restores the terminal and prints the last state of the UI to it, so that it stays visible.
+func (p *ProgressUI) Stop() {
+	close(p.stop)
+	<-p.done
+	fmt.Fprint(p.out, ansiMainScreen+ansiShowCursor)
+
+	var b bytes.Buffer
+	p.render(&b)
+	_, _ = p.out.Write(b.Bytes())
+}
+
+func (p *ProgressUI) draw() {
+	var b bytes.Buffer
+	b.WriteString(ansiClearScreen)
+	p.render(&b)
+	_, _ = p.out.Write(b.Bytes())
+}
+
+// event updates the UI with a line of the event stream.
+func (p *ProgressUI) event(line string) {
+	var event ProgressEvent
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.cluster, p.scope, p.upgradeID = event.Cluster, event.Scope, event.UpgradeID
+	switch event.Type {
+	case EventStep:
+		p.step = event.Message
+	case EventWarning:
+		p.warnings++
+	case EventMachine:
+		p.machinePhase(event.Machine, event.Phase, event.Time)
+	case EventFinished:
+		switch {
+		case event.Error != "":
+			p.outcome = "failed: " + event.Error
+		case event.NothingToDo:
+			p.outcome = "nothing to do"
+		default:
+			p.outcome = "succeeded"
+		}
+	}
+}
+
+func (p *ProgressUI) machinePhase(name, phase string, at time.Time) {
+	var m *progressMachine
+	for _, existing := range p.machines {
+		if existing.name == name {
+			m = existing
+			break
+		}
+	}
+	if m == nil {
+		m = &progressMachine{name: name}
+		p.machines = append(p.machines, m)
+	}
+	if m.phase == phase {
+		return
+	}
+
+	m.phase = phase
+	m.since = at
+	if phase != MachinePhasePending && m.started.IsZero() {
+		m.started = at
+	}
+	switch phase {
+	case MachinePhaseReplaced, MachinePhaseRolledOut, MachinePhaseFailed:
+		m.finished = at
+	default:
+		m.finished = time.Time{}
+	}
+}
+
+// log adds a line to the log pane.
+func (p *ProgressUI) log(line string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.logs = append(p.logs, line)
+	if len(p.logs) > progressUILogLines {
+		p.logs = p.logs[len(p.logs)-progressUILogLines:]
+	}
+}
+
+// render writes the UI, as of now, to w.
+func (p *ProgressUI) render(w io.Writer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+
+	title := "Upgrading"
+	if p.cluster != "" {
+		title = fmt.Sprintf("Upgrading %s (%s, upgrade %s)", p.cluster, p.scope, p.upgradeID)
+	}
+	fmt.Fprintf(w, "%s, %s\n", title, formatElapsed(now.Sub(p.started)))
+	if p.outcome != "" {
+		fmt.Fprintf(w, "Finished: %s\n", p.outcome)
+	} else if p.step != "" {
+		fmt.Fprintf(w, "Step: %s\n", p.step)
+	}
+	if p.warnings > 0 {
+		fmt.Fprintf(w, "Warnings: %d\n", p.warnings)
+	}
+	fmt.Fprintln(w)
+
+	table := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	name := "MACHINE"
+	if p.scope == machineDeploymentScope {
+		name = "MACHINE DEPLOYMENT"
+	}
+	fmt.Fprintf(table, "%s\tPHASE\tIN PHASE\tELAPSED\n", name)
+	for _, m := range p.machines {
+		var inPhase, elapsed string
+		if m.finished.IsZero() {
+			inPhase = formatElapsed(now.Sub(m.since))
+		}
+		if !m.started.IsZero() {
+			end := m.finished
+			if end.IsZero() {
+				end = now
+			}
+			elapsed = formatElapsed(end.Sub(m.started))
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", m.name, m.phase, inPhase, elapsed)
+	}
+	_ = table.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "LOGS")
+	for _, line := range p.logs {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// formatElapsed formats d to the second.
+func formatElapsed(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return d.Round(time.Second).String()
+}
+
+// lineWriter calls line with each complete line written to it, without its newline.
+type lineWriter struct {
+	lock    sync.Mutex
+	partial []byte
+	line    func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(strings.TrimRight(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
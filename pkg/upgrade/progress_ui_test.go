@@ -0,0 +1,86 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressUI(t *testing.T) {
+	start := time.Date(2019, 11, 5, 10, 0, 0, 0, time.UTC)
+	now := start
+
+	ui := NewProgressUI(ioutil.Discard)
+	ui.now = func() time.Time { return now }
+	ui.started = start
+
+	events, err := openEventStream(EventsConfig{Writer: ui.Events()}, "control-plane", "ns", "c", "123")
+	require.NoError(t, err)
+	events.now = func() time.Time { return now }
+	record := newRunRecorder("control-plane", "ns", "c", "123")
+	record.events = events
+	record.now = events.now
+
+	record.machinePhase("cp-0", MachinePhasePending)
+	record.machinePhase("cp-1", MachinePhasePending)
+	record.machinePhase("cp-0", MachinePhaseCreating)
+	now = start.Add(time.Minute)
+	record.machinePhase("cp-0", MachinePhaseWaitingForNode)
+	now = start.Add(3 * time.Minute)
+	record.machinePhase("cp-0", MachinePhaseReplaced)
+	record.machinePhase("cp-1", MachinePhaseCreating)
+	record.event("Created replacement machine cp-1.upgrade.123 for cp-1")
+	events.warning(Warning{Reason: WarningEtcdMemberAbsent, Message: "no etcd member"})
+	now = start.Add(4*time.Minute + 30*time.Second)
+
+	logs := ui.Logs()
+	for i := 0; i < progressUILogLines+2; i++ {
+		fmt.Fprintf(logs, "log line %d\n", i)
+	}
+	fmt.Fprint(logs, "partial")
+
+	var out bytes.Buffer
+	ui.render(&out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, []string{
+		"Upgrading ns/c (control-plane, upgrade 123), 4m30s",
+		"Step: Created replacement machine cp-1.upgrade.123 for cp-1",
+		"Warnings: 1",
+		"",
+		"MACHINE   PHASE                  IN PHASE   ELAPSED",
+		"cp-0      replaced                          3m0s",
+		"cp-1      creating replacement   1m30s      1m30s",
+		"",
+		"LOGS",
+		"log line 2",
+	}, lines[:10])
+	assert.Equal(t, fmt.Sprintf("log line %d", progressUILogLines+1), lines[len(lines)-1])
+
+	events.finished(errors.New("boom"), false)
+	out.Reset()
+	ui.render(&out)
+	assert.Contains(t, out.String(), "Finished: failed: boom\n")
+}
+
+func TestProgressUIStartStop(t *testing.T) {
+	var out bytes.Buffer
+	ui := NewProgressUI(&out)
+	fmt.Fprintln(ui.Logs(), "Upgrade started")
+	ui.Start()
+	ui.Stop()
+
+	got := out.String()
+	require.True(t, strings.HasPrefix(got, ansiAlternateScreen), got)
+	last := got[strings.LastIndex(got, ansiMainScreen):]
+	assert.Contains(t, last, "LOGS\nUpgrade started\n")
+}
@@ -0,0 +1,210 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// providerAdapter encapsulates the infrastructure provider specific knowledge needed to replace machines.
+type providerAdapter interface {
+	// defaultImageField returns the path to the image identifier in the provider's infrastructure machine, or "" if
+	// the provider has no single image field.
+	defaultImageField() string
+	// instanceState returns the state of the instance behind the infrastructure machine as reported by the provider, or
+	// "" if the provider does not report one.
+	instanceState(infra *unstructured.Unstructured) string
+	// defaultTagsField returns the path to the map of tags the provider applies to the cloud resources of the
+	// infrastructure machine, or "" if the provider has none.
+	defaultTagsField() string
+	// consoleOutputCommand returns the command printing the console output of the instance with instanceID, the ID
+	// of its provider ID, or nil if the provider has none.
+	consoleOutputCommand(instanceID string) []string
+	// lookupImage returns the image identifier of infrastructure machines of kind at version, expanding the image
+	// lookup format.
+	lookupImage(format, kind string, version semver.Version) (string, error)
+	// defaultFlavorField returns the path to the instance size in the provider's infrastructure machine, such as its
+	// instance type or flavor, or "" if the provider has none.
+	defaultFlavorField() string
+	// imageStatusCommand returns the command printing the status of image in the provider's image service, or nil if
+	// the provider has none.
+	imageStatusCommand(image string) []string
+}
+
+type genericProvider struct {
+	imageField         string
+	instanceStateField string
+	tagsField          string
+	flavorField        string
+	consoleOutput      func(instanceID string) []string
+	imageStatus        func(image string) []string
+}
+
+func (p genericProvider) defaultImageField() string {
+	return p.imageField
+}
+
+func (p genericProvider) instanceState(infra *unstructured.Unstructured) string {
+	if p.instanceStateField == "" {
+		return ""
+	}
+	state, _, _ := unstructured.NestedString(infra.Object, strings.Split(p.instanceStateField, ".")...)
+	return state
+}
+
+func (p genericProvider) defaultTagsField() string {
+	return p.tagsField
+}
+
+func (p genericProvider) consoleOutputCommand(instanceID string) []string {
+	if p.consoleOutput == nil || instanceID == "" {
+		return nil
+	}
+	return p.consoleOutput(instanceID)
+}
+
+func (p genericProvider) lookupImage(format, kind string, version semver.Version) (string, error) {
+	return expandImageLookupFormat(format, kind, version)
+}
+
+func (p genericProvider) defaultFlavorField() string {
+	return p.flavorField
+}
+
+func (p genericProvider) imageStatusCommand(image string) []string {
+	if p.imageStatus == nil {
+		return nil
+	}
+	return p.imageStatus(image)
+}
+
+// awsConsoleOutputCommand prints the console output of an EC2 instance with the aws command, using its usual
+// credentials.
+func awsConsoleOutputCommand(instanceID string) []string {
+	return []string{"aws", "ec2", "get-console-output", "--instance-id", instanceID, "--query", "Output", "--output", "text"}
+}
+
+// providerAdapters contains the adapters for known infrastructure machine kinds.
+var providerAdapters = map[string]providerAdapter{
+	"AWSMachine":    genericProvider{imageField: "spec.ami.id", instanceStateField: "status.instanceState", tagsField: "spec.additionalTags", flavorField: "spec.instanceType", consoleOutput: awsConsoleOutputCommand},
+	"AzureMachine":  genericProvider{tagsField: "spec.additionalTags", flavorField: "spec.vmSize"},
+	"DockerMachine": genericProvider{imageField: "spec.customImage"},
+	"OpenStackMachine": genericProvider{
+		imageField:         "spec.image",
+		instanceStateField: "status.instanceState",
+		flavorField:        "spec.flavor",
+		consoleOutput:      openstackConsoleOutputCommand,
+		imageStatus:        openstackImageStatusCommand,
+	},
+	"VSphereMachine": genericProvider{imageField: "spec.template"},
+}
+
+// providerAdapterForKind returns the adapter for kind, falling back to one without any provider specific knowledge.
+func providerAdapterForKind(kind string) providerAdapter {
+	if p, ok := providerAdapters[kind]; ok {
+		return p
+	}
+	return genericProvider{}
+}
+
+// imageUpdate is the image identifier to set, and where to set it, in an infrastructure machine.
+type imageUpdate struct {
+	field string
+	id    string
+}
+
+// resolveImageUpdate returns the image update for infrastructure machines of the given kind at version. Per-kind
+// configuration takes precedence over the global image configuration, and the provider adapter supplies the field if
+// it is not configured, and expands the image lookup format if no image identifier is. The returned bool is false if
+// no image update is configured for kind.
+func resolveImageUpdate(config MachineUpdateConfig, kind string, version semver.Version) (imageUpdate, bool, error) {
+	image := config.Image
+	if kindImage, ok := config.ImagesByKind[kind]; ok {
+		image = kindImage
+	}
+
+	id := image.ID
+	if id == "" && image.LookupFormat != "" {
+		var err error
+		if id, err = providerAdapterForKind(kind).lookupImage(image.LookupFormat, kind, version); err != nil {
+			return imageUpdate{}, false, err
+		}
+	}
+	if id == "" {
+		return imageUpdate{}, false, nil
+	}
+
+	field := image.Field
+	if field == "" {
+		field = providerAdapterForKind(kind).defaultImageField()
+	}
+	if field == "" {
+		return imageUpdate{}, false, errors.Errorf("no image field configured for infrastructure kind %q", kind)
+	}
+	if _, err := parseImageField(field); err != nil {
+		return imageUpdate{}, false, err
+	}
+
+	return imageUpdate{field: field, id: id}, true, nil
+}
+
+// infrastructureKindSummary describes the control plane machines that share an infrastructure kind.
+type infrastructureKindSummary struct {
+	Kind       string   `json:"kind"`
+	Machines   []string `json:"machines"`
+	ImageField string   `json:"imageField,omitempty"`
+	ImageID    string   `json:"imageID,omitempty"`
+	TagsField  string   `json:"tagsField,omitempty"`
+	// FlavorField is where the flavor of replacements is set.
+	FlavorField string `json:"flavorField,omitempty"`
+}
+
+// summarizeInfrastructureKinds groups machines by infrastructure kind, resolving the image update at version, tags
+// field and flavor field for each kind.
+func summarizeInfrastructureKinds(machines []*clusterv1.Machine, config MachineUpdateConfig, version semver.Version) ([]infrastructureKindSummary, error) {
+	byKind := make(map[string]*infrastructureKindSummary)
+	for _, machine := range machines {
+		kind := machine.Spec.InfrastructureRef.Kind
+		summary, ok := byKind[kind]
+		if !ok {
+			update, _, err := resolveImageUpdate(config, kind, version)
+			if err != nil {
+				return nil, err
+			}
+			tagsField, _, err := resolveTagsField(config, kind)
+			if err != nil {
+				return nil, err
+			}
+			flavorField, _, err := resolveFlavorField(config, kind)
+			if err != nil {
+				return nil, err
+			}
+			summary = &infrastructureKindSummary{
+				Kind:        kind,
+				ImageField:  update.field,
+				ImageID:     update.id,
+				TagsField:   tagsField,
+				FlavorField: flavorField,
+			}
+			byKind[kind] = summary
+		}
+		summary.Machines = append(summary.Machines, machine.Name)
+	}
+
+	var ret []infrastructureKindSummary
+	for _, summary := range byKind {
+		ret = append(ret, *summary)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Kind < ret[j].Kind
+	})
+
+	return ret, nil
+}
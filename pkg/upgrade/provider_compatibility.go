@@ -0,0 +1,269 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// clusterctlAPIVersion is the API version of the clusterctl provider inventory.
+	clusterctlAPIVersion = "clusterctl.cluster.x-k8s.io/v1alpha3"
+	// clusterctlInfrastructureProviderType is the type of infrastructure providers in the clusterctl inventory.
+	clusterctlInfrastructureProviderType = "InfrastructureProvider"
+	// providerLabelName is the label clusterctl and the provider manifests set on provider components, such as
+	// infrastructure-aws.
+	providerLabelName = "cluster.x-k8s.io/provider"
+	// infrastructureProviderPrefix is the prefix of the names of infrastructure providers.
+	infrastructureProviderPrefix = "infrastructure-"
+	// providerManagerContainer is the name of the container of a provider's controller manager.
+	providerManagerContainer = "manager"
+)
+
+// ProviderCompatibility is the oldest version of an infrastructure provider that supports a Kubernetes minor version.
+type ProviderCompatibility struct {
+	// Provider is the provider's name, such as infrastructure-aws.
+	Provider string `json:"provider"`
+	// KubernetesVersion is a Kubernetes minor version, such as 1.16.
+	KubernetesVersion string `json:"kubernetesVersion"`
+	// MinProviderVersion is the oldest version of the provider that supports KubernetesVersion.
+	MinProviderVersion string `json:"minProviderVersion"`
+}
+
+// defaultProviderCompatibility is the compatibility table used unless a provider is overridden by a compatibility file.
+// Kubernetes versions newer than those of a provider's entries are reported as unknown.
+var defaultProviderCompatibility = []ProviderCompatibility{
+	{Provider: "infrastructure-aws", KubernetesVersion: "1.15", MinProviderVersion: "v0.4.0"},
+	{Provider: "infrastructure-aws", KubernetesVersion: "1.16", MinProviderVersion: "v0.4.3"},
+	{Provider: "infrastructure-vsphere", KubernetesVersion: "1.15", MinProviderVersion: "v0.5.0"},
+	{Provider: "infrastructure-vsphere", KubernetesVersion: "1.16", MinProviderVersion: "v0.5.2"},
+	{Provider: "infrastructure-docker", KubernetesVersion: "1.15", MinProviderVersion: "v0.2.0"},
+	{Provider: "infrastructure-docker", KubernetesVersion: "1.16", MinProviderVersion: "v0.2.0"},
+}
+
+// loadProviderCompatibility returns the default compatibility table, with the providers listed in the YAML file at path
+// replacing their default entries. It returns the default table if path is empty.
+func loadProviderCompatibility(path string) ([]ProviderCompatibility, error) {
+	if path == "" {
+		return defaultProviderCompatibility, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading provider compatibility file %s", path)
+	}
+	var overrides []ProviderCompatibility
+	if err := yaml.Unmarshal(data, &overrides); err != nil {
+		return nil, errors.Wrapf(err, "error decoding provider compatibility file %s", path)
+	}
+	for i, c := range overrides {
+		if c.Provider == "" {
+			return nil, errors.Errorf("provider compatibility file %s: entry %d has no provider", path, i+1)
+		}
+		if _, err := semver.ParseTolerant(c.KubernetesVersion); err != nil {
+			return nil, errors.Wrapf(err, "provider compatibility file %s: invalid kubernetes version %q of %s", path, c.KubernetesVersion, c.Provider)
+		}
+		if _, err := semver.ParseTolerant(c.MinProviderVersion); err != nil {
+			return nil, errors.Wrapf(err, "provider compatibility file %s: invalid provider version %q of %s", path, c.MinProviderVersion, c.Provider)
+		}
+	}
+	return mergeProviderCompatibility(defaultProviderCompatibility, overrides), nil
+}
+
+// mergeProviderCompatibility returns base without the entries of the providers in overrides, followed by overrides.
+func mergeProviderCompatibility(base, overrides []ProviderCompatibility) []ProviderCompatibility {
+	overridden := make(map[string]bool)
+	for _, c := range overrides {
+		overridden[c.Provider] = true
+	}
+
+	var ret []ProviderCompatibility
+	for _, c := range base {
+		if !overridden[c.Provider] {
+			ret = append(ret, c)
+		}
+	}
+	return append(ret, overrides...)
+}
+
+// installedProvider is an infrastructure provider installed in the management cluster.
+type installedProvider struct {
+	name    string
+	version string
+}
+
+// providerCompatibilityFindings are the results of checking installed providers against the compatibility table.
+type providerCompatibilityFindings struct {
+	// incompatible lists providers older than the table requires for the Kubernetes version.
+	incompatible []string
+	// unknown lists providers whose compatibility could not be determined.
+	unknown []string
+}
+
+// checkProviderCompatibility checks providers support the Kubernetes version according to table. The entry of a
+// provider used is the one of the newest Kubernetes minor version up to version; older Kubernetes versions than all
+// entries are assumed supported, and newer ones are unknown.
+func checkProviderCompatibility(providers []installedProvider, table []ProviderCompatibility, version semver.Version) providerCompatibilityFindings {
+	var findings providerCompatibilityFindings
+	minor := semver.Version{Major: version.Major, Minor: version.Minor}
+
+	for _, p := range providers {
+		var (
+			entry                *ProviderCompatibility
+			entryVersion, newest semver.Version
+		)
+		for i := range table {
+			if table[i].Provider != p.name {
+				continue
+			}
+			v, err := semver.ParseTolerant(table[i].KubernetesVersion)
+			if err != nil {
+				continue
+			}
+			v = semver.Version{Major: v.Major, Minor: v.Minor}
+			if v.GT(newest) {
+				newest = v
+			}
+			if v.LTE(minor) && (entry == nil || v.GT(entryVersion)) {
+				entry, entryVersion = &table[i], v
+			}
+		}
+
+		switch {
+		case newest.EQ(unsetVersion):
+			findings.unknown = append(findings.unknown, fmt.Sprintf("%s %s is not in the provider compatibility table", p.name, p.version))
+			continue
+		case minor.GT(newest):
+			findings.unknown = append(findings.unknown, fmt.Sprintf("the provider compatibility table does not list whether %s supports kubernetes %d.%d", p.name, minor.Major, minor.Minor))
+			continue
+		case entry == nil:
+			continue
+		}
+
+		installed, err := semver.ParseTolerant(p.version)
+		if err != nil {
+			findings.unknown = append(findings.unknown, fmt.Sprintf("unable to parse the version %q of %s", p.version, p.name))
+			continue
+		}
+		required, _ := semver.ParseTolerant(entry.MinProviderVersion)
+		if installed.LT(required) {
+			findings.incompatible = append(findings.incompatible, fmt.Sprintf("%s %s does not support kubernetes %d.%d, which requires %s or newer",
+				p.name, p.version, minor.Major, minor.Minor, entry.MinProviderVersion))
+		}
+	}
+	return findings
+}
+
+// listInfrastructureProviders lists the infrastructure providers of the management cluster from the clusterctl
+// inventory or, if there is none, from the provider deployments' labels and images.
+func listInfrastructureProviders(c ctrlclient.Client) ([]installedProvider, error) {
+	inventory := &unstructured.UnstructuredList{}
+	inventory.SetAPIVersion(clusterctlAPIVersion)
+	inventory.SetKind("ProviderList")
+	err := c.List(context.TODO(), inventory)
+	if err != nil && !meta.IsNoMatchError(err) {
+		return nil, errors.Wrap(err, "error listing the clusterctl provider inventory")
+	}
+	if err == nil && len(inventory.Items) > 0 {
+		var providers []installedProvider
+		for _, p := range inventory.Items {
+			providerType, _, _ := unstructured.NestedString(p.Object, "type")
+			if providerType != clusterctlInfrastructureProviderType {
+				continue
+			}
+			name, _, _ := unstructured.NestedString(p.Object, "providerName")
+			version, _, _ := unstructured.NestedString(p.Object, "version")
+			providers = append(providers, installedProvider{name: infrastructureProviderPrefix + name, version: version})
+		}
+		return providers, nil
+	}
+
+	r, err := labels.NewRequirement(providerLabelName, selection.Exists, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	deployments := &unstructured.UnstructuredList{}
+	deployments.SetAPIVersion("apps/v1")
+	deployments.SetKind("DeploymentList")
+	if err := c.List(context.TODO(), deployments, ctrlclient.MatchingLabelsSelector{Selector: labels.NewSelector().Add(*r)}); err != nil {
+		return nil, errors.Wrap(err, "error listing provider deployments")
+	}
+	return providersFromDeployments(deployments.Items), nil
+}
+
+// providersFromDeployments returns the infrastructure providers of deployments, versioned by the image tag of their
+// manager container, or of their first container if none is called manager.
+func providersFromDeployments(deployments []unstructured.Unstructured) []installedProvider {
+	var providers []installedProvider
+	seen := make(map[string]bool)
+	for _, d := range deployments {
+		name := d.GetLabels()[providerLabelName]
+		if !strings.HasPrefix(name, infrastructureProviderPrefix) || seen[name] {
+			continue
+		}
+
+		containers, _, _ := unstructured.NestedSlice(d.Object, "spec", "template", "spec", "containers")
+		var image string
+		for i, c := range containers {
+			container, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if i == 0 || container["name"] == providerManagerContainer {
+				image, _ = container["image"].(string)
+			}
+			if container["name"] == providerManagerContainer {
+				break
+			}
+		}
+
+		seen[name] = true
+		providers = append(providers, installedProvider{name: name, version: imageTag(image)})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].name < providers[j].name })
+	return providers
+}
+
+// providerCompatibilityProblems returns the reasons the infrastructure providers of the management cluster c cannot
+// create machines at version according to table. Providers whose compatibility is unknown, and incompatible ones if
+// ignore is true, are recorded as warnings instead.
+func providerCompatibilityProblems(log logr.Logger, c ctrlclient.Client, table []ProviderCompatibility, version semver.Version, ignore bool, warnings *warningCollector) ([]string, error) {
+	providers, err := listInfrastructureProviders(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(providers) == 0 {
+		warnings.add(WarningProviderCompatibility, "", "no infrastructure provider was found in the management cluster to check it supports kubernetes %s", version)
+		return nil, nil
+	}
+	for _, p := range providers {
+		log.Info("Found infrastructure provider", "provider", p.name, "version", p.version)
+	}
+
+	findings := checkProviderCompatibility(providers, table, version)
+	for _, msg := range findings.unknown {
+		warnings.add(WarningProviderCompatibility, "", "%s", msg)
+	}
+	if ignore {
+		for _, msg := range findings.incompatible {
+			warnings.add(WarningProviderCompatibility, "", "%s", msg)
+		}
+		return nil, nil
+	}
+	return findings.incompatible, nil
+}
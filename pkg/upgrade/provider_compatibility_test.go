@@ -0,0 +1,105 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCheckProviderCompatibility(t *testing.T) {
+	table := []ProviderCompatibility{
+		{Provider: "infrastructure-aws", KubernetesVersion: "1.15", MinProviderVersion: "v0.4.0"},
+		{Provider: "infrastructure-aws", KubernetesVersion: "1.17", MinProviderVersion: "v0.5.0"},
+	}
+
+	tests := []struct {
+		name         string
+		provider     installedProvider
+		version      string
+		incompatible int
+		unknown      int
+	}{
+		{name: "compatible", provider: installedProvider{name: "infrastructure-aws", version: "v0.4.1"}, version: "1.15.3"},
+		{name: "entry of an older minor applies", provider: installedProvider{name: "infrastructure-aws", version: "v0.4.1"}, version: "1.16.3"},
+		{name: "too old", provider: installedProvider{name: "infrastructure-aws", version: "v0.4.1"}, version: "1.17.0", incompatible: 1},
+		{name: "older than all entries", provider: installedProvider{name: "infrastructure-aws", version: "v0.3.0"}, version: "1.14.9"},
+		{name: "newer than all entries", provider: installedProvider{name: "infrastructure-aws", version: "v0.5.0"}, version: "1.18.0", unknown: 1},
+		{name: "unknown provider", provider: installedProvider{name: "infrastructure-metal3", version: "v0.2.0"}, version: "1.16.3", unknown: 1},
+		{name: "unparseable version", provider: installedProvider{name: "infrastructure-aws", version: "latest"}, version: "1.16.3", unknown: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			findings := checkProviderCompatibility([]installedProvider{tc.provider}, table, semver.MustParse(tc.version))
+			assert.Len(t, findings.incompatible, tc.incompatible, findings.incompatible)
+			assert.Len(t, findings.unknown, tc.unknown, findings.unknown)
+		})
+	}
+}
+
+func TestLoadProviderCompatibility(t *testing.T) {
+	table, err := loadProviderCompatibility("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultProviderCompatibility, table)
+
+	dir, err := ioutil.TempDir("", "provider-compatibility")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "compatibility.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+- provider: infrastructure-aws
+  kubernetesVersion: "1.17"
+  minProviderVersion: v0.5.0
+`), 0600))
+	table, err = loadProviderCompatibility(path)
+	require.NoError(t, err)
+	var aws []ProviderCompatibility
+	for _, c := range table {
+		if c.Provider == "infrastructure-aws" {
+			aws = append(aws, c)
+		}
+	}
+	assert.Equal(t, []ProviderCompatibility{{Provider: "infrastructure-aws", KubernetesVersion: "1.17", MinProviderVersion: "v0.5.0"}}, aws)
+	assert.True(t, len(table) > 1, "the entries of other providers are kept")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`[{provider: infrastructure-aws, kubernetesVersion: latest, minProviderVersion: v0.5.0}]`), 0600))
+	_, err = loadProviderCompatibility(path)
+	assert.Error(t, err)
+}
+
+func TestProvidersFromDeployments(t *testing.T) {
+	deployment := func(provider string, containers ...map[string]interface{}) unstructured.Unstructured {
+		var list []interface{}
+		for _, c := range containers {
+			list = append(list, c)
+		}
+		d := unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{"containers": list}}},
+		}}
+		d.SetLabels(map[string]string{providerLabelName: provider})
+		return d
+	}
+
+	providers := providersFromDeployments([]unstructured.Unstructured{
+		deployment("infrastructure-vsphere",
+			map[string]interface{}{"name": "kube-rbac-proxy", "image": "gcr.io/kubebuilder/kube-rbac-proxy:v0.4.1"},
+			map[string]interface{}{"name": "manager", "image": "gcr.io/cluster-api-provider-vsphere/release/manager:v0.5.4"},
+		),
+		deployment("infrastructure-aws", map[string]interface{}{"name": "controller", "image": "gcr.io/k8s-staging-cluster-api-aws/cluster-api-aws-controller:v0.4.8"}),
+		deployment("cluster-api", map[string]interface{}{"name": "manager", "image": "us.gcr.io/k8s-artifacts-prod/cluster-api/cluster-api-controller:v0.2.9"}),
+	})
+	assert.Equal(t, []installedProvider{
+		{name: "infrastructure-aws", version: "v0.4.8"},
+		{name: "infrastructure-vsphere", version: "v0.5.4"},
+	}, providers)
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestResolveImageUpdate(t *testing.T) {
+	config := MachineUpdateConfig{
+		Image: ImageUpdateConfig{ID: "global-id", Field: "spec.image"},
+		ImagesByKind: map[string]ImageUpdateConfig{
+			"AWSMachine":     {ID: "ami-123"},
+			"VSphereMachine": {ID: "template-1", Field: "spec.customTemplate"},
+			"FooMachine":     {ID: "foo-1"},
+			"DockerMachine":  {LookupFormat: "kindest/node:v{{.Version}}"},
+			"AzureMachine":   {LookupFormat: "{{.Unknown}}", Field: "spec.image.id"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		kind        string
+		expected    imageUpdate
+		expectedOK  bool
+		expectedErr bool
+	}{
+		{
+			name:       "adapter default field",
+			kind:       "AWSMachine",
+			expected:   imageUpdate{field: "spec.ami.id", id: "ami-123"},
+			expectedOK: true,
+		},
+		{
+			name:       "per kind field",
+			kind:       "VSphereMachine",
+			expected:   imageUpdate{field: "spec.customTemplate", id: "template-1"},
+			expectedOK: true,
+		},
+		{
+			name:       "global fallback",
+			kind:       "GCPMachine",
+			expected:   imageUpdate{field: "spec.image", id: "global-id"},
+			expectedOK: true,
+		},
+		{
+			name:       "lookup format",
+			kind:       "DockerMachine",
+			expected:   imageUpdate{field: "spec.customImage", id: "kindest/node:v1.16.3"},
+			expectedOK: true,
+		},
+		{
+			name:        "invalid lookup format",
+			kind:        "AzureMachine",
+			expectedErr: true,
+		},
+		{
+			name:        "unknown kind without field",
+			kind:        "FooMachine",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, ok, err := resolveImageUpdate(config, tc.kind, semver.MustParse("1.16.3"))
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+
+	_, ok, err := resolveImageUpdate(MachineUpdateConfig{}, "AWSMachine", semver.MustParse("1.16.3"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSummarizeInfrastructureKinds(t *testing.T) {
+	machine := func(name, kind string) *clusterv1.Machine {
+		return &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: clusterv1.MachineSpec{
+				InfrastructureRef: corev1.ObjectReference{Kind: kind},
+			},
+		}
+	}
+
+	machines := []*clusterv1.Machine{
+		machine("a", "VSphereMachine"),
+		machine("b", "AWSMachine"),
+		machine("c", "VSphereMachine"),
+	}
+
+	config := MachineUpdateConfig{
+		ImagesByKind: map[string]ImageUpdateConfig{
+			"AWSMachine": {ID: "ami-123"},
+		},
+	}
+
+	summaries, err := summarizeInfrastructureKinds(machines, config, semver.MustParse("1.16.3"))
+	require.NoError(t, err)
+	assert.Equal(t, []infrastructureKindSummary{
+		{Kind: "AWSMachine", Machines: []string{"b"}, ImageField: "spec.ami.id", ImageID: "ami-123"},
+		{Kind: "VSphereMachine", Machines: []string{"a", "c"}},
+	}, summaries)
+}
+
+func TestInstanceState(t *testing.T) {
+	infra := &unstructured.Unstructured{Object: map[string]interface{}{
+		"status": map[string]interface{}{"instanceState": "shutting-down"},
+	}}
+
+	assert.Equal(t, "shutting-down", providerAdapterForKind("AWSMachine").instanceState(infra))
+	assert.Equal(t, "", providerAdapterForKind("FooMachine").instanceState(infra))
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// autoscalerStatusConfigMap is the kube-system configmap the cluster autoscaler writes its status to.
+	autoscalerStatusConfigMap = "cluster-autoscaler-status"
+
+	// autoscalerToBeDeletedTaint is the taint the cluster autoscaler puts on nodes it is scaling down.
+	autoscalerToBeDeletedTaint = "ToBeDeletedByClusterAutoscaler"
+)
+
+// quiescenceProblems returns the reasons the cluster is not quiescent: nodes that are not ready, nodes being scaled
+// down by the cluster autoscaler, and scale ups in progress according to autoscalerStatus, which may be nil if the
+// cluster autoscaler is not installed.
+func quiescenceProblems(nodes []v1.Node, autoscalerStatus *v1.ConfigMap) []string {
+	var problems []string
+
+	for _, node := range nodes {
+		if status := nodeReadyStatus(&node); status != v1.ConditionTrue {
+			problems = append(problems, fmt.Sprintf("node %s ready status is %s", node.Name, status))
+		}
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == autoscalerToBeDeletedTaint {
+				problems = append(problems, fmt.Sprintf("node %s is being scaled down by the cluster autoscaler", node.Name))
+			}
+		}
+	}
+
+	if autoscalerStatus != nil && autoscalerScaleUpInProgress(autoscalerStatus.Data["status"]) {
+		problems = append(problems, "the cluster autoscaler has a scale up in progress")
+	}
+
+	return problems
+}
+
+// nodeReadyStatus returns the status of node's Ready condition, or Unknown if it has none.
+func nodeReadyStatus(node *v1.Node) v1.ConditionStatus {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status
+		}
+	}
+	return v1.ConditionUnknown
+}
+
+// autoscalerScaleUpInProgress returns true if any "ScaleUp:" line of the cluster autoscaler's status report is
+// InProgress, cluster-wide or for a node group.
+func autoscalerScaleUpInProgress(status string) bool {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "ScaleUp:" && fields[1] == "InProgress" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuiescence returns the reasons the target cluster is not quiescent.
+func (u *ControlPlaneUpgrader) checkQuiescence() ([]string, error) {
+	nodes, err := u.targetKubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing nodes")
+	}
+
+	autoscalerStatus, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(autoscalerStatusConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		autoscalerStatus = nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting configmap %s", autoscalerStatusConfigMap)
+	}
+
+	return quiescenceProblems(nodes.Items, autoscalerStatus), nil
+}
+
+// waitForQuiescence waits until all nodes are ready and the cluster autoscaler, if present, is not scaling, so that
+// replacing a machine does not compound disruption from active scaling. It does nothing unless enabled.
+func (u *ControlPlaneUpgrader) waitForQuiescence(timeout time.Duration) error {
+	if !u.quiescenceGate {
+		return nil
+	}
+
+	var problems []string
+	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+		var err error
+		problems, err = u.checkQuiescence()
+		if err != nil {
+			u.log.Error(err, "Error checking cluster quiescence, will try again")
+			return false, nil
+		}
+		if len(problems) > 0 {
+			u.log.Info("Waiting for cluster to be quiescent", "problems", problems)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "timed out waiting for cluster to be quiescent: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestQuiescenceProblems(t *testing.T) {
+	node := func(name string, ready v1.ConditionStatus, taints ...v1.Taint) v1.Node {
+		return v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{Taints: taints},
+			Status: v1.NodeStatus{
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+			},
+		}
+	}
+	autoscalerStatus := func(scaleUp string) *v1.ConfigMap {
+		return &v1.ConfigMap{Data: map[string]string{"status": `Cluster-autoscaler status at 2019-10-01 12:00:00 +0000 UTC:
+Cluster-wide:
+  Health:      Healthy (ready=3 unready=0 notStarted=0 longNotStarted=0 registered=3 longUnregistered=0)
+  ScaleUp:     ` + scaleUp + ` (ready=3 registered=3)
+  ScaleDown:   NoCandidates (candidates=0)
+`}}
+	}
+
+	tests := []struct {
+		name             string
+		nodes            []v1.Node
+		autoscalerStatus *v1.ConfigMap
+		expected         []string
+	}{
+		{
+			name:  "ready nodes without autoscaler",
+			nodes: []v1.Node{node("a", v1.ConditionTrue), node("b", v1.ConditionTrue)},
+		},
+		{
+			name:             "autoscaler with no activity",
+			nodes:            []v1.Node{node("a", v1.ConditionTrue)},
+			autoscalerStatus: autoscalerStatus("NoActivity"),
+		},
+		{
+			name:     "not ready and unknown nodes",
+			nodes:    []v1.Node{node("a", v1.ConditionFalse), node("b", v1.ConditionUnknown), {ObjectMeta: metav1.ObjectMeta{Name: "c"}}},
+			expected: []string{"node a ready status is False", "node b ready status is Unknown", "node c ready status is Unknown"},
+		},
+		{
+			name:     "node being scaled down",
+			nodes:    []v1.Node{node("a", v1.ConditionTrue, v1.Taint{Key: autoscalerToBeDeletedTaint, Effect: v1.TaintEffectNoSchedule})},
+			expected: []string{"node a is being scaled down by the cluster autoscaler"},
+		},
+		{
+			name:             "scale up in progress",
+			nodes:            []v1.Node{node("a", v1.ConditionTrue)},
+			autoscalerStatus: autoscalerStatus("InProgress"),
+			expected:         []string{"the cluster autoscaler has a scale up in progress"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, quiescenceProblems(tc.nodes, tc.autoscalerStatus))
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// etcdFaultTolerance returns how many of members etcd members can be unavailable without etcd losing its quorum: 1 of
+// 3, 2 of 5.
+func etcdFaultTolerance(members int) int {
+	if members < 1 {
+		return 0
+	}
+	return (members - 1) / 2
+}
+
+// quorumState is the availability of the control plane members before a machine is replaced.
+type quorumState struct {
+	// members is the number of etcd members, or of control plane machines when the members cannot be listed.
+	members int
+	// unhealthy are the etcd members that are not healthy.
+	unhealthy []string
+	// deleting are the control plane machines whose deletion has not completed.
+	deleting []string
+}
+
+func (s quorumState) unavailable() int {
+	return len(s.unhealthy) + len(s.deleting)
+}
+
+// problem returns why replacing another control plane machine is unsafe, or "" if it is safe. A replacement may
+// leave one more member unavailable, if its new member does not start or its old one is removed, so with members
+// already unavailable it must still fit the fault tolerance. A fully available control plane can always have a machine
+// replaced, whatever its size.
+func (s quorumState) problem() string {
+	unavailable := s.unavailable()
+	tolerance := etcdFaultTolerance(s.members)
+	if unavailable == 0 || unavailable+1 <= tolerance {
+		return ""
+	}
+
+	var reasons []string
+	if len(s.unhealthy) > 0 {
+		reasons = append(reasons, fmt.Sprintf("unhealthy etcd members %s", strings.Join(s.unhealthy, "; ")))
+	}
+	if len(s.deleting) > 0 {
+		reasons = append(reasons, fmt.Sprintf("machines %s are still being deleted", strings.Join(s.deleting, ", ")))
+	}
+	return fmt.Sprintf("%d etcd members tolerate %d unavailable and %d already are (%s), replacing another machine could lose quorum",
+		s.members, tolerance, unavailable, strings.Join(reasons, ", "))
+}
+
+// quorumState returns the availability of the control plane members. Without etcdctl, or with an external etcd, the
+// members are the control plane machines and etcd is unhealthy as a whole if the API server says so.
+func (u *ControlPlaneUpgrader) quorumState() (quorumState, error) {
+	var s quorumState
+
+	deleting, err := listControlPlaneMachinesDeleting(u.log, u.managementClusterClient, u.clusterNamespace, u.clusterName, true)
+	if err != nil {
+		return quorumState{}, err
+	}
+	for _, m := range deleting {
+		s.deleting = append(s.deleting, m.Name)
+	}
+
+	if u.execForbidden || u.etcdExternal {
+		machines, err := u.listMachines()
+		if err != nil {
+			return quorumState{}, err
+		}
+		s.members = len(machines) + len(deleting)
+		if err := u.apiServerEtcdHealth(time.Minute * 1); err != nil {
+			s.unhealthy = append(s.unhealthy, err.Error())
+		}
+		return s, nil
+	}
+
+	members, err := u.listEtcdMembers(time.Minute * 1)
+	if err != nil {
+		return quorumState{}, err
+	}
+	s.members = len(members)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Minute*1)
+	defer cancel()
+	health, err := u.etcdEndpointHealthStatus(ctx, nil)
+	if err != nil {
+		return quorumState{}, err
+	}
+	s.unhealthy = unhealthyEtcdEndpoints(health)
+	return s, nil
+}
+
+// waitForQuorumSafety waits until replacing another control plane machine keeps etcd within its fault tolerance,
+// refusing to go on if it does not within timeout, so that quorum safety does not depend on the previous replacement
+// having fully completed.
+func (u *ControlPlaneUpgrader) waitForQuorumSafety(timeout time.Duration) error {
+	var problem string
+	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+		s, err := u.quorumState()
+		if err != nil {
+			u.log.Error(err, "Error checking the control plane members, will try again")
+			problem = err.Error()
+			return false, nil
+		}
+		problem = s.problem()
+		if problem != "" {
+			u.log.Info("Waiting for control plane members to be available", "problem", problem)
+			return false, nil
+		}
+		u.log.Info("Replacing another machine keeps etcd quorum", "members", s.members, "tolerance", etcdFaultTolerance(s.members), "unavailable", s.unavailable())
+		return true, nil
+	})
+	if err != nil {
+		return errors.Errorf("refusing to replace another control plane machine: %s", problem)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtcdFaultTolerance(t *testing.T) {
+	for members, tolerance := range map[int]int{0: 0, 1: 0, 2: 0, 3: 1, 4: 1, 5: 2, 7: 3} {
+		assert.Equal(t, tolerance, etcdFaultTolerance(members), "%d members", members)
+	}
+}
+
+func TestQuorumStateProblem(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   quorumState
+		problem string
+	}{
+		{
+			name:  "single member available",
+			state: quorumState{members: 1},
+		},
+		{
+			name:  "three members available",
+			state: quorumState{members: 3},
+		},
+		{
+			name:    "three members with one unhealthy",
+			state:   quorumState{members: 3, unhealthy: []string{"https://10.0.0.1:2379: context deadline exceeded"}},
+			problem: "3 etcd members tolerate 1 unavailable and 1 already are (unhealthy etcd members https://10.0.0.1:2379: context deadline exceeded), replacing another machine could lose quorum",
+		},
+		{
+			name:    "three members with a deletion pending",
+			state:   quorumState{members: 3, deleting: []string{"cp-0"}},
+			problem: "3 etcd members tolerate 1 unavailable and 1 already are (machines cp-0 are still being deleted), replacing another machine could lose quorum",
+		},
+		{
+			name:  "five members with one unavailable",
+			state: quorumState{members: 5, deleting: []string{"cp-0"}},
+		},
+		{
+			name:    "five members with two unavailable",
+			state:   quorumState{members: 5, unhealthy: []string{"https://10.0.0.1:2379: unhealthy"}, deleting: []string{"cp-0"}},
+			problem: "5 etcd members tolerate 2 unavailable and 2 already are (unhealthy etcd members https://10.0.0.1:2379: unhealthy, machines cp-0 are still being deleted), replacing another machine could lose quorum",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.problem, tt.state.problem())
+		})
+	}
+}
+
+func TestUnhealthyEtcdEndpoints(t *testing.T) {
+	assert.Equal(t, []string{"https://10.0.0.2:2379: context deadline exceeded"}, unhealthyEtcdEndpoints([]etcdEndpointHealth{
+		{Endpoint: "https://10.0.0.1:2379", Health: true},
+		{Endpoint: "https://10.0.0.2:2379", Error: "context deadline exceeded"},
+	}))
+}
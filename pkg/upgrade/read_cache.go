@@ -0,0 +1,199 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultReadCacheTTL is how long Config.ReadCacheTTL keeps reads by default. It is shorter than the 5 second interval
+// the tool polls machines at, so that polls never see a cached read.
+const defaultReadCacheTTL = 2 * time.Second
+
+// parseReadCacheTTL parses ttl, defaulting it to defaultReadCacheTTL. Zero disables the cache.
+func parseReadCacheTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return defaultReadCacheTTL, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error parsing read cache ttl %q", ttl)
+	}
+	if d < 0 {
+		return 0, errors.Errorf("invalid read cache ttl %q: must not be negative", ttl)
+	}
+	return d, nil
+}
+
+// readCacheKey identifies a cached object by its kind and key.
+type readCacheKey struct {
+	kind string
+	key  ctrlclient.ObjectKey
+}
+
+// readCacheEntry is a copy of an object read at a time.
+type readCacheEntry struct {
+	obj  runtime.Object
+	read time.Time
+}
+
+// readCache is a management cluster client that serves repeated Gets of the same Machine or KubeadmConfig within ttl
+// from a copy of the first read. The writes made through it invalidate the objects they change, so that they are
+// read again afterwards; other objects and Lists are always read from the API server.
+type readCache struct {
+	ctrlclient.Client
+	ttl time.Duration
+	// now returns the current time; it is replaced in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[readCacheKey]readCacheEntry
+}
+
+// newReadCache returns c caching the Machines and KubeadmConfigs it gets for ttl.
+func newReadCache(c ctrlclient.Client, ttl time.Duration) *readCache {
+	return &readCache{
+		Client:  c,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[readCacheKey]readCacheEntry{},
+	}
+}
+
+// readCacheKind returns the kind of obj if it is cached, or an empty string otherwise.
+func readCacheKind(obj runtime.Object) string {
+	switch obj.(type) {
+	case *clusterv1.Machine:
+		return "Machine"
+	case *bootstrapv1.KubeadmConfig:
+		return "KubeadmConfig"
+	default:
+		return ""
+	}
+}
+
+// Get reads obj from the cache if it was read less than ttl ago, or from the API server otherwise.
+func (c *readCache) Get(ctx context.Context, key ctrlclient.ObjectKey, obj runtime.Object) error {
+	kind := readCacheKind(obj)
+	if kind == "" {
+		return c.Client.Get(ctx, key, obj)
+	}
+	k := readCacheKey{kind: kind, key: key}
+
+	c.mu.Lock()
+	entry, ok := c.entries[k]
+	c.mu.Unlock()
+	if ok && c.now().Sub(entry.read) < c.ttl {
+		copyCachedObject(entry.obj, obj)
+		return nil
+	}
+
+	if err := c.Client.Get(ctx, key, obj); err != nil {
+		c.invalidate(obj, key)
+		return err
+	}
+	c.mu.Lock()
+	c.entries[k] = readCacheEntry{obj: obj.DeepCopyObject(), read: c.now()}
+	c.mu.Unlock()
+	return nil
+}
+
+// copyCachedObject copies the cached object from to obj, both of the same kind.
+func copyCachedObject(from, obj runtime.Object) {
+	switch o := obj.(type) {
+	case *clusterv1.Machine:
+		from.(*clusterv1.Machine).DeepCopyInto(o)
+	case *bootstrapv1.KubeadmConfig:
+		from.(*bootstrapv1.KubeadmConfig).DeepCopyInto(o)
+	}
+}
+
+// invalidate drops obj, whose key is key, from the cache.
+func (c *readCache) invalidate(obj runtime.Object, key ctrlclient.ObjectKey) {
+	kind := readCacheKind(obj)
+	if kind == "" {
+		return
+	}
+	c.mu.Lock()
+	delete(c.entries, readCacheKey{kind: kind, key: key})
+	c.mu.Unlock()
+}
+
+// invalidateObject drops obj from the cache, keyed by its own namespace and name.
+func (c *readCache) invalidateObject(obj runtime.Object) {
+	key, err := ctrlclient.ObjectKeyFromObject(obj)
+	if err != nil {
+		c.invalidateAll()
+		return
+	}
+	c.invalidate(obj, key)
+}
+
+// invalidateAll empties the cache.
+func (c *readCache) invalidateAll() {
+	c.mu.Lock()
+	c.entries = map[readCacheKey]readCacheEntry{}
+	c.mu.Unlock()
+}
+
+// Create creates obj, dropping any cached copy of it.
+func (c *readCache) Create(ctx context.Context, obj runtime.Object, opts ...ctrlclient.CreateOption) error {
+	defer c.invalidateObject(obj)
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// Update updates obj, dropping its cached copy.
+func (c *readCache) Update(ctx context.Context, obj runtime.Object, opts ...ctrlclient.UpdateOption) error {
+	defer c.invalidateObject(obj)
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+// Patch patches obj, dropping its cached copy.
+func (c *readCache) Patch(ctx context.Context, obj runtime.Object, patch ctrlclient.Patch, opts ...ctrlclient.PatchOption) error {
+	defer c.invalidateObject(obj)
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+// Delete deletes obj, dropping its cached copy.
+func (c *readCache) Delete(ctx context.Context, obj runtime.Object, opts ...ctrlclient.DeleteOption) error {
+	defer c.invalidateObject(obj)
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+// DeleteAllOf deletes the objects of the kind of obj matching opts, emptying the cache.
+func (c *readCache) DeleteAllOf(ctx context.Context, obj runtime.Object, opts ...ctrlclient.DeleteAllOfOption) error {
+	defer c.invalidateAll()
+	return c.Client.DeleteAllOf(ctx, obj, opts...)
+}
+
+// Status returns a writer of the status subresource that drops the cached copies of the objects it writes.
+func (c *readCache) Status() ctrlclient.StatusWriter {
+	return &readCacheStatusWriter{StatusWriter: c.Client.Status(), cache: c}
+}
+
+// readCacheStatusWriter is the status writer of a readCache.
+type readCacheStatusWriter struct {
+	ctrlclient.StatusWriter
+	cache *readCache
+}
+
+// Update updates the status of obj, dropping its cached copy.
+func (w *readCacheStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...ctrlclient.UpdateOption) error {
+	defer w.cache.invalidateObject(obj)
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+// Patch patches the status of obj, dropping its cached copy.
+func (w *readCacheStatusWriter) Patch(ctx context.Context, obj runtime.Object, patch ctrlclient.Patch, opts ...ctrlclient.PatchOption) error {
+	defer w.cache.invalidateObject(obj)
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
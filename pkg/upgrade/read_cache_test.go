@@ -0,0 +1,89 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// countingClient counts the Gets of the client it wraps.
+type countingClient struct {
+	ctrlclient.Client
+	gets int
+}
+
+func (c *countingClient) Get(ctx context.Context, key ctrlclient.ObjectKey, obj runtime.Object) error {
+	c.gets++
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestParseReadCacheTTL(t *testing.T) {
+	ttl, err := parseReadCacheTTL("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultReadCacheTTL, ttl)
+
+	ttl, err = parseReadCacheTTL("0")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl)
+
+	_, err = parseReadCacheTTL("-1s")
+	assert.Error(t, err)
+	_, err = parseReadCacheTTL("soon")
+	assert.Error(t, err)
+}
+
+func TestReadCache(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clusterv1.AddToScheme(scheme))
+	assert.NoError(t, v1.AddToScheme(scheme))
+	machine := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cp-0"}}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cp-0"}}
+	counting := &countingClient{Client: fake.NewFakeClientWithScheme(scheme, machine, secret)}
+
+	now := time.Unix(0, 0)
+	c := newReadCache(counting, time.Second)
+	c.now = func() time.Time { return now }
+	key := ctrlclient.ObjectKey{Namespace: "default", Name: "cp-0"}
+
+	// Repeated reads within the ttl are served from the first, as copies
+	got := &clusterv1.Machine{}
+	assert.NoError(t, c.Get(context.TODO(), key, got))
+	got.Labels = map[string]string{"changed": "locally"}
+	again := &clusterv1.Machine{}
+	assert.NoError(t, c.Get(context.TODO(), key, again))
+	assert.Equal(t, 1, counting.gets)
+	assert.Empty(t, again.Labels)
+
+	// Writes are read back from the API server
+	again.Labels = map[string]string{"changed": "remotely"}
+	assert.NoError(t, c.Update(context.TODO(), again))
+	updated := &clusterv1.Machine{}
+	assert.NoError(t, c.Get(context.TODO(), key, updated))
+	assert.Equal(t, 2, counting.gets)
+	assert.Equal(t, "remotely", updated.Labels["changed"])
+
+	// Reads expire after the ttl
+	now = now.Add(time.Second)
+	assert.NoError(t, c.Get(context.TODO(), key, &clusterv1.Machine{}))
+	assert.Equal(t, 3, counting.gets)
+
+	// Other kinds are not cached
+	assert.NoError(t, c.Get(context.TODO(), key, &v1.Secret{}))
+	assert.NoError(t, c.Get(context.TODO(), key, &v1.Secret{}))
+	assert.Equal(t, 5, counting.gets)
+
+	// Deleted objects are not found afterwards
+	assert.NoError(t, c.Delete(context.TODO(), updated))
+	assert.Error(t, c.Get(context.TODO(), key, &clusterv1.Machine{}))
+}
@@ -0,0 +1,20 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+)
+
+// EnableReadOnly makes the clients created from then on refuse any request that could change the management or target
+// clusters, such as creates, updates, deletes, exec and port-forward, so that assessments can run with a read-only
+// credential. It must be called before any client is created.
+func EnableReadOnly() {
+	kubernetes2.EnableReadOnly()
+}
+
+// ReadOnly returns true once EnableReadOnly has been called.
+func ReadOnly() bool {
+	return kubernetes2.ReadOnly()
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// mirrorPodAnnotation is set by the kubelet on the API server's copy of a static pod.
+const mirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+// defaultReadinessComponents are the kube-system components kubeadm runs as static pods on every control plane node.
+var defaultReadinessComponents = []string{"etcd", "kube-apiserver", "kube-scheduler", "kube-controller-manager"}
+
+// readinessComponent is a kube-system component that must be ready before a new control plane node is considered
+// ready.
+type readinessComponent struct {
+	name     string
+	selector labels.Selector
+}
+
+// parseReadinessComponents parses components of the form "name" or "name:selector". Without a selector, pods are
+// matched using the "component=name" label kubeadm sets on its static pods.
+func parseReadinessComponents(components []string) ([]readinessComponent, error) {
+	if len(components) == 0 {
+		components = defaultReadinessComponents
+	}
+
+	var ret []readinessComponent
+	for _, c := range components {
+		parts := strings.SplitN(c, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			return nil, errors.Errorf("invalid readiness component %q: name is required", c)
+		}
+
+		rawSelector := "component=" + name
+		if len(parts) == 2 {
+			rawSelector = parts[1]
+		}
+		selector, err := labels.Parse(rawSelector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid readiness component %q", c)
+		}
+
+		ret = append(ret, readinessComponent{name: name, selector: selector})
+	}
+
+	return ret, nil
+}
+
+// requiredPodConditions are the conditions a pod must have true to count as ready, whatever the pod conditions
+// configured for the readiness components.
+var requiredPodConditions = sets.NewString(defaultReadinessPodConditions...)
+
+// missingPodConditions returns the required conditions that are not true for pod.
+func missingPodConditions(pod *v1.Pod) sets.String {
+	foundConditions := sets.NewString()
+	for _, condition := range pod.Status.Conditions {
+		if condition.Status == v1.ConditionTrue {
+			foundConditions.Insert(string(condition.Type))
+		}
+	}
+	return requiredPodConditions.Difference(foundConditions)
+}
+
+func (u *ControlPlaneUpgrader) isReady(nodeName, nodeHostname string) bool {
+	u.log.Info("Component health check for node", "node", nodeName, "hostname", nodeHostname)
+
+	for _, component := range u.readinessComponents {
+		log := u.log.WithValues("component", component.name)
+
+		pods, err := u.componentPods(component, nodeName, nodeHostname)
+		if err != nil {
+			log.Error(err, "error getting component pods")
+			return false
+		}
+		if len(pods) == 0 {
+			log.Info("Pod not found yet")
+			return false
+		}
+
+		ready := false
+		for i := range pods {
+			unmetConditions := u.readiness.unmetPodConditions(&pods[i])
+			if len(unmetConditions) == 0 {
+				ready = true
+				break
+			}
+			log.Info("pod does not meet some required conditions", "pod", pods[i].Name, "conditions", strings.Join(unmetConditions, ","))
+			log.V(1).Info("Pod status", "pod", pods[i].Name, "phase", pods[i].Status.Phase, "containers", containerStates(&pods[i]))
+		}
+		if !ready {
+			return false
+		}
+	}
+
+	return u.isNodeReady(nodeName)
+}
+
+// componentPods returns the pods to check for component. The kubeadm static pod name for the node is tried first. If
+// it does not exist, pods matching the component's selector that run on the node are used. If none run on the node,
+// the component is assumed to run as a Deployment and all of its pods are returned, any one of which being ready is
+// enough. Static pods never fall back to other nodes.
+func (u *ControlPlaneUpgrader) componentPods(component readinessComponent, nodeName, nodeHostname string) ([]v1.Pod, error) {
+	podName := fmt.Sprintf("%s-%v", component.name, nodeHostname)
+	pod, err := u.targetKubernetesClient.CoreV1().Pods("kube-system").Get(podName, metav1.GetOptions{})
+	if err == nil {
+		return []v1.Pod{*pod}, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "error getting pod %s", podName)
+	}
+
+	list, err := u.targetKubernetesClient.CoreV1().Pods("kube-system").List(metav1.ListOptions{LabelSelector: component.selector.String()})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing pods for component %s", component.name)
+	}
+
+	var onNode []v1.Pod
+	for _, pod := range list.Items {
+		if pod.Spec.NodeName == nodeName {
+			onNode = append(onNode, pod)
+		}
+	}
+	if len(onNode) > 0 {
+		return onNode, nil
+	}
+
+	// Static pods on other nodes mean this node's pod hasn't shown up yet
+	for _, pod := range list.Items {
+		if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+			return nil, nil
+		}
+	}
+
+	return list.Items, nil
+}
+
+// componentLogTailLines is how many lines of logs are collected from each container of a component that did not become
+// ready.
+const componentLogTailLines = 50
+
+// containerLogRequest identifies the logs to collect from a container of a pod that is not ready.
+type containerLogRequest struct {
+	container string
+	// previous is set when the container has restarted and is not running, as its last run explains why.
+	previous bool
+}
+
+// unreadyContainerLogRequests returns the logs to collect from the containers of pod that are not ready.
+func unreadyContainerLogRequests(pod *v1.Pod) []containerLogRequest {
+	var ret []containerLogRequest
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Ready {
+			continue
+		}
+		ret = append(ret, containerLogRequest{
+			container: status.Name,
+			previous:  status.State.Running == nil && status.LastTerminationState.Terminated != nil,
+		})
+	}
+	return ret
+}
+
+// containerStates summarizes the state of each container of pod, such as
+// "etcd=waiting:CrashLoopBackOff,ready=false,restarts=3", for debug logs.
+func containerStates(pod *v1.Pod) []string {
+	var ret []string
+	for _, status := range pod.Status.ContainerStatuses {
+		state := "unknown"
+		switch {
+		case status.State.Running != nil:
+			state = "running"
+		case status.State.Waiting != nil:
+			state = "waiting:" + status.State.Waiting.Reason
+		case status.State.Terminated != nil:
+			state = "terminated:" + status.State.Terminated.Reason
+		}
+		ret = append(ret, fmt.Sprintf("%s=%s,ready=%t,restarts=%d", status.Name, state, status.Ready, status.RestartCount))
+	}
+	return ret
+}
+
+// unreadyComponentLogs returns the tail of the logs of the component pods on the node that are not ready, to explain
+// why a new control plane node did not become ready. Logs that cannot be retrieved are noted instead.
+func (u *ControlPlaneUpgrader) unreadyComponentLogs(nodeName, nodeHostname string) string {
+	var b strings.Builder
+	tailLines := int64(componentLogTailLines)
+
+	for _, component := range u.readinessComponents {
+		pods, err := u.componentPods(component, nodeName, nodeHostname)
+		if err != nil {
+			fmt.Fprintf(&b, "--- %s: %v\n", component.name, err)
+			continue
+		}
+
+		for i := range pods {
+			pod := &pods[i]
+			if pod.Spec.NodeName != nodeName || len(u.readiness.unmetPodConditions(pod)) == 0 {
+				continue
+			}
+
+			requests := unreadyContainerLogRequests(pod)
+			if len(requests) == 0 {
+				fmt.Fprintf(&b, "--- pod %s is not ready but has no unready containers (phase %s)\n", pod.Name, pod.Status.Phase)
+			}
+			for _, r := range requests {
+				opts := &v1.PodLogOptions{Container: r.container, TailLines: &tailLines, Previous: r.previous}
+				logs, err := u.targetKubernetesClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Do().Raw()
+				if err != nil {
+					fmt.Fprintf(&b, "--- unable to get logs of pod %s container %s: %v\n", pod.Name, r.container, err)
+					continue
+				}
+
+				previous := ""
+				if r.previous {
+					previous = " previous run"
+				}
+				fmt.Fprintf(&b, "--- last %d lines of pod %s container %s%s:\n%s\n", componentLogTailLines, pod.Name, r.container, previous, strings.TrimRight(string(logs), "\n"))
+			}
+		}
+	}
+
+	return b.String()
+}
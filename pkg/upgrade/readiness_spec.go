@@ -0,0 +1,257 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultReadinessPodConditions are the conditions the pods of the readiness components must have true by default.
+var defaultReadinessPodConditions = []string{"PodScheduled", "Initialized", "Ready", "ContainersReady"}
+
+// conditionRequirement is a condition of a pod or node, parsed from "Type", "Type=Status" or "Type!=Status".
+type conditionRequirement struct {
+	conditionType string
+	status        v1.ConditionStatus
+	negated       bool
+}
+
+func (r conditionRequirement) String() string {
+	op := "="
+	if r.negated {
+		op = "!="
+	}
+	return r.conditionType + op + string(r.status)
+}
+
+// holds returns whether the requirement holds given the status of the conditions by type. A missing condition has no
+// status, so only requirements for it not to have a status hold.
+func (r conditionRequirement) holds(statuses map[string]v1.ConditionStatus) bool {
+	return (statuses[r.conditionType] == r.status) != r.negated
+}
+
+// parseConditionRequirements parses the condition expressions of kind, "pod" or "node".
+func parseConditionRequirements(kind string, expressions []string) ([]conditionRequirement, error) {
+	var ret []conditionRequirement
+	for _, e := range expressions {
+		r := conditionRequirement{status: v1.ConditionTrue}
+		conditionType := e
+		if i := strings.Index(e, "="); i >= 0 {
+			conditionType = e[:i]
+			if strings.HasSuffix(conditionType, "!") {
+				conditionType = strings.TrimSuffix(conditionType, "!")
+				r.negated = true
+			}
+			status := v1.ConditionStatus(strings.TrimSpace(e[i+1:]))
+			switch status {
+			case v1.ConditionTrue, v1.ConditionFalse, v1.ConditionUnknown:
+			default:
+				return nil, errors.Errorf("invalid %s condition %q: status must be True, False or Unknown", kind, e)
+			}
+			r.status = status
+		}
+		r.conditionType = strings.TrimSpace(conditionType)
+		if r.conditionType == "" || strings.ContainsAny(r.conditionType, "! ") {
+			return nil, errors.Errorf("invalid %s condition %q: it must be Type, Type=Status or Type!=Status", kind, e)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// unmetConditions returns the requirements that do not hold given the status of the conditions by type.
+func unmetConditions(requirements []conditionRequirement, statuses map[string]v1.ConditionStatus) []string {
+	var ret []string
+	for _, r := range requirements {
+		if !r.holds(statuses) {
+			ret = append(ret, r.String())
+		}
+	}
+	return ret
+}
+
+func podConditionStatuses(pod *v1.Pod) map[string]v1.ConditionStatus {
+	ret := map[string]v1.ConditionStatus{}
+	for _, c := range pod.Status.Conditions {
+		ret[string(c.Type)] = c.Status
+	}
+	return ret
+}
+
+func nodeConditionStatuses(node *v1.Node) map[string]v1.ConditionStatus {
+	ret := map[string]v1.ConditionStatus{}
+	for _, c := range node.Status.Conditions {
+		ret[string(c.Type)] = c.Status
+	}
+	return ret
+}
+
+// readinessSpec is what a new control plane node must satisfy, besides its readiness components running, to be ready.
+type readinessSpec struct {
+	podConditions  []conditionRequirement
+	nodeConditions []conditionRequirement
+	prometheus     *prometheusClient
+	queries        []string
+}
+
+// newReadinessSpec parses config, defaulting the pod conditions to defaultReadinessPodConditions.
+func newReadinessSpec(config ReadinessConfig) (readinessSpec, error) {
+	podConditions := config.PodConditions
+	if len(podConditions) == 0 {
+		podConditions = defaultReadinessPodConditions
+	}
+
+	var spec readinessSpec
+	var err error
+	if spec.podConditions, err = parseConditionRequirements("pod", podConditions); err != nil {
+		return readinessSpec{}, err
+	}
+	if spec.nodeConditions, err = parseConditionRequirements("node", config.NodeConditions); err != nil {
+		return readinessSpec{}, err
+	}
+
+	switch {
+	case config.PrometheusURL == "" && len(config.PrometheusQueries) > 0:
+		return readinessSpec{}, errors.New("readiness Prometheus queries require a Prometheus URL")
+	case config.PrometheusURL != "":
+		u, err := url.Parse(config.PrometheusURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return readinessSpec{}, errors.Errorf("invalid Prometheus URL %q, it must be an http or https URL", config.PrometheusURL)
+		}
+		spec.prometheus = newPrometheusClient(config.PrometheusURL)
+		spec.queries = config.PrometheusQueries
+	}
+	return spec, nil
+}
+
+// unmetPodConditions returns the pod conditions that do not hold for pod.
+func (s readinessSpec) unmetPodConditions(pod *v1.Pod) []string {
+	return unmetConditions(s.podConditions, podConditionStatuses(pod))
+}
+
+// isNodeReady returns whether the node conditions and the Prometheus queries hold for the node named nodeName.
+func (u *ControlPlaneUpgrader) isNodeReady(nodeName string) bool {
+	if len(u.readiness.nodeConditions) > 0 {
+		node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			u.log.Error(err, "error getting node", "node", nodeName)
+			return false
+		}
+		if unmet := unmetConditions(u.readiness.nodeConditions, nodeConditionStatuses(node)); len(unmet) > 0 {
+			u.log.Info("Node does not meet some required conditions", "node", nodeName, "conditions", strings.Join(unmet, ","))
+			return false
+		}
+	}
+
+	for _, query := range u.readiness.queries {
+		query = strings.Replace(query, "$node", nodeName, -1)
+		ok, err := u.readiness.prometheus.holds(query)
+		if err != nil {
+			u.log.Error(err, "error running readiness query", "query", query)
+			return false
+		}
+		if !ok {
+			u.log.Info("Readiness query does not hold yet", "query", query)
+			return false
+		}
+	}
+	return true
+}
+
+// prometheusClient runs instant queries against the HTTP API of Prometheus.
+type prometheusClient struct {
+	url    string
+	client *http.Client
+}
+
+func newPrometheusClient(url string) *prometheusClient {
+	return &prometheusClient{
+		url:    strings.TrimRight(url, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// holds runs query and returns whether it returned a result whose values are all non-zero.
+func (p *prometheusClient) holds(query string) (bool, error) {
+	resp, err := p.client.Get(p.url + "/api/v1/query?" + url.Values{"query": {query}}.Encode())
+	if err != nil {
+		return false, errors.Wrap(err, "error querying Prometheus")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, errors.Wrap(err, "error querying Prometheus")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.Errorf("error querying Prometheus: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return prometheusResultHolds(body)
+}
+
+// prometheusResultHolds returns whether the response of an instant query has a result whose values are all
+// non-zero. Vectors must have at least one sample, so that a query selecting nothing does not hold.
+func prometheusResultHolds(body []byte) (bool, error) {
+	var response struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false, errors.Wrap(err, "error decoding the Prometheus response")
+	}
+	if response.Status != "success" {
+		return false, errors.Errorf("Prometheus query failed: %s", response.Error)
+	}
+
+	var values [][2]interface{}
+	switch response.Data.ResultType {
+	case "scalar":
+		var value [2]interface{}
+		if err := json.Unmarshal(response.Data.Result, &value); err != nil {
+			return false, errors.Wrap(err, "error decoding the Prometheus result")
+		}
+		values = append(values, value)
+	case "vector":
+		var samples []struct {
+			Value [2]interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(response.Data.Result, &samples); err != nil {
+			return false, errors.Wrap(err, "error decoding the Prometheus result")
+		}
+		for _, s := range samples {
+			values = append(values, s.Value)
+		}
+	default:
+		return false, errors.Errorf("unsupported Prometheus result type %q, the query must return a scalar or an instant vector", response.Data.ResultType)
+	}
+
+	if len(values) == 0 {
+		return false, nil
+	}
+	for _, v := range values {
+		f, err := strconv.ParseFloat(fmt.Sprint(v[1]), 64)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid Prometheus sample value %v", v[1])
+		}
+		if f == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseConditionRequirements(t *testing.T) {
+	requirements, err := parseConditionRequirements("node", []string{"Ready", "MemoryPressure=False", "NetworkUnavailable!=True"})
+	require.NoError(t, err)
+	assert.Equal(t, []conditionRequirement{
+		{conditionType: "Ready", status: v1.ConditionTrue},
+		{conditionType: "MemoryPressure", status: v1.ConditionFalse},
+		{conditionType: "NetworkUnavailable", status: v1.ConditionTrue, negated: true},
+	}, requirements)
+
+	for _, invalid := range []string{"", "=True", "Ready=yes", "Ready!"} {
+		_, err := parseConditionRequirements("node", []string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestUnmetConditions(t *testing.T) {
+	requirements, err := parseConditionRequirements("node", []string{"Ready", "MemoryPressure=False", "NetworkUnavailable!=True"})
+	require.NoError(t, err)
+
+	assert.Empty(t, unmetConditions(requirements, map[string]v1.ConditionStatus{"Ready": v1.ConditionTrue, "MemoryPressure": v1.ConditionFalse}))
+	assert.Equal(t, []string{"Ready=True", "MemoryPressure=False", "NetworkUnavailable!=True"}, unmetConditions(requirements, map[string]v1.ConditionStatus{
+		"Ready":              v1.ConditionUnknown,
+		"NetworkUnavailable": v1.ConditionTrue,
+	}))
+}
+
+func TestNewReadinessSpec(t *testing.T) {
+	spec, err := newReadinessSpec(ReadinessConfig{})
+	require.NoError(t, err)
+	pod := &v1.Pod{Status: v1.PodStatus{Conditions: []v1.PodCondition{
+		{Type: v1.PodScheduled, Status: v1.ConditionTrue},
+		{Type: v1.PodInitialized, Status: v1.ConditionTrue},
+		{Type: v1.PodReady, Status: v1.ConditionFalse},
+	}}}
+	assert.Equal(t, []string{"Ready=True", "ContainersReady=True"}, spec.unmetPodConditions(pod))
+	assert.Nil(t, spec.prometheus)
+
+	spec, err = newReadinessSpec(ReadinessConfig{PodConditions: []string{"PodScheduled"}})
+	require.NoError(t, err)
+	assert.Empty(t, spec.unmetPodConditions(pod))
+
+	_, err = newReadinessSpec(ReadinessConfig{PrometheusQueries: []string{"up"}})
+	assert.Error(t, err)
+	_, err = newReadinessSpec(ReadinessConfig{PrometheusURL: "prometheus:9090"})
+	assert.Error(t, err)
+}
+
+func TestPrometheusResultHolds(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		holds   bool
+		wantErr bool
+	}{
+		{name: "non-zero vector", body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1.5,"1"]},{"metric":{},"value":[1.5,"3"]}]}}`, holds: true},
+		{name: "vector with a zero", body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1.5,"1"]},{"metric":{},"value":[1.5,"0"]}]}}`},
+		{name: "empty vector", body: `{"status":"success","data":{"resultType":"vector","result":[]}}`},
+		{name: "scalar", body: `{"status":"success","data":{"resultType":"scalar","result":[1.5,"1"]}}`, holds: true},
+		{name: "matrix", body: `{"status":"success","data":{"resultType":"matrix","result":[]}}`, wantErr: true},
+		{name: "error", body: `{"status":"error","error":"parse error"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holds, err := prometheusResultHolds([]byte(tt.body))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.holds, holds)
+		})
+	}
+}
+
+func TestPrometheusClientHolds(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/query", r.URL.Path)
+		query = r.URL.Query().Get("query")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1.5,"1"]}]}}`))
+	}))
+	defer server.Close()
+
+	holds, err := newPrometheusClient(server.URL + "/").holds(`up{node="cp-1"}`)
+	require.NoError(t, err)
+	assert.True(t, holds)
+	assert.Equal(t, `up{node="cp-1"}`, query)
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseReadinessComponents(t *testing.T) {
+	components, err := parseReadinessComponents(nil)
+	require.NoError(t, err)
+	require.Len(t, components, len(defaultReadinessComponents))
+	assert.Equal(t, "etcd", components[0].name)
+	assert.Equal(t, "component=etcd", components[0].selector.String())
+
+	components, err = parseReadinessComponents([]string{"kube-apiserver", "kube-scheduler:k8s-app=kube-scheduler"})
+	require.NoError(t, err)
+	require.Len(t, components, 2)
+	assert.Equal(t, "component=kube-apiserver", components[0].selector.String())
+	assert.Equal(t, "kube-scheduler", components[1].name)
+	assert.Equal(t, "k8s-app=kube-scheduler", components[1].selector.String())
+
+	_, err = parseReadinessComponents([]string{":component=etcd"})
+	assert.Error(t, err)
+
+	_, err = parseReadinessComponents([]string{"etcd:=="})
+	assert.Error(t, err)
+}
+
+func TestMissingPodConditions(t *testing.T) {
+	pod := &v1.Pod{
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{
+				{Type: v1.PodScheduled, Status: v1.ConditionTrue},
+				{Type: v1.PodInitialized, Status: v1.ConditionTrue},
+				{Type: v1.PodReady, Status: v1.ConditionFalse},
+				{Type: v1.ContainersReady, Status: v1.ConditionTrue},
+			},
+		},
+	}
+
+	assert.Equal(t, []string{"Ready"}, missingPodConditions(pod).List())
+
+	pod.Status.Conditions[2].Status = v1.ConditionTrue
+	assert.Equal(t, 0, missingPodConditions(pod).Len())
+}
+
+func TestUnreadyContainerLogRequests(t *testing.T) {
+	pod := &v1.Pod{
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "ready", Ready: true},
+				{Name: "starting", State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+				{
+					Name:                 "crashing",
+					State:                v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+					LastTerminationState: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 1}},
+				},
+			},
+		},
+	}
+
+	expected := []containerLogRequest{
+		{container: "starting"},
+		{container: "crashing", previous: true},
+	}
+	assert.Equal(t, expected, unreadyContainerLogRequests(pod))
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// MachineRecreator replaces a single control plane machine with a new one at the same version, the way an upgrade
+// replaces each machine, for example to replace the machine of a sick node outside of an upgrade.
+type MachineRecreator struct {
+	upgrader *ControlPlaneUpgrader
+}
+
+// NewMachineRecreator returns a MachineRecreator for the target cluster in config. The Kubernetes version of config
+// is not used: replacements are at the version of the machine they replace.
+func NewMachineRecreator(log logr.Logger, config Config) (*MachineRecreator, error) {
+	config.KubernetesVersion = ""
+	config.VersionManifest = ""
+	upgrader, err := newControlPlaneUpgrader(log, config)
+	if err != nil {
+		return nil, err
+	}
+	return &MachineRecreator{upgrader: upgrader}, nil
+}
+
+// Recreate replaces the control plane machine name of the target cluster: it creates copies of its infrastructure and
+// bootstrap objects and a new machine at its version, waits for the new node, removes the etcd member of the old one,
+// then deletes it. Rerunning with the same upgrade ID resumes a replacement interrupted before the old machine was
+// deleted.
+func (r *MachineRecreator) Recreate(name string) error {
+	r.upgrader.record.start()
+	err := r.recreate(name)
+	r.upgrader.record.done(err)
+	return err
+}
+
+func (r *MachineRecreator) recreate(name string) error {
+	u := r.upgrader
+	u.record.event("Recreating machine %s", name)
+
+	machines, err := u.listMachines()
+	if err != nil {
+		return err
+	}
+	machine := findMachine(machines, name)
+	if machine == nil {
+		return errors.Errorf("control plane machine %s/%s not found", u.clusterNamespace, name)
+	}
+	if isPinned(machine) {
+		return errors.Errorf("machine %s/%s is pinned by the %s annotation, remove it to recreate the machine", machine.Namespace, machine.Name, AnnotationPin)
+	}
+	if skipsRemediation(machine) {
+		return errors.Errorf("machine %s/%s is excluded from remediation by the %s annotation, remove it to recreate the machine", machine.Namespace, machine.Name, AnnotationSkipRemediation)
+	}
+	if machine.Spec.Version == nil || *machine.Spec.Version == "" {
+		return errors.Errorf("machine %s/%s has no version", machine.Namespace, machine.Name)
+	}
+	version, err := semver.ParseTolerant(*machine.Spec.Version)
+	if err != nil {
+		return errors.Wrapf(err, "invalid version of machine %s/%s", machine.Namespace, machine.Name)
+	}
+	u.desiredVersion = version
+	u.effectiveConfig.DesiredVersion = version.String()
+	u.record.versions(version.String(), version.String())
+	if err := logEffectiveConfig(u.log, u.record, u.effectiveConfig); err != nil {
+		return err
+	}
+
+	u.selfHosted, err = u.isSelfHosted()
+	if err != nil {
+		return err
+	}
+	if u.selfHosted && !u.allowSelfHosted {
+		return errors.New("the management cluster is the target cluster (self-hosted); rerun with --allow-self-hosted to recreate a machine that may run the Cluster API controllers")
+	}
+
+	if err := u.checkExecAllowed(); err != nil {
+		return err
+	}
+	if err := u.detectExternalEtcd(); err != nil {
+		return err
+	}
+
+	u.log.Info("Checking etcd health")
+	if err := u.etcdClusterHealthCheck(time.Minute * 1); err != nil {
+		return err
+	}
+
+	if err := u.approval.wait(approvalPhaseControlPlane); err != nil {
+		return err
+	}
+
+	u.log.Info("Updating provider IDs to nodes")
+	if err := u.UpdateProviderIDsToNodes(); err != nil {
+		return err
+	}
+
+	u.log.Info("Checking for an egress selector configuration")
+	u.egressSelector, err = u.detectEgressSelector(machines)
+	if err != nil {
+		return err
+	}
+	if u.egressSelector != nil {
+		u.addKonnectivityServerReadiness()
+	}
+
+	if err := u.saveEtcdMembers(); err != nil {
+		return err
+	}
+	if err := u.restoreUpgradeState(); err != nil {
+		return err
+	}
+
+	if len(u.machinesToReplace([]*clusterv1.Machine{machine})) == 0 {
+		return errors.Errorf("machine %s/%s cannot be recreated, see the warnings", machine.Namespace, machine.Name)
+	}
+
+	// TODO extract timeout as a configurable constant
+	if err := u.waitForQuorumSafety(machineReplacementStepTimeout); err != nil {
+		return err
+	}
+
+	if err := u.paceDisruption(fmt.Sprintf("recreating machine %s", name), fmt.Sprintf("machine %s", name)); err != nil {
+		return err
+	}
+
+	replacementKey := u.replacementKey(machine)
+	if err := u.createReplacementObjects(replacementKey, machine); err != nil {
+		return err
+	}
+	if err := u.updateMachine(replacementKey, machine); err != nil {
+		return err
+	}
+	if err := u.removeUpgradeID(replacementKey); err != nil {
+		return err
+	}
+
+	u.log.Info("Checking etcd health")
+	if err := u.etcdClusterHealthCheck(time.Minute * 1); err != nil {
+		return err
+	}
+	u.record.event("Recreated machine %s as %s", name, replacementKey.Name)
+	return nil
+}
+
+// Warnings returns the non-fatal findings made so far by Recreate.
+func (r *MachineRecreator) Warnings() []Warning {
+	return r.upgrader.Warnings()
+}
+
+// Report returns the report of the run so far, including its warnings.
+func (r *MachineRecreator) Report() RunReport {
+	return r.upgrader.Report()
+}
+
+// findMachine returns the machine of machines named name, or nil.
+func findMachine(machines []*clusterv1.Machine, name string) *clusterv1.Machine {
+	for _, m := range machines {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestFindMachine(t *testing.T) {
+	machines := []*clusterv1.Machine{
+		{ObjectMeta: metav1.ObjectMeta{Name: "cp-0"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cp-1.upgrade.1570000000"}},
+	}
+	assert.Equal(t, machines[1], findMachine(machines, "cp-1.upgrade.1570000000"))
+	assert.Nil(t, findMachine(machines, "cp-1"))
+
+	// A recreated machine keeps its name, with the suffix of the new upgrade ID
+	assert.Equal(t, "cp-1.upgrade.1580000000", generateReplacementMachineName(machines[1].Name, "1580000000"))
+}
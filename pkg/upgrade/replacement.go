@@ -0,0 +1,267 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// ReplacementOptions are how the objects replacing a control plane machine are built by BuildReplacementMachine,
+// BuildReplacementKubeadmConfig and BuildReplacementInfra, which make no API calls, so that other controllers can
+// reuse the transformations of the tool with their own orchestration.
+type ReplacementOptions struct {
+	// MachineName is the name of the machine replaced, after which the replacement objects are named with the upgrade
+	// ID, as ReplacementName does. It defaults to the name of the object the replacement is built from.
+	MachineName string
+	// UpgradeID is the upgrade ID in the names of the replacement objects, such as a timestamp.
+	UpgradeID string
+	// Version is the Kubernetes version of the replacement machine, which also selects the kubelet extra args rules
+	// applied to the replacement KubeadmConfig.
+	Version string
+	// MachineUpdates are the images and tags of the replacement infrastructure machines.
+	MachineUpdates MachineUpdateConfig
+	// ExtraLabels and ExtraAnnotations are added to every replacement object.
+	ExtraLabels      map[string]string
+	ExtraAnnotations map[string]string
+	// ConvertInitConfiguration carries the settings of the InitConfiguration of the KubeadmConfig that apply to joining
+	// nodes to the JoinConfiguration of its replacement, instead of only its node registration.
+	ConvertInitConfiguration bool
+	// KubeletExtraArgsRules adjust the kubelet extra args of the replacement KubeadmConfig, after the rules the tool
+	// applies by default.
+	KubeletExtraArgsRules []KubeletExtraArgsRule
+	// Files are added to the replacement KubeadmConfig unless it has a file at the same path, such as the egress
+	// selector configuration of the control plane.
+	Files []bootstrapv1.File
+	// KubeadmPatches are written to the replacement KubeadmConfig. Its source directory is not read, as building
+	// replacements does no I/O.
+	KubeadmPatches KubeadmPatchesConfig
+	// APIServerCertSANs are added to the API server cert SANs of the ClusterConfiguration of the replacement
+	// KubeadmConfig, if it has one.
+	APIServerCertSANs []string
+}
+
+// ReplacementName returns the name of the machine, and of its infrastructure and bootstrap objects, replacing the
+// machine called name in the upgrade upgradeID.
+func ReplacementName(name, upgradeID string) string {
+	return generateReplacementMachineName(name, upgradeID)
+}
+
+// BuildReplacementMachine returns the machine replacing machine, referencing the replacement infrastructure and
+// bootstrap objects, at the version of opts and without a provider ID.
+func BuildReplacementMachine(machine *clusterv1.Machine, opts ReplacementOptions) (*clusterv1.Machine, error) {
+	b, err := opts.builder(machine.Name)
+	if err != nil {
+		return nil, err
+	}
+	return b.machine(machine), nil
+}
+
+// BuildReplacementKubeadmConfig returns the KubeadmConfig of the machine replacing the one of config, joining the
+// control plane instead of initializing it, and the settings of its InitConfiguration that could not be carried over.
+func BuildReplacementKubeadmConfig(config *bootstrapv1.KubeadmConfig, opts ReplacementOptions) (*bootstrapv1.KubeadmConfig, []string, error) {
+	b, err := opts.builder(config.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	replacement, changes := b.kubeadmConfig(config)
+	return replacement, changes.dropped, nil
+}
+
+// BuildReplacementInfra returns the infrastructure machine of the machine replacing the one of infra, without its
+// provider ID and with the image and tags of the machine updates of opts.
+func BuildReplacementInfra(infra *unstructured.Unstructured, opts ReplacementOptions) (*unstructured.Unstructured, error) {
+	b, err := opts.builder(infra.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return b.infrastructure(infra)
+}
+
+// builder returns the builder of the replacement objects of opts, named after name unless opts has a machine name.
+func (opts ReplacementOptions) builder(name string) (replacementBuilder, error) {
+	if opts.MachineName != "" {
+		name = opts.MachineName
+	}
+	if opts.UpgradeID == "" {
+		return replacementBuilder{}, errors.New("upgrade ID is required")
+	}
+	version, err := semver.ParseTolerant(opts.Version)
+	if err != nil {
+		return replacementBuilder{}, errors.Wrapf(err, "invalid kubernetes version %q", opts.Version)
+	}
+	rules, err := parseKubeletExtraArgsRules(append(append([]KubeletExtraArgsRule(nil), defaultKubeletExtraArgsRules...), opts.KubeletExtraArgsRules...))
+	if err != nil {
+		return replacementBuilder{}, err
+	}
+	if err := validateAPIServerCertSANs(opts.APIServerCertSANs); err != nil {
+		return replacementBuilder{}, err
+	}
+	patches := opts.KubeadmPatches
+	if patches.Directory == "" {
+		patches.Directory = defaultKubeadmPatchesDirectory
+	}
+
+	return replacementBuilder{
+		name:                     ReplacementName(name, opts.UpgradeID),
+		version:                  version,
+		machineUpdates:           opts.MachineUpdates,
+		extraLabels:              opts.ExtraLabels,
+		extraAnnotations:         opts.ExtraAnnotations,
+		convertInitConfiguration: opts.ConvertInitConfiguration,
+		kubeletExtraArgsRules:    rules,
+		files:                    opts.Files,
+		kubeadmPatches:           patches,
+		apiServerCertSANs:        opts.APIServerCertSANs,
+	}, nil
+}
+
+// replacementBuilder builds the objects replacing a control plane machine from copies of the originals.
+type replacementBuilder struct {
+	// name is the name of the replacement objects.
+	name                     string
+	version                  semver.Version
+	machineUpdates           MachineUpdateConfig
+	extraLabels              map[string]string
+	extraAnnotations         map[string]string
+	convertInitConfiguration bool
+	// kubeletExtraArgsRules are parsed, and include the default rules.
+	kubeletExtraArgsRules []KubeletExtraArgsRule
+	files                 []bootstrapv1.File
+	kubeadmPatches        KubeadmPatchesConfig
+	apiServerCertSANs     []string
+}
+
+// kubeadmConfigChanges are the changes made to a KubeadmConfig for its replacement worth reporting.
+type kubeadmConfigChanges struct {
+	// dropped are the settings of the InitConfiguration that cannot be carried to the replacement.
+	dropped []string
+	// kubeletExtraArgs are the adjustments of the kubelet extra args for the version of the replacement.
+	kubeletExtraArgs []string
+}
+
+// machine returns the machine replacing machine.
+func (b replacementBuilder) machine(machine *clusterv1.Machine) *clusterv1.Machine {
+	replacementMachine := machine.DeepCopy()
+
+	// have to clear this out so we can create a new machine
+	replacementMachine.ResourceVersion = ""
+
+	// the replacement is a new machine, not under investigation nor to be deleted first
+	deleteMachineStateAnnotations(replacementMachine.Annotations)
+
+	// have to clear this out so the new machine can get its own provider id set
+	replacementMachine.Spec.ProviderID = nil
+
+	// Use the new, generated replacement machine name for all the things
+	replacementMachine.Name = b.name
+	replacementMachine.Spec.InfrastructureRef.Name = b.name
+	replacementMachine.Spec.Bootstrap.Data = nil
+	replacementMachine.Spec.Bootstrap.ConfigRef.Name = b.name
+
+	version := b.version.String()
+	replacementMachine.Spec.Version = &version
+
+	applyExtraMetadata(replacementMachine, b.extraLabels, b.extraAnnotations)
+	return replacementMachine
+}
+
+// kubeadmConfig returns the KubeadmConfig replacing config, joining the control plane.
+func (b replacementBuilder) kubeadmConfig(config *bootstrapv1.KubeadmConfig) (*bootstrapv1.KubeadmConfig, kubeadmConfigChanges) {
+	var changes kubeadmConfigChanges
+	bootstrap := config.DeepCopy()
+	bootstrap.SetName(b.name)
+	bootstrap.SetResourceVersion("")
+	bootstrap.SetOwnerReferences(nil)
+
+	if b.convertInitConfiguration {
+		bootstrap.Spec.JoinConfiguration, changes.dropped = convertInitConfiguration(bootstrap.Spec.InitConfiguration, bootstrap.Spec.JoinConfiguration)
+	} else {
+		// find node registration
+		nodeRegistration := kubeadmv1beta1.NodeRegistrationOptions{}
+		if bootstrap.Spec.InitConfiguration != nil {
+			nodeRegistration = bootstrap.Spec.InitConfiguration.NodeRegistration
+		} else if bootstrap.Spec.JoinConfiguration != nil {
+			nodeRegistration = bootstrap.Spec.JoinConfiguration.NodeRegistration
+		}
+		if bootstrap.Spec.JoinConfiguration == nil {
+			bootstrap.Spec.JoinConfiguration = &kubeadmv1beta1.JoinConfiguration{
+				ControlPlane: &kubeadmv1beta1.JoinControlPlane{},
+			}
+		}
+		bootstrap.Spec.JoinConfiguration.NodeRegistration = nodeRegistration
+	}
+
+	// drop or update kubelet flags the desired version does not accept
+	registration := &bootstrap.Spec.JoinConfiguration.NodeRegistration
+	args, kubeletChanges := adjustKubeletExtraArgs(registration.KubeletExtraArgs, b.kubeletExtraArgsRules, b.version)
+	if len(kubeletChanges) > 0 {
+		changes.kubeletExtraArgs = kubeletChanges
+		registration.KubeletExtraArgs = args
+	}
+
+	// clear init configuration
+	// When you have both the init configuration and the join configuration present
+	// for a control plane upgrade, kubeadm will use the init configuration instead
+	// of the join configuration. during upgrades, you will never be initializing a
+	// new node. It will always be joining an existing control plane.
+	bootstrap.Spec.InitConfiguration = nil
+
+	// carry the egress selector configuration over to the replacement
+	bootstrap.Spec.Files = mergeMissingFiles(bootstrap.Spec.Files, b.files)
+
+	// carry static pod patches over to the replacement
+	bootstrap.Spec.Files = mergeKubeadmPatchFiles(bootstrap.Spec.Files, b.kubeadmPatches)
+
+	// certificates of joining nodes come from the kubeadm configmap, keep the KubeadmConfig in line with it
+	addClusterConfigurationCertSANs(bootstrap.Spec.ClusterConfiguration, b.apiServerCertSANs)
+
+	applyExtraMetadata(bootstrap, b.extraLabels, b.extraAnnotations)
+	return bootstrap, changes
+}
+
+// infrastructure returns the infrastructure machine replacing infra, with the image and tags of the machine updates.
+func (b replacementBuilder) infrastructure(infra *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	replacement := infra.DeepCopy()
+	replacement.SetResourceVersion("")
+	replacement.SetName(b.name)
+	replacement.SetOwnerReferences(nil)
+	unstructured.RemoveNestedField(replacement.UnstructuredContent(), "spec", "providerID")
+
+	// machines may use different infrastructure kinds, so the image update is resolved per kind
+	update, ok, err := resolveImageUpdate(b.machineUpdates, replacement.GetKind(), b.version)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := updateInfrastructureImage(replacement, update.field, update.id); err != nil {
+			return nil, err
+		}
+	}
+	flavorField, ok, err := resolveFlavorField(b.machineUpdates, replacement.GetKind())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := updateInfrastructureImage(replacement, flavorField, b.machineUpdates.Flavor); err != nil {
+			return nil, err
+		}
+	}
+	tagsField, ok, err := resolveTagsField(b.machineUpdates, replacement.GetKind())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := mergeInfrastructureTags(replacement, tagsField, b.machineUpdates.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	applyExtraMetadata(replacement, b.extraLabels, b.extraAnnotations)
+	return replacement, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// replacementNameHash returns a short hash of name, which disambiguates the truncated names of replacement machines.
+func replacementNameHash(name string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// replacementNameCollisions returns the replacement machine names of upgradeID shared by more than one of machines,
+// which would make machines replace each other's replacements. Machines already replaced by upgradeID are ignored, as
+// their replacement name is their own.
+func replacementNameCollisions(machines []*clusterv1.Machine, upgradeID string) []string {
+	var names []string
+	originals := make(map[string][]string)
+	for _, m := range machines {
+		name := generateReplacementMachineName(m.Name, upgradeID)
+		if name == m.Name {
+			continue
+		}
+		if _, ok := originals[name]; !ok {
+			names = append(names, name)
+		}
+		originals[name] = append(originals[name], m.Name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		if len(originals[name]) < 2 {
+			continue
+		}
+		sort.Strings(originals[name])
+		problems = append(problems, fmt.Sprintf("machines %s would all be replaced by machine %s", strings.Join(originals[name], ", "), name))
+	}
+	return problems
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestReplacementNameCollisions(t *testing.T) {
+	upgradeID := "1234567890"
+	machine := func(name string) *clusterv1.Machine {
+		return &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+	}
+
+	long := strings.Repeat("s", validation.DNS1123SubdomainMaxLength)
+	truncated := strings.TrimSuffix(generateReplacementMachineName(long+"-a", upgradeID), upgradeSuffix(upgradeID))
+
+	tests := []struct {
+		name     string
+		machines []*clusterv1.Machine
+		expected []string
+	}{
+		{
+			name:     "short names",
+			machines: []*clusterv1.Machine{machine("cp-0"), machine("cp-1")},
+		},
+		{
+			name:     "truncated names differing past the truncation",
+			machines: []*clusterv1.Machine{machine(long + "-a"), machine(long + "-b")},
+		},
+		{
+			name:     "resumed upgrade",
+			machines: []*clusterv1.Machine{machine(long + "-a"), machine(generateReplacementMachineName(long+"-a", upgradeID))},
+		},
+		{
+			name:     "truncated name matching another machine",
+			machines: []*clusterv1.Machine{machine(long + "-a"), machine(truncated)},
+			expected: []string{"machines " + truncated + ", " + long + "-a would all be replaced by machine " + truncated + upgradeSuffix(upgradeID)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, replacementNameCollisions(tc.machines, upgradeID))
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	kubeadmv1beta1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/kubeadm/v1beta1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func testReplacementOptions() ReplacementOptions {
+	return ReplacementOptions{
+		MachineName: "cp-0",
+		UpgradeID:   "123",
+		Version:     "v1.16.3",
+		MachineUpdates: MachineUpdateConfig{
+			Image: ImageUpdateConfig{ID: "ami-456"},
+			Tags:  map[string]string{"owner": "ops"},
+		},
+		ExtraLabels: map[string]string{"team": "platform"},
+	}
+}
+
+func TestBuildReplacementMachine(t *testing.T) {
+	providerID := "aws:///us-east-1a/i-0123"
+	version := "v1.15.5"
+	bootstrapData := "data"
+	machine := &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "cp-0", ResourceVersion: "7", Annotations: map[string]string{
+			AnnotationSkipRemediation:     "",
+			AnnotationDeleteMachine:       "yes",
+			AnnotationExcludeNodeDraining: "",
+		}},
+		Spec: clusterv1.MachineSpec{
+			ProviderID:        &providerID,
+			Version:           &version,
+			InfrastructureRef: corev1.ObjectReference{Kind: "AWSMachine", Name: "cp-0-infra"},
+			Bootstrap:         clusterv1.Bootstrap{ConfigRef: &corev1.ObjectReference{Kind: "KubeadmConfig", Name: "cp-0-config"}, Data: &bootstrapData},
+		},
+	}
+
+	opts := testReplacementOptions()
+	opts.MachineName = ""
+	replacement, err := BuildReplacementMachine(machine, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "cp-0.upgrade.123", replacement.Name)
+	assert.Equal(t, "ns", replacement.Namespace)
+	assert.Empty(t, replacement.ResourceVersion)
+	assert.Nil(t, replacement.Spec.ProviderID)
+	assert.Nil(t, replacement.Spec.Bootstrap.Data)
+	assert.Equal(t, "cp-0.upgrade.123", replacement.Spec.InfrastructureRef.Name)
+	assert.Equal(t, "cp-0.upgrade.123", replacement.Spec.Bootstrap.ConfigRef.Name)
+	assert.Equal(t, "1.16.3", *replacement.Spec.Version)
+	assert.Equal(t, "platform", replacement.Labels["team"])
+	assert.Equal(t, map[string]string{AnnotationExcludeNodeDraining: ""}, replacement.Annotations)
+	assert.Len(t, machine.Annotations, 3, "the original machine was changed")
+	assert.Equal(t, "cp-0", machine.Name, "the original machine was changed")
+	assert.Equal(t, providerID, *machine.Spec.ProviderID, "the original machine was changed")
+
+	opts.Version = "latest"
+	_, err = BuildReplacementMachine(machine, opts)
+	assert.Error(t, err)
+	opts = testReplacementOptions()
+	opts.UpgradeID = ""
+	_, err = BuildReplacementMachine(machine, opts)
+	assert.Error(t, err)
+}
+
+func TestBuildReplacementKubeadmConfig(t *testing.T) {
+	config := &bootstrapv1.KubeadmConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "ns",
+			Name:            "cp-0-config",
+			ResourceVersion: "7",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Machine", Name: "cp-0"}},
+		},
+		Spec: bootstrapv1.KubeadmConfigSpec{
+			InitConfiguration: &kubeadmv1beta1.InitConfiguration{
+				NodeRegistration: kubeadmv1beta1.NodeRegistrationOptions{
+					KubeletExtraArgs: map[string]string{"cloud-provider": "aws", "allow-privileged": "true"},
+				},
+				LocalAPIEndpoint: kubeadmv1beta1.APIEndpoint{AdvertiseAddress: "10.0.0.1", BindPort: 6443},
+			},
+		},
+	}
+
+	opts := testReplacementOptions()
+	opts.KubeadmPatches = KubeadmPatchesConfig{Files: map[string]string{"kube-apiserver0+strategic.yaml": "patch"}}
+	opts.Files = []bootstrapv1.File{{Path: "/etc/kubernetes/egress-selector.yaml", Content: "egress"}}
+
+	replacement, dropped, err := BuildReplacementKubeadmConfig(config, opts)
+	require.NoError(t, err)
+	assert.Empty(t, dropped)
+	assert.Equal(t, "cp-0.upgrade.123", replacement.Name)
+	assert.Empty(t, replacement.ResourceVersion)
+	assert.Empty(t, replacement.OwnerReferences)
+	assert.Nil(t, replacement.Spec.InitConfiguration)
+	require.NotNil(t, replacement.Spec.JoinConfiguration)
+	assert.NotNil(t, replacement.Spec.JoinConfiguration.ControlPlane)
+	assert.Equal(t, map[string]string{"cloud-provider": "aws"}, replacement.Spec.JoinConfiguration.NodeRegistration.KubeletExtraArgs)
+	assert.Equal(t, []bootstrapv1.File{
+		{Path: "/etc/kubernetes/egress-selector.yaml", Content: "egress"},
+		{Path: "/etc/kubernetes/patches/kube-apiserver0+strategic.yaml", Owner: "root:root", Permissions: "0600", Content: "patch"},
+	}, replacement.Spec.Files)
+	assert.Equal(t, "platform", replacement.Labels["team"])
+	assert.NotNil(t, config.Spec.InitConfiguration, "the original KubeadmConfig was changed")
+
+	opts.ConvertInitConfiguration = true
+	opts.KubeletExtraArgsRules = []KubeletExtraArgsRule{{KubernetesVersions: ">=1.16.0", Set: map[string]string{"rotate-certificates": "true"}}}
+	replacement, dropped, err = BuildReplacementKubeadmConfig(config, opts)
+	require.NoError(t, err)
+	assert.Len(t, dropped, 1)
+	assert.Equal(t, int32(6443), replacement.Spec.JoinConfiguration.ControlPlane.LocalAPIEndpoint.BindPort)
+	assert.Equal(t, map[string]string{"cloud-provider": "aws", "rotate-certificates": "true"}, replacement.Spec.JoinConfiguration.NodeRegistration.KubeletExtraArgs)
+}
+
+func TestBuildReplacementInfra(t *testing.T) {
+	infra := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "infrastructure.cluster.x-k8s.io/v1alpha2",
+		"kind":       "AWSMachine",
+		"metadata":   map[string]interface{}{"namespace": "ns", "name": "cp-0-infra", "resourceVersion": "7"},
+		"spec": map[string]interface{}{
+			"providerID": "aws:///us-east-1a/i-0123",
+			"ami":        map[string]interface{}{"id": "ami-123"},
+		},
+	}}
+
+	replacement, err := BuildReplacementInfra(infra, testReplacementOptions())
+	require.NoError(t, err)
+	assert.Equal(t, "cp-0.upgrade.123", replacement.GetName())
+	assert.Empty(t, replacement.GetResourceVersion())
+	_, found, _ := unstructured.NestedString(replacement.Object, "spec", "providerID")
+	assert.False(t, found)
+	id, _, _ := unstructured.NestedString(replacement.Object, "spec", "ami", "id")
+	assert.Equal(t, "ami-456", id)
+	tags, _, _ := unstructured.NestedStringMap(replacement.Object, "spec", "additionalTags")
+	assert.Equal(t, map[string]string{"owner": "ops"}, tags)
+	assert.Equal(t, "platform", replacement.GetLabels()["team"])
+
+	id, _, _ = unstructured.NestedString(infra.Object, "spec", "ami", "id")
+	assert.Equal(t, "ami-123", id, "the original infrastructure machine was changed")
+}
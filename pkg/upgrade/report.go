@@ -0,0 +1,444 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// RunReport is a shareable account of an upgrade run, for example to attach to a change ticket.
+type RunReport struct {
+	Scope         string    `json:"scope"`
+	Cluster       string    `json:"cluster"`
+	UpgradeID     string    `json:"upgradeID"`
+	StartedAt     time.Time `json:"startedAt"`
+	FinishedAt    time.Time `json:"finishedAt"`
+	VersionBefore string    `json:"versionBefore,omitempty"`
+	VersionAfter  string    `json:"versionAfter,omitempty"`
+	Succeeded     bool      `json:"succeeded"`
+	Error         string    `json:"error,omitempty"`
+	// NothingToDo is true if an idempotent run found the cluster already upgraded and changed nothing.
+	NothingToDo bool `json:"nothingToDo,omitempty"`
+
+	Timeline                  []TimelineEvent      `json:"timeline"`
+	HealthTimeline            []HealthWindow       `json:"healthTimeline,omitempty"`
+	MachinesReplaced          []MachineReplacement `json:"machinesReplaced,omitempty"`
+	MachineDeploymentsUpdated []string             `json:"machineDeploymentsUpdated,omitempty"`
+	Warnings                  []Warning            `json:"warnings,omitempty"`
+	Verification              *VerificationReport  `json:"verification,omitempty"`
+	Conformance               []ConformanceRun     `json:"conformance,omitempty"`
+	// Configuration is the effective configuration of the run, with secrets redacted.
+	Configuration *EffectiveConfig `json:"configuration,omitempty"`
+}
+
+// TimelineEvent is a step of an upgrade run.
+type TimelineEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// MachineReplacement records a machine replaced during an upgrade.
+type MachineReplacement struct {
+	Machine     string `json:"machine"`
+	Replacement string `json:"replacement"`
+}
+
+// Report file formats, chosen by the report file's extension.
+const (
+	reportFormatHTML     = "html"
+	reportFormatMarkdown = "md"
+)
+
+// runRecorder accumulates the report of an upgrade run. Like warningCollector, a nil recorder discards everything.
+type runRecorder struct {
+	report RunReport
+	now    func() time.Time
+	// events, if not nil, receives the steps of the timeline as they are recorded.
+	events *eventStream
+}
+
+func newRunRecorder(scope, namespace, name, upgradeID string) *runRecorder {
+	return &runRecorder{
+		report: RunReport{
+			Scope:     scope,
+			Cluster:   namespace + "/" + name,
+			UpgradeID: upgradeID,
+		},
+		now: time.Now,
+	}
+}
+
+// start marks the beginning of the run.
+func (r *runRecorder) start() {
+	if r == nil {
+		return
+	}
+	r.report.StartedAt = r.now()
+}
+
+// event adds a step to the timeline.
+func (r *runRecorder) event(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	r.report.Timeline = append(r.report.Timeline, TimelineEvent{Time: r.now(), Message: message})
+	r.events.step(message)
+}
+
+// machinePhase emits that machine, or a machine deployment, entered phase. Phases are too fine grained for the
+// timeline, so they only go to the event stream.
+func (r *runRecorder) machinePhase(machine, phase string) {
+	if r == nil {
+		return
+	}
+	r.events.machine(machine, phase)
+}
+
+// versions records the versions before and after the upgrade.
+func (r *runRecorder) versions(before, after string) {
+	if r == nil {
+		return
+	}
+	r.report.VersionBefore = before
+	r.report.VersionAfter = after
+}
+
+// replaced records that machine was replaced by replacement.
+func (r *runRecorder) replaced(machine, replacement string) {
+	if r == nil {
+		return
+	}
+	r.report.MachinesReplaced = append(r.report.MachinesReplaced, MachineReplacement{Machine: machine, Replacement: replacement})
+	r.event("Replaced machine %s with %s", machine, replacement)
+}
+
+// updated records that a machine deployment was updated.
+func (r *runRecorder) updated(machineDeployment string) {
+	if r == nil {
+		return
+	}
+	r.report.MachineDeploymentsUpdated = append(r.report.MachineDeploymentsUpdated, machineDeployment)
+}
+
+// verified records the verification results.
+func (r *runRecorder) verified(report *VerificationReport) {
+	if r == nil {
+		return
+	}
+	r.report.Verification = report
+}
+
+// conformance records a conformance run.
+func (r *runRecorder) conformance(run ConformanceRun) {
+	if r == nil {
+		return
+	}
+	r.report.Conformance = append(r.report.Conformance, run)
+}
+
+// health records the health windows sampled during the run.
+func (r *runRecorder) health(windows []HealthWindow) {
+	if r == nil {
+		return
+	}
+	r.report.HealthTimeline = windows
+}
+
+// nothingToDo records that the run found nothing to upgrade.
+func (r *runRecorder) nothingToDo() {
+	if r == nil {
+		return
+	}
+	r.report.NothingToDo = true
+	r.event("Nothing to do, already upgraded")
+}
+
+// configured records the effective configuration of the run.
+func (r *runRecorder) configured(config *EffectiveConfig) {
+	if r == nil {
+		return
+	}
+	r.report.Configuration = config
+}
+
+// done emits the outcome of the run, err being its error if it failed, to the event stream and closes it.
+func (r *runRecorder) done(err error) {
+	if r == nil {
+		return
+	}
+	r.events.finished(err, r.report.NothingToDo)
+}
+
+// finish returns the report with the given warnings, as of now.
+func (r *runRecorder) finish(warnings []Warning) RunReport {
+	if r == nil {
+		return RunReport{Warnings: warnings}
+	}
+	report := r.report
+	report.FinishedAt = r.now()
+	report.Warnings = warnings
+	return report
+}
+
+// versionRange formats the distinct versions as a single version or a "min - max" range.
+func versionRange(versions ...string) string {
+	set := sets.NewString()
+	for _, v := range versions {
+		if v != "" {
+			set.Insert(v)
+		}
+	}
+	list := set.List()
+	switch len(list) {
+	case 0:
+		return ""
+	case 1:
+		return list[0]
+	default:
+		return list[0] + " - " + list[len(list)-1]
+	}
+}
+
+// ReportFormat returns the format of the report file at path based on its extension.
+func ReportFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return reportFormatHTML, nil
+	case ".md", ".markdown":
+		return reportFormatMarkdown, nil
+	default:
+		return "", errors.Errorf("unsupported report file %q, the extension must be .html or .md", path)
+	}
+}
+
+// WriteReportFile writes report to path in the format given by its extension.
+func WriteReportFile(path string, report RunReport) error {
+	format, err := ReportFormat(path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "error creating report file %s", path)
+	}
+	defer f.Close()
+
+	if err := writeReport(f, format, report); err != nil {
+		return err
+	}
+	return errors.Wrapf(f.Close(), "error writing report file %s", path)
+}
+
+func writeReport(w io.Writer, format string, report RunReport) error {
+	var err error
+	switch format {
+	case reportFormatHTML:
+		err = htmlReportTemplate.Execute(w, report)
+	case reportFormatMarkdown:
+		err = markdownReportTemplate.Execute(w, report)
+	default:
+		err = errors.Errorf("unsupported report format %q", format)
+	}
+	return errors.Wrap(err, "error rendering report")
+}
+
+var reportFuncs = map[string]interface{}{
+	"timestamp": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+	"duration": func(start, end time.Time) string {
+		if start.IsZero() || end.IsZero() {
+			return ""
+		}
+		return end.Sub(start).Round(time.Second).String()
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.MarshalIndent(v, "", "  ")
+		return string(b), err
+	},
+	"status": func(passed bool) string {
+		if passed {
+			return "PASS"
+		}
+		return "FAIL"
+	},
+}
+
+const markdownReport = `# Upgrade report: {{.Cluster}}
+
+| | |
+|---|---|
+| Scope | {{.Scope}} |
+| Upgrade ID | {{.UpgradeID}} |
+| Result | {{if .Succeeded}}Succeeded{{else}}Failed{{with .Error}}: {{.}}{{end}}{{end}} |
+| Started | {{timestamp .StartedAt}} |
+| Finished | {{timestamp .FinishedAt}} ({{duration .StartedAt .FinishedAt}}) |
+| Version before | {{.VersionBefore}} |
+| Version after | {{.VersionAfter}} |
+
+## Timeline
+{{range .Timeline}}
+- {{timestamp .Time}} {{.Message}}
+{{- else}}
+No steps were recorded.
+{{- end}}
+{{with .HealthTimeline}}
+## Health timeline
+
+| From | To | Samples | etcd | API server |
+|---|---|---|---|---|
+{{- range .}}
+| {{timestamp .Start}} | {{timestamp .End}} | {{.Samples}} | {{.Etcd}} | {{.APIServer}} |
+{{- end}}
+{{end}}
+{{- with .MachinesReplaced}}
+## Machines replaced
+
+| Machine | Replacement |
+|---|---|
+{{- range .}}
+| {{.Machine}} | {{.Replacement}} |
+{{- end}}
+{{end}}
+{{- with .MachineDeploymentsUpdated}}
+## Machine deployments updated
+{{range .}}
+- {{.}}
+{{- end}}
+{{end}}
+## Warnings
+{{range .Warnings}}
+- [{{.Reason}}] {{with .Object}}{{.}}: {{end}}{{.Message}}
+{{- else}}
+None.
+{{- end}}
+{{with .Verification}}
+## Verification of version {{.Version}}
+{{range .Results}}
+- [{{status .Passed}}] {{.Name}}{{with .Message}}: {{.}}{{end}}
+{{- end}}
+{{end}}
+{{- range .Conformance}}
+## Conformance {{.Phase}} the upgrade: {{status .Passed}}
+
+{{.Runner}}, {{timestamp .StartedAt}} ({{duration .StartedAt .FinishedAt}})
+{{with .Summary}}
+` + "```" + `
+{{.}}
+` + "```" + `
+{{end}}
+{{- end}}
+{{- with .Configuration}}
+## Configuration
+
+` + "```json" + `
+{{json .}}
+` + "```" + `
+{{end}}`
+
+const htmlReport = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Upgrade report: {{.Cluster}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.PASS { color: #080; }
+.FAIL { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Upgrade report: {{.Cluster}}</h1>
+<table>
+<tr><th>Scope</th><td>{{.Scope}}</td></tr>
+<tr><th>Upgrade ID</th><td>{{.UpgradeID}}</td></tr>
+<tr><th>Result</th><td>{{if .Succeeded}}<span class="PASS">Succeeded</span>{{else}}<span class="FAIL">Failed</span>{{with .Error}}: {{.}}{{end}}{{end}}</td></tr>
+<tr><th>Started</th><td>{{timestamp .StartedAt}}</td></tr>
+<tr><th>Finished</th><td>{{timestamp .FinishedAt}} ({{duration .StartedAt .FinishedAt}})</td></tr>
+<tr><th>Version before</th><td>{{.VersionBefore}}</td></tr>
+<tr><th>Version after</th><td>{{.VersionAfter}}</td></tr>
+</table>
+<h2>Timeline</h2>
+{{if .Timeline}}<ul>
+{{- range .Timeline}}
+<li>{{timestamp .Time}} {{.Message}}</li>
+{{- end}}
+</ul>{{else}}<p>No steps were recorded.</p>{{end}}
+{{- with .HealthTimeline}}
+<h2>Health timeline</h2>
+<table>
+<tr><th>From</th><th>To</th><th>Samples</th><th>etcd</th><th>API server</th></tr>
+{{- range .}}
+<tr><td>{{timestamp .Start}}</td><td>{{timestamp .End}}</td><td>{{.Samples}}</td><td>{{.Etcd}}</td><td>{{.APIServer}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .MachinesReplaced}}
+<h2>Machines replaced</h2>
+<table>
+<tr><th>Machine</th><th>Replacement</th></tr>
+{{- range .}}
+<tr><td>{{.Machine}}</td><td>{{.Replacement}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .MachineDeploymentsUpdated}}
+<h2>Machine deployments updated</h2>
+<ul>
+{{- range .}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+<h2>Warnings</h2>
+{{if .Warnings}}<ul>
+{{- range .Warnings}}
+<li>[{{.Reason}}] {{with .Object}}{{.}}: {{end}}{{.Message}}</li>
+{{- end}}
+</ul>{{else}}<p>None.</p>{{end}}
+{{- with .Verification}}
+<h2>Verification of version {{.Version}}</h2>
+<ul>
+{{- range .Results}}
+<li><span class="{{status .Passed}}">[{{status .Passed}}]</span> {{.Name}}{{with .Message}}: {{.}}{{end}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- range .Conformance}}
+<h2>Conformance {{.Phase}} the upgrade: <span class="{{status .Passed}}">{{status .Passed}}</span></h2>
+<p>{{.Runner}}, {{timestamp .StartedAt}} ({{duration .StartedAt .FinishedAt}})</p>
+{{- with .Summary}}
+<pre>{{.}}</pre>
+{{- end}}
+{{- end}}
+{{- with .Configuration}}
+<h2>Configuration</h2>
+<pre>{{json .}}</pre>
+{{- end}}
+</body>
+</html>
+`
+
+var (
+	markdownReportTemplate = texttemplate.Must(texttemplate.New("report.md").Funcs(reportFuncs).Parse(markdownReport))
+	htmlReportTemplate     = htmltemplate.Must(htmltemplate.New("report.html").Funcs(reportFuncs).Parse(htmlReport))
+)
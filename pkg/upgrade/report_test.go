@@ -0,0 +1,95 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportFormat(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "report.html", expected: reportFormatHTML},
+		{path: "out/REPORT.HTM", expected: reportFormatHTML},
+		{path: "report.md", expected: reportFormatMarkdown},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			format, err := ReportFormat(tc.path)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, format)
+		})
+	}
+
+	_, err := ReportFormat("report.pdf")
+	assert.Error(t, err)
+}
+
+func TestRunRecorder(t *testing.T) {
+	now := time.Date(2019, 11, 5, 10, 0, 0, 0, time.UTC)
+	r := newRunRecorder("control-plane", "ns", "c", "123")
+	r.now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+
+	r.start()
+	r.versions(versionRange("1.15.3", "1.15.4"), "1.16.2")
+	r.replaced("a", "a-123")
+	r.verified(&VerificationReport{Version: "1.16.2", Results: []CheckResult{{Name: "node kubelets", Passed: true}}})
+	report := r.finish([]Warning{{Reason: WarningEtcdMemberAbsent, Object: "ns/a", Message: "no etcd member"}})
+
+	assert.Equal(t, "ns/c", report.Cluster)
+	assert.Equal(t, "1.15.3 - 1.15.4", report.VersionBefore)
+	assert.Equal(t, []MachineReplacement{{Machine: "a", Replacement: "a-123"}}, report.MachinesReplaced)
+	assert.Equal(t, "Replaced machine a with a-123", report.Timeline[0].Message)
+	assert.Equal(t, 2*time.Minute, report.FinishedAt.Sub(report.StartedAt))
+	assert.Len(t, report.Warnings, 1)
+
+	var nilRecorder *runRecorder
+	nilRecorder.event("ignored")
+	assert.Empty(t, nilRecorder.finish(nil).Timeline)
+}
+
+func TestWriteReport(t *testing.T) {
+	started := time.Date(2019, 11, 5, 10, 0, 0, 0, time.UTC)
+	report := RunReport{
+		Scope:            "control-plane",
+		Cluster:          "ns/c",
+		UpgradeID:        "123",
+		StartedAt:        started,
+		FinishedAt:       started.Add(25 * time.Minute),
+		VersionBefore:    "1.15.4",
+		VersionAfter:     "1.16.2",
+		Error:            "node <b> not ready",
+		Timeline:         []TimelineEvent{{Time: started, Message: "Upgrade started"}},
+		MachinesReplaced: []MachineReplacement{{Machine: "a", Replacement: "a-123"}},
+		HealthTimeline:   []HealthWindow{{Start: started, End: started.Add(time.Minute), Etcd: "healthy, 3 endpoints", APIServer: "ready", Samples: 7}},
+		Verification:     &VerificationReport{Version: "1.16.2", Results: []CheckResult{{Name: "etcd health", Message: "unhealthy"}}},
+	}
+
+	var md strings.Builder
+	require.NoError(t, writeReport(&md, reportFormatMarkdown, report))
+	assert.Contains(t, md.String(), "| Result | Failed: node <b> not ready |")
+	assert.Contains(t, md.String(), "| Finished | 2019-11-05T10:25:00Z (25m0s) |")
+	assert.Contains(t, md.String(), "- 2019-11-05T10:00:00Z Upgrade started")
+	assert.Contains(t, md.String(), "| a | a-123 |")
+	assert.Contains(t, md.String(), "| 2019-11-05T10:00:00Z | 2019-11-05T10:01:00Z | 7 | healthy, 3 endpoints | ready |")
+	assert.Contains(t, md.String(), "- [FAIL] etcd health: unhealthy")
+
+	var html strings.Builder
+	require.NoError(t, writeReport(&html, reportFormatHTML, report))
+	assert.Contains(t, html.String(), "node &lt;b&gt; not ready")
+	assert.Contains(t, html.String(), "<tr><td>a</td><td>a-123</td></tr>")
+	assert.Contains(t, html.String(), "<h2>Health timeline</h2>")
+	assert.NotContains(t, html.String(), "Machine deployments updated")
+}
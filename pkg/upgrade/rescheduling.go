@@ -0,0 +1,211 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// defaultReschedulingTimeout is how long the pods evicted from an old control plane node have to be ready elsewhere
+// by default.
+const defaultReschedulingTimeout = 10 * time.Minute
+
+// parseReschedulingTimeout parses the rescheduling timeout, defaulting to defaultReschedulingTimeout.
+func parseReschedulingTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return defaultReschedulingTimeout, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error parsing rescheduling timeout %q", timeout)
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("invalid rescheduling timeout %q: must be positive", timeout)
+	}
+	return d, nil
+}
+
+// rescheduledController is a controller with pods on a node being emptied, and the number of its pods that must be
+// ready on other nodes once they are rescheduled.
+type rescheduledController struct {
+	name  string
+	ready int
+}
+
+// podController returns the owner reference of the controller of pod, or nil if it has none.
+func podController(pod *v1.Pod) *metav1.OwnerReference {
+	for i := range pod.OwnerReferences {
+		if ref := &pod.OwnerReferences[i]; ref.Controller != nil && *ref.Controller {
+			return ref
+		}
+	}
+	return nil
+}
+
+// readyElsewhere returns true if pod runs on another node than nodeName, is not being deleted, and is ready.
+func readyElsewhere(pod *v1.Pod, nodeName string) bool {
+	return pod.Spec.NodeName != "" && pod.Spec.NodeName != nodeName && pod.DeletionTimestamp == nil && missingPodConditions(pod).Len() == 0
+}
+
+// podsToReschedule returns the pods of pods running on the node nodeName that are evicted before its machine is
+// deleted, leaving out DaemonSet, mirror and finished pods. It also returns, by UID, the controllers of the evicted
+// pods, with the number of their pods ready on other nodes once the evicted ones are rescheduled, and the evicted pods
+// without a controller, which nothing reschedules.
+func podsToReschedule(pods []v1.Pod, nodeName string) (evicted []v1.Pod, controllers map[types.UID]*rescheduledController, unowned []string) {
+	controllers = make(map[types.UID]*rescheduledController)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.NodeName != nodeName || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+			continue
+		}
+		ref := podController(pod)
+		if ref != nil && ref.Kind == "DaemonSet" {
+			continue
+		}
+
+		evicted = append(evicted, *pod)
+		if ref == nil {
+			unowned = append(unowned, pod.Namespace+"/"+pod.Name)
+			continue
+		}
+		if c, ok := controllers[ref.UID]; ok {
+			c.ready++
+			continue
+		}
+		controllers[ref.UID] = &rescheduledController{name: fmt.Sprintf("%s %s/%s", ref.Kind, pod.Namespace, ref.Name), ready: 1}
+	}
+
+	// Pods already ready elsewhere must stay ready on top of the rescheduled ones
+	for i := range pods {
+		pod := &pods[i]
+		if ref := podController(pod); ref != nil && controllers[ref.UID] != nil && readyElsewhere(pod, nodeName) {
+			controllers[ref.UID].ready++
+		}
+	}
+	return evicted, controllers, unowned
+}
+
+// unrescheduledControllers returns the controllers whose pods, as listed in pods, are not yet all ready on other nodes
+// than nodeName.
+func unrescheduledControllers(pods []v1.Pod, nodeName string, controllers map[types.UID]*rescheduledController) []string {
+	ready := make(map[types.UID]int)
+	for i := range pods {
+		pod := &pods[i]
+		if ref := podController(pod); ref != nil && readyElsewhere(pod, nodeName) {
+			ready[ref.UID]++
+		}
+	}
+
+	var problems []string
+	for uid, c := range controllers {
+		if ready[uid] < c.ready {
+			problems = append(problems, fmt.Sprintf("%s has %d of %d pods ready on other nodes", c.name, ready[uid], c.ready))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// rescheduleWorkloads cordons node and evicts its pods, then waits up to the rescheduling timeout for the controllers
+// of the evicted pods to have them ready on other nodes. Evictions refused by pod disruption budgets are retried.
+func (u *ControlPlaneUpgrader) rescheduleWorkloads(node *v1.Node) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), u.reschedulingTimeout)
+	defer cancel()
+	log := u.log.WithValues("node", node.Name)
+
+	if _, err := u.cordonNode(node.Name); err != nil {
+		return err
+	}
+
+	list, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error listing pods")
+	}
+	evicted, controllers, unowned := podsToReschedule(list.Items, node.Name)
+	for _, name := range unowned {
+		u.warnings.add(WarningUnreschedulablePod, name, "pod %s has no controller to reschedule it once evicted from node %s", name, node.Name)
+	}
+
+	for i := range evicted {
+		pod := &evicted[i]
+		err := wait.PollImmediateUntil(5*time.Second, func() (bool, error) {
+			err := u.targetKubernetesClient.PolicyV1beta1().Evictions(pod.Namespace).Evict(&policyv1beta1.Eviction{
+				ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+			})
+			switch {
+			case err == nil, apierrors.IsNotFound(err):
+				return true, nil
+			case apierrors.IsTooManyRequests(err):
+				log.Info("Eviction refused by a pod disruption budget, will try again", "pod", pod.Namespace+"/"+pod.Name)
+				return false, nil
+			default:
+				return false, errors.Wrapf(err, "error evicting pod %s/%s", pod.Namespace, pod.Name)
+			}
+		}, ctx.Done())
+		if err == wait.ErrWaitTimeout {
+			return errors.Errorf("timed out evicting pod %s/%s from node %s", pod.Namespace, pod.Name, node.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Info("Evicted pods", "count", len(evicted))
+
+	var problems []string
+	err = wait.PollImmediateUntil(15*time.Second, func() (bool, error) {
+		pods, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+		if err != nil {
+			log.Error(err, "Error listing pods, will try again")
+			return false, nil
+		}
+		problems = unrescheduledControllers(pods.Items, node.Name, controllers)
+		for _, problem := range problems {
+			log.Info("Waiting for evicted pods to be rescheduled", "controller", problem)
+		}
+		return len(problems) == 0, nil
+	}, ctx.Done())
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("refusing to delete the machine of node %s, evicted pods were not ready on other nodes within %s: %s",
+			node.Name, u.reschedulingTimeout, strings.Join(problems, "; "))
+	}
+	if err != nil {
+		return err
+	}
+
+	u.record.event("Rescheduled %d pods evicted from node %s", len(evicted), node.Name)
+	return nil
+}
+
+// cordonNode marks the node nodeName unschedulable. It returns false if the node already was.
+func (u *ControlPlaneUpgrader) cordonNode(nodeName string) (bool, error) {
+	node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, errors.Wrapf(err, "error getting node %s", nodeName)
+	}
+	if node.Spec.Unschedulable {
+		return false, nil
+	}
+
+	u.log.Info("Cordoning node", "node", nodeName)
+	node.Spec.Unschedulable = true
+	if _, err := u.targetKubernetesClient.CoreV1().Nodes().Update(node); err != nil {
+		return false, errors.Wrapf(err, "error cordoning node %s", nodeName)
+	}
+	return true, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func reschedulingPod(name, node, ownerKind string, ready bool) v1.Pod {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Spec:       v1.PodSpec{NodeName: node},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+	if ownerKind != "" {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{{Kind: ownerKind, Name: ownerKind + "-owner", UID: types.UID(ownerKind), Controller: &controller}}
+	}
+	if ready {
+		for _, condition := range requiredPodConditions.List() {
+			pod.Status.Conditions = append(pod.Status.Conditions, v1.PodCondition{Type: v1.PodConditionType(condition), Status: v1.ConditionTrue})
+		}
+	}
+	return pod
+}
+
+func TestParseReschedulingTimeout(t *testing.T) {
+	d, err := parseReschedulingTimeout("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultReschedulingTimeout, d)
+
+	d, err = parseReschedulingTimeout("15m")
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, d)
+
+	_, err = parseReschedulingTimeout("0s")
+	assert.Error(t, err)
+	_, err = parseReschedulingTimeout("soon")
+	assert.Error(t, err)
+}
+
+func TestPodsToReschedule(t *testing.T) {
+	mirror := reschedulingPod("etcd", "old", "", true)
+	mirror.Annotations = map[string]string{mirrorPodAnnotation: "x"}
+	finished := reschedulingPod("job", "old", "Job", false)
+	finished.Status.Phase = v1.PodSucceeded
+
+	pods := []v1.Pod{
+		reschedulingPod("web-1", "old", "ReplicaSet", true),
+		reschedulingPod("web-2", "old", "ReplicaSet", true),
+		reschedulingPod("web-3", "other", "ReplicaSet", true),
+		reschedulingPod("web-4", "other", "ReplicaSet", false),
+		reschedulingPod("proxy", "old", "DaemonSet", true),
+		reschedulingPod("debug", "old", "", true),
+		mirror,
+		finished,
+	}
+
+	evicted, controllers, unowned := podsToReschedule(pods, "old")
+	var names []string
+	for _, pod := range evicted {
+		names = append(names, pod.Name)
+	}
+	assert.Equal(t, []string{"web-1", "web-2", "debug"}, names)
+	assert.Equal(t, []string{"ns/debug"}, unowned)
+	require.Len(t, controllers, 1)
+	assert.Equal(t, &rescheduledController{name: "ReplicaSet ns/ReplicaSet-owner", ready: 3}, controllers["ReplicaSet"])
+
+	// The evicted pods are still on the old node, and web-4 is not ready yet
+	assert.Equal(t, []string{"ReplicaSet ns/ReplicaSet-owner has 1 of 3 pods ready on other nodes"},
+		unrescheduledControllers(pods, "old", controllers))
+
+	terminating := reschedulingPod("web-1", "other", "ReplicaSet", true)
+	terminating.DeletionTimestamp = &metav1.Time{}
+	rescheduled := []v1.Pod{
+		terminating,
+		reschedulingPod("web-3", "other", "ReplicaSet", true),
+		reschedulingPod("web-4", "other", "ReplicaSet", true),
+		reschedulingPod("web-5", "another", "ReplicaSet", true),
+	}
+	assert.Empty(t, unrescheduledControllers(rescheduled, "old", controllers))
+	assert.NotEmpty(t, unrescheduledControllers(rescheduled[:3], "old", controllers))
+}
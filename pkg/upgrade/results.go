@@ -0,0 +1,285 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+)
+
+// Artifacts uploaded for each run.
+const (
+	// resultsReport is the report of the run, as JSON.
+	resultsReport = "report.json"
+	// resultsAuditLog is the progress events of the run, in the format of the event stream.
+	resultsAuditLog = "audit.jsonl"
+	// resultsDiagnostics is a bundle of the report in every format and of the audit log.
+	resultsDiagnostics = "diagnostics.tar.gz"
+)
+
+// resultsTokenEnv is the environment variable holding the bearer token of the HTTP results endpoint, so that it is
+// never written to a config file.
+const resultsTokenEnv = "UPGRADE_RESULTS_TOKEN"
+
+// resultsSink stores the artifacts of runs.
+type resultsSink interface {
+	put(name, contentType string, data []byte) error
+}
+
+// resultsArtifact is a file uploaded to a results sink.
+type resultsArtifact struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// newResultsSink returns the sink configured in config, or nil if none is. At most one sink can be configured.
+func newResultsSink(config ResultsConfig) (resultsSink, error) {
+	var sinks []resultsSink
+	if config.S3 != "" {
+		if !strings.HasPrefix(config.S3, "s3://") {
+			return nil, errors.Errorf("invalid S3 results URL %q, it must start with s3://", config.S3)
+		}
+		sinks = append(sinks, commandResultsSink{command: "aws", url: config.S3, args: s3CopyArgs})
+	}
+	if config.GCS != "" {
+		if !strings.HasPrefix(config.GCS, "gs://") {
+			return nil, errors.Errorf("invalid GCS results URL %q, it must start with gs://", config.GCS)
+		}
+		sinks = append(sinks, commandResultsSink{command: "gsutil", url: config.GCS, args: gcsCopyArgs})
+	}
+	if config.HTTP != "" {
+		if !strings.HasPrefix(config.HTTP, "http://") && !strings.HasPrefix(config.HTTP, "https://") {
+			return nil, errors.Errorf("invalid HTTP results URL %q, it must start with http:// or https://", config.HTTP)
+		}
+		sinks = append(sinks, newHTTPResultsSink(config.HTTP))
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sinks[0], nil
+	default:
+		return nil, errors.New("only one of the S3, GCS, or HTTP results destinations can be set")
+	}
+}
+
+// CheckResultsConfig validates config, so that a run does not fail to upload its results only once it is over.
+func CheckResultsConfig(config ResultsConfig) error {
+	_, err := newResultsSink(config)
+	return err
+}
+
+// commandResultsSink copies artifacts, read from its standard input, with the CLI of a cloud storage service, which
+// finds its credentials as usual, for example from the environment or the workload identity of the pod.
+type commandResultsSink struct {
+	command string
+	url     string
+	args    func(url, contentType string) []string
+}
+
+func (s commandResultsSink) put(name, contentType string, data []byte) error {
+	url := strings.TrimRight(s.url, "/") + "/" + name
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.command, s.args(url, contentType)...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "error uploading %s with %s: %s", url, s.command, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func s3CopyArgs(url, contentType string) []string {
+	return []string{"s3", "cp", "--only-show-errors", "--content-type", contentType, "-", url}
+}
+
+func gcsCopyArgs(url, contentType string) []string {
+	return []string{"-q", "-h", "Content-Type:" + contentType, "cp", "-", url}
+}
+
+// httpResultsSink POSTs each artifact to a URL under its endpoint.
+type httpResultsSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newHTTPResultsSink(url string) httpResultsSink {
+	return httpResultsSink{
+		url:    strings.TrimRight(url, "/"),
+		token:  os.Getenv(resultsTokenEnv),
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (s httpResultsSink) put(name, contentType string, data []byte) error {
+	url := s.url + "/" + name
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error uploading %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("error uploading %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// UploadRunResults uploads the report, audit log and diagnostics bundle of a run to the sink configured in config,
+// under <namespace>/<name>/<upgrade ID>/<scope>/. It does nothing if no sink is configured.
+func UploadRunResults(log logr.Logger, config ResultsConfig, report RunReport) error {
+	sink, err := newResultsSink(config)
+	if err != nil || sink == nil {
+		return err
+	}
+
+	artifacts, err := runArtifacts(report)
+	if err != nil {
+		return err
+	}
+	prefix := path.Join(report.Cluster, report.UpgradeID, report.Scope)
+	for _, a := range artifacts {
+		name := prefix + "/" + a.name
+		if err := sink.put(name, a.contentType, a.data); err != nil {
+			return err
+		}
+		log.Info("Uploaded run results", "name", name)
+	}
+	return nil
+}
+
+// UploadFleetResults uploads the report of a fleet upgrade to the sink configured in config, as
+// fleet/<time>/report.json. It does nothing if no sink is configured.
+func UploadFleetResults(log logr.Logger, config ResultsConfig, report *FleetReport) error {
+	sink, err := newResultsSink(config)
+	if err != nil || sink == nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	name := path.Join("fleet", time.Now().UTC().Format("20060102T150405Z"), resultsReport)
+	if err := sink.put(name, "application/json", data); err != nil {
+		return err
+	}
+	log.Info("Uploaded fleet results", "name", name)
+	return nil
+}
+
+// runArtifacts returns the artifacts of the run of report.
+func runArtifacts(report RunReport) ([]resultsArtifact, error) {
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	auditLog, err := runAuditLog(report)
+	if err != nil {
+		return nil, err
+	}
+	var markdown, html bytes.Buffer
+	if err := writeReport(&markdown, reportFormatMarkdown, report); err != nil {
+		return nil, err
+	}
+	if err := writeReport(&html, reportFormatHTML, report); err != nil {
+		return nil, err
+	}
+
+	bundle, err := tarGz(report.FinishedAt, []resultsArtifact{
+		{name: resultsReport, data: reportJSON},
+		{name: "report.md", data: markdown.Bytes()},
+		{name: "report.html", data: html.Bytes()},
+		{name: resultsAuditLog, data: auditLog},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []resultsArtifact{
+		{name: resultsReport, contentType: "application/json", data: reportJSON},
+		{name: resultsAuditLog, contentType: "application/x-ndjson", data: auditLog},
+		{name: resultsDiagnostics, contentType: "application/gzip", data: bundle},
+	}, nil
+}
+
+// runAuditLog returns the progress events of the run of report, one JSON object per line: its steps, its warnings,
+// stamped with the end of the run, and its outcome.
+func runAuditLog(report RunReport) ([]byte, error) {
+	var events []ProgressEvent
+	for _, step := range report.Timeline {
+		events = append(events, ProgressEvent{Time: step.Time, Type: EventStep, Message: step.Message})
+	}
+	for i := range report.Warnings {
+		w := report.Warnings[i]
+		events = append(events, ProgressEvent{Time: report.FinishedAt, Type: EventWarning, Message: w.Message, Warning: &w})
+	}
+	succeeded := report.Succeeded
+	events = append(events, ProgressEvent{
+		Time:        report.FinishedAt,
+		Type:        EventFinished,
+		Succeeded:   &succeeded,
+		Error:       report.Error,
+		NothingToDo: report.NothingToDo,
+	})
+
+	var buf bytes.Buffer
+	for _, event := range events {
+		event.Scope = report.Scope
+		event.Cluster = report.Cluster
+		event.UpgradeID = report.UpgradeID
+		line, err := json.Marshal(event)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return buf.Bytes(), nil
+}
+
+// tarGz returns a gzipped tarball of files, modified at modTime.
+func tarGz(modTime time.Time, files []resultsArtifact) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		header := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: modTime}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, errors.Wrap(err, "error writing the diagnostics bundle")
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, errors.Wrap(err, "error writing the diagnostics bundle")
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "error writing the diagnostics bundle")
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errors.Wrap(err, "error writing the diagnostics bundle")
+	}
+	return buf.Bytes(), nil
+}
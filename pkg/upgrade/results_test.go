@@ -0,0 +1,153 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewResultsSink(t *testing.T) {
+	sink, err := newResultsSink(ResultsConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, sink)
+
+	sink, err = newResultsSink(ResultsConfig{GCS: "gs://bucket/prefix"})
+	require.NoError(t, err)
+	assert.Equal(t, "gsutil", sink.(commandResultsSink).command)
+
+	for _, config := range []ResultsConfig{
+		{S3: "bucket/prefix"},
+		{GCS: "s3://bucket"},
+		{HTTP: "example.com"},
+		{S3: "s3://bucket", HTTP: "https://example.com"},
+	} {
+		assert.Error(t, CheckResultsConfig(config), "%+v", config)
+	}
+}
+
+func TestResultsCopyArgs(t *testing.T) {
+	assert.Equal(t,
+		[]string{"s3", "cp", "--only-show-errors", "--content-type", "application/json", "-", "s3://bucket/ns/c/report.json"},
+		s3CopyArgs("s3://bucket/ns/c/report.json", "application/json"),
+	)
+	assert.Equal(t,
+		[]string{"-q", "-h", "Content-Type:application/json", "cp", "-", "gs://bucket/ns/c/report.json"},
+		gcsCopyArgs("gs://bucket/ns/c/report.json", "application/json"),
+	)
+}
+
+func testRunReport() RunReport {
+	started := time.Date(2019, 11, 4, 10, 0, 0, 0, time.UTC)
+	return RunReport{
+		Scope:      controlPlaneScope,
+		Cluster:    "ns/c",
+		UpgradeID:  "1572861600",
+		StartedAt:  started,
+		FinishedAt: started.Add(time.Hour),
+		Error:      "machine stuck",
+		Timeline:   []TimelineEvent{{Time: started, Message: "Upgrading the control plane"}},
+		Warnings:   []Warning{{Reason: WarningMachineWithoutProviderID, Object: "ns/m", Message: "machine ns/m has no provider ID"}},
+	}
+}
+
+func TestRunAuditLog(t *testing.T) {
+	report := testRunReport()
+	auditLog, err := runAuditLog(report)
+	require.NoError(t, err)
+
+	var events []ProgressEvent
+	scanner := bufio.NewScanner(bytes.NewReader(auditLog))
+	for scanner.Scan() {
+		var event ProgressEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.Len(t, events, 3)
+	assert.Equal(t, EventStep, events[0].Type)
+	assert.Equal(t, "Upgrading the control plane", events[0].Message)
+	assert.Equal(t, EventWarning, events[1].Type)
+	assert.Equal(t, report.FinishedAt, events[1].Time)
+	assert.Equal(t, EventFinished, events[2].Type)
+	assert.Equal(t, "machine stuck", events[2].Error)
+	require.NotNil(t, events[2].Succeeded)
+	assert.False(t, *events[2].Succeeded)
+	for _, event := range events {
+		assert.Equal(t, "ns/c", event.Cluster)
+		assert.Equal(t, "1572861600", event.UpgradeID)
+	}
+}
+
+func TestUploadRunResults(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		uploaded = map[string][]byte{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		uploaded[r.URL.Path] = body
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	previous, set := os.LookupEnv(resultsTokenEnv)
+	os.Setenv(resultsTokenEnv, "token")
+	defer func() {
+		if set {
+			os.Setenv(resultsTokenEnv, previous)
+		} else {
+			os.Unsetenv(resultsTokenEnv)
+		}
+	}()
+
+	config := ResultsConfig{HTTP: server.URL + "/runs/"}
+	require.NoError(t, UploadRunResults(logrtesting.NullLogger{}, config, testRunReport()))
+
+	prefix := "/runs/ns/c/1572861600/control-plane/"
+	require.Contains(t, uploaded, prefix+resultsReport)
+	require.Contains(t, uploaded, prefix+resultsAuditLog)
+	require.Contains(t, uploaded, prefix+resultsDiagnostics)
+
+	var report RunReport
+	require.NoError(t, json.Unmarshal(uploaded[prefix+resultsReport], &report))
+	assert.Equal(t, "machine stuck", report.Error)
+
+	gz, err := gzip.NewReader(bytes.NewReader(uploaded[prefix+resultsDiagnostics]))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{resultsReport, "report.md", "report.html", resultsAuditLog}, names)
+
+	os.Setenv(resultsTokenEnv, "wrong")
+	assert.Error(t, UploadRunResults(logrtesting.NullLogger{}, config, testRunReport()))
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// Phases of a control plane upgrade, in order, for Config.ResumeFrom.
+const (
+	// PhasePrechecks checks the cluster can be upgraded.
+	PhasePrechecks = "prechecks"
+	// PhaseKubeletConfig creates the kubelet configmap and RBAC of the desired version.
+	PhaseKubeletConfig = "kubelet-config"
+	// PhaseKubeadmConfig sets the desired version in the kubeadm-config configmap.
+	PhaseKubeadmConfig = "kubeadm-config"
+	// PhaseMachines replaces the control plane machines.
+	PhaseMachines = "machines"
+	// PhaseVerify verifies the control plane is at the desired version.
+	PhaseVerify = "verify"
+)
+
+var controlPlanePhases = []string{PhasePrechecks, PhaseKubeletConfig, PhaseKubeadmConfig, PhaseMachines, PhaseVerify}
+
+// parseResumeFrom validates phase, defaulting it to PhasePrechecks, the first phase.
+func parseResumeFrom(phase string) (string, error) {
+	if phase == "" {
+		return PhasePrechecks, nil
+	}
+	if phaseIndex(phase) < 0 {
+		return "", errors.Errorf("invalid phase %q: must be one of %s", phase, strings.Join(controlPlanePhases, ", "))
+	}
+	return phase, nil
+}
+
+func phaseIndex(phase string) int {
+	for i, p := range controlPlanePhases {
+		if p == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+// skipsPhase returns true if an upgrade resumed from resumeFrom skips phase.
+func skipsPhase(resumeFrom, phase string) bool {
+	return phaseIndex(phase) < phaseIndex(resumeFrom)
+}
+
+// machinesNotAtVersion returns the names of the machines whose version is not version.
+func machinesNotAtVersion(machines []*clusterv1.Machine, version semver.Version) []string {
+	var names []string
+	for _, m := range machines {
+		if m.Spec.Version == nil || !versionMatches(*m.Spec.Version, version) {
+			names = append(names, fmt.Sprintf("%s/%s", m.Namespace, m.Name))
+		}
+	}
+	return names
+}
+
+// checkResumePrerequisites checks the phases skipped by resuming the upgrade of machines, whose oldest version is
+// min, have been completed.
+func (u *ControlPlaneUpgrader) checkResumePrerequisites(machines []*clusterv1.Machine, min semver.Version) error {
+	v := u.verifier()
+
+	var problems []string
+	if skipsPhase(u.resumeFrom, PhaseKubeletConfig) && isMinorVersionUpgrade(min, u.desiredVersion) {
+		p, err := v.checkKubeletConfig()
+		if err != nil {
+			return err
+		}
+		problems = append(problems, p...)
+	}
+	if skipsPhase(u.resumeFrom, PhaseKubeadmConfig) {
+		p, err := v.checkKubeadmConfig()
+		if err != nil {
+			return err
+		}
+		problems = append(problems, p...)
+	}
+	if skipsPhase(u.resumeFrom, PhaseMachines) {
+		for _, name := range machinesNotAtVersion(machines, u.desiredVersion) {
+			problems = append(problems, fmt.Sprintf("machine %s is not at %s", name, u.desiredVersion))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("unable to resume the upgrade from the %s phase, as earlier phases are not complete: %s", u.resumeFrom, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blang/semver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestParseResumeFrom(t *testing.T) {
+	got, err := parseResumeFrom("")
+	if err != nil || got != PhasePrechecks {
+		t.Errorf("parseResumeFrom(\"\") = %q, %v, want %q", got, err, PhasePrechecks)
+	}
+	for _, phase := range controlPlanePhases {
+		if got, err := parseResumeFrom(phase); err != nil || got != phase {
+			t.Errorf("parseResumeFrom(%q) = %q, %v", phase, got, err)
+		}
+	}
+	if _, err := parseResumeFrom("nodes"); err == nil {
+		t.Error("expected an error for an unknown phase")
+	}
+}
+
+func TestSkipsPhase(t *testing.T) {
+	testcases := []struct {
+		resumeFrom string
+		phase      string
+		want       bool
+	}{
+		{resumeFrom: PhasePrechecks, phase: PhasePrechecks, want: false},
+		{resumeFrom: PhaseMachines, phase: PhasePrechecks, want: true},
+		{resumeFrom: PhaseMachines, phase: PhaseKubeadmConfig, want: true},
+		{resumeFrom: PhaseMachines, phase: PhaseMachines, want: false},
+		{resumeFrom: PhaseKubeletConfig, phase: PhaseVerify, want: false},
+	}
+
+	for _, tc := range testcases {
+		if got := skipsPhase(tc.resumeFrom, tc.phase); got != tc.want {
+			t.Errorf("skipsPhase(%q, %q) = %v, want %v", tc.resumeFrom, tc.phase, got, tc.want)
+		}
+	}
+}
+
+func TestMachinesNotAtVersion(t *testing.T) {
+	machine := func(name string, version *string) *clusterv1.Machine {
+		return &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Spec:       clusterv1.MachineSpec{Version: version},
+		}
+	}
+	upgraded, old := "v1.16.3", "v1.15.3"
+	machines := []*clusterv1.Machine{machine("a", &upgraded), machine("b", &old), machine("c", nil)}
+
+	got := machinesNotAtVersion(machines, semver.MustParse("1.16.3"))
+	if want := []string{"ns/b", "ns/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("machinesNotAtVersion() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// controllerPodSelector matches the controller manager pods of Cluster API and its providers.
+const controllerPodSelector = "control-plane=controller-manager"
+
+// isSelfHosted returns true if the management cluster is the target cluster, by comparing the UIDs of their
+// kube-system namespaces.
+func (u *ControlPlaneUpgrader) isSelfHosted() (bool, error) {
+	managementNamespace := &v1.Namespace{}
+	if err := u.managementClusterClient.Get(context.TODO(), ctrlclient.ObjectKey{Name: "kube-system"}, managementNamespace); err != nil {
+		return false, errors.Wrap(err, "error getting kube-system namespace from management cluster")
+	}
+
+	targetNamespace, err := u.targetKubernetesClient.CoreV1().Namespaces().Get("kube-system", metav1.GetOptions{})
+	if err != nil {
+		return false, errors.Wrap(err, "error getting kube-system namespace from target cluster")
+	}
+
+	return managementNamespace.UID == targetNamespace.UID, nil
+}
+
+// controllerNodes returns the names of the nodes running Cluster API controller pods.
+func (u *ControlPlaneUpgrader) controllerNodes() (sets.String, error) {
+	pods, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: controllerPodSelector})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing controller pods")
+	}
+
+	nodes := sets.NewString()
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != "" {
+			nodes.Insert(pod.Spec.NodeName)
+		}
+	}
+	return nodes, nil
+}
+
+// orderMachinesForSelfHosted returns machines with the ones whose nodes run controller pods last, so the controllers
+// keep running for as long as possible.
+func orderMachinesForSelfHosted(machines []*clusterv1.Machine, controllerNodes sets.String) []*clusterv1.Machine {
+	hostsControllers := func(m *clusterv1.Machine) bool {
+		return m.Status.NodeRef != nil && controllerNodes.Has(m.Status.NodeRef.Name)
+	}
+
+	ordered := make([]*clusterv1.Machine, len(machines))
+	copy(ordered, machines)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !hostsControllers(ordered[i]) && hostsControllers(ordered[j])
+	})
+	return ordered
+}
+
+// waitForControllers waits until all controller pods are ready and none of them run on oldNodeName.
+func (u *ControlPlaneUpgrader) waitForControllers(oldNodeName string, timeout time.Duration) error {
+	u.log.Info("Waiting for controllers to be rescheduled", "old-node", oldNodeName)
+
+	err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+		pods, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: controllerPodSelector})
+		if err != nil {
+			u.log.Error(err, "Error listing controller pods, will try again")
+			return false, nil
+		}
+		if len(pods.Items) == 0 {
+			return false, nil
+		}
+
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Spec.NodeName == oldNodeName || missingPodConditions(pod).Len() > 0 {
+				u.log.Info("Controller pod is not ready yet", "namespace", pod.Namespace, "pod", pod.Name, "node", pod.Spec.NodeName)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "timed out waiting for controllers to be rescheduled")
+	}
+
+	return nil
+}
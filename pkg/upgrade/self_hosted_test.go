@@ -0,0 +1,41 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestOrderMachinesForSelfHosted(t *testing.T) {
+	machine := func(name, node string) *clusterv1.Machine {
+		m := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if node != "" {
+			m.Status.NodeRef = &corev1.ObjectReference{Name: node}
+		}
+		return m
+	}
+
+	machines := []*clusterv1.Machine{
+		machine("a", "node-a"),
+		machine("b", "node-b"),
+		machine("c", ""),
+		machine("d", "node-d"),
+	}
+
+	ordered := orderMachinesForSelfHosted(machines, sets.NewString("node-a", "node-d"))
+
+	var names []string
+	for _, m := range ordered {
+		names = append(names, m.Name)
+	}
+	assert.Equal(t, []string{"b", "c", "a", "d"}, names)
+	assert.Equal(t, "a", machines[0].Name, "input must not be reordered")
+}
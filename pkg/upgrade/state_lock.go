@@ -0,0 +1,266 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+)
+
+// stateLockObject is the name of the lock object of a cluster, under <namespace>/<name>/ of the lock URL.
+const stateLockObject = "upgrade.lock"
+
+// stateLockHolder is the content of a lock object, describing the run holding it.
+type stateLockHolder struct {
+	UpgradeID  string    `json:"upgradeID"`
+	Scope      string    `json:"scope"`
+	Host       string    `json:"host,omitempty"`
+	User       string    `json:"user,omitempty"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+func (h stateLockHolder) String() string {
+	who := h.Host
+	if h.User != "" {
+		who = h.User + "@" + h.Host
+	}
+	return fmt.Sprintf("the %s upgrade %s run by %s since %s", h.Scope, h.UpgradeID, who, h.AcquiredAt.Format(time.RFC3339))
+}
+
+// lockStore stores lock objects.
+type lockStore interface {
+	// create creates the object name unless it exists, returning false if it does.
+	create(name string, data []byte) (bool, error)
+	// read returns the content of the object name.
+	read(name string) ([]byte, error)
+	// put creates or replaces the object name.
+	put(name string, data []byte) error
+	// remove deletes the object name.
+	remove(name string) error
+}
+
+// stateLock is a lock object in object storage held for the whole run, so that runs on the same cluster from
+// different machines do not overlap, even where the management cluster does not let the tool coordinate through it.
+type stateLock struct {
+	log    logr.Logger
+	store  lockStore
+	name   string
+	holder stateLockHolder
+	held   bool
+}
+
+// newStateLock returns the lock of the cluster namespace/name configured in config, held by the upgrade upgradeID of
+// scope, or nil if none is configured. At most one lock destination can be set.
+func newStateLock(log logr.Logger, config StateLockConfig, namespace, name, upgradeID, scope string) (*stateLock, error) {
+	var store lockStore
+	var url string
+	switch {
+	case config.S3 != "" && config.GCS != "":
+		return nil, errors.New("only one of the S3 or GCS state lock destinations can be set")
+	case config.S3 != "":
+		if !strings.HasPrefix(config.S3, "s3://") {
+			return nil, errors.Errorf("invalid S3 state lock URL %q, it must start with s3://", config.S3)
+		}
+		if _, err := exec.LookPath("aws"); err != nil {
+			return nil, errors.Wrap(err, "the aws CLI is required for an S3 state lock")
+		}
+		store, url = s3LockStore{}, config.S3
+	case config.GCS != "":
+		if !strings.HasPrefix(config.GCS, "gs://") {
+			return nil, errors.Errorf("invalid GCS state lock URL %q, it must start with gs://", config.GCS)
+		}
+		if _, err := exec.LookPath("gsutil"); err != nil {
+			return nil, errors.Wrap(err, "gsutil is required for a GCS state lock")
+		}
+		store, url = gcsLockStore{}, config.GCS
+	default:
+		return nil, nil
+	}
+
+	host, _ := os.Hostname()
+	return &stateLock{
+		log:   log,
+		store: store,
+		name:  strings.TrimRight(url, "/") + "/" + path.Join(namespace, name, stateLockObject),
+		holder: stateLockHolder{
+			UpgradeID: upgradeID,
+			Scope:     scope,
+			Host:      host,
+			User:      os.Getenv("USER"),
+		},
+	}, nil
+}
+
+// acquire takes the lock, failing with its holder if another upgrade holds it. A lock left behind by an interrupted
+// run of the same upgrade is taken over, so that the upgrade can be retried or resumed with its upgrade ID. It does
+// nothing on a nil lock.
+func (l *stateLock) acquire() error {
+	if l == nil {
+		return nil
+	}
+	l.holder.AcquiredAt = time.Now().UTC()
+	data, err := json.Marshal(l.holder)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	created, err := l.store.create(l.name, data)
+	if err != nil {
+		return err
+	}
+	if !created {
+		current, err := l.store.read(l.name)
+		if err != nil {
+			return errors.Wrapf(err, "error reading the holder of state lock %s", l.name)
+		}
+		var holder stateLockHolder
+		if err := json.Unmarshal(current, &holder); err != nil {
+			return errors.Wrapf(err, "error parsing the holder of state lock %s", l.name)
+		}
+		if holder.UpgradeID != l.holder.UpgradeID || holder.Scope != l.holder.Scope {
+			return errors.Errorf("state lock %s is held by %s; if that run is over, delete the lock object and retry", l.name, holder)
+		}
+		l.log.Info("Taking over the state lock of an interrupted run of this upgrade", "lock", l.name, "holder", holder.String())
+		if err := l.store.put(l.name, data); err != nil {
+			return err
+		}
+	}
+	l.held = true
+	l.log.Info("Acquired state lock", "lock", l.name)
+	return nil
+}
+
+// release deletes the lock if it is held. Failing to release the lock is only logged, as the next run of this upgrade
+// takes it over. It does nothing on a nil lock.
+func (l *stateLock) release() {
+	if l == nil || !l.held {
+		return
+	}
+	if err := l.store.remove(l.name); err != nil {
+		l.log.Error(err, "Unable to release state lock, delete it before running another upgrade of the cluster", "lock", l.name)
+		return
+	}
+	l.held = false
+	l.log.Info("Released state lock", "lock", l.name)
+}
+
+// runLockCommand runs command with args, reading data from its standard input, and returns its standard output.
+func runLockCommand(data []byte, command string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "%s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// s3LockStore stores lock objects with the aws CLI, which finds its credentials as usual. Objects are created with a
+// conditional write, which S3 refuses if the object exists.
+type s3LockStore struct{}
+
+// splitS3URL returns the bucket and key of the s3://bucket/key URL url.
+func splitS3URL(url string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// s3PreconditionFailed returns true if the stderr of the aws CLI reports that a conditional write was refused, as the
+// object exists or is being written concurrently.
+func s3PreconditionFailed(err error) bool {
+	return strings.Contains(err.Error(), "PreconditionFailed") || strings.Contains(err.Error(), "ConditionalRequestConflict")
+}
+
+func (s3LockStore) create(name string, data []byte) (bool, error) {
+	// put-object only reads its body from a file
+	f, err := ioutil.TempFile("", "upgrade-lock")
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return false, errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	bucket, key := splitS3URL(name)
+	_, err = runLockCommand(nil, "aws", "s3api", "put-object", "--bucket", bucket, "--key", key, "--body", f.Name(),
+		"--content-type", "application/json", "--if-none-match", "*")
+	if err != nil {
+		if s3PreconditionFailed(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "error creating state lock %s with aws", name)
+	}
+	return true, nil
+}
+
+func (s3LockStore) read(name string) ([]byte, error) {
+	data, err := runLockCommand(nil, "aws", "s3", "cp", "--only-show-errors", name, "-")
+	return data, errors.Wrapf(err, "error reading %s with aws", name)
+}
+
+func (s3LockStore) put(name string, data []byte) error {
+	_, err := runLockCommand(data, "aws", s3CopyArgs(name, "application/json")...)
+	return errors.Wrapf(err, "error writing state lock %s with aws", name)
+}
+
+func (s3LockStore) remove(name string) error {
+	_, err := runLockCommand(nil, "aws", "s3", "rm", "--only-show-errors", name)
+	return errors.Wrapf(err, "error deleting state lock %s with aws", name)
+}
+
+// gcsLockStore stores lock objects with gsutil, which finds its credentials as usual. Objects are created with a
+// generation precondition of 0, which GCS refuses if the object exists.
+type gcsLockStore struct{}
+
+// gcsPreconditionFailed returns true if the stderr of gsutil reports that a precondition was not met. Only the
+// exception name and the full status text are matched, as the code alone may be part of a bucket or object name.
+func gcsPreconditionFailed(err error) bool {
+	return strings.Contains(err.Error(), "PreconditionException") || strings.Contains(err.Error(), "412 Precondition Failed")
+}
+
+func (gcsLockStore) create(name string, data []byte) (bool, error) {
+	_, err := runLockCommand(data, "gsutil", "-q", "-h", "x-goog-if-generation-match:0", "-h", "Content-Type:application/json", "cp", "-", name)
+	if err != nil {
+		if gcsPreconditionFailed(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "error creating state lock %s with gsutil", name)
+	}
+	return true, nil
+}
+
+func (gcsLockStore) read(name string) ([]byte, error) {
+	data, err := runLockCommand(nil, "gsutil", "cat", name)
+	return data, errors.Wrapf(err, "error reading %s with gsutil", name)
+}
+
+func (gcsLockStore) put(name string, data []byte) error {
+	_, err := runLockCommand(data, "gsutil", gcsCopyArgs(name, "application/json")...)
+	return errors.Wrapf(err, "error writing state lock %s with gsutil", name)
+}
+
+func (gcsLockStore) remove(name string) error {
+	_, err := runLockCommand(nil, "gsutil", "-q", "rm", name)
+	return errors.Wrapf(err, "error deleting state lock %s with gsutil", name)
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+)
+
+// memoryLockStore stores lock objects in memory.
+type memoryLockStore map[string][]byte
+
+func (s memoryLockStore) create(name string, data []byte) (bool, error) {
+	if _, ok := s[name]; ok {
+		return false, nil
+	}
+	s[name] = data
+	return true, nil
+}
+
+func (s memoryLockStore) read(name string) ([]byte, error) {
+	return s[name], nil
+}
+
+func (s memoryLockStore) put(name string, data []byte) error {
+	s[name] = data
+	return nil
+}
+
+func (s memoryLockStore) remove(name string) error {
+	delete(s, name)
+	return nil
+}
+
+func TestNewStateLock(t *testing.T) {
+	log := logging.NewLogrusLoggerAdapter(logrus.New())
+
+	lock, err := newStateLock(log, StateLockConfig{}, "default", "workload", "1", controlPlaneScope)
+	assert.NoError(t, err)
+	assert.Nil(t, lock)
+
+	_, err = newStateLock(log, StateLockConfig{S3: "bucket/prefix"}, "default", "workload", "1", controlPlaneScope)
+	assert.Error(t, err)
+	_, err = newStateLock(log, StateLockConfig{S3: "s3://bucket", GCS: "gs://bucket"}, "default", "workload", "1", controlPlaneScope)
+	assert.Error(t, err)
+}
+
+func TestSplitS3URL(t *testing.T) {
+	bucket, key := splitS3URL("s3://locks/upgrades/default/workload/upgrade.lock")
+	assert.Equal(t, "locks", bucket)
+	assert.Equal(t, "upgrades/default/workload/upgrade.lock", key)
+}
+
+func TestStateLock(t *testing.T) {
+	log := logging.NewLogrusLoggerAdapter(logrus.New())
+	store := memoryLockStore{}
+	newLock := func(upgradeID, scope string) *stateLock {
+		return &stateLock{
+			log:    log,
+			store:  store,
+			name:   "s3://locks/default/workload/upgrade.lock",
+			holder: stateLockHolder{UpgradeID: upgradeID, Scope: scope, Host: "bastion-1"},
+		}
+	}
+
+	first := newLock("1", controlPlaneScope)
+	assert.NoError(t, first.acquire())
+	var holder stateLockHolder
+	assert.NoError(t, json.Unmarshal(store[first.name], &holder))
+	assert.Equal(t, "1", holder.UpgradeID)
+
+	// Another upgrade of the cluster is refused while the lock is held
+	err := newLock("2", controlPlaneScope).acquire()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "held by the control-plane upgrade 1 run by bastion-1")
+	assert.Error(t, newLock("1", machineDeploymentScope).acquire())
+
+	// A retry of the same upgrade takes the lock over
+	retry := newLock("1", controlPlaneScope)
+	assert.NoError(t, retry.acquire())
+	retry.release()
+	assert.Empty(t, store)
+
+	// Releasing a lock that is not held leaves the lock of its holder alone
+	assert.NoError(t, newLock("3", controlPlaneScope).acquire())
+	second := newLock("4", controlPlaneScope)
+	assert.Error(t, second.acquire())
+	second.release()
+	assert.Len(t, store, 1)
+
+	var none *stateLock
+	assert.NoError(t, none.acquire())
+	none.release()
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	assert.True(t, gcsPreconditionFailed(errors.New("PreconditionException: 412 Precondition Failed")))
+	assert.True(t, gcsPreconditionFailed(errors.New("412 Precondition Failed")))
+	assert.False(t, gcsPreconditionFailed(errors.New("AccessDeniedException: 403 on gs://locks-4120/ns/cluster/upgrade.lock")))
+
+	assert.True(t, s3PreconditionFailed(errors.New("An error occurred (PreconditionFailed) when calling the PutObject operation")))
+	assert.False(t, s3PreconditionFailed(errors.New("An error occurred (AccessDenied) when calling the PutObject operation")))
+}
@@ -0,0 +1,363 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// staticPodManifestsDir is where kubeadm writes the static pod manifests of control plane nodes.
+	staticPodManifestsDir = "/etc/kubernetes/manifests"
+	// staticPodManifestsMountPath is where the pods reading a node's manifests mount staticPodManifestsDir.
+	staticPodManifestsMountPath = "/host" + staticPodManifestsDir
+	// defaultStaticPodManifestsImage is the image of the pods reading a node's manifests unless another is configured.
+	defaultStaticPodManifestsImage = "busybox:1.31"
+	// staticPodManifestsScanTimeout is how long reading the manifests of a node may take, including pulling the image.
+	staticPodManifestsScanTimeout = 2 * time.Minute
+	// defaultCertificatesDir is the certificates directory kubeadm uses unless the ClusterConfiguration sets one.
+	defaultCertificatesDir = "/etc/kubernetes/pki"
+)
+
+// kubeadmStaticPod is a static pod kubeadm generates on control plane nodes.
+type kubeadmStaticPod struct {
+	// component is the ClusterConfiguration path of the component's configuration.
+	component []string
+	// flags are the flags kubeadm sets on the component, besides its extra args.
+	flags sets.String
+}
+
+// kubeadmStaticPods are the static pods kubeadm generates, by container name.
+var kubeadmStaticPods = map[string]kubeadmStaticPod{
+	"etcd": {
+		component: []string{"etcd", "local"},
+		flags: sets.NewString("advertise-client-urls", "cert-file", "client-cert-auth", "data-dir", "initial-advertise-peer-urls",
+			"initial-cluster", "initial-cluster-state", "key-file", "listen-client-urls", "listen-metrics-urls", "listen-peer-urls", "name",
+			"peer-cert-file", "peer-client-cert-auth", "peer-key-file", "peer-trusted-ca-file", "snapshot-count", "trusted-ca-file",
+			"experimental-initial-corrupt-check", "experimental-watch-progress-notify-interval"),
+	},
+	"kube-apiserver": {
+		component: []string{"apiServer"},
+		flags: sets.NewString("advertise-address", "allow-privileged", "authorization-mode", "client-ca-file", "enable-admission-plugins",
+			"enable-bootstrap-token-auth", "etcd-cafile", "etcd-certfile", "etcd-keyfile", "etcd-servers", "feature-gates", "insecure-port",
+			"kubelet-client-certificate", "kubelet-client-key", "kubelet-preferred-address-types", "proxy-client-cert-file",
+			"proxy-client-key-file", "requestheader-allowed-names", "requestheader-client-ca-file", "requestheader-extra-headers-prefix",
+			"requestheader-group-headers", "requestheader-username-headers", "secure-port", "service-account-issuer",
+			"service-account-key-file", "service-account-signing-key-file", "service-cluster-ip-range", "tls-cert-file",
+			"tls-private-key-file"),
+	},
+	"kube-controller-manager": {
+		component: []string{"controllerManager"},
+		flags: sets.NewString("allocate-node-cidrs", "authentication-kubeconfig", "authorization-kubeconfig", "bind-address",
+			"client-ca-file", "cluster-cidr", "cluster-name", "cluster-signing-cert-file", "cluster-signing-key-file", "controllers",
+			"feature-gates", "kubeconfig", "leader-elect", "node-cidr-mask-size", "node-cidr-mask-size-ipv4", "node-cidr-mask-size-ipv6",
+			"port", "requestheader-client-ca-file", "root-ca-file", "service-account-private-key-file", "service-cluster-ip-range",
+			"use-service-account-credentials"),
+	},
+	"kube-scheduler": {
+		component: []string{"scheduler"},
+		flags: sets.NewString("authentication-kubeconfig", "authorization-kubeconfig", "bind-address", "feature-gates", "kubeconfig",
+			"leader-elect", "port"),
+	},
+}
+
+// kubeadmHostPaths are the host paths kubeadm mounts into static pods, besides the certificates and etcd data
+// directories.
+var kubeadmHostPaths = sets.NewString("/etc/ssl/certs", "/etc/ca-certificates", "/etc/pki", "/usr/share/ca-certificates",
+	"/usr/local/share/ca-certificates", "/etc/kubernetes/controller-manager.conf", "/etc/kubernetes/scheduler.conf",
+	"/usr/libexec/kubernetes/kubelet-plugins/volume/exec")
+
+// staticPodManifestCustomizations returns how the static pod manifest file differs from what kubeadm generates from
+// clusterConfig: flags that are neither set by kubeadm nor extra args, extra args changed or removed, and host paths
+// that are neither mounted by kubeadm nor extra volumes. Values of the flags kubeadm sets are not compared, as they
+// depend on the node. Files in carried are written by the replacement's KubeadmConfig and are not customizations.
+func staticPodManifestCustomizations(file, content string, clusterConfig map[string]interface{}, carried sets.String) []string {
+	if carried.Has(file) {
+		return nil
+	}
+
+	pod := &v1.Pod{}
+	if err := yaml.Unmarshal([]byte(content), pod); err != nil || len(pod.Spec.Containers) == 0 {
+		return []string{"it is not a pod manifest kubeadm generates"}
+	}
+	container := pod.Spec.Containers[0]
+	staticPod, ok := kubeadmStaticPods[container.Name]
+	if !ok {
+		return []string{fmt.Sprintf("kubeadm does not generate the static pod %s", container.Name)}
+	}
+
+	var customizations []string
+	extraArgs, _, _ := unstructured.NestedStringMap(clusterConfig, append(staticPod.component, "extraArgs")...)
+	flags := containerFlags(container)
+	for _, name := range sortedKeys(flags) {
+		extra, isExtra := extraArgs[name]
+		switch {
+		case isExtra && extra != flags[name]:
+			customizations = append(customizations, fmt.Sprintf("flag --%s=%s instead of %s", name, flags[name], extra))
+		case !isExtra && !staticPod.flags.Has(name):
+			customizations = append(customizations, fmt.Sprintf("flag --%s=%s", name, flags[name]))
+		}
+	}
+	for _, name := range sortedKeys(extraArgs) {
+		if _, ok := flags[name]; !ok {
+			customizations = append(customizations, fmt.Sprintf("flag --%s removed", name))
+		}
+	}
+
+	hostPaths := sets.NewString(kubeadmHostPaths.UnsortedList()...)
+	certificatesDir, _, _ := unstructured.NestedString(clusterConfig, "certificatesDir")
+	if certificatesDir == "" {
+		certificatesDir = defaultCertificatesDir
+	}
+	hostPaths.Insert(certificatesDir, path.Join(certificatesDir, "etcd"))
+	dataDir, _, _ := unstructured.NestedString(clusterConfig, "etcd", "local", "dataDir")
+	if dataDir == "" {
+		dataDir = etcdDefaultDataDir
+	}
+	hostPaths.Insert(dataDir)
+	extraVolumes, _, _ := unstructured.NestedSlice(clusterConfig, append(staticPod.component, "extraVolumes")...)
+	for _, v := range extraVolumes {
+		if volume, ok := v.(map[string]interface{}); ok {
+			if hostPath, ok := volume["hostPath"].(string); ok {
+				hostPaths.Insert(hostPath)
+			}
+		}
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.HostPath != nil && !hostPaths.Has(volume.HostPath.Path) {
+			customizations = append(customizations, fmt.Sprintf("host path volume %s", volume.HostPath.Path))
+		}
+	}
+
+	return customizations
+}
+
+// containerFlags returns the --name=value flags of container's command and args, by name.
+func containerFlags(container v1.Container) map[string]string {
+	flags := make(map[string]string)
+	for _, arg := range append(append([]string{}, container.Command...), container.Args...) {
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+		if len(parts) == 1 {
+			flags[parts[0]] = "true"
+			continue
+		}
+		flags[parts[0]] = parts[1]
+	}
+	return flags
+}
+
+// carriedStaticPodManifests returns the names of the static pod manifests written by configs, which replacement
+// machines are bootstrapped with too.
+func carriedStaticPodManifests(configs []*bootstrapv1.KubeadmConfig) sets.String {
+	carried := sets.NewString()
+	for _, config := range configs {
+		for _, file := range config.Spec.Files {
+			if path.Dir(file.Path) == staticPodManifestsDir {
+				carried.Insert(path.Base(file.Path))
+			}
+		}
+	}
+	return carried
+}
+
+// staticPodManifestsReader returns a pod on node mounting its static pod manifests read-only, to read them with exec.
+func staticPodManifestsReader(node, image string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    "kube-system",
+			GenerateName: "static-pod-manifests-",
+		},
+		Spec: v1.PodSpec{
+			NodeName:      node,
+			RestartPolicy: v1.RestartPolicyNever,
+			Tolerations:   []v1.Toleration{{Operator: v1.TolerationOpExists}},
+			Containers: []v1.Container{{
+				Name:    "reader",
+				Image:   image,
+				Command: []string{"sleep", fmt.Sprintf("%d", int(staticPodManifestsScanTimeout.Seconds()))},
+				VolumeMounts: []v1.VolumeMount{{
+					Name:      "manifests",
+					MountPath: staticPodManifestsMountPath,
+					ReadOnly:  true,
+				}},
+			}},
+			Volumes: []v1.Volume{{
+				Name: "manifests",
+				VolumeSource: v1.VolumeSource{
+					HostPath: &v1.HostPathVolumeSource{Path: staticPodManifestsDir},
+				},
+			}},
+		},
+	}
+}
+
+// readStaticPodManifests returns the content of the static pod manifests of node, by file name, read through a pod
+// running on node. The pod is deleted before returning.
+func (u *ControlPlaneUpgrader) readStaticPodManifests(ctx context.Context, node string) (map[string]string, error) {
+	pods := u.targetKubernetesClient.CoreV1().Pods("kube-system")
+	pod, err := pods.Create(staticPodManifestsReader(node, u.staticPodManifests.Image))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating a pod to read the static pod manifests of node %s", node)
+	}
+	defer func() {
+		if err := pods.Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+			u.log.Error(err, "Unable to delete pod", "pod", pod.Name)
+		}
+	}()
+
+	err = wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		current, err := pods.Get(pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting pod %s", pod.Name)
+		}
+		switch current.Status.Phase {
+		case v1.PodRunning:
+			return true, nil
+		case v1.PodFailed, v1.PodSucceeded:
+			return false, errors.Errorf("pod %s exited", pod.Name)
+		}
+		return false, nil
+	}, ctx.Done())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error waiting for pod %s to run", pod.Name)
+	}
+
+	exec := func(command string) (string, error) {
+		stdout, stderr, err := kubernetes2.PodExec(ctx, kubernetes2.PodExecInput{
+			RestConfig:       u.targetRestConfig,
+			KubernetesClient: u.targetKubernetesClient,
+			Namespace:        pod.Namespace,
+			Name:             pod.Name,
+			Command:          []string{"sh", "-c", command},
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "error running %q in pod %s: %s", command, pod.Name, stderr)
+		}
+		return stdout, nil
+	}
+
+	stdout, err := exec("ls -1 " + shellQuote(staticPodManifestsMountPath))
+	if err != nil {
+		return nil, err
+	}
+	manifests := make(map[string]string)
+	for _, name := range strings.Fields(stdout) {
+		content, err := exec("cat " + shellQuote(path.Join(staticPodManifestsMountPath, name)))
+		if err != nil {
+			return nil, err
+		}
+		manifests[name] = content
+	}
+	return manifests, nil
+}
+
+// exportStaticPodManifests writes manifests, by file name, under a directory named after node in dir.
+func exportStaticPodManifests(dir, node string, manifests map[string]string) error {
+	nodeDir := filepath.Join(dir, node)
+	if err := os.MkdirAll(nodeDir, 0700); err != nil {
+		return errors.Wrapf(err, "error creating directory %s", nodeDir)
+	}
+	for name, content := range manifests {
+		file := filepath.Join(nodeDir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			return errors.Wrapf(err, "error exporting static pod manifest %s", file)
+		}
+	}
+	return nil
+}
+
+// scanStaticPodManifests reads the static pod manifests of the nodes of machines and warns about the customizations
+// made on disk that replacement machines, generated by kubeadm, will lose. Customized manifests are exported if an
+// export directory is configured. Nodes that cannot be scanned are reported as warnings.
+func (u *ControlPlaneUpgrader) scanStaticPodManifests(machines []*clusterv1.Machine) error {
+	cm, err := u.getKubeadmConfigMap()
+	if err != nil {
+		return err
+	}
+	clusterConfig := make(map[string]interface{})
+	if cm != nil {
+		if _, clusterConfig, err = findClusterConfiguration(cm); err != nil {
+			return err
+		}
+	}
+
+	var configs []*bootstrapv1.KubeadmConfig
+	for _, machine := range machines {
+		ref := machine.Spec.Bootstrap.ConfigRef
+		if ref == nil || ref.Kind != "KubeadmConfig" {
+			continue
+		}
+		config := &bootstrapv1.KubeadmConfig{}
+		key := ctrlclient.ObjectKey{Namespace: machine.Namespace, Name: ref.Name}
+		if err := u.managementClusterClient.Get(context.TODO(), key, config); err != nil {
+			return errors.Wrapf(err, "error getting kubeadm config %s", key.String())
+		}
+		configs = append(configs, config)
+	}
+	carried := carriedStaticPodManifests(configs)
+
+	for _, machine := range machines {
+		if machine.Status.NodeRef == nil {
+			continue
+		}
+		node := machine.Status.NodeRef.Name
+
+		ctx, cancel := context.WithTimeout(context.TODO(), staticPodManifestsScanTimeout)
+		manifests, err := u.readStaticPodManifests(ctx, node)
+		cancel()
+		if err != nil {
+			u.warnings.add(WarningStaticPodManifest, node, "unable to scan the static pod manifests for customizations: %v", err)
+			continue
+		}
+
+		customized := make(map[string]string)
+		names := make([]string, 0, len(manifests))
+		for name := range manifests {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			customizations := staticPodManifestCustomizations(name, manifests[name], clusterConfig, carried)
+			if len(customizations) == 0 {
+				continue
+			}
+			customized[name] = manifests[name]
+			u.warnings.add(WarningStaticPodManifest, node, "%s/%s is customized on disk and the customizations will be lost on replacement unless carried by a kubeadm patch: %s",
+				staticPodManifestsDir, name, strings.Join(customizations, ", "))
+		}
+		u.log.Info("Scanned static pod manifests", "node", node, "manifests", len(manifests), "customized", len(customized))
+
+		if len(customized) == 0 || u.staticPodManifests.ExportDirectory == "" {
+			continue
+		}
+		if err := exportStaticPodManifests(u.staticPodManifests.ExportDirectory, node, customized); err != nil {
+			return err
+		}
+		u.record.event("Exported the customized static pod manifests of node %s to %s", node, filepath.Join(u.staticPodManifests.ExportDirectory, node))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+	bootstrapv1 "sigs.k8s.io/cluster-api-bootstrap-provider-kubeadm/api/v1alpha2"
+	"sigs.k8s.io/yaml"
+)
+
+const apiServerManifest = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: kube-apiserver
+  namespace: kube-system
+spec:
+  containers:
+  - name: kube-apiserver
+    command:
+    - kube-apiserver
+    - --advertise-address=10.0.0.1
+    - --allow-privileged=true
+    - --audit-log-path=/var/log/audit.log
+    - --enable-admission-plugins=NodeRestriction,PodSecurityPolicy
+    - --service-node-port-range=30000-32767
+    - --tls-cert-file=/etc/kubernetes/pki/apiserver.crt
+  volumes:
+  - name: k8s-certs
+    hostPath:
+      path: /etc/kubernetes/pki
+  - name: audit
+    hostPath:
+      path: /var/log
+  - name: policy
+    hostPath:
+      path: /etc/kubernetes/policy
+`
+
+func TestStaticPodManifestCustomizations(t *testing.T) {
+	clusterConfig := make(map[string]interface{})
+	require.NoError(t, yaml.Unmarshal([]byte(`
+apiServer:
+  extraArgs:
+    enable-admission-plugins: NodeRestriction
+    oidc-issuer-url: https://issuer.example.com
+  extraVolumes:
+  - name: policy
+    hostPath: /etc/kubernetes/policy
+    mountPath: /etc/kubernetes/policy
+`), &clusterConfig))
+
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		carried  sets.String
+		expected []string
+	}{
+		{
+			name:    "customized kube-apiserver",
+			file:    "kube-apiserver.yaml",
+			content: apiServerManifest,
+			carried: sets.NewString(),
+			expected: []string{
+				"flag --audit-log-path=/var/log/audit.log",
+				"flag --enable-admission-plugins=NodeRestriction,PodSecurityPolicy instead of NodeRestriction",
+				"flag --service-node-port-range=30000-32767",
+				"flag --oidc-issuer-url removed",
+				"host path volume /var/log",
+			},
+		},
+		{
+			name:     "manifest kubeadm does not generate",
+			file:     "haproxy.yaml",
+			content:  "apiVersion: v1\nkind: Pod\nspec:\n  containers:\n  - name: haproxy\n",
+			carried:  sets.NewString(),
+			expected: []string{"kubeadm does not generate the static pod haproxy"},
+		},
+		{
+			name:    "manifest written by the kubeadm config",
+			file:    "konnectivity-server.yaml",
+			content: "apiVersion: v1\nkind: Pod\nspec:\n  containers:\n  - name: konnectivity-server\n",
+			carried: sets.NewString("konnectivity-server.yaml"),
+		},
+		{
+			name:     "not a manifest",
+			file:     "kube-apiserver.yaml.bak",
+			content:  "not yaml: [",
+			carried:  sets.NewString(),
+			expected: []string{"it is not a pod manifest kubeadm generates"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, staticPodManifestCustomizations(tc.file, tc.content, clusterConfig, tc.carried))
+		})
+	}
+}
+
+func TestCarriedStaticPodManifests(t *testing.T) {
+	configs := []*bootstrapv1.KubeadmConfig{
+		{Spec: bootstrapv1.KubeadmConfigSpec{Files: []bootstrapv1.File{
+			{Path: "/etc/kubernetes/manifests/konnectivity-server.yaml"},
+			{Path: "/etc/kubernetes/egress-selector-configuration.yaml"},
+		}}},
+	}
+	assert.Equal(t, []string{"konnectivity-server.yaml"}, carriedStaticPodManifests(configs).List())
+}
+
+func TestExportStaticPodManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-pod-manifests")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, exportStaticPodManifests(dir, "cp-0", map[string]string{"kube-apiserver.yaml": apiServerManifest}))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "cp-0", "kube-apiserver.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, apiServerManifest, string(content))
+}
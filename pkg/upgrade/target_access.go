@@ -0,0 +1,306 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	"golang.org/x/net/proxy"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Values for TargetAccessConfig.Mode.
+const (
+	// TargetAccessDirect connects to the target cluster's API server directly.
+	TargetAccessDirect = "direct"
+	// TargetAccessPortForward port-forwards to a relay pod in the management cluster that connects to the target
+	// cluster's API server.
+	TargetAccessPortForward = "port-forward"
+	// TargetAccessSOCKS5 connects to the target cluster's API server through a SOCKS5 proxy.
+	TargetAccessSOCKS5 = "socks5"
+)
+
+const (
+	defaultRelayImage    = "alpine/socat"
+	defaultRelayLifetime = 12 * time.Hour
+	// relayPort is the port the relay pod listens on.
+	relayPort = 6443
+	// relayTargetAnnotation records the API server address a relay pod connects to.
+	relayTargetAnnotation = annotationPrefix + "relay-target"
+	// relayStartTimeout is how long a new relay pod has to become ready.
+	relayStartTimeout = 2 * time.Minute
+)
+
+// parseTargetAccess validates access, returning its mode, defaulted to TargetAccessDirect, and the lifetime of the
+// relay pod of the port-forward mode.
+func parseTargetAccess(access TargetAccessConfig) (string, time.Duration, error) {
+	mode := access.Mode
+	switch mode {
+	case "":
+		mode = TargetAccessDirect
+	case TargetAccessDirect, TargetAccessPortForward, TargetAccessSOCKS5:
+	default:
+		return "", 0, errors.Errorf("invalid target access mode %q: must be one of %s, %s, %s", mode, TargetAccessDirect, TargetAccessPortForward, TargetAccessSOCKS5)
+	}
+
+	if mode == TargetAccessSOCKS5 && access.SOCKSProxy == "" {
+		return "", 0, errors.Errorf("the %s target access mode requires a SOCKS proxy", TargetAccessSOCKS5)
+	}
+	if mode != TargetAccessSOCKS5 && access.SOCKSProxy != "" {
+		return "", 0, errors.Errorf("a SOCKS proxy is only used by the %s target access mode", TargetAccessSOCKS5)
+	}
+	if mode != TargetAccessPortForward && (access.RelayImage != "" || access.RelayLifetime != "") {
+		return "", 0, errors.Errorf("a relay pod is only used by the %s target access mode", TargetAccessPortForward)
+	}
+
+	lifetime := defaultRelayLifetime
+	if access.RelayLifetime != "" {
+		var err error
+		lifetime, err = time.ParseDuration(access.RelayLifetime)
+		if err != nil {
+			return "", 0, errors.Wrapf(err, "error parsing relay lifetime %q", access.RelayLifetime)
+		}
+		if lifetime <= 0 {
+			return "", 0, errors.Errorf("invalid relay lifetime %q: must be positive", access.RelayLifetime)
+		}
+	}
+	return mode, lifetime, nil
+}
+
+// apiServerAddress returns the host:port of the API server at host, the host of a rest config with or without a
+// scheme, and its hostname, which its serving certificate is verified against.
+func apiServerAddress(host string) (string, string, error) {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error parsing API server address %q", host)
+	}
+	if u.Hostname() == "" {
+		return "", "", errors.Errorf("API server address %q has no host", host)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), u.Hostname(), nil
+}
+
+// tunnelRestConfig points config at localAddress, the local end of a tunnel to its API server, while still verifying
+// the server's certificate against serverName, the hostname it was reached at.
+func tunnelRestConfig(config *rest.Config, localAddress, serverName string) {
+	scheme := "https"
+	if strings.HasPrefix(config.Host, "http://") {
+		scheme = "http"
+	}
+	config.Host = scheme + "://" + localAddress
+	if config.TLSClientConfig.ServerName == "" {
+		config.TLSClientConfig.ServerName = serverName
+	}
+}
+
+// socksDialer returns a dialer connecting through the SOCKS5 proxy at proxyURL.
+func socksDialer(proxyURL string) (proxy.ContextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing SOCKS proxy %q", redactURL(proxyURL))
+	}
+	if u.Scheme != "socks5" {
+		return nil, errors.Errorf("invalid SOCKS proxy %q: the scheme must be socks5", redactURL(proxyURL))
+	}
+	dialer, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating dialer for SOCKS proxy %q", redactURL(proxyURL))
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.Errorf("the dialer for SOCKS proxy %q does not support contexts", redactURL(proxyURL))
+	}
+	return contextDialer, nil
+}
+
+// relayPodName returns the name of the relay pod of the cluster clusterName.
+func relayPodName(clusterName string) string {
+	return clusterName + "-apiserver-relay"
+}
+
+// relayPod returns a pod relaying connections on relayPort to the API server at address, the host:port of the target
+// cluster clusterName's API server, for lifetime.
+func relayPod(namespace, clusterName, image, address string, lifetime time.Duration) *v1.Pod {
+	deadline := int64(lifetime / time.Second)
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        relayPodName(clusterName),
+			Labels:      map[string]string{clusterLabelName: clusterName},
+			Annotations: map[string]string{relayTargetAnnotation: address},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy:         v1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &deadline,
+			Containers: []v1.Container{{
+				Name:    "relay",
+				Image:   image,
+				Command: []string{"socat", fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", relayPort), "TCP:" + address},
+				Ports:   []v1.ContainerPort{{Name: "apiserver", ContainerPort: relayPort}},
+			}},
+		},
+	}
+}
+
+// reusableRelayPod returns true if pod relays to address and keeps running, at now, for at least half of lifetime.
+func reusableRelayPod(pod *v1.Pod, address string, lifetime time.Duration, now time.Time) bool {
+	if pod.DeletionTimestamp != nil || pod.Annotations[relayTargetAnnotation] != address {
+		return false
+	}
+	switch pod.Status.Phase {
+	case v1.PodPending:
+		return true
+	case v1.PodRunning:
+	default:
+		return false
+	}
+	if pod.Status.StartTime == nil || pod.Spec.ActiveDeadlineSeconds == nil {
+		return true
+	}
+	end := pod.Status.StartTime.Add(time.Duration(*pod.Spec.ActiveDeadlineSeconds) * time.Second)
+	return end.Sub(now) >= lifetime/2
+}
+
+// configureTargetAccess points targetRestConfig at a local tunnel to the target cluster's API server when the access
+// mode of config is not direct. The port-forward mode starts, or reuses, a relay pod in the namespace of cluster.
+func configureTargetAccess(log logr.Logger, config Config, managementClusterClient ctrlclient.Client, cluster *clusterv1.Cluster, targetRestConfig *rest.Config) error {
+	mode, lifetime, err := parseTargetAccess(config.TargetCluster.Access)
+	if err != nil || mode == TargetAccessDirect {
+		return err
+	}
+	address, serverName, err := apiServerAddress(targetRestConfig.Host)
+	if err != nil {
+		return err
+	}
+
+	var localAddress string
+	switch mode {
+	case TargetAccessSOCKS5:
+		dialer, err := socksDialer(config.TargetCluster.Access.SOCKSProxy)
+		if err != nil {
+			return err
+		}
+		log.Info("Reaching the target cluster through a SOCKS proxy", "proxy", redactURL(config.TargetCluster.Access.SOCKSProxy), "apiserver", address)
+		localAddress, err = kubernetes2.Tunnel(func(ctx context.Context) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			return conn, errors.Wrapf(err, "error connecting to %s through the SOCKS proxy", address)
+		}, func(err error) {
+			log.Error(err, "Error tunneling a connection to the target cluster")
+		})
+		if err != nil {
+			return err
+		}
+
+	case TargetAccessPortForward:
+		if kubernetes2.ReadOnly() {
+			return errors.Errorf("the %s target access mode creates a relay pod, which is refused in read-only mode: use the %s or %s mode", TargetAccessPortForward, TargetAccessDirect, TargetAccessSOCKS5)
+		}
+		image := config.TargetCluster.Access.RelayImage
+		if image == "" {
+			image = defaultRelayImage
+		}
+		desired := relayPod(cluster.Namespace, cluster.Name, image, address, lifetime)
+		if err := ensureRelayPod(log, managementClusterClient, desired, lifetime); err != nil {
+			return err
+		}
+
+		managementRestConfig, err := newManagementRestConfig(config.ManagementCluster)
+		if err != nil {
+			return err
+		}
+		log.Info("Reaching the target cluster through a port-forward to a relay pod", "pod", desired.Namespace+"/"+desired.Name, "apiserver", address)
+		localAddress, err = kubernetes2.PortForward(managementRestConfig, desired.Namespace, desired.Name, relayPort, func(err error) {
+			log.Error(err, "Port-forward to the relay pod interrupted, reconnecting", "pod", desired.Namespace+"/"+desired.Name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	tunnelRestConfig(targetRestConfig, localAddress, serverName)
+	return nil
+}
+
+// ensureRelayPod creates desired, replacing a relay pod of the same name that cannot be reused, and waits for it to be
+// running.
+func ensureRelayPod(log logr.Logger, c ctrlclient.Client, desired *v1.Pod, lifetime time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), relayStartTimeout)
+	defer cancel()
+	key := ctrlclient.ObjectKey{Namespace: desired.Namespace, Name: desired.Name}
+	name := key.String()
+
+	existing := &v1.Pod{}
+	err := c.Get(ctx, key, existing)
+	switch {
+	case apierrors.IsNotFound(err):
+		existing = nil
+	case err != nil:
+		return errors.Wrapf(err, "error getting relay pod %s", name)
+	case reusableRelayPod(existing, desired.Annotations[relayTargetAnnotation], lifetime, time.Now()):
+		log.Info("Reusing relay pod", "pod", name)
+	default:
+		log.Info("Replacing relay pod", "pod", name, "phase", existing.Status.Phase)
+		if err := c.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting relay pod %s", name)
+		}
+		err := wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+			err := c.Get(ctx, key, &v1.Pod{})
+			return apierrors.IsNotFound(err), nil
+		}, ctx.Done())
+		if err != nil {
+			return errors.Wrapf(err, "error waiting for relay pod %s to be deleted", name)
+		}
+		existing = nil
+	}
+
+	if existing == nil {
+		log.Info("Creating relay pod", "pod", name, "image", desired.Spec.Containers[0].Image)
+		if err := c.Create(ctx, desired); err != nil {
+			return errors.Wrapf(err, "error creating relay pod %s", name)
+		}
+	}
+
+	pod := &v1.Pod{}
+	err = wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		if err := c.Get(ctx, key, pod); err != nil {
+			return false, nil
+		}
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			return true, nil
+		case v1.PodSucceeded, v1.PodFailed:
+			return false, errors.Errorf("relay pod %s stopped: %s", name, pod.Status.Message)
+		}
+		return false, nil
+	}, ctx.Done())
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("timed out waiting for relay pod %s to be running", name)
+	}
+	return err
+}
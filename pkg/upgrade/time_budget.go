@@ -0,0 +1,183 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runBudget is the wall-clock time budget of an upgrade. It is only checked between machines and batches, so the one
+// in progress is always finished. A zero budget is unlimited.
+type runBudget struct {
+	max time.Duration
+	// until is the end of the maintenance window, if any, which the budget does not run past.
+	until    time.Time
+	deadline time.Time
+	// estimate is how long a machine or batch is expected to take until one finished, the longest its steps may take.
+	estimate time.Duration
+	// finished and spent are how many machines or batches were upgraded by the run, and how long they took.
+	finished int
+	spent    time.Duration
+}
+
+// parseRunBudget parses maxDuration, such as 2h30m, and contextDeadline, an RFC 3339 time such as
+// 2019-11-02T04:00:00Z. Empty ones are unlimited.
+func parseRunBudget(maxDuration, contextDeadline string) (runBudget, error) {
+	var b runBudget
+	if maxDuration != "" {
+		max, err := time.ParseDuration(maxDuration)
+		if err != nil {
+			return runBudget{}, errors.Wrapf(err, "error parsing max duration %q", maxDuration)
+		}
+		if max <= 0 {
+			return runBudget{}, errors.Errorf("invalid max duration %q: must be positive", maxDuration)
+		}
+		b.max = max
+	}
+	if contextDeadline != "" {
+		until, err := time.Parse(time.RFC3339, contextDeadline)
+		if err != nil {
+			return runBudget{}, errors.Wrapf(err, "error parsing context deadline %q", contextDeadline)
+		}
+		b.until = until
+	}
+	return b, nil
+}
+
+// start starts the budget at now, running until the earlier of its maximum duration and the end of its window. Each
+// machine or batch is expected to take estimate until one finished.
+func (b *runBudget) start(now time.Time, estimate time.Duration) {
+	b.estimate = estimate
+	b.deadline = b.until
+	if b.max > 0 && (b.deadline.IsZero() || now.Add(b.max).Before(b.deadline)) {
+		b.deadline = now.Add(b.max)
+	}
+}
+
+// exhausted returns true if the budget started and ran out by now.
+func (b *runBudget) exhausted(now time.Time) bool {
+	return !b.deadline.IsZero() && !now.Before(b.deadline)
+}
+
+// observe records that a machine or batch took d to upgrade.
+func (b *runBudget) observe(d time.Duration) {
+	b.finished++
+	b.spent += d
+}
+
+// expected returns how long the next machine or batch is expected to take, the average of those the run upgraded, or
+// the estimate before the first one finished.
+func (b *runBudget) expected() time.Duration {
+	if b.finished == 0 {
+		return b.estimate
+	}
+	return b.spent / time.Duration(b.finished)
+}
+
+// insufficient returns true if the budget started and the next machine or batch, taking as long as expected, would
+// not finish before it runs out.
+func (b *runBudget) insufficient(now time.Time) bool {
+	expected := b.expected()
+	return !b.deadline.IsZero() && expected > 0 && now.Add(expected).After(b.deadline)
+}
+
+// stop returns the error stopping the upgrade with remaining left to upgrade, or nil if the next machine or batch
+// can start by now.
+func (b *runBudget) stop(now time.Time, upgradeID, remaining string) *TimeBudgetExhaustedError {
+	if !b.exhausted(now) && !b.insufficient(now) {
+		return nil
+	}
+	err := &TimeBudgetExhaustedError{Deadline: b.deadline, UpgradeID: upgradeID, Remaining: remaining}
+	if !b.deadline.Equal(b.until) {
+		err.Budget = b.max
+	}
+	if !b.exhausted(now) {
+		err.Expected = b.expected()
+		err.Estimated = b.finished == 0
+	}
+	return err
+}
+
+// stopWaiting returns the error stopping the upgrade with remaining left to upgrade if waiting wait from now would
+// run past the deadline, or nil.
+func (b *runBudget) stopWaiting(now time.Time, wait time.Duration, upgradeID, remaining string) *TimeBudgetExhaustedError {
+	if b.deadline.IsZero() || !now.Add(wait).After(b.deadline) {
+		return nil
+	}
+	err := &TimeBudgetExhaustedError{Deadline: b.deadline, UpgradeID: upgradeID, Remaining: remaining, Wait: wait}
+	if !b.deadline.Equal(b.until) {
+		err.Budget = b.max
+	}
+	return err
+}
+
+// TimeBudgetExhaustedError is returned by upgrades that stopped before starting the next machine or batch because
+// their time budget ran out. The upgrade can be resumed with the same upgrade ID.
+type TimeBudgetExhaustedError struct {
+	Budget time.Duration
+	// Deadline is when the budget runs out, the end of the maintenance window if it comes first.
+	Deadline  time.Time
+	UpgradeID string
+	// Remaining describes what is left to upgrade, such as "2 control plane machines".
+	Remaining string
+	// Expected is how long the next machine or batch was expected to take, if the upgrade stopped before the deadline
+	// as it would not have finished in time.
+	Expected time.Duration
+	// Estimated is true if Expected is the estimate of the plan, as no machine or batch had finished.
+	Estimated bool
+	// Wait is how long the upgrade would have waited for the disruption budget, if it stopped before the deadline as
+	// the wait would have run past it.
+	Wait time.Duration
+}
+
+// reason returns why the upgrade stopped.
+func (e *TimeBudgetExhaustedError) reason() string {
+	switch {
+	case e.Wait > 0:
+		return fmt.Sprintf("waiting %s for the disruption budget would run past the deadline %s", e.Wait, e.Deadline.Format(time.RFC3339))
+	case e.Expected > 0 && e.Estimated:
+		return fmt.Sprintf("the next step, estimated to take up to %s, would not finish before the deadline %s", e.Expected, e.Deadline.Format(time.RFC3339))
+	case e.Expected > 0:
+		return fmt.Sprintf("the next step, taking %s on average, would not finish before the deadline %s", e.Expected, e.Deadline.Format(time.RFC3339))
+	case e.Budget > 0:
+		return fmt.Sprintf("the time budget of %s is exhausted", e.Budget)
+	default:
+		return fmt.Sprintf("the deadline %s is reached", e.Deadline.Format(time.RFC3339))
+	}
+}
+
+func (e *TimeBudgetExhaustedError) Error() string {
+	return fmt.Sprintf("stopped as %s, with %s left to upgrade; resume with --upgrade-id=%s", e.reason(), e.Remaining, e.UpgradeID)
+}
+
+// IsTimeBudgetExhausted returns true if err, or its cause, is a TimeBudgetExhaustedError.
+func IsTimeBudgetExhausted(err error) bool {
+	_, ok := errors.Cause(err).(*TimeBudgetExhaustedError)
+	return ok
+}
+
+// timeBudgetExhausted returns the error stopping the upgrade with remaining left to upgrade if the next machine
+// cannot start, or nil.
+func (u *ControlPlaneUpgrader) timeBudgetExhausted(remaining string) error {
+	stop := u.budget.stop(time.Now(), u.upgradeID, remaining)
+	if stop == nil {
+		return nil
+	}
+	u.record.event("Stopped as %s, with %s left to upgrade", stop.reason(), remaining)
+	return stop
+}
+
+// timeBudgetExhausted returns the error stopping the upgrade with remaining left to upgrade if the next batch cannot
+// start, or nil.
+func (u *MachineDeploymentUpgrader) timeBudgetExhausted(remaining string) error {
+	stop := u.budget.stop(time.Now(), u.upgradeID, remaining)
+	if stop == nil {
+		return nil
+	}
+	u.record.event("Stopped as %s, with %s left to upgrade", stop.reason(), remaining)
+	return stop
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseRunBudget(t *testing.T) {
+	testcases := []struct {
+		maxDuration string
+		want        time.Duration
+		wantErr     bool
+	}{
+		{maxDuration: "", want: 0},
+		{maxDuration: "2h30m", want: 150 * time.Minute},
+		{maxDuration: "soon", wantErr: true},
+		{maxDuration: "0s", wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.maxDuration, func(t *testing.T) {
+			budget, err := parseRunBudget(tc.maxDuration, "")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseRunBudget() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if budget.max != tc.want {
+				t.Errorf("parseRunBudget() = %s, want %s", budget.max, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunBudgetExhausted(t *testing.T) {
+	now := time.Date(2019, 11, 1, 22, 0, 0, 0, time.UTC)
+
+	unlimited := runBudget{}
+	unlimited.start(now, 0)
+	if unlimited.exhausted(now.Add(24 * time.Hour)) {
+		t.Error("expected an unlimited budget never to be exhausted")
+	}
+
+	budget := runBudget{max: time.Hour}
+	if budget.exhausted(now.Add(2 * time.Hour)) {
+		t.Error("expected a budget that did not start not to be exhausted")
+	}
+	budget.start(now, 0)
+	if budget.exhausted(now.Add(59 * time.Minute)) {
+		t.Error("expected the budget not to be exhausted before its deadline")
+	}
+	if !budget.exhausted(now.Add(time.Hour)) {
+		t.Error("expected the budget to be exhausted at its deadline")
+	}
+}
+
+func TestParseRunBudgetContextDeadline(t *testing.T) {
+	budget, err := parseRunBudget("", "2019-11-02T04:00:00Z")
+	if err != nil {
+		t.Fatalf("parseRunBudget() error = %v", err)
+	}
+	if want := time.Date(2019, 11, 2, 4, 0, 0, 0, time.UTC); !budget.until.Equal(want) {
+		t.Errorf("parseRunBudget() until = %s, want %s", budget.until, want)
+	}
+	if _, err := parseRunBudget("", "4am"); err == nil {
+		t.Error("expected an invalid context deadline to be refused")
+	}
+}
+
+func TestRunBudgetContextDeadline(t *testing.T) {
+	now := time.Date(2019, 11, 1, 22, 0, 0, 0, time.UTC)
+
+	budget := runBudget{max: 8 * time.Hour, until: now.Add(6 * time.Hour)}
+	budget.start(now, 0)
+	if !budget.deadline.Equal(now.Add(6 * time.Hour)) {
+		t.Errorf("expected the end of the window to come before the time budget, got %s", budget.deadline)
+	}
+	budget = runBudget{max: 2 * time.Hour, until: now.Add(6 * time.Hour)}
+	budget.start(now, 0)
+	if !budget.deadline.Equal(now.Add(2 * time.Hour)) {
+		t.Errorf("expected the time budget to come before the end of the window, got %s", budget.deadline)
+	}
+
+	budget = runBudget{until: now.Add(time.Hour)}
+	budget.start(now, 0)
+	if budget.insufficient(now.Add(50 * time.Minute)) {
+		t.Error("expected the budget to be sufficient until a machine finished")
+	}
+	budget.observe(10 * time.Minute)
+	budget.observe(20 * time.Minute)
+	if budget.expected() != 15*time.Minute {
+		t.Errorf("expected() = %s, want 15m", budget.expected())
+	}
+	if budget.insufficient(now.Add(45 * time.Minute)) {
+		t.Error("expected the budget to be sufficient for a machine finishing at the deadline")
+	}
+	if !budget.insufficient(now.Add(46 * time.Minute)) {
+		t.Error("expected the budget to be insufficient for a machine finishing after the deadline")
+	}
+
+	if stop := budget.stop(now.Add(30*time.Minute), "123", "2 control plane machines"); stop != nil {
+		t.Errorf("expected the upgrade not to stop, got %v", stop)
+	}
+	stop := budget.stop(now.Add(50*time.Minute), "123", "2 control plane machines")
+	if stop == nil || stop.Expected != 15*time.Minute || stop.Budget != 0 {
+		t.Fatalf("expected the upgrade to stop as the next machine would not finish in time, got %#v", stop)
+	}
+	want := "stopped as the next step, taking 15m0s on average, would not finish before the deadline 2019-11-01T23:00:00Z, with 2 control plane machines left to upgrade; resume with --upgrade-id=123"
+	if stop.Error() != want {
+		t.Errorf("Error() = %q, want %q", stop.Error(), want)
+	}
+	stop = budget.stop(now.Add(time.Hour), "123", "2 control plane machines")
+	if stop == nil || stop.Expected != 0 {
+		t.Fatalf("expected the upgrade to stop at the deadline, got %#v", stop)
+	}
+	if want := "stopped as the deadline 2019-11-01T23:00:00Z is reached, with 2 control plane machines left to upgrade; resume with --upgrade-id=123"; stop.Error() != want {
+		t.Errorf("Error() = %q, want %q", stop.Error(), want)
+	}
+}
+
+func TestRunBudgetEstimate(t *testing.T) {
+	now := time.Date(2019, 11, 1, 22, 0, 0, 0, time.UTC)
+
+	budget := runBudget{max: time.Hour}
+	budget.start(now, 45*time.Minute)
+	if budget.expected() != 45*time.Minute {
+		t.Errorf("expected() = %s, want the estimate of 45m", budget.expected())
+	}
+	if budget.insufficient(now.Add(15 * time.Minute)) {
+		t.Error("expected the budget to be sufficient for the estimate of the first machine")
+	}
+	stop := budget.stop(now.Add(20*time.Minute), "123", "3 control plane machines")
+	if stop == nil || stop.Expected != 45*time.Minute || !stop.Estimated {
+		t.Fatalf("expected the upgrade to stop as the first machine would not finish in time, got %#v", stop)
+	}
+	want := "stopped as the next step, estimated to take up to 45m0s, would not finish before the deadline 2019-11-01T23:00:00Z, with 3 control plane machines left to upgrade; resume with --upgrade-id=123"
+	if stop.Error() != want {
+		t.Errorf("Error() = %q, want %q", stop.Error(), want)
+	}
+
+	// Observations replace the estimate
+	budget.observe(10 * time.Minute)
+	if budget.expected() != 10*time.Minute {
+		t.Errorf("expected() = %s, want the observed 10m", budget.expected())
+	}
+	if stop := budget.stop(now.Add(20*time.Minute), "123", "2 control plane machines"); stop != nil {
+		t.Errorf("expected the upgrade not to stop, got %v", stop)
+	}
+}
+
+func TestIsTimeBudgetExhausted(t *testing.T) {
+	err := &TimeBudgetExhaustedError{Budget: time.Hour, UpgradeID: "123", Remaining: "2 control plane machines"}
+	if !IsTimeBudgetExhausted(err) {
+		t.Error("expected the error to be a time budget exhaustion")
+	}
+	if !IsTimeBudgetExhausted(errors.Wrap(err, "error leveling control plane machines")) {
+		t.Error("expected a wrapped error to be a time budget exhaustion")
+	}
+	if IsTimeBudgetExhausted(errors.New("timed out waiting for the condition")) {
+		t.Error("expected another error not to be a time budget exhaustion")
+	}
+}
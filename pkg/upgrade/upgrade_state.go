@@ -0,0 +1,197 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of the upgrade state ConfigMap.
+const (
+	upgradeStateEtcdMembersKey = "etcdMembers"
+	upgradeStateNodesKey       = "nodes"
+)
+
+// upgradeState is what a control plane upgrade knew of the cluster before replacing any machine. It is persisted in a
+// ConfigMap on the management cluster so that a resumed upgrade, in a new process, still finds the old nodes and etcd
+// members of the machines whose nodes were already replaced.
+type upgradeState struct {
+	// etcdMembers maps node hostnames to the IDs of their etcd members.
+	etcdMembers map[string]string
+	// nodes maps provider IDs to snapshots of their nodes.
+	nodes map[string]*v1.Node
+}
+
+// upgradeStateConfigMapName returns the name of the ConfigMap holding the state of the upgrade upgradeID of the
+// cluster called clusterName.
+func upgradeStateConfigMapName(clusterName, upgradeID string) string {
+	return fmt.Sprintf("%s-upgrade-%s", clusterName, upgradeID)
+}
+
+// nodeSnapshot returns the parts of node the replacement of its machine uses: its name, labels, provider ID, taints,
+// kubelet config source, and addresses.
+func nodeSnapshot(node *v1.Node) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   node.Name,
+			Labels: node.Labels,
+		},
+		Spec: v1.NodeSpec{
+			ProviderID:   node.Spec.ProviderID,
+			Taints:       node.Spec.Taints,
+			ConfigSource: node.Spec.ConfigSource,
+		},
+		Status: v1.NodeStatus{
+			Addresses: node.Status.Addresses,
+		},
+	}
+}
+
+// encodeUpgradeState returns the ConfigMap data of state.
+func encodeUpgradeState(state *upgradeState) (map[string]string, error) {
+	etcdMembers, err := json.Marshal(state.etcdMembers)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding etcd members")
+	}
+
+	nodes := make(map[string]*v1.Node, len(state.nodes))
+	for providerID, node := range state.nodes {
+		nodes[providerID] = nodeSnapshot(node)
+	}
+	encodedNodes, err := json.Marshal(nodes)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding nodes")
+	}
+
+	return map[string]string{
+		upgradeStateEtcdMembersKey: string(etcdMembers),
+		upgradeStateNodesKey:       string(encodedNodes),
+	}, nil
+}
+
+// decodeUpgradeState returns the state in the ConfigMap data.
+func decodeUpgradeState(data map[string]string) (*upgradeState, error) {
+	state := &upgradeState{}
+	if err := json.Unmarshal([]byte(data[upgradeStateEtcdMembersKey]), &state.etcdMembers); err != nil {
+		return nil, errors.Wrap(err, "error decoding etcd members")
+	}
+	if err := json.Unmarshal([]byte(data[upgradeStateNodesKey]), &state.nodes); err != nil {
+		return nil, errors.Wrap(err, "error decoding nodes")
+	}
+	return state, nil
+}
+
+// mergeEtcdMembers adds to current the persisted hostnames whose etcd members are still in the cluster under another
+// name. Members no longer in the cluster were already removed, and are left out so they are not removed again.
+func mergeEtcdMembers(current, persisted map[string]string) map[string]string {
+	ids := sets.NewString()
+	merged := make(map[string]string, len(current))
+	for name, id := range current {
+		ids.Insert(id)
+		merged[name] = id
+	}
+	for name, id := range persisted {
+		if _, ok := merged[name]; !ok && ids.Has(id) {
+			merged[name] = id
+		}
+	}
+	return merged
+}
+
+// mergeNodes adds to current the persisted nodes of the provider IDs it lacks, such as the nodes of machines already
+// replaced.
+func mergeNodes(current, persisted map[string]*v1.Node) map[string]*v1.Node {
+	merged := make(map[string]*v1.Node, len(current))
+	for providerID, node := range current {
+		merged[providerID] = node
+	}
+	for providerID, node := range persisted {
+		if _, ok := merged[providerID]; !ok {
+			merged[providerID] = node
+		}
+	}
+	return merged
+}
+
+// restoreUpgradeState persists the etcd members and provider IDs to nodes maps the first time the upgrade replaces
+// machines, and merges the persisted maps into the current ones when the upgrade is resumed.
+func (u *ControlPlaneUpgrader) restoreUpgradeState() error {
+	key := ctrlclient.ObjectKey{Namespace: u.clusterNamespace, Name: upgradeStateConfigMapName(u.clusterName, u.upgradeID)}
+
+	cm := &v1.ConfigMap{}
+	err := u.managementClusterClient.Get(context.TODO(), key, cm)
+	if apierrors.IsNotFound(err) {
+		data, err := encodeUpgradeState(&upgradeState{etcdMembers: u.oldNodeToEtcdMember, nodes: u.providerIDsToNodes})
+		if err != nil {
+			return err
+		}
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Labels:    map[string]string{clusterv1.MachineClusterLabelName: u.clusterName},
+				Annotations: map[string]string{
+					AnnotationUpgradeID: u.upgradeID,
+				},
+			},
+			Data: data,
+		}
+		if u.clusterUID != "" {
+			// Deleting the cluster deletes the state of upgrades that never completed
+			cm.SetOwnerReferences([]metav1.OwnerReference{
+				{
+					APIVersion: clusterv1.GroupVersion.String(),
+					Kind:       "Cluster",
+					Name:       u.clusterName,
+					UID:        u.clusterUID,
+				},
+			})
+		}
+		u.log.Info("Saving upgrade state", "configmap", key.String())
+		if err := u.managementClusterClient.Create(context.TODO(), cm); err != nil {
+			return errors.Wrapf(err, "error saving upgrade state configmap %s", key)
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error getting upgrade state configmap %s", key)
+	}
+
+	state, err := decodeUpgradeState(cm.Data)
+	if err != nil {
+		return errors.Wrapf(err, "error reading upgrade state configmap %s", key)
+	}
+	u.log.Info("Restoring upgrade state", "configmap", key.String(), "etcd-members", len(state.etcdMembers), "nodes", len(state.nodes))
+	u.oldNodeToEtcdMember = mergeEtcdMembers(u.oldNodeToEtcdMember, state.etcdMembers)
+	u.providerIDsToNodes = mergeNodes(u.providerIDsToNodes, state.nodes)
+	u.record.event("Restored the upgrade state saved in %s", key)
+	return nil
+}
+
+// deleteUpgradeState deletes the upgrade state ConfigMap once the upgrade is verified, as no rerun needs it anymore.
+// Failing to delete it is only logged, since the Cluster owns it.
+func (u *ControlPlaneUpgrader) deleteUpgradeState() {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: u.clusterNamespace,
+			Name:      upgradeStateConfigMapName(u.clusterName, u.upgradeID),
+		},
+	}
+	err := u.managementClusterClient.Delete(context.TODO(), cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		u.log.Error(err, "Unable to delete upgrade state configmap", "configmap", cm.Namespace+"/"+cm.Name)
+		return
+	}
+	u.log.Info("Deleted upgrade state", "configmap", cm.Namespace+"/"+cm.Name)
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"testing"
+
+	logrtesting "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUpgradeStateRoundTrip(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cp-1",
+			Labels:      map[string]string{legacyControlPlaneNodeLabel: ""},
+			Annotations: map[string]string{"node.alpha.kubernetes.io/ttl": "0"},
+		},
+		Spec: v1.NodeSpec{
+			ProviderID: "aws:///us-east-1a/i-123",
+			Taints:     []v1.Taint{{Key: legacyControlPlaneNodeLabel, Effect: v1.TaintEffectNoSchedule}},
+		},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeHostName, Address: "ip-10-0-0-1"}},
+			NodeInfo:  v1.NodeSystemInfo{KubeletVersion: "v1.15.3"},
+		},
+	}
+
+	data, err := encodeUpgradeState(&upgradeState{
+		etcdMembers: map[string]string{"ip-10-0-0-1": "8e9e05c52164694d"},
+		nodes:       map[string]*v1.Node{"i-123": node},
+	})
+	require.NoError(t, err)
+
+	state, err := decodeUpgradeState(data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"ip-10-0-0-1": "8e9e05c52164694d"}, state.etcdMembers)
+	require.Contains(t, state.nodes, "i-123")
+	restored := state.nodes["i-123"]
+	assert.Equal(t, "cp-1", restored.Name)
+	assert.Equal(t, "ip-10-0-0-1", hostnameForNode(restored))
+	assert.True(t, hasControlPlaneTaint(restored))
+	assert.Empty(t, restored.Annotations, "only what replacing the machine uses is kept")
+	assert.Empty(t, restored.Status.NodeInfo.KubeletVersion)
+
+	_, err = decodeUpgradeState(map[string]string{upgradeStateEtcdMembersKey: "{", upgradeStateNodesKey: "{}"})
+	assert.Error(t, err)
+}
+
+func TestMergeEtcdMembers(t *testing.T) {
+	current := map[string]string{"cp-2": "b", "cp-1-renamed": "a"}
+	persisted := map[string]string{"cp-1": "a", "cp-2": "b", "cp-3": "c"}
+
+	assert.Equal(t, map[string]string{
+		"cp-1":         "a",
+		"cp-1-renamed": "a",
+		"cp-2":         "b",
+	}, mergeEtcdMembers(current, persisted), "cp-3 was already removed")
+}
+
+func TestMergeNodes(t *testing.T) {
+	current := map[string]*v1.Node{"i-2": {ObjectMeta: metav1.ObjectMeta{Name: "cp-2"}}}
+	persisted := map[string]*v1.Node{
+		"i-1": {ObjectMeta: metav1.ObjectMeta{Name: "cp-1"}},
+		"i-2": {ObjectMeta: metav1.ObjectMeta{Name: "cp-2-old"}},
+	}
+
+	merged := mergeNodes(current, persisted)
+	assert.Len(t, merged, 2)
+	assert.Equal(t, "cp-1", merged["i-1"].Name)
+	assert.Equal(t, "cp-2", merged["i-2"].Name, "current nodes are kept")
+}
+
+func TestUpgradeStateLifecycle(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, v1.AddToScheme(scheme))
+	u := &ControlPlaneUpgrader{
+		log:                     logrtesting.NullLogger{},
+		clusterNamespace:        "ns",
+		clusterName:             "cluster",
+		clusterUID:              "cluster-uid",
+		upgradeID:               "123",
+		managementClusterClient: fake.NewFakeClientWithScheme(scheme),
+		oldNodeToEtcdMember:     map[string]string{},
+		providerIDsToNodes:      map[string]*v1.Node{},
+	}
+	key := ctrlclient.ObjectKey{Namespace: "ns", Name: "cluster-upgrade-123"}
+
+	require.NoError(t, u.restoreUpgradeState())
+	cm := &v1.ConfigMap{}
+	require.NoError(t, u.managementClusterClient.Get(context.TODO(), key, cm))
+	assert.Equal(t, []metav1.OwnerReference{
+		{APIVersion: clusterv1.GroupVersion.String(), Kind: "Cluster", Name: "cluster", UID: "cluster-uid"},
+	}, cm.OwnerReferences)
+
+	u.deleteUpgradeState()
+	err := u.managementClusterClient.Get(context.TODO(), key, &v1.ConfigMap{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// Deleting it again, as when an upgrade resumed from verify completes, does nothing
+	u.deleteUpgradeState()
+}
@@ -0,0 +1,335 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// versionedControlPlaneComponents are the static pods whose image tag is the Kubernetes version.
+var versionedControlPlaneComponents = []string{"kube-apiserver", "kube-controller-manager", "kube-scheduler"}
+
+// Verifier checks that a cluster is fully and consistently at a Kubernetes version.
+type Verifier struct {
+	log                    logr.Logger
+	version                semver.Version
+	controlPlaneOnly       bool
+	targetRestConfig       *rest.Config
+	targetKubernetesClient kubernetes.Interface
+	// skipNodes are nodes that are expected to stay at their version, such as those of pinned machines.
+	skipNodes sets.String
+	// etcdCredentials authenticate etcdctl on clusters with etcd auth enabled.
+	etcdCredentials *etcdCredentials
+	// distroProfile leaves the kubelet configmap objects the distribution manages itself unchecked.
+	distroProfile distroProfile
+	// execForbidden checks etcd health through the API server, as etcdctl cannot be run without exec.
+	execForbidden bool
+}
+
+// CheckResult is the outcome of a single check.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// VerificationReport contains the results of all verification checks.
+type VerificationReport struct {
+	Version string        `json:"version"`
+	Results []CheckResult `json:"results"`
+}
+
+// NewVerifier returns a Verifier for the target cluster in config. If controlPlaneOnly is true, worker nodes are not
+// checked.
+func NewVerifier(log logr.Logger, config Config, controlPlaneOnly bool) (*Verifier, error) {
+	if config.KubernetesVersion == "" {
+		return nil, errors.New("kubernetes version is required")
+	}
+	version, err := semver.ParseTolerant(config.KubernetesVersion)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing kubernetes version %q", config.KubernetesVersion)
+	}
+
+	clients, err := newClusterClients(log, config)
+	if err != nil {
+		return nil, err
+	}
+	etcdCredentials, err := loadEtcdCredentials(clients.managementClusterClient, config.TargetCluster.Namespace, config.EtcdCredentialsSecret)
+	if err != nil {
+		return nil, err
+	}
+	distroProfile, err := parseDistroProfile(config.DistroProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verifier{
+		log:                    log,
+		version:                version,
+		controlPlaneOnly:       controlPlaneOnly,
+		targetRestConfig:       clients.targetRestConfig,
+		targetKubernetesClient: clients.targetKubernetesClient,
+		etcdCredentials:        etcdCredentials,
+		distroProfile:          distroProfile,
+	}, nil
+}
+
+// Passed returns true if all checks passed.
+func (r *VerificationReport) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes a human readable version of the report to w.
+func (r *VerificationReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Verifying cluster is at version %s\n", r.Version)
+	for _, result := range r.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		if result.Message == "" {
+			fmt.Fprintf(w, "[%s] %s\n", status, result.Name)
+			continue
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, result.Name, result.Message)
+	}
+}
+
+// Verify runs all verification checks. Checks that fail are reported in the returned report; an error is only returned
+// if the checks could not be run.
+func (v *Verifier) Verify() (*VerificationReport, error) {
+	report := &VerificationReport{Version: v.version.String()}
+
+	checks := []struct {
+		name  string
+		check func() ([]string, error)
+	}{
+		{name: "node kubelet versions", check: v.checkNodes},
+		{name: "control plane static pod versions", check: v.checkStaticPods},
+		{name: "kubeadm-config kubernetesVersion", check: v.checkKubeadmConfig},
+		{name: "kubelet configmap and rbac", check: v.checkKubeletConfig},
+		{name: "etcd health", check: v.checkEtcd},
+		{name: "control plane node labels", check: v.checkControlPlaneNodeRoles},
+	}
+
+	for _, c := range checks {
+		v.log.Info("Verifying", "check", c.name)
+		problems, err := c.check()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error verifying %s", c.name)
+		}
+		report.Results = append(report.Results, CheckResult{
+			Name:    c.name,
+			Passed:  len(problems) == 0,
+			Message: strings.Join(problems, "; "),
+		})
+	}
+
+	return report, nil
+}
+
+func (v *Verifier) checkNodes() ([]string, error) {
+	var nodes []v1.Node
+	if v.controlPlaneOnly {
+		var err error
+		nodes, err = listControlPlaneNodes(v.targetKubernetesClient)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		nodeList, err := v.targetKubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing nodes")
+		}
+		nodes = nodeList.Items
+	}
+
+	var problems []string
+	for _, node := range nodes {
+		if v.skipNodes.Has(node.Name) {
+			continue
+		}
+		if !versionMatches(node.Status.NodeInfo.KubeletVersion, v.version) {
+			problems = append(problems, fmt.Sprintf("node %s kubelet is at %s", node.Name, node.Status.NodeInfo.KubeletVersion))
+		}
+	}
+
+	return problems, nil
+}
+
+func (v *Verifier) checkStaticPods() ([]string, error) {
+	var problems []string
+
+	for _, component := range versionedControlPlaneComponents {
+		pods, err := v.targetKubernetesClient.CoreV1().Pods("kube-system").List(metav1.ListOptions{LabelSelector: "component=" + component})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing %s pods", component)
+		}
+		for _, pod := range pods.Items {
+			if v.skipNodes.Has(pod.Spec.NodeName) {
+				continue
+			}
+			for _, container := range pod.Spec.Containers {
+				tag := imageTag(container.Image)
+				if tag != "" && !versionMatches(tag, v.version) {
+					problems = append(problems, fmt.Sprintf("pod %s runs image %s", pod.Name, container.Image))
+				}
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+func (v *Verifier) checkKubeadmConfig() ([]string, error) {
+	cm, err := v.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(kubeadmConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return []string{fmt.Sprintf("configmap %s does not exist", kubeadmConfigMapName)}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "error getting kubeadm configmap from target cluster")
+	}
+
+	key, clusterConfig, err := findClusterConfiguration(cm)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return []string{fmt.Sprintf("configmap %s has no ClusterConfiguration", kubeadmConfigMapName)}, nil
+	}
+
+	version, _ := clusterConfig["kubernetesVersion"].(string)
+	if !versionMatches(version, v.version) {
+		return []string{fmt.Sprintf("kubeadm-config has kubernetesVersion %q", version)}, nil
+	}
+
+	return nil, nil
+}
+
+func (v *Verifier) checkKubeletConfig() ([]string, error) {
+	configMapName := kubeletConfigMapName(v.version)
+	roleName := kubeletConfigRoleName(v.version)
+
+	var problems []string
+
+	if !v.distroProfile.skipKubeletConfigMap {
+		_, err := v.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(configMapName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			problems = append(problems, fmt.Sprintf("configmap %s does not exist", configMapName))
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "error getting configmap %s", configMapName)
+		}
+	}
+	if v.distroProfile.skipKubeletRBAC {
+		return problems, nil
+	}
+
+	_, err := v.targetKubernetesClient.RbacV1().Roles("kube-system").Get(roleName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		problems = append(problems, fmt.Sprintf("role %s does not exist", roleName))
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting role %s", roleName)
+	}
+
+	_, err = v.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Get(roleName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		problems = append(problems, fmt.Sprintf("rolebinding %s does not exist", roleName))
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting rolebinding %s", roleName)
+	}
+
+	return problems, nil
+}
+
+func (v *Verifier) checkEtcd() ([]string, error) {
+	etcd := &ControlPlaneUpgrader{
+		log:                    v.log,
+		targetRestConfig:       v.targetRestConfig,
+		targetKubernetesClient: v.targetKubernetesClient,
+		etcdCredentials:        v.etcdCredentials,
+		// etcdctl cannot be run without exec
+		execForbidden: v.execForbidden || kubernetes2.ReadOnly(),
+	}
+	if err := etcd.detectExternalEtcd(); err != nil {
+		return nil, err
+	}
+
+	if err := etcd.etcdClusterHealthCheck(time.Minute * 1); err != nil {
+		return []string{err.Error()}, nil
+	}
+
+	return nil, nil
+}
+
+// imageTag returns the tag of image, or "" if it has none.
+func imageTag(image string) string {
+	if strings.Contains(image, "@") {
+		return ""
+	}
+	i := strings.LastIndex(image, ":")
+	if i == -1 || strings.Contains(image[i:], "/") {
+		return ""
+	}
+	return image[i+1:]
+}
+
+// versionMatches returns true if version parses to expected.
+func versionMatches(version string, expected semver.Version) bool {
+	v, err := semver.ParseTolerant(version)
+	if err != nil {
+		return false
+	}
+	return v.EQ(expected)
+}
+
+// verifier returns a Verifier of the control plane at the desired version, skipping the nodes of pinned machines.
+func (u *ControlPlaneUpgrader) verifier() *Verifier {
+	return &Verifier{
+		log:                    u.log,
+		version:                u.desiredVersion,
+		controlPlaneOnly:       true,
+		skipNodes:              u.pinnedNodes,
+		targetRestConfig:       u.targetRestConfig,
+		targetKubernetesClient: u.targetKubernetesClient,
+		etcdCredentials:        u.etcdCredentials,
+		distroProfile:          u.distroProfile,
+		execForbidden:          u.execForbidden,
+	}
+}
+
+// verify runs the control plane verification checks after an upgrade.
+func (u *ControlPlaneUpgrader) verify() error {
+	report, err := u.verifier().Verify()
+	if err != nil {
+		return err
+	}
+	u.record.verified(report)
+	if report.Passed() {
+		u.record.event("Verification of %s passed", u.desiredVersion)
+		return nil
+	}
+	u.record.event("Verification of %s failed", u.desiredVersion)
+
+	var b strings.Builder
+	report.Print(&b)
+	return errors.Errorf("upgrade verification failed:\n%s", b.String())
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestImageTag(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{image: "k8s.gcr.io/kube-apiserver:v1.15.3", expected: "v1.15.3"},
+		{image: "registry:5000/kube-apiserver:v1.15.3", expected: "v1.15.3"},
+		{image: "registry:5000/kube-apiserver", expected: ""},
+		{image: "kube-apiserver", expected: ""},
+		{image: "k8s.gcr.io/kube-apiserver@sha256:abcdef", expected: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.image, func(t *testing.T) {
+			if actual := imageTag(tc.image); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestVersionMatches(t *testing.T) {
+	expected := semver.MustParse("1.15.3")
+
+	if !versionMatches("v1.15.3", expected) {
+		t.Error("expected v1.15.3 to match")
+	}
+	if versionMatches("v1.15.2", expected) {
+		t.Error("expected v1.15.2 not to match")
+	}
+	if versionMatches("latest", expected) {
+		t.Error("expected latest not to match")
+	}
+}
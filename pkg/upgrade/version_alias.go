@@ -0,0 +1,145 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// VersionLatestPatch resolves to the newest patch release of the cluster's current minor version.
+	VersionLatestPatch = "latest-patch"
+	// VersionNextMinor resolves to the newest patch release of the minor version after the cluster's current one.
+	VersionNextMinor = "next-minor"
+
+	// defaultReleaseURL serves the newest patch release of each minor version at stable-<major>.<minor>.txt.
+	defaultReleaseURL = "https://dl.k8s.io/release"
+)
+
+// isVersionAlias returns true if version is one of the version aliases.
+func isVersionAlias(version string) bool {
+	return version == VersionLatestPatch || version == VersionNextMinor
+}
+
+// versionSource looks up the newest patch release of a minor version.
+type versionSource interface {
+	latestPatch(major, minor uint64) (semver.Version, error)
+}
+
+// versionManifest lists the Kubernetes versions available for upgrades.
+type versionManifest struct {
+	Versions []string `json:"versions"`
+}
+
+type manifestVersionSource struct {
+	versions []semver.Version
+}
+
+func (s *manifestVersionSource) latestPatch(major, minor uint64) (semver.Version, error) {
+	var latest semver.Version
+	found := false
+	for _, v := range s.versions {
+		if v.Major == major && v.Minor == minor && len(v.Pre) == 0 && (!found || v.GT(latest)) {
+			latest = v
+			found = true
+		}
+	}
+	if !found {
+		return semver.Version{}, errors.Errorf("version manifest has no release of v%d.%d", major, minor)
+	}
+	return latest, nil
+}
+
+type releaseVersionSource struct {
+	baseURL string
+}
+
+func (s *releaseVersionSource) latestPatch(major, minor uint64) (semver.Version, error) {
+	url := fmt.Sprintf("%s/stable-%d.%d.txt", s.baseURL, major, minor)
+	body, err := httpGet(url)
+	if err != nil {
+		return semver.Version{}, err
+	}
+
+	v, err := semver.ParseTolerant(strings.TrimSpace(string(body)))
+	if err != nil {
+		return semver.Version{}, errors.Wrapf(err, "error parsing version from %s", url)
+	}
+	return v, nil
+}
+
+// newVersionSource returns a source reading the version manifest at manifest, which may be a path or an http(s) URL,
+// or the Kubernetes release API if manifest is empty.
+func newVersionSource(manifest string) (versionSource, error) {
+	if manifest == "" {
+		return &releaseVersionSource{baseURL: defaultReleaseURL}, nil
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasPrefix(manifest, "http://") || strings.HasPrefix(manifest, "https://") {
+		data, err = httpGet(manifest)
+	} else {
+		data, err = ioutil.ReadFile(manifest)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading version manifest %s", manifest)
+	}
+
+	var m versionManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "error decoding version manifest %s", manifest)
+	}
+
+	source := &manifestVersionSource{}
+	for _, raw := range m.Versions {
+		v, err := semver.ParseTolerant(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid version %q in version manifest %s", raw, manifest)
+		}
+		source.versions = append(source.versions, v)
+	}
+	return source, nil
+}
+
+// resolveVersionAlias returns the version alias resolves to, given the cluster's current version.
+func resolveVersionAlias(alias string, current semver.Version, source versionSource) (semver.Version, error) {
+	switch alias {
+	case VersionLatestPatch:
+		return source.latestPatch(current.Major, current.Minor)
+	case VersionNextMinor:
+		return source.latestPatch(current.Major, current.Minor+1)
+	default:
+		return semver.Version{}, errors.Errorf("unknown version alias %q", alias)
+	}
+}
+
+func httpGet(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("error getting %s: %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", url)
+	}
+	return body, nil
+}
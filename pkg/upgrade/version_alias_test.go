@@ -0,0 +1,88 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveVersionAliasFromManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "version-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := filepath.Join(dir, "versions.yaml")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`versions:
+- v1.15.5
+- v1.16.2
+- v1.16.10
+- v1.16.11-rc.0
+- v1.17.0
+`), 0600))
+
+	source, err := newVersionSource(manifest)
+	require.NoError(t, err)
+
+	current := semver.MustParse("1.16.2")
+	tests := []struct {
+		alias    string
+		current  semver.Version
+		expected string
+		wantErr  bool
+	}{
+		{alias: VersionLatestPatch, current: current, expected: "1.16.10"},
+		{alias: VersionNextMinor, current: current, expected: "1.17.0"},
+		{alias: VersionNextMinor, current: semver.MustParse("1.17.0"), wantErr: true},
+		{alias: "latest", current: current, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s from %s", tc.alias, tc.current), func(t *testing.T) {
+			v, err := resolveVersionAlias(tc.alias, tc.current, source)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, v.String())
+		})
+	}
+}
+
+func TestResolveVersionAliasFromReleaseAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable-1.16.txt":
+			fmt.Fprintln(w, "v1.16.4")
+		case "/stable-1.17.txt":
+			fmt.Fprintln(w, "v1.17.1")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source := &releaseVersionSource{baseURL: server.URL}
+
+	v, err := resolveVersionAlias(VersionLatestPatch, semver.MustParse("1.16.1"), source)
+	require.NoError(t, err)
+	assert.Equal(t, "1.16.4", v.String())
+
+	v, err = resolveVersionAlias(VersionNextMinor, semver.MustParse("1.16.1"), source)
+	require.NoError(t, err)
+	assert.Equal(t, "1.17.1", v.String())
+
+	_, err = resolveVersionAlias(VersionNextMinor, semver.MustParse("1.17.1"), source)
+	assert.Error(t, err)
+}
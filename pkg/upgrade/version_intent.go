@@ -0,0 +1,190 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationDesiredKubernetesVersion records on a Cluster the Kubernetes version it was last upgraded towards, which
+// CheckVersionDrift compares its machines against.
+const AnnotationDesiredKubernetesVersion = annotationPrefix + "desired-kubernetes-version"
+
+// Statuses of a Cluster's versions against its desired version.
+const (
+	// VersionDriftCurrent is a Cluster whose machines are all at or past its desired version.
+	VersionDriftCurrent = "current"
+	// VersionDriftBehind is a Cluster with machines behind its desired version.
+	VersionDriftBehind = "behind"
+	// VersionDriftNoIntent is a Cluster without a desired version.
+	VersionDriftNoIntent = "no-intent"
+)
+
+// VersionDriftReport compares the versions of the Clusters in one or more management clusters with their desired
+// versions.
+type VersionDriftReport struct {
+	Clusters []ClusterVersionDrift `json:"clusters"`
+	// Failures lists the contexts whose Clusters could not be listed.
+	Failures []DiscoveryFailure `json:"failures,omitempty"`
+}
+
+// ClusterVersionDrift is the status of a Cluster's versions against its desired version.
+type ClusterVersionDrift struct {
+	Context              string   `json:"context"`
+	Namespace            string   `json:"namespace"`
+	Name                 string   `json:"name"`
+	DesiredVersion       string   `json:"desiredVersion,omitempty"`
+	ControlPlaneVersions []string `json:"controlPlaneVersions,omitempty"`
+	WorkerVersions       []string `json:"workerVersions,omitempty"`
+	Status               string   `json:"status"`
+	// Reasons explains why the Cluster is behind.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// desiredVersionToRecord returns the value of AnnotationDesiredKubernetesVersion once an upgrade to desired starts,
+// given its current value. The desired version only moves forward, so that holding machine deployments back does not
+// lower it, and an invalid value is replaced.
+func desiredVersionToRecord(current string, desired semver.Version) string {
+	if current != "" {
+		if v, err := semver.ParseTolerant(current); err == nil && v.GE(desired) {
+			return current
+		}
+	}
+	return "v" + desired.String()
+}
+
+// recordDesiredVersion sets AnnotationDesiredKubernetesVersion on the Cluster namespace/name to desired, unless it is
+// already at a newer version. Failing to do so is reported as a warning, as it does not affect the upgrade.
+func recordDesiredVersion(log logr.Logger, c ctrlclient.Client, warnings *warningCollector, namespace, name string, desired semver.Version) {
+	object := fmt.Sprintf("%s/%s", namespace, name)
+	cluster := &clusterv1.Cluster{}
+	if err := c.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: namespace, Name: name}, cluster); err != nil {
+		warnings.add(WarningDesiredVersionNotRecorded, object, "the desired version of cluster %s could not be recorded: %v", object, err)
+		return
+	}
+
+	current := cluster.Annotations[AnnotationDesiredKubernetesVersion]
+	value := desiredVersionToRecord(current, desired)
+	if value == current {
+		return
+	}
+
+	log.Info("Recording the desired version on the cluster", "version", value)
+	patch := ctrlclient.MergeFrom(cluster.DeepCopy())
+	if cluster.Annotations == nil {
+		cluster.Annotations = make(map[string]string)
+	}
+	cluster.Annotations[AnnotationDesiredKubernetesVersion] = value
+	if err := c.Patch(context.TODO(), cluster, patch); err != nil {
+		warnings.add(WarningDesiredVersionNotRecorded, object, "the desired version of cluster %s could not be recorded: %v", object, err)
+	}
+}
+
+// CheckVersionDrift lists the Clusters in the management cluster contexts selected by config, as Discover does, and
+// compares the versions of their machines with their desired versions.
+func CheckVersionDrift(log logr.Logger, config DiscoveryConfig) (*VersionDriftReport, error) {
+	discovered, err := Discover(log, config)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VersionDriftReport{Failures: discovered.Failures}
+	for _, c := range discovered.Clusters {
+		report.Clusters = append(report.Clusters, versionDrift(c))
+	}
+	return report, nil
+}
+
+// versionDrift compares the versions of the machines of c with its desired version. Machines without a version or
+// with an invalid one count as behind.
+func versionDrift(c DiscoveredCluster) ClusterVersionDrift {
+	drift := ClusterVersionDrift{
+		Context:              c.Context,
+		Namespace:            c.Namespace,
+		Name:                 c.Name,
+		DesiredVersion:       c.DesiredVersion,
+		ControlPlaneVersions: c.ControlPlaneVersions,
+		WorkerVersions:       c.WorkerVersions,
+	}
+	if c.DesiredVersion == "" {
+		drift.Status = VersionDriftNoIntent
+		return drift
+	}
+	desired, err := semver.ParseTolerant(c.DesiredVersion)
+	if err != nil {
+		drift.Status = VersionDriftBehind
+		drift.Reasons = append(drift.Reasons, fmt.Sprintf("invalid desired version %q", c.DesiredVersion))
+		return drift
+	}
+
+	check := func(kind string, versions []string) {
+		for _, version := range versions {
+			if version == "" {
+				drift.Reasons = append(drift.Reasons, fmt.Sprintf("%s machines without a version", kind))
+				continue
+			}
+			v, err := semver.ParseTolerant(version)
+			switch {
+			case err != nil:
+				drift.Reasons = append(drift.Reasons, fmt.Sprintf("%s machines at invalid version %q", kind, version))
+			case v.LT(desired):
+				drift.Reasons = append(drift.Reasons, fmt.Sprintf("%s machines at %s", kind, version))
+			}
+		}
+	}
+	check("control plane", c.ControlPlaneVersions)
+	check("worker", c.WorkerVersions)
+
+	drift.Status = VersionDriftCurrent
+	if len(drift.Reasons) > 0 {
+		drift.Status = VersionDriftBehind
+	}
+	return drift
+}
+
+// Behind returns the number of Clusters behind their desired version.
+func (r *VersionDriftReport) Behind() int {
+	behind := 0
+	for _, c := range r.Clusters {
+		if c.Status == VersionDriftBehind {
+			behind++
+		}
+	}
+	return behind
+}
+
+// Print writes a human readable version of the report to w.
+func (r *VersionDriftReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTEXT\tNAMESPACE\tNAME\tDESIRED\tCONTROL PLANE\tWORKERS\tSTATUS")
+	for _, c := range r.Clusters {
+		status := c.Status
+		if len(c.Reasons) > 0 {
+			status += ": " + strings.Join(c.Reasons, "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.Context,
+			c.Namespace,
+			c.Name,
+			c.DesiredVersion,
+			strings.Join(c.ControlPlaneVersions, ", "),
+			strings.Join(c.WorkerVersions, ", "),
+			status,
+		)
+	}
+	tw.Flush()
+
+	for _, f := range r.Failures {
+		fmt.Fprintf(w, "context %s: %s\n", f.Context, f.Error)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDesiredVersionToRecord(t *testing.T) {
+	desired := semver.MustParse("1.16.3")
+
+	assert.Equal(t, "v1.16.3", desiredVersionToRecord("", desired))
+	assert.Equal(t, "v1.16.3", desiredVersionToRecord("v1.15.9", desired))
+	assert.Equal(t, "v1.16.3", desiredVersionToRecord("latest", desired))
+	// The desired version does not go back
+	assert.Equal(t, "v1.16.3", desiredVersionToRecord("v1.16.3", desired))
+	assert.Equal(t, "1.17.0", desiredVersionToRecord("1.17.0", desired))
+}
+
+func TestVersionDrift(t *testing.T) {
+	cluster := func(desired string, controlPlane, workers []string) DiscoveredCluster {
+		return DiscoveredCluster{
+			Context:              "mgmt",
+			Namespace:            "ns",
+			Name:                 "prod",
+			DesiredVersion:       desired,
+			ControlPlaneVersions: controlPlane,
+			WorkerVersions:       workers,
+		}
+	}
+
+	testcases := []struct {
+		name    string
+		cluster DiscoveredCluster
+		status  string
+		reasons []string
+	}{
+		{
+			name:    "no intent",
+			cluster: cluster("", []string{"v1.15.3"}, nil),
+			status:  VersionDriftNoIntent,
+		},
+		{
+			name:    "current",
+			cluster: cluster("v1.16.3", []string{"v1.16.3"}, []string{"1.16.3", "v1.17.0"}),
+			status:  VersionDriftCurrent,
+		},
+		{
+			name:    "behind",
+			cluster: cluster("v1.16.3", []string{"v1.16.3"}, []string{"v1.15.3", "v1.16.3"}),
+			status:  VersionDriftBehind,
+			reasons: []string{"worker machines at v1.15.3"},
+		},
+		{
+			name:    "unknown versions",
+			cluster: cluster("v1.16.3", []string{""}, []string{"latest"}),
+			status:  VersionDriftBehind,
+			reasons: []string{"control plane machines without a version", `worker machines at invalid version "latest"`},
+		},
+		{
+			name:    "invalid intent",
+			cluster: cluster("next", []string{"v1.16.3"}, nil),
+			status:  VersionDriftBehind,
+			reasons: []string{`invalid desired version "next"`},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			drift := versionDrift(tc.cluster)
+			assert.Equal(t, tc.status, drift.Status)
+			assert.Equal(t, tc.reasons, drift.Reasons)
+		})
+	}
+
+	report := &VersionDriftReport{Clusters: []ClusterVersionDrift{
+		versionDrift(testcases[1].cluster),
+		versionDrift(testcases[2].cluster),
+		versionDrift(testcases[3].cluster),
+	}}
+	assert.Equal(t, 2, report.Behind())
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+)
+
+// Reasons for warnings.
+const (
+	WarningMachineWithoutProviderID    = "MachineWithoutProviderID"
+	WarningUpgradeIDNotStored          = "UpgradeIDNotStored"
+	WarningUpgradeIDMismatch           = "UpgradeIDMismatch"
+	WarningEtcdMemberAbsent            = "EtcdMemberAbsent"
+	WarningInvalidNodeProviderID       = "InvalidNodeProviderID"
+	WarningKubeadmConfigMapSkipped     = "KubeadmConfigMapSkipped"
+	WarningEmptyBatch                  = "EmptyBatch"
+	WarningNodeRuntime                 = "NodeRuntime"
+	WarningMachinePinned               = "MachinePinned"
+	WarningInstanceLeaked              = "InstanceLeaked"
+	WarningEgressSelector              = "EgressSelector"
+	WarningConcurrentOperation         = "ConcurrentOperation"
+	WarningMixedControlPlaneVersions   = "MixedControlPlaneVersions"
+	WarningEtcdSpace                   = "EtcdSpace"
+	WarningKubeletConfigSource         = "KubeletConfigSource"
+	WarningUnusedVersionOverride       = "UnusedVersionOverride"
+	WarningProviderCompatibility       = "ProviderCompatibility"
+	WarningDualStackFeatureGate        = "DualStackFeatureGate"
+	WarningStaticPodManifest           = "StaticPodManifest"
+	WarningUnreschedulablePod          = "UnreschedulablePod"
+	WarningInitConfigurationDropped    = "InitConfigurationDropped"
+	WarningInsufficientCapacity        = "InsufficientCapacity"
+	WarningDesiredVersionNotRecorded   = "DesiredVersionNotRecorded"
+	WarningEtcdDegraded                = "EtcdDegraded"
+	WarningEtcdMemberNotRemoved        = "EtcdMemberNotRemoved"
+	WarningInfrastructureSchema        = "InfrastructureSchema"
+	WarningNodeNotUncordoned           = "NodeNotUncordoned"
+	WarningKubeadmConfigMapNotReverted = "KubeadmConfigMapNotReverted"
+	WarningBootstrapObjectLingering    = "BootstrapObjectLingering"
+	WarningConformanceFailed           = "ConformanceFailed"
+)
+
+// Warning is a non-fatal finding that did not stop the upgrade but should be reviewed by the operator.
+type Warning struct {
+	Reason  string `json:"reason"`
+	Object  string `json:"object,omitempty"`
+	Message string `json:"message"`
+}
+
+// warningCollector accumulates warnings in the order they are first found.
+type warningCollector struct {
+	log      logr.Logger
+	warnings []Warning
+	// events, if not nil, receives the warnings as they are found.
+	events *eventStream
+}
+
+func newWarningCollector(log logr.Logger) *warningCollector {
+	return &warningCollector{log: log}
+}
+
+// add records a warning and logs it. Warnings identical to one already recorded, for example from polling, are
+// ignored. A nil collector, as used by helpers that borrow an upgrader's clients, discards warnings.
+func (c *warningCollector) add(reason, object, format string, args ...interface{}) {
+	if c == nil {
+		return
+	}
+
+	w := Warning{
+		Reason:  reason,
+		Object:  object,
+		Message: fmt.Sprintf(format, args...),
+	}
+	for _, existing := range c.warnings {
+		if existing == w {
+			return
+		}
+	}
+
+	c.log.Info("Warning: "+w.Message, "reason", w.Reason, "object", w.Object)
+	c.warnings = append(c.warnings, w)
+	c.events.warning(w)
+}
+
+// list returns a copy of the recorded warnings.
+func (c *warningCollector) list() []Warning {
+	if c == nil {
+		return nil
+	}
+
+	ret := make([]Warning, len(c.warnings))
+	copy(ret, c.warnings)
+	return ret
+}
+
+// PrintWarnings writes a human readable list of warnings to w. Nothing is written if there are none.
+func PrintWarnings(w io.Writer, warnings []Warning) {
+	if len(warnings) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Warnings (%d):\n", len(warnings))
+	for _, warning := range warnings {
+		if warning.Object == "" {
+			fmt.Fprintf(w, "  - [%s] %s\n", warning.Reason, warning.Message)
+			continue
+		}
+		fmt.Fprintf(w, "  - [%s] %s: %s\n", warning.Reason, warning.Object, warning.Message)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+)
+
+func TestWarningCollector(t *testing.T) {
+	c := newWarningCollector(logging.NewLogrusLoggerAdapter(logrus.New()))
+
+	c.add(WarningInvalidNodeProviderID, "node-a", "unable to parse provider id %q", "bogus")
+	c.add(WarningInvalidNodeProviderID, "node-a", "unable to parse provider id %q", "bogus")
+	c.add(WarningEmptyBatch, "", "machine deployment batch %d does not select any machine deployments", 2)
+
+	warnings := c.list()
+	assert.Equal(t, []Warning{
+		{Reason: WarningInvalidNodeProviderID, Object: "node-a", Message: `unable to parse provider id "bogus"`},
+		{Reason: WarningEmptyBatch, Message: "machine deployment batch 2 does not select any machine deployments"},
+	}, warnings)
+
+	var b bytes.Buffer
+	PrintWarnings(&b, warnings)
+	assert.Equal(t, `Warnings (2):
+  - [InvalidNodeProviderID] node-a: unable to parse provider id "bogus"
+  - [EmptyBatch] machine deployment batch 2 does not select any machine deployments
+`, b.String())
+
+	var nilCollector *warningCollector
+	nilCollector.add(WarningEmptyBatch, "", "ignored")
+	assert.Empty(t, nilCollector.list())
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newPlanCommand() *cobra.Command {
+	var output string
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Shows the current versions of a cluster and the commands that would upgrade it to a Kubernetes version.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return planUpgrade(config, output)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	cmd.Flags().StringVar(
+		&config.KubernetesVersion,
+		"kubernetes-version",
+		"",
+		"Desired kubernetes version to upgrade to, or latest-patch or next-minor (required)",
+	)
+	if err := cmd.MarkFlagRequired("kubernetes-version"); err != nil {
+		fmt.Printf("Unable to mark kubernetes-version as a required flag: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmd.Flags().StringVar(
+		&config.VersionManifest,
+		"version-manifest",
+		"",
+		"Path or URL of a version manifest used to resolve version aliases and intermediate versions, defaulting to the Kubernetes release API (optional)",
+	)
+
+	cmd.Flags().BoolVar(
+		&config.WaitForQuiescence,
+		"wait-for-quiescence",
+		false,
+		"Include waiting for quiescence before each control plane machine replacement in the estimated duration (optional)",
+	)
+
+	cmd.Flags().BoolVar(
+		&config.SkipEtcdMemberVerification,
+		"skip-etcd-member-verification",
+		false,
+		"Leave waiting for etcd members out of the estimated duration (optional)",
+	)
+
+	cmd.Flags().BoolVar(
+		&config.VerifyDeprovisioning,
+		"verify-deprovisioning",
+		false,
+		"Include waiting for deprovisioning after each control plane machine replacement in the estimated duration (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.BootstrapCleanup,
+		"bootstrap-cleanup",
+		"",
+		"Include waiting for bootstrap object cleanup after each control plane machine replacement in the estimated duration - [wait | delete] (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.DistroProfile,
+		"distro-profile",
+		upgrade.DistroProfileVanilla,
+		"Kubernetes distribution of the target cluster, leaving the kubelet configmap objects it manages itself out of the planned creations - [vanilla | eksa | managed] (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.KubeletConfigFile,
+		"kubelet-config-file",
+		"",
+		"KubeletConfiguration file the last control plane step writes to its kubelet configmap, listed in the planned creations if it replaces an existing configmap's content (optional)",
+	)
+
+	cmd.Flags().StringVarP(
+		&output,
+		"output",
+		"o",
+		textOutput,
+		"Output format - [text | json] (optional)",
+	)
+
+	return cmd
+}
+
+func planUpgrade(config upgrade.Config, output string) error {
+	if output != textOutput && output != jsonOutput {
+		return errors.Errorf("invalid output format %q, must be one of %v", output, []string{textOutput, jsonOutput})
+	}
+
+	// Planning changes nothing, the upgrade ID is only required to build the upgrader
+	config.UpgradeID = fmt.Sprintf("%d", time.Now().Unix())
+
+	// Keep stdout for the plan so json output can be piped
+	upgrader, err := upgrade.NewControlPlaneUpgrader(newLoggerTo(os.Stderr), config)
+	if err != nil {
+		return err
+	}
+
+	plan, err := upgrader.Plan()
+	if err != nil {
+		return err
+	}
+
+	if output == jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(plan))
+	}
+
+	plan.Print(os.Stdout, os.Args[0])
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+// readOnlyAnnotation marks the commands that run with --read-only, as they do not change any cluster.
+const readOnlyAnnotation = "read-only"
+
+// allowReadOnly marks cmd as running with --read-only.
+func allowReadOnly(cmd *cobra.Command) *cobra.Command {
+	if cmd.Annotations == nil {
+		cmd.Annotations = make(map[string]string)
+	}
+	cmd.Annotations[readOnlyAnnotation] = "true"
+	return cmd
+}
+
+// enforceReadOnly refuses to run cmd with --read-only unless it is marked by allowReadOnly, and otherwise makes its
+// clients refuse any request that could change a cluster.
+func enforceReadOnly(cmd *cobra.Command, readOnly bool) error {
+	if !readOnly {
+		return nil
+	}
+	if cmd.Annotations[readOnlyAnnotation] != "true" {
+		return errors.Errorf("%s changes clusters, which --read-only refuses: plan, verify, diagnose, discover, check-drift and the upgrade prechecks run read-only", cmd.CommandPath())
+	}
+	upgrade.EnableReadOnly()
+	return nil
+}
+
+// precheckCluster runs the prechecks of a control plane upgrade, without starting it, and prints their report. It
+// returns an error if the upgrade would refuse to start.
+func precheckCluster(scope, output string, config upgrade.Config) error {
+	if output != textOutput && output != jsonOutput {
+		return errors.Errorf("invalid output format %q, must be one of %v", output, []string{textOutput, jsonOutput})
+	}
+	if scope != controlPlaneScope {
+		return errors.Errorf("only the prechecks of the %s scope run with --read-only", controlPlaneScope)
+	}
+
+	// Keep stdout for the report so json output can be piped
+	upgrader, err := upgrade.NewControlPlaneUpgrader(newLoggerTo(os.Stderr), config)
+	if err != nil {
+		return err
+	}
+
+	report, err := upgrader.Precheck(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if output == jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	if !report.Eligible() {
+		return errors.New("the cluster failed the prechecks")
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newRecreateMachineCommand() *cobra.Command {
+	var machine string
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "recreate-machine",
+		Short: "Replaces a control plane Machine with a new one at the same version, as upgrades replace Machines.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return recreateMachine(config, machine)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	cmd.Flags().StringVar(
+		&machine,
+		"machine",
+		"",
+		"Name of the control plane machine to recreate, in the cluster namespace (required)",
+	)
+	if err := cmd.MarkFlagRequired("machine"); err != nil {
+		fmt.Printf("Unable to mark machine as a required flag: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmd.Flags().StringVar(
+		&config.UpgradeID,
+		"upgrade-id",
+		"",
+		"Unique identifier used to resume a partial replacement (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.EtcdCredentialsSecret,
+		"etcd-credentials-secret",
+		"",
+		"Secret in the cluster namespace with the username and password etcdctl authenticates with, for clusters with etcd auth enabled (optional)",
+	)
+
+	cmd.Flags().BoolVar(
+		&config.AllowSelfHosted,
+		"allow-self-hosted",
+		false,
+		"Allow recreating a machine of a cluster that is its own management cluster (optional)",
+	)
+
+	return cmd
+}
+
+func recreateMachine(config upgrade.Config, machine string) error {
+	log := newLogger()
+	logging.ToggleDebugOnSignal(log)
+
+	recreator, err := upgrade.NewMachineRecreator(log, config)
+	if err != nil {
+		return err
+	}
+
+	recreateErr := recreator.Recreate(machine)
+	upgrade.PrintWarnings(os.Stdout, recreator.Warnings())
+
+	return recreateErr
+}
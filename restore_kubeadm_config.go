@@ -0,0 +1,41 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newRestoreKubeadmConfigCommand() *cobra.Command {
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "restore-kubeadm-config",
+		Short: "Restores the kubeadm-config ConfigMap to its version before an abandoned upgrade.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return restoreKubeadmConfig(config)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	cmd.Flags().StringVar(
+		&config.UpgradeID,
+		"upgrade-id",
+		"",
+		"Only restore the snapshot taken by this upgrade (optional)",
+	)
+
+	return cmd
+}
+
+func restoreKubeadmConfig(config upgrade.Config) error {
+	restorer, err := upgrade.NewKubeadmConfigRestorer(newLogger(), config)
+	if err != nil {
+		return err
+	}
+	return restorer.Restore()
+}
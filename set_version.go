@@ -0,0 +1,94 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newSetVersionCommand() *cobra.Command {
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "set-version",
+		Short: "Sets the version and image of MachineDeployment templates, leaving Cluster API to roll out their Machines.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return setVersion(config)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	cmd.Flags().StringVar(
+		&config.KubernetesVersion,
+		"kubernetes-version",
+		"",
+		"Desired kubernetes version, or latest-patch (required)",
+	)
+	if err := cmd.MarkFlagRequired("kubernetes-version"); err != nil {
+		fmt.Printf("Unable to mark kubernetes-version as a required flag: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmd.Flags().StringVar(
+		&config.MachineUpdates.Image.ID,
+		"image-id",
+		"",
+		"The provider-specific image identifier to use when booting a machine (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.MachineUpdates.Image.Field,
+		"image-field",
+		"",
+		"The image identifier field in provider manifests (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.VersionManifest,
+		"version-manifest",
+		"",
+		"Path or URL of a version manifest used to resolve latest-patch, defaulting to the Kubernetes release API (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.MachineDeployment.Name,
+		"machine-deployment-name",
+		"",
+		"Name of a single machine deployment to update",
+	)
+
+	cmd.Flags().StringVar(
+		&config.MachineDeployment.LabelSelector,
+		"machine-deployment-selector",
+		"",
+		"Label selector used to find machine deployments to update",
+	)
+
+	cmd.Flags().StringSliceVar(
+		&config.MachineDeployment.Names,
+		"machine-deployment-names",
+		nil,
+		"Names of machine deployments to update",
+	)
+
+	return cmd
+}
+
+func setVersion(config upgrade.Config) error {
+	upgrader, err := upgrade.NewMachineDeploymentUpgrader(newLogger(), config)
+	if err != nil {
+		return err
+	}
+
+	setErr := upgrader.SetVersion()
+	upgrade.PrintWarnings(os.Stdout, upgrader.Warnings())
+
+	return setErr
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
+)
+
+func newVerifyCommand() *cobra.Command {
+	var controlPlaneOnly bool
+	config := upgrade.Config{}
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verifies that a cluster is fully and consistently at a Kubernetes version.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return verifyCluster(config, controlPlaneOnly)
+		},
+		SilenceUsage: true,
+	}
+
+	addTargetClusterFlags(cmd, &config)
+
+	cmd.Flags().StringVar(
+		&config.KubernetesVersion,
+		"kubernetes-version",
+		"",
+		"The kubernetes version the cluster is expected to be at (required)",
+	)
+	if err := cmd.MarkFlagRequired("kubernetes-version"); err != nil {
+		fmt.Printf("Unable to mark kubernetes-version as a required flag: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmd.Flags().StringVar(
+		&config.EtcdCredentialsSecret,
+		"etcd-credentials-secret",
+		"",
+		"Secret in the cluster namespace with the username and password etcdctl authenticates with, for clusters with etcd auth enabled (optional)",
+	)
+
+	cmd.Flags().StringVar(
+		&config.DistroProfile,
+		"distro-profile",
+		upgrade.DistroProfileVanilla,
+		"Kubernetes distribution of the cluster, leaving the kubelet configmap objects it manages itself unchecked - [vanilla | eksa | managed] (optional)",
+	)
+
+	cmd.Flags().BoolVar(
+		&controlPlaneOnly,
+		"control-plane-only",
+		false,
+		"Only verify control plane nodes (optional)",
+	)
+
+	return cmd
+}
+
+func verifyCluster(config upgrade.Config, controlPlaneOnly bool) error {
+	verifier, err := upgrade.NewVerifier(newLogger(), config, controlPlaneOnly)
+	if err != nil {
+		return err
+	}
+
+	report, err := verifier.Verify()
+	if err != nil {
+		return err
+	}
+
+	report.Print(os.Stdout)
+
+	if !report.Passed() {
+		return errors.New("verification failed")
+	}
+
+	return nil
+}